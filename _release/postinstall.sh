@@ -19,3 +19,9 @@ systemctl enable rpi-reboot.service
 
 systemctl enable tc2-hat-comms.service
 systemctl restart tc2-hat-comms.service
+
+systemctl enable tc2-hat-rp2040-monitor.service
+systemctl restart tc2-hat-rp2040-monitor.service
+
+systemctl enable tc2-hat-audit.timer
+systemctl start tc2-hat-audit.timer
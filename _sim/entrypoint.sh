@@ -0,0 +1,16 @@
+#!/bin/bash
+# Starts dbus and the hat services with the i2c service using the simulated devices.
+# Expose the system bus to other containers by mounting /run/dbus.
+set -e
+
+dbus-daemon --system --fork
+
+tc2-hat-i2c sim $SIM_ARGS &
+sleep 1
+tc2-hat-rtc &
+tc2-hat-attiny &
+tc2-hat-temp &
+
+# Exit if any of the services stop so the container can be restarted.
+wait -n
+exit 1
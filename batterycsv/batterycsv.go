@@ -0,0 +1,224 @@
+// Package batterycsv is the layout of battery-readings.csv, written by tc2-hat-attiny and read
+// back to learn from the readings. The columns have changed over time:
+//
+//	1  time, hv, lv, rtc
+//	2  time, hv, lv, rtc, flags
+//
+// Files start with a header giving the schema version and the columns, so the layout can be
+// changed again without guessing:
+//
+//	# battery-readings schema 2: time, hv, lv, rtc, flags
+//
+// Older files have no header, or a plain "time, hv, lv, rtc" line from a spreadsheet, so
+// without one the layout of each line is taken from the number of fields. Lines can be from
+// more than one layout when the service was updated part way through a file.
+package batterycsv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+)
+
+// Version is the current schema version.
+const Version = 2
+
+const headerPrefix = "# battery-readings schema "
+
+// columns are the columns in each schema version.
+var columns = map[int][]string{
+	1: {"time", "hv", "lv", "rtc"},
+	2: {"time", "hv", "lv", "rtc", "flags"},
+}
+
+// Header returns the header line for the current schema.
+func Header() string {
+	return fmt.Sprintf("%s%d: %s", headerPrefix, Version, strings.Join(columns[Version], ", "))
+}
+
+// Row is one battery reading.
+type Row struct {
+	Time  time.Time
+	HV    float32
+	LV    float32
+	RTC   float32
+	Flags int // The quality flags of the reading, 0 for readings from before they were added.
+}
+
+// String formats the row as a line in the current schema, with an RFC3339 timestamp.
+func (r Row) String() string {
+	return r.Format(false)
+}
+
+// Format formats the row as a line in the current schema, with the timestamp in the legacy
+// local time format if legacyTime is true.
+func (r Row) Format(legacyTime bool) string {
+	return fmt.Sprintf("%s, %.2f, %.2f, %.2f, %d", csvtime.Format(r.Time, legacyTime), r.HV, r.LV, r.RTC, r.Flags)
+}
+
+// Parser parses the lines of a file in order, following the layout from the header.
+type Parser struct {
+	version int      // From the header, 0 if there wasn't one.
+	columns []string // From the header, nil if there wasn't one.
+	oldest  int      // Oldest schema version of the lines parsed.
+}
+
+// Parse parses a line, returning false without an error for a header or blank line.
+func (p *Parser) Parse(line string) (Row, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return Row{}, false, nil
+	}
+	if strings.HasPrefix(line, "#") {
+		return Row{}, false, p.parseHeader(line)
+	}
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if fields[0] == "time" {
+		p.columns = fields
+		return Row{}, false, nil
+	}
+	cols, version := p.columns, p.version
+	if cols == nil || len(cols) != len(fields) {
+		if version = versionWithFields(len(fields)); version == 0 {
+			return Row{}, false, fmt.Errorf("expected 4 or 5 fields, got %d", len(fields))
+		}
+		cols = columns[version]
+	} else if version == 0 {
+		version = versionWithFields(len(cols))
+	}
+	if version != 0 && (p.oldest == 0 || version < p.oldest) {
+		p.oldest = version
+	}
+
+	row := Row{}
+	for i, col := range cols {
+		if col == "time" {
+			t, err := csvtime.Parse(fields[i])
+			if err != nil {
+				return Row{}, false, err
+			}
+			row.Time = t
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[i], 32)
+		if err != nil {
+			return Row{}, false, fmt.Errorf("invalid %s: %v", col, err)
+		}
+		switch col {
+		case "hv":
+			row.HV = float32(v)
+		case "lv":
+			row.LV = float32(v)
+		case "rtc":
+			row.RTC = float32(v)
+		case "flags":
+			row.Flags = int(v)
+		}
+		// Columns from a newer schema are ignored.
+	}
+	if row.Time.IsZero() {
+		return Row{}, false, fmt.Errorf("no time column")
+	}
+	return row, true, nil
+}
+
+func (p *Parser) parseHeader(line string) error {
+	rest, ok := strings.CutPrefix(line, headerPrefix)
+	if !ok {
+		// Some other comment.
+		return nil
+	}
+	versionStr, cols, ok := strings.Cut(rest, ":")
+	version, err := strconv.Atoi(strings.TrimSpace(versionStr))
+	if !ok || err != nil || version < 1 {
+		return fmt.Errorf("invalid header '%s'", line)
+	}
+	p.version = version
+	p.columns = nil
+	for _, col := range strings.Split(cols, ",") {
+		p.columns = append(p.columns, strings.TrimSpace(col))
+	}
+	return nil
+}
+
+// versionWithFields returns the schema version with the number of fields, 0 if there isn't one.
+func versionWithFields(n int) int {
+	for version, cols := range columns {
+		if len(cols) == n {
+			return version
+		}
+	}
+	return 0
+}
+
+// Read parses all the lines in the data, skipping ones that can't be parsed such as one cut
+// short by losing power. Returns the rows and the number of lines skipped.
+func Read(data []byte) ([]Row, int) {
+	rows := []Row{}
+	bad := 0
+	p := &Parser{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		row, ok, err := p.Parse(scanner.Text())
+		if err != nil {
+			bad++
+		} else if ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows, bad
+}
+
+// Migrate rewrites the data in the current schema with the header. Lines that can't be parsed
+// are kept as they are, so nothing is lost. Returns the migrated data, the oldest schema
+// version in the data, and whether it needed migrating.
+func Migrate(data []byte) ([]byte, int, bool) {
+	out := &bytes.Buffer{}
+	out.WriteString(Header() + "\n")
+	p := &Parser{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	first := true
+	changed := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			first = false
+			if strings.TrimSpace(line) != Header() {
+				changed = true
+			}
+		}
+		row, ok, err := p.Parse(line)
+		switch {
+		case err != nil:
+			out.WriteString(line + "\n")
+		case ok:
+			// Keep the timestamps in the same format as the file.
+			timeStr, _, _ := strings.Cut(line, ",")
+			if s := row.Format(csvtime.IsLegacy(strings.TrimSpace(timeStr))); s != strings.TrimSpace(line) {
+				changed = true
+				line = s
+			}
+			out.WriteString(line + "\n")
+		case strings.TrimSpace(line) != Header():
+			// Old headers are dropped.
+			changed = true
+		}
+	}
+	oldest := p.oldest
+	if oldest == 0 {
+		oldest = Version
+	}
+	if first {
+		// An empty file is left to be started with the header when it is written.
+		changed = false
+	}
+	return out.Bytes(), oldest, changed
+}
@@ -0,0 +1,65 @@
+package batterycsv
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	p := &Parser{}
+	_, _, err := p.Parse("2024-05-01 10:00:00, 12.40, 0.00")
+	assert.Error(t, err)
+	_, _, err = p.Parse("not a time, 0.00, 12.40, 3.00")
+	assert.Error(t, err)
+	row, ok, err := p.Parse("2024-05-01 10:00:00, 0.00, 12.40, 3.00, 2")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float32(12.40), row.LV)
+	assert.Equal(t, 2, row.Flags)
+
+	// Columns are taken from the header, ones from a newer schema are ignored.
+	p = &Parser{}
+	_, ok, err = p.Parse("# battery-readings schema 3: time, lv, hv, rtc, flags, temp")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	row, ok, err = p.Parse("2024-05-01T10:00:00+12:00, 12.40, 0.00, 3.00, 0, 21.5")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float32(12.40), row.LV)
+	assert.Equal(t, time.Date(2024, 4, 30, 22, 0, 0, 0, time.UTC), row.Time.UTC())
+}
+
+func TestMigrate(t *testing.T) {
+	old := strings.Join([]string{
+		"time, hv, lv, rtc",
+		"2024-05-01 10:00:00, 0.00, 12.40, 3.00",
+		"2024-05-01 10:02:00, 0.00, 12.3", // Cut short.
+		"2024-05-01 10:04:00, 0.00, 12.39, 3.00, 2",
+	}, "\n")
+	migrated, fromVersion, changed := Migrate([]byte(old))
+	assert.True(t, changed)
+	assert.Equal(t, 1, fromVersion)
+	assert.Equal(t, strings.Join([]string{
+		Header(),
+		"2024-05-01 10:00:00, 0.00, 12.40, 3.00, 0",
+		"2024-05-01 10:02:00, 0.00, 12.3",
+		"2024-05-01 10:04:00, 0.00, 12.39, 3.00, 2",
+	}, "\n")+"\n", string(migrated))
+
+	rows, bad := Read(migrated)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, 1, bad)
+
+	_, fromVersion, changed = Migrate(migrated)
+	assert.False(t, changed)
+	assert.Equal(t, Version, fromVersion)
+}
+
+func TestRowFormat(t *testing.T) {
+	row := Row{Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("NZST", 12*60*60)), LV: 12.4, RTC: 3, Flags: 2}
+	assert.Equal(t, "2024-05-01T10:00:00+12:00, 0.00, 12.40, 3.00, 2", row.String())
+	assert.Equal(t, "2024-05-01 10:00:00, 0.00, 12.40, 3.00, 2", row.Format(true))
+}
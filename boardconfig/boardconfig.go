@@ -0,0 +1,74 @@
+// Package boardconfig reads the settings for expansion boards stacked on the hat. Each board
+// has its own section in the config, named after the board, so the sensors and pins on the
+// boards don't clash with the main hat:
+//
+//	[boards.board1]
+//	temp-sensor-address = 0x39
+//	[boards.board1.pins]
+//	trap-out = "GPIO22"
+package boardconfig
+
+import (
+	"fmt"
+	"sort"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+)
+
+const ConfigKey = "boards"
+
+// Board is the config for one expansion board.
+type Board struct {
+	// I2C address of the AHT20 compatible temperature and humidity sensor, 0 if there isn't one.
+	TempSensorAddress int `mapstructure:"temp-sensor-address"`
+	// GPIO pins on the board, by what they are used for.
+	Pins map[string]string `mapstructure:"pins"`
+}
+
+// Load returns the config for each board, checking the board names are valid.
+func Load(config *goconfig.Config) (map[string]Board, error) {
+	boards := map[string]Board{}
+	if err := configcompat.Unmarshal(config, ConfigKey, &boards); err != nil {
+		return nil, err
+	}
+	for name := range boards {
+		if _, err := eeprom.BoardAddress(name); err != nil {
+			return nil, err
+		}
+	}
+	return boards, nil
+}
+
+// Get returns the config for the board with the name.
+func Get(config *goconfig.Config, name string) (Board, error) {
+	boards, err := Load(config)
+	if err != nil {
+		return Board{}, err
+	}
+	board, ok := boards[name]
+	if !ok {
+		return Board{}, fmt.Errorf("no config for board '%s'", name)
+	}
+	return board, nil
+}
+
+// Names returns the names of the boards in the config, sorted so they are in address order.
+func Names(boards map[string]Board) []string {
+	names := []string{}
+	for name := range boards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pin returns the name of the GPIO pin used for the function on the board.
+func (b Board) Pin(function string) (string, error) {
+	pin, ok := b.Pins[function]
+	if !ok {
+		return "", fmt.Errorf("no '%s' pin configured", function)
+	}
+	return pin, nil
+}
@@ -0,0 +1,24 @@
+package boardconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNames(t *testing.T) {
+	boards := map[string]Board{
+		"board3": {},
+		"board1": {TempSensorAddress: 0x39},
+	}
+	assert.Equal(t, []string{"board1", "board3"}, Names(boards))
+}
+
+func TestPin(t *testing.T) {
+	b := Board{Pins: map[string]string{"trap-out": "GPIO22"}}
+	pin, err := b.Pin("trap-out")
+	assert.NoError(t, err)
+	assert.Equal(t, "GPIO22", pin)
+	_, err = b.Pin("uart-tx")
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+// Package buzzer plays beep patterns on a buzzer so someone at the device can hear when the
+// trap is armed or triggered, the battery is low, or how a self test went. The buzzer is
+// driven from a GPIO with PWM, or by the ATtiny on power PCBs that have a buzzer:
+//
+//	[buzzer]
+//	enable = true
+//	driver = "gpio"
+//	pin = "GPIO13"
+//	frequency = 2700
+//	quiet-start = "21:00"
+//	quiet-end = "07:00"
+//
+// Nothing is played during the quiet hours.
+package buzzer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/host/v3"
+)
+
+const (
+	ConfigKey        = "buzzer"
+	DriverGPIO       = "gpio"
+	DriverATtiny     = "attiny"
+	defaultFrequency = 2700 // Hz, the resonant frequency of most piezo buzzers.
+)
+
+var log = logging.NewLogger("info")
+
+// Pattern is the on and off times of the beeps, starting with on.
+type Pattern struct {
+	Name  string
+	Steps []time.Duration
+}
+
+var (
+	TrapArmed      = Pattern{"trapArmed", beeps(100, 100, 100)}
+	TrapTriggered  = Pattern{"trapTriggered", beeps(600, 200, 600, 200, 600)}
+	LowBattery     = Pattern{"lowBattery", beeps(50, 150, 50, 150, 50)}
+	SelfTestPassed = Pattern{"selfTestPassed", beeps(300)}
+	SelfTestFailed = Pattern{"selfTestFailed", beeps(800, 200, 150, 200, 800)}
+	// Deterrent is long and loud enough to scare off an animal that shouldn't be trapped.
+	Deterrent = Pattern{"deterrent", beeps(1500, 300, 1500, 300, 1500, 300, 1500)}
+)
+
+func beeps(ms ...int) []time.Duration {
+	steps := make([]time.Duration, len(ms))
+	for i, m := range ms {
+		steps[i] = time.Duration(m) * time.Millisecond
+	}
+	return steps
+}
+
+// Config is read from the "buzzer" section of the config.
+type Config struct {
+	Enable     bool   `mapstructure:"enable"`
+	Driver     string `mapstructure:"driver"`
+	Pin        string `mapstructure:"pin"`
+	Frequency  int    `mapstructure:"frequency"`
+	QuietStart string `mapstructure:"quiet-start"`
+	QuietEnd   string `mapstructure:"quiet-end"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Driver:    DriverGPIO,
+		Frequency: defaultFrequency,
+	}
+}
+
+// Driver turns the buzzer on and off.
+type Driver interface {
+	Tone(on bool) error
+}
+
+type gpioDriver struct {
+	pin       gpio.PinIO
+	frequency physic.Frequency
+}
+
+func (d *gpioDriver) Tone(on bool) error {
+	if on {
+		return d.pin.PWM(gpio.DutyHalf, d.frequency)
+	}
+	return d.pin.Out(gpio.Low)
+}
+
+type attinyDriver struct {
+	client *attinyclient.Client
+}
+
+func (d *attinyDriver) Tone(on bool) error {
+	return d.client.SetBuzzer(on)
+}
+
+// Buzzer plays the patterns. A nil Buzzer doesn't play anything, so it can be used when the
+// buzzer isn't enabled.
+type Buzzer struct {
+	driver     Driver
+	quietStart int // Minutes from midnight, -1 if there are no quiet hours.
+	quietEnd   int
+	sleep      func(time.Duration)
+
+	mu sync.Mutex
+}
+
+// LoadConfig returns the buzzer config, the buzzer isn't enabled if there is no config.
+func LoadConfig(config *goconfig.Config) (Config, error) {
+	c := DefaultConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, ConfigKey, &c); err != nil {
+		return DefaultConfig(), err
+	}
+	return c, nil
+}
+
+// FromConfig returns the buzzer from the config, nil if it isn't enabled.
+func FromConfig(config *goconfig.Config) (*Buzzer, error) {
+	c, err := LoadConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return Open(c)
+}
+
+// Open returns the buzzer for the config, nil if it isn't enabled.
+func Open(c Config) (*Buzzer, error) {
+	if !c.Enable {
+		return nil, nil
+	}
+	driver, err := newDriver(c)
+	if err != nil {
+		return nil, err
+	}
+	return New(driver, c)
+}
+
+func newDriver(c Config) (Driver, error) {
+	switch c.Driver {
+	case DriverGPIO:
+		if _, err := host.Init(); err != nil {
+			return nil, err
+		}
+		pin := gpioreg.ByName(c.Pin)
+		if pin == nil {
+			return nil, fmt.Errorf("failed to find buzzer pin '%s'", c.Pin)
+		}
+		if c.Frequency <= 0 {
+			return nil, fmt.Errorf("buzzer frequency must be positive")
+		}
+		return &gpioDriver{pin: pin, frequency: physic.Frequency(c.Frequency) * physic.Hertz}, nil
+	case DriverATtiny:
+		return &attinyDriver{client: attinyclient.NewI2CClient()}, nil
+	default:
+		return nil, fmt.Errorf("unknown buzzer driver '%s'", c.Driver)
+	}
+}
+
+// New returns a buzzer using the driver, with the quiet hours from the config.
+func New(driver Driver, c Config) (*Buzzer, error) {
+	b := &Buzzer{
+		driver:     driver,
+		quietStart: -1,
+		sleep:      time.Sleep,
+	}
+	if c.QuietStart == "" && c.QuietEnd == "" {
+		return b, nil
+	}
+	start, err1 := time.Parse("15:04", c.QuietStart)
+	end, err2 := time.Parse("15:04", c.QuietEnd)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("buzzer quiet-start and quiet-end should be HH:MM")
+	}
+	b.quietStart = start.Hour()*60 + start.Minute()
+	b.quietEnd = end.Hour()*60 + end.Minute()
+	return b, nil
+}
+
+// quiet returns true during the quiet hours, which can cross midnight.
+func (b *Buzzer) quiet(t time.Time) bool {
+	if b.quietStart < 0 || b.quietStart == b.quietEnd {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if b.quietStart < b.quietEnd {
+		return minute >= b.quietStart && minute < b.quietEnd
+	}
+	return minute >= b.quietStart || minute < b.quietEnd
+}
+
+// Play plays the pattern, waiting until it has finished. Patterns played at the same time
+// are played one after the other.
+func (b *Buzzer) Play(p Pattern) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.quiet(time.Now()) {
+		log.Debugf("Not playing '%s' during quiet hours", p.Name)
+		return nil
+	}
+	log.Debugf("Playing '%s' on the buzzer", p.Name)
+	for i, d := range p.Steps {
+		if err := b.driver.Tone(i%2 == 0); err != nil {
+			// Try to stop it beeping.
+			_ = b.driver.Tone(false)
+			return err
+		}
+		b.sleep(d)
+	}
+	return b.driver.Tone(false)
+}
+
+// PlayAsync plays the pattern in the background, logging any error.
+func (b *Buzzer) PlayAsync(p Pattern) {
+	if b == nil {
+		return
+	}
+	go func() {
+		if err := b.Play(p); err != nil {
+			log.Errorf("Failed to play '%s' on the buzzer: %v", p.Name, err)
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+package buzzer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDriver struct {
+	tones []bool
+}
+
+func (d *fakeDriver) Tone(on bool) error {
+	d.tones = append(d.tones, on)
+	return nil
+}
+
+func TestPlayPattern(t *testing.T) {
+	driver := &fakeDriver{}
+	b, err := New(driver, DefaultConfig())
+	assert.NoError(t, err)
+	slept := []time.Duration{}
+	b.sleep = func(d time.Duration) { slept = append(slept, d) }
+	assert.NoError(t, b.Play(TrapArmed))
+	assert.Equal(t, []bool{true, false, true, false}, driver.tones)
+	assert.Equal(t, TrapArmed.Steps, slept)
+}
+
+func TestQuietHours(t *testing.T) {
+	c := DefaultConfig()
+	c.QuietStart = "21:00"
+	c.QuietEnd = "07:00"
+	b, err := New(&fakeDriver{}, c)
+	assert.NoError(t, err)
+	for _, tc := range []struct {
+		hour  int
+		quiet bool
+	}{
+		{20, false},
+		{22, true},
+		{3, true},
+		{7, false},
+	} {
+		assert.Equal(t, tc.quiet, b.quiet(time.Date(2024, 1, 1, tc.hour, 0, 0, 0, time.Local)), "hour %d", tc.hour)
+	}
+}
+
+func TestInvalidQuietHours(t *testing.T) {
+	c := DefaultConfig()
+	c.QuietStart = "9pm"
+	_, err := New(&fakeDriver{}, c)
+	assert.Error(t, err)
+}
+
+func TestNilBuzzer(t *testing.T) {
+	var b *Buzzer
+	assert.NoError(t, b.Play(TrapTriggered))
+	b.PlayAsync(TrapTriggered)
+}
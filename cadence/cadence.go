@@ -0,0 +1,267 @@
+// Package cadence sets how often the hat services poll and make readings, from one power
+// profile. Every polling interval, such as the ATtiny signal checks, connection state updates
+// and temperature sampling, is scaled by the factor of the profile instead of each being tuned
+// on its own:
+//   - performance, the normal intervals.
+//   - balanced, the intervals are multiplied by low-factor.
+//   - endurance, the intervals are multiplied by critical-factor.
+//
+// With the "auto" profile it is picked from the battery level. While the battery is healthy
+// the performance profile is used, when the battery is low, and then critical, the balanced
+// and endurance profiles are used to cut the I2C traffic and events, so the last hours of the
+// battery last longer:
+//
+//	[reporting-cadence]
+//	enable = true
+//	profile = "auto"
+//	low-percent = 25
+//	critical-percent = 10
+//	low-factor = 2
+//	critical-factor = 6
+//
+// A fixed profile is used whatever the battery level, enable only turns the auto profile off.
+// The battery level is set by tc2-hat-attiny with Update, other services read it from the
+// battery state file saved by tc2-hat-attiny.
+package cadence
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+)
+
+const (
+	ConfigKey        = "reporting-cadence"
+	batteryStateFile = "/etc/cacophony/battery_state.json"
+	// The battery state file is read again after this long.
+	refreshInterval = time.Minute
+	// Battery readings older than this are ignored, and the normal cadence is used.
+	maxReadingAge = 6 * time.Hour
+)
+
+type Level string
+
+const (
+	Normal   Level = "normal"
+	Low      Level = "low"
+	Critical Level = "critical"
+)
+
+type Profile string
+
+const (
+	Auto        Profile = "auto"
+	Performance Profile = "performance"
+	Balanced    Profile = "balanced"
+	Endurance   Profile = "endurance"
+)
+
+// profileForLevel is the profile used by the auto profile at each battery level.
+var profileForLevel = map[Level]Profile{
+	Normal:   Performance,
+	Low:      Balanced,
+	Critical: Endurance,
+}
+
+// Config is read from the "reporting-cadence" section of the config.
+type Config struct {
+	Enable          bool    `mapstructure:"enable"`
+	Profile         Profile `mapstructure:"profile"`
+	LowPercent      float64 `mapstructure:"low-percent"`
+	CriticalPercent float64 `mapstructure:"critical-percent"`
+	// The intervals are multiplied by these at the low and critical levels.
+	LowFactor      float64 `mapstructure:"low-factor"`
+	CriticalFactor float64 `mapstructure:"critical-factor"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Enable:          true,
+		Profile:         Auto,
+		LowPercent:      25,
+		CriticalPercent: 10,
+		LowFactor:       2,
+		CriticalFactor:  6,
+	}
+}
+
+// LoadConfig returns the cadence config, the default config is returned with the error if
+// it can't be read.
+func LoadConfig(config *goconfig.Config) (Config, error) {
+	c := DefaultConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, ConfigKey, &c); err != nil {
+		return DefaultConfig(), err
+	}
+	if c.CriticalPercent > c.LowPercent {
+		return DefaultConfig(), fmt.Errorf("%s critical-percent can't be above low-percent", ConfigKey)
+	}
+	if c.LowFactor < 1 || c.CriticalFactor < 1 {
+		return DefaultConfig(), fmt.Errorf("%s factors must be at least 1", ConfigKey)
+	}
+	switch c.Profile {
+	case "":
+		c.Profile = Auto
+	case Auto, Performance, Balanced, Endurance:
+	default:
+		return DefaultConfig(), fmt.Errorf("%s unknown profile '%s'", ConfigKey, c.Profile)
+	}
+	return c, nil
+}
+
+// Policy gives the cadence for the current battery level. A nil Policy always uses the
+// normal cadence.
+type Policy struct {
+	config      Config
+	readBattery func() (percent float64, reading time.Time, err error)
+	now         func() time.Time
+
+	mu      sync.Mutex
+	percent float64
+	reading time.Time
+	checked time.Time
+}
+
+// New returns a policy that reads the battery level from the battery state file.
+func New(c Config) *Policy {
+	return &Policy{
+		config:      c,
+		readBattery: readBatteryState,
+		now:         time.Now,
+	}
+}
+
+// LevelFor returns the cadence level for the battery percentage.
+func (p *Policy) LevelFor(percent float64) Level {
+	if p == nil || !p.config.Enable {
+		return Normal
+	}
+	switch {
+	case percent <= p.config.CriticalPercent:
+		return Critical
+	case percent <= p.config.LowPercent:
+		return Low
+	default:
+		return Normal
+	}
+}
+
+// Update sets the battery level from a new reading, returning true if the level changed.
+func (p *Policy) Update(percent float64, now time.Time) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	before := p.level()
+	p.percent = percent
+	p.reading = now
+	p.checked = now
+	return p.level() != before
+}
+
+// Level returns the cadence level for the last battery reading.
+func (p *Policy) Level() Level {
+	if p == nil {
+		return Normal
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.refresh() {
+		return Normal
+	}
+	return p.level()
+}
+
+// BatteryPercent returns the last battery reading, ok is false if there isn't a recent one.
+func (p *Policy) BatteryPercent() (percent float64, ok bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.refresh() {
+		return 0, false
+	}
+	return p.percent, true
+}
+
+// refresh reads the battery state file if it hasn't been read recently, returning false if
+// there isn't a recent battery reading.
+func (p *Policy) refresh() bool {
+	now := p.now()
+	if p.readBattery != nil && now.Sub(p.checked) >= refreshInterval {
+		p.checked = now
+		if percent, reading, err := p.readBattery(); err == nil && reading.After(p.reading) {
+			p.percent = percent
+			p.reading = reading
+		}
+	}
+	return !p.reading.IsZero() && now.Sub(p.reading) <= maxReadingAge
+}
+
+func (p *Policy) level() Level {
+	if p.reading.IsZero() {
+		return Normal
+	}
+	return p.LevelFor(p.percent)
+}
+
+// Interval returns the interval to use in place of base at the current level.
+func (p *Policy) Interval(base time.Duration) time.Duration {
+	return p.IntervalFor(p.Level(), base)
+}
+
+// IntervalFor returns the interval to use in place of base at the level.
+func (p *Policy) IntervalFor(level Level, base time.Duration) time.Duration {
+	if p == nil {
+		return base
+	}
+	switch p.ProfileFor(level) {
+	case Endurance:
+		return time.Duration(float64(base) * p.config.CriticalFactor)
+	case Balanced:
+		return time.Duration(float64(base) * p.config.LowFactor)
+	default:
+		return base
+	}
+}
+
+// Profile returns the power profile for the last battery reading.
+func (p *Policy) Profile() Profile {
+	return p.ProfileFor(p.Level())
+}
+
+// ProfileFor returns the power profile used at the level, the profile from the config unless
+// it is auto.
+func (p *Policy) ProfileFor(level Level) Profile {
+	if p == nil {
+		return Performance
+	}
+	if p.config.Profile != Auto && p.config.Profile != "" {
+		return p.config.Profile
+	}
+	return profileForLevel[level]
+}
+
+func readBatteryState() (float64, time.Time, error) {
+	data, err := os.ReadFile(batteryStateFile)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	state := struct {
+		LastPercent float64   `json:"lastPercent"`
+		LastReading time.Time `json:"lastReading"`
+	}{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, time.Time{}, err
+	}
+	return state.LastPercent, state.LastReading, nil
+}
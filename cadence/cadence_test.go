@@ -0,0 +1,98 @@
+package cadence
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevels(t *testing.T) {
+	p := New(DefaultConfig())
+	assert.Equal(t, Normal, p.LevelFor(80))
+	assert.Equal(t, Low, p.LevelFor(25))
+	assert.Equal(t, Critical, p.LevelFor(5))
+
+	assert.Equal(t, time.Minute, p.IntervalFor(Normal, time.Minute))
+	assert.Equal(t, 2*time.Minute, p.IntervalFor(Low, time.Minute))
+	assert.Equal(t, 6*time.Minute, p.IntervalFor(Critical, time.Minute))
+
+	disabled := New(Config{})
+	assert.Equal(t, Normal, disabled.LevelFor(5))
+
+	var nilPolicy *Policy
+	assert.Equal(t, Normal, nilPolicy.Level())
+	assert.Equal(t, time.Minute, nilPolicy.Interval(time.Minute))
+	assert.False(t, nilPolicy.Update(5, time.Now()))
+}
+
+func TestLevelFromBatteryState(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	percent, reading := 50.0, now
+	var readErr error
+	reads := 0
+	p := New(DefaultConfig())
+	p.now = func() time.Time { return now }
+	p.readBattery = func() (float64, time.Time, error) {
+		reads++
+		return percent, reading, readErr
+	}
+
+	assert.Equal(t, Normal, p.Level())
+	percent = 8
+	// Not read again until the refresh interval.
+	assert.Equal(t, Normal, p.Level())
+	assert.Equal(t, 1, reads)
+
+	now = now.Add(refreshInterval)
+	reading = now
+	assert.Equal(t, Critical, p.Level())
+	batteryPercent, ok := p.BatteryPercent()
+	assert.True(t, ok)
+	assert.Equal(t, 8.0, batteryPercent)
+
+	// Old readings aren't used.
+	readErr = errors.New("no battery state")
+	now = now.Add(maxReadingAge + time.Minute)
+	assert.Equal(t, Normal, p.Level())
+	_, ok = p.BatteryPercent()
+	assert.False(t, ok)
+}
+
+func TestUpdate(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	p := New(DefaultConfig())
+	p.now = func() time.Time { return now }
+	p.readBattery = nil
+	assert.False(t, p.Update(60, now))
+	assert.False(t, p.Update(40, now))
+	assert.True(t, p.Update(20, now))
+	assert.Equal(t, Low, p.Level())
+	assert.True(t, p.Update(60, now))
+}
+
+func TestProfiles(t *testing.T) {
+	p := New(DefaultConfig())
+	assert.Equal(t, Performance, p.ProfileFor(Normal))
+	assert.Equal(t, Balanced, p.ProfileFor(Low))
+	assert.Equal(t, Endurance, p.ProfileFor(Critical))
+
+	// A fixed profile is used at every battery level.
+	c := DefaultConfig()
+	c.Profile = Endurance
+	fixed := New(c)
+	assert.Equal(t, Endurance, fixed.ProfileFor(Normal))
+	assert.Equal(t, 6*time.Second, fixed.IntervalFor(Normal, time.Second))
+	c.Profile = Performance
+	fixed = New(c)
+	assert.Equal(t, time.Second, fixed.IntervalFor(Critical, time.Second))
+
+	// Disabling only turns off the auto profile.
+	c = Config{Profile: Balanced, LowFactor: 3, CriticalFactor: 5}
+	assert.Equal(t, 3*time.Second, New(c).Interval(time.Second))
+	assert.Equal(t, Performance, New(Config{Profile: Auto}).Profile())
+
+	var nilPolicy *Policy
+	assert.Equal(t, Performance, nilPolicy.Profile())
+}
@@ -0,0 +1,174 @@
+// Package classpayload is a compact CBOR encoding of a classification, for comms outputs such
+// as LoRa radios where sending the JSON for every classification uses up the airtime. A
+// payload is a CBOR array, encoded with the core deterministic encoding so the same
+// classification always gives the same bytes:
+//
+//	[version, seconds since the classification, {species code: confidence (0-100), ...}]
+//
+// Only the MaxSpecies with the highest confidence are included. A payload with the four
+// species is at most 20 bytes. It is checked by the framing it is sent in, see commsproto.
+//
+// The species codes are the index in Species, new species are only ever added to the end so
+// older decoders still understand the codes they know about.
+package classpayload
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	Version    = 2 // Version 1 was a fixed layout with a CRC-8.
+	MaxSpecies = 4
+	// Code for species that aren't in Species.
+	CodeOther = 0
+)
+
+// Species are the species codes, the code is the index. Don't reorder or remove species.
+var Species = []string{
+	"other",
+	"possum",
+	"rodent",
+	"cat",
+	"hedgehog",
+	"mustelid",
+	"bird",
+	"kiwi",
+	"penguin",
+	"land-bird",
+	"leporidae",
+	"wallaby",
+	"deer",
+	"dog",
+	"sheep",
+	"human",
+	"vehicle",
+	"insect",
+	"false-positive",
+	"unidentified",
+}
+
+var encMode = func() cbor.EncMode {
+	mode, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// wirePayload is the layout of the CBOR array.
+type wirePayload struct {
+	_       struct{} `cbor:",toarray"`
+	Version uint
+	Age     uint32         // Seconds.
+	Species map[byte]uint8 // Confidence by species code.
+}
+
+// Payload is a decoded classification.
+type Payload struct {
+	Species map[string]int32
+	Age     time.Duration
+}
+
+// Code returns the code for the species, CodeOther if it doesn't have one.
+func Code(species string) byte {
+	for i, s := range Species {
+		if s == species {
+			return byte(i)
+		}
+	}
+	return CodeOther
+}
+
+// Encode encodes the species and confidences of a classification made age ago. Only the
+// MaxSpecies with the highest confidence are included.
+func Encode(species map[string]int32, age time.Duration) ([]byte, error) {
+	if len(species) == 0 {
+		return nil, fmt.Errorf("no species to encode")
+	}
+	names := make([]string, 0, len(species))
+	for name := range species {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if species[names[i]] != species[names[j]] {
+			return species[names[i]] > species[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > MaxSpecies {
+		names = names[:MaxSpecies]
+	}
+	w := wirePayload{Version: Version, Species: map[byte]uint8{}}
+	for _, name := range names {
+		confidence := uint8(min(max(species[name], 0), 100))
+		code := Code(name)
+		w.Species[code] = max(w.Species[code], confidence)
+	}
+	return encode(w, age)
+}
+
+// SetAge sets the time since the classification, this is used when the payload was encoded
+// before it could be sent.
+func SetAge(payload []byte, age time.Duration) ([]byte, error) {
+	w, err := decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return encode(w, age)
+}
+
+func encode(w wirePayload, age time.Duration) ([]byte, error) {
+	w.Age = uint32(min(max(math.Round(age.Seconds()), 0), math.MaxUint32))
+	return encMode.Marshal(w)
+}
+
+// Decode checks and decodes a payload. Species codes this version doesn't know about are
+// decoded as "species-<code>".
+func Decode(payload []byte) (Payload, error) {
+	w, err := decode(payload)
+	if err != nil {
+		return Payload{}, err
+	}
+	p := Payload{
+		Species: map[string]int32{},
+		Age:     time.Duration(w.Age) * time.Second,
+	}
+	for code, confidence := range w.Species {
+		name := fmt.Sprintf("species-%d", code)
+		if int(code) < len(Species) {
+			name = Species[code]
+		}
+		p.Species[name] = int32(confidence)
+	}
+	return p, nil
+}
+
+func decode(payload []byte) (wirePayload, error) {
+	// The version is checked first, a newer version can have a different layout.
+	header := []cbor.RawMessage{}
+	if err := cbor.Unmarshal(payload, &header); err != nil {
+		return wirePayload{}, fmt.Errorf("invalid payload: %v", err)
+	}
+	version := uint(0)
+	if len(header) > 0 {
+		if err := cbor.Unmarshal(header[0], &version); err != nil {
+			return wirePayload{}, fmt.Errorf("invalid payload version: %v", err)
+		}
+	}
+	if version != Version {
+		return wirePayload{}, fmt.Errorf("unsupported payload version %d", version)
+	}
+	w := wirePayload{}
+	if err := cbor.Unmarshal(payload, &w); err != nil {
+		return wirePayload{}, fmt.Errorf("invalid payload: %v", err)
+	}
+	if len(w.Species) == 0 || len(w.Species) > MaxSpecies {
+		return wirePayload{}, fmt.Errorf("invalid number of species %d", len(w.Species))
+	}
+	return w, nil
+}
@@ -0,0 +1,72 @@
+package classpayload
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	payload, err := Encode(map[string]int32{"possum": 87, "cat": 12}, 95*time.Second)
+	assert.NoError(t, err)
+	decoded, err := Decode(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int32{"possum": 87, "cat": 12}, decoded.Species)
+	assert.Equal(t, 95*time.Second, decoded.Age)
+
+	// Only the species with the highest confidence fit.
+	payload, err = Encode(map[string]int32{"possum": 50, "cat": 40, "kiwi": 30, "dog": 20, "deer": 10, "stoat": 150}, 0)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(payload), 20)
+	decoded, err = Decode(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int32{"other": 100, "possum": 50, "cat": 40, "kiwi": 30}, decoded.Species)
+
+	_, err = Encode(nil, 0)
+	assert.Error(t, err)
+}
+
+// TestWireFormat checks the bytes on the wire, decoders on the receiving side depend on them
+// so they can't change without bumping the version.
+func TestWireFormat(t *testing.T) {
+	// [2, 95, {possum: 87, cat: 12}]
+	wire := []byte{0x83, 0x02, 0x18, 0x5f, 0xa2, 0x01, 0x18, 0x57, 0x03, 0x0c}
+	payload, err := Encode(map[string]int32{"possum": 87, "cat": 12}, 95*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, wire, payload)
+
+	decoded, err := Decode(wire)
+	assert.NoError(t, err)
+	assert.Equal(t, Payload{Species: map[string]int32{"possum": 87, "cat": 12}, Age: 95 * time.Second}, decoded)
+}
+
+func TestSetAge(t *testing.T) {
+	payload, err := Encode(map[string]int32{"possum": 87}, 0)
+	assert.NoError(t, err)
+	payload, err = SetAge(payload, 48*time.Hour)
+	assert.NoError(t, err)
+	decoded, err := Decode(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, 48*time.Hour, decoded.Age)
+	assert.Equal(t, map[string]int32{"possum": 87}, decoded.Species)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, payload := range [][]byte{
+		nil,
+		{0x83, 0x02, 0x18},                   // Cut short.
+		{0x83, 0x03, 0x00, 0xa1, 0x01, 0x01}, // Newer version.
+		{0x83, 0x02, 0x00, 0xa0},             // No species.
+		{0x84, 0x02, 0x00, 0xa1, 0x01, 0x01, 0x00}, // Extra field.
+		{0x01, 0x02, 0x03},
+	} {
+		_, err := Decode(payload)
+		assert.Error(t, err, "%x", payload)
+	}
+
+	// A species code from a newer version.
+	decoded, err := Decode([]byte{0x83, 0x02, 0x01, 0xa1, 0x18, 0xc8, 0x18, 0x57})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int32{"species-200": 87}, decoded.Species)
+}
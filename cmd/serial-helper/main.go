@@ -2,8 +2,10 @@ package main
 
 import (
 	"log"
+	"os"
 	"time"
 
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
 	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
 	"periph.io/x/conn/v3/gpio"
 )
@@ -11,7 +13,8 @@ import (
 func main() {
 	err := runMain()
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		os.Exit(exitcode.Code(err))
 	}
 }
 
@@ -19,7 +22,7 @@ func runMain() error {
 	log.Println("Setting up serial helper for the ATtiny")
 	serialFile, err := serialhelper.GetSerial(3, gpio.Low, gpio.Low, time.Second)
 	if err != nil {
-		return err
+		return exitcode.Wrap(exitcode.BusError, err)
 	}
 	log.Println("Serial acquired")
 
@@ -0,0 +1,90 @@
+package main
+
+import (
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+)
+
+// The raw ADC readings are converted to voltages with the dividers for the power PCB version
+// from the EEPROM. Boards can be calibrated, or a modified board described, by setting any
+// of the values in the config, values that aren't set keep the value for the PCB version:
+//
+//	[attiny-analog]
+//	vref = 3.31
+//	hv-offset = -0.12
+//	lv-r2 = 560
+const analogConfigKey = "attiny-analog"
+
+// analogOverrides is read from the "attiny-analog" section of the config.
+type analogOverrides struct {
+	Vref      float32 `mapstructure:"vref"`
+	ADCMax    float32 `mapstructure:"adc-max"`
+	LVR1      float32 `mapstructure:"lv-r1"`
+	LVR2      float32 `mapstructure:"lv-r2"`
+	LVOffset  float32 `mapstructure:"lv-offset"`
+	HVR1      float32 `mapstructure:"hv-r1"`
+	HVR2      float32 `mapstructure:"hv-r2"`
+	HVOffset  float32 `mapstructure:"hv-offset"`
+	RTCOffset float32 `mapstructure:"rtc-offset"`
+}
+
+func loadAnalogOverrides(config *goconfig.Config) (analogOverrides, error) {
+	o := analogOverrides{}
+	if config == nil {
+		return o, nil
+	}
+	err := configcompat.Unmarshal(config, analogConfigKey, &o)
+	return o, err
+}
+
+// apply returns the config with the values that are set replaced.
+func (o analogOverrides) apply(c attinyclient.AnalogConfig) attinyclient.AnalogConfig {
+	set := func(v *float32, override float32) {
+		if override != 0 {
+			*v = override
+		}
+	}
+	set(&c.Vref, o.Vref)
+	set(&c.ADCMax, o.ADCMax)
+	set(&c.LV.R1, o.LVR1)
+	set(&c.LV.R2, o.LVR2)
+	set(&c.LV.Offset, o.LVOffset)
+	set(&c.HV.R1, o.HVR1)
+	set(&c.HV.R2, o.HVR2)
+	set(&c.HV.Offset, o.HVOffset)
+	set(&c.RTC.Offset, o.RTCOffset)
+	return c
+}
+
+// analogConfig returns how to convert the ADC readings for this power PCB.
+func (a *attiny) analogConfig() (attinyclient.AnalogConfig, error) {
+	c, err := attinyclient.AnalogConfigForVersion(attinyclient.Version(getPowerPCBVersion()))
+	if err != nil {
+		return c, err
+	}
+	return a.analogOverrides.apply(c), nil
+}
+
+// readVoltage reads the ADC channel and converts it to a voltage, adding the noise and
+// retries to the quality of the readings.
+func (a *attiny) readVoltage(reg1, reg2 attinyclient.Register, channel func(attinyclient.AnalogConfig) attinyclient.Channel) (float32, error) {
+	// The retries are for the whole link, so can include other transactions made at the same time.
+	retries := linkStats.Stats().Retries
+	raw, diff, err := a.readBattery(reg1, reg2)
+	if err != nil {
+		return 0, err
+	}
+	a.analogQuality.add(diff, linkStats.Stats().Retries-retries)
+	c, err := a.analogConfig()
+	if err != nil {
+		return 0, err
+	}
+	return c.Voltage(raw, channel(c)), nil
+}
+
+// TakeReadingQuality returns the quality of the voltage readings since it was last called.
+func (a *attiny) TakeReadingQuality() battery.ReadingQuality {
+	return a.analogQuality.take()
+}
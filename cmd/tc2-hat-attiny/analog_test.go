@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalogOverrides(t *testing.T) {
+	c, err := attinyclient.AnalogConfigForVersion("0.7.0")
+	assert.NoError(t, err)
+
+	// Nothing set keeps the values for the PCB version.
+	assert.Equal(t, c, analogOverrides{}.apply(c))
+
+	o := analogOverrides{Vref: 3.31, HVOffset: -0.1, LVR2: 560}
+	calibrated := o.apply(c)
+	assert.Equal(t, float32(3.31), calibrated.Vref)
+	assert.Equal(t, float32(-0.1), calibrated.HV.Offset)
+	assert.Equal(t, float32(560), calibrated.LV.R2)
+	assert.Equal(t, c.LV.R1, calibrated.LV.R1)
+	assert.Equal(t, c.HV.R2, calibrated.HV.R2)
+}
@@ -21,207 +21,62 @@ package main
 import (
 	"errors"
 	"fmt"
-	"math"
 	"os/exec"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	"github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/buzzer"
 	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/firmware"
 	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/livefeed"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
 	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
 	"periph.io/x/conn/v3/gpio"
 )
 
-type Register uint8
-
-const (
-	typeReg Register = iota
-	majorVersionReg
-	cameraStateReg
-	cameraConnectionReg
-	piCommandsReg
-	rp2040PiPowerCtrlReg
-	auxTerminalReg
-	tc2AgentReadyReg
-	minorVersionReg
-	flashErrorsReg
-	clearErrorReg
-	patchVersionReg
-)
-
-const (
-	batteryCheckCtrlReg Register = iota + 0x10
-	batteryLow1Reg
-	batteryLow2Reg
-	batteryLVDivVal1Reg
-	batteryLVDivVal2Reg
-	batteryHVDivVal1Reg
-	batteryHVDivVal2Reg
-	rtcBattery1Reg
-	rtcBattery2Reg
-)
-
-const (
-	regErrors1 Register = iota + 0x20
-	regErrors2
-	regErrors3
-	regErrors4
-	errorRegisters = 4
-)
-
-// PiCommandFlags
-const (
-	WriteCameraStateFlag = 1 << iota
-	ReadErrorsFlag
-	EnableWifiFlag
-	PowerDownFlag
-	ToggleAuxTerminalFlag
-)
-
-type CameraState uint8
-
-const (
-	statePoweringOn CameraState = iota
-	statePoweredOn
-	statePoweringOff
-	statePoweredOff
-	statePowerOnTimeout
-	stateRebooting
-)
-
 var (
 	// These variables are set by environment variables. Travis will set them automatically from the .travis.yml.
 	// The are needed for testing though so the values can be set as shown below.
 	attinyMajorStr = "" // To set for testing run `export ATTINY_MAJOR=1`
 	attinyMinorStr = "" // To set for testing run `export ATTINY_MINOR=0`
 	attinyPatchStr = "" // To set for testing run `export ATTINY_PATCH=0`
-	// TODO, check hash of the hex file before programming.
+	// Used to verify the hex file if the config doesn't pin a hash, see verifyATtinyFirmware.
 	attinyHexHash = "" // To set for testing run `export ATTINY_HASH=$(sha256sum _release/attiny-firmware.hex | cut -d ' ' -f 1)`
 )
 
 const (
-	// Version of firmware that this software works with.
-	attinyI2CAddress = 0x25
-	hexFile          = "/etc/cacophony/attiny-firmware.hex"
-	eepromData       = "/etc/cacophony/eeprom-data.json"
-	i2cTypeVal       = 0xCA
+	hexFile    = "/etc/cacophony/attiny-firmware.hex"
+	eepromData = "/etc/cacophony/eeprom-data.json"
 )
 
-func (s CameraState) String() string {
-	switch s {
-	case statePoweringOn:
-		return "Powering On"
-	case statePoweredOn:
-		return "Powered On"
-	case statePoweringOff:
-		return "Powering Off"
-	case statePoweredOff:
-		return "Powered Off"
-	case statePowerOnTimeout:
-		return "Power On Timeout"
-	case stateRebooting:
-		return "Rebooting"
-	default:
-		log.Println("Unknown camera state:", int(s))
-		return "Unknown"
-	}
-}
-
-type ConnectionState uint8
-
-const (
-	connStateWifiNoConnection ConnectionState = iota
-	connStateWifiConnected
-	connStateHotspot
-	connStateWifiSettingUp
-	connStateHotspotSettingUp
-)
-
-func (s ConnectionState) String() string {
-	switch s {
-	case connStateWifiNoConnection:
-		return "WIFI, no connection"
-	case connStateWifiConnected:
-		return "Wifi, connected"
-	case connStateHotspot:
-		return "Hosting Hotspot"
-	case connStateWifiSettingUp:
-		return "Setting up WIFI"
-	case connStateHotspotSettingUp:
-		return "Setting up hotspot"
-	default:
-		log.Println("Unknown connection state:", int(s))
-		return "Unknown"
-	}
+func attinyUPDIPing() error {
+	command := []string{"pymcuprog", "-d", "attiny1616", "-t", "uart", "-u", "/dev/serial0", "ping"}
+	return exec.Command(command[0], command[1:]...).Run()
 }
 
-type ErrorCode uint8
-
-const (
-	POWER_ON_FAILED               ErrorCode = 0x02
-	WATCHDOG_TIMEOUT              ErrorCode = 0x03
-	INVALID_CAMERA_STATE          ErrorCode = 0x04
-	WRITE_TO_READ_ONLY            ErrorCode = 0x05
-	LOW_BATTERY_LEVEL_SET_TOO_LOW ErrorCode = 0x06
-	INVALID_REG_ADDRESS           ErrorCode = 0x07
-	INVALID_ERROR_CODE            ErrorCode = 0x08
-	NO_PING_RESPONSE              ErrorCode = 0x09
-	RTC_TIMEOUT                   ErrorCode = 0x0A
-	CRC_ERROR                     ErrorCode = 0x0B
-	BAD_I2C_LENGTH_SHORT          ErrorCode = 0x0C
-	BAD_I2C_LENGTH_LONG           ErrorCode = 0x0D
-	BAD_I2C                       ErrorCode = 0x0E
+// Set from the config and arguments, for verifying the hex file before programming it.
+var (
+	firmwareConfig        firmware.Config
+	allowUnsignedFirmware bool
 )
 
-func (e ErrorCode) String() string {
-	switch e {
-	case POWER_ON_FAILED:
-		return "POWER_ON_FAILED"
-	case WATCHDOG_TIMEOUT:
-		return "WATCHDOG_TIMEOUT"
-	case INVALID_CAMERA_STATE:
-		return "INVALID_CAMERA_STATE"
-	case WRITE_TO_READ_ONLY:
-		return "WRITE_TO_READ_ONLY"
-	case LOW_BATTERY_LEVEL_SET_TOO_LOW:
-		return "LOW_BATTERY_LEVEL_SET_TOO_LOW"
-	case INVALID_REG_ADDRESS:
-		return "INVALID_REG_ADDRESS"
-	case INVALID_ERROR_CODE:
-		return "INVALID_ERROR_CODE"
-	case NO_PING_RESPONSE:
-		return "NO_PING_RESPONSE"
-	case RTC_TIMEOUT:
-		return "RTC_TIMEOUT"
-	case CRC_ERROR:
-		return "CRC_ERROR"
-	case BAD_I2C_LENGTH_LONG:
-		return "BAD_I2C_LENGTH_LONG"
-	case BAD_I2C_LENGTH_SHORT:
-		return "BAD_I2C_LENGTH_SHORT"
-	case BAD_I2C:
-		return "BAD_I2C"
-	default:
-		return fmt.Sprintf("UNKNOWN_ERROR_CODE 0x%02X", uint8(e))
+// verifyATtinyFirmware checks the hex file with its signature or the SHA-256 pinned in the
+// config, or the hash it was built with if the config doesn't pin one.
+func verifyATtinyFirmware() (firmware.Result, error) {
+	pinned := firmwareConfig.ATtinySHA256
+	if pinned == "" {
+		pinned = attinyHexHash
 	}
-}
-
-func attinyUPDIPing() error {
-	command := []string{"pymcuprog", "-d", "attiny1616", "-t", "uart", "-u", "/dev/serial0", "ping"}
-	return exec.Command(command[0], command[1:]...).Run()
+	result, err := firmwareConfig.Verify(hexFile, pinned, allowUnsignedFirmware)
+	return result, exitcode.Wrap(exitcode.FirmwareUnverified, err)
 }
 
 func updateATtinyFirmware() error {
-	hash, err := calculateSHA256(hexFile)
-	if err != nil {
-		return err
-	}
-	if hash != attinyHexHash {
-		return fmt.Errorf("hashes of hex file don't match: expecting '%s', got '%s'", attinyHexHash, hash)
-	}
 
 	if serialhelper.SerialInUseFromTerminal() {
 		_, err := exec.Command("disable-aux-uart").CombinedOutput()
@@ -244,6 +99,13 @@ func updateATtinyFirmware() error {
 
 	}
 
+	lease, err := serialhelper.AcquireSerialLease("attiny-programming", time.Minute, 0, true)
+	if err != nil {
+		return err
+	}
+	lease.KeepAlive()
+	defer lease.Release()
+
 	serialFile, err := serialhelper.GetSerial(3, gpio.Low, gpio.Low, time.Second)
 	if err != nil {
 		return err
@@ -298,7 +160,7 @@ func connectToATtinyWithRetries(retries int) (*attiny, error) {
 	for {
 		attiny, err := connectToATtiny()
 		if err == nil {
-			attiny.writeCameraState(statePoweredOn)
+			attiny.writeCameraState(attinyclient.StatePoweredOn)
 			attiny.writeAuxState()
 			return attiny, err
 		}
@@ -309,6 +171,13 @@ func connectToATtinyWithRetries(retries int) (*attiny, error) {
 			return nil, err
 		}
 
+		if dryRun {
+			log.Println("Dry run: not updating the ATtiny firmware")
+			attempt++
+			time.Sleep(time.Second)
+			continue
+		}
+
 		// Need to stop tc2-hat-comms as it will be using the UART pins that are needed to update the firmware.
 		service := "tc2-hat-comms.service"
 		tc2CommsRunning, err := isServiceRunning(service)
@@ -326,17 +195,20 @@ func connectToATtinyWithRetries(retries int) (*attiny, error) {
 			}()
 		}
 
-		err = updateATtinyFirmware()
+		verification, err := verifyATtinyFirmware()
+		if err == nil {
+			err = updateATtinyFirmware()
+		}
 		if err != nil {
 			log.Printf("Error updating firmware: %v\n.", err)
 		}
-		eventclient.AddEvent(eventclient.Event{
-			Timestamp: time.Now(),
-			Type:      "programmingAttiny",
-			Details: map[string]interface{}{
-				"success": err == nil,
-			},
-		})
+		eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ProgrammingATtiny, time.Now(), eventhelper.FirmwareProgramming{
+			SHA256:            verification.SHA256,
+			Verification:      verification.Method,
+			Verified:          verification.Verified,
+			VerificationError: verification.Error,
+			Success:           err == nil,
+		}))
 		time.Sleep(time.Second)
 		attempt++
 	}
@@ -347,7 +219,7 @@ func (a *attiny) writeAuxState() error {
 	if serialhelper.SerialInUseFromTerminal() {
 		regVal = 0x01
 	}
-	return a.writeRegister(auxTerminalReg, regVal, 3)
+	return a.writeRegister(attinyclient.AuxTerminalReg, regVal, 3)
 }
 
 // connectToATtiny initializes the required drivers and connects to the ATtiny device
@@ -358,25 +230,25 @@ func (a *attiny) writeAuxState() error {
 func connectToATtiny() (*attiny, error) {
 	// Check that a device is present on I2C bus at the attiny address.
 
-	if err := i2crequest.CheckAddress(attinyI2CAddress, 1000); err != nil {
-		return nil, fmt.Errorf("failed to find attiny device on i2c bus: %v", err)
+	if err := i2crequest.CheckAddressContext(serviceCtx, attinyclient.Address); err != nil {
+		return nil, exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("failed to find attiny device on i2c bus: %v", err))
 	}
 
 	// Check that the device at ATtiny address responds with the correct type byte.
-	a := &attiny{version: 1}
-	typeRead, err := a.readRegister(typeReg)
+	a := newATtiny(1)
+	typeRead, err := a.readRegister(attinyclient.TypeReg)
 	if err != nil {
-		return nil, fmt.Errorf("error reading type register %s", err)
+		return nil, exitcode.Wrap(exitcode.BusError, fmt.Errorf("error reading type register %s", err))
 	}
 	log.Printf("Type: 0x%X", typeRead)
-	if typeRead != i2cTypeVal {
-		return nil, fmt.Errorf("device responded with '0x%x' instead of the correct type byte '%x'", typeRead, i2cTypeVal)
+	if typeRead != attinyclient.TypeVal {
+		return nil, exitcode.Wrap(exitcode.FirmwareMismatch, fmt.Errorf("device responded with '0x%x' instead of the correct type byte '%x'", typeRead, attinyclient.TypeVal))
 	}
 
 	// Check that ATtiny is running the right version of firmware.
-	majorVersionResponse, err := a.readRegister(majorVersionReg)
+	majorVersionResponse, err := a.readRegister(attinyclient.MajorVersionReg)
 	if err != nil {
-		return nil, err
+		return nil, exitcode.Wrap(exitcode.BusError, err)
 	}
 	attinyMajor, err := strconv.ParseUint(attinyMajorStr, 10, 8)
 	if err != nil {
@@ -384,12 +256,12 @@ func connectToATtiny() (*attiny, error) {
 	}
 	log.Printf("Major Version: %d", majorVersionResponse)
 	if majorVersionResponse != uint8(attinyMajor) {
-		return nil, fmt.Errorf("device major version is %d instead of %d", majorVersionResponse, attinyMajor)
+		return nil, exitcode.Wrap(exitcode.FirmwareMismatch, fmt.Errorf("device major version is %d instead of %d", majorVersionResponse, attinyMajor))
 	}
 
-	minorVersionResponse, err := a.readRegister(minorVersionReg)
+	minorVersionResponse, err := a.readRegister(attinyclient.MinorVersionReg)
 	if err != nil {
-		return nil, err
+		return nil, exitcode.Wrap(exitcode.BusError, err)
 	}
 	attinyMinor, err := strconv.ParseUint(attinyMinorStr, 10, 8)
 	if err != nil {
@@ -397,12 +269,12 @@ func connectToATtiny() (*attiny, error) {
 	}
 	log.Printf("Minor Version: %d", minorVersionResponse)
 	if minorVersionResponse != uint8(attinyMinor) {
-		return nil, fmt.Errorf("device minor version is %d instead of %d", minorVersionResponse, attinyMinor)
+		return nil, exitcode.Wrap(exitcode.FirmwareMismatch, fmt.Errorf("device minor version is %d instead of %d", minorVersionResponse, attinyMinor))
 	}
 
-	patchVersionResponse, err := a.readRegister(patchVersionReg)
+	patchVersionResponse, err := a.readRegister(attinyclient.PatchVersionReg)
 	if err != nil {
-		return nil, err
+		return nil, exitcode.Wrap(exitcode.BusError, err)
 	}
 	attinyPatch, err := strconv.ParseUint(attinyPatchStr, 10, 8)
 	if err != nil {
@@ -410,36 +282,75 @@ func connectToATtiny() (*attiny, error) {
 	}
 	log.Printf("Patch Version: %d", patchVersionResponse)
 	if patchVersionResponse != uint8(attinyPatch) {
-		return nil, fmt.Errorf("device patch version is %d instead of %d", patchVersionResponse, attinyPatch)
+		return nil, exitcode.Wrap(exitcode.FirmwareMismatch, fmt.Errorf("device patch version is %d instead of %d", patchVersionResponse, attinyPatch))
 	}
 
-	return &attiny{version: majorVersionResponse}, nil
+	return newATtiny(majorVersionResponse), nil
 }
 
 type attiny struct {
 	version uint8
+	client  *attinyclient.Client
 
 	wifiMu          sync.Mutex
-	CameraState     CameraState
-	ConnectionState ConnectionState
+	CameraState     attinyclient.CameraState
+	ConnectionState attinyclient.ConnectionState
+
+	// Held while making analog readings so the battery readings and transient sampling
+	// don't start readings on top of each other.
+	analogMu   sync.Mutex
+	transients *transientCapture // nil if transients aren't captured.
+	buzzer     *buzzer.Buzzer    // nil if there is no buzzer.
+	live       *livefeed.Feed    // nil when not running as the service.
+
+	// Calibration of the ADC readings from the config, see analog.go.
+	analogOverrides analogOverrides
+	// Quality of the voltage readings for the battery monitor, see readingquality.go.
+	analogQuality analogQuality
+	// Set from the config, see errorlog.go.
+	errorLogEnabled bool
 }
 
-func (a *attiny) writeCameraState(newState CameraState) error {
+// newATtiny returns an attiny for the given major version that talks to it over I2C with retries.
+// The fast analog readings for sampling transients poll the registers through a register reader.
+// In a dry run the writes aren't sent, see dryrun.go.
+func newATtiny(version uint8) *attiny {
+	tx := attinyclient.TxFunc(crcTxWithRetry)
+	if dryRun {
+		tx = newDryRunTx(tx).Tx
+	}
+	client := attinyclient.NewClient(tx)
+	client.SetFastRead(fastRegisterRead(i2crequest.NewRegisterReader(attinyclient.Address, true)))
+	return &attiny{version: version, client: client}
+}
+
+func (a *attiny) writeCameraState(newState attinyclient.CameraState) error {
 	mu.Lock()
 	defer mu.Unlock()
-	if err := a.writeRegister(cameraStateReg, uint8(newState), 3); err != nil {
+	write := func() error {
+		return a.writeRegister(attinyclient.CameraStateReg, uint8(newState), 3)
+	}
+	var err error
+	if newState != a.CameraState && newState != attinyclient.StatePoweringOff {
+		// Powering off is skipped as the RPi will be off before the capture finishes.
+		err = a.transients.capture(cameraStateReason(newState), write, nil)
+	} else {
+		err = write()
+	}
+	if err != nil {
 		return err
 	}
 	currentState := a.CameraState
+	a.CameraState = newState
 	if currentState != newState {
 		log.Println("Changed camera state from ", currentState, " to ", newState)
+		a.sendState()
 	}
-	a.CameraState = newState
 	return nil
 }
 
 func (a *attiny) readPiCommands(clear bool) (uint8, error) {
-	val, err := a.readRegister(piCommandsReg)
+	val, err := a.readRegister(attinyclient.PiCommandsReg)
 	if err != nil {
 		return 0, err
 	}
@@ -447,22 +358,35 @@ func (a *attiny) readPiCommands(clear bool) (uint8, error) {
 		a.writeCameraState(a.CameraState)
 	}
 	if clear {
-		return val, a.writeRegister(piCommandsReg, 0x00, 2)
+		return val, a.writeRegister(attinyclient.PiCommandsReg, 0x00, 2)
 	}
 	return val, nil
 }
 
-func (a *attiny) writeConnectionState(newState ConnectionState) error {
-	if err := a.writeRegister(cameraConnectionReg, uint8(newState), 3); err != nil {
+func (a *attiny) writeConnectionState(newState attinyclient.ConnectionState) error {
+	if err := a.writeRegister(attinyclient.CameraConnectionReg, uint8(newState), 3); err != nil {
 		return err
 	}
-	if a.ConnectionState != newState {
-		log.Println("Changed camera connection state from ", a.ConnectionState, " to ", newState)
-	}
+	currentState := a.ConnectionState
 	a.ConnectionState = newState
+	if currentState != newState {
+		log.Println("Changed camera connection state from ", currentState, " to ", newState)
+		a.sendState()
+	}
 	return nil
 }
 
+// sendState sends the camera and connection state to the live feed.
+func (a *attiny) sendState() {
+	if err := a.live.Send(livefeed.ATtinyState, livefeed.ATtinyStateSample{
+		Time:            time.Now(),
+		CameraState:     a.CameraState.String(),
+		ConnectionState: a.ConnectionState.String(),
+	}); err != nil {
+		log.Debugf("Failed to send the ATtiny state to the live feed: %v", err)
+	}
+}
+
 func (a *attiny) checkForConnectionStateUpdates() error {
 	for {
 		stateChan, done, err := netmanagerclient.GetStateChanges()
@@ -483,7 +407,7 @@ func (a *attiny) checkForConnectionStateUpdates() error {
 				log.Println(err)
 			}
 		}
-		time.Sleep(5 * time.Second)
+		time.Sleep(powerProfile.Interval(5 * time.Second))
 	}
 }
 
@@ -492,23 +416,23 @@ func (a *attiny) setConnectionState(state netmanagerclient.NetworkState) error {
 	defer a.wifiMu.Unlock()
 	switch state {
 	case netmanagerclient.NS_INIT:
-		return a.writeConnectionState(connStateWifiNoConnection)
+		return a.writeConnectionState(attinyclient.ConnStateWifiNoConnection)
 	case netmanagerclient.NS_WIFI_OFF:
-		return a.writeConnectionState(connStateWifiNoConnection)
+		return a.writeConnectionState(attinyclient.ConnStateWifiNoConnection)
 	case netmanagerclient.NS_WIFI_SETUP:
-		return a.writeConnectionState(connStateWifiSettingUp)
+		return a.writeConnectionState(attinyclient.ConnStateWifiSettingUp)
 	case netmanagerclient.NS_WIFI_SCANNING:
-		return a.writeConnectionState(connStateWifiSettingUp)
+		return a.writeConnectionState(attinyclient.ConnStateWifiSettingUp)
 	case netmanagerclient.NS_WIFI_CONNECTING:
-		return a.writeConnectionState(connStateWifiSettingUp)
+		return a.writeConnectionState(attinyclient.ConnStateWifiSettingUp)
 	case netmanagerclient.NS_WIFI_CONNECTED:
-		return a.writeConnectionState(connStateWifiConnected)
+		return a.writeConnectionState(attinyclient.ConnStateWifiConnected)
 	case netmanagerclient.NS_HOTSPOT_STARTING:
-		return a.writeConnectionState(connStateHotspotSettingUp)
+		return a.writeConnectionState(attinyclient.ConnStateHotspotSettingUp)
 	case netmanagerclient.NS_HOTSPOT_RUNNING:
-		return a.writeConnectionState(connStateHotspot)
+		return a.writeConnectionState(attinyclient.ConnStateHotspot)
 	case netmanagerclient.NS_ERROR:
-		return a.writeConnectionState(connStateWifiNoConnection) //TODO change this.
+		return a.writeConnectionState(attinyclient.ConnStateWifiNoConnection) //TODO change this.
 	default:
 		return fmt.Errorf("unknown connection state: '%s'", string(state))
 	}
@@ -517,227 +441,85 @@ func (a *attiny) setConnectionState(state netmanagerclient.NetworkState) error {
 func (a *attiny) readCameraState() error {
 	mu.Lock()
 	defer mu.Unlock()
-	state, err := a.readRegister(cameraStateReg)
+	state, err := a.readRegister(attinyclient.CameraStateReg)
 	if err != nil {
 		return err
 	}
-	a.CameraState = CameraState(state)
+	a.CameraState = attinyclient.CameraState(state)
 	return nil
 }
 
-func (a *attiny) readBattery(reg1, reg2 Register) (uint16, uint16, error) {
-	numReadings := 5
-	readings := make([]uint16, numReadings)
-	var max = uint16(0)
-	var min = uint16(math.MaxUint16)
-	for i := 0; i < numReadings; i++ {
-		val, err := a.makeIndividualAnalogReading(reg1, reg2)
-		if err != nil {
-			return 0, 0, err
-		}
-		readings[i] = val
-		if val > max {
-			max = val
-		}
-		if val < min {
-			min = val
-		}
-	}
-	log.Debugf("Analog readings. Max: %d, Min: %d", max, min)
-	diff := max - min
-	acceptableDifference := uint16(50)
-	if diff > acceptableDifference {
-		err := fmt.Errorf("difference in max and min analog readings was %d, readings were %v", diff, readings)
+func (a *attiny) readBattery(reg1, reg2 attinyclient.Register) (uint16, uint16, error) {
+	a.analogMu.Lock()
+	defer a.analogMu.Unlock()
+	avg, diff, err := a.client.ReadAveragedAnalog(reg1, reg2)
+	if err != nil {
 		return 0, 0, err
 	}
-
-	sum := 0
-	for i := 0; i < numReadings; i++ {
-		sum += int(readings[i])
-	}
-	avg := sum / numReadings
-	log.Debugf("Analog average: %d", avg)
-
-	return uint16(avg), diff, nil
+	log.Debugf("Analog average: %d, difference: %d", avg, diff)
+	return avg, diff, nil
 }
 
-func (a *attiny) makeIndividualAnalogReading(reg1, reg2 Register) (uint16, error) {
-	// Write to the 7th bit to trigger an analog reading.
-	if err := a.writeRegister(reg1, 1<<7, -1); err != nil {
-		return 0, err
-	}
-
-	// Wait for ATtiny to make the analog reading
-	time.Sleep(time.Millisecond * 200)
-
-	// Read the first register
-	val1, err := a.readRegister(reg1)
-	if err != nil {
-		return 0, err
-	}
-
-	// Check if the 7th bit has been set back to 0, indicating the analog reading has been made.
-	if (val1 & (0x01 << 7)) != 0 {
-		err := fmt.Errorf("analog reading not made")
-		log.Errorf("Error making analog reading: %v", err)
-		return 0, err
-	}
-
-	// Read the second register
-	val2, err := a.readRegister(reg2)
-	if err != nil {
-		return 0, err
-	}
-
-	// Combine the two register values
-	reading := (uint16(val1) << 8) | uint16(val2)
-	log.Debugf("Raw battery reading: %d", reading)
-	return reading, nil
+func (a *attiny) ReadRTCBattery() (float32, error) {
+	return a.readVoltage(attinyclient.BatteryLVDivVal1Reg, attinyclient.BatteryLVDivVal2Reg,
+		func(c attinyclient.AnalogConfig) attinyclient.Channel { return c.RTC })
 }
 
-/*
- Voltage Divider Circuit Diagram
-
-  V_bat
-   |
-  R1
-   |-- V_out
-  R2
-   |
-  GND
-
- V_bat = V_in * ((R1 + R2)/R2)
-*/
-
-func (a *attiny) readRTCBattery() (float32, error) {
-	raw, _, err := a.readBattery(batteryLVDivVal1Reg, batteryLVDivVal2Reg)
-	if err != nil {
-		return 0, err
-	}
-	hardwareVersion, err := eeprom.GetPowerPCBVersion()
-	if err != nil {
-		return 0, err
-	}
-	return calculateBatteryVoltage(raw, versionStr(hardwareVersion), rtcResistorVals)
+func (a *attiny) ReadLVBattery() (float32, error) {
+	return a.readVoltage(attinyclient.BatteryLVDivVal1Reg, attinyclient.BatteryLVDivVal2Reg,
+		func(c attinyclient.AnalogConfig) attinyclient.Channel { return c.LV })
 }
 
-func (a *attiny) readLVBattery() (float32, error) {
-	raw, _, err := a.readBattery(batteryLVDivVal1Reg, batteryLVDivVal2Reg)
-	if err != nil {
-		return 0, err
-	}
-	hardwareVersion, err := eeprom.GetPowerPCBVersion()
-	if err != nil {
-		return 0, err
-	}
-	return calculateBatteryVoltage(raw, versionStr(hardwareVersion), lvResistorVals)
+func (a *attiny) ReadHVBattery() (float32, error) {
+	return a.readVoltage(attinyclient.BatteryHVDivVal1Reg, attinyclient.BatteryHVDivVal2Reg,
+		func(c attinyclient.AnalogConfig) attinyclient.Channel { return c.HV })
 }
 
-func (a *attiny) readHVBattery() (float32, error) {
-	raw, _, err := a.readBattery(batteryHVDivVal1Reg, batteryHVDivVal2Reg)
+// sampleRail makes a single quick reading of the "hv" or "lv" battery rail, for sampling transients.
+func (a *attiny) sampleRail(rail string) (float32, error) {
+	c, err := a.analogConfig()
 	if err != nil {
 		return 0, err
 	}
-	hardwareVersion, err := eeprom.GetPowerPCBVersion()
-	if err != nil {
-		return 0, err
+	reg1, reg2, channel := attinyclient.BatteryHVDivVal1Reg, attinyclient.BatteryHVDivVal2Reg, c.HV
+	if rail == "lv" {
+		reg1, reg2, channel = attinyclient.BatteryLVDivVal1Reg, attinyclient.BatteryLVDivVal2Reg, c.LV
 	}
-	return calculateBatteryVoltage(raw, versionStr(hardwareVersion), hvResistorVals)
-}
-
-func calculateBatteryVoltage(raw uint16, pcbVersion versionStr, resistorVals []rVals) (float32, error) {
-	vref, r1, r2, err := getResistorDividerValuesFromVersion(pcbVersion, resistorVals)
+	a.analogMu.Lock()
+	raw, err := a.client.ReadAnalogFast(reg1, reg2)
+	a.analogMu.Unlock()
 	if err != nil {
 		return 0, err
 	}
-	v := float32(raw) * vref / 1023 // raw is from 0 to 1023, 0 at 0V and 1023 at Vref
-	return v * (r1 + r2) / (r2), nil
+	return c.Voltage(raw, channel), nil
 }
 
-var lvResistorVals = []rVals{
-	{"0.1.4", 3.3, 2000, 560 + 33},
-	{"0.1.5", 3.325, 2000, 680},
-	{"0.7.0", 3.3, 2000, 470},
-}
-
-var hvResistorVals = []rVals{
-	{"0.1.4", 3.3, 2000, 150 + 22},
-	{"0.1.5", 3.325, 2000, 168},
-	{"0.7.0", 3.3, 2000, 168},
-}
+// Power PCB version used in safe mode when the EEPROM data can't be read. This is the
+// same version that is used when a PCB doesn't have an EEPROM chip.
+const safeModePowerPCBVersion = "0.1.4"
 
-var rtcResistorVals = []rVals{
-	{"0.1.4", 3.3, 0, 1},
-	{"0.1.5", 3.325, 0, 1},
-	{"0.7.0", 3.3, 0, 1},
-}
+var eepromSafeModeOnce sync.Once
 
-func (a *attiny) checkForErrorCodes(clearErrors bool) ([]ErrorCode, error) {
-	errorIdCounter := 0
-	errorCodes := []ErrorCode{}
-	for i := 0; i < errorRegisters; i++ {
-		errorReg := Register(int(regErrors1) + i)
-		errors, err := a.readRegister(errorReg)
-		if err != nil {
-			return nil, err
-		}
-		for j := 0; j < 8; j++ {
-			if errors&(1<<j) != 0 {
-				errorCodes = append(errorCodes, ErrorCode(errorIdCounter))
-			}
-			errorIdCounter++
-		}
-	}
-	if clearErrors {
-		if err := a.writeRegister(clearErrorReg, 0, 3); err != nil {
-			return nil, err
-		}
+func getPowerPCBVersion() string {
+	hardwareVersion, err := eeprom.GetPowerPCBVersion()
+	if err != nil {
+		eepromSafeModeOnce.Do(func() {
+			log.Errorf("Failed to read power PCB version, using v%s: %v", safeModePowerPCBVersion, err)
+			eventhelper.ReportSafeMode(safeModeService, fmt.Errorf("eeprom: %v", err))
+		})
+		return safeModePowerPCBVersion
 	}
-	return errorCodes, nil
+	return hardwareVersion
 }
 
-// writeRegister writes the specified data to the given register on the attiny device.
-// If retries is 0 or above it will try to verify by reading the register back off the ATtiny.
-// Set retries to -1 if you are not wanting to verify the write operation.
-func (a *attiny) writeRegister(register Register, data uint8, retries int) error {
-	write := []byte{byte(register), data}
-	if err := crcTxWithRetry(write, nil); err != nil {
-		if retries <= 0 {
-			return err
-		}
-		time.Sleep(100 * time.Millisecond)
-		return a.writeRegister(register, data, retries-1)
-	}
-
-	if retries <= -1 {
-		return nil
-	}
-
-	// Verify the write operation by reading back the data
-	registerVal, err := a.readRegister(register)
-	if err != nil {
-		if retries == 0 {
-			return err
-		}
-		time.Sleep(100 * time.Millisecond)
-		return a.writeRegister(register, data, retries-1)
-	}
-	if registerVal != data {
-		if retries == 0 {
-			return fmt.Errorf("error writing 0x%x to register %d. Register value is 0x%x", data, register, registerVal)
-		}
-		time.Sleep(100 * time.Millisecond)
-		return a.writeRegister(register, data, retries-1)
-	}
-	return nil
+func (a *attiny) checkForErrorCodes(clearErrors bool) ([]attinyclient.ErrorCode, error) {
+	return a.client.ReadErrorCodes(clearErrors)
 }
 
-func (a *attiny) readRegister(register Register) (uint8, error) {
-	write := []byte{byte(register)}
-	read := make([]byte, 1)
-	if err := crcTxWithRetry(write, read); err != nil {
-		return 0, err
-	}
+func (a *attiny) writeRegister(register attinyclient.Register, data uint8, retries int) error {
+	return a.client.WriteRegister(register, data, retries)
+}
 
-	return uint8(read[0]), nil
+func (a *attiny) readRegister(register attinyclient.Register) (uint8, error) {
+	return a.client.ReadRegister(register)
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/window"
+)
+
+// Power to the aux connector is switched by the ATtiny, which will also cut the power
+// itself on a short circuit.
+const (
+	auxPowerMinMajorVersion = 3 // First ATtiny firmware that can switch the aux power.
+	auxPowerConfigKey       = "aux-power"
+	defaultAuxCurrentLimit  = 500 // mA
+	auxPowerCheckInterval   = 10 * time.Second
+)
+
+// auxPowerConfig is read from the "aux-power" section of the config.
+type auxPowerConfig struct {
+	Enable         bool   `mapstructure:"enable"`
+	PowerOn        string `mapstructure:"power-on"` // If not set the aux power is always on.
+	PowerOff       string `mapstructure:"power-off"`
+	CurrentLimitMA int    `mapstructure:"current-limit-ma"`
+}
+
+type auxPowerStatus struct {
+	On               bool      `json:"on"`
+	Tripped          bool      `json:"tripped"`
+	CurrentSupported bool      `json:"currentSupported"`
+	CurrentMA        int       `json:"currentMA"`
+	CurrentLimitMA   int       `json:"currentLimitMA"`
+	OverrideUntil    time.Time `json:"overrideUntil,omitempty"`
+}
+
+// auxPowerSwitch is what controls the aux power, the ATtiny or a mock for testing.
+type auxPowerSwitch interface {
+	setAuxPower(on bool) error
+	readAuxPower() (on, tripped bool, err error)
+	readAuxCurrent() (mA int, supported bool, err error)
+}
+
+func (a *attiny) hasAuxPower() bool {
+	return a.version >= auxPowerMinMajorVersion
+}
+
+func (a *attiny) setAuxPower(on bool) error {
+	return a.client.SetAuxPower(on)
+}
+
+func (a *attiny) readAuxPower() (bool, bool, error) {
+	return a.client.ReadAuxPower()
+}
+
+func (a *attiny) readAuxCurrent() (int, bool, error) {
+	return a.client.ReadAuxCurrent()
+}
+
+// auxPower switches the aux power on and off following the power window and any override,
+// and cuts the power if too much current is drawn.
+type auxPower struct {
+	sw           auxPowerSwitch
+	window       *window.Window // nil if the power is always on.
+	currentLimit int
+	now          func() time.Time
+	transients   *transientCapture
+
+	mu            sync.Mutex
+	override      *bool
+	overrideUntil time.Time
+	tripped       bool
+	status        auxPowerStatus
+}
+
+var auxPowerController *auxPower
+
+func newAuxPower(sw auxPowerSwitch, config auxPowerConfig, w *window.Window) *auxPower {
+	limit := config.CurrentLimitMA
+	if limit <= 0 {
+		limit = defaultAuxCurrentLimit
+	}
+	return &auxPower{
+		sw:           sw,
+		window:       w,
+		currentLimit: limit,
+		now:          time.Now,
+	}
+}
+
+// loadAuxPowerConfig reads the aux power config and makes the power window.
+func loadAuxPowerConfig(config *goconfig.Config) (auxPowerConfig, *window.Window, error) {
+	auxConfig := auxPowerConfig{}
+	if config == nil {
+		return auxConfig, nil, nil
+	}
+	if err := configcompat.Unmarshal(config, auxPowerConfigKey, &auxConfig); err != nil {
+		return auxConfig, nil, err
+	}
+	if auxConfig.PowerOn == "" || auxConfig.PowerOff == "" {
+		return auxConfig, nil, nil
+	}
+	location := goconfig.DefaultWindowLocation()
+	if err := config.Unmarshal(goconfig.LocationKey, &location); err != nil {
+		return auxConfig, nil, err
+	}
+	w, err := window.New(auxConfig.PowerOn, auxConfig.PowerOff, float64(location.Latitude), float64(location.Longitude))
+	return auxConfig, w, err
+}
+
+func auxPowerLoop(a *attiny, config *goconfig.Config) {
+	if !a.hasAuxPower() {
+		log.Printf("ATtiny firmware version %d can't switch the aux power", a.version)
+		return
+	}
+	auxConfig, w, err := loadAuxPowerConfig(config)
+	if err != nil {
+		log.Errorf("Failed to read aux power config: %v", err)
+		return
+	}
+	if !auxConfig.Enable {
+		return
+	}
+	p := newAuxPower(a, auxConfig, w)
+	p.transients = a.transients
+	auxPowerController = p
+	for {
+		if err := p.check(); err != nil {
+			log.Errorf("Error checking aux power: %v", err)
+		}
+		time.Sleep(powerProfile.Interval(auxPowerCheckInterval))
+	}
+}
+
+// wantOn returns if the aux power should be on, from the override or the power window.
+func (p *auxPower) wantOn(now time.Time) bool {
+	if p.override != nil {
+		if p.overrideUntil.IsZero() || now.Before(p.overrideUntil) {
+			return *p.override
+		}
+		p.override = nil
+	}
+	return p.window == nil || p.window.Active()
+}
+
+// check switches the aux power to the state it should be in and checks the load current.
+func (p *auxPower) check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	on, firmwareTripped, err := p.sw.readAuxPower()
+	if err != nil {
+		return err
+	}
+	if firmwareTripped && !p.tripped {
+		p.tripped = true
+		p.reportOvercurrent(now, -1, "attiny")
+	}
+	current, supported, err := p.sw.readAuxCurrent()
+	if err != nil {
+		return err
+	}
+	if on && supported && current > p.currentLimit {
+		log.Printf("Aux power drawing %dmA, over the %dmA limit, turning it off", current, p.currentLimit)
+		if err := p.sw.setAuxPower(false); err != nil {
+			return err
+		}
+		on = false
+		p.tripped = true
+		p.reportOvercurrent(now, current, "controller")
+	}
+
+	want := p.wantOn(now) && !p.tripped
+	if want != on {
+		log.Printf("Turning aux power %s", onOffStr(want))
+		setPower := func() error { return p.sw.setAuxPower(want) }
+		if want {
+			err = p.transients.capture("aux-power-on", setPower, p.loadCurrent)
+		} else {
+			err = setPower()
+		}
+		if err != nil {
+			return err
+		}
+		on = want
+	}
+	p.status = auxPowerStatus{
+		On:               on,
+		Tripped:          p.tripped,
+		CurrentSupported: supported,
+		CurrentMA:        current,
+		CurrentLimitMA:   p.currentLimit,
+		OverrideUntil:    p.overrideUntil,
+	}
+	return nil
+}
+
+// setOverride turns the aux power on or off for the duration, ignoring the power window.
+// A duration of 0 keeps the override until the service restarts. Turning the power on
+// also resets an overcurrent trip.
+func (p *auxPower) setOverride(on bool, duration time.Duration) error {
+	p.mu.Lock()
+	p.override = &on
+	p.overrideUntil = time.Time{}
+	if duration > 0 {
+		p.overrideUntil = p.now().Add(duration)
+	}
+	if on && p.tripped {
+		p.tripped = false
+		if err := p.sw.setAuxPower(true); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	}
+	p.mu.Unlock()
+	return p.check()
+}
+
+// loadCurrent returns the aux current in amps, for estimating the battery internal resistance.
+func (p *auxPower) loadCurrent() (float64, bool) {
+	current, supported, err := p.sw.readAuxCurrent()
+	if err != nil || !supported {
+		return 0, false
+	}
+	return float64(current) / 1000, true
+}
+
+func (p *auxPower) getStatus() auxPowerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *auxPower) reportOvercurrent(now time.Time, current int, trippedBy string) {
+	payload := eventhelper.AuxOvercurrent{
+		LimitMA:   p.currentLimit,
+		TrippedBy: trippedBy,
+	}
+	if current >= 0 {
+		payload.CurrentMA = &current
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.AuxPowerOvercurrent, now, payload)); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+}
+
+func onOffStr(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func getAuxPowerController() (*auxPower, error) {
+	if auxPowerController == nil {
+		return nil, fmt.Errorf("aux power control is not enabled")
+	}
+	return auxPowerController, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuxSwitch struct {
+	on        bool
+	tripped   bool
+	current   int
+	supported bool
+}
+
+func (m *mockAuxSwitch) setAuxPower(on bool) error {
+	m.on = on
+	m.tripped = false
+	return nil
+}
+
+func (m *mockAuxSwitch) readAuxPower() (bool, bool, error) {
+	return m.on, m.tripped, nil
+}
+
+func (m *mockAuxSwitch) readAuxCurrent() (int, bool, error) {
+	return m.current, m.supported, nil
+}
+
+func TestAuxPowerOvercurrent(t *testing.T) {
+	events := eventtest.Capture(t)
+	sw := &mockAuxSwitch{supported: true, current: 100}
+	p := newAuxPower(sw, auxPowerConfig{Enable: true, CurrentLimitMA: 300}, nil)
+
+	// No window so the power should be turned on.
+	assert.NoError(t, p.check())
+	assert.True(t, sw.on)
+
+	sw.current = 450
+	assert.NoError(t, p.check())
+	assert.False(t, sw.on)
+	assert.True(t, p.getStatus().Tripped)
+	assert.Equal(t, []string{"auxPowerOvercurrent"}, events.Types())
+	assert.Equal(t, 450, events.Events()[0].Details["currentMA"])
+
+	// Stays off until it is turned back on.
+	sw.current = 0
+	assert.NoError(t, p.check())
+	assert.False(t, sw.on)
+	assert.NoError(t, p.setOverride(true, 0))
+	assert.True(t, sw.on)
+	assert.False(t, p.getStatus().Tripped)
+	assert.Len(t, events.Events(), 1)
+}
+
+func TestAuxPowerFirmwareTrip(t *testing.T) {
+	events := eventtest.Capture(t)
+	sw := &mockAuxSwitch{tripped: true}
+	p := newAuxPower(sw, auxPowerConfig{Enable: true, CurrentLimitMA: 300}, nil)
+
+	assert.NoError(t, p.check())
+	assert.False(t, sw.on)
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "attiny", events.Events()[0].Details["trippedBy"])
+
+	// Only reported once.
+	assert.NoError(t, p.check())
+	assert.Len(t, events.Events(), 1)
+}
+
+func TestAuxPowerOverride(t *testing.T) {
+	sw := &mockAuxSwitch{}
+	p := newAuxPower(sw, auxPowerConfig{Enable: true, CurrentLimitMA: 300}, nil)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	assert.NoError(t, p.setOverride(false, time.Hour))
+	assert.False(t, sw.on)
+
+	// The override expires and the power goes back on.
+	now = now.Add(2 * time.Hour)
+	assert.NoError(t, p.check())
+	assert.True(t, sw.on)
+}
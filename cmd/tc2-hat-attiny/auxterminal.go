@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
+)
+
+const auxTerminalLeaseTimeout = time.Minute
+
+var (
+	auxTerminalMu    sync.Mutex
+	auxTerminalLease *serialhelper.SerialLease
+)
+
+// toggleAuxTerminal switches the serial port between being used for the terminal console and
+// being used by other services. When the terminal is enabled it takes ownership of the serial
+// port, forcing other services (such as tc2-hat-comms) to release it.
+func toggleAuxTerminal(a *attiny) {
+	if dryRun {
+		log.Println("Dry run: not toggling the aux terminal")
+		return
+	}
+	if serialhelper.SerialInUseFromTerminal() {
+		_, err := exec.Command("disable-aux-uart").CombinedOutput()
+		if err != nil {
+			log.Println("Error disabling aux uart:", err)
+		}
+		releaseSerialForAuxTerminal()
+	} else {
+		claimSerialForAuxTerminal()
+		_, err := exec.Command("enable-aux-uart").CombinedOutput()
+		if err != nil {
+			log.Println("Error enabling aux uart:", err)
+		}
+	}
+	a.writeAuxState()
+}
+
+// claimSerialForAuxTerminal takes ownership of the serial port for the terminal console.
+func claimSerialForAuxTerminal() {
+	auxTerminalMu.Lock()
+	defer auxTerminalMu.Unlock()
+	if auxTerminalLease != nil && auxTerminalLease.Valid() {
+		return
+	}
+	lease, err := serialhelper.AcquireSerialLease("aux-terminal", auxTerminalLeaseTimeout, 0, true)
+	if err != nil {
+		log.Println("Error getting serial lease for aux terminal:", err)
+		return
+	}
+	lease.KeepAlive()
+	auxTerminalLease = lease
+}
+
+func releaseSerialForAuxTerminal() {
+	auxTerminalMu.Lock()
+	defer auxTerminalMu.Unlock()
+	if auxTerminalLease == nil {
+		return
+	}
+	if err := auxTerminalLease.Release(); err != nil {
+		log.Println("Error releasing serial lease for aux terminal:", err)
+	}
+	auxTerminalLease = nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+)
+
+const batteryStateFile = "/etc/cacophony/battery_state.json"
+
+// exportBatteryProfile writes the learned battery state to a portable JSON profile.
+// If no voltage curve has been imported the curve from the battery config is used.
+func exportBatteryProfile(batteryConfig *goconfig.Battery, filePath string) error {
+	state, err := battery.LoadState(batteryStateFile)
+	if err != nil {
+		return err
+	}
+	if state.Chemistry == "" {
+		return fmt.Errorf("no battery chemistry has been detected yet, nothing to export")
+	}
+	profile := state.Profile()
+	if profile.VoltageCurve == nil && state.LastVoltage > 0 {
+		_, voltages, percents := batteryConfig.GetBatteryVoltageThresholds(state.LastVoltage)
+		profile.VoltageCurve = &battery.VoltageCurve{Voltages: voltages, Percents: percents}
+	}
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return err
+	}
+	log.Printf("Exported battery profile for '%s' battery to %s", profile.Chemistry, filePath)
+	return nil
+}
+
+// importBatteryProfile loads a profile exported from another device into the battery state.
+func importBatteryProfile(filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	profile := battery.Profile{}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return fmt.Errorf("failed to parse battery profile: %v", err)
+	}
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	state, err := battery.LoadState(batteryStateFile)
+	if err != nil {
+		log.Printf("Error loading current battery state, replacing it: %v", err)
+		state = &battery.State{}
+	}
+	state.ApplyProfile(profile)
+	if err := state.Save(batteryStateFile); err != nil {
+		return err
+	}
+	log.Printf("Imported battery profile for '%s' battery. Restart tc2-hat-attiny for it to take effect.", profile.Chemistry)
+	return nil
+}
+
+// migrateBatteryStateFile migrates the battery state file to the current schema version,
+// if dryRun is set the migrated state is printed instead of being saved.
+func migrateBatteryStateFile(filePath string, dryRun bool) error {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		log.Printf("No battery state file at %s, nothing to migrate", filePath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	migrated, fromVersion, err := battery.MigrateState(data)
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %v", filePath, err)
+	}
+	if fromVersion == battery.StateSchemaVersion {
+		log.Printf("Battery state is already at schema version %d", fromVersion)
+		return nil
+	}
+	log.Printf("Migrating battery state from schema version %d to %d", fromVersion, battery.StateSchemaVersion)
+	if dryRun {
+		fmt.Println(string(migrated))
+		return nil
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", filePath, fromVersion)
+	if err := os.WriteFile(backup, data, 0644); err != nil {
+		return err
+	}
+	tmpFile := filePath + ".tmp"
+	if err := os.WriteFile(tmpFile, migrated, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, filePath); err != nil {
+		return err
+	}
+	log.Printf("Migrated battery state, old state saved to %s", backup)
+	return nil
+}
+
+// migrateBatteryReadingsFile rewrites the battery readings file in the current schema, if
+// dryRun is set the migrated readings are printed instead of being saved.
+func migrateBatteryReadingsFile(filePath string, dryRun bool) error {
+	if dryRun {
+		return battery.MigrateReadingsFile(filePath, os.Stdout)
+	}
+	return battery.MigrateReadingsFile(filePath, nil)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateBatteryStateFile(t *testing.T) {
+	v0 := []byte(`{"chemistry": "Li-Ion", "cellCount": 0, "lastVoltage": 12.1}`)
+	file := filepath.Join(t.TempDir(), "battery_state.json")
+	assert.NoError(t, os.WriteFile(file, v0, 0644))
+
+	// A dry run leaves the file alone.
+	assert.NoError(t, migrateBatteryStateFile(file, true))
+	assert.Equal(t, v0, mustReadFile(t, file))
+
+	assert.NoError(t, migrateBatteryStateFile(file, false))
+	_, fromVersion, err := battery.MigrateState(mustReadFile(t, file))
+	assert.NoError(t, err)
+	assert.Equal(t, battery.StateSchemaVersion, fromVersion)
+	assert.Equal(t, v0, mustReadFile(t, file+".v0.bak"))
+}
+
+func mustReadFile(t *testing.T, file string) []byte {
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	return data
+}
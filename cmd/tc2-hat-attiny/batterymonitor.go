@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+	"github.com/TheCacophonyProject/tc2-hat-controller/cadence"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvbuffer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/journal"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+)
+
+var batteryMonitorController *battery.Monitor
+
+// The battery readings timestamps can be kept in the old local time format for parsers that
+// haven't been updated to RFC3339:
+//
+//	[battery-readings]
+//	legacy-csv-time = true
+const batteryReadingsConfigKey = "battery-readings"
+
+type batteryReadingsConfig struct {
+	LegacyCSVTime bool `mapstructure:"legacy-csv-time"`
+}
+
+// loadBatteryReadingsConfig returns the battery readings config, the default config is
+// returned with the error if it can't be read.
+func loadBatteryReadingsConfig(config *goconfig.Config) (batteryReadingsConfig, error) {
+	c := batteryReadingsConfig{}
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, batteryReadingsConfigKey, &c); err != nil {
+		return batteryReadingsConfig{}, err
+	}
+	return c, nil
+}
+
+// monitorVoltageLoop runs the battery monitor on the readings from the ATtiny.
+func monitorVoltageLoop(a *attiny, config *goconfig.Config) {
+	batteryConfig := loadBatteryConfig(config)
+	policy, err := loadPowerPolicy(config)
+	if err != nil {
+		log.Errorf("Failed to load power policy: %v", err)
+	}
+	powerPolicyController = policy
+	impedance, err := battery.LoadImpedanceConfig(config)
+	if err != nil {
+		log.Errorf("Failed to load battery impedance config: %v", err)
+	}
+	journalConfig, err := journal.LoadConfig(config)
+	if err != nil {
+		log.Errorf("Failed to load journal telemetry config: %v", err)
+	}
+	csvWrites, err := csvbuffer.LoadConfig(config)
+	if err != nil {
+		log.Errorf("Failed to load CSV write config, using defaults: %v", err)
+	}
+	readingsConfig, err := loadBatteryReadingsConfig(config)
+	if err != nil {
+		log.Errorf("Failed to load battery readings config, using defaults: %v", err)
+	}
+	m := battery.NewMonitor(a, &batteryConfig, batteryReadingsFile, batteryStateFile)
+	m.MaxReadings = batteryMaxLines
+	m.Transients = a.transients
+	m.Impedance = impedance
+	m.Cadence = powerProfile
+	m.Buzzer = a.buzzer
+	m.Journal = journal.New(journalConfig, "tc2-hat-attiny")
+	m.Live = a.live
+	m.Readings = csvbuffer.New(batteryReadingsFile, batterycsv.Header(), csvWrites)
+	m.LegacyTime = readingsConfig.LegacyCSVTime
+	m.OnStatus = func(status battery.Status) {
+		rtcBackupController.update(status.RTCBattery)
+		setBatteryStatus(status)
+	}
+	if policy != nil {
+		m.OnHoursRemaining = func(hours float64, now time.Time) {
+			policy.update(hours, now)
+		}
+	}
+	m.OnLevel = func(level cadence.Level) {
+		sosBeaconController.checkBattery(level == cadence.Critical)
+	}
+	batteryMonitorController = m
+	if err := m.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadBatteryConfig returns the battery config, falling back to the defaults in safe mode
+// if it can't be read so the battery is still monitored.
+func loadBatteryConfig(config *goconfig.Config) goconfig.Battery {
+	batteryConfig := goconfig.DefaultBattery()
+	if config == nil {
+		return batteryConfig
+	}
+	if err := config.Unmarshal(goconfig.BatteryKey, &batteryConfig); err != nil {
+		log.Errorf("Failed to read battery config, using defaults: %v", err)
+		eventhelper.ReportSafeMode(safeModeService, fmt.Errorf("battery config: %v", err))
+		return goconfig.DefaultBattery()
+	}
+	return batteryConfig
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+	"github.com/godbus/dbus"
+)
+
+// After swapping the battery pack a technician runs `tc2-hat-attiny battery replaced`, or
+// calls BatteryReplaced on D-Bus, so the battery state is started afresh for the new pack,
+// see pkg/battery/swap.go.
+type BatteryReplacedCmd struct {
+	OldPack string `arg:"--old-pack" help:"Identity of the pack taken out, such as its serial number, defaults to the new pack of the last swap."`
+	NewPack string `arg:"--new-pack" help:"Identity of the pack put in."`
+}
+
+// runBatteryReplaced records a battery swap with the running service, or in the battery state
+// file if the service isn't running.
+func runBatteryReplaced(args *BatteryReplacedCmd) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	running := false
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, dbusName).Store(&running); err != nil {
+		return err
+	}
+	if running {
+		if err := conn.Object(dbusName, dbusPath).Call(dbusName+".BatteryReplaced", 0, args.OldPack, args.NewPack).Err; err != nil {
+			return err
+		}
+		log.Println("Battery swap recorded")
+		return nil
+	}
+
+	state, err := battery.LoadState(batteryStateFile)
+	if err != nil {
+		log.Printf("Error loading current battery state, replacing it: %v", err)
+		state = &battery.State{}
+	}
+	now := time.Now()
+	old := state.ReplacePack(args.NewPack, now)
+	if err := state.Save(batteryStateFile); err != nil {
+		return err
+	}
+	if err := eventhelper.AddEvent(battery.SwapEvent(battery.Swap{OldPack: args.OldPack, NewPack: args.NewPack}, old, now)); err != nil {
+		return fmt.Errorf("failed to add the batteryReplaced event: %v", err)
+	}
+	log.Println("Battery swap recorded in the battery state, tc2-hat-attiny isn't running")
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// The ATtiny powers the camera (the RPi) on and off, so for the lifetime of the hardware the
+// number of power cycles, the hours it has been powered on and how long it takes to boot are
+// saved in cameraPowerFile. A power cycle is counted once for each RPi boot ID, so restarting
+// the service isn't counted. The boot duration is the RPi uptime when the ATtiny is told the
+// camera is powered on. The powered on time is from the uptime, so it isn't thrown out by the
+// clock being set, and is saved every cameraPowerCheckInterval and when powering off.
+//
+// A cameraPowerDailySummary event is made each day with the power cycles, powered on hours
+// and average boot duration for the day and the totals. The totals are also in the device
+// twin and can be printed with --camera-power.
+const (
+	cameraPowerFile          = "/etc/cacophony/camera-power.json"
+	uptimeFile               = "/proc/uptime"
+	cameraPowerCheckInterval = 5 * time.Minute
+	cameraPowerReportPeriod  = 24 * time.Hour
+)
+
+// cameraPowerTotals are the power cycles, powered on time and boot durations counted.
+type cameraPowerTotals struct {
+	PowerCycles      int     `json:"powerCycles"`
+	PoweredOnSeconds float64 `json:"poweredOnSeconds"`
+	Boots            int     `json:"boots"` // Boots with a boot duration.
+	BootSeconds      float64 `json:"bootSeconds"`
+}
+
+// avgBootSeconds returns the average boot duration, 0 if there are none.
+func (t cameraPowerTotals) avgBootSeconds() float64 {
+	if t.Boots == 0 {
+		return 0
+	}
+	return t.BootSeconds / float64(t.Boots)
+}
+
+func (t cameraPowerTotals) payload() eventhelper.CameraPowerTotals {
+	return eventhelper.CameraPowerTotals{
+		PowerCycles:    t.PowerCycles,
+		PoweredOnHours: math.Round(t.PoweredOnSeconds/36) / 100,
+		AvgBootSeconds: round1(t.avgBootSeconds()),
+	}
+}
+
+func (t *cameraPowerTotals) add(cycles int, onSeconds float64, bootSeconds float64) {
+	t.PowerCycles += cycles
+	t.PoweredOnSeconds += onSeconds
+	if bootSeconds > 0 {
+		t.Boots++
+		t.BootSeconds += bootSeconds
+	}
+}
+
+// cameraPowerStats are saved in cameraPowerFile.
+type cameraPowerStats struct {
+	Total cameraPowerTotals `json:"total"`
+	// Counted since the last daily summary.
+	Day        cameraPowerTotals `json:"day"`
+	ReportTime time.Time         `json:"reportTime"` // Start of the current report period.
+	// Boot the powered on time was last counted on and the uptime it was counted to.
+	BootID        string    `json:"bootID"`
+	UptimeSeconds float64   `json:"uptimeSeconds"`
+	Updated       time.Time `json:"updated"`
+}
+
+// cameraPowerTracker counts the camera power cycles and powered on time.
+type cameraPowerTracker struct {
+	file   string
+	bootID func() (string, error)
+	uptime func() (time.Duration, error)
+	now    func() time.Time
+
+	mu    sync.Mutex
+	stats cameraPowerStats
+}
+
+var cameraPowerController *cameraPowerTracker
+
+func newCameraPowerTracker() *cameraPowerTracker {
+	return &cameraPowerTracker{
+		file:   cameraPowerFile,
+		bootID: readBootID,
+		uptime: readUptime,
+		now:    time.Now,
+	}
+}
+
+func loadCameraPowerStats(file string) (cameraPowerStats, error) {
+	stats := cameraPowerStats{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	return stats, json.Unmarshal(data, &stats)
+}
+
+func (t *cameraPowerTracker) save() error {
+	data, err := json.MarshalIndent(t.stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := t.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.file)
+}
+
+// start loads the saved stats and counts the boot, if it hasn't been counted already. Call it
+// once the ATtiny has been told the camera is powered on.
+func (t *cameraPowerTracker) start() error {
+	stats, err := loadCameraPowerStats(t.file)
+	if err != nil {
+		log.Printf("Failed to load camera power stats, starting again: %v", err)
+	}
+	t.mu.Lock()
+	t.stats = stats
+	t.mu.Unlock()
+	return t.update()
+}
+
+// update counts the powered on time since it was last counted, and the boot if this is a new
+// boot, reporting the daily summary when the report period is up.
+func (t *cameraPowerTracker) update() error {
+	if t == nil {
+		return nil
+	}
+	bootID, err := t.bootID()
+	if err != nil {
+		return err
+	}
+	uptime, err := t.uptime()
+	if err != nil {
+		return err
+	}
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.stats
+	if s.ReportTime.IsZero() || s.ReportTime.After(now) {
+		s.ReportTime = now
+	}
+	if bootID != s.BootID {
+		// The RPi was on for the uptime before being counted, which is also how long it took to boot.
+		log.Printf("Camera powered on, booted in %s", uptime.Round(time.Second))
+		s.Total.add(1, uptime.Seconds(), uptime.Seconds())
+		s.Day.add(1, uptime.Seconds(), uptime.Seconds())
+	} else if on := uptime.Seconds() - s.UptimeSeconds; on > 0 {
+		s.Total.add(0, on, 0)
+		s.Day.add(0, on, 0)
+	}
+	s.BootID = bootID
+	s.UptimeSeconds = uptime.Seconds()
+	s.Updated = now
+	if now.Sub(s.ReportTime) >= cameraPowerReportPeriod {
+		t.report(now)
+	}
+	return t.save()
+}
+
+// report makes a cameraPowerDailySummary event and starts a new report period.
+func (t *cameraPowerTracker) report(now time.Time) {
+	s := &t.stats
+	period := now.Sub(s.ReportTime)
+	day := s.Day.payload()
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.CameraPowerDailySummary, now, eventhelper.CameraPowerSummary{
+		PowerCycles:    day.PowerCycles,
+		PoweredOnHours: day.PoweredOnHours,
+		AvgBootSeconds: day.AvgBootSeconds,
+		PeriodSeconds:  int(period.Seconds()),
+		OnPercent:      round1(100 * s.Day.PoweredOnSeconds / period.Seconds()),
+		Total:          s.Total.payload(),
+	})); err != nil {
+		log.Printf("Error adding event: %v", err)
+		return
+	}
+	s.Day = cameraPowerTotals{}
+	s.ReportTime = now
+}
+
+// run updates the camera power stats every cameraPowerCheckInterval.
+func (t *cameraPowerTracker) run() {
+	for {
+		time.Sleep(powerProfile.Interval(cameraPowerCheckInterval))
+		if err := t.update(); err != nil {
+			log.Printf("Failed to update the camera power stats: %v", err)
+		}
+	}
+}
+
+func readUptime() (time.Duration, error) {
+	data, err := os.ReadFile(uptimeFile)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("no uptime in %s", uptimeFile)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// printCameraPower prints the saved camera power stats.
+func printCameraPower() error {
+	stats, err := loadCameraPowerStats(cameraPowerFile)
+	if err != nil {
+		return err
+	}
+	if stats.Updated.IsZero() {
+		return fmt.Errorf("no camera power stats have been saved yet")
+	}
+	total := stats.Total
+	log.Printf("Power cycles: %d", total.PowerCycles)
+	log.Printf("Powered on: %.1f hours", total.PoweredOnSeconds/3600)
+	log.Printf("Average boot duration: %.1fs over %d boots", total.avgBootSeconds(), total.Boots)
+	log.Printf("Since %s: %d power cycles, %.1f hours powered on", stats.ReportTime.Format(time.DateTime), stats.Day.PowerCycles, stats.Day.PoweredOnSeconds/3600)
+	log.Printf("Last updated %s", stats.Updated.Format(time.DateTime))
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCameraPowerTracker(t *testing.T) {
+	now := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	bootID := "boot1"
+	uptime := 40 * time.Second
+	events := eventtest.Capture(t)
+	newTracker := func(file string) *cameraPowerTracker {
+		return &cameraPowerTracker{
+			file:   file,
+			bootID: func() (string, error) { return bootID, nil },
+			uptime: func() (time.Duration, error) { return uptime, nil },
+			now:    func() time.Time { return now },
+		}
+	}
+	file := filepath.Join(t.TempDir(), "camera-power.json")
+	tracker := newTracker(file)
+	assert.NoError(t, tracker.start())
+
+	// Restarting the service on the same boot isn't another power cycle.
+	now = now.Add(2 * time.Hour)
+	uptime += 2 * time.Hour
+	tracker = newTracker(file)
+	assert.NoError(t, tracker.start())
+	assert.Equal(t, cameraPowerTotals{
+		PowerCycles:      1,
+		PoweredOnSeconds: 7240,
+		Boots:            1,
+		BootSeconds:      40,
+	}, tracker.stats.Total)
+
+	now = now.Add(20 * time.Hour)
+	bootID = "boot2"
+	uptime = 20 * time.Second
+	assert.NoError(t, tracker.update())
+	assert.Empty(t, events.Events())
+
+	now = now.Add(2 * time.Hour)
+	uptime += 2 * time.Hour
+	assert.NoError(t, tracker.update())
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "cameraPowerDailySummary", events.Events()[0].Type)
+	assert.Equal(t, 2, events.Events()[0].Details["powerCycles"])
+	assert.Equal(t, 4.02, events.Events()[0].Details["poweredOnHours"])
+	assert.Equal(t, 30.0, events.Events()[0].Details["avgBootSeconds"])
+	assert.Equal(t, 16.7, events.Events()[0].Details["onPercent"])
+	assert.Equal(t, cameraPowerTotals{}, tracker.stats.Day)
+
+	saved, err := loadCameraPowerStats(file)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, saved.Total.PowerCycles)
+	assert.Equal(t, now, saved.ReportTime)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+// Consumables for a trap, such as bait or a CO2 canister, can be monitored with a level or
+// pressure sensor so servicing trips can be planned from how fast they are actually used.
+// Each sensor has its own section in the config:
+//
+//	[consumables.bait]
+//	source = "attiny"
+//	empty = 120
+//	full = 880
+//	low-percent = 20
+//
+//	[consumables.co2]
+//	source = "i2c"
+//	address = 0x28
+//	register = 0
+//	empty = 1638
+//	full = 14745
+//	low-percent = 25
+//
+// A sensor with the "attiny" source is read from the external analog channel of the ATtiny.
+// One with the "i2c" source is read as a big endian number of length bytes, default 2, from
+// the register of the I2C device. empty and full are the raw readings when the consumable is
+// empty and full, full is less than empty for a sensor that reads lower as it fills.
+//
+// A consumableLevels event is made each day with the level of each consumable, how much was
+// used per day and how many days are left at that rate. A consumableLow event is made when a
+// level drops below low-percent, and not again until it has been refilled. The levels are
+// saved so the daily usage carries over the RPi being powered off.
+const (
+	consumablesConfigKey     = "consumables"
+	consumablesFile          = "/etc/cacophony/consumables.json"
+	consumablesCheckInterval = 10 * time.Minute
+	consumablesReportPeriod  = 24 * time.Hour
+	// A rise in the level bigger than this is a refill, smaller rises are noise.
+	consumableRefillPercent = 10
+	// The level has to go this far back above low-percent before it can be low again.
+	consumableLowHysteresis = 5
+	consumableI2CTimeout    = 1000 // ms
+)
+
+// consumableSensor is the config for one consumable sensor.
+type consumableSensor struct {
+	Source     string  `mapstructure:"source"` // "attiny" or "i2c".
+	Address    int     `mapstructure:"address"`
+	Register   int     `mapstructure:"register"`
+	Length     int     `mapstructure:"length"`
+	Empty      float64 `mapstructure:"empty"`
+	Full       float64 `mapstructure:"full"`
+	LowPercent float64 `mapstructure:"low-percent"`
+}
+
+// loadConsumables returns the config for each consumable sensor, checking it is valid.
+func loadConsumables(config *goconfig.Config) (map[string]consumableSensor, error) {
+	sensors := map[string]consumableSensor{}
+	if config == nil {
+		return sensors, nil
+	}
+	if err := configcompat.Unmarshal(config, consumablesConfigKey, &sensors); err != nil {
+		return nil, err
+	}
+	for name, s := range sensors {
+		if s.Length == 0 {
+			s.Length = 2
+		}
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("consumable '%s': %v", name, err)
+		}
+		sensors[name] = s
+	}
+	return sensors, nil
+}
+
+func (s consumableSensor) validate() error {
+	switch s.Source {
+	case "attiny":
+	case "i2c":
+		if s.Address <= 0 || s.Address > 0x7F || s.Register < 0 || s.Register > 0xFF {
+			return fmt.Errorf("invalid I2C address 0x%x or register 0x%x", s.Address, s.Register)
+		}
+		if s.Length < 1 || s.Length > 4 {
+			return fmt.Errorf("length must be from 1 to 4 bytes")
+		}
+	default:
+		return fmt.Errorf("unknown source '%s'", s.Source)
+	}
+	if s.Empty == s.Full {
+		return fmt.Errorf("empty and full can't be the same")
+	}
+	if s.LowPercent < 0 || s.LowPercent >= 100 {
+		return fmt.Errorf("low-percent must be from 0 to 100")
+	}
+	return nil
+}
+
+// level returns the raw reading as a percentage of full.
+func (s consumableSensor) level(raw float64) float64 {
+	level := (raw - s.Empty) / (s.Full - s.Empty) * 100
+	return math.Max(0, math.Min(100, level))
+}
+
+// consumableState is the saved level of one consumable.
+type consumableState struct {
+	Level float64 `json:"level"`
+	Raw   float64 `json:"raw"`
+	// Level after the last report or refill, the usage since is measured from this.
+	StartLevel float64 `json:"startLevel"`
+	// Usage before the last refill since the last report.
+	Used    float64 `json:"used"`
+	Refills int     `json:"refills"`
+	Low     bool    `json:"low"`
+}
+
+type consumablesState struct {
+	ReportTime  time.Time                   `json:"reportTime"` // Start of the current report period.
+	Consumables map[string]*consumableState `json:"consumables"`
+}
+
+// consumablesTracker reads the consumable sensors and reports the levels.
+type consumablesTracker struct {
+	sensors map[string]consumableSensor
+	file    string
+	now     func() time.Time
+	read    func(consumableSensor) (float64, error)
+	state   consumablesState
+}
+
+func newConsumablesTracker(sensors map[string]consumableSensor, read func(consumableSensor) (float64, error)) *consumablesTracker {
+	return &consumablesTracker{
+		sensors: sensors,
+		file:    consumablesFile,
+		now:     time.Now,
+		read:    read,
+	}
+}
+
+func (t *consumablesTracker) load() error {
+	t.state = consumablesState{Consumables: map[string]*consumableState{}}
+	data, err := os.ReadFile(t.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &t.state); err != nil {
+		t.state = consumablesState{Consumables: map[string]*consumableState{}}
+		return fmt.Errorf("failed to parse '%s', starting again: %v", t.file, err)
+	}
+	if t.state.Consumables == nil {
+		t.state.Consumables = map[string]*consumableState{}
+	}
+	return nil
+}
+
+func (t *consumablesTracker) save() error {
+	data, err := json.MarshalIndent(t.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+// check reads each sensor, reporting the levels when the report period is up.
+func (t *consumablesTracker) check() error {
+	now := t.now()
+	if t.state.ReportTime.IsZero() || t.state.ReportTime.After(now) {
+		t.state.ReportTime = now
+	}
+	names := make([]string, 0, len(t.sensors))
+	for name := range t.sensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := t.sensors[name]
+		raw, err := t.read(s)
+		if err != nil {
+			log.Errorf("Failed to read consumable '%s': %v", name, err)
+			continue
+		}
+		t.update(name, s, raw, now)
+	}
+	if now.Sub(t.state.ReportTime) >= consumablesReportPeriod {
+		t.report(now)
+	}
+	return t.save()
+}
+
+func (t *consumablesTracker) update(name string, s consumableSensor, raw float64, now time.Time) {
+	level := s.level(raw)
+	c, ok := t.state.Consumables[name]
+	if !ok {
+		c = &consumableState{Level: level, StartLevel: level}
+		t.state.Consumables[name] = c
+	}
+	if level-c.Level > consumableRefillPercent {
+		log.Infof("Consumable '%s' refilled from %.0f%% to %.0f%%", name, c.Level, level)
+		c.Used += math.Max(0, c.StartLevel-c.Level)
+		c.StartLevel = level
+		c.Refills++
+	}
+	c.Level = level
+	c.Raw = raw
+
+	if c.Low && level >= s.LowPercent+consumableLowHysteresis {
+		c.Low = false
+	}
+	if !c.Low && level < s.LowPercent {
+		c.Low = true
+		log.Infof("Consumable '%s' is low, %.0f%%", name, level)
+		payload := eventhelper.ConsumableAlert{
+			Name:         name,
+			LevelPercent: round1(level),
+			LowPercent:   s.LowPercent,
+		}
+		if days, ok := t.daysRemaining(c, now); ok {
+			payload.DaysRemaining = &days
+		}
+		if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ConsumableLow, now, payload)); err != nil {
+			log.Errorf("Error adding event: %v", err)
+		}
+	}
+}
+
+// usedPerDay returns the percentage used per day since the last report.
+func (t *consumablesTracker) usedPerDay(c *consumableState, now time.Time) float64 {
+	days := now.Sub(t.state.ReportTime).Hours() / 24
+	if days <= 0 {
+		return 0
+	}
+	return (c.Used + math.Max(0, c.StartLevel-c.Level)) / days
+}
+
+// daysRemaining returns how many days are left at the current usage, false if there hasn't
+// been any usage.
+func (t *consumablesTracker) daysRemaining(c *consumableState, now time.Time) (float64, bool) {
+	perDay := t.usedPerDay(c, now)
+	if perDay <= 0 {
+		return 0, false
+	}
+	return round1(c.Level / perDay), true
+}
+
+// report makes a consumableLevels event and starts a new report period.
+func (t *consumablesTracker) report(now time.Time) {
+	levels := map[string]eventhelper.ConsumableLevel{}
+	for name, c := range t.state.Consumables {
+		if _, ok := t.sensors[name]; !ok {
+			// No longer in the config.
+			delete(t.state.Consumables, name)
+			continue
+		}
+		level := eventhelper.ConsumableLevel{
+			LevelPercent:      round1(c.Level),
+			Raw:               c.Raw,
+			UsedPercentPerDay: round1(t.usedPerDay(c, now)),
+			Refills:           c.Refills,
+			Low:               c.Low,
+		}
+		if days, ok := t.daysRemaining(c, now); ok {
+			level.DaysRemaining = &days
+		}
+		levels[name] = level
+		c.StartLevel = c.Level
+		c.Used = 0
+		c.Refills = 0
+	}
+	if len(levels) > 0 {
+		if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ConsumableLevels, now, eventhelper.ConsumableReport{
+			Consumables:   levels,
+			PeriodSeconds: int(now.Sub(t.state.ReportTime).Seconds()),
+		})); err != nil {
+			log.Errorf("Error adding event: %v", err)
+		}
+	}
+	t.state.ReportTime = now
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+func (a *attiny) hasExternalAnalog() bool {
+	return a.version >= attinyclient.ExternalAnalogMinMajorVersion
+}
+
+// readConsumable makes a raw reading from a consumable sensor.
+func (a *attiny) readConsumable(s consumableSensor) (float64, error) {
+	if s.Source == "i2c" {
+		data, err := i2crequest.Tx(byte(s.Address), []byte{byte(s.Register)}, s.Length, consumableI2CTimeout)
+		if err != nil {
+			return 0, err
+		}
+		raw := uint32(0)
+		for _, b := range data {
+			raw = raw<<8 | uint32(b)
+		}
+		return float64(raw), nil
+	}
+	if !a.hasExternalAnalog() {
+		return 0, fmt.Errorf("ATtiny firmware version %d does not have the external analog channel", a.version)
+	}
+	raw, _, err := a.readBattery(attinyclient.ExternalAnalog1Reg, attinyclient.ExternalAnalog2Reg)
+	return float64(raw), err
+}
+
+// consumablesLoop reads the consumable sensors in the config every consumablesCheckInterval.
+func consumablesLoop(a *attiny, config *goconfig.Config) {
+	sensors, err := loadConsumables(config)
+	if err != nil {
+		log.Errorf("Failed to read the consumables config: %v", err)
+		return
+	}
+	if len(sensors) == 0 {
+		return
+	}
+	t := newConsumablesTracker(sensors, a.readConsumable)
+	if err := t.load(); err != nil {
+		log.Errorf("Failed to load the consumable levels: %v", err)
+	}
+	for {
+		if err := t.check(); err != nil {
+			log.Errorf("Error checking consumables: %v", err)
+		}
+		time.Sleep(powerProfile.Interval(consumablesCheckInterval))
+	}
+}
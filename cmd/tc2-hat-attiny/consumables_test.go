@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumableLevel(t *testing.T) {
+	s := consumableSensor{Empty: 100, Full: 900}
+	assert.Equal(t, 50.0, s.level(500))
+	assert.Equal(t, 0.0, s.level(50))
+	assert.Equal(t, 100.0, s.level(1000))
+	// A sensor that reads lower as it fills.
+	s = consumableSensor{Empty: 900, Full: 100}
+	assert.Equal(t, 25.0, s.level(700))
+}
+
+func TestConsumablesTracker(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	raw := 900.0
+	events := eventtest.Capture(t)
+	sensors := map[string]consumableSensor{"bait": {Source: "attiny", Empty: 100, Full: 900, LowPercent: 20}}
+	file := filepath.Join(t.TempDir(), "consumables.json")
+	newTracker := func() *consumablesTracker {
+		tr := newConsumablesTracker(sensors, func(consumableSensor) (float64, error) { return raw, nil })
+		tr.file = file
+		tr.now = func() time.Time { return now }
+		assert.NoError(t, tr.load())
+		return tr
+	}
+
+	tr := newTracker()
+	assert.NoError(t, tr.check())
+	// 20% is used over the day, the tracker is restarted part way through.
+	now = now.Add(12 * time.Hour)
+	raw = 820
+	assert.NoError(t, tr.check())
+	tr = newTracker()
+	now = now.Add(12 * time.Hour)
+	raw = 740
+	assert.NoError(t, tr.check())
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "consumableLevels", events.Events()[0].Type)
+		assert.Equal(t, map[string]interface{}{
+			"levelPercent":      80.0,
+			"raw":               740.0,
+			"usedPercentPerDay": 20.0,
+			"refills":           0,
+			"low":               false,
+			"daysRemaining":     4.0,
+		}, events.Events()[0].Details["consumables"].(map[string]interface{})["bait"])
+	}
+
+	// Dropping below low-percent is reported once.
+	events.Reset()
+	now = now.Add(time.Hour)
+	raw = 200
+	assert.NoError(t, tr.check())
+	now = now.Add(time.Hour)
+	raw = 190
+	assert.NoError(t, tr.check())
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "consumableLow", events.Events()[0].Type)
+		assert.Equal(t, 12.5, events.Events()[0].Details["levelPercent"])
+	}
+
+	// Refilled, the usage before the refill still counts.
+	events.Reset()
+	now = now.Add(22 * time.Hour)
+	raw = 900
+	assert.NoError(t, tr.check())
+	if assert.Len(t, events.Events(), 1) {
+		bait := events.Events()[0].Details["consumables"].(map[string]interface{})["bait"].(map[string]interface{})
+		assert.Equal(t, 100.0, bait["levelPercent"])
+		assert.Equal(t, 1, bait["refills"])
+		assert.Equal(t, false, bait["low"])
+		assert.Equal(t, 68.8, bait["usedPercentPerDay"])
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+// With --dry-run the service runs as normal but doesn't change anything on the hardware, so
+// changes to the power management can be tried on a live device. Register writes, such as
+// the camera state, are logged instead of sent to the ATtiny, the RPi isn't powered off and
+// the firmware isn't reprogrammed. Reads still come from the ATtiny, or the simulator when
+// tc2-hat-i2c is running with it. A register that was written reads back as the value
+// written until the ATtiny changes it, so the service sees its own writes.
+var dryRun = false
+
+// dryRunTx wraps the transactions with the ATtiny for a dry run.
+type dryRunTx struct {
+	tx attinyclient.TxFunc
+
+	mu      sync.Mutex
+	written map[attinyclient.Register]dryRunWrite
+}
+
+// dryRunWrite is a write that wasn't made, with what the register held at the time.
+type dryRunWrite struct {
+	value    uint8
+	hardware uint8
+}
+
+func newDryRunTx(tx attinyclient.TxFunc) *dryRunTx {
+	return &dryRunTx{tx: tx, written: map[attinyclient.Register]dryRunWrite{}}
+}
+
+// Tx is an attinyclient.TxFunc that doesn't send writes to the ATtiny.
+func (d *dryRunTx) Tx(write, read []byte) error {
+	if len(write) == 2 && len(read) == 0 {
+		register, value := attinyclient.Register(write[0]), write[1]
+		if readOnlyWrite(register, value) {
+			return d.tx(write, read)
+		}
+		hardware := make([]byte, 1)
+		if err := d.tx(write[:1], hardware); err != nil {
+			return err
+		}
+		log.Printf("Dry run: not writing 0x%02x to register 0x%02x", value, register)
+		d.mu.Lock()
+		d.written[register] = dryRunWrite{value: value, hardware: hardware[0]}
+		d.mu.Unlock()
+		return nil
+	}
+
+	if err := d.tx(write, read); err != nil || len(write) != 1 || len(read) != 1 {
+		return err
+	}
+	register := attinyclient.Register(write[0])
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if w, ok := d.written[register]; ok {
+		if read[0] == w.hardware {
+			read[0] = w.value
+		} else {
+			// The ATtiny has changed the register since, so it's the value to use now.
+			delete(d.written, register)
+		}
+	}
+	return nil
+}
+
+// readOnlyWrite returns true for writes that only start a reading or pick what is read next,
+// these are still made in a dry run so the readings are real.
+func readOnlyWrite(register attinyclient.Register, value uint8) bool {
+	switch register {
+	case attinyclient.BatteryLVDivVal1Reg, attinyclient.BatteryHVDivVal1Reg, attinyclient.RTCBattery1Reg:
+		return value&attinyclient.AnalogReadingStart != 0
+	case attinyclient.ErrorLogSelectReg:
+		return true
+	}
+	return false
+}
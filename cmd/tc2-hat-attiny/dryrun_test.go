@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunTx(t *testing.T) {
+	registers := map[byte]byte{byte(attinyclient.CameraStateReg): 0x02}
+	writes := 0
+	d := newDryRunTx(func(write, read []byte) error {
+		if len(read) == 0 {
+			writes++
+			registers[write[0]] = write[1]
+			return nil
+		}
+		read[0] = registers[write[0]]
+		return nil
+	})
+	client := attinyclient.NewClient(d.Tx)
+
+	// The write isn't made but reads back as written.
+	assert.NoError(t, client.WriteRegister(attinyclient.CameraStateReg, 0x04, 3))
+	assert.Zero(t, writes)
+	assert.Equal(t, byte(0x02), registers[byte(attinyclient.CameraStateReg)])
+	val, err := client.ReadRegister(attinyclient.CameraStateReg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x04), val)
+
+	// Until the ATtiny changes the register.
+	registers[byte(attinyclient.CameraStateReg)] = 0x03
+	val, err = client.ReadRegister(attinyclient.CameraStateReg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x03), val)
+
+	// Starting an analog reading is still written.
+	assert.NoError(t, client.WriteRegister(attinyclient.BatteryHVDivVal1Reg, attinyclient.AnalogReadingStart, -1))
+	assert.Equal(t, 1, writes)
+}
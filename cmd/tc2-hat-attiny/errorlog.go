@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+// The persistent error log needs ATtiny firmware that isn't released yet, so it is only used
+// once it is enabled in the config, for trying out firmware with the error log:
+//
+//	[attiny-error-log]
+//	enable = true
+const errorLogConfigKey = "attiny-error-log"
+
+type errorLogConfig struct {
+	Enable bool `mapstructure:"enable"`
+}
+
+func loadErrorLogConfig(config *goconfig.Config) (errorLogConfig, error) {
+	c := errorLogConfig{}
+	if config == nil {
+		return c, nil
+	}
+	err := configcompat.Unmarshal(config, errorLogConfigKey, &c)
+	return c, err
+}
+
+func (a *attiny) hasErrorLog() bool {
+	return a.errorLogEnabled && a.version >= attinyclient.ErrorLogMinMajorVersion
+}
+
+func (a *attiny) errorLogUnavailable() error {
+	if !a.errorLogEnabled {
+		return fmt.Errorf("the ATtiny error log isn't enabled in the %s config", errorLogConfigKey)
+	}
+	return fmt.Errorf("ATtiny firmware version %d does not have an error log", a.version)
+}
+
+// readErrorLog downloads and decodes the persistent error log from the ATtiny, oldest entry
+// first. The log is left on the ATtiny, see clearErrorLog.
+func (a *attiny) readErrorLog() ([]attinyclient.ErrorLogEntry, error) {
+	if !a.hasErrorLog() {
+		return nil, a.errorLogUnavailable()
+	}
+	return a.client.ReadErrorLog(time.Now())
+}
+
+func (a *attiny) clearErrorLog() error {
+	if !a.hasErrorLog() {
+		return a.errorLogUnavailable()
+	}
+	return a.client.ClearErrorLog()
+}
+
+// syncErrorLog moves the errors from the ATtiny error log into the event stream, with
+// the time they happened, then clears the log on the ATtiny.
+func syncErrorLog(a *attiny) {
+	if !a.hasErrorLog() {
+		return
+	}
+	entries, err := a.readErrorLog()
+	if err != nil {
+		log.Println("Error reading ATtiny error log:", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	log.Printf("Found %d errors in the ATtiny error log", len(entries))
+	for _, entry := range entries {
+		err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ATtinyError, entry.Time, eventhelper.ATtinyErrors{
+			Errors:          []string{entry.Error},
+			FromErrorLog:    true,
+			ApproximateTime: true,
+		}))
+		if err != nil {
+			// Don't clear the log so the errors can be added next time.
+			log.Println("Error adding event:", err)
+			return
+		}
+	}
+	if err := a.clearErrorLog(); err != nil {
+		log.Println("Error clearing ATtiny error log:", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorLogVersion(t *testing.T) {
+	a := &attiny{version: 1, errorLogEnabled: true}
+	assert.False(t, a.hasErrorLog())
+	_, err := a.readErrorLog()
+	assert.Error(t, err)
+	assert.Error(t, a.clearErrorLog())
+
+	a = &attiny{version: attinyclient.ErrorLogMinMajorVersion, errorLogEnabled: true}
+	assert.True(t, a.hasErrorLog())
+
+	// Held back until it is enabled in the config.
+	a = &attiny{version: attinyclient.ErrorLogMinMajorVersion}
+	assert.False(t, a.hasErrorLog())
+	_, err = a.readErrorLog()
+	assert.Error(t, err)
+}
+
+func TestLoadErrorLogConfig(t *testing.T) {
+	c, err := loadErrorLogConfig(nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Enable)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+)
+
+// An attinyLinkDegraded event is made when too many of the recent attempts at talking to the
+// ATtiny fail, the percentage can be changed in the config:
+//
+//	[attiny-link]
+//	degraded-percent = 10
+const (
+	linkConfigKey = "attiny-link"
+
+	linkWindowSize       = 100 // Number of recent attempts used to calculate the failure rate.
+	linkMinWindowSamples = 20  // Don't raise an alarm until there are enough attempts to be meaningful.
+	linkAlarmInterval    = 6 * time.Hour
+)
+
+var (
+	linkStats = newATtinyLinkStats()
+
+	// Percentage of failed attempts in the window that will raise an attinyLinkDegraded event.
+	linkDegradedPercent = defaultLinkConfig().DegradedPercent
+)
+
+type linkConfig struct {
+	DegradedPercent float64 `mapstructure:"degraded-percent"`
+}
+
+func defaultLinkConfig() linkConfig {
+	return linkConfig{DegradedPercent: 10}
+}
+
+func loadLinkConfig(config *goconfig.Config) (linkConfig, error) {
+	c := defaultLinkConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, linkConfigKey, &c); err != nil {
+		return defaultLinkConfig(), err
+	}
+	if c.DegradedPercent <= 0 || c.DegradedPercent > 100 {
+		return defaultLinkConfig(), fmt.Errorf("%s degraded-percent must be between 0 and 100", linkConfigKey)
+	}
+	return c, nil
+}
+
+// LinkStats are the statistics of the I2C link to the ATtiny.
+type LinkStats struct {
+	Transactions       int     `json:"transactions"`
+	FailedTransactions int     `json:"failedTransactions"`
+	Attempts           int     `json:"attempts"`
+	Retries            int     `json:"retries"`
+	CRCFailures        int     `json:"crcFailures"`
+	OtherFailures      int     `json:"otherFailures"`
+	FailureRatePercent float64 `json:"failureRatePercent"`
+	AvgLatencyMs       float64 `json:"avgLatencyMs"`
+	MaxLatencyMs       float64 `json:"maxLatencyMs"`
+}
+
+type attinyLinkStats struct {
+	mu            sync.Mutex
+	stats         LinkStats
+	totalLatency  time.Duration
+	maxLatency    time.Duration
+	window        []bool // true if the attempt failed.
+	failedInARow  int    // Transactions that failed since the last one that worked.
+	windowPos     int
+	lastAlarmTime time.Time
+}
+
+func newATtinyLinkStats() *attinyLinkStats {
+	return &attinyLinkStats{window: make([]bool, 0, linkWindowSize)}
+}
+
+// recordAttempt records the result of a single attempt at a transaction.
+func (l *attinyLinkStats) recordAttempt(err error, latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.Attempts++
+	l.totalLatency += latency
+	if latency > l.maxLatency {
+		l.maxLatency = latency
+	}
+	failed := err != nil
+	if failed {
+		if errors.Is(err, i2crequest.ErrCRCMismatch) {
+			l.stats.CRCFailures++
+		} else {
+			l.stats.OtherFailures++
+		}
+	}
+	if len(l.window) < linkWindowSize {
+		l.window = append(l.window, failed)
+	} else {
+		l.window[l.windowPos] = failed
+		l.windowPos = (l.windowPos + 1) % linkWindowSize
+	}
+}
+
+// recordTransaction records the result of a transaction after all attempts have been made.
+func (l *attinyLinkStats) recordTransaction(attempts int, err error) {
+	l.mu.Lock()
+	l.stats.Transactions++
+	l.stats.Retries += attempts - 1
+	if err != nil {
+		l.stats.FailedTransactions++
+		l.failedInARow++
+	} else {
+		l.failedInARow = 0
+	}
+	failedInARow := l.failedInARow
+	l.mu.Unlock()
+	l.checkDegraded()
+	sosBeaconController.checkATtinyFailures(failedInARow)
+}
+
+func (l *attinyLinkStats) failureRate() float64 {
+	if len(l.window) == 0 {
+		return 0
+	}
+	failures := 0
+	for _, failed := range l.window {
+		if failed {
+			failures++
+		}
+	}
+	return 100 * float64(failures) / float64(len(l.window))
+}
+
+// Stats returns a copy of the current link statistics.
+func (l *attinyLinkStats) Stats() LinkStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.FailureRatePercent = l.failureRate()
+	if stats.Attempts > 0 {
+		stats.AvgLatencyMs = float64(l.totalLatency.Milliseconds()) / float64(stats.Attempts)
+	}
+	stats.MaxLatencyMs = float64(l.maxLatency.Milliseconds())
+	return stats
+}
+
+func (l *attinyLinkStats) degraded() bool {
+	return len(l.window) >= linkMinWindowSamples && l.failureRate() > linkDegradedPercent
+}
+
+// checkDegraded will raise an attinyLinkDegraded event if the failure rate is too high.
+// This is often the first sign of a failing ribbon cable.
+func (l *attinyLinkStats) checkDegraded() {
+	l.mu.Lock()
+	if !l.degraded() || time.Since(l.lastAlarmTime) < linkAlarmInterval {
+		l.mu.Unlock()
+		return
+	}
+	l.lastAlarmTime = time.Now()
+	l.mu.Unlock()
+
+	stats := l.Stats()
+	log.Printf("ATtiny link degraded, failure rate %.1f%%: %+v", stats.FailureRatePercent, stats)
+	err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ATtinyLinkDegraded, time.Now(), eventhelper.LinkDegradation{
+		FailureRatePercent: stats.FailureRatePercent,
+		ThresholdPercent:   linkDegradedPercent,
+		CRCFailures:        stats.CRCFailures,
+		OtherFailures:      stats.OtherFailures,
+		Retries:            stats.Retries,
+		FailedTransactions: stats.FailedTransactions,
+		AvgLatencyMs:       stats.AvgLatencyMs,
+	}))
+	if err != nil {
+		log.Println("Error adding event:", err)
+	}
+}
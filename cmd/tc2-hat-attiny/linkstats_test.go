@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkStats(t *testing.T) {
+	eventtest.Capture(t)
+	l := newATtinyLinkStats()
+	// Works on the second attempt after a CRC failure.
+	l.recordAttempt(fmt.Errorf("read: %w", i2crequest.ErrCRCMismatch), 2*time.Millisecond)
+	l.recordAttempt(nil, 4*time.Millisecond)
+	l.recordTransaction(2, nil)
+	// Fails on every attempt.
+	for i := 0; i < 3; i++ {
+		l.recordAttempt(errors.New("i2c timeout"), 6*time.Millisecond)
+	}
+	l.recordTransaction(3, errors.New("i2c timeout"))
+
+	assert.Equal(t, LinkStats{
+		Transactions:       2,
+		FailedTransactions: 1,
+		Attempts:           5,
+		Retries:            3,
+		CRCFailures:        1,
+		OtherFailures:      3,
+		FailureRatePercent: 80,
+		AvgLatencyMs:       4.8,
+		MaxLatencyMs:       6,
+	}, l.Stats())
+	assert.Equal(t, 1, l.failedInARow)
+
+	// Only the most recent attempts count towards the failure rate.
+	for i := 0; i < linkWindowSize; i++ {
+		l.recordAttempt(nil, time.Millisecond)
+	}
+	assert.Equal(t, 0.0, l.Stats().FailureRatePercent)
+	assert.Equal(t, 4, l.Stats().CRCFailures+l.Stats().OtherFailures)
+}
+
+func TestLinkDegradedAlarm(t *testing.T) {
+	events := eventtest.Capture(t)
+	l := newATtinyLinkStats()
+	attempt := func(failed bool) {
+		var err error
+		if failed {
+			err = errors.New("i2c timeout")
+		}
+		l.recordAttempt(err, time.Millisecond)
+		l.recordTransaction(1, err)
+	}
+
+	// Not raised until there are enough attempts, even though they all failed.
+	for i := 0; i < linkMinWindowSamples-1; i++ {
+		attempt(true)
+	}
+	assert.Empty(t, events.Events())
+	attempt(true)
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "attinyLinkDegraded", events.Events()[0].Type)
+		assert.Equal(t, 100.0, events.Events()[0].Details["failureRatePercent"])
+		assert.Equal(t, linkDegradedPercent, events.Events()[0].Details["thresholdPercent"])
+	}
+
+	// Only raised once per alarm interval.
+	attempt(true)
+	assert.Len(t, events.Events(), 1)
+
+	// Cleared once the failure rate drops back, so it isn't raised after the interval.
+	for i := 0; i < linkWindowSize; i++ {
+		attempt(false)
+	}
+	l.lastAlarmTime = l.lastAlarmTime.Add(-linkAlarmInterval)
+	attempt(false)
+	assert.Len(t, events.Events(), 1)
+	assert.False(t, l.degraded())
+
+	// Raised again if the link degrades after the interval.
+	for i := 0; i < linkWindowSize/2; i++ {
+		attempt(true)
+	}
+	assert.Len(t, events.Events(), 2)
+}
@@ -19,33 +19,42 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	goconfig "github.com/TheCacophonyProject/go-config"
 	"github.com/TheCacophonyProject/go-utils/logging"
 	"github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/buzzer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/cadence"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/firmware"
+	"github.com/TheCacophonyProject/tc2-hat-controller/instancelock"
+	"github.com/TheCacophonyProject/tc2-hat-controller/livefeed"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/TheCacophonyProject/tc2-hat-controller/readiness"
+	"github.com/TheCacophonyProject/tc2-hat-controller/safemode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/selfmonitor"
 	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
-	"github.com/alexflint/go-arg"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
 	"periph.io/x/conn/v3/gpio"
 	"periph.io/x/conn/v3/gpio/gpioreg"
 	"periph.io/x/host/v3"
 )
 
 const (
-	initialGracePeriod         = 5 * time.Minute
-	saltCommandMaxWaitDuration = 30 * time.Minute
-	saltCommandWaitDuration    = time.Minute
-	batteryMaxLines            = 20000
-	lvBatThresh                = 15
-	batteryReadingsFile        = "/var/log/battery-readings.csv"
+	saltCommandWaitDuration = time.Minute
+	batteryMaxLines         = 20000
+	batteryReadingsFile     = "/var/log/battery-readings.csv"
+	safeModeService         = "tc2-hat-attiny"
 )
 
 var (
@@ -57,36 +66,84 @@ var (
 	stayOnUntil        = time.Now()
 	stayOnLock         sync.Mutex
 	stayOnForProcess   = map[string]time.Time{}
+	stayOnOwners       = map[string]string{} // The D-Bus senders that asked to stay on, by process.
 	saltCommandWaitEnd = time.Time{}
 	log                = logging.NewLogger("info")
+
+	// powerProfile scales the polling intervals, see the cadence package. The battery monitor
+	// updates it with the battery level.
+	powerProfile *cadence.Policy
+
+	// serviceCtx is cancelled when the service is asked to stop, so a hung I2C request
+	// doesn't hold up stopping the service.
+	serviceCtx = context.Background()
 )
 
 type Args struct {
-	ConfigDir          string `arg:"-c,--config" help:"configuration folder"`
-	SkipWait           bool   `arg:"-s,--skip-wait" help:"will not wait for the date to update"`
-	Timestamps         bool   `arg:"-t,--timestamps" help:"include timestamps in log output"`
-	SkipSystemShutdown bool   `arg:"--skip-system-shutdown" help:"don't shut down operating system when powering down"`
-	BatteryReading     bool   `arg:"--battery-reading" help:"Run helper code to read battery voltage."`
+	ConfigDir          string  `arg:"-c,--config" help:"configuration folder"`
+	SkipWait           bool    `arg:"-s,--skip-wait" help:"will not wait for the date to update"`
+	Timestamps         bool    `arg:"-t,--timestamps" help:"include timestamps in log output"`
+	SkipSystemShutdown bool    `arg:"--skip-system-shutdown" help:"don't shut down operating system when powering down"`
+	BatteryReading     bool    `arg:"--battery-reading" help:"Run helper code to read battery voltage."`
+	ExportBattery      string  `arg:"--export-battery-profile" help:"Export the learned battery state to a JSON profile file."`
+	ImportBattery      string  `arg:"--import-battery-profile" help:"Import a battery profile JSON file exported from another device."`
+	SelfTest           bool    `arg:"--self-test" help:"Run a self test of the ATtiny and print the results."`
+	BatteryReplay      string  `arg:"--battery-replay" help:"Replay battery readings from a CSV file through the battery monitor instead of reading from the ATtiny."`
+	ReplaySpeed        float64 `arg:"--speed" help:"Speed multiplier for --battery-replay, 0 will replay as fast as possible."`
+	ErrorLog           bool    `arg:"--error-log" help:"Print the persistent error log from the ATtiny, when it is enabled in the attiny-error-log config."`
+	ClearErrorLog      bool    `arg:"--clear-error-log" help:"Clear the persistent error log on the ATtiny."`
+	Replace            bool    `arg:"--replace" help:"Stop another running instance of the service and take over from it."`
+	DryRun             bool    `arg:"--dry-run" help:"Log the writes to the ATtiny and powering off instead of doing them, for trying changes on a live device."`
+	RTCHoldup          bool    `arg:"--rtc-holdup" help:"Print how long the RTC supercap will keep the time, learnt from the battery readings."`
+	PlannedOff         string  `arg:"--planned-off" help:"Warn if the RTC supercap won't keep the time for this long, such as 72h, for --rtc-holdup."`
+	CameraPower        bool    `arg:"--camera-power" help:"Print the camera power cycles, powered on hours and average boot duration."`
+	AllowUnsigned      bool    `arg:"--allow-unsigned" help:"Allow updating the ATtiny firmware with a hex file that has no signature or pinned SHA-256 in the config."`
+
+	Battery *BatteryCmd `arg:"subcommand:battery" help:"Manage the saved battery state."`
 
 	logging.LogArgs
 }
 
+type BatteryCmd struct {
+	State    *BatteryStateCmd    `arg:"subcommand:state" help:"Manage the battery state file."`
+	Readings *BatteryReadingsCmd `arg:"subcommand:readings" help:"Manage the battery readings CSV file."`
+	Replaced *BatteryReplacedCmd `arg:"subcommand:replaced" help:"Record that the battery pack has been swapped, starting the learned battery state afresh."`
+}
+
+type BatteryStateCmd struct {
+	Migrate *MigrateCmd `arg:"subcommand:migrate" help:"Migrate the battery state file to the current schema version."`
+}
+
+type BatteryReadingsCmd struct {
+	Migrate *MigrateReadingsCmd `arg:"subcommand:migrate" help:"Rewrite the battery readings file in the current schema with a header."`
+}
+
+type MigrateReadingsCmd struct {
+	File   string `arg:"--file" help:"Battery readings file to migrate, defaults to the one written by the service."`
+	DryRun bool   `arg:"--dry-run" help:"Print the migrated readings instead of saving them."`
+}
+
+type MigrateCmd struct {
+	DryRun bool `arg:"--dry-run" help:"Print the migrated state instead of saving it."`
+}
+
 func (Args) Version() string {
 	return version
 }
 
 func procArgs() Args {
 	args := Args{
-		ConfigDir: goconfig.DefaultConfigDir,
+		ConfigDir: standalone.ConfigDirOr(goconfig.DefaultConfigDir),
 	}
-	arg.MustParse(&args)
+	exitcode.MustParse(&args)
 	return args
 }
 
 func main() {
 	err := runMain()
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(exitcode.Code(err))
 	}
 }
 
@@ -94,85 +151,277 @@ func runMain() error {
 	args := procArgs()
 
 	log = logging.NewLogger(args.LogLevel)
+	dryRun = args.DryRun
+	eventhelper.ConfigDir = args.ConfigDir
 
-	config, err := goconfig.New(args.ConfigDir)
-	if err != nil {
-		return err
+	config, configErr := goconfig.New(args.ConfigDir)
+
+	if args.ExportBattery != "" {
+		if configErr != nil {
+			return exitcode.Wrap(exitcode.Usage, configErr)
+		}
+		batteryConfig := goconfig.DefaultBattery()
+		if err := config.Unmarshal(goconfig.BatteryKey, &batteryConfig); err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		return exportBatteryProfile(&batteryConfig, args.ExportBattery)
+	}
+	if args.ImportBattery != "" {
+		return importBatteryProfile(args.ImportBattery)
+	}
+	if args.Battery != nil && args.Battery.State != nil && args.Battery.State.Migrate != nil {
+		return migrateBatteryStateFile(batteryStateFile, args.Battery.State.Migrate.DryRun)
+	}
+	if args.Battery != nil && args.Battery.Readings != nil && args.Battery.Readings.Migrate != nil {
+		file := args.Battery.Readings.Migrate.File
+		if file == "" {
+			file = batteryReadingsFile
+		}
+		return migrateBatteryReadingsFile(file, args.Battery.Readings.Migrate.DryRun)
+	}
+	if args.Battery != nil && args.Battery.Replaced != nil {
+		return runBatteryReplaced(args.Battery.Replaced)
+	}
+	if args.BatteryReplay != "" {
+		if configErr != nil {
+			return exitcode.Wrap(exitcode.Usage, configErr)
+		}
+		return replayBatteryReadings(config, args.BatteryReplay, args.ReplaySpeed)
+	}
+	if args.RTCHoldup {
+		if configErr != nil {
+			return exitcode.Wrap(exitcode.Usage, configErr)
+		}
+		return printRTCHoldup(config, args.PlannedOff)
+	}
+
+	if args.CameraPower {
+		return printCameraPower()
 	}
 
 	log.Printf("Running version: %s", version)
+	configcompat.SetBinary("tc2-hat-attiny", version)
+
+	if configErr != nil {
+		// Keep managing the power with default settings rather than restart looping.
+		log.Errorf("Failed to load config, running in safe mode: %v", configErr)
+		eventhelper.ReportSafeMode(safeModeService, fmt.Errorf("config: %v", configErr))
+		config = nil
+	} else if err := safemode.Exit(safeModeService); err != nil {
+		log.Errorf("Error clearing safe mode: %v", err)
+	}
+	if dryRun {
+		log.Println("Dry run, the ATtiny registers won't be written and the RPi won't be powered off.")
+	}
 	log.Printf("Expecting ATtiny version v%s.%s.%s", attinyMajorStr, attinyMinorStr, attinyPatchStr)
 
-	_, err = host.Init()
+	oneShot := args.BatteryReading || args.SelfTest || args.ErrorLog || args.ClearErrorLog
+	if !oneShot {
+		if _, err := instancelock.Acquire(safeModeService, args.Replace); err != nil {
+			return err
+		}
+		if err := readiness.Clear(safeModeService); err != nil {
+			log.Errorf("Failed to clear readiness: %v", err)
+		}
+		// The battery readings are saved with timestamps, so the RTC needs to have set the time first.
+		readiness.WaitFor(context.Background(), safeModeService, readiness.I2C, readiness.RTC)
+	}
+
+	_, err := host.Init()
 	if err != nil {
 		return err
 	}
 
+	allowUnsignedFirmware = args.AllowUnsigned
+	if firmwareConfig, err = firmware.LoadConfig(config); err != nil {
+		log.Errorf("Failed to read the firmware config, only the built in hex file hash will be trusted: %v", err)
+	}
+
+	if link, err := loadLinkConfig(config); err != nil {
+		log.Errorf("Failed to read the ATtiny link config, using the default: %v", err)
+	} else {
+		linkDegradedPercent = link.DegradedPercent
+	}
+
 	log.Println("Connecting to ATtiny.")
 	attiny, err := connectToATtinyWithRetries(10)
 	if err != nil {
 		return err
 	}
+	if errorLog, err := loadErrorLogConfig(config); err != nil {
+		log.Errorf("Failed to read the ATtiny error log config, not using the error log: %v", err)
+	} else {
+		attiny.errorLogEnabled = errorLog.Enable
+	}
+	if attiny.analogOverrides, err = loadAnalogOverrides(config); err != nil {
+		log.Errorf("Failed to read the analog config, using the values for the power PCB: %v", err)
+	}
+	if attiny.buzzer, err = buzzer.FromConfig(config); err != nil {
+		log.Errorf("Failed to set up the buzzer: %v", err)
+	}
 
 	if args.BatteryReading {
 		err := makeBatteryReadings(attiny)
 		if err != nil {
 			log.Error(err)
 		}
-		return err
+		return exitcode.Wrap(exitcode.BusError, err)
+	}
+
+	if args.SelfTest {
+		result := runSelfTest(attiny)
+		for _, check := range result.Checks {
+			log.Printf("%s passed: %t, %s", check.Name, check.Passed, check.Details)
+		}
+		if !result.Passed() {
+			if err := attiny.buzzer.Play(buzzer.SelfTestFailed); err != nil {
+				log.Errorf("Failed to play the self test result on the buzzer: %v", err)
+			}
+			return errors.New("self test failed")
+		}
+		log.Println("Self test passed.")
+		if err := attiny.buzzer.Play(buzzer.SelfTestPassed); err != nil {
+			log.Errorf("Failed to play the self test result on the buzzer: %v", err)
+		}
+		return nil
+	}
+
+	if args.ErrorLog {
+		entries, err := attiny.readErrorLog()
+		if err != nil {
+			return exitcode.Wrap(exitcode.BusError, err)
+		}
+		for _, entry := range entries {
+			log.Printf("%s (about %s ago) %s", entry.Time.Format("2006-01-02 15:04"), durToStr(time.Duration(entry.AgeMinutes)*time.Minute), entry.Error)
+		}
+		log.Printf("%d entries in the error log", len(entries))
+		return nil
+	}
+
+	if args.ClearErrorLog {
+		return exitcode.Wrap(exitcode.BusError, attiny.clearErrorLog())
+	}
+
+	if serialhelper.SerialInUseFromTerminal() {
+		claimSerialForAuxTerminal()
 	}
 
+	attiny.live = livefeed.New(safeModeService)
 	log.Info("Starting DBus service.")
-	if err := startService(attiny); err != nil {
-		return err
+	if err := startService(attiny, args.ConfigDir); err != nil {
+		if !standalone.Enabled() {
+			return err
+		}
+		// A datalogger keeps logging without the D-Bus API.
+		log.Errorf("Failed to start DBus service: %v", err)
+	}
+	if err := readiness.Announce(safeModeService); err != nil {
+		log.Errorf("Failed to announce readiness: %v", err)
 	}
 
-	go func() {
-		for {
-			if err := attiny.checkForConnectionStateUpdates(); err != nil {
-				log.Printf("Error checking for connection state updates: %s", err)
-				time.Sleep(time.Second)
+	cadenceConfig, err := cadence.LoadConfig(config)
+	if err != nil {
+		log.Errorf("Failed to load reporting cadence config, using defaults: %v", err)
+	}
+	powerProfile = cadence.New(cadenceConfig)
+
+	// There is no network manager when running standalone.
+	if !standalone.Enabled() {
+		go func() {
+			for {
+				if err := attiny.checkForConnectionStateUpdates(); err != nil {
+					log.Printf("Error checking for connection state updates: %s", err)
+					time.Sleep(powerProfile.Interval(time.Second))
+				}
 			}
-		}
-	}()
+		}()
+	}
+
+	health, err := selfmonitor.LoadConfig(config)
+	if err != nil {
+		log.Errorf("Failed to read service health config, using defaults: %v", err)
+	}
+	selfmonitor.Start(safeModeService, health)
+
+	syncErrorLog(attiny)
+	reportPowerQuality(attiny)
+	checkHardwarePairing(attiny, config)
+
+	if transients, err := loadTransientConfig(config); err != nil {
+		log.Errorf("Failed to read battery transients config: %v", err)
+	} else if transients.Enable {
+		attiny.transients = newTransientCapture(attiny, transients)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serviceCtx = ctx
+
+	if rtcBackupController, err = loadRTCBackup(config, batteryReadingsFile); err != nil {
+		log.Errorf("Failed to read the RTC backup config: %v", err)
+	}
+
+	cameraPowerController = newCameraPowerTracker()
+	if err := cameraPowerController.start(); err != nil {
+		log.Errorf("Failed to count the camera power on: %v", err)
+	}
+	go cameraPowerController.run()
 
 	go monitorVoltageLoop(attiny, config)
-	go checkATtinySignalLoop(attiny)
+	go checkATtinySignalLoop(attiny, config)
+	go auxPowerLoop(attiny, config)
+	go consumablesLoop(attiny, config)
+	go sosBeaconLoop(attiny, config)
 
 	attiny.readCameraState()
 	log.Println(attiny.CameraState)
 
-	waitDuration := time.Duration(0)
+	postponer, err := loadUploadPostponer(config)
+	if err != nil {
+		log.Errorf("Failed to read the upload postpone config: %v", err)
+	}
+
+	start := time.Now()
+	timings := loadPowerTimings(config, defaultPowerTimings())
 	previousOnReason := ""
-	onReason := ""
 	if args.SkipWait {
 		log.Println("Not waiting initial grace period.")
-	} else {
-		waitDuration = initialGracePeriod
-		onReason = fmt.Sprintf("Waiting initial grace period of %s", durToStr(waitDuration))
 	}
 
 	for {
+		timings = loadPowerTimings(config, timings)
+		waitDuration := time.Duration(0)
+		onReason := ""
+		if !args.SkipWait {
+			if graceRemaining := time.Until(start.Add(timings.InitialGracePeriod)); graceRemaining > 0 {
+				waitDuration = graceRemaining
+				onReason = fmt.Sprintf("Waiting initial grace period of %s", durToStr(timings.InitialGracePeriod))
+			}
+		}
+
 		stayOnUntilDuration := time.Until(stayOnUntil)
 		if stayOnUntilDuration > waitDuration {
 			waitDuration = stayOnUntilDuration
-			onReason = fmt.Sprintf("Staying on because camera has been requested to stay on for %s", durToStr(waitDuration))
+			onReason = "Staying on because camera has been requested to stay on"
 		}
 
 		// Check if the RP2040 wants the RPi to stay on
 		if waitDuration <= time.Duration(0) {
-			val, err := attiny.readRegister(rp2040PiPowerCtrlReg)
-			if err != nil {
-				return err
+			val, err := attiny.readRegister(attinyclient.RP2040PiPowerCtrlReg)
+			if err != nil && ctx.Err() != nil {
+				log.Println("Stopping service")
+				return nil
+			} else if err != nil {
+				return exitcode.Wrap(exitcode.BusError, err)
 			}
 			if (val & 0x01) == 0x01 {
 				onReason = "Staying on because RP2040 wants me to stay on"
-				waitDuration = 10 * time.Second
+				waitDuration = timings.PollInterval
 			}
 		}
 
 		// Checking if a salt command is running should only be done if needed
-		if waitDuration < time.Duration(0) && shouldStayOnForSalt() {
+		if waitDuration < time.Duration(0) && shouldStayOnForSalt(timings.SaltCommandMaxWait) {
 			waitDuration = saltCommandWaitDuration
 			onReason = "Staying on because salt command is running"
 		}
@@ -183,18 +432,29 @@ func runMain() error {
 				if time.Now().After(maxTime) {
 					log.Printf("Max stay on time reached for %v", process)
 					delete(stayOnForProcess, process)
+					delete(stayOnOwners, process)
 				} else {
 					onReason = fmt.Sprintf("Staying on for %v", process)
-					waitDuration = 10 * time.Second
+					waitDuration = timings.PollInterval
 					break
 				}
 			}
 			stayOnLock.Unlock()
 		}
 
+		if waitDuration <= time.Duration(0) {
+			if postpone, reason := postponer.postpone(); postpone > 0 {
+				waitDuration = postpone
+				onReason = "Postponing power off for uploads, " + reason
+			}
+		}
+
 		if waitDuration <= time.Duration(0) {
 			log.Println("No longer needed to be powered on, powering off")
-			time.Sleep(1 * time.Second)
+			setOnReason("Powering off", time.Time{})
+			rtcBackupController.checkPowerOff(time.Now())
+			batteryMonitorController.FlushReadings()
+			quiesceController.quiesce(timings.QuiesceBudget)
 			if err := shutdown(attiny); err != nil {
 				return err
 			}
@@ -202,161 +462,46 @@ func runMain() error {
 			return nil
 		}
 
-		// TODO Make this a timeout switch with a channel trigger also so the
+		setOnReason(onReason, time.Now().Add(waitDuration))
 		if previousOnReason != onReason {
-			log.Println(onReason)
+			log.Printf("%s, %s remaining", onReason, durToStr(waitDuration))
 			previousOnReason = onReason
 		}
-		time.Sleep(waitDuration)
-		waitDuration = time.Duration(0)
-	}
-}
-
-// keepLastLines keeps the last `maxLines` lines of the specified file.
-func keepLastLines(filePath string, maxLines int) error {
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return nil
-	}
-	tmpFile := filepath.Join(os.TempDir(), filepath.Base(filePath)+".tmp")
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("tail -n %d %s > %s", maxLines, filePath, tmpFile))
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	return os.Rename(tmpFile, filePath)
-}
-
-func getBatteryPercent(batteryConfig *goconfig.Battery, hvBat float32, lvBat float32) (float32, string, float32) {
-	var batVolt float32
-	if hvBat <= lvBatThresh {
-		batVolt = lvBat
-	} else {
-		batVolt = hvBat
-	}
-
-	if batVolt < 1 {
-		batVolt = 0
-	}
-
-	batType, voltages, percents := batteryConfig.GetBatteryVoltageThresholds(batVolt)
-
-	if batVolt == 0 {
-		return 100, batType, 0
-	}
-
-	var upper float32 = 0
-	var lower float32 = 0
-	var i = 0
-	for i = 0; i < len(voltages); i++ {
-		voltage := voltages[i]
-		lower = upper
-		upper = voltage
-		if batVolt >= lower && batVolt < upper {
-			break
-		}
-		if batVolt <= lower && batVolt <= upper {
-			// probably have wrong battery config
-			log.Printf("Could not find a matching voltage range in config for %vV", batVolt)
-			return percents[i], batType, batVolt
+		// Sleep for at most the poll interval so config changes and stay on requests are picked up.
+		select {
+		case <-time.After(min(waitDuration, timings.PollInterval)):
+		case <-ctx.Done():
+			log.Println("Stopping service")
+			batteryMonitorController.FlushReadings()
+			return nil
 		}
 	}
-	if i == 0 {
-		return 0, batType, batVolt
-	} else if batVolt > upper {
-		//voltage is higher than config
-		return 100, batType, batVolt
-	}
-	gradient := (percents[i] - percents[i-1]) / (upper - lower)
-	batteryPercent := gradient*batVolt + percents[i-1] - gradient*lower
-	return batteryPercent, batType, batVolt
 }
 
-func monitorVoltageLoop(a *attiny, config *goconfig.Config) {
-	batteryConfig := goconfig.DefaultBattery()
-	if err := config.Unmarshal(goconfig.BatteryKey, &batteryConfig); err != nil {
+func checkATtinySignalLoop(a *attiny, config *goconfig.Config) {
+	pin := gpioreg.ByName(attinySignalPin)
+	if pin == nil {
+		log.Printf("Failed to find {%s}", attinySignalPin)
 		return
 	}
-	err := keepLastLines("/var/log/battery-readings.csv", batteryMaxLines)
-	if err != nil {
-		log.Printf("Could not truncate /var/log/battery-readings.csv %v", err)
-	}
-	var batteryPercent float32 = -1.0
-	startTime := time.Now()
-	i := 5
-	for {
-		hvBat, err := a.readHVBattery()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		lvBat, err := a.readLVBattery()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		rtcBat, err := a.readRTCBattery()
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		if time.Since(startTime) > time.Duration(24*time.Hour) {
-			err := keepLastLines(batteryReadingsFile, batteryMaxLines)
-			if err != nil {
-				//not sure why it would error but should we keep trying...
-				log.Printf("Could not truncate /var/log/battery-readings.csv %v", err)
-			} else {
-				startTime = time.Now()
-			}
-		}
-		file, err := os.OpenFile(batteryReadingsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-		line := fmt.Sprintf("%s, %.2f, %.2f, %.2f", time.Now().Format("2006-01-02 15:04:05"), hvBat, lvBat, rtcBat)
-		if i >= 5 {
-			log.Println("Battery reading:", line)
-			i = 0
+	watcher := newSignalWatcher(pin)
+	if err := pin.In(gpio.PullUp, gpio.FallingEdge); err != nil {
+		log.Printf("Failed to set up edge detection on %s for signals from the ATtiny, polling it instead: %v", attinySignalPin, err)
+		if err := pin.In(gpio.PullUp, gpio.NoEdge); err != nil {
+			log.Printf("Failed to set up %s as an input: %v", attinySignalPin, err)
 		}
-		i++
-		_, err = file.WriteString(line + "\n")
-		file.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-		newPercent, batteryType, voltage := getBatteryPercent(&batteryConfig, hvBat, lvBat)
-		if batteryPercent == -1 || math.Abs(float64(batteryPercent-newPercent)) >= 10 {
-			//log battery percent
-			batteryPercent = newPercent
-			eventclient.AddEvent(eventclient.Event{
-				Timestamp: time.Now(),
-				Type:      "rpiBattery",
-				Details: map[string]interface{}{
-					"battery":     math.Round((float64(batteryPercent))),
-					"batteryType": batteryType,
-					"voltage":     voltage,
-				},
-			})
-		}
-		time.Sleep(2 * time.Minute)
-	}
-}
-
-func checkATtinySignalLoop(a *attiny) {
-	pinName := "GPIO16" //TODO add pin to config
-	pin := gpioreg.ByName(pinName)
-	if pin == nil {
-		log.Printf("Failed to find {%s}", pinName)
+		watcher.poll = true
 	}
-	pin.In(gpio.PullUp, gpio.FallingEdge)
 	log.Println("Starting check ATtiny signal loop")
 	for {
-		pin.Read()
-		if pin.Read() == gpio.High {
-			time.Sleep(200 * time.Millisecond)
-			continue
+		signalled, fromEdge := watcher.wait()
+		if fromEdge {
+			log.Println("Signal from ATtiny")
+		} else {
+			log.Println("Signal from ATtiny, found by the watchdog")
 		}
-		log.Println("Signal from ATtiny")
 		for {
-			if a.CameraState != statePoweringOff {
+			if a.CameraState != attinyclient.StatePoweringOff {
 				break
 			}
 			time.Sleep(100 * time.Millisecond)
@@ -366,6 +511,7 @@ func checkATtinySignalLoop(a *attiny) {
 			log.Println("Error reading pi commands:", err)
 			continue
 		}
+		signalStats.recordSignal(fromEdge, time.Since(signalled))
 
 		//TODO Fix bug causing this instead to be triggered twice, error is probably in ATtiny code
 		log.Printf("Commands register: %x\n", piCommands)
@@ -378,45 +524,44 @@ func checkATtinySignalLoop(a *attiny) {
 				log.Printf("Error writing connection state: %s", err)
 			}
 		}
-		if isFlagSet(piCommands, WriteCameraStateFlag) {
+		if isFlagSet(piCommands, attinyclient.WriteCameraStateFlag) {
 			log.Println("write camera state flag")
 			if err := a.writeCameraState(a.CameraState); err != nil {
 				log.Printf("Error writing camera state: %s", err)
 			}
 		}
 
-		if isFlagSet(piCommands, ReadErrorsFlag) {
+		if isFlagSet(piCommands, attinyclient.ReadErrorsFlag) {
 			log.Println("Read attiny errors flag set")
-			readAttinyErrors(a)
+			// The errors have been reported now so remove them from the error log, otherwise
+			// they would be reported again the next time the error log is synced.
+			if readAttinyErrors(a) && a.hasErrorLog() {
+				if err := a.clearErrorLog(); err != nil {
+					log.Println("Error clearing ATtiny error log:", err)
+				}
+			}
 		}
 
-		if isFlagSet(piCommands, EnableWifiFlag) {
+		if isFlagSet(piCommands, attinyclient.EnableWifiFlag) {
 			log.Println("Enable wifi flag set.")
 			enableWifi()
 		}
 
-		if isFlagSet(piCommands, PowerDownFlag) {
+		if isFlagSet(piCommands, attinyclient.PowerDownFlag) {
 			log.Println("Power down flag set.")
-			log.Println("TODO, make sure device has finished its business before powering down.")
+			timings := loadPowerTimings(config, defaultPowerTimings())
+			batteryMonitorController.FlushReadings()
+			quiesceController.quiesce(timings.QuiesceBudget)
 			log.Println("Shutting down.")
-			shutdown(a)
+			if err := shutdown(a); err != nil {
+				log.Printf("Error shutting down: %v", err)
+			}
 			time.Sleep(time.Second * 3)
 		}
 
-		if isFlagSet(piCommands, ToggleAuxTerminalFlag) {
+		if isFlagSet(piCommands, attinyclient.ToggleAuxTerminalFlag) {
 			log.Println("Toggle aux terminal flag set.")
-			if serialhelper.SerialInUseFromTerminal() {
-				_, err := exec.Command("disable-aux-uart").CombinedOutput()
-				if err != nil {
-					log.Println("Error disabling aux uart:", err)
-				}
-			} else {
-				_, err := exec.Command("enable-aux-uart").CombinedOutput()
-				if err != nil {
-					log.Println("Error enabling aux uart:", err)
-				}
-			}
-			a.writeAuxState()
+			toggleAuxTerminal(a)
 		}
 
 		time.Sleep(time.Second)
@@ -434,7 +579,8 @@ func enableWifi() {
 	}
 }
 
-func readAttinyErrors(a *attiny) {
+// readAttinyErrors reports the errors from the ATtiny, returning true if there were any.
+func readAttinyErrors(a *attiny) bool {
 	log.Println("Reading Attiny errors.")
 	errorCodes, err := a.checkForErrorCodes(true)
 	if err != nil {
@@ -447,15 +593,9 @@ func readAttinyErrors(a *attiny) {
 	}
 
 	if len(errorStrs) > 0 {
-		event := eventclient.Event{
-			Timestamp: time.Now(),
-			Type:      "ATtinyError",
-			Details: map[string]interface{}{
-				"error": errorStrs,
-			},
-		}
+		event := eventhelper.NewEvent(eventhelper.ATtinyError, time.Now(), eventhelper.ATtinyErrors{Errors: errorStrs})
 		log.Println("ATtiny Errors:", errorStrs)
-		err := eventclient.AddEvent(event)
+		err := eventhelper.AddEvent(event)
 		if err != nil {
 			log.Println("Error adding event:", err)
 		}
@@ -464,21 +604,25 @@ func readAttinyErrors(a *attiny) {
 	// Run specific checks for some errors
 	for _, err := range errorCodes {
 		switch err {
-		case INVALID_CAMERA_STATE:
+		case attinyclient.INVALID_CAMERA_STATE:
 			if err := a.readCameraState(); err != nil {
 				log.Println("Error reading camera state:", err)
 			}
-			if err := a.writeCameraState(statePoweredOn); err != nil {
+			if err := a.writeCameraState(attinyclient.StatePoweredOn); err != nil {
 				log.Println("Error writing camera state:", err)
 			}
 		}
 	}
+	return len(errorStrs) > 0
 }
 
 func setStayOnUntil(newTime time.Time) error {
 	if time.Until(newTime) > 12*time.Hour {
 		return errors.New("can not delay over 12 hours")
 	}
+	if powerPolicyController != nil {
+		newTime = powerPolicyController.limitStayOn(newTime)
+	}
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -493,18 +637,32 @@ func stayOnFinished(processName string) {
 	stayOnLock.Lock()
 	defer stayOnLock.Unlock()
 	delete(stayOnForProcess, processName)
+	delete(stayOnOwners, processName)
 }
 
-func setStayOnForProcess(processName string, maxTime time.Time) error {
+// stayOnOwner returns the sender that asked to stay on for the process, empty if it isn't
+// being stayed on for.
+func stayOnOwner(processName string) string {
+	stayOnLock.Lock()
+	defer stayOnLock.Unlock()
+	return stayOnOwners[processName]
+}
+
+func setStayOnForProcess(processName, owner string, maxTime time.Time) error {
 	if time.Until(maxTime) > 12*time.Hour {
 		return errors.New("can not delay over 12 hours")
 	}
+	if powerPolicyController != nil && !powerPolicyController.allowProcess(processName) {
+		return fmt.Errorf("not staying on for %s as the battery is low", processName)
+	}
 	stayOnLock.Lock()
 	defer stayOnLock.Unlock()
 	if stayOnUntil.Before(maxTime) {
 		stayOnForProcess[processName] = maxTime
+		stayOnOwners[processName] = owner
 	} else {
 		delete(stayOnForProcess, processName)
+		delete(stayOnOwners, processName)
 	}
 	return nil
 }
@@ -517,7 +675,7 @@ func makeBatteryReadings(attiny *attiny) error {
 	var err error
 	for i := 0; i < readings; i++ {
 
-		rawValues[i], rawDiffs[i], err = attiny.readBattery(batteryHVDivVal1Reg, batteryHVDivVal2Reg)
+		rawValues[i], rawDiffs[i], err = attiny.readBattery(attinyclient.BatteryHVDivVal1Reg, attinyclient.BatteryHVDivVal2Reg)
 		if err != nil {
 			log.Error(err)
 			continue
@@ -532,13 +690,13 @@ func makeBatteryReadings(attiny *attiny) error {
 				continue
 			}
 			log.Infof("Main battery voltage: %v", hvBat)
-			lvBat, err := attiny.readLVBattery()
+			lvBat, err := attiny.ReadLVBattery()
 			if err != nil {
 				log.Error(err)
 				continue
 			}
 			log.Info("Low voltage battery voltage: ", lvBat)
-			rtcBat, err := attiny.readRTCBattery()
+			rtcBat, err := attiny.ReadRTCBattery()
 			if err != nil {
 				log.Error(err)
 				continue
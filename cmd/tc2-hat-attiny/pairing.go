@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+// At startup the RPi writes its device ID into the ATtiny, and reads back the ID that was
+// there, so a hat that was last in another device, or a device that has been given a new
+// hat, is reported with a hardwarePairingChanged event. The pairing is also saved on the RPi
+// with the hat EEPROM ID, so a swap to a hat that has never been paired is detected too.
+const (
+	pairingFile = "/etc/cacophony/hardware-pairing.json"
+
+	pairingHatSwapped = "hatSwapped" // The hat was last paired with another device.
+	pairingPiSwapped  = "piSwapped"  // The hat is the same but the device ID has changed.
+)
+
+// savedPairing is the pairing at the last startup.
+type savedPairing struct {
+	DeviceID uint32    `json:"deviceID"`
+	HatID    uint64    `json:"hatID,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// pairingTracker checks the device ID stored in the ATtiny against the device ID of the RPi.
+type pairingTracker struct {
+	file      string
+	deviceID  uint32
+	readHatID func() (uint64, error)
+	readID    func() (uint32, bool, error)
+	writeID   func(uint32) error
+	now       func() time.Time
+}
+
+func newPairingTracker(a *attiny, deviceID uint32) *pairingTracker {
+	return &pairingTracker{
+		file:      pairingFile,
+		deviceID:  deviceID,
+		readHatID: eeprom.GetHatID,
+		readID:    a.client.ReadPairedDeviceID,
+		writeID:   a.client.WritePairedDeviceID,
+		now:       time.Now,
+	}
+}
+
+func (a *attiny) hasPairing() bool {
+	return a.version >= attinyclient.PairingMinMajorVersion
+}
+
+func (t *pairingTracker) load() (*savedPairing, error) {
+	data, err := os.ReadFile(t.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := &savedPairing{}
+	return saved, json.Unmarshal(data, saved)
+}
+
+func (t *pairingTracker) save(p savedPairing) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmpFile := t.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.file)
+}
+
+// change returns how the pairing has changed, "" if it hasn't.
+func (t *pairingTracker) change(hatDeviceID uint32, paired bool, hatID uint64, saved *savedPairing) string {
+	if paired && hatDeviceID != t.deviceID {
+		if saved != nil && saved.DeviceID != t.deviceID && saved.DeviceID == hatDeviceID {
+			return pairingPiSwapped
+		}
+		return pairingHatSwapped
+	}
+	if saved != nil && saved.HatID != 0 && hatID != 0 && saved.HatID != hatID {
+		return pairingHatSwapped
+	}
+	return ""
+}
+
+// check reports any change in the pairing, then pairs the ATtiny with this device.
+func (t *pairingTracker) check() error {
+	hatDeviceID, paired, err := t.readID()
+	if err != nil {
+		return err
+	}
+	hatID, err := t.readHatID()
+	if err != nil {
+		log.Printf("Failed to read the hat ID: %v", err)
+	}
+	saved, err := t.load()
+	if err != nil {
+		log.Printf("Failed to read saved hardware pairing: %v", err)
+	}
+	now := t.now()
+	if change := t.change(hatDeviceID, paired, hatID, saved); change != "" {
+		log.Printf("Hardware pairing changed (%s), hat was paired with device %d, this is device %d", change, hatDeviceID, t.deviceID)
+		payload := eventhelper.PairingChange{
+			Change:      change,
+			DeviceID:    t.deviceID,
+			HatDeviceID: hatDeviceID,
+		}
+		if hatID != 0 {
+			payload.HatID = fmt.Sprintf("%016x", hatID)
+		}
+		if saved != nil {
+			payload.PreviousDeviceID = &saved.DeviceID
+			if saved.HatID != 0 {
+				payload.PreviousHatID = fmt.Sprintf("%016x", saved.HatID)
+			}
+		}
+		if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.HardwarePairingChanged, now, payload)); err != nil {
+			// Don't pair so the change is reported next time.
+			return err
+		}
+	}
+	if !paired || hatDeviceID != t.deviceID {
+		if err := t.writeID(t.deviceID); err != nil {
+			return err
+		}
+	}
+	return t.save(savedPairing{DeviceID: t.deviceID, HatID: hatID, Time: now})
+}
+
+// checkHardwarePairing pairs the ATtiny with this device, if the firmware supports it and the
+// device has been registered.
+func checkHardwarePairing(a *attiny, config *goconfig.Config) {
+	if !a.hasPairing() || config == nil {
+		return
+	}
+	device := goconfig.Device{}
+	if err := config.Unmarshal(goconfig.DeviceKey, &device); err != nil {
+		log.Println("Error reading device config:", err)
+		return
+	}
+	if device.ID <= 0 {
+		return
+	}
+	if err := newPairingTracker(a, uint32(device.ID)).check(); err != nil {
+		log.Println("Error checking hardware pairing:", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePairing is the device ID stored in the ATtiny and the hat EEPROM ID.
+type fakePairing struct {
+	hatDeviceID uint32
+	hatID       uint64
+}
+
+func (f *fakePairing) tracker(file string, deviceID uint32) *pairingTracker {
+	return &pairingTracker{
+		file:      file,
+		deviceID:  deviceID,
+		readHatID: func() (uint64, error) { return f.hatID, nil },
+		readID:    func() (uint32, bool, error) { return f.hatDeviceID, f.hatDeviceID != 0, nil },
+		writeID:   func(id uint32) error { f.hatDeviceID = id; return nil },
+		now:       func() time.Time { return time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC) },
+	}
+}
+
+func TestHardwarePairing(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pairing.json")
+	f := &fakePairing{hatID: 0xAA}
+	events := eventtest.Capture(t)
+
+	// First startup pairs without an event.
+	assert.NoError(t, f.tracker(file, 100).check())
+	assert.Equal(t, uint32(100), f.hatDeviceID)
+	assert.Empty(t, events.Events())
+	assert.NoError(t, f.tracker(file, 100).check())
+	assert.Empty(t, events.Events())
+
+	// A new hat that has never been paired.
+	f.hatDeviceID, f.hatID = 0, 0xBB
+	assert.NoError(t, f.tracker(file, 100).check())
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "hardwarePairingChanged", events.Events()[0].Type)
+		assert.Equal(t, pairingHatSwapped, events.Events()[0].Details["change"])
+		assert.Equal(t, "00000000000000aa", events.Events()[0].Details["previousHatID"])
+	}
+
+	// A hat that was last in another device.
+	f.hatDeviceID, f.hatID = 200, 0xCC
+	assert.NoError(t, f.tracker(file, 100).check())
+	if assert.Len(t, events.Events(), 2) {
+		assert.Equal(t, pairingHatSwapped, events.Events()[1].Details["change"])
+		assert.Equal(t, uint32(200), events.Events()[1].Details["hatDeviceID"])
+		assert.Equal(t, uint32(100), events.Events()[1].Details["deviceID"])
+	}
+	assert.Equal(t, uint32(100), f.hatDeviceID)
+
+	// The same hat with a new device ID.
+	assert.NoError(t, f.tracker(file, 300).check())
+	if assert.Len(t, events.Events(), 3) {
+		assert.Equal(t, pairingPiSwapped, events.Events()[2].Details["change"])
+	}
+	assert.Equal(t, uint32(300), f.hatDeviceID)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/window"
+)
+
+// The power policy uses the battery depletion estimate to make sure the device lasts until the
+// end of the next upload window. When the battery won't last, recording is cut short by the
+// time that is missing and low priority processes are no longer kept on.
+const (
+	powerPolicyConfigKey  = "power-policy"
+	defaultPowerReserve   = 2 * time.Hour
+	powerPolicyNormal     = "normal"
+	powerPolicyShortened  = "shortenedRecording"
+	powerPolicySkipRecord = "skipRecording"
+)
+
+// powerPolicyConfig is read from the "power-policy" section of the config.
+type powerPolicyConfig struct {
+	Enable      bool   `mapstructure:"enable"`
+	UploadStart string `mapstructure:"upload-start"`
+	UploadEnd   string `mapstructure:"upload-end"`
+	// Battery time to keep in hand at the end of the upload window.
+	Reserve time.Duration `mapstructure:"reserve"`
+	// Processes that aren't kept on by StayOnForProcess when the battery is short.
+	LowPriorityProcesses []string `mapstructure:"low-priority-processes"`
+}
+
+// powerPolicyDecision is what the policy has decided from the last battery reading.
+type powerPolicyDecision struct {
+	Level           string    `json:"level"`
+	HoursRemaining  float64   `json:"hoursRemaining"`
+	HoursNeeded     float64   `json:"hoursNeeded"`
+	NextUploadEnd   time.Time `json:"nextUploadEnd"`
+	RecordingCutoff time.Time `json:"recordingCutoff,omitempty"` // Recording stay on requests are limited to this.
+	SkipLowPriority bool      `json:"skipLowPriority"`
+}
+
+type powerPolicy struct {
+	config powerPolicyConfig
+	// Returns the end of the current or next upload and recording windows.
+	uploadEnd    func(now time.Time) time.Time
+	recordingEnd func(now time.Time) time.Time
+
+	mu       sync.Mutex
+	decision powerPolicyDecision
+}
+
+var powerPolicyController *powerPolicy
+
+// loadPowerPolicy makes the power policy from the config, returning nil if it isn't enabled.
+func loadPowerPolicy(config *goconfig.Config) (*powerPolicy, error) {
+	if config == nil {
+		return nil, nil
+	}
+	policyConfig := powerPolicyConfig{Reserve: defaultPowerReserve}
+	if err := configcompat.Unmarshal(config, powerPolicyConfigKey, &policyConfig); err != nil {
+		return nil, err
+	}
+	if !policyConfig.Enable {
+		return nil, nil
+	}
+	if policyConfig.UploadStart == "" || policyConfig.UploadEnd == "" {
+		return nil, fmt.Errorf("upload-start and upload-end need to be set for the power policy")
+	}
+	location := goconfig.DefaultWindowLocation()
+	if err := config.Unmarshal(goconfig.LocationKey, &location); err != nil {
+		return nil, err
+	}
+	windows := goconfig.DefaultWindows()
+	if err := config.Unmarshal(goconfig.WindowsKey, &windows); err != nil {
+		return nil, err
+	}
+	lat, lng := float64(location.Latitude), float64(location.Longitude)
+	uploadWindow, err := window.New(policyConfig.UploadStart, policyConfig.UploadEnd, lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	recordingWindow, err := window.New(windows.StartRecording, windows.StopRecording, lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	return &powerPolicy{
+		config:       policyConfig,
+		uploadEnd:    func(time.Time) time.Time { return uploadWindow.NextEnd() },
+		recordingEnd: func(time.Time) time.Time { return recordingWindow.NextEnd() },
+		decision:     powerPolicyDecision{Level: powerPolicyNormal},
+	}, nil
+}
+
+// update makes a new decision from the estimated hours of battery remaining, reporting
+// a powerPolicyAdjusted event if the decision changed.
+func (p *powerPolicy) update(hoursRemaining float64, now time.Time) powerPolicyDecision {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	uploadEnd := p.uploadEnd(now)
+	needed := uploadEnd.Sub(now) + p.config.Reserve
+	d := powerPolicyDecision{
+		Level:          powerPolicyNormal,
+		HoursRemaining: math.Round(hoursRemaining*10) / 10,
+		HoursNeeded:    math.Round(needed.Hours()*10) / 10,
+		NextUploadEnd:  uploadEnd,
+	}
+	remaining := time.Duration(hoursRemaining * float64(time.Hour))
+	// A negative estimate means there isn't enough information to make one yet.
+	if hoursRemaining >= 0 && remaining < needed {
+		d.SkipLowPriority = true
+		d.Level = powerPolicyShortened
+		// Only recording before the upload window ends uses battery that is needed for the upload.
+		recordingEnd := p.recordingEnd(now)
+		if recordingEnd.Before(uploadEnd) {
+			d.RecordingCutoff = recordingEnd.Add(remaining - needed)
+			if !d.RecordingCutoff.After(now) {
+				d.RecordingCutoff = now
+				d.Level = powerPolicySkipRecord
+			}
+		}
+	}
+
+	previous := p.decision
+	p.decision = d
+	if d.Level == previous.Level && d.RecordingCutoff.Sub(previous.RecordingCutoff).Abs() < 30*time.Minute {
+		return d
+	}
+	log.Printf("Power policy changed from %s to %s, %.1f hours of battery remaining, %.1f hours needed",
+		previous.Level, d.Level, d.HoursRemaining, d.HoursNeeded)
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.PowerPolicyAdjusted, now, eventhelper.PowerPolicyChange{
+		Level:           d.Level,
+		PreviousLevel:   previous.Level,
+		HoursRemaining:  d.HoursRemaining,
+		HoursNeeded:     d.HoursNeeded,
+		NextUploadEnd:   d.NextUploadEnd,
+		SkipLowPriority: d.SkipLowPriority,
+		RecordingCutoff: d.RecordingCutoff,
+	})); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+	return d
+}
+
+func (p *powerPolicy) getDecision() powerPolicyDecision {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.decision
+}
+
+// limitStayOn limits a stay on request from the camera to the recording cutoff.
+func (p *powerPolicy) limitStayOn(until time.Time) time.Time {
+	d := p.getDecision()
+	if !d.RecordingCutoff.IsZero() && until.After(d.RecordingCutoff) {
+		return d.RecordingCutoff
+	}
+	return until
+}
+
+// allowProcess returns false if the process shouldn't be kept on because the battery is short.
+func (p *powerPolicy) allowProcess(processName string) bool {
+	return !p.getDecision().SkipLowPriority || !slices.Contains(p.config.LowPriorityProcesses, processName)
+}
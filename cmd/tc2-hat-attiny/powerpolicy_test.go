@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPowerPolicy(now time.Time) *powerPolicy {
+	return &powerPolicy{
+		config: powerPolicyConfig{
+			Reserve:              2 * time.Hour,
+			LowPriorityProcesses: []string{"audio-recorder"},
+		},
+		// Recording until 6 hours from now, uploading until 10 hours from now.
+		recordingEnd: func(time.Time) time.Time { return now.Add(6 * time.Hour) },
+		uploadEnd:    func(time.Time) time.Time { return now.Add(10 * time.Hour) },
+		decision:     powerPolicyDecision{Level: powerPolicyNormal},
+	}
+}
+
+func TestPowerPolicy(t *testing.T) {
+	now := time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	p := newTestPowerPolicy(now)
+
+	// Enough battery, or no estimate yet.
+	assert.Equal(t, powerPolicyNormal, p.update(20, now).Level)
+	assert.Equal(t, powerPolicyNormal, p.update(-1, now).Level)
+	assert.Empty(t, events.Events())
+	assert.True(t, p.allowProcess("audio-recorder"))
+
+	// 3 hours short, so recording is cut short by 3 hours.
+	d := p.update(9, now)
+	assert.Equal(t, powerPolicyShortened, d.Level)
+	assert.Equal(t, now.Add(3*time.Hour), d.RecordingCutoff)
+	assert.Equal(t, []string{"powerPolicyAdjusted"}, events.Types())
+	assert.Equal(t, now.Add(3*time.Hour), p.limitStayOn(now.Add(4*time.Hour)))
+	assert.Equal(t, now.Add(time.Hour), p.limitStayOn(now.Add(time.Hour)))
+	assert.False(t, p.allowProcess("audio-recorder"))
+	assert.True(t, p.allowProcess("salt-update"))
+
+	// The same decision isn't reported again.
+	p.update(9, now.Add(2*time.Minute))
+	assert.Len(t, events.Events(), 1)
+
+	// Too short to record at all.
+	d = p.update(5, now)
+	assert.Equal(t, powerPolicySkipRecord, d.Level)
+	assert.Equal(t, now, d.RecordingCutoff)
+	assert.Len(t, events.Events(), 2)
+
+	// Battery replaced.
+	d = p.update(50, now)
+	assert.Equal(t, powerPolicyNormal, d.Level)
+	assert.True(t, d.RecordingCutoff.IsZero())
+	assert.Len(t, events.Events(), 3)
+}
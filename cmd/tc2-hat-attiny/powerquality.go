@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+// The ATtiny reset counters are saved on each RPi boot so the resets since the last boot can
+// be reported with a hatPowerQuality event. Brown-outs of the ATtiny also cut the power to
+// the RPi, so they explain reboots that otherwise leave nothing in the logs.
+const (
+	resetCountersFile = "/etc/cacophony/attiny-reset-counters.json"
+	bootIDFile        = "/proc/sys/kernel/random/boot_id"
+)
+
+// savedResetCounters are the counters at the last RPi boot.
+type savedResetCounters struct {
+	BootID         string    `json:"bootID"`
+	Time           time.Time `json:"time"`
+	Resets         uint16    `json:"resets"`
+	BrownOuts      uint16    `json:"brownOuts"`
+	WatchdogResets uint16    `json:"watchdogResets"`
+}
+
+// powerQuality is the resets of the ATtiny since the last RPi boot.
+type powerQuality struct {
+	LastResetCause string `json:"lastResetCause"`
+	Resets         uint16 `json:"resets"`
+	BrownOuts      uint16 `json:"brownOuts"`
+	WatchdogResets uint16 `json:"watchdogResets"`
+	TotalBrownOuts uint16 `json:"totalBrownOuts"`
+	// Zero if the counters haven't been saved before.
+	Since time.Time `json:"since,omitempty"`
+}
+
+func (p powerQuality) payload() eventhelper.PowerQuality {
+	return eventhelper.PowerQuality{
+		LastResetCause: p.LastResetCause,
+		Resets:         p.Resets,
+		BrownOuts:      p.BrownOuts,
+		WatchdogResets: p.WatchdogResets,
+		TotalBrownOuts: p.TotalBrownOuts,
+		Since:          p.Since,
+	}
+}
+
+// resetCounterTracker works out the resets since the counters were last saved.
+type resetCounterTracker struct {
+	file   string
+	read   func() (attinyclient.ResetCounters, error)
+	bootID func() (string, error)
+	now    func() time.Time
+}
+
+func newResetCounterTracker(a *attiny) *resetCounterTracker {
+	return &resetCounterTracker{
+		file:   resetCountersFile,
+		read:   a.readResetCounters,
+		bootID: readBootID,
+		now:    time.Now,
+	}
+}
+
+func (a *attiny) hasResetCounters() bool {
+	return a.version >= attinyclient.ResetCountersMinMajorVersion
+}
+
+func (a *attiny) readResetCounters() (attinyclient.ResetCounters, error) {
+	if !a.hasResetCounters() {
+		return attinyclient.ResetCounters{}, fmt.Errorf("ATtiny firmware version %d does not have reset counters", a.version)
+	}
+	return a.client.ReadResetCounters()
+}
+
+func (t *resetCounterTracker) load() (*savedResetCounters, error) {
+	data, err := os.ReadFile(t.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := &savedResetCounters{}
+	return saved, json.Unmarshal(data, saved)
+}
+
+// current returns the resets since the counters were last saved, without saving them.
+func (t *resetCounterTracker) current() (powerQuality, *savedResetCounters, error) {
+	counters, err := t.read()
+	if err != nil {
+		return powerQuality{}, nil, err
+	}
+	saved, err := t.load()
+	if err != nil {
+		log.Printf("Failed to read saved reset counters: %v", err)
+	}
+	p := powerQuality{
+		LastResetCause: counters.LastCause.String(),
+		TotalBrownOuts: counters.BrownOuts,
+	}
+	if saved != nil {
+		// The counters wrap, so the difference is still right after wrapping.
+		p.Resets = counters.Resets - saved.Resets
+		p.BrownOuts = counters.BrownOuts - saved.BrownOuts
+		p.WatchdogResets = counters.WatchdogResets - saved.WatchdogResets
+		p.Since = saved.Time
+	}
+	return p, &savedResetCounters{
+		Time:           t.now(),
+		Resets:         counters.Resets,
+		BrownOuts:      counters.BrownOuts,
+		WatchdogResets: counters.WatchdogResets,
+	}, nil
+}
+
+// report sends a hatPowerQuality event with the resets since the last RPi boot and saves
+// the counters. Nothing is done if they have already been saved on this boot.
+func (t *resetCounterTracker) report() error {
+	bootID, err := t.bootID()
+	if err != nil {
+		return err
+	}
+	saved, err := t.load()
+	if err == nil && saved != nil && saved.BootID == bootID {
+		return nil
+	}
+	p, counters, err := t.current()
+	if err != nil {
+		return err
+	}
+	counters.BootID = bootID
+	if p.BrownOuts > 0 {
+		log.Printf("ATtiny had %d brown-outs since the last boot", p.BrownOuts)
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.HatPowerQuality, t.now(), p.payload())); err != nil {
+		// Don't save the counters so the resets are reported next time.
+		return err
+	}
+	data, err := json.Marshal(counters)
+	if err != nil {
+		return err
+	}
+	tmpFile := t.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.file)
+}
+
+func readBootID() (string, error) {
+	data, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// reportPowerQuality reports the ATtiny resets since the last boot, if the firmware counts them.
+func reportPowerQuality(a *attiny) {
+	if !a.hasResetCounters() {
+		return
+	}
+	if err := newResetCounterTracker(a).report(); err != nil {
+		log.Println("Error reporting ATtiny power quality:", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResetCounterReport(t *testing.T) {
+	counters := attinyclient.ResetCounters{
+		LastCause:      attinyclient.ResetPowerOnFlag,
+		Resets:         10,
+		BrownOuts:      65535,
+		WatchdogResets: 2,
+	}
+	bootID := "boot1"
+	events := eventtest.Capture(t)
+	tracker := &resetCounterTracker{
+		file:   filepath.Join(t.TempDir(), "counters.json"),
+		read:   func() (attinyclient.ResetCounters, error) { return counters, nil },
+		bootID: func() (string, error) { return bootID, nil },
+		now:    func() time.Time { return time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC) },
+	}
+
+	assert.NoError(t, tracker.report())
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "hatPowerQuality", events.Events()[0].Type)
+		assert.Equal(t, uint16(0), events.Events()[0].Details["brownOuts"])
+		assert.NotContains(t, events.Events()[0].Details, "since")
+	}
+
+	// Only reported once for each boot.
+	counters.BrownOuts = 1
+	assert.NoError(t, tracker.report())
+	assert.Len(t, events.Events(), 1)
+
+	// The brown-out counter wrapped.
+	bootID = "boot2"
+	counters.Resets = 13
+	counters.LastCause = attinyclient.ResetBrownOutFlag
+	assert.NoError(t, tracker.report())
+	if assert.Len(t, events.Events(), 2) {
+		assert.Equal(t, uint16(2), events.Events()[1].Details["brownOuts"])
+		assert.Equal(t, uint16(3), events.Events()[1].Details["resets"])
+		assert.Equal(t, "brownOut", events.Events()[1].Details["lastResetCause"])
+		assert.Contains(t, events.Events()[1].Details, "since")
+	}
+}
+
+func TestResetCountersVersion(t *testing.T) {
+	a := &attiny{version: attinyclient.ResetCountersMinMajorVersion - 1}
+	assert.False(t, a.hasResetCounters())
+	_, err := a.readResetCounters()
+	assert.Error(t, err)
+}
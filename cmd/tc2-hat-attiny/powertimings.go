@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+)
+
+const (
+	powerTimingsConfigKey     = "power-timings"
+	defaultInitialGracePeriod = 5 * time.Minute
+	defaultSaltCommandMaxWait = 30 * time.Minute
+	defaultStayOnPollInterval = 10 * time.Second
+)
+
+// powerTimings control how long the RPi is kept on for. They are read from the "power-timings"
+// section of the config and reloaded while running so they can be changed without a restart.
+type powerTimings struct {
+	InitialGracePeriod time.Duration `mapstructure:"initial-grace-period"`
+	SaltCommandMaxWait time.Duration `mapstructure:"salt-command-max-wait"`
+	// How often to check if the RP2040 or a process still wants the RPi to stay on.
+	PollInterval time.Duration `mapstructure:"poll-interval"`
+	// How long to wait for services to quiesce before powering down, see quiesce.go.
+	QuiesceBudget time.Duration `mapstructure:"quiesce-budget"`
+}
+
+func defaultPowerTimings() powerTimings {
+	return powerTimings{
+		InitialGracePeriod: defaultInitialGracePeriod,
+		SaltCommandMaxWait: defaultSaltCommandMaxWait,
+		PollInterval:       defaultStayOnPollInterval,
+		QuiesceBudget:      defaultQuiesceBudget,
+	}
+}
+
+// loadPowerTimings reloads the config and returns the power timings. If the config can't be
+// read the previous timings are kept, invalid values are replaced with the defaults.
+func loadPowerTimings(config *goconfig.Config, previous powerTimings) powerTimings {
+	if config == nil {
+		return previous
+	}
+	if err := config.Reload(); err != nil {
+		log.Errorf("Failed to reload config: %v", err)
+		return previous
+	}
+	t := defaultPowerTimings()
+	if err := configcompat.Unmarshal(config, powerTimingsConfigKey, &t); err != nil {
+		log.Errorf("Failed to read power timings: %v", err)
+		return previous
+	}
+	t = t.withDefaults()
+	if t != previous {
+		log.Printf("Power timings: initial grace period %s, salt command max wait %s, poll interval %s, quiesce budget %s",
+			durToStr(t.InitialGracePeriod), durToStr(t.SaltCommandMaxWait), durToStr(t.PollInterval), durToStr(t.QuiesceBudget))
+	}
+	return t
+}
+
+func (t powerTimings) withDefaults() powerTimings {
+	if t.InitialGracePeriod < 0 {
+		t.InitialGracePeriod = defaultInitialGracePeriod
+	}
+	if t.SaltCommandMaxWait < 0 {
+		t.SaltCommandMaxWait = defaultSaltCommandMaxWait
+	}
+	if t.PollInterval <= 0 {
+		t.PollInterval = defaultStayOnPollInterval
+	}
+	if t.QuiesceBudget < 0 {
+		t.QuiesceBudget = defaultQuiesceBudget
+	}
+	return t
+}
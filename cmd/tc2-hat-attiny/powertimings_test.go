@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPowerTimingsDefaults(t *testing.T) {
+	timings := powerTimings{
+		InitialGracePeriod: 0,
+		SaltCommandMaxWait: -time.Minute,
+		PollInterval:       0,
+	}.withDefaults()
+	assert.Equal(t, powerTimings{
+		InitialGracePeriod: 0,
+		SaltCommandMaxWait: defaultSaltCommandMaxWait,
+		PollInterval:       defaultStayOnPollInterval,
+	}, timings)
+
+	// Safe mode keeps the previous timings.
+	assert.Equal(t, defaultPowerTimings(), loadPowerTimings(nil, defaultPowerTimings()))
+}
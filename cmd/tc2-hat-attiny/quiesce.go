@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// Before powering down, services that registered with RegisterQuiesce are sent the Quiesce
+// signal with the number of seconds they have to finish what they are doing, such as closing
+// a recording. Each service calls QuiesceDone when it's ready. Powering down waits until all
+// the services are done or the quiesce budget runs out, then syncs the filesystems. Services
+// that didn't finish in time are reported in a quiesceTimeout event.
+const defaultQuiesceBudget = 20 * time.Second
+
+var quiesceController = newQuiescer()
+
+type quiescer struct {
+	notify func(budget time.Duration) error
+	sync   func()
+	now    func() time.Time
+
+	mu         sync.Mutex
+	registered map[string]string // The D-Bus senders that registered the services, by name.
+	pending    map[string]bool
+	done       chan struct{} // Closed when there are no pending services.
+}
+
+func newQuiescer() *quiescer {
+	return &quiescer{
+		notify:     func(time.Duration) error { return nil },
+		sync:       syscall.Sync,
+		registered: map[string]string{},
+	}
+}
+
+// register adds a service to be told before powering down, registered by the owner.
+func (q *quiescer) register(name, owner string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.registered[name]; !ok {
+		log.Printf("'%s' registered for quiesce before power down", name)
+	}
+	q.registered[name] = owner
+}
+
+// owner returns the sender that registered the service, empty if it isn't registered.
+func (q *quiescer) owner(name string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.registered[name]
+}
+
+// unregister stops a service from being told before powering down.
+func (q *quiescer) unregister(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.registered, name)
+	q.ackLocked(name)
+}
+
+// ack records that the service has finished and is ready for power down.
+func (q *quiescer) ack(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ackLocked(name)
+}
+
+func (q *quiescer) ackLocked(name string) {
+	if q.pending == nil || !q.pending[name] {
+		return
+	}
+	delete(q.pending, name)
+	log.Printf("'%s' is ready for power down", name)
+	if len(q.pending) == 0 {
+		close(q.done)
+	}
+}
+
+// quiesce tells the registered services to finish up and waits for them, for at most the
+// budget, then syncs the filesystems. Returns the services that didn't finish.
+func (q *quiescer) quiesce(budget time.Duration) []string {
+	q.mu.Lock()
+	q.pending = map[string]bool{}
+	for name := range q.registered {
+		q.pending[name] = true
+	}
+	q.done = make(chan struct{})
+	if len(q.pending) == 0 {
+		close(q.done)
+	}
+	done := q.done
+	count := len(q.pending)
+	q.mu.Unlock()
+
+	start := time.Now()
+	if count > 0 {
+		log.Printf("Waiting up to %s for %d services to quiesce", durToStr(budget), count)
+		if err := q.notify(budget); err != nil {
+			log.Errorf("Failed to send quiesce signal: %v", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(budget):
+		}
+	}
+
+	q.mu.Lock()
+	failed := []string{}
+	for name := range q.pending {
+		failed = append(failed, name)
+	}
+	q.pending = nil
+	q.mu.Unlock()
+	sort.Strings(failed)
+
+	log.Println("Syncing filesystems")
+	q.sync()
+
+	if len(failed) > 0 {
+		log.Printf("Services didn't quiesce in %s: %v", durToStr(budget), failed)
+		if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.QuiesceTimedOut, start, eventhelper.QuiesceTimeout{
+			Services:      failed,
+			BudgetSeconds: int(budget.Seconds()),
+		})); err != nil {
+			log.Errorf("Error adding event: %v", err)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQuiescer(synced *bool) *quiescer {
+	q := newQuiescer()
+	q.sync = func() { *synced = true }
+	return q
+}
+
+func TestQuiesceAllDone(t *testing.T) {
+	events := eventtest.Capture(t)
+	synced := false
+	q := newTestQuiescer(&synced)
+	q.register("thermal-recorder", "")
+	q.register("audiobait", "")
+	q.notify = func(budget time.Duration) error {
+		assert.Equal(t, time.Minute, budget)
+		go q.ack("thermal-recorder")
+		go q.ack("audiobait")
+		return nil
+	}
+
+	start := time.Now()
+	assert.Empty(t, q.quiesce(time.Minute))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, synced)
+	assert.Empty(t, events.Events())
+}
+
+func TestQuiesceTimeout(t *testing.T) {
+	events := eventtest.Capture(t)
+	synced := false
+	q := newTestQuiescer(&synced)
+	q.register("thermal-recorder", "")
+	q.register("audiobait", "")
+	q.register("old-service", "")
+	q.unregister("old-service")
+	q.notify = func(time.Duration) error {
+		q.ack("audiobait")
+		return nil
+	}
+
+	assert.Equal(t, []string{"thermal-recorder"}, q.quiesce(10*time.Millisecond))
+	assert.True(t, synced)
+	assert.Equal(t, []string{"quiesceTimeout"}, events.Types())
+	assert.Equal(t, []string{"thermal-recorder"}, events.Events()[0].Details["services"])
+
+	// Acks after the power down has given up are ignored.
+	q.ack("thermal-recorder")
+}
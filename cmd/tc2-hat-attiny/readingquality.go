@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+)
+
+// analogQuality collects the quality of the analog readings from the ATtiny.
+type analogQuality struct {
+	mu      sync.Mutex
+	quality battery.ReadingQuality
+}
+
+func (q *analogQuality) add(noise uint16, retries int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.quality.Noise = max(q.quality.Noise, noise)
+	q.quality.Retries += retries
+}
+
+func (q *analogQuality) take() battery.ReadingQuality {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	quality := q.quality
+	q.quality = battery.ReadingQuality{}
+	return quality
+}
+
+var (
+	batteryStatusMu   sync.Mutex
+	lastBatteryStatus battery.Status
+)
+
+func setBatteryStatus(status battery.Status) {
+	batteryStatusMu.Lock()
+	defer batteryStatusMu.Unlock()
+	lastBatteryStatus = status
+}
+
+func getBatteryStatus() battery.Status {
+	batteryStatusMu.Lock()
+	defer batteryStatusMu.Unlock()
+	return lastBatteryStatus
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+)
+
+type batteryCSVRow struct {
+	time time.Time
+	hv   float32
+	lv   float32
+	rtc  float32
+}
+
+// csvBatteryReader replays battery readings from a battery-readings.csv file in place of the ATtiny.
+// It also acts as the clock for the battery monitor so the replay is deterministic.
+type csvBatteryReader struct {
+	rows    []batteryCSVRow
+	current int
+	speed   float64 // Replay speed multiplier, 0 replays as fast as possible.
+}
+
+func newCSVBatteryReader(filePath string, speed float64) (*csvBatteryReader, error) {
+	rows, err := readBatteryCSV(filePath, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no battery readings found in %s", filePath)
+	}
+	return &csvBatteryReader{rows: rows, current: -1, speed: speed}, nil
+}
+
+// readBatteryCSV reads the time and voltages from a battery readings file in any of its
+// layouts, the quality flags are ignored. If strict is false lines that can't be parsed are
+// skipped, such as one cut short by losing power.
+func readBatteryCSV(filePath string, strict bool) ([]batteryCSVRow, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rows := []batteryCSVRow{}
+	parser := &batterycsv.Parser{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		row, ok, err := parser.Parse(scanner.Text())
+		if err != nil && strict {
+			return nil, fmt.Errorf("%s line %d: %v", filePath, lineNum, err)
+		}
+		if ok {
+			rows = append(rows, batteryCSVRow{time: row.Time, hv: row.HV, lv: row.LV, rtc: row.RTC})
+		}
+	}
+	return rows, scanner.Err()
+}
+
+// ReadHVBattery moves on to the next row, the LV and RTC readings are then from the same row.
+func (r *csvBatteryReader) ReadHVBattery() (float32, error) {
+	if r.current+1 >= len(r.rows) {
+		return 0, io.EOF
+	}
+	r.current++
+	return r.rows[r.current].hv, nil
+}
+
+func (r *csvBatteryReader) ReadLVBattery() (float32, error) {
+	return r.rows[r.current].lv, nil
+}
+
+func (r *csvBatteryReader) ReadRTCBattery() (float32, error) {
+	return r.rows[r.current].rtc, nil
+}
+
+func (r *csvBatteryReader) now() time.Time {
+	if r.current < 0 {
+		return r.rows[0].time
+	}
+	return r.rows[r.current].time
+}
+
+// sleep waits for the time between the current and next reading, scaled by the replay speed.
+func (r *csvBatteryReader) sleep(time.Duration) {
+	if r.speed <= 0 || r.current+1 >= len(r.rows) {
+		return
+	}
+	gap := r.rows[r.current+1].time.Sub(r.rows[r.current].time)
+	time.Sleep(time.Duration(float64(gap) / r.speed))
+}
+
+// replayBatteryReadings runs the battery readings from a CSV file through the battery monitor.
+// Events are printed instead of being sent and the readings and state are written to a temporary directory.
+func replayBatteryReadings(config *goconfig.Config, filePath string, speed float64) error {
+	batteryConfig := goconfig.DefaultBattery()
+	if err := config.Unmarshal(goconfig.BatteryKey, &batteryConfig); err != nil {
+		return err
+	}
+	reader, err := newCSVBatteryReader(filePath, speed)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "battery-replay")
+	if err != nil {
+		return err
+	}
+	log.Printf("Replaying %d battery readings, output in %s", len(reader.rows), dir)
+
+	m := battery.NewMonitor(reader, &batteryConfig, filepath.Join(dir, "battery-readings.csv"), filepath.Join(dir, "battery_state.json"))
+	m.Now = reader.now
+	m.Sleep = reader.sleep
+	m.AddEvent = printEvent
+	if err := m.Run(); err != nil {
+		return err
+	}
+	state, err := battery.LoadState(m.StateFile)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Printf("Final battery state: %s", string(data))
+	return nil
+}
+
+func printEvent(event eventclient.Event) error {
+	data, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s %s\n", event.Timestamp.Format("2006-01-02 15:04:05"), event.Type, string(data))
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatteryReplay(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "battery-readings.csv")
+	csv := strings.Join([]string{
+		"time, hv, lv, rtc",
+		"2024-05-01 10:00:00, 0.00, 12.40, 3.00",
+		"2024-05-01 10:02:00, 0.00, 12.39, 3.00",
+		"2024-05-01 10:04:00, 0.00, 12.38, 3.00",
+	}, "\n")
+	assert.NoError(t, os.WriteFile(csvFile, []byte(csv), 0644))
+
+	reader, err := newCSVBatteryReader(csvFile, 0)
+	assert.NoError(t, err)
+	assert.Len(t, reader.rows, 3)
+
+	events := []eventclient.Event{}
+	batteryConfig := goconfig.DefaultBattery()
+	m := battery.NewMonitor(reader, &batteryConfig, filepath.Join(dir, "out.csv"), filepath.Join(dir, "state.json"))
+	m.Now = reader.now
+	m.Sleep = reader.sleep
+	m.AddEvent = func(e eventclient.Event) error {
+		events = append(events, e)
+		return nil
+	}
+	assert.NoError(t, m.Run())
+
+	// Readings are logged with the time from the replayed file.
+	out, err := os.ReadFile(m.ReadingsFile)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	assert.Len(t, lines, 4)
+	assert.Equal(t, batterycsv.Header(), lines[0])
+	assert.Equal(t, csvtime.Format(reader.rows[2].time, false)+", 0.00, 12.38, 3.00, 0", lines[3])
+
+	// First reading always reports the battery level.
+	assert.Len(t, events, 1)
+	assert.Equal(t, "rpiBattery", events[0].Type)
+	assert.Equal(t, reader.rows[0].time, events[0].Timestamp)
+	assert.Equal(t, float32(12.40), events[0].Details["voltage"])
+}
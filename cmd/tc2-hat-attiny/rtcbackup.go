@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/window"
+)
+
+// The RTC keeps time while the RPi is off from a coin cell or, on some hats, a supercap that
+// is charged while the RPi is on. A supercap only lasts days, so for those hats how long it
+// can keep time is modelled from the RTC voltage:
+//
+//	[rtc-backup]
+//	type = "supercap"
+//	min-voltage = 1.2
+//	time-constant = "336h"
+//
+// The supercap discharges through the RTC close to exponentially, V = V0*exp(-t/τ). The time
+// constant τ is learnt from the gaps in the battery readings, from the RTC voltage before and
+// after each time the RPi was off, starting from time-constant until there is a measurable
+// drop. The holdup is how long the RTC can keep time from the present voltage before it drops
+// below min-voltage. If the RPi powers off until the next power on window for longer than
+// the holdup an rtcHoldupShort event is made, as the device will lose the time.
+const (
+	rtcBackupConfigKey = "rtc-backup"
+	rtcBackupCoinCell  = "coin-cell"
+	rtcBackupSupercap  = "supercap"
+
+	// Gaps in the readings shorter than this are the service restarting, not the RPi being off.
+	minRTCOffPeriod = time.Hour
+	// Total drop, as ln(V0/V1), over the off periods before the time constant is learnt.
+	minRTCLearnDrop = 0.02
+)
+
+type rtcBackupConfig struct {
+	Type         string        `mapstructure:"type"`
+	MinVoltage   float32       `mapstructure:"min-voltage"`
+	TimeConstant time.Duration `mapstructure:"time-constant"`
+}
+
+func defaultRTCBackupConfig() rtcBackupConfig {
+	return rtcBackupConfig{
+		Type:         rtcBackupCoinCell,
+		MinVoltage:   1.2,
+		TimeConstant: 14 * 24 * time.Hour,
+	}
+}
+
+func loadRTCBackupConfig(config *goconfig.Config) (rtcBackupConfig, error) {
+	c := defaultRTCBackupConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, rtcBackupConfigKey, &c); err != nil {
+		return defaultRTCBackupConfig(), err
+	}
+	if c.Type != rtcBackupCoinCell && c.Type != rtcBackupSupercap {
+		return defaultRTCBackupConfig(), fmt.Errorf("%s type must be %s or %s", rtcBackupConfigKey, rtcBackupCoinCell, rtcBackupSupercap)
+	}
+	if c.MinVoltage <= 0 || c.TimeConstant <= 0 {
+		return defaultRTCBackupConfig(), fmt.Errorf("%s min-voltage and time-constant must be positive", rtcBackupConfigKey)
+	}
+	return c, nil
+}
+
+// rtcDischarge is the discharge of the supercap learnt from the readings.
+type rtcDischarge struct {
+	TimeConstant time.Duration
+	Learnt       bool // false if TimeConstant is from the config.
+	OffPeriods   int
+	OffTime      time.Duration
+	FullVoltage  float32 // Highest RTC voltage seen, taken as fully charged.
+}
+
+// learnRTCDischarge learns the discharge from the readings, in time order.
+func learnRTCDischarge(rows []batteryCSVRow, c rtcBackupConfig) rtcDischarge {
+	d := rtcDischarge{TimeConstant: c.TimeConstant}
+	drop := 0.0
+	for i, row := range rows {
+		d.FullVoltage = max(d.FullVoltage, row.rtc)
+		if i == 0 {
+			continue
+		}
+		before := rows[i-1]
+		gap := row.time.Sub(before.time)
+		// Once below the min voltage the RTC has stopped, so the decay can't be measured.
+		if gap < minRTCOffPeriod || before.rtc < c.MinVoltage || row.rtc < c.MinVoltage {
+			continue
+		}
+		d.OffPeriods++
+		d.OffTime += gap
+		// Increases from noise are kept so that they cancel out the decreases from noise.
+		drop += math.Log(float64(before.rtc / row.rtc))
+	}
+	if drop >= minRTCLearnDrop {
+		d.TimeConstant = time.Duration(float64(d.OffTime) / drop)
+		d.Learnt = true
+	}
+	return d
+}
+
+// holdup returns how long the RTC can keep time from the voltage.
+func (d rtcDischarge) holdup(voltage, minVoltage float32) time.Duration {
+	if voltage <= minVoltage {
+		return 0
+	}
+	return time.Duration(float64(d.TimeConstant) * math.Log(float64(voltage/minVoltage)))
+}
+
+// RTCBackupStatus is the modelled state of the supercap, for the D-Bus API.
+type RTCBackupStatus struct {
+	Voltage           float32 `json:"voltage"`
+	ChargePercent     float64 `json:"chargePercent"` // Of the holdup when fully charged.
+	HoldupHours       float64 `json:"holdupHours"`
+	TimeConstantHours float64 `json:"timeConstantHours"`
+	Learnt            bool    `json:"learnt"`
+	OffPeriods        int     `json:"offPeriods"`
+}
+
+func (d rtcDischarge) status(voltage, minVoltage float32) RTCBackupStatus {
+	s := RTCBackupStatus{
+		Voltage:           voltage,
+		HoldupHours:       math.Round(d.holdup(voltage, minVoltage).Hours()*10) / 10,
+		TimeConstantHours: math.Round(d.TimeConstant.Hours()*10) / 10,
+		Learnt:            d.Learnt,
+		OffPeriods:        d.OffPeriods,
+	}
+	if full := d.holdup(d.FullVoltage, minVoltage); full > 0 {
+		s.ChargePercent = math.Round(min(100, 100*float64(d.holdup(voltage, minVoltage))/float64(full)))
+	}
+	return s
+}
+
+// rtcBackup tracks the supercap while the service is running.
+type rtcBackup struct {
+	config    rtcBackupConfig
+	discharge rtcDischarge
+	// Returns how long until the next power on window, 0 if it is always on.
+	untilPowerOn func() time.Duration
+
+	mu      sync.Mutex
+	voltage float32 // Last RTC voltage, 0 before the first reading.
+}
+
+var rtcBackupController *rtcBackup
+
+// loadRTCBackup learns the discharge from the battery readings file, returning nil if the
+// RTC has a coin cell.
+func loadRTCBackup(config *goconfig.Config, readingsFile string) (*rtcBackup, error) {
+	c, err := loadRTCBackupConfig(config)
+	if err != nil || c.Type != rtcBackupSupercap {
+		return nil, err
+	}
+	location := goconfig.DefaultWindowLocation()
+	if err := config.Unmarshal(goconfig.LocationKey, &location); err != nil {
+		return nil, err
+	}
+	windows := goconfig.DefaultWindows()
+	if err := config.Unmarshal(goconfig.WindowsKey, &windows); err != nil {
+		return nil, err
+	}
+	powerWindow, err := window.New(windows.PowerOn, windows.PowerOff, float64(location.Latitude), float64(location.Longitude))
+	if err != nil {
+		return nil, err
+	}
+	rows := readRTCHistory(readingsFile)
+	b := &rtcBackup{
+		config:       c,
+		discharge:    learnRTCDischarge(rows, c),
+		untilPowerOn: powerWindow.Until,
+	}
+	if len(rows) > 0 {
+		b.voltage = rows[len(rows)-1].rtc
+	}
+	if b.discharge.Learnt {
+		log.Printf("RTC supercap time constant of %s learnt from %d off periods", durToStr(b.discharge.TimeConstant), b.discharge.OffPeriods)
+	}
+	return b, nil
+}
+
+// readRTCHistory reads the battery readings file, skipping lines that can't be parsed.
+func readRTCHistory(path string) []batteryCSVRow {
+	rows, _ := readBatteryCSV(path, false)
+	return rows
+}
+
+// update records the latest RTC voltage.
+func (b *rtcBackup) update(voltage float32) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.voltage = voltage
+}
+
+func (b *rtcBackup) status() RTCBackupStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.discharge.status(b.voltage, b.config.MinVoltage)
+}
+
+// checkPowerOff reports an rtcHoldupShort event if the RPi will be off until the next power
+// on window for longer than the supercap can keep the time.
+func (b *rtcBackup) checkPowerOff(now time.Time) {
+	if b == nil {
+		return
+	}
+	plannedOff := b.untilPowerOn()
+	s := b.status()
+	holdup := time.Duration(s.HoldupHours * float64(time.Hour))
+	if s.Voltage <= 0 || plannedOff <= holdup {
+		return
+	}
+	log.Printf("Powering off for %s but the RTC supercap will only keep the time for %s", durToStr(plannedOff), durToStr(holdup))
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.RTCHoldupShort, now, eventhelper.RTCHoldup{
+		PlannedOffHours: math.Round(plannedOff.Hours()*10) / 10,
+		HoldupHours:     s.HoldupHours,
+		RTCVoltage:      s.Voltage,
+		Learnt:          s.Learnt,
+	})); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+}
+
+// printRTCHoldup prints the modelled state of the supercap from the battery readings, warning
+// if it won't keep the time for the planned off period, if one is given.
+func printRTCHoldup(config *goconfig.Config, plannedOffStr string) error {
+	plannedOff := time.Duration(0)
+	if plannedOffStr != "" {
+		var err error
+		if plannedOff, err = time.ParseDuration(plannedOffStr); err != nil {
+			return fmt.Errorf("invalid planned off period: %v", err)
+		}
+	}
+	b, err := loadRTCBackup(config, batteryReadingsFile)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return fmt.Errorf("the RTC has a coin cell, set %s type to \"%s\" for a supercap", rtcBackupConfigKey, rtcBackupSupercap)
+	}
+	s := b.status()
+	source := "from the config"
+	if s.Learnt {
+		source = fmt.Sprintf("learnt from %d off periods", s.OffPeriods)
+	}
+	holdup := time.Duration(s.HoldupHours * float64(time.Hour))
+	log.Printf("RTC supercap at %.2fV, %.0f%% charged", s.Voltage, s.ChargePercent)
+	log.Printf("Time constant %s, %s", durToStr(time.Duration(s.TimeConstantHours*float64(time.Hour))), source)
+	log.Printf("Keeps the time for %s without power", durToStr(holdup))
+	if plannedOff > holdup {
+		log.Printf("Warning: the RTC will lose the time if the device is off for %s", durToStr(plannedOff))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLearnRTCDischarge(t *testing.T) {
+	c := defaultRTCBackupConfig()
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	tau := 5 * 24 * time.Hour
+	decay := func(v float32, off time.Duration) float32 {
+		return v * float32(math.Exp(-off.Hours()/tau.Hours()))
+	}
+	rows := []batteryCSVRow{
+		{time: start, rtc: 3.0},
+		// Off overnight, then charged again soon after powering on.
+		{time: start.Add(14 * time.Hour), rtc: decay(3.0, 14*time.Hour)},
+		{time: start.Add(14*time.Hour + 2*time.Minute), rtc: 3.0},
+		{time: start.Add(34*time.Hour + 2*time.Minute), rtc: decay(3.0, 20*time.Hour)},
+		// The RTC stopped, so this gap isn't used.
+		{time: start.Add(100 * time.Hour), rtc: 0.5},
+	}
+	d := learnRTCDischarge(rows, c)
+	assert.True(t, d.Learnt)
+	assert.Equal(t, 2, d.OffPeriods)
+	assert.Equal(t, float32(3.0), d.FullVoltage)
+	assert.InDelta(t, tau.Hours(), d.TimeConstant.Hours(), 1)
+	assert.InDelta(t, tau.Hours()*math.Log(3.0/1.2), d.holdup(3.0, c.MinVoltage).Hours(), 1)
+	assert.Zero(t, d.holdup(1.0, c.MinVoltage))
+
+	// Without a measurable drop the time constant from the config is used.
+	d = learnRTCDischarge([]batteryCSVRow{{time: start, rtc: 3.0}, {time: start.Add(10 * time.Hour), rtc: 3.0}}, c)
+	assert.False(t, d.Learnt)
+	assert.Equal(t, c.TimeConstant, d.TimeConstant)
+}
+
+func TestRTCBackupCheckPowerOff(t *testing.T) {
+	events := eventtest.Capture(t)
+	b := &rtcBackup{
+		config:       defaultRTCBackupConfig(),
+		discharge:    rtcDischarge{TimeConstant: 24 * time.Hour, FullVoltage: 3.0},
+		untilPowerOn: func() time.Duration { return 12 * time.Hour },
+		voltage:      3.0,
+	}
+	assert.Equal(t, float64(100), b.status().ChargePercent)
+	b.checkPowerOff(time.Now())
+	assert.Empty(t, events.Events())
+
+	// Holds up for about 7 hours at 1.6V.
+	b.update(1.6)
+	assert.Equal(t, float64(31), b.status().ChargePercent)
+	b.checkPowerOff(time.Now())
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "rtcHoldupShort", events.Events()[0].Type)
+		assert.Equal(t, 12.0, events.Events()[0].Details["plannedOffHours"])
+	}
+
+	// Nothing to check with a coin cell.
+	var coinCell *rtcBackup
+	coinCell.update(3.0)
+	coinCell.checkPowerOff(time.Now())
+}
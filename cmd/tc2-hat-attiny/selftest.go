@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+const selfTestLinkReads = 50
+
+type selfTestCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Details string `json:"details,omitempty"`
+}
+
+type selfTestResult struct {
+	Checks       []selfTestCheck `json:"checks"`
+	LinkStats    LinkStats       `json:"linkStats"`
+	PowerQuality *powerQuality   `json:"powerQuality,omitempty"`
+}
+
+func (r *selfTestResult) add(name string, passed bool, details string) {
+	r.Checks = append(r.Checks, selfTestCheck{Name: name, Passed: passed, Details: details})
+}
+
+func (r *selfTestResult) Passed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// runSelfTest checks that the ATtiny is working and that the link to it is healthy.
+func runSelfTest(a *attiny) *selfTestResult {
+	result := &selfTestResult{}
+
+	typeErrors := 0
+	for i := 0; i < selfTestLinkReads; i++ {
+		val, err := a.readRegister(attinyclient.TypeReg)
+		if err != nil || val != attinyclient.TypeVal {
+			typeErrors++
+		}
+	}
+	result.add("typeRegisterReads", typeErrors == 0,
+		fmt.Sprintf("%d of %d reads failed", typeErrors, selfTestLinkReads))
+
+	errorCodes, err := a.checkForErrorCodes(false)
+	if err != nil {
+		result.add("errorCodes", false, err.Error())
+	} else {
+		errorStrs := []string{}
+		for _, e := range errorCodes {
+			errorStrs = append(errorStrs, e.String())
+		}
+		result.add("errorCodes", len(errorCodes) == 0, strings.Join(errorStrs, ", "))
+	}
+
+	result.LinkStats = linkStats.Stats()
+	result.add("linkQuality", result.LinkStats.FailureRatePercent <= linkDegradedPercent,
+		fmt.Sprintf("failure rate %.1f%%, %d CRC failures, %d retries, avg latency %.0fms",
+			result.LinkStats.FailureRatePercent, result.LinkStats.CRCFailures,
+			result.LinkStats.Retries, result.LinkStats.AvgLatencyMs))
+
+	if a.hasResetCounters() {
+		p, _, err := newResetCounterTracker(a).current()
+		if err != nil {
+			result.add("powerQuality", false, err.Error())
+		} else {
+			result.PowerQuality = &p
+			result.add("powerQuality", p.BrownOuts == 0,
+				fmt.Sprintf("%d brown-outs, %d watchdog resets and %d resets since the last boot, last reset cause %s",
+					p.BrownOuts, p.WatchdogResets, p.Resets, p.LastResetCause))
+		}
+	}
+
+	return result
+}
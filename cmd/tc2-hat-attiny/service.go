@@ -19,13 +19,17 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"runtime"
 	"strings"
 	"time"
 
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusapi"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusauth"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
 	"github.com/godbus/dbus"
-	"github.com/godbus/dbus/introspect"
+	"github.com/godbus/dbus/prop"
 )
 
 const (
@@ -33,11 +37,26 @@ const (
 	dbusPath = "/org/cacophony/ATtiny"
 )
 
+// api is the version and capabilities of the D-Bus API, see the dbusapi package.
+var api = dbusapi.API{
+	Version: 1,
+	Capabilities: []string{
+		"isPresent", "stayOnFor", "stayOnForProcess", "linkStats", "errorLog",
+		"auxPower", "powerPolicy", "onReason", "quiesce", "cameraState",
+		"batteryStatus", "rtcBackup", "signalStats", "batteryReplaced",
+	},
+}
+
 type service struct {
 	attiny *attiny
+	auth   *dbusauth.Authorizer // Checks callers of the methods that change the power or the ATtiny.
 }
 
-func startService(a *attiny) error {
+// onReasonProps has the OnReason and OnUntil properties, showing why the RPi is being kept
+// on and until when. OnUntil is an RFC3339 time, empty when powering off.
+var onReasonProps *prop.Properties
+
+func startService(a *attiny, configDir string) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return err
@@ -52,20 +71,29 @@ func startService(a *attiny) error {
 
 	s := &service{
 		attiny: a,
+		auth:   dbusauth.Load(conn, dbusName, configDir),
 	}
-	conn.Export(s, dbusPath, dbusName)
-	conn.Export(genIntrospectable(s), dbusPath, "org.freedesktop.DBus.Introspectable")
-	return nil
+	quiesceController.notify = func(budget time.Duration) error {
+		return conn.Emit(dbusPath, dbusName+".Quiesce", int32(budget.Seconds()))
+	}
+	onReasonProps, err = dbusapi.Export(conn, s, dbusPath, dbusName, api, map[string]*prop.Prop{
+		"OnReason": {Value: "", Emit: prop.EmitTrue},
+		"OnUntil":  {Value: "", Emit: prop.EmitTrue},
+	})
+	return err
 }
 
-func genIntrospectable(v interface{}) introspect.Introspectable {
-	node := &introspect.Node{
-		Interfaces: []introspect.Interface{{
-			Name:    dbusName,
-			Methods: introspect.Methods(v),
-		}},
+// setOnReason updates the OnReason and OnUntil properties.
+func setOnReason(reason string, until time.Time) {
+	if onReasonProps == nil {
+		return
+	}
+	untilStr := ""
+	if !until.IsZero() {
+		untilStr = until.Format(time.RFC3339)
 	}
-	return introspect.NewIntrospectable(node)
+	onReasonProps.SetMust(dbusName, "OnReason", reason)
+	onReasonProps.SetMust(dbusName, "OnUntil", untilStr)
 }
 
 // IsPresent returns whether or not an ATtiny was detected.
@@ -74,7 +102,10 @@ func (s service) IsPresent() (bool, *dbus.Error) {
 }
 
 // StayOnFor will delay turning off the raspberry pi for m minutes.
-func (s service) StayOnFor(m int) *dbus.Error {
+func (s service) StayOnFor(sender dbus.Sender, m int) *dbus.Error {
+	if err := s.auth.Check(sender, "StayOnFor"); err != nil {
+		return err
+	}
 	err := setStayOnUntil(time.Now().Add(time.Duration(m) * time.Minute))
 	if err != nil {
 		return dbusErr(err)
@@ -82,21 +113,180 @@ func (s service) StayOnFor(m int) *dbus.Error {
 	return nil
 }
 
-// StayOnFinished finished staying on for this process.
-func (s service) StayOnFinished(processName string) *dbus.Error {
+// StayOnFinished finished staying on for this process. Only the sender that asked to stay on
+// for the process, or root, can finish it.
+func (s service) StayOnFinished(sender dbus.Sender, processName string) *dbus.Error {
+	if err := s.auth.CheckOwner(sender, stayOnOwner(processName), "StayOnFinished"); err != nil {
+		return err
+	}
 	stayOnFinished(processName)
 	return nil
 }
 
 // StayOnForProcess will delay turning off the raspberry pi for m minutes or until process says finished.
-func (s service) StayOnForProcess(processName string, maxDuration int) *dbus.Error {
-	err := setStayOnForProcess(processName, time.Now().Add(time.Duration(maxDuration)*time.Minute))
+func (s service) StayOnForProcess(sender dbus.Sender, processName string, maxDuration int) *dbus.Error {
+	if err := s.auth.Check(sender, "StayOnForProcess"); err != nil {
+		return err
+	}
+	err := setStayOnForProcess(processName, string(sender), time.Now().Add(time.Duration(maxDuration)*time.Minute))
 	if err != nil {
 		return dbusErr(err)
 	}
 	return nil
 }
 
+// RegisterQuiesce registers the process to be sent the Quiesce signal before powering down.
+// The process then has the number of seconds in the signal to call QuiesceDone.
+func (s service) RegisterQuiesce(sender dbus.Sender, processName string) *dbus.Error {
+	if err := s.auth.Check(sender, "RegisterQuiesce"); err != nil {
+		return err
+	}
+	quiesceController.register(processName, string(sender))
+	return nil
+}
+
+// UnregisterQuiesce stops the process being waited for before powering down. Only the sender
+// that registered the process, or root, can unregister it.
+func (s service) UnregisterQuiesce(sender dbus.Sender, processName string) *dbus.Error {
+	if err := s.auth.CheckOwner(sender, quiesceController.owner(processName), "UnregisterQuiesce"); err != nil {
+		return err
+	}
+	quiesceController.unregister(processName)
+	return nil
+}
+
+// QuiesceDone is called by a process when it is ready for power down. Only the sender that
+// registered the process, or root, can say it is done.
+func (s service) QuiesceDone(sender dbus.Sender, processName string) *dbus.Error {
+	if err := s.auth.CheckOwner(sender, quiesceController.owner(processName), "QuiesceDone"); err != nil {
+		return err
+	}
+	quiesceController.ack(processName)
+	return nil
+}
+
+// GetCameraState returns the camera state and the major version of the ATtiny firmware.
+func (s service) GetCameraState() (string, int32, *dbus.Error) {
+	if s.attiny == nil {
+		return "", 0, dbusErr(errors.New("no ATtiny found"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return s.attiny.CameraState.String(), int32(s.attiny.version), nil
+}
+
+// GetLinkStats returns the statistics of the I2C link to the ATtiny as JSON.
+func (s service) GetLinkStats() (string, *dbus.Error) {
+	data, err := json.Marshal(linkStats.Stats())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetSignalStats returns the statistics of the signals from the ATtiny, with the latency
+// from the signal to the commands being read, as JSON.
+func (s service) GetSignalStats() (string, *dbus.Error) {
+	data, err := json.Marshal(signalStats.Stats())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetBatteryStatus returns the last battery reading and its quality as JSON.
+func (s service) GetBatteryStatus() (string, *dbus.Error) {
+	data, err := json.Marshal(getBatteryStatus())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// BatteryReplaced records that the battery pack has been swapped, starting the learned battery
+// state afresh for the new pack. The old pack defaults to the new pack of the last swap.
+func (s service) BatteryReplaced(sender dbus.Sender, oldPack, newPack string) *dbus.Error {
+	if err := s.auth.Check(sender, "BatteryReplaced"); err != nil {
+		return err
+	}
+	if batteryMonitorController == nil {
+		return dbusErr(errors.New("the battery isn't being monitored"))
+	}
+	batteryMonitorController.RequestSwap(battery.Swap{OldPack: oldPack, NewPack: newPack})
+	return nil
+}
+
+// GetRTCBackup returns the modelled state of the RTC supercap as JSON.
+func (s service) GetRTCBackup() (string, *dbus.Error) {
+	if rtcBackupController == nil {
+		return "", dbusErr(errors.New("the RTC doesn't have a supercap"))
+	}
+	data, err := json.Marshal(rtcBackupController.status())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetErrorLog returns the persistent error log from the ATtiny as JSON.
+func (s service) GetErrorLog() (string, *dbus.Error) {
+	entries, err := s.attiny.readErrorLog()
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// ClearErrorLog clears the persistent error log on the ATtiny.
+func (s service) ClearErrorLog(sender dbus.Sender) *dbus.Error {
+	if err := s.auth.Check(sender, "ClearErrorLog"); err != nil {
+		return err
+	}
+	return dbusErr(s.attiny.clearErrorLog())
+}
+
+// SetAuxPower turns the aux power on or off for the given minutes, overriding the aux power
+// window. 0 minutes keeps it until the service restarts. Turning it on resets an overcurrent trip.
+func (s service) SetAuxPower(sender dbus.Sender, on bool, minutes int) *dbus.Error {
+	if err := s.auth.Check(sender, "SetAuxPower"); err != nil {
+		return err
+	}
+	p, err := getAuxPowerController()
+	if err != nil {
+		return dbusErr(err)
+	}
+	return dbusErr(p.setOverride(on, time.Duration(minutes)*time.Minute))
+}
+
+// GetAuxPower returns the state of the aux power as JSON.
+func (s service) GetAuxPower() (string, *dbus.Error) {
+	p, err := getAuxPowerController()
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	data, err := json.Marshal(p.getStatus())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetPowerPolicy returns the last decision of the power policy as JSON.
+func (s service) GetPowerPolicy() (string, *dbus.Error) {
+	if powerPolicyController == nil {
+		return "", dbusErr(errors.New("power policy is not enabled"))
+	}
+	data, err := json.Marshal(powerPolicyController.getDecision())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
 func dbusErr(err error) *dbus.Error {
 	if err == nil {
 		return nil
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusauth"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestService() service {
+	uids := map[string]uint32{"root": 0, "pi": 1000, "thermal": 1001, "www-data": 33}
+	config := dbusauth.DefaultConfig()
+	config.AllowUsers = []string{"pi", "thermal"}
+	return service{auth: dbusauth.NewWithUsers(dbusName, config, uids)}
+}
+
+// Only the sender that asked to stay on for a process, or root, can finish it.
+func TestStayOnFinishedOwner(t *testing.T) {
+	events := eventtest.Capture(t)
+	s := newTestService()
+	defer stayOnFinished("test-process")
+
+	assert.Nil(t, s.StayOnForProcess("thermal", "test-process", 10))
+	assert.NotNil(t, s.StayOnFinished("pi", "test-process"))
+	assert.NotNil(t, s.StayOnFinished("www-data", "test-process"))
+	assert.Contains(t, stayOnForProcess, "test-process")
+	assert.Equal(t, []string{"dbusAccessDenied", "dbusAccessDenied"}, events.Types())
+
+	assert.Nil(t, s.StayOnFinished("thermal", "test-process"))
+	assert.NotContains(t, stayOnForProcess, "test-process")
+
+	assert.Nil(t, s.StayOnForProcess("thermal", "test-process", 10))
+	assert.Nil(t, s.StayOnFinished("root", "test-process"))
+	assert.NotContains(t, stayOnForProcess, "test-process")
+}
+
+// Only the sender that registered a process for quiesce, or root, can unregister it or say
+// it is done.
+func TestQuiesceOwner(t *testing.T) {
+	events := eventtest.Capture(t)
+	controller := quiesceController
+	defer func() { quiesceController = controller }()
+	synced := false
+	quiesceController = newTestQuiescer(&synced)
+	s := newTestService()
+
+	assert.Nil(t, s.RegisterQuiesce("thermal", "thermal-recorder"))
+	assert.Nil(t, s.RegisterQuiesce("pi", "audiobait"))
+	assert.NotNil(t, s.UnregisterQuiesce("pi", "thermal-recorder"))
+	quiesceController.notify = func(time.Duration) error {
+		assert.NotNil(t, s.QuiesceDone("pi", "thermal-recorder"))
+		assert.Nil(t, s.QuiesceDone("pi", "audiobait"))
+		return nil
+	}
+	assert.Equal(t, []string{"thermal-recorder"}, quiesceController.quiesce(10*time.Millisecond))
+	assert.Equal(t, []string{"dbusAccessDenied", "dbusAccessDenied", "quiesceTimeout"}, events.Types())
+
+	quiesceController.notify = func(time.Duration) error {
+		assert.Nil(t, s.QuiesceDone("thermal", "thermal-recorder"))
+		return nil
+	}
+	assert.Nil(t, s.UnregisterQuiesce("root", "audiobait"))
+	assert.Empty(t, quiesceController.quiesce(time.Minute))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/cadence"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// The ATtiny pulls attinySignalPin low when it has commands for the RPi. The pin is waited on
+// with edge interrupts instead of being polled, so the commands are handled as soon as they
+// are signalled without waking up every 200ms. An edge is only taken as a signal if the pin
+// is still low after signalDebounce, so glitches and contact bounce are ignored. Edges can be
+// missed, such as one while the last signal was being handled, so if there hasn't been an
+// edge for signalWatchdogInterval, scaled by the power profile, the pin level is checked anyway.
+// If edge detection can't be set up on the pin the level is polled every signalPollInterval
+// instead, as it was before edges were used.
+const (
+	attinySignalPin        = "GPIO16"
+	signalDebounce         = 10 * time.Millisecond
+	signalWatchdogInterval = 5 * time.Second
+	signalPollInterval     = 200 * time.Millisecond
+)
+
+var signalStats = &attinySignalStats{}
+
+// signalPin is the part of gpio.PinIn used to wait for signals.
+type signalPin interface {
+	WaitForEdge(timeout time.Duration) bool
+	Read() gpio.Level
+}
+
+// signalWatcher waits for the ATtiny to signal.
+type signalWatcher struct {
+	pin   signalPin
+	now   func() time.Time
+	sleep func(time.Duration)
+	stats *attinySignalStats
+	poll  bool // Polls the pin level, for when edge detection isn't available.
+	// Optional, stretches the watchdog interval to save power.
+	profile *cadence.Policy
+}
+
+func newSignalWatcher(pin signalPin) *signalWatcher {
+	return &signalWatcher{pin: pin, now: time.Now, sleep: time.Sleep, stats: signalStats, profile: powerProfile}
+}
+
+// wait waits for a signal, returning when it was signalled and true if it was seen from an
+// edge, false if the watchdog or polling found the pin low.
+func (w *signalWatcher) wait() (time.Time, bool) {
+	for w.poll {
+		if w.pin.Read() == gpio.Low {
+			return w.now(), false
+		}
+		w.sleep(signalPollInterval)
+	}
+	for {
+		if !w.pin.WaitForEdge(w.profile.Interval(signalWatchdogInterval)) {
+			if w.pin.Read() == gpio.Low {
+				return w.now(), false
+			}
+			continue
+		}
+		edge := w.now()
+		w.sleep(signalDebounce)
+		if w.pin.Read() == gpio.Low {
+			return edge, true
+		}
+		w.stats.recordGlitch()
+	}
+}
+
+// SignalStats are the statistics of the signals from the ATtiny. The latency is from the
+// signal to when the commands were read.
+type SignalStats struct {
+	Signals         int     `json:"signals"`
+	WatchdogSignals int     `json:"watchdogSignals"` // Signals the edge was missed for.
+	Glitches        int     `json:"glitches"`        // Edges without the pin staying low.
+	AvgLatencyMs    float64 `json:"avgLatencyMs"`
+	MaxLatencyMs    float64 `json:"maxLatencyMs"`
+	LastLatencyMs   float64 `json:"lastLatencyMs"`
+}
+
+type attinySignalStats struct {
+	mu           sync.Mutex
+	stats        SignalStats
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// recordSignal records a signal that was handled, fromEdge is false if it was found by the
+// watchdog.
+func (s *attinySignalStats) recordSignal(fromEdge bool, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Signals++
+	if !fromEdge {
+		s.stats.WatchdogSignals++
+	}
+	s.totalLatency += latency
+	s.maxLatency = max(s.maxLatency, latency)
+	s.stats.LastLatencyMs = float64(latency.Microseconds()) / 1000
+}
+
+func (s *attinySignalStats) recordGlitch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Glitches++
+}
+
+// Stats returns a copy of the current signal statistics.
+func (s *attinySignalStats) Stats() SignalStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	if stats.Signals > 0 {
+		stats.AvgLatencyMs = float64(s.totalLatency.Microseconds()) / 1000 / float64(stats.Signals)
+	}
+	stats.MaxLatencyMs = float64(s.maxLatency.Microseconds()) / 1000
+	return stats
+}
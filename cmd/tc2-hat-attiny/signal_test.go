@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// fakeSignalPin returns the edges and levels in order.
+type fakeSignalPin struct {
+	edges  []bool
+	levels []gpio.Level
+}
+
+func (p *fakeSignalPin) WaitForEdge(time.Duration) bool {
+	edge := p.edges[0]
+	p.edges = p.edges[1:]
+	return edge
+}
+
+func (p *fakeSignalPin) Read() gpio.Level {
+	level := p.levels[0]
+	p.levels = p.levels[1:]
+	return level
+}
+
+func TestSignalWatcher(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	stats := &attinySignalStats{}
+	pin := &fakeSignalPin{}
+	w := &signalWatcher{
+		pin:   pin,
+		now:   func() time.Time { return now },
+		sleep: func(d time.Duration) { now = now.Add(d) },
+		stats: stats,
+	}
+
+	// A glitch, then a signal held low.
+	pin.edges = []bool{true, true}
+	pin.levels = []gpio.Level{gpio.High, gpio.Low}
+	signalled, fromEdge := w.wait()
+	assert.True(t, fromEdge)
+	assert.Equal(t, now.Add(-signalDebounce), signalled)
+	assert.Equal(t, 1, stats.Stats().Glitches)
+
+	// The watchdog finds the pin low after a missed edge.
+	pin.edges = []bool{false, false}
+	pin.levels = []gpio.Level{gpio.High, gpio.Low}
+	_, fromEdge = w.wait()
+	assert.False(t, fromEdge)
+
+	stats.recordSignal(true, 2*time.Millisecond)
+	stats.recordSignal(false, 4*time.Millisecond)
+	assert.Equal(t, SignalStats{
+		Signals:         2,
+		WatchdogSignals: 1,
+		Glitches:        1,
+		AvgLatencyMs:    3,
+		MaxLatencyMs:    4,
+		LastLatencyMs:   4,
+	}, stats.Stats())
+}
+
+func TestSignalWatcherPoll(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	start := now
+	// Edges aren't waited for when polling.
+	pin := &fakeSignalPin{levels: []gpio.Level{gpio.High, gpio.High, gpio.Low}}
+	w := &signalWatcher{
+		pin:   pin,
+		now:   func() time.Time { return now },
+		sleep: func(d time.Duration) { now = now.Add(d) },
+		stats: &attinySignalStats{},
+		poll:  true,
+	}
+	signalled, fromEdge := w.wait()
+	assert.False(t, fromEdge)
+	assert.Equal(t, start.Add(2*signalPollInterval), signalled)
+	assert.Empty(t, pin.levels)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/godbus/dbus"
+)
+
+// When the device can't keep working it broadcasts a minimal SOS status over whatever
+// channels it has before powering down, so someone knows to come and fix it:
+//
+//	[emergency-beacon]
+//	enable = true
+//	channels = ["wifi", "lora", "ble"]
+//	min-interval = "24h"
+//	attiny-failures = 10
+//	power-down = true
+//	send-window = "2m"
+//
+// The conditions are the RTC having lost the time with NTP not synchronised for
+// sosRTCLostGrace, the battery reaching the critical cadence level and attiny-failures ATtiny
+// transactions failing in a row. The wifi channel turns on the Wi-Fi so the emergencyBeacon
+// event can be uploaded, lora sends an "sos" event through the tc2-hat-comms output (it has
+// to be allowed in comms-injection) and ble sets a BLE advert with the status. Only one SOS is
+// broadcast per min-interval, whatever the condition, and the time it was sent is saved in
+// sosBeaconFile so restarting or rebooting doesn't send another.
+//
+// The channels only hand the SOS to other processes, the event reporter, tc2-hat-comms and
+// bluetoothd, so when powering down it waits for send-window after broadcasting to give them
+// time to send it.
+const (
+	sosBeaconConfigKey = "emergency-beacon"
+	sosBeaconFile      = "/etc/cacophony/emergency-beacon.json"
+
+	sosChannelWifi = "wifi"
+	sosChannelLoRa = "lora"
+	sosChannelBLE  = "ble"
+
+	sosRTCLost         = "rtcLost"
+	sosBatteryCritical = "batteryCritical"
+	sosATtinyFailing   = "attinyFailing"
+
+	defaultSOSMinInterval    = 24 * time.Hour
+	defaultSOSATtinyFailures = 10
+	sosCheckInterval         = 5 * time.Minute
+	sosRTCLostGrace          = 30 * time.Minute
+	sosAdvertTimeout         = 10 * time.Minute
+	defaultSOSSendWindow     = 2 * time.Minute
+
+	// The comms service that sends the "sos" event over LoRa.
+	commsDBusName = "org.cacophony.TC2HatComms"
+	commsDBusPath = "/org/cacophony/TC2HatComms"
+)
+
+var sosChannels = []string{sosChannelWifi, sosChannelLoRa, sosChannelBLE}
+
+// sosConditionCodes are the conditions in the BLE advert.
+var sosConditionCodes = map[string]byte{
+	sosRTCLost:         1,
+	sosBatteryCritical: 2,
+	sosATtinyFailing:   3,
+}
+
+// sosBeaconConfig is read from the "emergency-beacon" section of the config.
+type sosBeaconConfig struct {
+	Enable         bool          `mapstructure:"enable"`
+	Channels       []string      `mapstructure:"channels"`
+	MinInterval    time.Duration `mapstructure:"min-interval"`
+	ATtinyFailures int           `mapstructure:"attiny-failures"`
+	PowerDown      bool          `mapstructure:"power-down"`
+	SendWindow     time.Duration `mapstructure:"send-window"`
+}
+
+func defaultSOSBeaconConfig() sosBeaconConfig {
+	return sosBeaconConfig{
+		Channels:       sosChannels,
+		MinInterval:    defaultSOSMinInterval,
+		ATtinyFailures: defaultSOSATtinyFailures,
+		PowerDown:      true,
+		SendWindow:     defaultSOSSendWindow,
+	}
+}
+
+func loadSOSBeaconConfig(config *goconfig.Config) (sosBeaconConfig, error) {
+	c := defaultSOSBeaconConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, sosBeaconConfigKey, &c); err != nil {
+		return defaultSOSBeaconConfig(), err
+	}
+	for _, channel := range c.Channels {
+		if !slices.Contains(sosChannels, channel) {
+			return defaultSOSBeaconConfig(), fmt.Errorf("%s channel '%s' must be one of %v", sosBeaconConfigKey, channel, sosChannels)
+		}
+	}
+	if c.MinInterval < time.Hour {
+		return defaultSOSBeaconConfig(), fmt.Errorf("%s min-interval must be at least an hour", sosBeaconConfigKey)
+	}
+	if c.ATtinyFailures <= 0 {
+		return defaultSOSBeaconConfig(), fmt.Errorf("%s attiny-failures must be positive", sosBeaconConfigKey)
+	}
+	if c.SendWindow < 0 || c.SendWindow > sosAdvertTimeout {
+		return defaultSOSBeaconConfig(), fmt.Errorf("%s send-window must be between 0 and %s", sosBeaconConfigKey, sosAdvertTimeout)
+	}
+	return c, nil
+}
+
+// sosStatus is the status that is broadcast.
+type sosStatus struct {
+	Condition string  `json:"condition"`
+	Battery   float32 `json:"battery"` // %, -1 if it isn't known.
+	HatID     uint64  `json:"hatID"`
+}
+
+// advert returns the status as BLE manufacturer data, "SOS", the condition code, the battery
+// percentage (0xFF if it isn't known) and the low 4 bytes of the hat ID.
+func (s sosStatus) advert() []byte {
+	battery := byte(0xFF)
+	if s.Battery >= 0 {
+		battery = byte(min(s.Battery, 100))
+	}
+	data := []byte{'S', 'O', 'S', sosConditionCodes[s.Condition], battery,
+		byte(s.HatID >> 24), byte(s.HatID >> 16), byte(s.HatID >> 8), byte(s.HatID)}
+	// AD structure with the manufacturer specific type and the company ID for testing.
+	return append([]byte{byte(len(data) + 3), 0xFF, 0xFF, 0xFF}, data...)
+}
+
+// sosBeaconState is saved in sosBeaconFile.
+type sosBeaconState struct {
+	LastSent      time.Time `json:"lastSent"`
+	LastCondition string    `json:"lastCondition"`
+	Sent          int       `json:"sent"`
+}
+
+// sosBeacon broadcasts the SOS status when a condition is raised.
+type sosBeacon struct {
+	config    sosBeaconConfig
+	file      string
+	now       func() time.Time
+	status    func(condition string) sosStatus
+	send      map[string]func(sosStatus) error
+	powerDown func()
+	rtcLost   func() (bool, error)
+	sleep     func(time.Duration)
+
+	mu           sync.Mutex
+	state        sosBeaconState
+	rtcLostSince time.Time
+	poweringDown bool
+}
+
+var sosBeaconController *sosBeacon
+
+func newSOSBeacon(config sosBeaconConfig, file string, powerDown func()) (*sosBeacon, error) {
+	b := &sosBeacon{
+		config: config,
+		file:   file,
+		now:    time.Now,
+		status: currentSOSStatus,
+		send: map[string]func(sosStatus) error{
+			sosChannelWifi: func(sosStatus) error { return netmanagerclient.EnableWifi(true) },
+			sosChannelLoRa: func(s sosStatus) error { return sendSOSOverComms(s, systemBusCall) },
+			sosChannelBLE:  sendSOSAdvert,
+		},
+		powerDown: powerDown,
+		rtcLost:   rtcLostWithoutNTP,
+		sleep:     time.Sleep,
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return b, err
+	}
+	return b, json.Unmarshal(data, &b.state)
+}
+
+func (b *sosBeacon) save() error {
+	data, err := json.MarshalIndent(b.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := b.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, b.file)
+}
+
+// raise broadcasts the SOS for the condition, unless one was sent less than min-interval ago,
+// and powers down if power-down is set, after the send window if anything was broadcast. It
+// returns true if the SOS was broadcast.
+func (b *sosBeacon) raise(condition string) bool {
+	if b == nil || !b.config.Enable {
+		return false
+	}
+	now := b.now()
+	b.mu.Lock()
+	if b.poweringDown {
+		b.mu.Unlock()
+		return false
+	}
+	b.poweringDown = b.config.PowerDown
+	lastSent := b.state.LastSent
+	// A clock that has gone back, which it can when the RTC loses the time, is rate limited
+	// too so an SOS isn't sent on every boot.
+	send := lastSent.IsZero() || now.Sub(lastSent) >= b.config.MinInterval
+	if send {
+		// Saved before sending so an SOS that is cut short by the power going still counts.
+		b.state = sosBeaconState{LastSent: now, LastCondition: condition, Sent: b.state.Sent + 1}
+		if err := b.save(); err != nil {
+			log.Errorf("Failed to save the emergency beacon state: %v", err)
+		}
+	}
+	b.mu.Unlock()
+
+	sent := 0
+	if send {
+		sent = b.broadcast(condition, now)
+	} else {
+		log.Debugf("Not broadcasting SOS for %s, the last was sent at %s", condition, lastSent.Format(time.RFC3339))
+	}
+	if b.config.PowerDown {
+		if sent > 0 && b.config.SendWindow > 0 {
+			log.Printf("Waiting %s for the SOS to be sent before powering down", b.config.SendWindow)
+			b.sleep(b.config.SendWindow)
+		}
+		log.Printf("Powering down for %s", condition)
+		b.powerDown()
+	}
+	return send
+}
+
+// broadcast sends the SOS status over each of the channels and reports what was sent,
+// returning the number of channels it was handed to.
+func (b *sosBeacon) broadcast(condition string, now time.Time) int {
+	status := b.status(condition)
+	sent := []string{}
+	failed := []string{}
+	for _, channel := range b.config.Channels {
+		if err := b.send[channel](status); err != nil {
+			log.Errorf("Failed to send SOS over %s: %v", channel, err)
+			failed = append(failed, channel)
+			continue
+		}
+		sent = append(sent, channel)
+	}
+	log.Printf("Emergency beacon for %s sent over %v", condition, sent)
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.EmergencyBeaconSent, now, eventhelper.EmergencyBeacon{
+		Condition: condition,
+		Sent:      strings.Join(sent, ","),
+		Failed:    strings.Join(failed, ","),
+		Battery:   float64(status.Battery),
+	})); err != nil {
+		log.Errorf("Failed to add emergencyBeacon event: %v", err)
+	}
+	return len(sent)
+}
+
+// checkBattery raises batteryCritical when the battery is at the critical cadence level.
+func (b *sosBeacon) checkBattery(critical bool) {
+	if critical {
+		b.raise(sosBatteryCritical)
+	}
+}
+
+// checkATtinyFailures raises attinyFailing when the ATtiny transactions that failed in a row
+// reach attiny-failures.
+func (b *sosBeacon) checkATtinyFailures(failures int) {
+	if b == nil || failures < b.config.ATtinyFailures {
+		return
+	}
+	// Powering down talks to the ATtiny, so don't do it from inside a transaction.
+	go b.raise(sosATtinyFailing)
+}
+
+// checkRTC raises rtcLost when the RTC has lost the time and NTP hasn't synchronised for
+// sosRTCLostGrace.
+func (b *sosBeacon) checkRTC() {
+	if b == nil {
+		return
+	}
+	lost, err := b.rtcLost()
+	if err != nil {
+		log.Debugf("Failed to check the RTC for the emergency beacon: %v", err)
+		return
+	}
+	now := b.now()
+	b.mu.Lock()
+	if !lost {
+		b.rtcLostSince = time.Time{}
+		b.mu.Unlock()
+		return
+	}
+	if b.rtcLostSince.IsZero() {
+		b.rtcLostSince = now
+	}
+	raise := now.Sub(b.rtcLostSince) >= sosRTCLostGrace
+	b.mu.Unlock()
+	if raise {
+		b.raise(sosRTCLost)
+	}
+}
+
+// run checks the RTC every sosCheckInterval.
+func (b *sosBeacon) run() {
+	for {
+		b.checkRTC()
+		time.Sleep(sosCheckInterval)
+	}
+}
+
+func sosBeaconLoop(a *attiny, config *goconfig.Config) {
+	c, err := loadSOSBeaconConfig(config)
+	if err != nil {
+		log.Errorf("Failed to read the emergency beacon config: %v", err)
+		return
+	}
+	if !c.Enable {
+		return
+	}
+	b, err := newSOSBeacon(c, sosBeaconFile, func() {
+		timings := loadPowerTimings(config, defaultPowerTimings())
+		quiesceController.quiesce(timings.QuiesceBudget)
+		if err := shutdown(a); err != nil {
+			log.Errorf("Error shutting down: %v", err)
+		}
+	})
+	if err != nil {
+		log.Errorf("Failed to load the emergency beacon state: %v", err)
+	}
+	sosBeaconController = b
+	b.run()
+}
+
+// currentSOSStatus returns the status from the last battery reading and the EEPROM.
+func currentSOSStatus(condition string) sosStatus {
+	s := sosStatus{Condition: condition, Battery: -1}
+	if battery := getBatteryStatus(); !battery.Time.IsZero() && battery.Percent >= 0 {
+		s.Battery = battery.Percent
+	}
+	if id, err := eeprom.GetHatID(); err == nil {
+		s.HatID = id
+	}
+	return s
+}
+
+// dbusCall calls the method of the object on the bus.
+type dbusCall func(dest string, path dbus.ObjectPath, method string, args ...interface{}) error
+
+func systemBusCall(dest string, path dbus.ObjectPath, method string, args ...interface{}) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	return conn.Object(dest, path).Call(method, 0, args...).Err
+}
+
+// sendSOSOverComms sends the status as an "sos" event through the tc2-hat-comms output with
+// its InjectEvent method.
+func sendSOSOverComms(s sosStatus, call dbusCall) error {
+	details, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return call(commsDBusName, commsDBusPath, commsDBusName+".InjectEvent", safeModeService, "sos", string(details))
+}
+
+// sendSOSAdvert advertises the status over BLE for sosAdvertTimeout.
+func sendSOSAdvert(s sosStatus) error {
+	timeout := fmt.Sprintf("%d", int(sosAdvertTimeout.Seconds()))
+	out, err := exec.Command("btmgmt", "add-adv", "-d", hex.EncodeToString(s.advert()), "-t", timeout, "1").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btmgmt add-adv failed: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// rtcLostWithoutNTP returns true if the RTC has lost integrity and NTP isn't synchronised.
+func rtcLostWithoutNTP() (bool, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false, err
+	}
+	var timeStr string
+	var integrity bool
+	obj := conn.Object("org.cacophony.RTC", "/org/cacophony/RTC")
+	if err := obj.Call("org.cacophony.RTC.GetTime", 0).Store(&timeStr, &integrity); err != nil {
+		return false, err
+	}
+	if integrity {
+		return false, nil
+	}
+	out, err := exec.Command("timedatectl", "status").CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("timedatectl failed: %v, output: %s", err, out)
+	}
+	return !strings.Contains(string(out), "synchronized: yes"), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSOSBeacon(t *testing.T, file string, now *time.Time) (*sosBeacon, *[]string, *int) {
+	config := defaultSOSBeaconConfig()
+	config.Enable = true
+	powerDowns := 0
+	sent := []string{}
+	b, err := newSOSBeacon(config, file, func() {
+		powerDowns++
+		sent = append(sent, "powerDown")
+	})
+	assert.NoError(t, err)
+	b.now = func() time.Time { return *now }
+	b.sleep = func(d time.Duration) { sent = append(sent, "wait:"+d.String()) }
+	b.send = map[string]func(sosStatus) error{
+		sosChannelWifi: func(s sosStatus) error { sent = append(sent, sosChannelWifi+":"+s.Condition); return nil },
+		sosChannelLoRa: func(sosStatus) error { return errors.New("comms not running") },
+		sosChannelBLE:  func(s sosStatus) error { sent = append(sent, sosChannelBLE+":"+s.Condition); return nil },
+	}
+	b.status = func(condition string) sosStatus { return sosStatus{Condition: condition, Battery: 7, HatID: 0x1234} }
+	return b, &sent, &powerDowns
+}
+
+func TestSOSBeacon(t *testing.T) {
+	file := t.TempDir() + "/emergency-beacon.json"
+	now := time.Date(2026, 6, 1, 3, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	b, sent, powerDowns := newTestSOSBeacon(t, file, &now)
+
+	// The power goes after the send window, so the channels have time to send it.
+	assert.True(t, b.raise(sosBatteryCritical))
+	assert.Equal(t, []string{"wifi:batteryCritical", "ble:batteryCritical", "wait:2m0s", "powerDown"}, *sent)
+	assert.Equal(t, 1, *powerDowns)
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "emergencyBeacon", events.Events()[0].Type)
+		assert.Equal(t, map[string]interface{}{
+			"condition": sosBatteryCritical,
+			"sent":      "wifi,ble",
+			"failed":    "lora",
+			"battery":   float64(7),
+		}, events.Events()[0].Details)
+	}
+
+	// Only powers down once.
+	assert.False(t, b.raise(sosATtinyFailing))
+	assert.Equal(t, 1, *powerDowns)
+
+	// After a reboot the SOS isn't sent again until the min interval is up, even if the clock
+	// has gone back.
+	now = now.Add(time.Hour)
+	b, sent, powerDowns = newTestSOSBeacon(t, file, &now)
+	assert.False(t, b.raise(sosATtinyFailing))
+	assert.Equal(t, []string{"powerDown"}, *sent)
+	assert.Equal(t, 1, *powerDowns)
+	now = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, sent, _ = newTestSOSBeacon(t, file, &now)
+	assert.False(t, b.raise(sosRTCLost))
+	now = time.Date(2026, 6, 2, 3, 0, 0, 0, time.UTC)
+	b, sent, _ = newTestSOSBeacon(t, file, &now)
+	b.config.PowerDown = false
+	assert.True(t, b.raise(sosRTCLost))
+	assert.Equal(t, []string{"wifi:rtcLost", "ble:rtcLost"}, *sent)
+
+	// A nil or disabled beacon does nothing.
+	var nilBeacon *sosBeacon
+	assert.False(t, nilBeacon.raise(sosBatteryCritical))
+	nilBeacon.checkATtinyFailures(100)
+	nilBeacon.checkRTC()
+	b, _, _ = newTestSOSBeacon(t, file, &now)
+	b.config.Enable = false
+	assert.False(t, b.raise(sosBatteryCritical))
+}
+
+func TestSOSBeaconRTC(t *testing.T) {
+	now := time.Date(2026, 6, 1, 3, 0, 0, 0, time.UTC)
+	eventtest.Capture(t)
+	b, sent, _ := newTestSOSBeacon(t, t.TempDir()+"/emergency-beacon.json", &now)
+	lost := true
+	b.rtcLost = func() (bool, error) { return lost, nil }
+
+	// NTP can take a while after booting, so it needs to be lost for the grace period.
+	b.checkRTC()
+	now = now.Add(20 * time.Minute)
+	b.checkRTC()
+	lost = false
+	b.checkRTC()
+	lost = true
+	now = now.Add(20 * time.Minute)
+	b.checkRTC()
+	assert.Empty(t, *sent)
+	now = now.Add(sosRTCLostGrace)
+	b.checkRTC()
+	assert.Equal(t, []string{"wifi:rtcLost", "ble:rtcLost", "wait:2m0s", "powerDown"}, *sent)
+}
+
+// Nothing is waited for when none of the channels took the SOS.
+func TestSOSBeaconNothingSent(t *testing.T) {
+	now := time.Date(2026, 6, 1, 3, 0, 0, 0, time.UTC)
+	eventtest.Capture(t)
+	b, sent, powerDowns := newTestSOSBeacon(t, t.TempDir()+"/emergency-beacon.json", &now)
+	b.config.Channels = []string{sosChannelLoRa}
+	assert.True(t, b.raise(sosBatteryCritical))
+	assert.Equal(t, []string{"powerDown"}, *sent)
+	assert.Equal(t, 1, *powerDowns)
+}
+
+// The LoRa SOS is injected through the comms service, on the name it requests.
+func TestSendSOSOverComms(t *testing.T) {
+	var dest, method string
+	var path dbus.ObjectPath
+	var args []interface{}
+	err := sendSOSOverComms(sosStatus{Condition: sosRTCLost, Battery: 50, HatID: 1}, func(d string, p dbus.ObjectPath, m string, a ...interface{}) error {
+		dest, path, method, args = d, p, m, a
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "org.cacophony.TC2HatComms", dest)
+	assert.Equal(t, dbus.ObjectPath("/org/cacophony/TC2HatComms"), path)
+	assert.Equal(t, "org.cacophony.TC2HatComms.InjectEvent", method)
+	assert.Equal(t, []interface{}{safeModeService, "sos", `{"condition":"rtcLost","battery":50,"hatID":1}`}, args)
+}
+
+func TestSOSAdvert(t *testing.T) {
+	assert.Equal(t, []byte{12, 0xFF, 0xFF, 0xFF, 'S', 'O', 'S', 2, 9, 0x9A, 0xBC, 0xDE, 0xF0},
+		sosStatus{Condition: sosBatteryCritical, Battery: 9.6, HatID: 0x123456789ABCDEF0}.advert())
+	assert.Equal(t, byte(0xFF), sosStatus{Condition: sosRTCLost, Battery: -1}.advert()[8])
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/battery"
+)
+
+// The regular battery readings are too slow to see the voltage sag when a load is switched
+// on, so around camera state changes and aux power switching the voltage is sampled quickly
+// for a short time. The sample before the load is switched is the baseline, the sag is how
+// far below that the voltage drops. When the load current is known the sag gives an
+// estimate of the internal resistance of the pack, this goes up as a pack ages or gets cold.
+const (
+	transientConfigKey      = "battery-transients"
+	transientSampleInterval = 100 * time.Millisecond
+	transientBaseline       = time.Second
+	transientDuration       = 10 * time.Second
+	transientDir            = "/var/log/battery-transients"
+	transientMaxProfiles    = 50
+	// Measurements kept until the battery monitor takes them, see pkg/battery/impedance.go.
+	maxPendingMeasurements = 20
+	// Weight of a new internal resistance measurement in the running estimate.
+	resistanceSmoothing = 0.3
+)
+
+var errTransientBusy = errors.New("already capturing a transient")
+
+// transientConfig is read from the "battery-transients" section of the config.
+type transientConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// Power in watts of the load switched for each capture reason, used to estimate the
+	// internal resistance when the current can't be measured.
+	LoadWatts map[string]float64 `mapstructure:"load-watts"`
+}
+
+type transientSample struct {
+	OffsetMs int64   `json:"offsetMs"` // From when the load was switched.
+	Voltage  float32 `json:"voltage"`
+}
+
+type transientProfile struct {
+	Reason             string            `json:"reason"`
+	Time               time.Time         `json:"time"`
+	Rail               string            `json:"rail"`
+	BaselineVoltage    float32           `json:"baselineVoltage"`
+	MinVoltage         float32           `json:"minVoltage"`
+	SagVoltage         float32           `json:"sagVoltage"`
+	LoadCurrent        float64           `json:"loadCurrentA,omitempty"`
+	InternalResistance float64           `json:"internalResistanceOhms,omitempty"`
+	Samples            []transientSample `json:"samples"`
+}
+
+// railSampler makes a quick voltage reading of a battery rail.
+type railSampler interface {
+	sampleRail(rail string) (float32, error)
+}
+
+// transientCapture samples the battery voltage around load changes.
+type transientCapture struct {
+	sampler   railSampler
+	loadWatts map[string]float64
+	dir       string
+	now       func() time.Time
+	sleep     func(time.Duration)
+
+	mu         sync.Mutex
+	busy       bool
+	resistance float64
+	pending    []battery.ResistanceMeasurement
+}
+
+func newTransientCapture(sampler railSampler, config transientConfig) *transientCapture {
+	return &transientCapture{
+		sampler:   sampler,
+		loadWatts: config.LoadWatts,
+		dir:       transientDir,
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+func loadTransientConfig(config *goconfig.Config) (transientConfig, error) {
+	c := transientConfig{Enable: true}
+	if config == nil {
+		return c, nil
+	}
+	err := configcompat.Unmarshal(config, transientConfigKey, &c)
+	return c, err
+}
+
+// capture takes the baseline samples, switches the load with apply, then samples the voltage
+// in the background so the caller is only held up for the baseline. loadCurrent returns the
+// current drawn by the load in amps once it is on, nil if it can't be measured. If a capture
+// is already running, or t is nil, the load is just switched.
+func (t *transientCapture) capture(reason string, apply func() error, loadCurrent func() (float64, bool)) error {
+	if t == nil || !t.start() {
+		return apply()
+	}
+	rail := "hv"
+	if v, err := t.sampler.sampleRail(rail); err != nil || v <= battery.LVThreshold {
+		rail = "lv"
+	}
+	baseline := t.sample(rail, transientBaseline, -transientBaseline)
+	switchTime := t.now()
+	if err := apply(); err != nil {
+		t.finish()
+		return err
+	}
+	go func() {
+		defer t.finish()
+		samples := append(baseline, t.sample(rail, transientDuration, 0)...)
+		current, ok := 0.0, false
+		if loadCurrent != nil {
+			current, ok = loadCurrent()
+		}
+		p, err := t.analyse(reason, rail, switchTime, samples, current, ok)
+		if err != nil {
+			log.Errorf("Failed to capture %s transient: %v", reason, err)
+			return
+		}
+		t.report(p)
+	}()
+	return nil
+}
+
+func (t *transientCapture) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busy {
+		log.Debug(errTransientBusy)
+		return false
+	}
+	t.busy = true
+	return true
+}
+
+func (t *transientCapture) finish() {
+	t.mu.Lock()
+	t.busy = false
+	t.mu.Unlock()
+}
+
+// sample reads the rail every transientSampleInterval for the duration. Failed readings are skipped.
+func (t *transientCapture) sample(rail string, duration, offset time.Duration) []transientSample {
+	samples := []transientSample{}
+	start := t.now()
+	for elapsed := time.Duration(0); elapsed < duration; elapsed = t.now().Sub(start) {
+		v, err := t.sampler.sampleRail(rail)
+		if err == nil {
+			samples = append(samples, transientSample{
+				OffsetMs: (offset + elapsed).Milliseconds(),
+				Voltage:  v,
+			})
+		}
+		t.sleep(transientSampleInterval)
+	}
+	return samples
+}
+
+// analyse works out the sag from the samples and updates the internal resistance estimate.
+func (t *transientCapture) analyse(reason, rail string, switchTime time.Time, samples []transientSample, current float64, currentKnown bool) (*transientProfile, error) {
+	p := &transientProfile{Reason: reason, Time: switchTime, Rail: rail, Samples: samples}
+	var baselineSum float32
+	baselineCount := 0
+	for _, s := range samples {
+		if s.OffsetMs < 0 {
+			baselineSum += s.Voltage
+			baselineCount++
+		} else if p.MinVoltage == 0 || s.Voltage < p.MinVoltage {
+			p.MinVoltage = s.Voltage
+		}
+	}
+	if baselineCount == 0 || p.MinVoltage == 0 {
+		return nil, fmt.Errorf("not enough samples")
+	}
+	p.BaselineVoltage = baselineSum / float32(baselineCount)
+	p.SagVoltage = max(p.BaselineVoltage-p.MinVoltage, 0)
+
+	if !currentKnown {
+		if watts := t.loadWatts[reason]; watts > 0 {
+			current, currentKnown = watts/float64(p.BaselineVoltage), true
+		}
+	}
+	if currentKnown && current > 0 && p.SagVoltage > 0 {
+		p.LoadCurrent = current
+		p.InternalResistance = float64(p.SagVoltage) / current
+		t.mu.Lock()
+		if t.resistance == 0 {
+			t.resistance = p.InternalResistance
+		} else {
+			t.resistance += resistanceSmoothing * (p.InternalResistance - t.resistance)
+		}
+		t.pending = append(t.pending, battery.ResistanceMeasurement{Reason: reason, Time: switchTime, Ohms: p.InternalResistance})
+		if len(t.pending) > maxPendingMeasurements {
+			t.pending = t.pending[len(t.pending)-maxPendingMeasurements:]
+		}
+		t.mu.Unlock()
+	}
+	return p, nil
+}
+
+func (t *transientCapture) report(p *transientProfile) {
+	log.Printf("%s transient on %s rail, %.2fV sag from %.2fV", p.Reason, p.Rail, p.SagVoltage, p.BaselineVoltage)
+	if err := t.save(p); err != nil {
+		log.Errorf("Failed to save transient profile: %v", err)
+	}
+	payload := eventhelper.Transient{
+		Reason:          p.Reason,
+		Rail:            p.Rail,
+		BaselineVoltage: p.BaselineVoltage,
+		MinVoltage:      p.MinVoltage,
+		SagVoltage:      p.SagVoltage,
+	}
+	if p.InternalResistance > 0 {
+		payload.InternalResistanceOhms = p.InternalResistance
+		payload.LoadCurrentA = p.LoadCurrent
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.BatteryTransient, p.Time, payload)); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+}
+
+// save writes the profile to the transient directory, keeping the newest transientMaxProfiles.
+func (t *transientCapture) save(p *transientProfile) error {
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.json", p.Time.Format("20060102-150405"), p.Reason)
+	if err := os.WriteFile(filepath.Join(t.dir, name), data, 0644); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for len(files) > transientMaxProfiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// InternalResistance returns the running estimate of the pack internal resistance in ohms,
+// 0 if there is no estimate.
+func (t *transientCapture) InternalResistance() float64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resistance
+}
+
+// TakeMeasurements returns the internal resistance measurements since it was last called.
+func (t *transientCapture) TakeMeasurements() []battery.ResistanceMeasurement {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.pending
+	t.pending = nil
+	return m
+}
+
+// SetInternalResistance sets the starting estimate, from the saved battery state.
+func (t *transientCapture) SetInternalResistance(r float64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resistance = r
+}
+
+// cameraStateReason is the capture reason for a camera state change.
+func cameraStateReason(state attinyclient.CameraState) string {
+	return "camera-" + strings.ToLower(strings.ReplaceAll(state.String(), " ", "-"))
+}
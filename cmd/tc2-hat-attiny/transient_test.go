@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRail is a 24V pack with 0.5 ohm internal resistance, loadAmps is drawn once the load is on.
+type fakeRail struct {
+	loadAmps float64
+	on       bool
+}
+
+func (r *fakeRail) sampleRail(rail string) (float32, error) {
+	if rail == "lv" {
+		return 0, nil
+	}
+	if r.on {
+		return float32(24 - 0.5*r.loadAmps), nil
+	}
+	return 24, nil
+}
+
+func TestTransientCapture(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	rail := &fakeRail{loadAmps: 0.4}
+	events := eventtest.Capture(t)
+	tc := newTransientCapture(rail, transientConfig{LoadWatts: map[string]float64{"camera-powered-on": 4.8}})
+	tc.dir = filepath.Join(t.TempDir(), "transients")
+	tc.now = func() time.Time { return now }
+	tc.sleep = func(d time.Duration) { now = now.Add(d) }
+
+	apply := func() error {
+		rail.on = true
+		return nil
+	}
+	assert.NoError(t, tc.capture("aux-power-on", apply, func() (float64, bool) { return rail.loadAmps, true }))
+	// A second capture is skipped while the first is running, the load is still switched.
+	called := false
+	assert.NoError(t, tc.capture("camera-powered-on", func() error { called = true; return nil }, nil))
+	assert.True(t, called)
+
+	// Wait for the capture to finish.
+	for !tc.start() {
+		time.Sleep(time.Millisecond)
+	}
+	tc.finish()
+	assert.InDelta(t, 0.5, tc.InternalResistance(), 0.01)
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "batteryTransient", events.Events()[0].Type)
+	assert.Equal(t, "hv", events.Events()[0].Details["rail"])
+	assert.InDelta(t, 0.2, events.Events()[0].Details["sagVoltage"], 0.01)
+	files, _ := filepath.Glob(filepath.Join(tc.dir, "*.json"))
+	assert.Len(t, files, 1)
+
+	// With an unknown load current the sag is still recorded but the estimate isn't changed.
+	p, err := tc.analyse("unknown", "hv", now, []transientSample{{-100, 24}, {0, 23.5}}, 0, false)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.5, p.SagVoltage, 0.01)
+	assert.Zero(t, p.InternalResistance)
+
+	// The load power from the config is used when the current isn't measured.
+	p, err = tc.analyse("camera-powered-on", "hv", now, []transientSample{{-100, 24}, {0, 23.8}}, 0, false)
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.0, p.InternalResistance, 0.01)
+	assert.InDelta(t, 0.65, tc.InternalResistance(), 0.01)
+
+	var nilCapture *transientCapture
+	called = false
+	assert.NoError(t, nilCapture.capture("x", func() error { called = true; return nil }, nil))
+	assert.True(t, called)
+}
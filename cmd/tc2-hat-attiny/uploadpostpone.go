@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// Powering off can be postponed while recordings are still uploading, so an upload isn't cut
+// off part way through and started again from the beginning the next time the RPi is on:
+//
+//	[upload-postpone]
+//	enable = true
+//	increment = "2m"
+//	max = "15m"
+//	upload-dirs = ["/var/spool/cptv"]
+//	min-transfer-rate = 2000
+//
+// An upload is taken to be in progress when there are files waiting in the upload dirs and
+// data is being sent faster than min-transfer-rate, in bytes per second. Powering off is then
+// postponed by increment before checking again, for at most max in total so a stuck upload
+// doesn't keep the RPi on. When powering off, or when a postponement stops, a
+// powerOffPostponed event reports how many times and for how long it was postponed and why.
+const (
+	uploadPostponeConfigKey = "upload-postpone"
+	netDevFile              = "/proc/net/dev"
+	// How long the data sent is measured over for the transfer rate.
+	transferRateSample = 2 * time.Second
+)
+
+type uploadPostponeConfig struct {
+	Enable          bool          `mapstructure:"enable"`
+	Increment       time.Duration `mapstructure:"increment"`
+	Max             time.Duration `mapstructure:"max"`
+	UploadDirs      []string      `mapstructure:"upload-dirs"`
+	MinTransferRate float64       `mapstructure:"min-transfer-rate"`
+}
+
+func defaultUploadPostponeConfig() uploadPostponeConfig {
+	return uploadPostponeConfig{
+		Increment:       2 * time.Minute,
+		Max:             15 * time.Minute,
+		UploadDirs:      []string{"/var/spool/cptv"},
+		MinTransferRate: 2000,
+	}
+}
+
+// uploadPostponer decides if powering off should be postponed for uploads.
+type uploadPostponer struct {
+	config uploadPostponeConfig
+	now    func() time.Time
+	// Returns why an upload is in progress, false if there isn't one.
+	uploading func() (string, bool)
+
+	start  time.Time // When powering off was first postponed, zero if it isn't postponed.
+	until  time.Time
+	count  int
+	reason string
+}
+
+// loadUploadPostponer returns nil if powering off isn't postponed for uploads.
+func loadUploadPostponer(config *goconfig.Config) (*uploadPostponer, error) {
+	c := defaultUploadPostponeConfig()
+	if config == nil {
+		return nil, nil
+	}
+	if err := configcompat.Unmarshal(config, uploadPostponeConfigKey, &c); err != nil {
+		return nil, err
+	}
+	if !c.Enable {
+		return nil, nil
+	}
+	if c.Increment <= 0 || c.Max <= 0 {
+		return nil, fmt.Errorf("%s increment and max must be positive", uploadPostponeConfigKey)
+	}
+	log.Printf("Postponing power off by %s, for at most %s, while uploading", durToStr(c.Increment), durToStr(c.Max))
+	return &uploadPostponer{
+		config: c,
+		now:    time.Now,
+		uploading: func() (string, bool) {
+			return uploadActivity(c, netDevFile, time.Sleep)
+		},
+	}, nil
+}
+
+// postpone returns how long to postpone powering off for and why, 0 to power off now.
+func (p *uploadPostponer) postpone() (time.Duration, string) {
+	if p == nil {
+		return 0, ""
+	}
+	now := p.now()
+	if !p.start.IsZero() {
+		if now.Before(p.until) {
+			return p.until.Sub(now), p.reason
+		}
+		if now.Sub(p.start) >= p.config.Max {
+			log.Printf("Powering off after postponing for %s, the upload is taking too long", durToStr(now.Sub(p.start)))
+			p.finish(now, true)
+			return 0, ""
+		}
+		if now.Sub(p.until) > p.config.Increment {
+			// Something else kept the RPi on since, so this is a new postponement.
+			p.finish(now, false)
+		}
+	}
+	reason, ok := p.uploading()
+	if !ok {
+		p.finish(now, false)
+		return 0, ""
+	}
+	if p.start.IsZero() {
+		p.start = now
+	}
+	p.count++
+	p.reason = reason
+	p.until = now.Add(p.config.Increment)
+	if limit := p.start.Add(p.config.Max); p.until.After(limit) {
+		p.until = limit
+	}
+	return p.until.Sub(now), reason
+}
+
+// finish reports how powering off was postponed, if it was.
+func (p *uploadPostponer) finish(now time.Time, capped bool) {
+	if p.count > 0 {
+		if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.PowerOffPostponed, now, eventhelper.PowerOffPostponement{
+			Postponements:    p.count,
+			PostponedMinutes: math.Round(now.Sub(p.start).Minutes()*10) / 10,
+			Reason:           p.reason,
+			Capped:           capped,
+		})); err != nil {
+			log.Printf("Error adding event: %v", err)
+		}
+	}
+	p.start = time.Time{}
+	p.until = time.Time{}
+	p.count = 0
+	p.reason = ""
+}
+
+// uploadActivity returns why an upload is in progress, false if there isn't one.
+func uploadActivity(c uploadPostponeConfig, netDev string, sleep func(time.Duration)) (string, bool) {
+	pending := 0
+	for _, dir := range c.UploadDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				pending++
+			}
+		}
+	}
+	if pending == 0 {
+		return "", false
+	}
+	before, err := readTxBytes(netDev)
+	if err != nil {
+		log.Printf("Failed to read the data sent: %v", err)
+		return "", false
+	}
+	sleep(transferRateSample)
+	after, err := readTxBytes(netDev)
+	if err != nil {
+		log.Printf("Failed to read the data sent: %v", err)
+		return "", false
+	}
+	rate := float64(after-before) / transferRateSample.Seconds()
+	if after < before || rate < c.MinTransferRate {
+		return "", false
+	}
+	return fmt.Sprintf("%d files waiting to upload, sending %.1f kB/s", pending, rate/1000), true
+}
+
+// readTxBytes returns the total bytes sent on the network interfaces, other than loopback.
+func readTxBytes(netDev string) (uint64, error) {
+	file, err := os.Open(netDev)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	total := uint64(0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		iface, stats, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(iface) == "lo" {
+			continue
+		}
+		// The receive stats are first, then the bytes sent.
+		fields := strings.Fields(stats)
+		if len(fields) < 9 {
+			continue
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bytes sent for %s: %v", strings.TrimSpace(iface), err)
+		}
+		total += tx
+	}
+	return total, scanner.Err()
+}
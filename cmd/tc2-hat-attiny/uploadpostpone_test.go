@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPostponer(t *testing.T) {
+	now := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	uploading := true
+	events := eventtest.Capture(t)
+	c := defaultUploadPostponeConfig()
+	c.Max = 5 * time.Minute
+	p := &uploadPostponer{
+		config: c,
+		now:    func() time.Time { return now },
+		uploading: func() (string, bool) {
+			return "1 files waiting to upload", uploading
+		},
+	}
+
+	postpone, reason := p.postpone()
+	assert.Equal(t, 2*time.Minute, postpone)
+	assert.Equal(t, "1 files waiting to upload", reason)
+	now = now.Add(time.Minute)
+	postpone, _ = p.postpone()
+	assert.Equal(t, time.Minute, postpone)
+
+	// The last increment is cut short by the cap, then it powers off still uploading.
+	now = now.Add(3 * time.Minute)
+	postpone, _ = p.postpone()
+	assert.Equal(t, time.Minute, postpone)
+	now = now.Add(time.Minute)
+	postpone, _ = p.postpone()
+	assert.Zero(t, postpone)
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "powerOffPostponed", events.Events()[0].Type)
+		assert.Equal(t, 2, events.Events()[0].Details["postponements"])
+		assert.Equal(t, 5.0, events.Events()[0].Details["postponedMinutes"])
+		assert.Equal(t, true, events.Events()[0].Details["capped"])
+	}
+
+	// Not uploading, so nothing to report.
+	uploading = false
+	postpone, _ = p.postpone()
+	assert.Zero(t, postpone)
+	assert.Len(t, events.Events(), 1)
+
+	var disabled *uploadPostponer
+	postpone, _ = disabled.postpone()
+	assert.Zero(t, postpone)
+}
+
+func TestUploadActivity(t *testing.T) {
+	dir := t.TempDir()
+	netDev := filepath.Join(dir, "dev")
+	writeNetDev := func(tx string) {
+		data := "Inter-|   Receive                                                |  Transmit\n" +
+			" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n" +
+			"    lo:  500000     100    0    0    0     0          0         0  900000     100    0    0    0     0       0          0\n" +
+			"  wlan0: 1000     10    0    0    0     0          0         0 " + tx + "     20    0    0    0     0       0          0\n"
+		assert.NoError(t, os.WriteFile(netDev, []byte(data), 0644))
+	}
+	c := defaultUploadPostponeConfig()
+	c.UploadDirs = []string{filepath.Join(dir, "cptv")}
+	assert.NoError(t, os.Mkdir(c.UploadDirs[0], 0755))
+	writeNetDev("100000")
+	sendWhileSleeping := func(time.Duration) { writeNetDev("120000") }
+
+	// Nothing waiting to upload.
+	_, ok := uploadActivity(c, netDev, sendWhileSleeping)
+	assert.False(t, ok)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(c.UploadDirs[0], "a.cptv"), nil, 0644))
+	reason, ok := uploadActivity(c, netDev, sendWhileSleeping)
+	assert.True(t, ok)
+	assert.Equal(t, "1 files waiting to upload, sending 10.0 kB/s", reason)
+
+	// Waiting but not sending.
+	writeNetDev("100000")
+	_, ok = uploadActivity(c, netDev, func(time.Duration) {})
+	assert.False(t, ok)
+}
@@ -2,25 +2,29 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io"
 	"math"
-	"os"
 	"os/exec"
 	"strings"
 	"time"
 
 	"github.com/TheCacophonyProject/go-utils/saltutil"
 	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
 )
 
 func shutdown(a *attiny) error {
-	err := a.writeCameraState(statePoweringOff) // Without setting the state to powering off the ATtiny will automatically reboot the RPi.
+	if err := cameraPowerController.update(); err != nil {
+		log.Printf("Failed to update the camera power stats: %v", err)
+	}
+	err := a.writeCameraState(attinyclient.StatePoweringOff) // Without setting the state to powering off the ATtiny will automatically reboot the RPi.
 	if err != nil {
 		return err
 	}
+	if dryRun {
+		log.Println("Dry run: not powering off")
+		return nil
+	}
 	time.Sleep(5 * time.Second)
 	log.Println("Powering off")
 	output, err := exec.Command("/sbin/poweroff").CombinedOutput()
@@ -32,13 +36,13 @@ func shutdown(a *attiny) error {
 
 // shouldStayOnForSalt will check if a salt command is running via checking the output from `salt-call saltutil.running`
 // If a device is being kept on for too long because of salt commands it will ignore the salt command check.
-func shouldStayOnForSalt() bool {
+func shouldStayOnForSalt(maxWait time.Duration) bool {
 	if !saltutil.IsSaltIdSet() {
 		return false
 	}
 
 	if saltCommandWaitEnd.IsZero() {
-		saltCommandWaitEnd = time.Now().Add(saltCommandMaxWaitDuration)
+		saltCommandWaitEnd = time.Now().Add(maxWait)
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
@@ -55,7 +59,7 @@ func shouldStayOnForSalt() bool {
 	}
 
 	if time.Now().After(saltCommandWaitEnd) {
-		log.Printf("waiting for salt command for too long (%v)", saltCommandMaxWaitDuration)
+		log.Printf("waiting for salt command for too long (%v)", maxWait)
 		log.Printf("salt command:\n%v", strOut)
 		return false
 	}
@@ -70,28 +74,37 @@ func durToStr(duration time.Duration) string {
 func crcTxWithRetry(write, read []byte) error {
 	attempts := 0
 	for {
+		start := time.Now()
 		err := crcTX(write, read)
+		linkStats.recordAttempt(err, time.Since(start))
+		attempts++
 		if err == nil {
+			linkStats.recordTransaction(attempts, nil)
 			return nil
 		}
 
-		attempts++
-		if attempts >= maxTxAttempts {
+		if attempts >= maxTxAttempts || serviceCtx.Err() != nil {
+			linkStats.recordTransaction(attempts, err)
 			return err
 		}
 		time.Sleep(txRetryInterval)
 	}
 }
 
-func crcTX(write, read []byte) error {
-	response, err := i2crequest.TxWithCRC(0x25, write, len(read), 1000)
-	if err != nil {
-		return err
+// fastRegisterRead returns a function that reads a register through the reader, recording it
+// in the link statistics. It isn't retried, a failed poll only loses that transient sample.
+func fastRegisterRead(reader *i2crequest.RegisterReader) func(attinyclient.Register) (uint8, error) {
+	return func(register attinyclient.Register) (uint8, error) {
+		start := time.Now()
+		value, err := reader.ReadRegister(serviceCtx, byte(register))
+		linkStats.recordAttempt(err, time.Since(start))
+		linkStats.recordTransaction(1, err)
+		return value, err
 	}
-	for i := 0; i < len(read); i++ {
-		read[i] = response[i]
-	}
-	return nil
+}
+
+func crcTX(write, read []byte) error {
+	return attinyclient.TxWithCRCContext(serviceCtx, write, read)
 }
 
 func checkServiceStatus(serviceName string) (bool, error) {
@@ -108,21 +121,6 @@ func checkServiceStatus(serviceName string) (bool, error) {
 	return false, err
 }
 
-func calculateSHA256(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return "", err
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
-}
-
 func calculateMean(values []uint16) float64 {
 	sum := 0.0
 	for _, value := range values {
@@ -142,49 +140,6 @@ func calculateStandardDeviation(values []uint16) float64 {
 	return math.Sqrt(variance)
 }
 
-func getResistorDividerValuesFromVersion(hardwareVer versionStr, resistorValues []rVals) (float32, float32, float32, error) {
-	// Find the resistor and voltage values for the given hardware version
-	var vref, r1, r2 float32 = 0, 0, 0
-	for _, v := range resistorValues {
-		newer, err := hardwareVer.IsNewerOrEqual(v.hardwareVersion)
-		if err != nil {
-			return 0, 0, 0, err
-		}
-		if newer {
-			vref = v.vref
-			r1 = v.r1
-			r2 = v.r2
-		}
-	}
-
-	return vref, r1, r2, nil
-}
-
-type rVals struct {
-	hardwareVersion versionStr
-	vref, r1, r2    float32
-}
-
-type versionStr string
-
-func (v versionStr) IsNewerOrEqual(other versionStr) (bool, error) {
-	parts := strings.Split(string(v), ".")
-	if len(parts) != 3 {
-		return false, fmt.Errorf("invalid version format '%s", v)
-	}
-	partsOther := strings.Split(string(other), ".")
-	if len(partsOther) != 3 {
-		return false, fmt.Errorf("invalid version format '%s", other)
-	}
-	if parts[0] != partsOther[0] {
-		return parts[0] > partsOther[0], nil
-	}
-	if parts[1] != partsOther[1] {
-		return parts[1] > partsOther[1], nil
-	}
-	return parts[2] >= partsOther[2], nil
-}
-
 // Check if the service is running
 func isServiceRunning(serviceName string) (bool, error) {
 	cmd := exec.Command("systemctl", "is-active", "--quiet", serviceName)
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+)
+
+// Corrections from the server (a track classified as a possum was actually a cat) are saved
+// to speciesCorrectionsFile, by the server sync or with `tc2-hat-comms correction`, and are
+// used to adjust the confidence thresholds from the config:
+//   - A trap species classification that was wrong raises the threshold for that species.
+//   - A trap species classification that was confirmed lowers it back towards the config.
+//   - A track that was actually a protect species lowers the threshold for that species.
+//
+// Each correction moves the threshold by step and it is kept within max-adjustment of the
+// configured threshold, so a bad batch of corrections can't stop the trap from triggering
+// or protect a species on any classification.
+const (
+	calibrationConfigKey            = "species-calibration"
+	speciesCorrectionsFile          = "/etc/cacophony/species-corrections.json"
+	defaultCalibrationStep          = 2
+	defaultCalibrationMaxAdjustment = 15
+	maxSpeciesCorrections           = 500
+)
+
+// calibrationConfig is read from the "species-calibration" section of the config.
+type calibrationConfig struct {
+	Enable        bool  `mapstructure:"enable"`
+	Step          int32 `mapstructure:"step"`
+	MaxAdjustment int32 `mapstructure:"max-adjustment"`
+}
+
+func defaultCalibrationConfig() calibrationConfig {
+	return calibrationConfig{
+		Enable:        true,
+		Step:          defaultCalibrationStep,
+		MaxAdjustment: defaultCalibrationMaxAdjustment,
+	}
+}
+
+func loadCalibrationConfig(conf *goconfig.Config) (calibrationConfig, error) {
+	c := defaultCalibrationConfig()
+	if err := configcompat.Unmarshal(conf, calibrationConfigKey, &c); err != nil {
+		return c, err
+	}
+	if c.Step < 0 || c.MaxAdjustment < 0 {
+		return c, fmt.Errorf("species calibration step and max-adjustment can't be negative")
+	}
+	return c, nil
+}
+
+type speciesCorrection struct {
+	Time       time.Time `json:"time"`
+	TrackID    int       `json:"trackId,omitempty"`
+	Predicted  string    `json:"predicted"`
+	Confidence int32     `json:"confidence,omitempty"`
+	Actual     string    `json:"actual"`
+}
+
+// loadSpeciesCorrections loads the corrections from the file, a missing file has no corrections.
+func loadSpeciesCorrections(file string) ([]speciesCorrection, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	corrections := []speciesCorrection{}
+	if err := json.Unmarshal(data, &corrections); err != nil {
+		return nil, fmt.Errorf("failed to parse species corrections '%s': %v", file, err)
+	}
+	return corrections, nil
+}
+
+// addSpeciesCorrection saves the correction, keeping the newest maxSpeciesCorrections.
+func addSpeciesCorrection(file string, c speciesCorrection) error {
+	corrections, err := loadSpeciesCorrections(file)
+	if err != nil {
+		return err
+	}
+	c.Predicted = strings.ToLower(c.Predicted)
+	c.Actual = strings.ToLower(c.Actual)
+	corrections = append(corrections, c)
+	sort.SliceStable(corrections, func(i, j int) bool { return corrections[i].Time.Before(corrections[j].Time) })
+	if len(corrections) > maxSpeciesCorrections {
+		corrections = corrections[len(corrections)-maxSpeciesCorrections:]
+	}
+	data, err := json.MarshalIndent(corrections, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// calibrateThresholds returns the trap and protect thresholds adjusted by the corrections,
+// which are applied oldest first.
+func calibrateThresholds(trap, protect tracks.Species, corrections []speciesCorrection, config calibrationConfig) (tracks.Species, tracks.Species) {
+	sorted := append([]speciesCorrection{}, corrections...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	trapAdjust := map[string]int32{}
+	protectAdjust := map[string]int32{}
+	for _, c := range sorted {
+		if _, ok := trap[c.Predicted]; ok {
+			if c.Actual == c.Predicted {
+				trapAdjust[c.Predicted] = max(trapAdjust[c.Predicted]-config.Step, 0)
+			} else {
+				trapAdjust[c.Predicted] = min(trapAdjust[c.Predicted]+config.Step, config.MaxAdjustment)
+			}
+		}
+		if _, ok := protect[c.Actual]; ok && c.Actual != c.Predicted {
+			protectAdjust[c.Actual] = max(protectAdjust[c.Actual]-config.Step, -config.MaxAdjustment)
+		}
+	}
+
+	calTrap := tracks.Species{}
+	for animal, conf := range trap {
+		calTrap[animal] = min(conf+trapAdjust[animal], 100)
+	}
+	calProtect := tracks.Species{}
+	for animal, conf := range protect {
+		calProtect[animal] = max(conf+protectAdjust[animal], 0)
+	}
+	return calTrap, calProtect
+}
+
+// speciesThresholds gives the trap and protect thresholds to use, recalibrating them when
+// the corrections file changes.
+type speciesThresholds struct {
+	trap    tracks.Species
+	protect tracks.Species
+	config  calibrationConfig
+	file    string
+
+	mu         sync.Mutex
+	modTime    time.Time
+	calTrap    tracks.Species
+	calProtect tracks.Species
+}
+
+func newSpeciesThresholds(config *CommsConfig) *speciesThresholds {
+	return &speciesThresholds{
+		trap:       config.TrapSpecies,
+		protect:    config.ProtectSpecies,
+		config:     config.Calibration,
+		file:       speciesCorrectionsFile,
+		calTrap:    config.TrapSpecies,
+		calProtect: config.ProtectSpecies,
+	}
+}
+
+// current returns the calibrated trap and protect thresholds. If the corrections can't be
+// read the last thresholds are kept.
+func (s *speciesThresholds) current() (trap, protect tracks.Species) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.config.Enable {
+		return s.trap, s.protect
+	}
+	info, err := os.Stat(s.file)
+	modTime := time.Time{}
+	if err == nil {
+		modTime = info.ModTime()
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Failed to check species corrections: %v", err)
+		return s.calTrap, s.calProtect
+	}
+	if modTime.Equal(s.modTime) {
+		return s.calTrap, s.calProtect
+	}
+	corrections, err := loadSpeciesCorrections(s.file)
+	if err != nil {
+		log.Errorf("Failed to load species corrections: %v", err)
+		return s.calTrap, s.calProtect
+	}
+	s.modTime = modTime
+	calTrap, calProtect := calibrateThresholds(s.trap, s.protect, corrections, s.config)
+	if !sameSpecies(calTrap, s.calTrap) || !sameSpecies(calProtect, s.calProtect) {
+		log.Infof("Calibrated species thresholds from %d corrections, trap: %v, protect: %v", len(corrections), calTrap, calProtect)
+		s.report(calTrap, calProtect, len(corrections))
+	}
+	s.calTrap, s.calProtect = calTrap, calProtect
+	return calTrap, calProtect
+}
+
+func (s *speciesThresholds) report(trap, protect tracks.Species, corrections int) {
+	err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.SpeciesCalibrated, time.Now(), eventhelper.SpeciesCalibration{
+		TrapSpecies:    map[string]int32(trap),
+		ProtectSpecies: map[string]int32(protect),
+		Corrections:    corrections,
+	}))
+	if err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+}
+
+func sameSpecies(a, b tracks.Species) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for animal, conf := range a {
+		if other, ok := b[animal]; !ok || other != conf {
+			return false
+		}
+	}
+	return true
+}
+
+// recordCorrection saves a correction and prints the thresholds it results in.
+func recordCorrection(config *CommsConfig, c speciesCorrection) error {
+	if c.Predicted == "" || c.Actual == "" {
+		return fmt.Errorf("predicted and actual species are required")
+	}
+	if err := addSpeciesCorrection(speciesCorrectionsFile, c); err != nil {
+		return err
+	}
+	corrections, err := loadSpeciesCorrections(speciesCorrectionsFile)
+	if err != nil {
+		return err
+	}
+	trap, protect := calibrateThresholds(config.TrapSpecies, config.ProtectSpecies, corrections, config.Calibration)
+	fmt.Printf("Saved correction, %d corrections recorded.\n", len(corrections))
+	if !config.Calibration.Enable {
+		fmt.Println("Species calibration is disabled in the config, the thresholds won't be changed.")
+	}
+	fmt.Printf("Species to trap:\n%v\nSpecies to protect:\n%v\n", trap, protect)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalibrateThresholds(t *testing.T) {
+	trap := tracks.Species{"possum": 80, "cat": 90}
+	protect := tracks.Species{"kiwi": 40}
+	config := calibrationConfig{Enable: true, Step: 2, MaxAdjustment: 5}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	corrections := []speciesCorrection{}
+	add := func(predicted, actual string) {
+		corrections = append(corrections, speciesCorrection{
+			Time:      start.Add(time.Duration(len(corrections)) * time.Minute),
+			Predicted: predicted,
+			Actual:    actual,
+		})
+	}
+
+	// Wrong possum classifications raise the threshold up to the max adjustment.
+	for i := 0; i < 4; i++ {
+		add("possum", "cat")
+	}
+	calTrap, calProtect := calibrateThresholds(trap, protect, corrections, config)
+	assert.Equal(t, tracks.Species{"possum": 85, "cat": 90}, calTrap)
+	assert.Equal(t, protect, calProtect)
+
+	// Confirmed classifications bring it back down, but not below the config.
+	add("possum", "possum")
+	calTrap, _ = calibrateThresholds(trap, protect, corrections, config)
+	assert.Equal(t, int32(83), calTrap["possum"])
+	for i := 0; i < 5; i++ {
+		add("possum", "possum")
+	}
+	calTrap, _ = calibrateThresholds(trap, protect, corrections, config)
+	assert.Equal(t, int32(80), calTrap["possum"])
+
+	// A missed kiwi lowers the kiwi threshold.
+	add("cat", "kiwi")
+	calTrap, calProtect = calibrateThresholds(trap, protect, corrections, config)
+	assert.Equal(t, int32(38), calProtect["kiwi"])
+	assert.Equal(t, int32(92), calTrap["cat"])
+	// The config isn't changed.
+	assert.Equal(t, int32(40), protect["kiwi"])
+}
+
+func TestSpeciesThresholdsReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "corrections.json")
+	events := eventtest.Capture(t)
+	s := newSpeciesThresholds(&CommsConfig{
+		TrapSpecies:    tracks.Species{"possum": 80},
+		ProtectSpecies: tracks.Species{"kiwi": 40},
+		Calibration:    defaultCalibrationConfig(),
+	})
+	s.file = file
+
+	trap, _ := s.current()
+	assert.Equal(t, int32(80), trap["possum"])
+	assert.Empty(t, events.Events())
+
+	assert.NoError(t, addSpeciesCorrection(file, speciesCorrection{Time: time.Now(), Predicted: "Possum", Actual: "cat"}))
+	trap, _ = s.current()
+	assert.Equal(t, int32(82), trap["possum"])
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "speciesCalibration", events.Events()[0].Type)
+
+	s.config.Enable = false
+	trap, _ = s.current()
+	assert.Equal(t, int32(80), trap["possum"])
+}
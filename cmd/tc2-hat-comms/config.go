@@ -1,7 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
+	"time"
+
 	"github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/buzzer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/selfmonitor"
 	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
 )
 
@@ -12,6 +19,81 @@ type CommsConfig struct {
 	ProtectSpecies tracks.Species
 
 	UartTxPin string
+
+	// Baud rate for UART output, 0 will probe the candidate baud rates to find a working one.
+	BaudRate           int
+	BaudRateCandidates []int
+	// Baud rate to switch an AT-ESL trap to once the session has started, 0 to stay at
+	// BaudRate, see eslbaud.go.
+	ESLFastBaudRate int
+	// Mux channel wiring of the aux UART, "straight" or "swapped", see esl.go.
+	UartWiring string
+	// How tracks are sent over the UART, "json" or "compact" for radio links, see classpayload.
+	TrackPayload string
+
+	// Drive the trap output with keep-alive pulses for a pulse stretcher, see failsafe.go.
+	KeepAlive         bool
+	KeepAliveInterval time.Duration
+
+	// Commands that can be sent over the UART, see remote.go.
+	RemoteCommands     []string
+	RemoteCommandToken string
+
+	// Optional rain gauge or weather module, see weather.go.
+	Weather weatherConfig
+
+	// Adjusting the species thresholds from server corrections, see calibration.go.
+	Calibration calibrationConfig
+
+	// When the trap can be activated, see schedule.go.
+	Schedule scheduleConfig
+
+	// Events other services can send through the comms output, see inject.go.
+	Injection injectionConfig
+
+	// Optional buzzer for beeping when the trap is armed or triggered.
+	Buzzer buzzer.Config
+
+	// Button for forcing the trap safe, see override.go.
+	Override overrideConfig
+
+	// Technicians' phones that put the device in maintenance mode, see presence.go.
+	Presence presenceConfig
+
+	// Routing species to several trap outputs, see routing.go.
+	Routing routingConfig
+
+	// Optional relay board on an I2C GPIO expander for the trap outputs, see relayboard.go.
+	RelayBoard relayBoardConfig
+
+	// Tracks taking longer than this to reach the output are reported, see latency.go.
+	MaxTrackLatency time.Duration
+
+	// Goroutine, heap and loop limits for the self monitor.
+	Health selfmonitor.Config
+
+	uartStateFile string
+}
+
+// uartConfig is the UART settings stored in the comms section of the config.
+type uartConfig struct {
+	BaudRate           int    `mapstructure:"baud-rate"`
+	BaudRateCandidates []int  `mapstructure:"baud-rate-candidates"`
+	Wiring             string `mapstructure:"aux-uart-wiring"`
+	TrackPayload       string `mapstructure:"track-payload"`
+	ESLFastBaudRate    int    `mapstructure:"esl-fast-baud-rate"`
+}
+
+// remoteCommandConfig is the remote command settings stored in the comms section of the config.
+type remoteCommandConfig struct {
+	Commands []string `mapstructure:"remote-commands"`
+	Token    string   `mapstructure:"remote-command-token"`
+}
+
+// trapOutputConfig is the trap output settings stored in the comms section of the config.
+type trapOutputConfig struct {
+	KeepAlive         bool          `mapstructure:"trap-keep-alive"`
+	KeepAliveInterval time.Duration `mapstructure:"trap-keep-alive-interval"`
 }
 
 func ParseCommsConfig(configDir string) (*CommsConfig, error) {
@@ -20,8 +102,89 @@ func ParseCommsConfig(configDir string) (*CommsConfig, error) {
 		return nil, err
 	}
 
+	// The hat settings are stored in the comms section with the go-config settings, so they
+	// are read together and only fields that none of them have are reported.
 	c := config.DefaultComms()
-	if err := conf.Unmarshal(config.CommsKey, &c); err != nil {
+	uart := uartConfig{}
+	trapOutput := trapOutputConfig{}
+	remote := remoteCommandConfig{}
+	latency := latencyConfig{MaxTrackLatency: defaultMaxTrackLatency}
+	if err := configcompat.Unmarshal(conf, config.CommsKey, &c, &uart, &trapOutput, &remote, &latency); err != nil {
+		return nil, err
+	}
+	if latency.MaxTrackLatency < 0 {
+		return nil, fmt.Errorf("max-track-latency can't be negative")
+	}
+	uartStateFile := filepath.Join(configDir, uartStateFileName)
+	learnt, err := loadUARTState(uartStateFile)
+	if err != nil {
+		return nil, err
+	}
+	learnt.apply(&uart)
+	if len(uart.BaudRateCandidates) == 0 {
+		uart.BaudRateCandidates = defaultBaudRateCandidates
+	}
+	if _, err := uartWiringByName(uart.Wiring); err != nil {
+		return nil, err
+	}
+	if uart.ESLFastBaudRate < 0 {
+		return nil, fmt.Errorf("esl-fast-baud-rate can't be negative")
+	}
+	switch uart.TrackPayload {
+	case "":
+		uart.TrackPayload = trackPayloadJSON
+	case trackPayloadJSON, trackPayloadCompact:
+	default:
+		return nil, fmt.Errorf("unknown track payload '%s'", uart.TrackPayload)
+	}
+
+	weather, err := loadWeatherConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	calibration, err := loadCalibrationConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := loadScheduleConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	injection, err := loadInjectionConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	buzzerConfig, err := buzzer.LoadConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	override, err := loadOverrideConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	presence, err := loadPresenceConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	routing, err := loadRoutingConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	relayBoard, err := loadRelayBoardConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	health, err := selfmonitor.LoadConfig(conf)
+	if err != nil {
 		return nil, err
 	}
 
@@ -35,5 +198,56 @@ func ParseCommsConfig(configDir string) (*CommsConfig, error) {
 		TrapSpecies:    tracks.Species(c.TrapSpecies),
 		ProtectSpecies: tracks.Species(c.ProtectSpecies),
 		UartTxPin:      gpio.UartTx,
+
+		BaudRate:           uart.BaudRate,
+		BaudRateCandidates: uart.BaudRateCandidates,
+		ESLFastBaudRate:    uart.ESLFastBaudRate,
+		UartWiring:         uart.Wiring,
+		TrackPayload:       uart.TrackPayload,
+
+		KeepAlive:         trapOutput.KeepAlive,
+		KeepAliveInterval: trapOutput.KeepAliveInterval,
+
+		RemoteCommands:     remote.Commands,
+		RemoteCommandToken: remote.Token,
+
+		MaxTrackLatency: latency.MaxTrackLatency,
+
+		Weather:     weather,
+		Calibration: calibration,
+		Schedule:    schedule,
+		Injection:   injection,
+		Buzzer:      buzzerConfig,
+		Override:    override,
+		Presence:    presence,
+		Routing:     routing,
+		RelayBoard:  relayBoard,
+		Health:      health,
+
+		uartStateFile: uartStateFile,
 	}, nil
 }
+
+// saveBaudRate records the baud rate so it doesn't need to be probed again, see uartstate.go.
+func (c *CommsConfig) saveBaudRate(baud int) error {
+	s, err := loadUARTState(c.uartStateFile)
+	if err != nil {
+		return err
+	}
+	s.BaudRate = baud
+	if err := saveUARTState(c.uartStateFile, s); err != nil {
+		return err
+	}
+	c.BaudRate = baud
+	return nil
+}
+
+// saveESLDetection records the wiring and baud rate an ESL trap was found on.
+func (c *CommsConfig) saveESLDetection(d eslDetection) error {
+	if err := saveUARTState(c.uartStateFile, uartState{BaudRate: d.Baud, Wiring: d.Wiring}); err != nil {
+		return err
+	}
+	c.UartWiring = d.Wiring
+	c.BaudRate = d.Baud
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// AT-ESL traps are often installed with TX and RX swapped, so detect-esl tries each wiring the
+// UART mux can select on the aux header at the common baud rates, sending an ATI command and
+// looking for the AT-ESL banner in the response. The wiring and baud rate that got a banner are
+// saved, see uartstate.go, and used for the UART output from then on. When no trap responds
+// the attempts are used to work out what is most likely wrong with the wiring, which is
+// printed and reported with an eslNotDetected event.
+const (
+	wiringStraight = "straight"
+	wiringSwapped  = "swapped"
+
+	eslBanner = "AT-ESL"
+)
+
+var (
+	eslIdentify = []byte("ATI\r\n")
+
+	eslBaudRates = []int{4800, 9600, 19200, 38400, 57600, 115200}
+)
+
+// uartWiring is a mux channel connecting the UART to the aux header.
+type uartWiring struct {
+	name       string
+	mul0, mul1 gpio.Level
+}
+
+// The aux header is on mux channel 1, and channel 3 connects it with TX and RX crossed over.
+var uartWirings = []uartWiring{
+	{name: wiringStraight, mul0: gpio.High, mul1: gpio.Low},
+	{name: wiringSwapped, mul0: gpio.High, mul1: gpio.High},
+}
+
+// Wiring used for sending messages, set from the config.
+var uartMux = uartWirings[0]
+
+// uartWiringByName returns the wiring with the name, an empty name is the straight wiring.
+func uartWiringByName(name string) (uartWiring, error) {
+	if name == "" {
+		return uartWirings[0], nil
+	}
+	for _, w := range uartWirings {
+		if w.name == name {
+			return w, nil
+		}
+	}
+	return uartWiring{}, fmt.Errorf("unknown aux UART wiring '%s'", name)
+}
+
+// eslDetection is a wiring and baud rate an ESL trap responded on.
+type eslDetection struct {
+	Wiring string
+	Baud   int
+	Banner string
+}
+
+// eslAttempt is the response to the identify command on a wiring at a baud rate.
+type eslAttempt struct {
+	wiring   string
+	baud     int
+	response []byte
+	err      error
+}
+
+// wiringDiagnosisError is returned when no ESL trap responded, with what is most likely wrong.
+type wiringDiagnosisError struct {
+	diagnosis string
+	attempts  int
+}
+
+func (e *wiringDiagnosisError) Error() string {
+	return fmt.Sprintf("no ESL trap found after %d attempts: %s", e.attempts, e.diagnosis)
+}
+
+// detectESL sends the identify command on each wiring at each baud rate until an ESL banner
+// comes back. If there is no banner the error is a *wiringDiagnosisError.
+func detectESL(wirings []uartWiring, bauds []int, send func(w uartWiring, baud int, data []byte) ([]byte, error)) (eslDetection, error) {
+	attempts := []eslAttempt{}
+	for _, w := range wirings {
+		for _, baud := range bauds {
+			log.Infof("Looking for an ESL trap with %s wiring at baud rate %d", w.name, baud)
+			response, err := send(w, baud, eslIdentify)
+			attempts = append(attempts, eslAttempt{wiring: w.name, baud: baud, response: response, err: err})
+			if err != nil {
+				log.Debugf("No response with %s wiring at baud rate %d: %v", w.name, baud, err)
+				continue
+			}
+			if banner, ok := eslBannerLine(response); ok {
+				log.Infof("Found '%s' with %s wiring at baud rate %d", banner, w.name, baud)
+				return eslDetection{Wiring: w.name, Baud: baud, Banner: banner}, nil
+			}
+			log.Debugf("Response with %s wiring at baud rate %d isn't an ESL banner: %q", w.name, baud, response)
+		}
+	}
+	return eslDetection{}, &wiringDiagnosisError{diagnosis: diagnoseWiring(attempts), attempts: len(attempts)}
+}
+
+// eslBannerLine returns the line of the response with the ESL banner.
+func eslBannerLine(response []byte) (string, bool) {
+	for _, line := range strings.Split(string(response), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, eslBanner) {
+			return line, true
+		}
+	}
+	return "", false
+}
+
+// diagnoseWiring works out the most likely wiring problem from the responses when no ESL
+// banner came back.
+func diagnoseWiring(attempts []eslAttempt) string {
+	for _, a := range attempts {
+		if bytes.Equal(bytes.TrimSpace(a.response), bytes.TrimSpace(eslIdentify)) {
+			return fmt.Sprintf("the command was read straight back with %s wiring, TX and RX are probably connected to each other", a.wiring)
+		}
+	}
+	for _, a := range attempts {
+		if bytes.Contains(a.response, []byte("OK")) {
+			return fmt.Sprintf("an AT device responded with %s wiring at baud rate %d but it isn't an ESL trap: %q", a.wiring, a.baud, bytes.TrimSpace(a.response))
+		}
+	}
+	for _, a := range attempts {
+		if len(a.response) > 0 {
+			return fmt.Sprintf("unreadable data came back with %s wiring, the trap is connected but might be using a baud rate other than %v", a.wiring, eslBaudRates)
+		}
+	}
+	return "nothing responded with any wiring or baud rate, check the trap is powered, shares a ground with the hat and has its TX and RX connected to the aux header"
+}
+
+// runDetectESL looks for an ESL trap on the aux UART, saving the wiring and baud rate it
+// responded on to the config.
+func runDetectESL(config *CommsConfig) error {
+	if config.CommsOut != "uart" {
+		return fmt.Errorf("ESL traps can only be detected with UART output, comms-out is '%s'", config.CommsOut)
+	}
+	d, err := detectESL(uartWirings, eslBaudRates, func(w uartWiring, baud int, data []byte) ([]byte, error) {
+		lease, err := serialhelper.AcquireSerialLease(serialLeaseOwner, 10*time.Second, 5*time.Second, false)
+		if err != nil {
+			return nil, err
+		}
+		defer lease.Release()
+		return serialhelper.SerialSendReceiveBaud(1, w.mul0, w.mul1, time.Second, baud, data)
+	})
+	if diagnosis, ok := err.(*wiringDiagnosisError); ok {
+		fmt.Println(diagnosis)
+		if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ESLNotDetected, time.Now(), eventhelper.WiringDiagnosis{
+			Diagnosis: diagnosis.diagnosis,
+			Attempts:  diagnosis.attempts,
+		})); err != nil {
+			log.Errorf("Failed to add eslNotDetected event: %v", err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found '%s' with %s wiring at baud rate %d\n", d.Banner, d.Wiring, d.Baud)
+	if d.Wiring == wiringSwapped {
+		fmt.Println("The trap's TX and RX are swapped, it will be used through the crossed over mux channel")
+	}
+	return config.saveESLDetection(d)
+}
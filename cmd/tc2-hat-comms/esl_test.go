@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectESL(t *testing.T) {
+	tried := []string{}
+	send := func(w uartWiring, baud int, data []byte) ([]byte, error) {
+		tried = append(tried, w.name)
+		if w.name == wiringSwapped && baud == 19200 {
+			return []byte("ATI\r\nAT-ESL v2.1\r\nOK\r\n"), nil
+		}
+		return nil, errors.New("timeout")
+	}
+	d, err := detectESL(uartWirings, eslBaudRates, send)
+	assert.NoError(t, err)
+	assert.Equal(t, eslDetection{Wiring: wiringSwapped, Baud: 19200, Banner: "AT-ESL v2.1"}, d)
+	assert.Len(t, tried, len(eslBaudRates)+3)
+
+	_, err = detectESL(uartWirings[:1], eslBaudRates, send)
+	diagnosis, ok := err.(*wiringDiagnosisError)
+	if assert.True(t, ok) {
+		assert.Equal(t, len(eslBaudRates), diagnosis.attempts)
+		assert.Contains(t, diagnosis.diagnosis, "nothing responded")
+	}
+}
+
+func TestDiagnoseWiring(t *testing.T) {
+	assert.Contains(t, diagnoseWiring([]eslAttempt{
+		{wiring: wiringStraight, baud: 9600, err: errors.New("timeout")},
+		{wiring: wiringSwapped, baud: 9600, response: []byte("ATI\r\n")},
+	}), "TX and RX are probably connected to each other")
+	assert.Contains(t, diagnoseWiring([]eslAttempt{
+		{wiring: wiringStraight, baud: 115200, response: []byte("\x8f\x02")},
+		{wiring: wiringSwapped, baud: 9600, response: []byte("Modem v1\r\nOK\r\n")},
+	}), "an AT device responded with swapped wiring at baud rate 9600")
+	assert.Contains(t, diagnoseWiring([]eslAttempt{
+		{wiring: wiringStraight, baud: 115200, response: []byte("\x8f\x02")},
+	}), "unreadable data came back with straight wiring")
+}
+
+func TestUartWiringByName(t *testing.T) {
+	w, err := uartWiringByName("")
+	assert.NoError(t, err)
+	assert.Equal(t, wiringStraight, w.name)
+	w, err = uartWiringByName(wiringSwapped)
+	assert.NoError(t, err)
+	assert.Equal(t, wiringSwapped, w.name)
+	_, err = uartWiringByName("crossed")
+	assert.Error(t, err)
+}
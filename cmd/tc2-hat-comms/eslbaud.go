@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
+)
+
+// AT-ESL traps start at a slow baud rate, 4800, but newer trap firmware can switch to a faster
+// one once it is talking. With esl-fast-baud-rate set in the comms section the trap is sent
+// AT+BAUD with the fast rate at the start of the session, the port is switched and the trap is
+// pinged at the new rate to check the switch worked:
+//
+//	[comms]
+//	baud-rate = 4800
+//	esl-fast-baud-rate = 38400
+//
+// If the trap doesn't accept the command, or doesn't answer at the new rate, it is told to
+// switch back and the session falls back to the rate it started at. A trap still at the fast
+// rate from before tc2-hat-comms restarted is just used at that rate. When sending fails at
+// the fast rate, such as after the trap has been power cycled and is back at its starting
+// rate, the fast rate is checked again and the session falls back if it no longer answers.
+const (
+	eslBaudCommand = "AT+BAUD=%d\r\n"
+	eslBaudOK      = "OK"
+	// Time for the trap to switch its UART after acknowledging the command.
+	eslBaudSwitchDelay = 100 * time.Millisecond
+)
+
+// eslBaudSession is the baud rate of the session with an AT-ESL trap.
+type eslBaudSession struct {
+	fallback int
+	fast     int
+	// atCommand sends a raw AT command at the baud rate, returning the response.
+	atCommand func(baud int, command []byte) ([]byte, error)
+	// verify checks the trap is answering at the baud rate.
+	verify func(baud int) error
+
+	mu      sync.Mutex
+	current int
+}
+
+// The session with the trap, nil when esl-fast-baud-rate isn't set.
+var eslBaud *eslBaudSession
+
+func newESLBaudSession(fallback, fast int) *eslBaudSession {
+	return &eslBaudSession{
+		fallback:  fallback,
+		fast:      fast,
+		atCommand: eslATCommand,
+		verify:    handshake,
+		current:   fallback,
+	}
+}
+
+// negotiate switches the trap to the fast rate, returning the rate to use. The error is why it
+// had to fall back.
+func (s *eslBaudSession) negotiate() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response, err := s.atCommand(s.fallback, []byte(fmt.Sprintf(eslBaudCommand, s.fast)))
+	switch {
+	case err == nil && bytes.Contains(response, []byte(eslBaudOK)):
+		time.Sleep(eslBaudSwitchDelay)
+		if err := s.verify(s.fast); err != nil {
+			return s.fallBack(fmt.Errorf("no response at baud rate %d after switching: %v", s.fast, err))
+		}
+		log.Infof("AT-ESL trap switched to baud rate %d", s.fast)
+		s.current = s.fast
+		return s.current, nil
+	case err == nil:
+		err = fmt.Errorf("baud rate change not accepted: %q", bytes.TrimSpace(response))
+	}
+	// It might have been left at the fast rate by the last session.
+	if s.verify(s.fast) == nil {
+		log.Infof("AT-ESL trap is already at baud rate %d", s.fast)
+		s.current = s.fast
+		return s.current, nil
+	}
+	return s.fallBack(err)
+}
+
+// fallBack tells the trap to go back to the fallback rate, s.mu must be held.
+func (s *eslBaudSession) fallBack(reason error) (int, error) {
+	log.Infof("Falling back to baud rate %d for the AT-ESL trap", s.fallback)
+	if _, err := s.atCommand(s.fast, []byte(fmt.Sprintf(eslBaudCommand, s.fallback))); err == nil {
+		time.Sleep(eslBaudSwitchDelay)
+	}
+	s.current = s.fallback
+	if err := s.verify(s.fallback); err != nil {
+		return s.current, fmt.Errorf("%v, and no response at baud rate %d: %v", reason, s.fallback, err)
+	}
+	return s.current, reason
+}
+
+// sendFailed checks the trap is still at the fast rate after sending failed, falling back if
+// it isn't. Returns the rate to use. Safe to call on a nil session.
+func (s *eslBaudSession) sendFailed(baud int) int {
+	if s == nil {
+		return baud
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != s.fast || s.verify(s.fast) == nil {
+		return s.current
+	}
+	rate, err := s.fallBack(fmt.Errorf("no response at baud rate %d", s.fast))
+	if err != nil {
+		log.Error(err)
+	}
+	return rate
+}
+
+// eslATCommand sends the command over the UART, with the response read until the timeout.
+func eslATCommand(baud int, command []byte) ([]byte, error) {
+	lease, err := serialhelper.AcquireSerialLease(serialLeaseOwner, 10*time.Second, 5*time.Second, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.Release()
+	return serialhelper.SerialSendReceiveBaud(1, uartMux.mul0, uartMux.mul1, time.Second, baud, command)
+}
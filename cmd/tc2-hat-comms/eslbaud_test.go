@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeESLTrap answers at its baud rate, switching when sent AT+BAUD if it supports the rate.
+type fakeESLTrap struct {
+	baud      int
+	supported []int
+	commands  []string
+}
+
+func (t *fakeESLTrap) atCommand(baud int, command []byte) ([]byte, error) {
+	t.commands = append(t.commands, fmt.Sprintf("%d %q", baud, command))
+	if baud != t.baud {
+		return nil, errors.New("timeout")
+	}
+	for _, b := range t.supported {
+		if string(command) == fmt.Sprintf(eslBaudCommand, b) {
+			t.baud = b
+			return []byte("OK\r\n"), nil
+		}
+	}
+	return []byte("ERROR\r\n"), nil
+}
+
+func (t *fakeESLTrap) verify(baud int) error {
+	if baud != t.baud {
+		return errors.New("no ACK")
+	}
+	return nil
+}
+
+func newTestESLBaudSession(trap *fakeESLTrap) *eslBaudSession {
+	s := newESLBaudSession(4800, 38400)
+	s.atCommand = trap.atCommand
+	s.verify = trap.verify
+	return s
+}
+
+func TestESLBaudNegotiate(t *testing.T) {
+	trap := &fakeESLTrap{baud: 4800, supported: []int{4800, 38400}}
+	s := newTestESLBaudSession(trap)
+	baud, err := s.negotiate()
+	assert.NoError(t, err)
+	assert.Equal(t, 38400, baud)
+	assert.Equal(t, 38400, trap.baud)
+
+	// Older firmware doesn't know the command.
+	trap = &fakeESLTrap{baud: 4800, supported: []int{4800}}
+	s = newTestESLBaudSession(trap)
+	baud, err = s.negotiate()
+	assert.Error(t, err)
+	assert.Equal(t, 4800, baud)
+
+	// Still at the fast rate from the last session.
+	trap = &fakeESLTrap{baud: 38400, supported: []int{4800, 38400}}
+	s = newTestESLBaudSession(trap)
+	baud, err = s.negotiate()
+	assert.NoError(t, err)
+	assert.Equal(t, 38400, baud)
+}
+
+func TestESLBaudSendFailed(t *testing.T) {
+	trap := &fakeESLTrap{baud: 4800, supported: []int{4800, 38400}}
+	s := newTestESLBaudSession(trap)
+	_, err := s.negotiate()
+	assert.NoError(t, err)
+
+	// Still answering at the fast rate, so it was something else.
+	assert.Equal(t, 38400, s.sendFailed(38400))
+
+	// Power cycled back to the slow rate.
+	trap.baud = 4800
+	assert.Equal(t, 4800, s.sendFailed(38400))
+	assert.Equal(t, 4800, s.sendFailed(4800))
+
+	var nilSession *eslBaudSession
+	assert.Equal(t, 9600, nilSession.sendFailed(9600))
+}
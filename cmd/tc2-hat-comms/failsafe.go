@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// The trap output can be driven as a train of keep-alive pulses instead of a steady high.
+// The trap is then fitted with a pulse stretcher (retriggerable monostable) that only keeps
+// the trap energised while pulses keep arriving, so if tc2-hat-comms crashes, hangs, or the
+// power is lost, the pulses stop and the trap returns to its safe state without relying on
+// any software to turn it off.
+const (
+	defaultKeepAliveInterval = 100 * time.Millisecond
+	trapActiveFile           = "/etc/cacophony/trap-active"
+)
+
+// outputPin is what a trap output is driven through, a GPIO pin or a relay, see relayboard.go.
+type outputPin interface {
+	Out(level gpio.Level) error
+}
+
+// trapOutput drives the trap output pin.
+type trapOutput struct {
+	pin               outputPin
+	keepAlive         bool
+	keepAliveInterval time.Duration
+	activeFile        string
+
+	mu     sync.Mutex
+	active bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newTrapOutput(pin outputPin, config *CommsConfig) *trapOutput {
+	interval := config.KeepAliveInterval
+	if interval <= 0 {
+		interval = defaultKeepAliveInterval
+	}
+	return &trapOutput{
+		pin:               pin,
+		keepAlive:         config.KeepAlive,
+		keepAliveInterval: interval,
+		activeFile:        trapActiveFile,
+	}
+}
+
+// setActive activates or deactivates the trap. While active the trap is recorded in
+// activeFile so the fail-safe tripping can be detected after a crash or power loss.
+func (t *trapOutput) setActive(active bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if active == t.active {
+		return nil
+	}
+	if active {
+		if err := markTrapActive(t.activeFile, time.Now()); err != nil {
+			log.Errorf("Failed to record trap as active: %v", err)
+		}
+		if t.keepAlive {
+			t.startPulses()
+		} else if err := t.pin.Out(gpio.High); err != nil {
+			return err
+		}
+	} else {
+		t.stopPulses()
+		if err := t.pin.Out(gpio.Low); err != nil {
+			return err
+		}
+		if err := clearTrapActive(t.activeFile); err != nil {
+			log.Errorf("Failed to clear trap active record: %v", err)
+		}
+	}
+	t.active = active
+	return nil
+}
+
+func (t *trapOutput) startPulses() {
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		level := gpio.High
+		ticker := time.NewTicker(t.keepAliveInterval / 2)
+		defer ticker.Stop()
+		for {
+			if err := t.pin.Out(level); err != nil {
+				// Stopping the pulses lets the pulse stretcher deactivate the trap.
+				log.Errorf("Failed to output keep-alive pulse, trap will deactivate: %v", err)
+				return
+			}
+			level = !level
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(t.stop, t.done)
+}
+
+func (t *trapOutput) stopPulses() {
+	if t.stop == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.stop = nil
+	t.done = nil
+}
+
+func markTrapActive(file string, now time.Time) error {
+	return os.WriteFile(file, []byte(now.Format(time.RFC3339)), 0644)
+}
+
+func clearTrapActive(file string) error {
+	err := os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// trapActiveSince returns when the trap was activated if it was left active when
+// tc2-hat-comms last stopped.
+func trapActiveSince(file string) (time.Time, bool, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	activeSince, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		// Still report that it tripped, just without the time.
+		return time.Time{}, true, nil
+	}
+	return activeSince, true, nil
+}
+
+// checkFailSafeTripped reports if the trap was active when tc2-hat-comms stopped, meaning
+// the trap was turned off by the fail-safe instead of by tc2-hat-comms.
+func checkFailSafeTripped(file string, keepAlive bool) {
+	activeSince, tripped, err := trapActiveSince(file)
+	if err != nil {
+		log.Errorf("Failed to check if trap fail-safe tripped: %v", err)
+		return
+	}
+	if !tripped {
+		return
+	}
+	log.Info("Trap was active when tc2-hat-comms last stopped, the fail-safe has deactivated it")
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.TrapFailSafeTripped, time.Now(), eventhelper.FailSafeTrip{
+		KeepAlive:   keepAlive,
+		ActiveSince: activeSince,
+	})); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+	if err := clearTrapActive(file); err != nil {
+		log.Errorf("Failed to clear trap active record: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrapActiveRecord(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "trap-active")
+
+	_, tripped, err := trapActiveSince(file)
+	assert.NoError(t, err)
+	assert.False(t, tripped)
+
+	now := time.Now().Truncate(time.Second)
+	assert.NoError(t, markTrapActive(file, now))
+	activeSince, tripped, err := trapActiveSince(file)
+	assert.NoError(t, err)
+	assert.True(t, tripped)
+	assert.True(t, now.Equal(activeSince))
+
+	assert.NoError(t, clearTrapActive(file))
+	_, tripped, err = trapActiveSince(file)
+	assert.NoError(t, err)
+	assert.False(t, tripped)
+
+	// Clearing when not active is fine.
+	assert.NoError(t, clearTrapActive(file))
+}
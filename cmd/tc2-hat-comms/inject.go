@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+)
+
+// Other local services can send events out through the comms output with the InjectEvent
+// D-Bus method, so they don't need their own connection to the trap. For example the audio
+// recorder can trigger a deterrent when it hears a predator. Only the event types in the
+// config are accepted, "*" accepts all types that aren't blocked:
+//
+//	[comms-injection]
+//	allow = ["deterrent", "predatorCall"]
+//	block = []
+//	max-per-minute = 10
+//
+// With UART output the event is queued as a write of the event type with the details as the
+// value. With simple output there are only the trap outputs, so an event with "activateTrap"
+// set in the details activates the main trap like a sighting of a trap species, and one with
+// "protect" set keeps it off like a sighting of a protected species. The trap schedule and
+// disarming still apply.
+const (
+	injectionConfigKey         = "comms-injection"
+	defaultInjectionsPerMinute = 10
+	injectionQueueSize         = 10
+)
+
+var (
+	eventTypeRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{0,31}$`)
+
+	// Event types sent by tc2-hat-comms itself, these can't be injected.
+	reservedEventTypes = []string{"track", "heavyRain", "active"}
+)
+
+// injectionConfig is read from the "comms-injection" section of the config.
+type injectionConfig struct {
+	Allow        []string `mapstructure:"allow"`
+	Block        []string `mapstructure:"block"`
+	MaxPerMinute int      `mapstructure:"max-per-minute"`
+}
+
+func loadInjectionConfig(conf *goconfig.Config) (injectionConfig, error) {
+	c := injectionConfig{MaxPerMinute: defaultInjectionsPerMinute}
+	if err := configcompat.Unmarshal(conf, injectionConfigKey, &c); err != nil {
+		return c, err
+	}
+	if c.MaxPerMinute <= 0 {
+		return c, fmt.Errorf("%s max-per-minute must be positive", injectionConfigKey)
+	}
+	return c, nil
+}
+
+// injectedEvent is an event from another service to send out through the comms output.
+type injectedEvent struct {
+	Type    string
+	Source  string
+	Details map[string]interface{}
+}
+
+// flag returns true if the detail is set to true.
+func (e injectedEvent) flag(name string) bool {
+	v, ok := e.Details[name].(bool)
+	return ok && v
+}
+
+// eventInjector filters the injected events and passes them to the comms output.
+type eventInjector struct {
+	config injectionConfig
+	now    func() time.Time
+	events chan injectedEvent
+
+	mu     sync.Mutex
+	recent []time.Time
+}
+
+func newEventInjector(c injectionConfig) *eventInjector {
+	return &eventInjector{
+		config: c,
+		now:    time.Now,
+		events: make(chan injectedEvent, injectionQueueSize),
+	}
+}
+
+// inject checks the event against the config and passes it to the comms output.
+func (i *eventInjector) inject(e injectedEvent) error {
+	if !eventTypeRegex.MatchString(e.Type) {
+		return fmt.Errorf("invalid event type '%s'", e.Type)
+	}
+	if slices.Contains(reservedEventTypes, e.Type) {
+		return fmt.Errorf("event type '%s' is reserved", e.Type)
+	}
+	if !i.accepts(e.Type) {
+		return fmt.Errorf("event type '%s' is not allowed by the %s config", e.Type, injectionConfigKey)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := i.now()
+	recent := i.recent[:0]
+	for _, t := range i.recent {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	i.recent = recent
+	if len(i.recent) >= i.config.MaxPerMinute {
+		return fmt.Errorf("more than %d events injected in the last minute", i.config.MaxPerMinute)
+	}
+	select {
+	case i.events <- e:
+	default:
+		return errors.New("too many events waiting to be sent")
+	}
+	i.recent = append(i.recent, now)
+	log.Infof("Event '%s' injected by %s", e.Type, e.Source)
+	return nil
+}
+
+func (i *eventInjector) accepts(eventType string) bool {
+	if slices.Contains(i.config.Block, eventType) {
+		return false
+	}
+	return slices.Contains(i.config.Allow, eventType) || slices.Contains(i.config.Allow, "*")
+}
+
+// injected returns the channel of accepted events, nil if there is no injector.
+func (i *eventInjector) injected() <-chan injectedEvent {
+	if i == nil {
+		return nil
+	}
+	return i.events
+}
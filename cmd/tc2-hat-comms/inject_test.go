@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInjectFiltersEvents(t *testing.T) {
+	i := newEventInjector(injectionConfig{Allow: []string{"deterrent"}, MaxPerMinute: 10})
+
+	assert.NoError(t, i.inject(injectedEvent{Type: "deterrent", Source: "audio", Details: map[string]interface{}{"activateTrap": true}}))
+	assert.Error(t, i.inject(injectedEvent{Type: "predatorCall", Source: "audio"}))
+	assert.Error(t, i.inject(injectedEvent{Type: "bad type!", Source: "audio"}))
+
+	e := <-i.injected()
+	assert.Equal(t, "deterrent", e.Type)
+	assert.True(t, e.flag("activateTrap"))
+	assert.False(t, e.flag("protect"))
+}
+
+func TestInjectAllowAll(t *testing.T) {
+	i := newEventInjector(injectionConfig{Allow: []string{"*"}, Block: []string{"predatorCall"}, MaxPerMinute: 10})
+	assert.NoError(t, i.inject(injectedEvent{Type: "deterrent"}))
+	assert.Error(t, i.inject(injectedEvent{Type: "predatorCall"}))
+	// Event types sent by tc2-hat-comms can't be injected.
+	assert.Error(t, i.inject(injectedEvent{Type: "track"}))
+}
+
+func TestInjectRateLimit(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	i := newEventInjector(injectionConfig{Allow: []string{"*"}, MaxPerMinute: 2})
+	i.now = func() time.Time { return now }
+
+	assert.NoError(t, i.inject(injectedEvent{Type: "deterrent"}))
+	assert.NoError(t, i.inject(injectedEvent{Type: "deterrent"}))
+	assert.Error(t, i.inject(injectedEvent{Type: "deterrent"}))
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, i.inject(injectedEvent{Type: "deterrent"}))
+}
+
+func TestInjectNilInjector(t *testing.T) {
+	var i *eventInjector
+	assert.Nil(t, i.injected())
+}
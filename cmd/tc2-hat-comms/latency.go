@@ -0,0 +1,178 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// A trap is only useful for fast moving animals if it is activated quickly, so the time from
+// a tracking signal being received to the output acting on it is measured in stages:
+//   - dispatch, from the signal being received until the output loop picks it up.
+//   - queue, UART only, from the message being queued until it has been delivered.
+//   - output, simple output only, from the pick up until the trap outputs have been set.
+//   - total, from the signal being received until the output acted on it.
+//
+// Tracks that don't change the trap outputs with simple output aren't counted in output or
+// total. The percentiles of the last latencySamples of each stage are returned by GetStats.
+// When the total is over max-track-latency, in the comms section of the config, it is logged
+// and a trackLatencyExceeded event is made, at most every latencyWarningInterval. A
+// max-track-latency of 0 turns the warning off.
+const (
+	defaultMaxTrackLatency = 2 * time.Second
+	latencySamples         = 500
+	latencyWarningInterval = time.Hour
+
+	stageDispatch = "dispatch"
+	stageQueue    = "queue"
+	stageOutput   = "output"
+	stageTotal    = "total"
+)
+
+// latencyConfig is the latency settings stored in the comms section of the config.
+type latencyConfig struct {
+	MaxTrackLatency time.Duration `mapstructure:"max-track-latency"`
+}
+
+// latencyPercentiles are the latencies of a stage, in milliseconds.
+type latencyPercentiles struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+// stageSamples are the last samples of a stage, in a ring buffer.
+type stageSamples struct {
+	samples []time.Duration
+	next    int
+	count   uint64
+}
+
+func (s *stageSamples) add(d time.Duration) {
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, d)
+	} else {
+		s.samples[s.next] = d
+	}
+	s.next = (s.next + 1) % latencySamples
+	s.count++
+}
+
+func (s *stageSamples) percentiles() latencyPercentiles {
+	sorted := slices.Clone(s.samples)
+	slices.Sort(sorted)
+	return latencyPercentiles{
+		Count: s.count,
+		P50:   percentileMs(sorted, 50),
+		P90:   percentileMs(sorted, 90),
+		P99:   percentileMs(sorted, 99),
+		Max:   percentileMs(sorted, 100),
+	}
+}
+
+// percentileMs returns the nearest rank percentile of the sorted durations in milliseconds.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	d := sorted[max(rank, 1)-1]
+	return float64(d.Microseconds()) / 1000
+}
+
+// trackLatency records the latencies of the tracks.
+type trackLatency struct {
+	now        func() time.Time
+	maxLatency time.Duration
+
+	mu          sync.Mutex
+	stages      map[string]*stageSamples
+	exceeded    uint64
+	lastWarning time.Time
+}
+
+func newTrackLatency(now func() time.Time) *trackLatency {
+	return &trackLatency{
+		now:        now,
+		maxLatency: defaultMaxTrackLatency,
+		stages:     map[string]*stageSamples{},
+	}
+}
+
+// record records the latency of a stage.
+func (l *trackLatency) record(stage string, d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.stages[stage]
+	if !ok {
+		s = &stageSamples{}
+		l.stages[stage] = s
+	}
+	s.add(max(d, 0))
+}
+
+// acted records the total latency of a track the output has acted on, warning if it is over
+// the max latency.
+func (l *trackLatency) acted(received time.Time, output string) {
+	if l == nil || received.IsZero() {
+		return
+	}
+	now := l.now()
+	total := now.Sub(received)
+	l.record(stageTotal, total)
+	if l.maxLatency <= 0 || total <= l.maxLatency {
+		return
+	}
+	l.mu.Lock()
+	l.exceeded++
+	warn := l.lastWarning.IsZero() || now.Sub(l.lastWarning) >= latencyWarningInterval
+	if warn {
+		l.lastWarning = now
+	}
+	exceeded := l.exceeded
+	l.mu.Unlock()
+	if !warn {
+		return
+	}
+	log.Errorf("Track took %s to reach the %s output, over the limit of %s", total.Round(time.Millisecond), output, l.maxLatency)
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.TrackLatencyExceeded, now, eventhelper.TrackLatency{
+		Output:    output,
+		LatencyMs: total.Milliseconds(),
+		MaxMs:     l.maxLatency.Milliseconds(),
+		Exceeded:  exceeded,
+		P90Ms:     l.report()[stageTotal].P90,
+	})); err != nil {
+		log.Errorf("Failed to add trackLatencyExceeded event: %v", err)
+	}
+}
+
+// sent records the queue stage and total latency of a track delivered over the UART.
+func (l *trackLatency) sent(queued, received time.Time) {
+	if l == nil || received.IsZero() {
+		return
+	}
+	l.record(stageQueue, l.now().Sub(queued))
+	l.acted(received, channelUART)
+}
+
+// report returns the latency percentiles of each stage.
+func (l *trackLatency) report() map[string]latencyPercentiles {
+	r := map[string]latencyPercentiles{}
+	if l == nil {
+		return r
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for stage, s := range l.stages {
+		r[stage] = s.percentiles()
+	}
+	return r
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	l := newTrackLatency(time.Now)
+	for i := 1; i <= 100; i++ {
+		l.record(stageDispatch, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, latencyPercentiles{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}, l.report()[stageDispatch])
+
+	// Only the last samples are kept, but all are counted.
+	for i := 0; i < latencySamples; i++ {
+		l.record(stageDispatch, time.Millisecond)
+	}
+	assert.Equal(t, latencyPercentiles{Count: 100 + latencySamples, P50: 1, P90: 1, P99: 1, Max: 1}, l.report()[stageDispatch])
+
+	var nilLatency *trackLatency
+	nilLatency.record(stageTotal, time.Second)
+	nilLatency.acted(time.Now(), channelSimple)
+	assert.Empty(t, nilLatency.report())
+}
+
+func TestLatencyExceeded(t *testing.T) {
+	now := time.Date(2026, 6, 1, 21, 0, 0, 0, time.UTC)
+	l := newTrackLatency(func() time.Time { return now })
+	events := eventtest.Capture(t)
+
+	l.acted(now.Add(-500*time.Millisecond), channelSimple)
+	assert.Empty(t, events.Events())
+	l.acted(now.Add(-3*time.Second), channelSimple)
+	l.acted(now.Add(-4*time.Second), channelSimple)
+	// Only warned about once in the interval.
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "trackLatencyExceeded", events.Events()[0].Type)
+		assert.Equal(t, int64(3000), events.Events()[0].Details["latencyMs"])
+		assert.Equal(t, uint64(1), events.Events()[0].Details["exceeded"])
+	}
+	now = now.Add(latencyWarningInterval)
+	l.acted(now.Add(-3*time.Second), channelSimple)
+	if assert.Len(t, events.Events(), 2) {
+		assert.Equal(t, uint64(3), events.Events()[1].Details["exceeded"])
+	}
+	assert.Equal(t, uint64(4), l.report()[stageTotal].Count)
+
+	// A max of 0 doesn't warn.
+	l.maxLatency = 0
+	now = now.Add(latencyWarningInterval)
+	l.acted(now.Add(-time.Minute), channelSimple)
+	assert.Len(t, events.Events(), 2)
+}
+
+func TestQueueRecordsTrackLatency(t *testing.T) {
+	now := time.Date(2026, 6, 1, 21, 0, 0, 0, time.UTC)
+	q, err := loadOutboundQueue(t.TempDir() + "/queue.json")
+	assert.NoError(t, err)
+	q.latency = newTrackLatency(func() time.Time { return now })
+	received := now.Add(-300 * time.Millisecond)
+	assert.NoError(t, q.addTrack(commsproto.UartMessage{Type: "write", Data: "track"}, received, now.Add(-100*time.Millisecond)))
+	assert.NoError(t, q.add(commsproto.UartMessage{Type: "write", Data: "heavyRain"}, now))
+
+	_, err = q.deliver(func(commsproto.UartMessage) error { return nil }, now)
+	assert.NoError(t, err)
+	r := q.latency.report()
+	assert.Equal(t, latencyPercentiles{Count: 1, P50: 100, P90: 100, P99: 100, Max: 100}, r[stageQueue])
+	assert.Equal(t, latencyPercentiles{Count: 1, P50: 300, P90: 300, P99: 300, Max: 300}, r[stageTotal])
+}
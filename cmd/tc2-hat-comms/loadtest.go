@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+)
+
+// load-test pushes synthetic tracking and battery events through the same channels and
+// message handling as the service, with the output faked, to size the buffers and spot where
+// events back up before it loses real detections. Tracking events come from the D-Bus signals
+// through a channel only defaultEventBuffer deep. When it is full the signal is held by the
+// D-Bus library and delivered later, in any order, so these are reported as backed up, or as
+// dropped with --drop to see what a sender that doesn't wait would lose. The UART output saves
+// each message to a queue file in a temporary directory and takes --send-time to send it. The
+// simple output only records the sighting, so its latency is how long events wait in the
+// channel. Battery events go through the injected events channel, the rate limit on injected
+// events isn't applied.
+const defaultEventBuffer = 10
+
+type LoadTestCmd struct {
+	Events          int           `arg:"--events" default:"1000" help:"Number of synthetic events to send."`
+	Rate            float64       `arg:"--rate" default:"50" help:"Events per second, 0 sends them as fast as possible."`
+	BatteryFraction float64       `arg:"--battery-fraction" default:"0.1" help:"Fraction of the events that are battery events, the rest are tracking events."`
+	Buffer          int           `arg:"--buffer" default:"10" help:"Depth of the event channels."`
+	Outputs         string        `arg:"--outputs" default:"uart,simple" help:"Comma separated outputs to test, uart and simple."`
+	SendTime        time.Duration `arg:"--send-time" default:"20ms" help:"Time taken to send each message over the UART."`
+	Drop            bool          `arg:"--drop" help:"Drop events when the channel is full instead of waiting."`
+}
+
+// loadTestEvent is a synthetic event with the time it was generated.
+type loadTestEvent struct {
+	track   trackingEvent
+	battery bool
+	created time.Time
+}
+
+// loadTestResult is how an output coped with the events.
+type loadTestResult struct {
+	output    string
+	sent      int
+	backedUp  int // Sends that found the channel full.
+	dropped   int
+	delivered int
+	duration  time.Duration // From the first event to the last delivery.
+	latencies []time.Duration
+}
+
+func (r loadTestResult) throughput() float64 {
+	if r.duration <= 0 {
+		return 0
+	}
+	return float64(r.delivered) / r.duration.Seconds()
+}
+
+// percentile returns the latency that p percent of the events were delivered within.
+func (r loadTestResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, r.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func (r loadTestResult) String() string {
+	return fmt.Sprintf("%-6s sent %d, backed up %d, dropped %d, delivered %d, %.1f events/s, latency p50 %s p95 %s max %s",
+		r.output, r.sent, r.backedUp, r.dropped, r.delivered, r.throughput(),
+		r.percentile(50).Round(time.Microsecond), r.percentile(95).Round(time.Microsecond), r.percentile(100).Round(time.Microsecond))
+}
+
+// runLoadTest runs the load test on each output and prints the results.
+func runLoadTest(config *CommsConfig, args *LoadTestCmd) error {
+	if args.Events <= 0 || args.Buffer < 0 || args.Rate < 0 || args.BatteryFraction < 0 || args.BatteryFraction > 1 {
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("events must be positive, buffer and rate can't be negative and battery-fraction must be from 0 to 1"))
+	}
+	dir, err := os.MkdirTemp("", "comms-load-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	log.Printf("Sending %d events at %.0f/s through channels %d deep", args.Events, args.Rate, args.Buffer)
+	for _, output := range strings.Split(args.Outputs, ",") {
+		output = strings.TrimSpace(output)
+		if output != channelUART && output != channelSimple {
+			return exitcode.Wrap(exitcode.Usage, fmt.Errorf("unknown output '%s'", output))
+		}
+		result, err := loadTestOutput(output, args, config.TrackPayload, filepath.Join(dir, output+"-queue.json"))
+		if err != nil {
+			return err
+		}
+		fmt.Println(result)
+	}
+	return nil
+}
+
+// loadTestOutput sends the events to the output and measures how long they take to deliver.
+func loadTestOutput(output string, args *LoadTestCmd, trackPayload, queueFile string) (loadTestResult, error) {
+	result := loadTestResult{output: output}
+	tracksChan := make(chan loadTestEvent, args.Buffer)
+	batteryChan := make(chan loadTestEvent, args.Buffer)
+	start := time.Now()
+	go func() {
+		defer close(tracksChan)
+		defer close(batteryChan)
+		batteryDebt := 0.0
+		for i := 0; i < args.Events; i++ {
+			if args.Rate > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(i) / args.Rate * float64(time.Second)))))
+			}
+			e := loadTestEvent{
+				track: trackingEvent{
+					species:     tracks.Species{"possum": int32(50 + i%50)},
+					boundingBox: [4]int32{10, 10, 40, 40},
+					motion:      true,
+					received:    time.Now(),
+				},
+				created: time.Now(),
+			}
+			ch := tracksChan
+			if batteryDebt += args.BatteryFraction; batteryDebt >= 1 {
+				batteryDebt--
+				e.battery = true
+				ch = batteryChan
+			}
+			result.sent++
+			select {
+			case ch <- e:
+				continue
+			default:
+			}
+			result.backedUp++
+			if args.Drop {
+				result.dropped++
+				continue
+			}
+			ch <- e
+		}
+	}()
+
+	var deliver func(e loadTestEvent) error
+	var flush func() error
+	switch output {
+	case channelUART:
+		queue, err := loadOutboundQueue(queueFile)
+		if err != nil {
+			return result, err
+		}
+		// The queue is sent in order, so these are the times the queued events were made.
+		queued := []time.Time{}
+		send := func(commsproto.UartMessage) error {
+			time.Sleep(args.SendTime)
+			result.latencies = append(result.latencies, time.Since(queued[0]))
+			queued = queued[1:]
+			return nil
+		}
+		deliver = func(e loadTestEvent) error {
+			message, err := trackMessage(e.track, trackPayload)
+			if e.battery {
+				message, err = writeMessage("battery", map[string]interface{}{"voltage": 3.7, "percent": 80})
+			}
+			if err != nil {
+				return err
+			}
+			if err := queue.add(message, time.Now()); err != nil {
+				return err
+			}
+			queued = append(queued, e.created)
+			_, err = queue.deliver(send, time.Now())
+			return err
+		}
+		flush = func() error {
+			_, err := queue.deliver(send, time.Now())
+			return err
+		}
+	case channelSimple:
+		sightings := map[string]time.Time{}
+		deliver = func(e loadTestEvent) error {
+			for species := range e.track.species {
+				sightings[species] = time.Now()
+			}
+			result.latencies = append(result.latencies, time.Since(e.created))
+			return nil
+		}
+		flush = func() error { return nil }
+	}
+
+	for tracksChan != nil || batteryChan != nil {
+		var e loadTestEvent
+		var ok bool
+		select {
+		case e, ok = <-tracksChan:
+			if !ok {
+				tracksChan = nil
+				continue
+			}
+		case e, ok = <-batteryChan:
+			if !ok {
+				batteryChan = nil
+				continue
+			}
+		}
+		if err := deliver(e); err != nil {
+			return result, err
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+	result.delivered = len(result.latencies)
+	result.duration = time.Since(start)
+	return result, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTestOutput(t *testing.T) {
+	args := &LoadTestCmd{Events: 50, BatteryFraction: 0.2, Buffer: 10}
+	result, err := loadTestOutput(channelUART, args, trackPayloadCompact, filepath.Join(t.TempDir(), "queue.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, 50, result.sent)
+	assert.Equal(t, 50, result.delivered)
+	assert.Zero(t, result.dropped)
+
+	// Sending slower than the events arrive backs up the channel, dropping events that
+	// don't fit.
+	args = &LoadTestCmd{Events: 50, Buffer: 2, Drop: true}
+	result, err = loadTestOutput(channelSimple, args, trackPayloadJSON, "")
+	assert.NoError(t, err)
+	assert.Equal(t, result.sent-result.dropped, result.delivered)
+	assert.Equal(t, result.backedUp, result.dropped)
+}
+
+func TestLoadTestPercentile(t *testing.T) {
+	r := loadTestResult{latencies: []time.Duration{4, 1, 3, 2, 5}}
+	assert.Equal(t, time.Duration(3), r.percentile(50))
+	assert.Equal(t, time.Duration(5), r.percentile(100))
+	assert.Zero(t, loadTestResult{}.percentile(95))
+}
@@ -1,13 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"time"
 
 	goconfig "github.com/TheCacophonyProject/go-config"
 	"github.com/TheCacophonyProject/go-utils/logging"
-	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
-	"github.com/alexflint/go-arg"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/instancelock"
+	"github.com/TheCacophonyProject/tc2-hat-controller/readiness"
+	"github.com/TheCacophonyProject/tc2-hat-controller/safemode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/selfmonitor"
+)
+
+const (
+	safeModeService = "tc2-hat-comms"
+	// How often a config that failed to parse is read again.
+	configRetryInterval = 30 * time.Second
 )
 
 var (
@@ -18,22 +31,72 @@ var (
 type Args struct {
 	goconfig.ConfigArgs
 	logging.LogArgs
+	Replace bool `arg:"--replace" help:"Stop another running instance of the service and take over from it."`
+
+	Queue      *QueueCmd      `arg:"subcommand:queue" help:"Print the messages waiting to be sent over the UART and the ones that failed."`
+	Correction *CorrectionCmd `arg:"subcommand:correction" help:"Record a correction to a species classification, used to calibrate the species thresholds."`
+	Schedule   *ScheduleCmd   `arg:"subcommand:schedule" help:"Print the trap schedule, or override it for maintenance."`
+
+	SendTestClassification *SendTestClassificationCmd `arg:"subcommand:send-test-classification" help:"Send a test classification over the UART and check it was sent."`
+	LoadTest               *LoadTestCmd               `arg:"subcommand:load-test" help:"Send synthetic events through the event pipeline, measuring throughput, backed up events and latency."`
+	DetectESL              *DetectESLCmd              `arg:"subcommand:detect-esl" help:"Find the wiring and baud rate of an AT-ESL trap on the aux UART and save them to the config."`
+}
+
+type QueueCmd struct {
+	Retry bool `arg:"--retry" help:"Move the failed messages back to pending so they are sent again."`
+}
+
+type CorrectionCmd struct {
+	Predicted  string `arg:"--predicted,required" help:"Species the track was classified as."`
+	Actual     string `arg:"--actual,required" help:"Species the track actually was."`
+	Confidence int32  `arg:"--confidence" help:"Confidence of the classification."`
+	TrackID    int    `arg:"--track-id" help:"ID of the track on the server."`
+}
+
+type ScheduleCmd struct {
+	AllowFor time.Duration `arg:"--allow-for" help:"Allow the trap to be active for this long, whatever the schedule says."`
+	BlockFor time.Duration `arg:"--block-for" help:"Stop the trap from being active for this long, whatever the schedule says."`
+	Clear    bool          `arg:"--clear" help:"Clear the override and follow the schedule."`
 }
 
+type SendTestClassificationCmd struct {
+	Species    string `arg:"--species" default:"possum" help:"Species of the test classification."`
+	Confidence int32  `arg:"--confidence" default:"90" help:"Confidence of the test classification."`
+	Loopback   bool   `arg:"--loopback" help:"Fail unless the frame is read back from a loopback adapter on the serial port."`
+}
+
+type DetectESLCmd struct{}
+
 func (Args) Version() string {
 	return version
 }
 
 func procArgs() Args {
 	args := Args{}
-	arg.MustParse(&args)
+	exitcode.MustParse(&args)
 	return args
 }
 
+// waitForValidConfig parses the config every configRetryInterval until it is valid.
+func waitForValidConfig(configDir string, err error) *CommsConfig {
+	for {
+		time.Sleep(configRetryInterval)
+		config, parseErr := ParseCommsConfig(configDir)
+		if parseErr == nil {
+			return config
+		}
+		if parseErr.Error() != err.Error() {
+			log.Errorf("Failed to parse config: %v", parseErr)
+			err = parseErr
+		}
+	}
+}
+
 func main() {
 	err := runMain()
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(exitcode.Code(err))
 	}
 }
 
@@ -42,11 +105,72 @@ func runMain() error {
 
 	log = logging.NewLogger(args.LogLevel)
 
+	if args.Queue != nil {
+		return printOutboundQueue(outboundQueueFile, args.Queue.Retry)
+	}
+
+	if args.Correction != nil {
+		config, err := ParseCommsConfig(args.ConfigDir)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		return recordCorrection(config, speciesCorrection{
+			Time:       time.Now(),
+			TrackID:    args.Correction.TrackID,
+			Predicted:  args.Correction.Predicted,
+			Confidence: args.Correction.Confidence,
+			Actual:     args.Correction.Actual,
+		})
+	}
+
+	if args.Schedule != nil {
+		config, err := ParseCommsConfig(args.ConfigDir)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		return runScheduleCommand(config, args.Schedule)
+	}
+
+	if args.SendTestClassification != nil {
+		config, err := ParseCommsConfig(args.ConfigDir)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		return runTestClassification(config, args.SendTestClassification)
+	}
+
+	if args.LoadTest != nil {
+		config, err := ParseCommsConfig(args.ConfigDir)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		return runLoadTest(config, args.LoadTest)
+	}
+
+	if args.DetectESL != nil {
+		config, err := ParseCommsConfig(args.ConfigDir)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		return runDetectESL(config)
+	}
+
 	log.Printf("Running version: %s", version)
+	configcompat.SetBinary("tc2-hat-comms", version)
+	if _, err := instancelock.Acquire(safeModeService, args.Replace); err != nil {
+		return err
+	}
 
 	config, err := ParseCommsConfig(args.ConfigDir)
 	if err != nil {
-		return err
+		// Don't restart loop on a bad config, keep the trap disabled until the config is fixed.
+		log.Errorf("Failed to parse config, running in safe mode with comms disabled: %v", err)
+		eventhelper.ReportSafeMode(safeModeService, fmt.Errorf("config: %v", err))
+		config = waitForValidConfig(args.ConfigDir, err)
+		log.Info("Config is valid now, starting comms.")
+	}
+	if err := safemode.Exit(safeModeService); err != nil {
+		log.Errorf("Error clearing safe mode: %v", err)
 	}
 
 	if !config.Enable {
@@ -58,28 +182,68 @@ func runMain() error {
 
 	if config.CommsOut == "uart" && config.Bluetooth {
 		log.Error("Can't have output set to UART and Bluetooth enabled at the same time.")
-		return fmt.Errorf("can't have output set to UART and Bluetooth enabled at the same time")
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("can't have output set to UART and Bluetooth enabled at the same time"))
+	}
+
+	if err := readiness.Clear(safeModeService); err != nil {
+		log.Errorf("Failed to clear readiness: %v", err)
 	}
+	// Events and the trap schedule use the time, so the RTC needs to have set it first.
+	readiness.WaitFor(context.Background(), safeModeService, readiness.RTC)
 
-	log.Info("Species to trap:\n", tracks.Species(config.TrapSpecies))
-	log.Info("Species to protect:\n", tracks.Species(config.ProtectSpecies))
+	thresholds := newSpeciesThresholds(config)
+	trapSpecies, protectSpecies := thresholds.current()
+	log.Info("Species to trap:\n", trapSpecies)
+	log.Info("Species to protect:\n", protectSpecies)
 
 	trackingSignals, err := getTrackingSignals()
 	if err != nil {
 		return err
 	}
 
+	weather, err := startWeatherMonitor(config.Weather)
+	if err != nil {
+		// Keep running without the weather input rather than leaving the trap unmanaged.
+		log.Errorf("Failed to start weather input: %v", err)
+	}
+
+	scheduler, err := newTrapScheduler(config.Schedule, newRTCClock().Now)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, err)
+	}
+	injector := newEventInjector(config.Injection)
+	protectedSightingsCounter, err = loadProtectedSightings(protectedSightingsFile)
+	if err != nil {
+		log.Errorf("Failed to load protected sightings, starting again: %v", err)
+	}
+	override, err := startTrapOverride(config.Override)
+	if err != nil {
+		// The override can still be started over D-Bus.
+		log.Errorf("Failed to set up trap override button: %v", err)
+	}
+	startMaintenancePresence(config.Presence, override, args.LogLevel)
+	if err := startCommsService(scheduler, injector, override, args.ConfigDir); err != nil {
+		log.Errorf("Failed to start D-Bus service: %v", err)
+	}
+	if err := readiness.Announce(safeModeService); err != nil {
+		log.Errorf("Failed to announce readiness: %v", err)
+	}
+
+	stats.latency.maxLatency = config.MaxTrackLatency
+	go reportCommsHealth(stats, commsHealthInterval)
+	selfmonitor.Start(safeModeService, config.Health)
+
 	switch config.CommsOut {
 	case "uart":
-		if err := processUart(); err != nil {
+		if err := processUart(config, trackingSignals, weather, injector); err != nil {
 			return err
 		}
 	case "simple":
-		if err := processSimpleOutput(config, trackingSignals); err != nil {
+		if err := processSimpleOutput(config, trackingSignals, weather, thresholds, scheduler, injector, override); err != nil {
 			return err
 		}
 	default:
-		return fmt.Errorf("unknown output type '%s'", config.CommsOut)
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("unknown output type '%s'", config.CommsOut))
 	}
 
 	return nil
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+)
+
+// Messages sent over the UART are saved to a queue file before sending, so they aren't lost
+// if the write fails or tc2-hat-comms restarts mid-send. Failed sends are retried with a
+// backoff until they reach outboundMaxAttempts, they are then kept as failed so they can be
+// inspected with `tc2-hat-comms queue`.
+const (
+	outboundQueueFile   = "/etc/cacophony/comms-outbound-queue.json"
+	outboundMaxAttempts = 10
+	outboundMinBackoff  = 5 * time.Second
+	outboundMaxBackoff  = 10 * time.Minute
+	outboundMaxFailed   = 100
+)
+
+const (
+	deliveryPending = "pending"
+	deliveryFailed  = "failed"
+)
+
+type queuedMessage struct {
+	ID          int                    `json:"id"`
+	Message     commsproto.UartMessage `json:"message"`
+	Added       time.Time              `json:"added"`
+	Received    time.Time              `json:"received,omitempty"` // Tracking signal, for tracks.
+	Status      string                 `json:"status"`
+	Attempts    int                    `json:"attempts"`
+	NextAttempt time.Time              `json:"nextAttempt"`
+	LastError   string                 `json:"lastError,omitempty"`
+}
+
+// queueFile is the saved queue, nextID is kept so IDs aren't reused after messages are sent.
+type queueFile struct {
+	NextID   int             `json:"nextID"`
+	Messages []queuedMessage `json:"messages"`
+}
+
+type outboundQueue struct {
+	file    string
+	stats   *channelStats // Optional, counts the retries.
+	latency *trackLatency // Optional, records the latency of tracks.
+
+	mu       sync.Mutex
+	nextID   int
+	messages []queuedMessage
+}
+
+// loadOutboundQueue loads the queue from the file, a missing file is an empty queue.
+func loadOutboundQueue(file string) (*outboundQueue, error) {
+	q := &outboundQueue{file: file, nextID: 1}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := queueFile{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse outbound queue '%s': %v", file, err)
+	}
+	q.messages = saved.Messages
+	q.nextID = max(q.nextID, saved.NextID)
+	for _, m := range q.messages {
+		q.nextID = max(q.nextID, m.ID+1)
+	}
+	return q, nil
+}
+
+// add saves the message to the queue so it will be sent on the next delivery.
+func (q *outboundQueue) add(message commsproto.UartMessage, now time.Time) error {
+	return q.addTrack(message, time.Time{}, now)
+}
+
+// addTrack saves the message for a track, received is when its tracking signal was received.
+func (q *outboundQueue) addTrack(message commsproto.UartMessage, received, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, queuedMessage{
+		ID:          q.nextID,
+		Message:     message,
+		Added:       now,
+		Received:    received,
+		Status:      deliveryPending,
+		NextAttempt: now,
+	})
+	q.nextID++
+	return q.save()
+}
+
+// deliver tries to send the pending messages that are due, in the order they were added.
+// Sent messages are removed from the queue. Returns when the next message is due.
+func (q *outboundQueue) deliver(send func(commsproto.UartMessage) error, now time.Time) (time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	remaining := []queuedMessage{}
+	for _, m := range q.messages {
+		if m.Status != deliveryPending || m.NextAttempt.After(now) {
+			remaining = append(remaining, m)
+			continue
+		}
+		m.Attempts++
+		if m.Attempts > 1 {
+			q.stats.retry()
+		}
+		// Compact classifications carry their age, which is only known when they are sent.
+		err := send(withAge(m.Message, now.Sub(m.Added)))
+		if err == nil {
+			log.Debugf("Delivered message %d after %d attempts", m.ID, m.Attempts)
+			q.latency.sent(m.Added, m.Received)
+			continue
+		}
+		m.LastError = err.Error()
+		if m.Attempts >= outboundMaxAttempts {
+			log.Errorf("Giving up on message %d after %d attempts: %v", m.ID, m.Attempts, err)
+			m.Status = deliveryFailed
+		} else {
+			m.NextAttempt = now.Add(retryBackoff(m.Attempts))
+			log.Infof("Failed to send message %d, retrying at %s: %v", m.ID, m.NextAttempt.Format(time.TimeOnly), err)
+		}
+		remaining = append(remaining, m)
+	}
+	q.messages = trimFailed(remaining, outboundMaxFailed)
+	return q.nextDue(), q.save()
+}
+
+// retryFailed moves the failed messages back to pending.
+func (q *outboundQueue) retryFailed(now time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := 0
+	for i := range q.messages {
+		if q.messages[i].Status == deliveryFailed {
+			q.messages[i].Status = deliveryPending
+			q.messages[i].Attempts = 0
+			q.messages[i].NextAttempt = now
+			count++
+		}
+	}
+	return count, q.save()
+}
+
+func (q *outboundQueue) nextDue() time.Time {
+	next := time.Time{}
+	for _, m := range q.messages {
+		if m.Status == deliveryPending && (next.IsZero() || m.NextAttempt.Before(next)) {
+			next = m.NextAttempt
+		}
+	}
+	return next
+}
+
+func (q *outboundQueue) save() error {
+	data, err := json.MarshalIndent(queueFile{NextID: q.nextID, Messages: q.messages}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := q.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, q.file)
+}
+
+// retryBackoff doubles the wait after each attempt, up to outboundMaxBackoff.
+func retryBackoff(attempts int) time.Duration {
+	backoff := outboundMinBackoff
+	for i := 1; i < attempts && backoff < outboundMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, outboundMaxBackoff)
+}
+
+// trimFailed drops the oldest failed messages so the queue can't grow forever.
+func trimFailed(messages []queuedMessage, maxFailed int) []queuedMessage {
+	failed := 0
+	for _, m := range messages {
+		if m.Status == deliveryFailed {
+			failed++
+		}
+	}
+	trimmed := []queuedMessage{}
+	for _, m := range messages {
+		if m.Status == deliveryFailed && failed > maxFailed {
+			failed--
+			continue
+		}
+		trimmed = append(trimmed, m)
+	}
+	return trimmed
+}
+
+// printOutboundQueue prints the pending and failed messages in the queue.
+func printOutboundQueue(file string, retry bool) error {
+	q, err := loadOutboundQueue(file)
+	if err != nil {
+		return err
+	}
+	if retry {
+		count, err := q.retryFailed(time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved %d failed messages back to pending.\n", count)
+	}
+	if len(q.messages) == 0 {
+		fmt.Println("Outbound queue is empty.")
+		return nil
+	}
+	for _, m := range q.messages {
+		fmt.Printf("%d\t%s\t%s %s\tadded %s\tattempts %d", m.ID, m.Status, m.Message.Type, m.Message.Data,
+			m.Added.Format(time.DateTime), m.Attempts)
+		if m.Status == deliveryPending && m.Attempts > 0 {
+			fmt.Printf("\tnext attempt %s", m.NextAttempt.Format(time.DateTime))
+		}
+		if m.LastError != "" {
+			fmt.Printf("\terror: %s", m.LastError)
+		}
+		fmt.Println()
+	}
+	return nil
+}
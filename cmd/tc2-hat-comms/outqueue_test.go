@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundQueue(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queue.json")
+	q, err := loadOutboundQueue(file)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	assert.NoError(t, q.add(commsproto.UartMessage{Type: "write", Data: "a"}, now))
+	assert.NoError(t, q.add(commsproto.UartMessage{Type: "write", Data: "b"}, now))
+
+	// First message fails, second is sent.
+	sent := []string{}
+	send := func(m commsproto.UartMessage) error {
+		if m.Data == "a" {
+			return errors.New("no response")
+		}
+		sent = append(sent, m.Data)
+		return nil
+	}
+	next, err := q.deliver(send, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, sent)
+	assert.Equal(t, now.Add(outboundMinBackoff), next)
+
+	// Queue is kept across restarts.
+	q, err = loadOutboundQueue(file)
+	assert.NoError(t, err)
+	assert.Len(t, q.messages, 1)
+	assert.Equal(t, 1, q.messages[0].Attempts)
+	assert.NoError(t, q.add(commsproto.UartMessage{Type: "write", Data: "c"}, now))
+	assert.Equal(t, 3, q.messages[1].ID)
+
+	// Not retried until the backoff has passed.
+	_, err = q.deliver(send, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.messages[0].Attempts)
+
+	// Marked as failed after the max attempts.
+	for i := 0; i < outboundMaxAttempts; i++ {
+		now = now.Add(outboundMaxBackoff)
+		_, err = q.deliver(send, now)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, q.messages, 1)
+	assert.Equal(t, deliveryFailed, q.messages[0].Status)
+	assert.Equal(t, outboundMaxAttempts, q.messages[0].Attempts)
+
+	count, err := q.retryFailed(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, deliveryPending, q.messages[0].Status)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, outboundMinBackoff, retryBackoff(1))
+	assert.Equal(t, 2*outboundMinBackoff, retryBackoff(2))
+	assert.Equal(t, outboundMaxBackoff, retryBackoff(20))
+}
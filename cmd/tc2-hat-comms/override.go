@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
+)
+
+// A ranger can press an override button at the trap to force it safe while clearing it.
+// The trap is kept deactivated for the override duration and then re-arms by itself, the LED
+// is on while the override is active. Pressing the button again restarts the duration.
+//
+//	[trap-override]
+//	button-pin = "GPIO26"
+//	led-pin = "GPIO19"
+//	duration = "30m"
+//
+// The override can also be started over D-Bus. It is saved so it isn't lost if tc2-hat-comms
+// restarts while the trap is being cleared. It applies to the simple output, where
+// tc2-hat-comms decides if the trap is active.
+const (
+	overrideConfigKey      = "trap-override"
+	trapOverrideFile       = "/etc/cacophony/trap-override.json"
+	defaultOverrideTime    = 30 * time.Minute
+	overrideButtonDebounce = 200 * time.Millisecond
+
+	overrideTriggerButton   = "button"
+	overrideTriggerDBus     = "dbus"
+	overrideTriggerPresence = "presence"
+)
+
+// overrideConfig is read from the "trap-override" section of the config.
+type overrideConfig struct {
+	ButtonPin string        `mapstructure:"button-pin"`
+	LEDPin    string        `mapstructure:"led-pin"`
+	Duration  time.Duration `mapstructure:"duration"`
+}
+
+func loadOverrideConfig(conf *goconfig.Config) (overrideConfig, error) {
+	c := overrideConfig{Duration: defaultOverrideTime}
+	if err := configcompat.Unmarshal(conf, overrideConfigKey, &c); err != nil {
+		return c, err
+	}
+	if c.Duration <= 0 {
+		return c, fmt.Errorf("%s duration must be positive", overrideConfigKey)
+	}
+	return c, nil
+}
+
+// savedOverride is the active override.
+type savedOverride struct {
+	Trigger string    `json:"trigger"`
+	Start   time.Time `json:"start"`
+	Until   time.Time `json:"until"`
+}
+
+// trapOverride forces the trap safe for a while.
+type trapOverride struct {
+	config overrideConfig
+	file   string
+	now    func() time.Time
+	setLED func(on bool) error
+	// Sent a value when an override is started or stopped, so the trap changes straight away.
+	changes chan struct{}
+
+	mu      sync.Mutex
+	current *savedOverride
+}
+
+func newTrapOverride(c overrideConfig) *trapOverride {
+	o := &trapOverride{
+		config:  c,
+		file:    trapOverrideFile,
+		now:     time.Now,
+		setLED:  func(bool) error { return nil },
+		changes: make(chan struct{}, 1),
+	}
+	if err := o.load(); err != nil {
+		log.Errorf("Failed to read saved trap override: %v", err)
+	}
+	return o
+}
+
+// startTrapOverride starts watching the override button, if there is one.
+func startTrapOverride(c overrideConfig) (*trapOverride, error) {
+	o := newTrapOverride(c)
+	if c.ButtonPin == "" && c.LEDPin == "" {
+		return o, nil
+	}
+	if _, err := host.Init(); err != nil {
+		return o, fmt.Errorf("failed to initialize periph: %v", err)
+	}
+	if c.LEDPin != "" {
+		led := gpioreg.ByName(c.LEDPin)
+		if led == nil {
+			return o, fmt.Errorf("failed to find override LED pin '%s'", c.LEDPin)
+		}
+		o.setLED = func(on bool) error { return led.Out(gpio.Level(on)) }
+		o.mu.Lock()
+		err := o.setLED(o.current != nil)
+		o.mu.Unlock()
+		if err != nil {
+			return o, err
+		}
+	}
+	if c.ButtonPin != "" {
+		button := gpioreg.ByName(c.ButtonPin)
+		if button == nil {
+			return o, fmt.Errorf("failed to find override button pin '%s'", c.ButtonPin)
+		}
+		if err := button.In(gpio.PullUp, gpio.FallingEdge); err != nil {
+			return o, fmt.Errorf("failed to set up override button pin: %v", err)
+		}
+		log.Infof("Watching trap override button on %s", c.ButtonPin)
+		go o.watchButton(button)
+	}
+	return o, nil
+}
+
+func (o *trapOverride) watchButton(pin gpio.PinIn) {
+	lastPress := time.Time{}
+	for {
+		if !pin.WaitForEdge(-1) {
+			continue
+		}
+		now := o.now()
+		if now.Sub(lastPress) < overrideButtonDebounce {
+			continue
+		}
+		lastPress = now
+		if err := o.start(overrideTriggerButton, o.config.Duration); err != nil {
+			log.Errorf("Failed to start trap override: %v", err)
+		}
+	}
+}
+
+func (o *trapOverride) load() error {
+	data, err := os.ReadFile(o.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := &savedOverride{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return err
+	}
+	o.current = saved
+	return nil
+}
+
+func (o *trapOverride) save() error {
+	if o.current == nil {
+		err := os.Remove(o.file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(o.current)
+	if err != nil {
+		return err
+	}
+	tmpFile := o.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, o.file)
+}
+
+// start forces the trap safe for the duration, restarting the duration if it is already active.
+func (o *trapOverride) start(trigger string, d time.Duration) error {
+	if o == nil {
+		return fmt.Errorf("trap override isn't available")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	o.current = &savedOverride{Trigger: trigger, Start: now, Until: now.Add(d)}
+	log.Infof("Trap forced safe by %s until %s", trigger, o.current.Until.Format(time.DateTime))
+	if err := o.save(); err != nil {
+		log.Errorf("Failed to save trap override: %v", err)
+	}
+	if err := o.setLED(true); err != nil {
+		log.Errorf("Failed to turn on override LED: %v", err)
+	}
+	o.report(eventhelper.TrapOverrideStarted, now, eventhelper.TrapOverride{
+		DurationSeconds: int(d.Seconds()),
+		Until:           o.current.Until,
+	})
+	select {
+	case o.changes <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// active returns true if the trap is forced safe, re-arming it once the override has ended.
+// Safe to call on a nil override.
+func (o *trapOverride) active() bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current == nil {
+		return false
+	}
+	now := o.now()
+	if now.Before(o.current.Until) {
+		return true
+	}
+	o.end(now)
+	return false
+}
+
+// stop ends the override early if it was started by the trigger, so one started by the button
+// isn't ended by something else. Safe to call on a nil override.
+func (o *trapOverride) stop(trigger string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current == nil || o.current.Trigger != trigger {
+		return
+	}
+	o.end(o.now())
+	select {
+	case o.changes <- struct{}{}:
+	default:
+	}
+}
+
+// end clears the override and re-arms the trap, o.mu must be held.
+func (o *trapOverride) end(now time.Time) {
+	log.Infof("Trap override by %s ended, re-arming", o.current.Trigger)
+	o.report(eventhelper.TrapOverrideEnded, now, eventhelper.TrapOverride{
+		Start: o.current.Start,
+	})
+	o.current = nil
+	if err := o.save(); err != nil {
+		log.Errorf("Failed to clear trap override: %v", err)
+	}
+	if err := o.setLED(false); err != nil {
+		log.Errorf("Failed to turn off override LED: %v", err)
+	}
+}
+
+// remaining returns how long until the override ends, 0 if it isn't active.
+func (o *trapOverride) remaining() time.Duration {
+	if o == nil {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.current == nil {
+		return 0
+	}
+	return max(0, o.current.Until.Sub(o.now()))
+}
+
+// started returns a channel that is sent a value when an override is started, nil for a
+// nil override.
+func (o *trapOverride) started() <-chan struct{} {
+	if o == nil {
+		return nil
+	}
+	return o.changes
+}
+
+func (o *trapOverride) report(eventType string, now time.Time, payload eventhelper.TrapOverride) {
+	payload.Trigger = o.current.Trigger
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventType, now, payload)); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTrapOverride(t *testing.T, now *time.Time, led *bool) *trapOverride {
+	return &trapOverride{
+		config: overrideConfig{Duration: 30 * time.Minute},
+		file:   filepath.Join(t.TempDir(), "trap-override.json"),
+		now:    func() time.Time { return *now },
+		setLED: func(on bool) error {
+			*led = on
+			return nil
+		},
+		changes: make(chan struct{}, 1),
+	}
+}
+
+func TestTrapOverride(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	led := false
+	o := newTestTrapOverride(t, &now, &led)
+	assert.False(t, o.active())
+
+	assert.NoError(t, o.start(overrideTriggerButton, o.config.Duration))
+	assert.True(t, o.active())
+	assert.True(t, led)
+	assert.Equal(t, 30*time.Minute, o.remaining())
+	assert.Len(t, o.started(), 1)
+	assert.Equal(t, []string{"trapOverrideStarted"}, events.Types())
+	assert.Equal(t, overrideTriggerButton, events.Events()[0].Details["trigger"])
+
+	// The override is saved so it is kept after a restart.
+	restarted := newTestTrapOverride(t, &now, &led)
+	restarted.file = o.file
+	assert.NoError(t, restarted.load())
+	assert.True(t, restarted.active())
+
+	now = now.Add(30 * time.Minute)
+	assert.False(t, o.active())
+	assert.False(t, led)
+	assert.Equal(t, time.Duration(0), o.remaining())
+	assert.Equal(t, []string{"trapOverrideStarted", "trapOverrideEnded"}, events.Types())
+	assert.Equal(t, overrideTriggerButton, events.Events()[1].Details["trigger"])
+	assert.NoFileExists(t, o.file)
+
+	var nilOverride *trapOverride
+	assert.False(t, nilOverride.active())
+	assert.Error(t, nilOverride.start(overrideTriggerDBus, time.Minute))
+}
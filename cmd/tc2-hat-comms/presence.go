@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// When a registered technician's phone is seen nearby over BLE the device goes into
+// maintenance mode for the service visit: the trap is forced safe with the override LED on,
+// the RPi is kept on and tc2-hat-comms logs at debug level. It goes back to normal once the
+// phone hasn't been seen for the absent timeout.
+//
+//	[maintenance-presence]
+//	addresses = ["5C:F3:70:12:34:56"]
+//	irks = ["ec0234a357c8ad05341010a60a397d9b"]
+//	min-rssi = -80
+//	scan-interval = "30s"
+//	absent-timeout = "5m"
+//	stay-on = "30m"
+//	max-duration = "4h"
+//
+// Phones mostly use a random address that changes every few minutes, so they are matched by
+// their identity resolving key (IRK), most significant byte first as in the Bluetooth core
+// spec. Addresses are for devices that keep a fixed address. Sightings weaker than min-rssi
+// are ignored so a phone going past on the road doesn't disarm the trap. The override is
+// started for max-duration so the trap re-arms even if the phone is never seen leaving.
+const (
+	presenceConfigKey       = "maintenance-presence"
+	defaultPresenceMinRSSI  = -80
+	defaultScanInterval     = 30 * time.Second
+	defaultAbsentTimeout    = 5 * time.Minute
+	defaultPresenceStayOn   = 30 * time.Minute
+	defaultMaintenanceLimit = 4 * time.Hour
+	bleScanTimeout          = 30 * time.Second
+
+	maintenanceLogLevel = "debug"
+)
+
+// presenceConfig is read from the "maintenance-presence" section of the config.
+type presenceConfig struct {
+	Addresses     []string      `mapstructure:"addresses"`
+	IRKs          []string      `mapstructure:"irks"`
+	MinRSSI       int           `mapstructure:"min-rssi"`
+	ScanInterval  time.Duration `mapstructure:"scan-interval"`
+	AbsentTimeout time.Duration `mapstructure:"absent-timeout"`
+	StayOn        time.Duration `mapstructure:"stay-on"`
+	MaxDuration   time.Duration `mapstructure:"max-duration"`
+}
+
+func loadPresenceConfig(conf *goconfig.Config) (presenceConfig, error) {
+	c := presenceConfig{
+		MinRSSI:       defaultPresenceMinRSSI,
+		ScanInterval:  defaultScanInterval,
+		AbsentTimeout: defaultAbsentTimeout,
+		StayOn:        defaultPresenceStayOn,
+		MaxDuration:   defaultMaintenanceLimit,
+	}
+	if err := configcompat.Unmarshal(conf, presenceConfigKey, &c); err != nil {
+		return c, err
+	}
+	for _, a := range c.Addresses {
+		if _, err := net.ParseMAC(a); err != nil {
+			return c, fmt.Errorf("invalid %s address '%s': %v", presenceConfigKey, a, err)
+		}
+	}
+	for _, k := range c.IRKs {
+		if _, err := parseIRK(k); err != nil {
+			return c, fmt.Errorf("invalid %s irk: %v", presenceConfigKey, err)
+		}
+	}
+	if c.ScanInterval <= 0 || c.AbsentTimeout <= 0 || c.StayOn < time.Minute || c.MaxDuration <= 0 {
+		return c, fmt.Errorf("%s scan-interval, absent-timeout and max-duration must be positive and stay-on at least a minute", presenceConfigKey)
+	}
+	return c, nil
+}
+
+func (c presenceConfig) enabled() bool {
+	return len(c.Addresses) > 0 || len(c.IRKs) > 0
+}
+
+func parseIRK(s string) ([]byte, error) {
+	irk, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(irk) != 16 {
+		return nil, fmt.Errorf("IRK '%s' isn't 16 bytes", s)
+	}
+	return irk, nil
+}
+
+// bleSighting is a device seen in a BLE scan.
+type bleSighting struct {
+	Address string // Most significant byte first, as printed.
+	Random  bool
+	RSSI    int
+}
+
+// resolvesWithIRK returns true if the address is a resolvable private address made with the
+// IRK, that is the hash in its low 3 bytes is ah(irk, prand) with prand its high 3 bytes.
+func resolvesWithIRK(address string, irk []byte) bool {
+	a, err := net.ParseMAC(address)
+	if err != nil || len(a) != 6 || a[0]>>6 != 0b01 {
+		return false
+	}
+	block, err := aes.NewCipher(irk)
+	if err != nil {
+		return false
+	}
+	r := make([]byte, aes.BlockSize)
+	copy(r[13:], a[:3])
+	block.Encrypt(r, r)
+	return r[13] == a[3] && r[14] == a[4] && r[15] == a[5]
+}
+
+// technicianMatcher finds a technician's phone in the sightings.
+type technicianMatcher struct {
+	addresses []net.HardwareAddr
+	irks      [][]byte
+	names     []string // Of the IRKs, for reporting which technician it was.
+	minRSSI   int
+}
+
+func newTechnicianMatcher(c presenceConfig) *technicianMatcher {
+	m := &technicianMatcher{minRSSI: c.MinRSSI}
+	for _, a := range c.Addresses {
+		addr, _ := net.ParseMAC(a)
+		m.addresses = append(m.addresses, addr)
+	}
+	for _, k := range c.IRKs {
+		irk, _ := parseIRK(k)
+		m.irks = append(m.irks, irk)
+		m.names = append(m.names, "irk:"+k[:8])
+	}
+	return m
+}
+
+// match returns the technician of the strongest sighting of a technician's phone.
+func (m *technicianMatcher) match(sightings []bleSighting) (technician string, rssi int, ok bool) {
+	for _, s := range sightings {
+		if s.RSSI < m.minRSSI || (ok && s.RSSI <= rssi) {
+			continue
+		}
+		if name, found := m.technician(s); found {
+			technician, rssi, ok = name, s.RSSI, true
+		}
+	}
+	return technician, rssi, ok
+}
+
+func (m *technicianMatcher) technician(s bleSighting) (string, bool) {
+	addr, err := net.ParseMAC(s.Address)
+	if err != nil {
+		return "", false
+	}
+	for _, a := range m.addresses {
+		if a.String() == addr.String() {
+			return strings.ToUpper(a.String()), true
+		}
+	}
+	if !s.Random {
+		return "", false
+	}
+	for i, irk := range m.irks {
+		if resolvesWithIRK(s.Address, irk) {
+			return m.names[i], true
+		}
+	}
+	return "", false
+}
+
+var btmgmtDeviceFound = regexp.MustCompile(`dev_found: ([0-9A-Fa-f:]{17}) type (LE Public|LE Random|BR/EDR) rssi (-?\d+)`)
+
+// parseBtmgmtFind returns the devices found in the output of btmgmt find.
+func parseBtmgmtFind(output string) []bleSighting {
+	sightings := []bleSighting{}
+	for _, line := range strings.Split(output, "\n") {
+		m := btmgmtDeviceFound.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		rssi, err := strconv.Atoi(m[3])
+		if err != nil {
+			continue
+		}
+		sightings = append(sightings, bleSighting{Address: strings.ToUpper(m[1]), Random: m[2] == "LE Random", RSSI: rssi})
+	}
+	return sightings
+}
+
+// scanBLE runs an LE discovery with btmgmt.
+func scanBLE() ([]bleSighting, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bleScanTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "btmgmt", "find", "-l").CombinedOutput()
+	if err != nil && ctx.Err() == nil {
+		return nil, fmt.Errorf("btmgmt find failed: %v, output: %s", err, out)
+	}
+	return parseBtmgmtFind(string(out)), nil
+}
+
+// maintenancePresence puts the device in maintenance mode while a technician is nearby.
+type maintenancePresence struct {
+	config      presenceConfig
+	matcher     *technicianMatcher
+	override    *trapOverride
+	logLevel    string // Restored when maintenance mode ends.
+	now         func() time.Time
+	scan        func() ([]bleSighting, error)
+	stayOn      func(minutes int) error
+	setLogLevel func(level string)
+
+	mu         sync.Mutex
+	technician string // Empty when not in maintenance mode.
+	since      time.Time
+	lastSeen   time.Time
+	lastRSSI   int
+	lastStayOn time.Time
+}
+
+func newMaintenancePresence(c presenceConfig, override *trapOverride, logLevel string) *maintenancePresence {
+	return &maintenancePresence{
+		config:      c,
+		matcher:     newTechnicianMatcher(c),
+		override:    override,
+		logLevel:    logLevel,
+		now:         time.Now,
+		scan:        scanBLE,
+		stayOn:      attinyStayOnFor,
+		setLogLevel: func(level string) { log = logging.NewLogger(level) },
+	}
+}
+
+// startMaintenancePresence starts scanning for the technicians' phones, if there are any.
+func startMaintenancePresence(c presenceConfig, override *trapOverride, logLevel string) {
+	if !c.enabled() {
+		return
+	}
+	p := newMaintenancePresence(c, override, logLevel)
+	log.Infof("Scanning for %d technician phones every %s", len(c.Addresses)+len(c.IRKs), c.ScanInterval)
+	go func() {
+		for {
+			p.check()
+			time.Sleep(c.ScanInterval)
+		}
+	}()
+}
+
+// check scans for the technicians' phones, entering or leaving maintenance mode.
+func (p *maintenancePresence) check() {
+	sightings, err := p.scan()
+	if err != nil {
+		// Treated as not seen, so a broken scan can't keep the trap safe.
+		log.Errorf("Failed to scan for technician phones: %v", err)
+	}
+	technician, rssi, seen := p.matcher.match(sightings)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if seen {
+		p.lastSeen = now
+		p.lastRSSI = rssi
+		if p.technician == "" {
+			p.enter(technician, rssi, now)
+		} else if now.Sub(p.lastStayOn) >= p.config.StayOn/2 {
+			p.keepOn(now)
+		}
+		return
+	}
+	if p.technician != "" && now.Sub(p.lastSeen) >= p.config.AbsentTimeout {
+		p.leave(now)
+	}
+}
+
+// active returns true while in maintenance mode.
+func (p *maintenancePresence) active() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.technician != ""
+}
+
+func (p *maintenancePresence) enter(technician string, rssi int, now time.Time) {
+	log.Infof("Technician %s is nearby (RSSI %d), entering maintenance mode", technician, rssi)
+	p.technician = technician
+	p.since = now
+	if err := p.override.start(overrideTriggerPresence, p.config.MaxDuration); err != nil {
+		log.Errorf("Failed to force trap safe for maintenance: %v", err)
+	}
+	p.keepOn(now)
+	p.setLogLevel(maintenanceLogLevel)
+	p.report(eventhelper.MaintenanceModeStarted, now, eventhelper.MaintenancePresence{
+		Technician: technician,
+		RSSI:       rssi,
+	})
+}
+
+func (p *maintenancePresence) keepOn(now time.Time) {
+	p.lastStayOn = now
+	if err := p.stayOn(int(p.config.StayOn.Minutes())); err != nil {
+		log.Errorf("Failed to keep the RPi on for maintenance: %v", err)
+	}
+}
+
+func (p *maintenancePresence) leave(now time.Time) {
+	p.setLogLevel(p.logLevel)
+	log.Infof("Technician %s has left, ending maintenance mode", p.technician)
+	p.override.stop(overrideTriggerPresence)
+	p.report(eventhelper.MaintenanceModeEnded, now, eventhelper.MaintenancePresence{
+		Technician:      p.technician,
+		RSSI:            p.lastRSSI,
+		DurationSeconds: int64(now.Sub(p.since).Seconds()),
+	})
+	p.technician = ""
+}
+
+func (p *maintenancePresence) report(eventType string, now time.Time, payload interface{}) {
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventType, now, payload)); err != nil {
+		log.Errorf("Failed to add %s event: %v", eventType, err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// Sample data for the ah function from the Bluetooth core spec.
+const (
+	testIRK        = "ec0234a357c8ad05341010a60a397d9b"
+	testResolvable = "70:81:94:0D:FB:AA"
+)
+
+func TestResolvesWithIRK(t *testing.T) {
+	irk, err := parseIRK(testIRK)
+	assert.NoError(t, err)
+	assert.True(t, resolvesWithIRK(testResolvable, irk))
+	assert.False(t, resolvesWithIRK("70:81:94:0D:FB:AB", irk))
+	// Not a resolvable private address.
+	assert.False(t, resolvesWithIRK("F0:81:94:0D:FB:AA", irk))
+
+	_, err = parseIRK("ec0234a357c8ad05")
+	assert.Error(t, err)
+}
+
+func TestParseBtmgmtFind(t *testing.T) {
+	output := `Discovery started
+hci0 type 6 discovering on
+hci0 dev_found: 70:81:94:0D:FB:AA type LE Random rssi -62 flags 0x0004
+AD flags 0x1a
+hci0 dev_found: 5c:f3:70:12:34:56 type LE Public rssi -90 flags 0x0000
+hci0 type 6 discovering off
+`
+	assert.Equal(t, []bleSighting{
+		{Address: "70:81:94:0D:FB:AA", Random: true, RSSI: -62},
+		{Address: "5C:F3:70:12:34:56", Random: false, RSSI: -90},
+	}, parseBtmgmtFind(output))
+}
+
+func TestTechnicianMatcher(t *testing.T) {
+	m := newTechnicianMatcher(presenceConfig{
+		Addresses: []string{"5c:f3:70:12:34:56"},
+		IRKs:      []string{testIRK},
+		MinRSSI:   -80,
+	})
+	technician, rssi, ok := m.match([]bleSighting{
+		{Address: "5C:F3:70:12:34:56", RSSI: -70},
+		{Address: testResolvable, Random: true, RSSI: -60},
+		{Address: "11:22:33:44:55:66", RSSI: -40},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "irk:ec0234a3", technician)
+	assert.Equal(t, -60, rssi)
+
+	technician, _, ok = m.match([]bleSighting{{Address: "5C:F3:70:12:34:56", RSSI: -70}})
+	assert.True(t, ok)
+	assert.Equal(t, "5C:F3:70:12:34:56", technician)
+
+	// Too far away.
+	_, _, ok = m.match([]bleSighting{{Address: "5C:F3:70:12:34:56", RSSI: -85}})
+	assert.False(t, ok)
+}
+
+func TestMaintenancePresence(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	led := false
+	o := newTestTrapOverride(t, &now, &led)
+
+	c := presenceConfig{
+		Addresses:     []string{"5C:F3:70:12:34:56"},
+		MinRSSI:       -80,
+		ScanInterval:  30 * time.Second,
+		AbsentTimeout: 5 * time.Minute,
+		StayOn:        30 * time.Minute,
+		MaxDuration:   4 * time.Hour,
+	}
+	sightings := []bleSighting{}
+	stayOn := []int{}
+	level := "info"
+	p := newMaintenancePresence(c, o, "info")
+	p.now = func() time.Time { return now }
+	p.scan = func() ([]bleSighting, error) { return sightings, nil }
+	p.stayOn = func(minutes int) error {
+		stayOn = append(stayOn, minutes)
+		return nil
+	}
+	p.setLogLevel = func(l string) { level = l }
+
+	p.check()
+	assert.False(t, p.active())
+	assert.False(t, o.active())
+
+	sightings = []bleSighting{{Address: "5C:F3:70:12:34:56", RSSI: -65}}
+	p.check()
+	assert.True(t, p.active())
+	assert.True(t, o.active())
+	assert.True(t, led)
+	assert.Equal(t, []int{30}, stayOn)
+	assert.Equal(t, "debug", level)
+	assert.Equal(t, []string{"trapOverrideStarted", eventhelper.MaintenanceModeStarted}, events.Types())
+
+	// The stay on is extended while the technician is still there.
+	now = now.Add(20 * time.Minute)
+	p.check()
+	assert.Equal(t, []int{30, 30}, stayOn)
+
+	// Not gone until they haven't been seen for the absent timeout.
+	sightings = nil
+	now = now.Add(4 * time.Minute)
+	p.check()
+	assert.True(t, p.active())
+	now = now.Add(time.Minute)
+	p.check()
+	assert.False(t, p.active())
+	assert.False(t, o.active())
+	assert.False(t, led)
+	assert.Equal(t, "info", level)
+	assert.Equal(t, []string{"trapOverrideStarted", eventhelper.MaintenanceModeStarted, "trapOverrideEnded", eventhelper.MaintenanceModeEnded}, events.Types())
+	assert.Equal(t, int64(25*60), events.Events()[3].Details["durationSeconds"])
+
+	// An override from the button isn't ended when the technician leaves.
+	sightings = []bleSighting{{Address: "5C:F3:70:12:34:56", RSSI: -65}}
+	p.check()
+	assert.NoError(t, o.start(overrideTriggerButton, time.Hour))
+	sightings = nil
+	now = now.Add(5 * time.Minute)
+	p.check()
+	assert.False(t, p.active())
+	assert.True(t, o.active())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+)
+
+// Sightings of protected species keep the traps off, they are also the sightings conservation
+// teams most want from the devices, so each one is reported with a protectedSpeciesSighted
+// event with the species, the confidence and what was done with the traps:
+//   - trapDeactivated, a trap was active and has been deactivated.
+//   - trapKeptOff, no traps were active and they are kept off for the protect duration.
+//
+// The sightings of each species are counted in protectedSightingsFile, so the counts last
+// across restarts. They are available from the GetProtectedSightings D-Bus method.
+const (
+	protectedSightingsFile = "/etc/cacophony/protected-sightings.json"
+
+	protectActionDeactivated = "trapDeactivated"
+	protectActionKeptOff     = "trapKeptOff"
+)
+
+// speciesSightings are the sightings counted for a protected species.
+type speciesSightings struct {
+	Count         int       `json:"count"`
+	LastSighted   time.Time `json:"lastSighted"`
+	MaxConfidence int32     `json:"maxConfidence"`
+}
+
+type protectedSightings struct {
+	file string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	species map[string]speciesSightings
+}
+
+// protectedSightingsCounter counts the sightings of protected species for tc2-hat-comms.
+var protectedSightingsCounter *protectedSightings
+
+// loadProtectedSightings loads the counts from the file, a missing file has no sightings.
+func loadProtectedSightings(file string) (*protectedSightings, error) {
+	p := &protectedSightings{
+		file:    file,
+		now:     time.Now,
+		species: map[string]speciesSightings{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p.species); err != nil {
+		p.species = map[string]speciesSightings{}
+		return p, fmt.Errorf("failed to parse protected sightings '%s': %v", file, err)
+	}
+	return p, nil
+}
+
+func (p *protectedSightings) save() error {
+	data, err := json.MarshalIndent(p.species, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := p.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, p.file)
+}
+
+// sighted counts the sighting of each protected species in the classification and reports
+// it with the action taken.
+func (p *protectedSightings) sighted(classification, protectSpecies tracks.Species, action string) {
+	if p == nil {
+		return
+	}
+	now := p.now()
+	names := make([]string, 0, len(classification))
+	for name, confidence := range classification {
+		if required, ok := protectSpecies[name]; ok && confidence >= required {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.record(name, classification[name], action, now)
+	}
+}
+
+// record counts a sighting of the species and makes the protectedSpeciesSighted event.
+func (p *protectedSightings) record(species string, confidence int32, action string, now time.Time) {
+	if p == nil {
+		return
+	}
+	log.Infof("Protected species '%s' sighted with confidence %d, %s", species, confidence, action)
+	p.mu.Lock()
+	s := p.species[species]
+	s.Count++
+	s.LastSighted = now
+	s.MaxConfidence = max(s.MaxConfidence, confidence)
+	p.species[species] = s
+	if err := p.save(); err != nil {
+		log.Errorf("Failed to save protected sightings: %v", err)
+	}
+	p.mu.Unlock()
+
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ProtectedSpeciesSighted, now, eventhelper.ProtectedSighting{
+		Species:    species,
+		Confidence: confidence,
+		Action:     action,
+		Count:      s.Count,
+	})); err != nil {
+		log.Errorf("Failed to add protectedSpeciesSighted event: %v", err)
+	}
+}
+
+// counts returns the sightings of each protected species.
+func (p *protectedSightings) counts() map[string]speciesSightings {
+	counts := map[string]speciesSightings{}
+	if p == nil {
+		return counts
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, s := range p.species {
+		counts[name] = s
+	}
+	return counts
+}
+
+// protectAction returns what a protected species sighting does to the trap channels.
+func protectAction(channels []*trapChannel) string {
+	for _, c := range channels {
+		if c.active {
+			return protectActionDeactivated
+		}
+	}
+	return protectActionKeptOff
+}
+
+// injectedSighting returns the species and confidence of an injected protect event, from its
+// "species" and "confidence" details, or the event type if it has no species.
+func injectedSighting(e injectedEvent) (string, int32) {
+	species, ok := e.Details["species"].(string)
+	if !ok || species == "" {
+		species = e.Type
+	}
+	// JSON numbers are unmarshalled as float64.
+	confidence, _ := e.Details["confidence"].(float64)
+	return species, int32(confidence)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtectedSightings(t *testing.T) {
+	file := t.TempDir() + "/protected-sightings.json"
+	p, err := loadProtectedSightings(file)
+	assert.NoError(t, err)
+	now := time.Date(2026, 5, 1, 22, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	events := eventtest.Capture(t)
+	protect := tracks.Species{"kiwi": 60, "weka": 70}
+
+	p.sighted(tracks.Species{"kiwi": 85, "weka": 50}, protect, protectActionDeactivated)
+	p.sighted(tracks.Species{"kiwi": 70}, protect, protectActionKeptOff)
+	p.sighted(tracks.Species{"weka": 90, "kiwi": 65}, protect, protectActionKeptOff)
+
+	assert.Len(t, events.Events(), 4)
+	assert.Equal(t, "protectedSpeciesSighted", events.Events()[0].Type)
+	assert.Equal(t, map[string]interface{}{
+		"species":    "kiwi",
+		"confidence": int32(85),
+		"action":     protectActionDeactivated,
+		"count":      1,
+	}, events.Events()[0].Details)
+	assert.Equal(t, "kiwi", events.Events()[2].Details["species"])
+	assert.Equal(t, "weka", events.Events()[3].Details["species"])
+
+	// The counts are kept across restarts.
+	p, err = loadProtectedSightings(file)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]speciesSightings{
+		"kiwi": {Count: 3, LastSighted: now, MaxConfidence: 85},
+		"weka": {Count: 1, LastSighted: now, MaxConfidence: 90},
+	}, p.counts())
+
+	// A nil counter is ignored.
+	var nilCounter *protectedSightings
+	nilCounter.sighted(tracks.Species{"kiwi": 90}, protect, protectActionKeptOff)
+	assert.Empty(t, nilCounter.counts())
+}
+
+func TestProtectAction(t *testing.T) {
+	channels := []*trapChannel{{name: mainChannel}, {name: "buzzer"}}
+	assert.Equal(t, protectActionKeptOff, protectAction(channels))
+	channels[1].active = true
+	assert.Equal(t, protectActionDeactivated, protectAction(channels))
+}
+
+func TestInjectedSighting(t *testing.T) {
+	species, confidence := injectedSighting(injectedEvent{Type: "predatorCall", Details: map[string]interface{}{"species": "kiwi", "confidence": 75.0}})
+	assert.Equal(t, "kiwi", species)
+	assert.Equal(t, int32(75), confidence)
+
+	species, confidence = injectedSighting(injectedEvent{Type: "kiwiCall", Details: map[string]interface{}{"protect": true}})
+	assert.Equal(t, "kiwiCall", species)
+	assert.Equal(t, int32(0), confidence)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// A dry-contact relay board driven by an I2C GPIO expander can be used for the trap channels,
+// so several relays can be driven without using the RPi GPIO header. The relays are named
+// and a trap channel uses one with a relay: target, see routing.go:
+//
+//	[relay-board]
+//	type = "mcp23017"
+//	address = 0x20
+//	relays = ["gate=0", "siren=1", "light=8"]
+//	active-low = true
+//	check-interval = "30s"
+//
+//	[trap-routing]
+//	channels = ["gate=relay:gate", "siren=relay:siren"]
+//
+// The type is mcp23017, with relays on bits 0 to 15 (GPA0 is 0 and GPB0 is 8), or pcf8574,
+// with relays on bits 0 to 7. Most relay boards switch on when their input is low, so
+// active-low is set for them. After each write, and every check-interval, the outputs are
+// read back from the expander. If it stops acknowledging a relayBoardFault event is made, the
+// state the relays should be in is kept and written again, with the expander set up again as
+// it has likely been power cycled, when it is back, with a relayBoardRecovered event. If an
+// output reads back wrong it is written again. The state of the relays can be read with
+// GetRelays on D-Bus.
+const (
+	relayBoardConfigKey  = "relay-board"
+	relayTargetPrefix    = "relay:"
+	expanderMCP23017     = "mcp23017"
+	expanderPCF8574      = "pcf8574"
+	relayI2CTimeout      = 1000 // ms
+	defaultRelayInterval = 30 * time.Second
+
+	// MCP23017 registers, with the default IOCON.BANK = 0 so A and B are next to each other.
+	mcp23017IODIRA = 0x00
+	mcp23017GPIOA  = 0x12
+	mcp23017OLATA  = 0x14
+)
+
+// relayBoardConfig is read from the "relay-board" section of the config.
+type relayBoardConfig struct {
+	Type          string        `mapstructure:"type"`
+	Address       int           `mapstructure:"address"`
+	Relays        []string      `mapstructure:"relays"`
+	ActiveLow     bool          `mapstructure:"active-low"`
+	CheckInterval time.Duration `mapstructure:"check-interval"`
+}
+
+func loadRelayBoardConfig(conf *goconfig.Config) (relayBoardConfig, error) {
+	c := relayBoardConfig{CheckInterval: defaultRelayInterval}
+	if err := configcompat.Unmarshal(conf, relayBoardConfigKey, &c); err != nil {
+		return c, err
+	}
+	_, err := c.relayBits()
+	return c, err
+}
+
+// enabled returns true if there is a relay board in the config.
+func (c relayBoardConfig) enabled() bool {
+	return c.Type != ""
+}
+
+// relayBits returns the bit each relay is on, checking the config is valid.
+func (c relayBoardConfig) relayBits() (map[string]int, error) {
+	bits := map[string]int{}
+	if !c.enabled() {
+		return bits, nil
+	}
+	width := 0
+	switch c.Type {
+	case expanderMCP23017:
+		width = 16
+	case expanderPCF8574:
+		width = 8
+	default:
+		return nil, fmt.Errorf("%s type should be %s or %s, not '%s'", relayBoardConfigKey, expanderMCP23017, expanderPCF8574, c.Type)
+	}
+	if c.Address <= 0 || c.Address > 0x7F {
+		return nil, fmt.Errorf("%s address 0x%X isn't a 7 bit I2C address", relayBoardConfigKey, c.Address)
+	}
+	if c.CheckInterval <= 0 {
+		return nil, fmt.Errorf("%s check-interval must be positive", relayBoardConfigKey)
+	}
+	used := map[int]string{}
+	for _, relay := range c.Relays {
+		name, bitStr, ok := strings.Cut(relay, "=")
+		name = strings.TrimSpace(name)
+		bit, err := strconv.Atoi(strings.TrimSpace(bitStr))
+		if !ok || name == "" || err != nil || bit < 0 || bit >= width {
+			return nil, fmt.Errorf("%s relay '%s' should be name=bit, with the bit from 0 to %d", relayBoardConfigKey, relay, width-1)
+		}
+		if _, ok := bits[name]; ok {
+			return nil, fmt.Errorf("%s relay '%s' is named more than once", relayBoardConfigKey, name)
+		}
+		if other, ok := used[bit]; ok {
+			return nil, fmt.Errorf("%s relays '%s' and '%s' are on the same bit", relayBoardConfigKey, other, name)
+		}
+		bits[name] = bit
+		used[bit] = name
+	}
+	if len(bits) == 0 {
+		return nil, fmt.Errorf("%s has no relays", relayBoardConfigKey)
+	}
+	return bits, nil
+}
+
+// relayStatus is the state of a relay returned by GetRelays.
+type relayStatus struct {
+	Name   string `json:"name"`
+	Bit    int    `json:"bit"`
+	On     bool   `json:"on"`
+	ReadOn *bool  `json:"readOn,omitempty"` // From the last read back, nil if it couldn't be read.
+}
+
+// relayBoardStatus is the state of the relay board returned by GetRelays.
+type relayBoardStatus struct {
+	Type       string        `json:"type"`
+	Address    int           `json:"address"`
+	Faulty     bool          `json:"faulty"`
+	FaultSince time.Time     `json:"faultSince,omitempty"`
+	LastError  string        `json:"lastError,omitempty"`
+	Relays     []relayStatus `json:"relays"`
+}
+
+// relayBoard drives the relays on the expander.
+type relayBoard struct {
+	config relayBoardConfig
+	bits   map[string]int
+	tx     func(write []byte, readLen int) ([]byte, error)
+	now    func() time.Time
+
+	mu          sync.Mutex
+	wanted      uint16 // Relays that should be on.
+	read        uint16 // Relays that were on when last read back.
+	readOK      bool
+	initialised bool
+	faultSince  time.Time // Zero unless the expander has stopped acknowledging.
+	lastErr     error
+}
+
+var relayBoardController *relayBoard
+
+func newRelayBoard(c relayBoardConfig) (*relayBoard, error) {
+	bits, err := c.relayBits()
+	if err != nil {
+		return nil, err
+	}
+	return &relayBoard{
+		config: c,
+		bits:   bits,
+		tx: func(write []byte, readLen int) ([]byte, error) {
+			return i2crequest.Tx(byte(c.Address), write, readLen, relayI2CTimeout)
+		},
+		now: time.Now,
+	}, nil
+}
+
+// openRelayBoard sets up the expander with all the relays off and starts checking it.
+// Returns nil if there is no relay board in the config.
+func openRelayBoard(c relayBoardConfig) (*relayBoard, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	b, err := newRelayBoard(c)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	err = b.sync()
+	b.mu.Unlock()
+	if err != nil {
+		// Carry on, the relays will be set when it is back.
+		log.Errorf("Failed to set up %s relay board at 0x%X: %v", c.Type, c.Address, err)
+	} else {
+		log.Infof("Relay board %s at 0x%X with relays %v", c.Type, c.Address, c.Relays)
+	}
+	go b.checkLoop()
+	relayBoardController = b
+	return b, nil
+}
+
+// pin returns the output for the relay.
+func (b *relayBoard) pin(name string) (*relayPin, bool) {
+	if b == nil {
+		return nil, false
+	}
+	bit, ok := b.bits[name]
+	if !ok {
+		return nil, false
+	}
+	return &relayPin{board: b, bit: bit}, true
+}
+
+// relayPin is the output for one relay, used in place of a GPIO pin for a trap channel.
+type relayPin struct {
+	board *relayBoard
+	bit   int
+}
+
+// Out switches the relay on for gpio.High. If the expander isn't acknowledging the state is
+// kept and written when it is back, so the trap channel carries on with the relay board faulty.
+func (p *relayPin) Out(level gpio.Level) error {
+	b := p.board
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if level == gpio.High {
+		b.wanted |= 1 << p.bit
+	} else {
+		b.wanted &^= 1 << p.bit
+	}
+	if err := b.sync(); err != nil {
+		log.Errorf("Failed to set relay: %v", err)
+	}
+	return nil
+}
+
+// port returns the value to write for the wanted relays, with the bits that aren't relays
+// left high on a PCF8574 so they stay as inputs.
+func (b *relayBoard) port() uint16 {
+	relays := b.relayMask()
+	value := b.wanted
+	if b.config.ActiveLow {
+		value = ^value
+	}
+	value &= relays
+	if b.config.Type == expanderPCF8574 {
+		value |= ^relays & 0xFF
+	}
+	return value
+}
+
+// relayMask returns the bits with relays on them.
+func (b *relayBoard) relayMask() uint16 {
+	mask := uint16(0)
+	for _, bit := range b.bits {
+		mask |= 1 << bit
+	}
+	return mask
+}
+
+// sync sets up the expander if it needs it, writes the wanted relay states and reads them
+// back. Returns an error if the expander didn't acknowledge or the relays read back wrong.
+func (b *relayBoard) sync() error {
+	err := b.writeRelays()
+	if err == nil {
+		_, err = b.readRelays()
+	}
+	b.recordBus(err)
+	if err != nil {
+		return err
+	}
+	if b.read != b.wanted {
+		b.lastErr = fmt.Errorf("relays read back as %016b, should be %016b", b.read, b.wanted)
+		return b.lastErr
+	}
+	return nil
+}
+
+// writeRelays writes the wanted relay states, setting up the expander first if it needs it.
+func (b *relayBoard) writeRelays() error {
+	port := b.port()
+	if b.config.Type == expanderPCF8574 {
+		_, err := b.tx([]byte{byte(port)}, 0)
+		return err
+	}
+	if !b.initialised {
+		// Only the relay bits are outputs.
+		iodir := ^b.relayMask()
+		if _, err := b.tx([]byte{mcp23017IODIRA, byte(iodir), byte(iodir >> 8)}, 0); err != nil {
+			return err
+		}
+		b.initialised = true
+	}
+	_, err := b.tx([]byte{mcp23017OLATA, byte(port), byte(port >> 8)}, 0)
+	return err
+}
+
+// readRelays reads which relays are on from the pins of the expander.
+func (b *relayBoard) readRelays() (uint16, error) {
+	var data []byte
+	var err error
+	if b.config.Type == expanderMCP23017 {
+		data, err = b.tx([]byte{mcp23017GPIOA}, 2)
+	} else {
+		data, err = b.tx(nil, 1)
+	}
+	if err == nil && len(data) == 0 {
+		err = fmt.Errorf("no data read from the relay board")
+	}
+	if err != nil {
+		b.readOK = false
+		return 0, err
+	}
+	value := uint16(data[0])
+	if len(data) > 1 {
+		value |= uint16(data[1]) << 8
+	}
+	if b.config.ActiveLow {
+		value = ^value
+	}
+	b.read = value & b.relayMask()
+	b.readOK = true
+	return b.read, nil
+}
+
+// recordBus reports the expander stopping or starting to acknowledge.
+func (b *relayBoard) recordBus(err error) {
+	b.lastErr = err
+	now := time.Now()
+	switch {
+	case err != nil && b.faultSince.IsZero():
+		b.faultSince = now
+		// It has likely been power cycled by the time it is back.
+		b.initialised = false
+		log.Errorf("Relay board at 0x%X has stopped acknowledging: %v", b.config.Address, err)
+		b.report(eventhelper.RelayBoardFault, eventhelper.RelayBoardStatus{Error: err.Error()}, now)
+	case err == nil && !b.faultSince.IsZero():
+		log.Infof("Relay board at 0x%X is back after %s", b.config.Address, now.Sub(b.faultSince).Round(time.Second))
+		b.report(eventhelper.RelayBoardRecovered, eventhelper.RelayBoardStatus{
+			FaultSeconds: int(now.Sub(b.faultSince).Seconds()),
+		}, now)
+		b.faultSince = time.Time{}
+	}
+}
+
+func (b *relayBoard) report(eventType string, payload eventhelper.RelayBoardStatus, now time.Time) {
+	payload.Type = b.config.Type
+	payload.Address = b.config.Address
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventType, now, payload)); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+}
+
+// check reads the relays back, writing them again if they are wrong or the expander is back.
+func (b *relayBoard) check() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	read, err := b.readRelays()
+	if err != nil {
+		b.recordBus(err)
+		return
+	}
+	if read == b.wanted && b.faultSince.IsZero() {
+		b.lastErr = nil
+		return
+	}
+	if read != b.wanted {
+		log.Errorf("Relays read back as %016b, should be %016b, writing them again", read, b.wanted)
+	}
+	if err := b.sync(); err != nil {
+		log.Errorf("Failed to set relays: %v", err)
+	}
+}
+
+func (b *relayBoard) checkLoop() {
+	for {
+		time.Sleep(b.config.CheckInterval)
+		b.check()
+	}
+}
+
+// status returns the state of the relay board.
+func (b *relayBoard) status() relayBoardStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := relayBoardStatus{
+		Type:       b.config.Type,
+		Address:    b.config.Address,
+		Faulty:     !b.faultSince.IsZero(),
+		FaultSince: b.faultSince,
+		Relays:     []relayStatus{},
+	}
+	if b.lastErr != nil {
+		s.LastError = b.lastErr.Error()
+	}
+	for name, bit := range b.bits {
+		r := relayStatus{Name: name, Bit: bit, On: b.wanted&(1<<bit) != 0}
+		if b.readOK {
+			readOn := b.read&(1<<bit) != 0
+			r.ReadOn = &readOn
+		}
+		s.Relays = append(s.Relays, r)
+	}
+	sort.Slice(s.Relays, func(i, j int) bool { return s.Relays[i].Bit < s.Relays[j].Bit })
+	return s
+}
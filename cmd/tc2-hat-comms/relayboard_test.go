@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// fakeExpander records the writes and returns the pins as written, unless it is down.
+type fakeExpander struct {
+	writes [][]byte
+	pins   []byte
+	down   bool
+}
+
+func (e *fakeExpander) tx(write []byte, readLen int) ([]byte, error) {
+	if e.down {
+		return nil, errors.New("no ack")
+	}
+	if readLen == 0 {
+		e.writes = append(e.writes, append([]byte{}, write...))
+		if len(write) == 1 {
+			e.pins = []byte{write[0]}
+		} else if write[0] == mcp23017OLATA {
+			e.pins = write[1:]
+		}
+		return nil, nil
+	}
+	return e.pins[:readLen], nil
+}
+
+func newTestRelayBoard(t *testing.T, c relayBoardConfig) (*relayBoard, *fakeExpander) {
+	b, err := newRelayBoard(c)
+	assert.NoError(t, err)
+	e := &fakeExpander{}
+	b.tx = e.tx
+	return b, e
+}
+
+func TestRelayBoardConfig(t *testing.T) {
+	c := relayBoardConfig{Type: expanderPCF8574, Address: 0x20, Relays: []string{"gate=0", "siren=7"}, CheckInterval: time.Second}
+	bits, err := c.relayBits()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"gate": 0, "siren": 7}, bits)
+
+	for _, relays := range [][]string{{"gate=8"}, {"gate"}, {"gate=0", "gate=1"}, {"gate=0", "siren=0"}, {}} {
+		c.Relays = relays
+		_, err := c.relayBits()
+		assert.Error(t, err, relays)
+	}
+	c.Relays = []string{"gate=0"}
+	c.Type = "mcp23008"
+	_, err = c.relayBits()
+	assert.Error(t, err)
+}
+
+func TestRelayBoardMCP23017(t *testing.T) {
+	b, e := newTestRelayBoard(t, relayBoardConfig{
+		Type:          expanderMCP23017,
+		Address:       0x20,
+		Relays:        []string{"gate=0", "light=8"},
+		ActiveLow:     true,
+		CheckInterval: time.Second,
+	})
+	pin, ok := b.pin("light")
+	assert.True(t, ok)
+	_, ok = b.pin("siren")
+	assert.False(t, ok)
+
+	assert.NoError(t, pin.Out(gpio.High))
+	assert.Equal(t, [][]byte{
+		{mcp23017IODIRA, 0xFE, 0xFE},
+		{mcp23017OLATA, 0x01, 0x00},
+	}, e.writes)
+	status := b.status()
+	assert.False(t, status.Faulty)
+	assert.Equal(t, "gate", status.Relays[0].Name)
+	assert.False(t, *status.Relays[0].ReadOn)
+	assert.True(t, status.Relays[1].On)
+	assert.True(t, *status.Relays[1].ReadOn)
+}
+
+func TestRelayBoardPCF8574(t *testing.T) {
+	b, e := newTestRelayBoard(t, relayBoardConfig{
+		Type:          expanderPCF8574,
+		Address:       0x20,
+		Relays:        []string{"gate=1"},
+		CheckInterval: time.Second,
+	})
+	pin, _ := b.pin("gate")
+	assert.NoError(t, pin.Out(gpio.High))
+	assert.NoError(t, pin.Out(gpio.Low))
+	// The bits that aren't relays stay high as inputs.
+	assert.Equal(t, [][]byte{{0xFF}, {0xFD}}, e.writes)
+}
+
+func TestRelayBoardFault(t *testing.T) {
+	events := eventtest.Capture(t)
+	b, e := newTestRelayBoard(t, relayBoardConfig{
+		Type:          expanderMCP23017,
+		Address:       0x20,
+		Relays:        []string{"gate=0"},
+		CheckInterval: time.Second,
+	})
+	pin, _ := b.pin("gate")
+	e.down = true
+	assert.NoError(t, pin.Out(gpio.High))
+	assert.True(t, b.status().Faulty)
+	assert.Nil(t, b.status().Relays[0].ReadOn)
+	b.check()
+	assert.Equal(t, []string{"relayBoardFault"}, events.Types())
+
+	// When it is back it is set up again and the relay is switched on.
+	e.down = false
+	e.pins = []byte{0, 0}
+	b.check()
+	assert.Equal(t, [][]byte{
+		{mcp23017IODIRA, 0xFE, 0xFF},
+		{mcp23017OLATA, 0x01, 0x00},
+	}, e.writes)
+	assert.Equal(t, []string{"relayBoardFault", "relayBoardRecovered"}, events.Types())
+	assert.False(t, b.status().Faulty)
+	assert.True(t, *b.status().Relays[0].ReadOn)
+}
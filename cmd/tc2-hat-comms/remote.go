@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/safemode"
+	"github.com/godbus/dbus/v5"
+	"github.com/tarm/serial"
+)
+
+// Remote commands can be sent over the UART by radio modems that can only pass short
+// strings of DTMF characters (0-9, * and #). A command is:
+//
+//	*<token>*<code>[*<arg>]#
+//
+// The token must match comms.remote-command-token and the command must be in
+// comms.remote-commands. Every command received is written to the audit log.
+const (
+	remoteCodeDisarm = "10"
+	remoteCodeArm    = "11"
+	remoteCodeStatus = "20"
+	remoteCodeStayOn = "30"
+
+	remoteMaxLineLength   = 64
+	remoteMaxAuthFailures = 5
+	remoteLockoutDuration = 10 * time.Minute
+	remoteMaxStayOn       = 12 * 60 // minutes
+	remoteAuditLogFile    = "/var/log/tc2-hat-comms-commands.log"
+	trapDisarmedFile      = "/etc/cacophony/trap-disarmed"
+)
+
+// Names of the commands used in the allow-list.
+var remoteCommandNames = map[string]string{
+	remoteCodeDisarm: "disarm",
+	remoteCodeArm:    "arm",
+	remoteCodeStatus: "status",
+	remoteCodeStayOn: "stay-on",
+}
+
+type remoteCommand struct {
+	token string
+	code  string
+	arg   string
+}
+
+// parseRemoteCommand parses a DTMF style command line.
+func parseRemoteCommand(line string) (remoteCommand, error) {
+	line = strings.TrimSpace(line)
+	if len(line) > remoteMaxLineLength {
+		return remoteCommand{}, fmt.Errorf("command too long")
+	}
+	for _, c := range line {
+		if !strings.ContainsRune("0123456789*#", c) {
+			return remoteCommand{}, fmt.Errorf("invalid character in command")
+		}
+	}
+	if !strings.HasPrefix(line, "*") || !strings.HasSuffix(line, "#") {
+		return remoteCommand{}, fmt.Errorf("command should start with '*' and end with '#'")
+	}
+	parts := strings.Split(line[1:len(line)-1], "*")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return remoteCommand{}, fmt.Errorf("invalid command format")
+	}
+	cmd := remoteCommand{token: parts[0], code: parts[1]}
+	if len(parts) == 3 {
+		cmd.arg = parts[2]
+	}
+	return cmd, nil
+}
+
+// remoteCommandHandler checks and runs remote commands.
+type remoteCommandHandler struct {
+	token        string
+	allowed      map[string]bool
+	auditLogFile string
+	disarmedFile string
+	now          func() time.Time
+	stayOn       func(minutes int) error
+
+	mu           sync.Mutex
+	authFailures int
+	lockedUntil  time.Time
+}
+
+func newRemoteCommandHandler(config *CommsConfig) (*remoteCommandHandler, error) {
+	if len(config.RemoteCommandToken) < 4 {
+		return nil, fmt.Errorf("remote command token needs to be at least 4 digits")
+	}
+	allowed := map[string]bool{}
+	for _, name := range config.RemoteCommands {
+		found := false
+		for _, n := range remoteCommandNames {
+			found = found || n == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown remote command '%s'", name)
+		}
+		allowed[name] = true
+	}
+	return &remoteCommandHandler{
+		token:        config.RemoteCommandToken,
+		allowed:      allowed,
+		auditLogFile: remoteAuditLogFile,
+		disarmedFile: trapDisarmedFile,
+		now:          time.Now,
+		stayOn:       attinyStayOnFor,
+	}, nil
+}
+
+// handle runs the command in the line and returns the response to send back.
+func (h *remoteCommandHandler) handle(line string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	cmd, err := parseRemoteCommand(line)
+	name := remoteCommandNames[cmd.code]
+	response := ""
+	switch {
+	case err != nil:
+		response = "*E*00#"
+	case now.Before(h.lockedUntil):
+		err = fmt.Errorf("locked out after too many authentication failures")
+		response = "*E*01#"
+	case subtle.ConstantTimeCompare([]byte(cmd.token), []byte(h.token)) != 1:
+		h.authFailures++
+		if h.authFailures >= remoteMaxAuthFailures {
+			h.lockedUntil = now.Add(remoteLockoutDuration)
+			h.authFailures = 0
+		}
+		err = fmt.Errorf("bad token")
+		response = "*E*01#"
+	case name == "":
+		err = fmt.Errorf("unknown command code '%s'", cmd.code)
+		response = "*E*02#"
+	case !h.allowed[name]:
+		err = fmt.Errorf("command '%s' is not allowed", name)
+		response = "*E*03#"
+	default:
+		h.authFailures = 0
+		var data string
+		data, err = h.run(cmd)
+		if err != nil {
+			response = "*E*04#"
+		} else {
+			response = "*OK*" + cmd.code + data + "#"
+		}
+	}
+	h.audit(now, line, name, err)
+	return response
+}
+
+func (h *remoteCommandHandler) run(cmd remoteCommand) (string, error) {
+	switch cmd.code {
+	case remoteCodeArm:
+		return "", setTrapDisarmed(h.disarmedFile, false)
+	case remoteCodeDisarm:
+		return "", setTrapDisarmed(h.disarmedFile, true)
+	case remoteCodeStatus:
+		return h.status(), nil
+	case remoteCodeStayOn:
+		minutes, err := strconv.Atoi(cmd.arg)
+		if err != nil || minutes <= 0 || minutes > remoteMaxStayOn {
+			return "", fmt.Errorf("invalid stay on minutes '%s'", cmd.arg)
+		}
+		return "", h.stayOn(minutes)
+	}
+	return "", fmt.Errorf("unhandled command code '%s'", cmd.code)
+}
+
+// status returns a short status dump as DTMF characters: armed (0/1), safe mode (0/1)
+// and the device time as YYMMDDhhmm.
+func (h *remoteCommandHandler) status() string {
+	armed := "1"
+	if trapDisarmed(h.disarmedFile) {
+		armed = "0"
+	}
+	safeMode := "0"
+	if safemode.Active() {
+		safeMode = "1"
+	}
+	return "*" + armed + "*" + safeMode + "*" + h.now().Format("0601021504")
+}
+
+// audit records every command received, including rejected ones. The token is not logged.
+func (h *remoteCommandHandler) audit(now time.Time, line, name string, err error) {
+	cmd, parseErr := parseRemoteCommand(line)
+	logged := "<unparsable>"
+	if parseErr == nil {
+		logged = fmt.Sprintf("*<token>*%s*%s#", cmd.code, cmd.arg)
+	}
+	result := "accepted"
+	if err != nil {
+		result = "rejected: " + err.Error()
+	}
+	log.Printf("Remote command %s (%s) %s", logged, name, result)
+	entry := fmt.Sprintf("%s, %s, %s, %s\n", now.Format(time.RFC3339), logged, name, result)
+	file, fileErr := os.OpenFile(h.auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if fileErr != nil {
+		log.Errorf("Failed to open remote command audit log: %v", fileErr)
+	} else {
+		if _, fileErr := file.WriteString(entry); fileErr != nil {
+			log.Errorf("Failed to write remote command audit log: %v", fileErr)
+		}
+		file.Close()
+	}
+	payload := eventhelper.RemoteCommand{
+		Command:  name,
+		Code:     cmd.code,
+		Accepted: err == nil,
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	if eventErr := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.RemoteCommandRun, now, payload)); eventErr != nil {
+		log.Errorf("Error adding event: %v", eventErr)
+	}
+}
+
+// setTrapDisarmed records if the trap has been remotely disarmed, this is kept over restarts.
+func setTrapDisarmed(file string, disarmed bool) error {
+	if !disarmed {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.WriteFile(file, []byte(time.Now().Format(time.RFC3339)), 0644)
+}
+
+func trapDisarmed(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+func attinyStayOnFor(minutes int) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	obj := conn.Object("org.cacophony.ATtiny", "/org/cacophony/ATtiny")
+	return obj.Call("org.cacophony.ATtiny.StayOnFor", 0, minutes).Err
+}
+
+// listenForRemoteCommands reads commands from the UART and writes back the responses.
+func listenForRemoteCommands(h *remoteCommandHandler, port io.ReadWriter) error {
+	buf := make([]byte, remoteMaxLineLength)
+	line := []byte{}
+	for {
+		n, err := port.Read(buf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for _, b := range buf[:n] {
+			if b == '\r' || b == '\n' {
+				continue
+			}
+			line = append(line, b)
+			if b != '#' && len(line) <= remoteMaxLineLength {
+				continue
+			}
+			response := h.handle(string(line))
+			line = line[:0]
+			if _, err := port.Write([]byte(response + "\r\n")); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func openRemoteCommandPort(baud int) (*serial.Port, error) {
+	return serial.OpenPort(&serial.Config{Name: "/dev/serial0", Baud: baud, ReadTimeout: time.Second})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRemoteCommand(t *testing.T) {
+	cmd, err := parseRemoteCommand("*1234*30*15#")
+	assert.NoError(t, err)
+	assert.Equal(t, remoteCommand{token: "1234", code: "30", arg: "15"}, cmd)
+
+	cmd, err = parseRemoteCommand(" *1234*20#\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, remoteCommand{token: "1234", code: "20"}, cmd)
+
+	for _, line := range []string{"", "1234*20#", "*1234*20", "*1234#", "**20#", "*12a4*20#", "*1*2*3*4#"} {
+		_, err := parseRemoteCommand(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func newTestRemoteHandler(t *testing.T, allowed ...string) (*remoteCommandHandler, *int) {
+	dir := t.TempDir()
+	h, err := newRemoteCommandHandler(&CommsConfig{RemoteCommands: allowed, RemoteCommandToken: "4321"})
+	assert.NoError(t, err)
+	stayOn := 0
+	h.auditLogFile = filepath.Join(dir, "audit.log")
+	h.disarmedFile = filepath.Join(dir, "trap-disarmed")
+	h.stayOn = func(minutes int) error {
+		stayOn = minutes
+		return nil
+	}
+	return h, &stayOn
+}
+
+func TestRemoteCommands(t *testing.T) {
+	events := eventtest.Capture(t)
+	h, stayOn := newTestRemoteHandler(t, "arm", "disarm", "stay-on")
+
+	assert.Equal(t, "*OK*10#", h.handle("*4321*10#"))
+	assert.True(t, trapDisarmed(h.disarmedFile))
+	assert.Equal(t, "*OK*11#", h.handle("*4321*11#"))
+	assert.False(t, trapDisarmed(h.disarmedFile))
+
+	assert.Equal(t, "*OK*30#", h.handle("*4321*30*45#"))
+	assert.Equal(t, 45, *stayOn)
+	assert.Equal(t, "*E*04#", h.handle("*4321*30*0#"))
+
+	// Not in the allow-list.
+	assert.Equal(t, "*E*03#", h.handle("*4321*20#"))
+	assert.Len(t, events.Events(), 5)
+
+	// The token is not written to the audit log.
+	data, err := os.ReadFile(h.auditLogFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, strings.Count(string(data), "\n"))
+	assert.NotContains(t, string(data), "4321")
+
+	_, err = newRemoteCommandHandler(&CommsConfig{RemoteCommands: []string{"reboot"}, RemoteCommandToken: "4321"})
+	assert.Error(t, err)
+}
+
+func TestRemoteCommandLockout(t *testing.T) {
+	eventtest.Capture(t)
+	h, _ := newTestRemoteHandler(t, "status")
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < remoteMaxAuthFailures; i++ {
+		assert.Equal(t, "*E*01#", h.handle("*1111*20#"))
+	}
+	// Locked out even with the right token.
+	assert.Equal(t, "*E*01#", h.handle("*4321*20#"))
+
+	now = now.Add(remoteLockoutDuration + time.Second)
+	assert.True(t, strings.HasPrefix(h.handle("*4321*20#"), "*OK*20*1*"))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/buzzer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+// With simple output one camera can drive several traps. Each output channel is named and is
+// either a GPIO pin, a relay on the relay board (see relayboard.go) or the buzzer, which plays
+// a deterrent instead of activating a trap. The routes send sightings of a species to one or
+// more of the channels:
+//
+//	[trap-routing]
+//	channels = ["trap1=GPIO23", "trap2=relay:gate", "deterrent=buzzer"]
+//	routes = ["possum=trap1", "rat=trap2", "cat=deterrent"]
+//	min-confidence = 80
+//
+// The trap output on the UART TX pin is the "main" channel. Species without a route activate
+// the main channel as before, if they are trap species. A routed species needs the confidence
+// of the trap species it is listed as, or min-confidence if it isn't a trap species. Sightings
+// of protected species, disarming, the override, the schedule and heavy rain apply to all of
+// the channels.
+const (
+	routingConfigKey     = "trap-routing"
+	mainChannel          = "main"
+	audioChannel         = "buzzer"
+	defaultMinConfidence = 80
+)
+
+// routingConfig is read from the "trap-routing" section of the config.
+type routingConfig struct {
+	Channels      []string `mapstructure:"channels"`
+	Routes        []string `mapstructure:"routes"`
+	MinConfidence int32    `mapstructure:"min-confidence"`
+}
+
+func loadRoutingConfig(conf *goconfig.Config) (routingConfig, error) {
+	c := routingConfig{MinConfidence: defaultMinConfidence}
+	if err := configcompat.Unmarshal(conf, routingConfigKey, &c); err != nil {
+		return c, err
+	}
+	_, _, err := parseRouting(c)
+	return c, err
+}
+
+// parseRouting returns the channels, as the pin or audioChannel for each name, and the
+// channels each species is routed to.
+func parseRouting(c routingConfig) (map[string]string, map[string][]string, error) {
+	channels := map[string]string{}
+	for _, channel := range c.Channels {
+		name, target, ok := strings.Cut(channel, "=")
+		name, target = strings.TrimSpace(name), strings.TrimSpace(target)
+		if !ok || name == "" || target == "" {
+			return nil, nil, fmt.Errorf("%s channel '%s' should be name=pin, name=%srelay or name=%s", routingConfigKey, channel, relayTargetPrefix, audioChannel)
+		}
+		if _, ok := channels[name]; ok || name == mainChannel {
+			return nil, nil, fmt.Errorf("%s channel '%s' is used more than once", routingConfigKey, name)
+		}
+		channels[name] = target
+	}
+	routes := map[string][]string{}
+	for _, route := range c.Routes {
+		species, name, ok := strings.Cut(route, "=")
+		species, name = strings.TrimSpace(species), strings.TrimSpace(name)
+		if !ok || species == "" {
+			return nil, nil, fmt.Errorf("%s route '%s' should be species=channel", routingConfigKey, route)
+		}
+		if _, ok := channels[name]; !ok && name != mainChannel {
+			return nil, nil, fmt.Errorf("%s route '%s' is to an unknown channel", routingConfigKey, route)
+		}
+		routes[species] = append(routes[species], name)
+	}
+	if c.MinConfidence < 0 || c.MinConfidence > 100 {
+		return nil, nil, fmt.Errorf("%s min-confidence must be from 0 to 100", routingConfigKey)
+	}
+	return channels, routes, nil
+}
+
+// trapRouter picks the channels that a sighting activates.
+type trapRouter struct {
+	routes        map[string][]string
+	minConfidence int32
+}
+
+// channelsFor returns the channels, sorted, that the classification activates.
+func (r trapRouter) channelsFor(species, trapSpecies tracks.Species) []string {
+	matched := map[string]bool{}
+	for animal, confidence := range species {
+		required, isTrapSpecies := trapSpecies[animal]
+		channels, routed := r.routes[animal]
+		if !routed {
+			if isTrapSpecies && confidence >= required {
+				matched[mainChannel] = true
+			}
+			continue
+		}
+		if !isTrapSpecies {
+			required = r.minConfidence
+		}
+		if confidence >= required {
+			for _, name := range channels {
+				matched[name] = true
+			}
+		}
+	}
+	names := []string{}
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// trapChannel is one of the outputs driven by the simple output.
+type trapChannel struct {
+	name   string
+	output *trapOutput // nil for the buzzer.
+
+	lastSighting time.Time
+	active       bool
+}
+
+// openTrapChannels sets up the main channel on the pin and the routed channels, returning the
+// channels and the router.
+func openTrapChannels(config *CommsConfig, mainPin gpio.PinIO) ([]*trapChannel, trapRouter, error) {
+	channels := []*trapChannel{{name: mainChannel, output: newTrapOutput(mainPin, config)}}
+	targets, routes, err := parseRouting(config.Routing)
+	if err != nil {
+		return nil, trapRouter{}, err
+	}
+	names := []string{}
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	board, err := openRelayBoard(config.RelayBoard)
+	if err != nil {
+		return nil, trapRouter{}, exitcode.Wrap(exitcode.Usage, err)
+	}
+	for _, name := range names {
+		c := &trapChannel{name: name}
+		if relay, ok := strings.CutPrefix(targets[name], relayTargetPrefix); ok {
+			pin, ok := board.pin(relay)
+			if !ok {
+				return nil, trapRouter{}, exitcode.Wrap(exitcode.Usage, fmt.Errorf("no relay '%s' on the %s for trap channel '%s'", relay, relayBoardConfigKey, name))
+			}
+			c.output = newTrapOutput(pin, config)
+			// Keep-alive pulses would chatter the relay, the relay board has its own checks.
+			c.output.keepAlive = false
+			c.output.activeFile = trapActiveFile + "-" + name
+			checkFailSafeTripped(c.output.activeFile, false)
+		} else if targets[name] != audioChannel {
+			pin := gpioreg.ByName(targets[name])
+			if pin == nil {
+				return nil, trapRouter{}, exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("failed to find pin '%s' for trap channel '%s'", targets[name], name))
+			}
+			if err := pin.Out(gpio.Low); err != nil {
+				return nil, trapRouter{}, fmt.Errorf("failed to set trap channel '%s' low: %v", name, err)
+			}
+			c.output = newTrapOutput(pin, config)
+			c.output.activeFile = trapActiveFile + "-" + name
+			checkFailSafeTripped(c.output.activeFile, config.KeepAlive)
+		}
+		log.Infof("Trap channel '%s' on %s", name, targets[name])
+		channels = append(channels, c)
+	}
+	return channels, trapRouter{routes: routes, minConfidence: config.Routing.MinConfidence}, nil
+}
+
+func (c *trapChannel) String() string {
+	if c.name == mainChannel {
+		return "trap"
+	}
+	return fmt.Sprintf("trap channel '%s'", c.name)
+}
+
+// deactivateTrapChannels deactivates all of the channels.
+func deactivateTrapChannels(channels []*trapChannel, beeper *buzzer.Buzzer) {
+	for _, c := range channels {
+		if err := c.setActive(false, beeper); err != nil {
+			log.Errorf("Failed to deactivate %s: %v", c, err)
+		}
+	}
+}
+
+// setActive activates or deactivates the channel, the buzzer plays the deterrent when it is
+// activated.
+func (c *trapChannel) setActive(active bool, beeper *buzzer.Buzzer) error {
+	if c.output != nil {
+		if err := c.output.setActive(active); err != nil {
+			return err
+		}
+	} else if active && !c.active {
+		beeper.PlayAsync(buzzer.Deterrent)
+	}
+	c.active = active
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRouting(t *testing.T) {
+	channels, routes, err := parseRouting(routingConfig{
+		Channels: []string{"trap1=GPIO23", "deterrent = buzzer"},
+		Routes:   []string{"possum=trap1", "possum=main", "cat=deterrent"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"trap1": "GPIO23", "deterrent": audioChannel}, channels)
+	assert.Equal(t, map[string][]string{"possum": {"trap1", mainChannel}, "cat": {"deterrent"}}, routes)
+
+	for _, c := range []routingConfig{
+		{Channels: []string{"trap1"}},
+		{Channels: []string{"trap1=GPIO23", "trap1=GPIO24"}},
+		{Channels: []string{"main=GPIO23"}},
+		{Routes: []string{"possum=trap1"}},
+		{Routes: []string{"possum"}},
+		{MinConfidence: 101},
+	} {
+		_, _, err := parseRouting(c)
+		assert.Error(t, err, c)
+	}
+}
+
+func TestChannelsFor(t *testing.T) {
+	r := trapRouter{
+		routes:        map[string][]string{"possum": {"trap1"}, "rat": {"trap2"}, "cat": {"deterrent"}},
+		minConfidence: 80,
+	}
+	trapSpecies := tracks.Species{"possum": 70, "rat": 70, "stoat": 70}
+
+	assert.Equal(t, []string{"trap1"}, r.channelsFor(tracks.Species{"possum": 75}, trapSpecies))
+	assert.Equal(t, []string{"main"}, r.channelsFor(tracks.Species{"stoat": 75}, trapSpecies))
+	assert.Equal(t, []string{"main", "trap2"}, r.channelsFor(tracks.Species{"rat": 90, "stoat": 90}, trapSpecies))
+	// Cat isn't a trap species so needs min-confidence.
+	assert.Empty(t, r.channelsFor(tracks.Species{"cat": 75}, trapSpecies))
+	assert.Equal(t, []string{"deterrent"}, r.channelsFor(tracks.Species{"cat": 85}, trapSpecies))
+	assert.Empty(t, r.channelsFor(tracks.Species{"possum": 60}, trapSpecies))
+
+	// Without routes only the trap species activate the main channel.
+	assert.Equal(t, []string{"main"}, trapRouter{}.channelsFor(tracks.Species{"possum": 75}, trapSpecies))
+	assert.Empty(t, trapRouter{}.channelsFor(tracks.Species{"cat": 99}, trapSpecies))
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// The trap schedule limits when the trap can be activated, for deployments where it should
+// only run at night or not during a bird nesting season:
+//
+//	[trap-schedule]
+//	windows = ["19:00-07:00"]
+//	blackout = ["09-01/12-31"]
+//
+// Windows are the local times of day the trap can be active, all day if there are none.
+// Blackout dates are month-day ranges, repeated each year, when the trap is never active.
+// The schedule is checked against the RTC time so it still works if the system clock hasn't
+// been set. A maintenance override, from `tc2-hat-comms schedule` or D-Bus, allows or blocks
+// the trap until a set time, whatever the schedule says.
+const (
+	scheduleConfigKey        = "trap-schedule"
+	trapScheduleOverrideFile = "/etc/cacophony/trap-schedule-override.json"
+	rtcClockSyncInterval     = 10 * time.Minute
+)
+
+// scheduleConfig is read from the "trap-schedule" section of the config.
+type scheduleConfig struct {
+	Windows  []string `mapstructure:"windows"`
+	Blackout []string `mapstructure:"blackout"`
+}
+
+func loadScheduleConfig(conf *goconfig.Config) (scheduleConfig, error) {
+	c := scheduleConfig{}
+	if err := configcompat.Unmarshal(conf, scheduleConfigKey, &c); err != nil {
+		return c, err
+	}
+	_, err := parseTrapSchedule(c)
+	return c, err
+}
+
+// timeWindow is a time of day range in minutes from midnight, it can cross midnight.
+type timeWindow struct {
+	start, end int
+}
+
+// dateRange is a range of days in the year as month*100+day, it can cross the new year.
+type dateRange struct {
+	start, end int
+}
+
+type trapSchedule struct {
+	config   scheduleConfig
+	windows  []timeWindow
+	blackout []dateRange
+}
+
+func parseTrapSchedule(c scheduleConfig) (trapSchedule, error) {
+	s := trapSchedule{config: c}
+	for _, w := range c.Windows {
+		start, end, ok := strings.Cut(w, "-")
+		if !ok {
+			return s, fmt.Errorf("trap schedule window '%s' should be HH:MM-HH:MM", w)
+		}
+		startTime, err1 := time.Parse("15:04", strings.TrimSpace(start))
+		endTime, err2 := time.Parse("15:04", strings.TrimSpace(end))
+		if err1 != nil || err2 != nil {
+			return s, fmt.Errorf("trap schedule window '%s' should be HH:MM-HH:MM", w)
+		}
+		s.windows = append(s.windows, timeWindow{
+			start: startTime.Hour()*60 + startTime.Minute(),
+			end:   endTime.Hour()*60 + endTime.Minute(),
+		})
+	}
+	for _, d := range c.Blackout {
+		start, end, ok := strings.Cut(d, "/")
+		if !ok {
+			return s, fmt.Errorf("trap schedule blackout '%s' should be MM-DD/MM-DD", d)
+		}
+		startDate, err1 := time.Parse("01-02", strings.TrimSpace(start))
+		endDate, err2 := time.Parse("01-02", strings.TrimSpace(end))
+		if err1 != nil || err2 != nil {
+			return s, fmt.Errorf("trap schedule blackout '%s' should be MM-DD/MM-DD", d)
+		}
+		s.blackout = append(s.blackout, dateRange{
+			start: int(startDate.Month())*100 + startDate.Day(),
+			end:   int(endDate.Month())*100 + endDate.Day(),
+		})
+	}
+	return s, nil
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// contains checks if the day is in the range, the end day is included.
+func (d dateRange) contains(day int) bool {
+	if d.start <= d.end {
+		return day >= d.start && day <= d.end
+	}
+	return day >= d.start || day <= d.end
+}
+
+// allowed returns if the trap can be active at the local time t, and the reason if not.
+func (s trapSchedule) allowed(t time.Time) (bool, string) {
+	day := int(t.Month())*100 + t.Day()
+	for i, d := range s.blackout {
+		if d.contains(day) {
+			return false, "blackout " + s.config.Blackout[i]
+		}
+	}
+	if len(s.windows) == 0 {
+		return true, ""
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start == w.end || w.contains(minute) {
+			return true, ""
+		}
+	}
+	return false, "outside windows"
+}
+
+// scheduleOverride is a maintenance override of the schedule.
+type scheduleOverride struct {
+	Allow bool      `json:"allow"`
+	Until time.Time `json:"until"`
+}
+
+func loadScheduleOverride(file string) (*scheduleOverride, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o := &scheduleOverride{}
+	return o, json.Unmarshal(data, o)
+}
+
+// setScheduleOverride saves the override, or removes it if o is nil.
+func setScheduleOverride(file string, o *scheduleOverride) error {
+	if o == nil {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+type scheduleState struct {
+	Time     time.Time         `json:"time"`
+	Allowed  bool              `json:"allowed"`
+	Reason   string            `json:"reason,omitempty"`
+	Override *scheduleOverride `json:"override,omitempty"`
+	Windows  []string          `json:"windows"`
+	Blackout []string          `json:"blackout"`
+}
+
+// trapScheduler checks the schedule and override, reporting when the trap is allowed or
+// stopped by the schedule.
+type trapScheduler struct {
+	schedule     trapSchedule
+	overrideFile string
+	now          func() time.Time
+
+	mu          sync.Mutex
+	lastAllowed *bool
+}
+
+func newTrapScheduler(c scheduleConfig, now func() time.Time) (*trapScheduler, error) {
+	schedule, err := parseTrapSchedule(c)
+	if err != nil {
+		return nil, err
+	}
+	return &trapScheduler{
+		schedule:     schedule,
+		overrideFile: trapScheduleOverrideFile,
+		now:          now,
+	}, nil
+}
+
+// state returns if the trap is allowed by the schedule now.
+func (s *trapScheduler) state() scheduleState {
+	now := s.now().In(time.Local)
+	state := scheduleState{
+		Time:     now,
+		Windows:  s.schedule.config.Windows,
+		Blackout: s.schedule.config.Blackout,
+	}
+	override, err := loadScheduleOverride(s.overrideFile)
+	if err != nil {
+		log.Errorf("Failed to read trap schedule override: %v", err)
+	}
+	if override != nil && now.Before(override.Until) {
+		state.Override = override
+		state.Allowed = override.Allow
+		if !override.Allow {
+			state.Reason = "override"
+		}
+		return state
+	}
+	state.Allowed, state.Reason = s.schedule.allowed(now)
+	return state
+}
+
+// allowed returns if the trap can be active now, reporting changes. Safe to call on a nil
+// scheduler when there is no schedule.
+func (s *trapScheduler) allowed() bool {
+	if s == nil {
+		return true
+	}
+	state := s.state()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastAllowed != nil && *s.lastAllowed == state.Allowed {
+		return state.Allowed
+	}
+	first := s.lastAllowed == nil
+	s.lastAllowed = &state.Allowed
+	if state.Allowed {
+		log.Info("Trap allowed by the schedule")
+	} else {
+		log.Infof("Trap stopped by the schedule: %s", state.Reason)
+	}
+	if first && state.Allowed {
+		return true
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.TrapScheduleChanged, state.Time, eventhelper.TrapSchedule{
+		Allowed:  state.Allowed,
+		Override: state.Override != nil,
+		Reason:   state.Reason,
+	})); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+	return state.Allowed
+}
+
+// rtcClock gives the time from the RTC, falling back to the system clock if the RTC can't
+// be read or its time doesn't have integrity. The offset from the system clock is updated
+// every rtcClockSyncInterval.
+type rtcClock struct {
+	readRTC func() (time.Time, bool, error)
+	now     func() time.Time
+
+	mu       sync.Mutex
+	offset   time.Duration
+	lastSync time.Time
+}
+
+func (c *rtcClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.lastSync.IsZero() || now.Sub(c.lastSync) >= rtcClockSyncInterval {
+		c.lastSync = now
+		rtcTime, integrity, err := c.readRTC()
+		switch {
+		case err != nil:
+			log.Debugf("Failed to read RTC, using the system clock: %v", err)
+			c.offset = 0
+		case !integrity:
+			log.Debug("RTC time doesn't have integrity, using the system clock")
+			c.offset = 0
+		default:
+			c.offset = rtcTime.Sub(now).Round(time.Second)
+		}
+	}
+	return now.Add(c.offset)
+}
+
+// runScheduleCommand sets or clears the override and prints the schedule state.
+func runScheduleCommand(config *CommsConfig, args *ScheduleCmd) error {
+	switch {
+	case args.Clear:
+		if err := setScheduleOverride(trapScheduleOverrideFile, nil); err != nil {
+			return err
+		}
+	case args.AllowFor > 0 && args.BlockFor > 0:
+		return fmt.Errorf("can't use --allow-for and --block-for together")
+	case args.AllowFor > 0:
+		if err := setScheduleOverride(trapScheduleOverrideFile, &scheduleOverride{Allow: true, Until: time.Now().Add(args.AllowFor)}); err != nil {
+			return err
+		}
+	case args.BlockFor > 0:
+		if err := setScheduleOverride(trapScheduleOverrideFile, &scheduleOverride{Allow: false, Until: time.Now().Add(args.BlockFor)}); err != nil {
+			return err
+		}
+	}
+	scheduler, err := newTrapScheduler(config.Schedule, newRTCClock().Now)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(scheduler.state(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
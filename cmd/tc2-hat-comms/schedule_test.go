@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrapScheduleAllowed(t *testing.T) {
+	s, err := parseTrapSchedule(scheduleConfig{
+		Windows:  []string{"19:00-07:00"},
+		Blackout: []string{"09-01/12-31", "12-24/01-02"},
+	})
+	assert.NoError(t, err)
+
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.Local)
+	}
+	allowed, _ := s.allowed(at(3, 10, 22, 0))
+	assert.True(t, allowed)
+	allowed, _ = s.allowed(at(3, 10, 6, 59))
+	assert.True(t, allowed)
+	allowed, reason := s.allowed(at(3, 10, 7, 0))
+	assert.False(t, allowed)
+	assert.Equal(t, "outside windows", reason)
+
+	allowed, reason = s.allowed(at(12, 31, 22, 0))
+	assert.False(t, allowed)
+	assert.Equal(t, "blackout 09-01/12-31", reason)
+	allowed, reason = s.allowed(at(1, 2, 22, 0))
+	assert.False(t, allowed)
+	assert.Equal(t, "blackout 12-24/01-02", reason)
+	allowed, _ = s.allowed(at(1, 3, 22, 0))
+	assert.True(t, allowed)
+
+	for _, c := range []scheduleConfig{
+		{Windows: []string{"19:00"}},
+		{Windows: []string{"25:00-07:00"}},
+		{Blackout: []string{"09-01-12-31"}},
+		{Blackout: []string{"13-01/12-31"}},
+	} {
+		_, err := parseTrapSchedule(c)
+		assert.Error(t, err, c)
+	}
+}
+
+func TestTrapSchedulerOverride(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	s, err := newTrapScheduler(scheduleConfig{Windows: []string{"19:00-07:00"}}, func() time.Time { return now })
+	assert.NoError(t, err)
+	s.overrideFile = filepath.Join(t.TempDir(), "override.json")
+	events := eventtest.Capture(t)
+
+	assert.False(t, s.allowed())
+	assert.Len(t, events.Events(), 1)
+
+	assert.NoError(t, setScheduleOverride(s.overrideFile, &scheduleOverride{Allow: true, Until: now.Add(time.Hour)}))
+	assert.True(t, s.allowed())
+	assert.True(t, s.allowed())
+	assert.Len(t, events.Events(), 2)
+	assert.Equal(t, true, events.Events()[1].Details["override"])
+
+	// The override runs out.
+	now = now.Add(time.Hour)
+	assert.False(t, s.allowed())
+
+	assert.NoError(t, setScheduleOverride(s.overrideFile, nil))
+	assert.NoError(t, setScheduleOverride(s.overrideFile, nil))
+
+	var nilScheduler *trapScheduler
+	assert.True(t, nilScheduler.allowed())
+}
+
+func TestRTCClock(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	rtcOffset := 30 * time.Second
+	integrity := true
+	reads := 0
+	c := &rtcClock{
+		now: func() time.Time { return now },
+		readRTC: func() (time.Time, bool, error) {
+			reads++
+			return now.Add(rtcOffset), integrity, nil
+		},
+	}
+	assert.Equal(t, now.Add(rtcOffset), c.Now())
+	now = now.Add(time.Minute)
+	assert.Equal(t, now.Add(rtcOffset), c.Now())
+	assert.Equal(t, 1, reads)
+
+	integrity = false
+	now = now.Add(rtcClockSyncInterval)
+	assert.Equal(t, now, c.Now())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusapi"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusauth"
+	"github.com/godbus/dbus"
+)
+
+const (
+	dbusName = "org.cacophony.TC2HatComms"
+	dbusPath = "/org/cacophony/TC2HatComms"
+)
+
+// api is the version and capabilities of the D-Bus API, see the dbusapi package.
+var api = dbusapi.API{
+	Version:      1,
+	Capabilities: []string{"trapSchedule", "injectEvent", "commsStats", "trapOverride", "relays", "protectedSightings"},
+}
+
+type commsService struct {
+	scheduler *trapScheduler
+	injector  *eventInjector
+	override  *trapOverride
+	auth      *dbusauth.Authorizer
+}
+
+// startCommsService exports the trap schedule, override and event injection on D-Bus.
+func startCommsService(scheduler *trapScheduler, injector *eventInjector, override *trapOverride, configDir string) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return errors.New("name already taken")
+	}
+	s := &commsService{
+		scheduler: scheduler,
+		injector:  injector,
+		override:  override,
+		auth:      dbusauth.Load(conn, dbusName, configDir),
+	}
+	_, err = dbusapi.Export(conn, s, dbusPath, dbusName, api, nil)
+	return err
+}
+
+// GetTrapSchedule returns the schedule and if the trap is allowed now as JSON.
+func (s commsService) GetTrapSchedule() (string, *dbus.Error) {
+	data, err := json.Marshal(s.scheduler.state())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// OverrideTrapSchedule allows or blocks the trap for the given minutes, whatever the schedule says.
+func (s commsService) OverrideTrapSchedule(sender dbus.Sender, allow bool, minutes int32) *dbus.Error {
+	if err := s.auth.Check(sender, "OverrideTrapSchedule"); err != nil {
+		return err
+	}
+	if minutes <= 0 {
+		return dbusErr(errors.New("minutes must be positive"))
+	}
+	until := s.scheduler.now().Add(time.Duration(minutes) * time.Minute)
+	log.Printf("Trap schedule overridden, allow: %t, until %s", allow, until.Format(time.DateTime))
+	return dbusErr(setScheduleOverride(s.scheduler.overrideFile, &scheduleOverride{Allow: allow, Until: until}))
+}
+
+// ClearTrapScheduleOverride goes back to following the schedule.
+func (s commsService) ClearTrapScheduleOverride(sender dbus.Sender) *dbus.Error {
+	if err := s.auth.Check(sender, "ClearTrapScheduleOverride"); err != nil {
+		return err
+	}
+	log.Println("Trap schedule override cleared")
+	return dbusErr(setScheduleOverride(s.scheduler.overrideFile, nil))
+}
+
+// ForceTrapSafe keeps the trap deactivated for the given minutes, the same as pressing the
+// override button.
+func (s commsService) ForceTrapSafe(sender dbus.Sender, minutes int32) *dbus.Error {
+	if err := s.auth.Check(sender, "ForceTrapSafe"); err != nil {
+		return err
+	}
+	if minutes <= 0 {
+		return dbusErr(errors.New("minutes must be positive"))
+	}
+	return dbusErr(s.override.start(overrideTriggerDBus, time.Duration(minutes)*time.Minute))
+}
+
+// InjectEvent sends an event from another service out through the comms output, the
+// details are a JSON object. See inject.go for the events that are accepted.
+func (s commsService) InjectEvent(sender dbus.Sender, source, eventType, details string) *dbus.Error {
+	if err := s.auth.Check(sender, "InjectEvent"); err != nil {
+		return err
+	}
+	e := injectedEvent{Type: eventType, Source: source, Details: map[string]interface{}{}}
+	if details != "" {
+		if err := json.Unmarshal([]byte(details), &e.Details); err != nil {
+			return dbusErr(fmt.Errorf("details must be a JSON object: %v", err))
+		}
+	}
+	return dbusErr(s.injector.inject(e))
+}
+
+// GetStats returns the message counts for each comms output as JSON.
+func (s commsService) GetStats() (string, *dbus.Error) {
+	data, err := json.Marshal(stats.report())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetProtectedSightings returns the sightings counted for each protected species as JSON.
+func (s commsService) GetProtectedSightings() (string, *dbus.Error) {
+	data, err := json.Marshal(protectedSightingsCounter.counts())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetRelays returns the state of the relays on the relay board as JSON, with the states read
+// back from the board.
+func (s commsService) GetRelays() (string, *dbus.Error) {
+	if relayBoardController == nil {
+		return "", dbusErr(errors.New("there is no relay board in use"))
+	}
+	data, err := json.Marshal(relayBoardController.status())
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+func dbusErr(err error) *dbus.Error {
+	if err == nil {
+		return nil
+	}
+	return &dbus.Error{
+		Name: dbusName + ".Error",
+		Body: []interface{}{err.Error()},
+	}
+}
+
+// newRTCClock returns a clock that uses the time from tc2-hat-rtc.
+func newRTCClock() *rtcClock {
+	return &rtcClock{
+		now: time.Now,
+		readRTC: func() (time.Time, bool, error) {
+			conn, err := dbus.SystemBus()
+			if err != nil {
+				return time.Time{}, false, err
+			}
+			var timeStr string
+			var integrity bool
+			obj := conn.Object("org.cacophony.RTC", "/org/cacophony/RTC")
+			if err := obj.Call("org.cacophony.RTC.GetTime", 0).Store(&timeStr, &integrity); err != nil {
+				return time.Time{}, false, err
+			}
+			t, err := time.Parse(time.RFC3339, timeStr)
+			return t, integrity, err
+		},
+	}
+}
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
 	"github.com/godbus/dbus/v5"
 )
@@ -11,6 +13,7 @@ type trackingEvent struct {
 	species     tracks.Species
 	boundingBox [4]int32
 	motion      bool
+	received    time.Time // When the tracking signal was received, see latency.go.
 }
 
 func getTrackingSignals() (chan trackingEvent, error) {
@@ -32,7 +35,7 @@ func getTrackingSignals() (chan trackingEvent, error) {
 	conn.Signal(c)
 
 	// Create a channel to send tracking events
-	tracksChan := make(chan trackingEvent, 10)
+	tracksChan := make(chan trackingEvent, defaultEventBuffer)
 
 	// Listen for signals
 	log.Println("Listening for D-Bus signals from org.cacophony.thermalrecorder...")
@@ -64,6 +67,7 @@ func getTrackingSignals() (chan trackingEvent, error) {
 					},
 					boundingBox: boundingBox,
 					motion:      signal.Body[3].(bool),
+					received:    time.Now(),
 				}
 				tracksChan <- t
 			}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
 	"time"
 
+	"github.com/TheCacophonyProject/tc2-hat-controller/buzzer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/selfmonitor"
 	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
 	"periph.io/x/conn/v3/gpio"
 	"periph.io/x/conn/v3/gpio/gpioreg"
@@ -11,18 +18,26 @@ import (
 )
 
 // processSimpleOutput will just output HIGH or LOW to the UART TX pin for showing if the
-// trap should be active or not.
-func processSimpleOutput(config *CommsConfig, trackingSignals chan trackingEvent) error {
+// trap should be active or not, and to the pins of any other trap channels, see routing.go.
+func processSimpleOutput(config *CommsConfig, trackingSignals chan trackingEvent, weather *weatherMonitor, thresholds *speciesThresholds, schedule *trapScheduler, injector *eventInjector, override *trapOverride) error {
 	// Initialize the periph host drivers
 	if _, err := host.Init(); err != nil {
 		return fmt.Errorf("failed to initialize periph: %v", err)
 	}
 
+	log.Info("Get lease on serial port")
+	lease, err := acquireSerialLease()
+	if err != nil {
+		return err
+	}
+	lease.KeepAlive()
+	defer lease.Release()
+
 	log.Info("Get lock on serial port")
 	if config.CommsOut == "uart" || config.CommsOut == "simple" {
 		serialFile, err := serialhelper.GetSerial(3, gpio.High, gpio.Low, time.Second)
 		if err != nil {
-			return err
+			return exitcode.Wrap(exitcode.BusError, err)
 		}
 		defer serialhelper.ReleaseSerial(serialFile)
 	}
@@ -32,68 +47,161 @@ func processSimpleOutput(config *CommsConfig, trackingSignals chan trackingEvent
 	outPin := gpioreg.ByName(config.UartTxPin)
 	log.Debugf("Setting output pin '%s'", config.UartTxPin)
 	if outPin == nil {
-		return fmt.Errorf("failed to find out pin '%s'", config.UartTxPin)
+		return exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("failed to find out pin '%s'", config.UartTxPin))
 	}
 	if err := outPin.Out(gpio.Low); err != nil {
 		return fmt.Errorf("failed to set out pin low: %v", err)
 	}
+	beeper, err := buzzer.Open(config.Buzzer)
+	if err != nil {
+		log.Errorf("Failed to set up the buzzer: %v", err)
+	}
+	checkFailSafeTripped(trapActiveFile, config.KeepAlive)
+	if config.KeepAlive {
+		log.Info("Driving trap output with keep-alive pulses")
+	}
+	channels, router, err := openTrapChannels(config, outPin)
+	if err != nil {
+		return err
+	}
+	// Deactivate the traps if we stop for any reason we can handle.
+	defer deactivateTrapChannels(channels, beeper)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	trapActive := false
-	previousTrapActive := false
 	lastProtectSpeciesSighting := time.Time{}
-	lastTrapSpeciesSighting := time.Time{}
+	// The track waiting for the outputs to be set, for measuring the latency.
+	pendingTrack, pickedUp := time.Time{}, time.Time{}
 
 	for {
+		selfmonitor.Beat("simple", loopMaxGap)
 		now := time.Now()
-		trapActive = config.TrapEnabledByDefault
 
-		// Check if species sighting influences trap state
-		if lastProtectSpeciesSighting.Add(config.ProtectDuration).After(now) {
-			trapActive = false // Disable trap if protective species has been sighted recently
-		} else if lastTrapSpeciesSighting.Add(config.TrapDuration).After(now) {
-			trapActive = true // Enable trap if trap species has been sighted recently
+		// Check if species sightings influence the trap states, a protective species
+		// sighted recently disables all of the traps.
+		protected := lastProtectSpeciesSighting.Add(config.ProtectDuration).After(now)
+		wanted := map[string]bool{}
+		trapActive := false
+		for _, c := range channels {
+			sighted := c.lastSighting.Add(config.TrapDuration).After(now)
+			if !protected && (sighted || (c.name == mainChannel && config.TrapEnabledByDefault)) {
+				wanted[c.name] = true
+				trapActive = true
+			}
+		}
+		if trapActive && trapDisarmed(trapDisarmedFile) {
+			trapActive = false // Trap has been disarmed by a remote command.
+		}
+		// Checked every time so the trap re-arms when the override ends.
+		if override.active() && trapActive {
+			log.Debug("Not activating trap while it is forced safe")
+			trapActive = false
+		}
+		// Checked every time so changes to the schedule are reported.
+		if !schedule.allowed() && trapActive {
+			log.Debug("Not activating trap outside the trap schedule")
+			trapActive = false
+		}
+		if trapActive && weather.suppressTrap() {
+			log.Debug("Not activating trap during heavy rain")
+			trapActive = false
 		}
 
-		// Check if the state has changed and if so, activate or deactivate the trap
-		if trapActive != previousTrapActive {
-			if trapActive {
-				log.Info("Activating trap")
-				if err := outPin.Out(gpio.High); err != nil {
-					return fmt.Errorf("failed to set out pin high: %v", err)
+		// Check if the states have changed and if so, activate or deactivate the traps
+		for _, c := range channels {
+			active := trapActive && wanted[c.name]
+			if active == c.active {
+				continue
+			}
+			if active {
+				log.Infof("Activating %s", c)
+				// The buzzer channel plays the deterrent instead.
+				if c.output != nil && c.lastSighting.Add(config.TrapDuration).After(now) {
+					beeper.PlayAsync(buzzer.TrapTriggered)
+				} else if c.output != nil {
+					beeper.PlayAsync(buzzer.TrapArmed)
 				}
 			} else {
-				log.Info("Deactivating trap")
-				if err := outPin.Out(gpio.Low); err != nil {
-					return fmt.Errorf("failed to set out pin low: %v", err)
-				}
+				log.Infof("Deactivating %s", c)
+			}
+			err := c.setActive(active, beeper)
+			stats.channel(channelSimple).sent(false, err)
+			if err != nil {
+				return fmt.Errorf("failed to set %s output: %v", c, err)
+			}
+			if !pendingTrack.IsZero() {
+				stats.latency.record(stageOutput, time.Since(pickedUp))
+				stats.latency.acted(pendingTrack, channelSimple)
+				pendingTrack = time.Time{}
 			}
 		}
+		pendingTrack = time.Time{}
 
-		previousTrapActive = trapActive
-
-		// Delay 10 seconds or until the trap should be deactivated
+		// Delay 10 seconds or until a trap should be deactivated
 		var delay = 10 * time.Second
-		trapDeactivateTime := lastTrapSpeciesSighting.Add(config.TrapDuration)
-		if trapActive && time.Until(trapDeactivateTime) < delay {
-			delay = time.Until(trapDeactivateTime)
+		for _, c := range channels {
+			trapDeactivateTime := c.lastSighting.Add(config.TrapDuration)
+			if c.active && time.Until(trapDeactivateTime) < delay {
+				delay = time.Until(trapDeactivateTime)
+			}
+		}
+		if remaining := override.remaining(); remaining > 0 && remaining < delay {
+			delay = remaining
 		}
 
 		log.Debug("Waiting")
 		select {
 		case t := <-trackingSignals:
 			log.Debugf("Found new track: %+v", t)
-			if t.species.MatchSpeciesWithConfidence(config.ProtectSpecies) {
+			stats.latency.record(stageDispatch, time.Since(t.received))
+			trapSpecies, protectSpecies := thresholds.current()
+			if t.species.MatchSpeciesWithConfidence(protectSpecies) {
 				log.Debug("Found an animal that needs to be protected")
+				protectedSightingsCounter.sighted(t.species, protectSpecies, protectAction(channels))
 				lastProtectSpeciesSighting = time.Now()
-			} else if t.species.MatchSpeciesWithConfidence(config.TrapSpecies) {
-				log.Debug("Found an animal that needs to be trapped")
-				lastTrapSpeciesSighting = time.Now()
+				pendingTrack, pickedUp = t.received, time.Now()
+			} else if names := router.channelsFor(t.species, trapSpecies); len(names) > 0 {
+				log.Debugf("Found an animal that needs to be trapped, trap channels %v", names)
+				pendingTrack, pickedUp = t.received, time.Now()
+				for _, c := range channels {
+					if slices.Contains(names, c.name) {
+						c.lastSighting = time.Now()
+					}
+				}
 			} else {
 				log.Debug("No animals need to be protected or trapped, not changing trap state.")
 			}
 
+		case e := <-injector.injected():
+			if e.flag("protect") {
+				log.Debugf("Event '%s' from %s is protecting, deactivating trap", e.Type, e.Source)
+				species, confidence := injectedSighting(e)
+				protectedSightingsCounter.record(species, confidence, protectAction(channels), time.Now())
+				lastProtectSpeciesSighting = time.Now()
+			} else if e.flag("activateTrap") {
+				log.Debugf("Event '%s' from %s is activating trap", e.Type, e.Source)
+				channels[0].lastSighting = time.Now()
+			} else {
+				log.Debugf("Event '%s' from %s can't be sent with simple output, ignoring it", e.Type, e.Source)
+			}
+
+		case <-override.started():
+			log.Debug("Trap override started")
+
 		case <-time.After(delay):
 			log.Debug("Scheduled check")
+
+		case sig := <-stop:
+			log.Infof("Received %s, deactivating trap", sig)
+			return nil
+
+		case <-lease.Revoked():
+			deactivateTrapChannels(channels, beeper)
+			// Stop driving the pin so we don't interfere with whatever is now using the serial port.
+			if err := outPin.In(gpio.Float, gpio.NoEdge); err != nil {
+				log.Errorf("Failed to release out pin: %v", err)
+			}
+			return fmt.Errorf("serial port was taken by another process")
 		}
 	}
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+)
+
+// The messages on each comms output are counted so it can be told remotely if a trap is
+// getting them. The counts are available from the GetStats D-Bus method and are sent in a
+// commsHealth event every commsHealthInterval. GetStats also returns the track latencies, see
+// latency.go.
+const (
+	commsHealthInterval = 6 * time.Hour
+
+	channelUART   = "uart"
+	channelSimple = "simple"
+)
+
+// channelCounts are the counts for a comms output since tc2-hat-comms started.
+type channelCounts struct {
+	FramesSent   uint64    `json:"framesSent"`
+	AcksReceived uint64    `json:"acksReceived"`
+	Nacks        uint64    `json:"nacks"`
+	Retries      uint64    `json:"retries"`
+	CRCErrors    uint64    `json:"crcErrors"`
+	Errors       uint64    `json:"errors"`
+	LastSuccess  time.Time `json:"lastSuccess"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+type channelStats struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	counts channelCounts
+}
+
+// sent records a frame that was sent and how it went. Outputs without a response, such as
+// the simple output, record a success with ack false.
+func (c *channelStats) sent(ack bool, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts.FramesSent++
+	switch {
+	case err == nil:
+		if ack {
+			c.counts.AcksReceived++
+		}
+		c.counts.LastSuccess = c.now()
+		return
+	case errors.Is(err, errNACK):
+		c.counts.Nacks++
+	case errors.Is(err, commsproto.ErrChecksumMismatch):
+		c.counts.CRCErrors++
+	default:
+		c.counts.Errors++
+	}
+	c.counts.LastError = err.Error()
+}
+
+// retry records that a frame is being sent again.
+func (c *channelStats) retry() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts.Retries++
+}
+
+func (c *channelStats) snapshot() channelCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts
+}
+
+type commsStats struct {
+	now     func() time.Time
+	started time.Time
+
+	latency *trackLatency
+
+	mu       sync.Mutex
+	channels map[string]*channelStats
+}
+
+func newCommsStats(now func() time.Time) *commsStats {
+	return &commsStats{
+		now:      now,
+		started:  now(),
+		latency:  newTrackLatency(now),
+		channels: map[string]*channelStats{},
+	}
+}
+
+// stats for all the comms outputs of tc2-hat-comms.
+var stats = newCommsStats(time.Now)
+
+// channel returns the stats for the comms output, creating them on first use.
+func (s *commsStats) channel(name string) *channelStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.channels[name]
+	if !ok {
+		c = &channelStats{now: s.now}
+		s.channels[name] = c
+	}
+	return c
+}
+
+// commsStatsReport is returned by GetStats.
+type commsStatsReport struct {
+	Since    time.Time                     `json:"since"`
+	Channels map[string]channelCounts      `json:"channels"`
+	Latency  map[string]latencyPercentiles `json:"latency"`
+}
+
+func (s *commsStats) report() commsStatsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := commsStatsReport{Since: s.started, Channels: map[string]channelCounts{}, Latency: s.latency.report()}
+	for name, c := range s.channels {
+		r.Channels[name] = c.snapshot()
+	}
+	return r
+}
+
+// healthEvent returns the commsHealth event with the counts of each comms output.
+func (s *commsStats) healthEvent() eventclient.Event {
+	r := s.report()
+	return eventhelper.NewEvent(eventhelper.CommsHealth, s.now(), eventhelper.CommsHealthReport{
+		Since:  r.Since,
+		UART:   channelPayload(r.Channels, channelUART),
+		Simple: channelPayload(r.Channels, channelSimple),
+	})
+}
+
+// channelPayload returns the counts of the comms output for the commsHealth event, nil if
+// it hasn't been used.
+func channelPayload(channels map[string]channelCounts, name string) *eventhelper.CommsChannel {
+	c, ok := channels[name]
+	if !ok {
+		return nil
+	}
+	return &eventhelper.CommsChannel{
+		FramesSent:   c.FramesSent,
+		AcksReceived: c.AcksReceived,
+		Nacks:        c.Nacks,
+		Retries:      c.Retries,
+		CRCErrors:    c.CRCErrors,
+		Errors:       c.Errors,
+		LastSuccess:  c.LastSuccess,
+	}
+}
+
+// reportCommsHealth sends a commsHealth event every interval.
+func reportCommsHealth(s *commsStats, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := eventhelper.AddEvent(s.healthEvent()); err != nil {
+			log.Errorf("Failed to add commsHealth event: %v", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelStats(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := newCommsStats(func() time.Time { return now })
+	uart := s.channel(channelUART)
+	assert.True(t, uart == s.channel(channelUART))
+
+	uart.sent(true, nil)
+	uart.sent(false, errNACK)
+	uart.retry()
+	uart.sent(false, commsproto.ErrChecksumMismatch)
+	uart.sent(false, errors.New("serial timeout"))
+
+	counts := s.report().Channels[channelUART]
+	assert.Equal(t, channelCounts{
+		FramesSent:   4,
+		AcksReceived: 1,
+		Nacks:        1,
+		Retries:      1,
+		CRCErrors:    1,
+		Errors:       1,
+		LastSuccess:  now,
+		LastError:    "serial timeout",
+	}, counts)
+
+	e := s.healthEvent()
+	assert.Equal(t, "commsHealth", e.Type)
+	details := e.Details[channelUART].(map[string]interface{})
+	assert.Equal(t, uint64(4), details["framesSent"])
+	assert.Equal(t, now, details["lastSuccess"])
+
+	// A nil channel is ignored.
+	var c *channelStats
+	c.sent(true, nil)
+	c.retry()
+}
+
+func TestQueueCountsRetries(t *testing.T) {
+	q, err := loadOutboundQueue(t.TempDir() + "/queue.json")
+	assert.NoError(t, err)
+	q.stats = &channelStats{now: time.Now}
+	now := time.Now()
+	assert.NoError(t, q.add(commsproto.UartMessage{Type: "write"}, now))
+	fail := func(commsproto.UartMessage) error { return errors.New("no response") }
+	_, err = q.deliver(fail, now)
+	assert.NoError(t, err)
+	_, err = q.deliver(fail, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), q.stats.snapshot().Retries)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/classpayload"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+)
+
+// send-test-classification sends a track over the UART the same way a real classification
+// is sent, so an installer can check the comms path before leaving a site. With a loopback
+// adapter on the serial port (TX wired to RX) the frame is read back off the wire, decoded and
+// compared with what was sent. Without one the peripheral has to acknowledge the frame.
+// --loopback fails the test if the frame isn't read back, so a peripheral answering doesn't
+// hide a problem with the adapter.
+
+// testResult is the outcome of sending a test classification.
+type testResult struct {
+	Pass     bool
+	Loopback bool // The frame was read back from the wire.
+	Detail   string
+}
+
+func (r testResult) String() string {
+	status := "FAIL"
+	if r.Pass {
+		status = "PASS"
+	}
+	return fmt.Sprintf("%s: %s", status, r.Detail)
+}
+
+// runTestClassification sends the test classification and prints the result, returning an
+// error if it failed.
+func runTestClassification(config *CommsConfig, args *SendTestClassificationCmd) error {
+	if config.CommsOut != "uart" {
+		return fmt.Errorf("test classifications can only be sent with UART output, comms-out is '%s'", config.CommsOut)
+	}
+	baud := config.BaudRate
+	if baud == 0 {
+		baud = serialhelper.DefaultBaudRate
+	}
+	wiring, err := uartWiringByName(config.UartWiring)
+	if err != nil {
+		return err
+	}
+	species := tracks.Species{args.Species: args.Confidence}
+	result, err := sendTestClassification(species, config.TrackPayload, args.Loopback, func(frame []byte) ([]byte, error) {
+		lease, err := serialhelper.AcquireSerialLease(serialLeaseOwner, 10*time.Second, 5*time.Second, false)
+		if err != nil {
+			return nil, err
+		}
+		defer lease.Release()
+		return serialhelper.SerialSendReceiveBaud(3, wiring.mul0, wiring.mul1, time.Second, baud, frame)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	if !result.Pass {
+		return fmt.Errorf("test classification failed")
+	}
+	return nil
+}
+
+// sendTestClassification sends the track with sendFrame and checks what was read back.
+func sendTestClassification(species tracks.Species, trackPayload string, loopback bool, sendFrame func([]byte) ([]byte, error)) (testResult, error) {
+	message, err := trackMessage(trackingEvent{species: species}, trackPayload)
+	if err != nil {
+		return testResult{}, err
+	}
+	frame, err := commsproto.Encode(message)
+	if err != nil {
+		return testResult{}, err
+	}
+	log.Printf("Sending test classification: %s", frameString(frame))
+	response, err := sendFrame(frame)
+	if err != nil {
+		return testResult{Detail: fmt.Sprintf("failed to send the frame: %v", err)}, nil
+	}
+	return checkTestResponse(message, frame, response, loopback), nil
+}
+
+// checkTestResponse checks the data read back after sending the frame.
+func checkTestResponse(sent commsproto.UartMessage, frame, response []byte, loopback bool) testResult {
+	// Compact frames are raw bytes, so only the start is trimmed until the frame is ruled out.
+	response = bytes.TrimLeftFunc(response, unicode.IsSpace)
+	if len(bytes.TrimSpace(response)) == 0 {
+		return testResult{Detail: "nothing was read back, check the wiring and the peripheral"}
+	}
+	if bytes.HasPrefix(response, frame) {
+		received, err := commsproto.Decode(response[:len(frame)])
+		if err != nil {
+			return testResult{Loopback: true, Detail: fmt.Sprintf("frame read back but can't be decoded: %v", err)}
+		}
+		if !reflect.DeepEqual(*received, sent) {
+			return testResult{Loopback: true, Detail: "frame read back but it doesn't match what was sent"}
+		}
+		decoded, err := describeTrack(*received)
+		if err != nil {
+			return testResult{Loopback: true, Detail: fmt.Sprintf("frame read back but the track can't be decoded: %v", err)}
+		}
+		return testResult{Pass: true, Loopback: true, Detail: "frame read back from the wire, " + decoded}
+	}
+	response = bytes.TrimSpace(response)
+	if loopback {
+		return testResult{Detail: fmt.Sprintf("expected the frame to be read back, got '%s'", response)}
+	}
+	received, err := commsproto.Decode(response)
+	switch {
+	case err != nil:
+		return testResult{Detail: fmt.Sprintf("invalid response '%s': %v", response, err)}
+	case received.Type == commsproto.TypeACK:
+		return testResult{Pass: true, Detail: "peripheral acknowledged the classification"}
+	case received.Type == commsproto.TypeNACK:
+		return testResult{Detail: "peripheral rejected the classification"}
+	default:
+		return testResult{Detail: fmt.Sprintf("unexpected '%s' response", received.Type)}
+	}
+}
+
+// describeTrack decodes the species from a track message.
+func describeTrack(message commsproto.UartMessage) (string, error) {
+	species := map[string]int32{}
+	switch message.Type {
+	case commsproto.TypeCompact:
+		payload, err := classpayload.Decode(message.Payload)
+		if err != nil {
+			return "", err
+		}
+		species = payload.Species
+	default:
+		write := struct {
+			Var string           `json:"var"`
+			Val map[string]int32 `json:"val"`
+		}{}
+		if err := json.Unmarshal([]byte(message.Data), &write); err != nil {
+			return "", err
+		}
+		if write.Var != "track" {
+			return "", fmt.Errorf("expected a track, got '%s'", write.Var)
+		}
+		species = write.Val
+	}
+	names := []string{}
+	for name, confidence := range species {
+		names = append(names, fmt.Sprintf("%s %d", name, confidence))
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%s payload with %s", payloadName(message), strings.Join(names, ", ")), nil
+}
+
+func payloadName(message commsproto.UartMessage) string {
+	if message.Type == commsproto.TypeCompact {
+		return trackPayloadCompact
+	}
+	return trackPayloadJSON
+}
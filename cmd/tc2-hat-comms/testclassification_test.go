@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestClassificationLoopback(t *testing.T) {
+	species := tracks.Species{"possum": 90}
+	echo := func(frame []byte) ([]byte, error) { return frame, nil }
+
+	for _, payload := range []string{trackPayloadJSON, trackPayloadCompact} {
+		result, err := sendTestClassification(species, payload, true, echo)
+		assert.NoError(t, err)
+		assert.True(t, result.Pass, result.Detail)
+		assert.True(t, result.Loopback)
+		assert.Contains(t, result.Detail, "possum 90")
+	}
+
+	// A corrupted frame.
+	result, err := sendTestClassification(species, trackPayloadJSON, true, func(frame []byte) ([]byte, error) {
+		frame[len(frame)-2]++
+		return frame, nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, result.Pass)
+
+	result, err = sendTestClassification(species, trackPayloadJSON, true, func([]byte) ([]byte, error) {
+		return nil, errors.New("serial port busy")
+	})
+	assert.NoError(t, err)
+	assert.False(t, result.Pass)
+}
+
+func TestTestClassificationPeripheral(t *testing.T) {
+	species := tracks.Species{"cat": 80}
+	ack, err := commsproto.Encode(commsproto.UartMessage{Response: true, Type: commsproto.TypeACK})
+	assert.NoError(t, err)
+	reply := func([]byte) ([]byte, error) { return ack, nil }
+
+	result, err := sendTestClassification(species, trackPayloadJSON, false, reply)
+	assert.NoError(t, err)
+	assert.True(t, result.Pass)
+	assert.False(t, result.Loopback)
+
+	// Loopback mode needs the frame read back.
+	result, err = sendTestClassification(species, trackPayloadJSON, true, reply)
+	assert.NoError(t, err)
+	assert.False(t, result.Pass)
+
+	nack, err := commsproto.Encode(commsproto.UartMessage{Response: true, Type: commsproto.TypeNACK})
+	assert.NoError(t, err)
+	result, err = sendTestClassification(species, trackPayloadJSON, false, func([]byte) ([]byte, error) { return nack, nil })
+	assert.NoError(t, err)
+	assert.False(t, result.Pass)
+	assert.Equal(t, "FAIL: peripheral rejected the classification", result.String())
+}
@@ -3,59 +3,281 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/TheCacophonyProject/tc2-hat-controller/classpayload"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/TheCacophonyProject/tc2-hat-controller/selfmonitor"
 	"github.com/TheCacophonyProject/tc2-hat-controller/serialhelper"
-	"periph.io/x/conn/v3/gpio"
 )
 
 // TODO
 
-// UartMessage represents the data structure for communication with a device connected on UART.
-// - ID: Identifier of the message being sent or the message being responded to.
-// - Response: Indicates if the message is a response.
-// - Type: Specifies the type of message (e.g., write, read, command, ACK, NACK).
-// - Data: Contains the actual data payload, which varies depending on the type or response.
-type UartMessage struct {
-	ID       int    `json:"id,omitempty"`
-	Response bool   `json:"response,omitempty"`
-	Type     string `json:"type,omitempty"`
-	Data     string `json:"data,omitempty"`
-}
+const (
+	serialLeaseOwner   = "tc2-hat-comms"
+	serialLeaseTimeout = 30 * time.Second
 
-type Command struct {
-	Command string `json:"command"`
-	Args    string `json:"args,omitempty"`
-}
+	trackPayloadJSON    = "json"
+	trackPayloadCompact = "compact"
+
+	// The output loops wait at most a minute, so they have stopped if they haven't gone
+	// around in this long.
+	loopMaxGap = 5 * time.Minute
+)
+
+var errNACK = errors.New("NACK response")
+
+var (
+	defaultBaudRateCandidates = []int{9600, 4800, 115200}
 
-type Write struct {
-	Var string      `json:"var,omitempty"`
-	Val interface{} `json:"val,omitempty"`
+	// Baud rate used for sending messages, set once the baud rate has been negotiated.
+	uartBaudRate = serialhelper.DefaultBaudRate
+)
+
+// acquireSerialLease waits until tc2-hat-comms has ownership of the serial port.
+func acquireSerialLease() (*serialhelper.SerialLease, error) {
+	for {
+		lease, err := serialhelper.AcquireSerialLease(serialLeaseOwner, serialLeaseTimeout, time.Minute, false)
+		if err == nil {
+			return lease, nil
+		}
+		if _, ok := err.(*serialhelper.SerialUnavailableError); !ok {
+			return nil, err
+		}
+		log.Infof("Waiting for serial port: %v", err)
+	}
 }
 
 func sendTrapActiveState(active bool) error {
 	return sendWriteMessage("active", active)
 }
 
-func processUart() error {
-	// TODO
+func processUart(config *CommsConfig, trackingSignals chan trackingEvent, weather *weatherMonitor, injector *eventInjector) error {
+	if err := setupBaudRate(config); err != nil {
+		return exitcode.Wrap(exitcode.BusError, err)
+	}
+	if len(config.RemoteCommands) > 0 {
+		return processRemoteCommands(config)
+	}
+	return processUartEvents(trackingSignals, weather, injector, config.TrackPayload)
+}
+
+// processUartEvents queues a message for each tracking event, heavy rain change and injected
+// event and delivers the queue over the UART.
+func processUartEvents(trackingSignals chan trackingEvent, weather *weatherMonitor, injector *eventInjector, trackPayload string) error {
+	queue, err := loadOutboundQueue(outboundQueueFile)
+	if err != nil {
+		return err
+	}
+	queue.stats = stats.channel(channelUART)
+	queue.latency = stats.latency
+	for {
+		selfmonitor.Beat("uart", loopMaxGap)
+		next, err := queue.deliver(sendQueuedMessage, time.Now())
+		if err != nil {
+			log.Errorf("Failed to save outbound queue: %v", err)
+		}
+		delay := time.Minute
+		if !next.IsZero() {
+			delay = max(time.Until(next), 0)
+		}
+		select {
+		case t := <-trackingSignals:
+			stats.latency.record(stageDispatch, time.Since(t.received))
+			message, err := trackMessage(t, trackPayload)
+			if err != nil {
+				return err
+			}
+			if err := queue.addTrack(message, t.received, time.Now()); err != nil {
+				log.Errorf("Failed to save outbound queue: %v", err)
+			}
+		case heavy := <-weather.heavyRainChanges():
+			message, err := writeMessage("heavyRain", heavy)
+			if err != nil {
+				return err
+			}
+			if err := queue.add(message, time.Now()); err != nil {
+				log.Errorf("Failed to save outbound queue: %v", err)
+			}
+		case e := <-injector.injected():
+			message, err := writeMessage(e.Type, e.Details)
+			if err != nil {
+				return err
+			}
+			if err := queue.add(message, time.Now()); err != nil {
+				log.Errorf("Failed to save outbound queue: %v", err)
+			}
+		case <-time.After(delay):
+		}
+	}
+}
+
+// trackMessage returns the message for the track, as JSON or as a compact payload.
+func trackMessage(t trackingEvent, trackPayload string) (commsproto.UartMessage, error) {
+	if trackPayload == trackPayloadCompact {
+		// The age of the classification is set when the message is sent.
+		payload, err := classpayload.Encode(t.species, 0)
+		if err != nil {
+			return commsproto.UartMessage{}, err
+		}
+		return commsproto.UartMessage{Type: commsproto.TypeCompact, Payload: payload}, nil
+	}
+	data, err := json.Marshal(&commsproto.Write{Var: "track", Val: t.species})
+	if err != nil {
+		return commsproto.UartMessage{}, err
+	}
+	return commsproto.UartMessage{Type: commsproto.TypeWrite, Data: string(data)}, nil
+}
+
+// writeMessage returns the message to write the value to the variable.
+func writeMessage(name string, val interface{}) (commsproto.UartMessage, error) {
+	data, err := json.Marshal(&commsproto.Write{Var: name, Val: val})
+	if err != nil {
+		return commsproto.UartMessage{}, err
+	}
+	return commsproto.UartMessage{Type: commsproto.TypeWrite, Data: string(data)}, nil
+}
+
+// withAge sets the age of a compact classification to the time since it was queued.
+func withAge(message commsproto.UartMessage, age time.Duration) commsproto.UartMessage {
+	if message.Type != commsproto.TypeCompact {
+		return message
+	}
+	payload, err := classpayload.SetAge(message.Payload, age)
+	if err != nil {
+		log.Errorf("Failed to set the age of a compact payload: %v", err)
+		return message
+	}
+	message.Payload = payload
+	return message
+}
+
+func sendQueuedMessage(message commsproto.UartMessage) error {
+	response, err := sendMessage(message)
+	if err != nil {
+		uartBaudRate = eslBaud.sendFailed(uartBaudRate)
+		return err
+	}
+	if response.Type == "NACK" {
+		return errNACK
+	}
+	return nil
+}
+
+// processRemoteCommands holds the serial port and handles commands sent to it.
+func processRemoteCommands(config *CommsConfig) error {
+	h, err := newRemoteCommandHandler(config)
+	if err != nil {
+		return err
+	}
+	lease, err := acquireSerialLease()
+	if err != nil {
+		return err
+	}
+	lease.KeepAlive()
+	defer lease.Release()
+	serialFile, err := serialhelper.GetSerial(3, uartMux.mul0, uartMux.mul1, time.Second)
+	if err != nil {
+		return err
+	}
+	defer serialhelper.ReleaseSerial(serialFile)
+	port, err := openRemoteCommandPort(uartBaudRate)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	log.Infof("Listening for remote commands %v", config.RemoteCommands)
+	errs := make(chan error, 1)
+	go func() { errs <- listenForRemoteCommands(h, port) }()
+	select {
+	case err := <-errs:
+		return err
+	case <-lease.Revoked():
+		return fmt.Errorf("serial port was taken by another process")
+	}
+}
+
+// setupBaudRate sets the baud rate from the config. If no baud rate is set it will probe
+// the candidate baud rates, lock in the first one that responds to a handshake, and save
+// it to the config.
+func setupBaudRate(config *CommsConfig) error {
+	wiring, err := uartWiringByName(config.UartWiring)
+	if err != nil {
+		return err
+	}
+	if wiring.name != wiringStraight {
+		log.Infof("Using %s UART wiring", wiring.name)
+	}
+	uartMux = wiring
+	if config.BaudRate != 0 {
+		log.Infof("Using UART baud rate %d", config.BaudRate)
+		uartBaudRate = config.BaudRate
+	} else {
+		baud, err := probeBaudRate(config.BaudRateCandidates, handshake)
+		if err != nil {
+			return err
+		}
+		uartBaudRate = baud
+		if err := config.saveBaudRate(baud); err != nil {
+			log.Errorf("Failed to save baud rate to config: %v", err)
+		}
+	}
+	if config.ESLFastBaudRate != 0 && config.ESLFastBaudRate != uartBaudRate {
+		eslBaud = newESLBaudSession(uartBaudRate, config.ESLFastBaudRate)
+		if uartBaudRate, err = eslBaud.negotiate(); err != nil {
+			// The trap is still usable at the slower rate.
+			log.Errorf("Failed to switch AT-ESL trap to baud rate %d: %v", config.ESLFastBaudRate, err)
+		}
+	}
+	return nil
+}
+
+// probeBaudRate tries the handshake at each candidate baud rate, returning the first that works.
+func probeBaudRate(candidates []int, handshake func(baud int) error) (int, error) {
+	for _, baud := range candidates {
+		log.Infof("Probing UART at baud rate %d", baud)
+		err := handshake(baud)
+		if err == nil {
+			log.Infof("Found working UART baud rate %d", baud)
+			return baud, nil
+		}
+		log.Debugf("Handshake failed at baud rate %d: %v", baud, err)
+	}
+	return 0, fmt.Errorf("no response to handshake at baud rates %v", candidates)
+}
+
+// handshake sends a ping command and checks that a valid ACK comes back.
+func handshake(baud int) error {
+	data, err := json.Marshal(&commsproto.Command{Command: "ping"})
+	if err != nil {
+		return err
+	}
+	response, err := sendMessageAtBaud(commsproto.UartMessage{Type: commsproto.TypeCommand, Data: string(data)}, baud)
+	if err != nil {
+		return err
+	}
+	if response.Type != "ACK" {
+		return fmt.Errorf("unexpected handshake response type '%s'", response.Type)
+	}
 	return nil
 }
 
 func sendWriteMessage(varName string, val interface{}) error {
-	data, err := json.Marshal(&Write{
+	data, err := json.Marshal(&commsproto.Write{
 		Var: varName,
 		Val: val,
 	})
 	if err != nil {
 		return err
 	}
-	message := UartMessage{
-		Type: "write",
+	message := commsproto.UartMessage{
+		Type: commsproto.TypeWrite,
 		Data: string(data),
 	}
 	response, err := sendMessage(message)
@@ -63,7 +285,7 @@ func sendWriteMessage(varName string, val interface{}) error {
 		return err
 	}
 	if response.Type == "NACK" {
-		return fmt.Errorf("NACK response")
+		return errNACK
 	}
 	return nil
 }
@@ -74,14 +296,14 @@ func beep() error {
 }
 
 func sendCommandMessage(cmd string) error {
-	data, err := json.Marshal(&Command{
+	data, err := json.Marshal(&commsproto.Command{
 		Command: cmd,
 	})
 	if err != nil {
 		return err
 	}
-	message := UartMessage{
-		Type: "command",
+	message := commsproto.UartMessage{
+		Type: commsproto.TypeCommand,
 		Data: string(data),
 	}
 	response, err := sendMessage(message)
@@ -89,28 +311,20 @@ func sendCommandMessage(cmd string) error {
 		return err
 	}
 	if response.Type == "NACK" {
-		return fmt.Errorf("NACK response")
+		return errNACK
 	}
 	return nil
 }
 
-type Read struct {
-	Var string `json:"var,omitempty"`
-}
-
-type ReadResponse struct {
-	Val string `json:"var,omitempty"`
-}
-
 func sendReadMessage(varName string) (string, error) {
-	data, err := json.Marshal(&Read{
+	data, err := json.Marshal(&commsproto.Read{
 		Var: varName,
 	})
 	if err != nil {
 		return "", err
 	}
-	message := UartMessage{
-		Type: "read",
+	message := commsproto.UartMessage{
+		Type: commsproto.TypeRead,
 		Data: string(data),
 	}
 	response, err := sendMessage(message)
@@ -118,9 +332,9 @@ func sendReadMessage(varName string) (string, error) {
 		return "", err
 	}
 	if response.Type == "NACK" {
-		return "", fmt.Errorf("NACK response")
+		return "", errNACK
 	}
-	readResponse := &ReadResponse{}
+	readResponse := &commsproto.ReadResponse{}
 	if err := json.Unmarshal([]byte(response.Data), readResponse); err != nil {
 		return "", err
 	}
@@ -143,53 +357,45 @@ func checkPIR(oldPirVal int) (int, error) {
 	return newPirVal, nil
 }
 
-func computeChecksum(message []byte) int {
-	checksum := 0
-	for _, b := range message {
-		checksum += int(b)
+func sendMessage(cmd commsproto.UartMessage) (*commsproto.UartMessage, error) {
+	return sendMessageAtBaud(cmd, uartBaudRate)
+}
+
+// frameString returns the frame for logging, compact frames are raw bytes so are shown in hex.
+func frameString(frame []byte) string {
+	if len(frame) > 0 && frame[0] != '<' {
+		return fmt.Sprintf("%x", frame)
 	}
-	return checksum % 256
+	return string(frame)
 }
 
-func sendMessage(cmd UartMessage) (*UartMessage, error) {
-	cmdData, err := json.Marshal(cmd)
+func sendMessageAtBaud(cmd commsproto.UartMessage, baud int) (*commsproto.UartMessage, error) {
+	message, err := commsproto.Encode(cmd)
 	if err != nil {
 		return nil, err
 	}
-	message := fmt.Sprintf("<%s|%d>", cmdData, computeChecksum(cmdData))
-
-	log.Println("Message: ", message)
-	responseData, err := serialhelper.SerialSendReceive(3, gpio.High, gpio.Low, time.Second, []byte(message))
 
+	log.Println("Message: ", frameString(message))
+	lease, err := serialhelper.AcquireSerialLease(serialLeaseOwner, 10*time.Second, 5*time.Second, false)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Response: ", string(responseData))
+	defer lease.Release()
+	responseData, err := serialhelper.SerialSendReceiveBaud(3, uartMux.mul0, uartMux.mul1, time.Second, baud, message)
 
-	if responseData[0] != '<' {
-		return nil, fmt.Errorf("response doesn't start with '<'")
-	}
-	if responseData[len(responseData)-1] != '>' {
-		return nil, fmt.Errorf("response doesn't end with '>'")
-	}
-
-	// Extract and verify message and checksum
-	responseData = responseData[1 : len(responseData)-1]
-	parts := bytes.Split(responseData, []byte("|"))
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid response format")
-	}
-	log.Println("Response:", string(parts[0]))
-	receivedChecksum, err := strconv.Atoi(string(parts[1]))
 	if err != nil {
+		stats.channel(channelUART).sent(false, err)
 		return nil, err
 	}
-	if computeChecksum(parts[0]) != receivedChecksum {
-		return nil, fmt.Errorf("checksum mismatch")
+	log.Println("Response: ", string(responseData))
+	response, err := commsproto.Decode(responseData)
+	switch {
+	case err != nil:
+		stats.channel(channelUART).sent(false, err)
+	case response.Type == commsproto.TypeNACK:
+		stats.channel(channelUART).sent(false, errNACK)
+	default:
+		stats.channel(channelUART).sent(response.Type == commsproto.TypeACK, nil)
 	}
-
-	// Unmarshal response to a Message
-	responseMessage := &UartMessage{}
-	log.Println(string(parts[0]))
-	return responseMessage, json.Unmarshal(parts[0], responseMessage)
+	return response, err
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/classpayload"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/commsproto"
+	"github.com/TheCacophonyProject/tc2-hat-controller/tracks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeBaudRate(t *testing.T) {
+	tried := []int{}
+	handshake := func(baud int) error {
+		tried = append(tried, baud)
+		if baud == 115200 {
+			return nil
+		}
+		return errors.New("no response")
+	}
+
+	baud, err := probeBaudRate([]int{4800, 9600, 115200, 19200}, handshake)
+	assert.NoError(t, err)
+	assert.Equal(t, 115200, baud)
+	assert.Equal(t, []int{4800, 9600, 115200}, tried)
+
+	_, err = probeBaudRate([]int{4800, 9600}, handshake)
+	assert.Error(t, err)
+}
+
+func TestCompactTrackMessage(t *testing.T) {
+	track := trackingEvent{species: tracks.Species{"possum": 87}}
+	message, err := trackMessage(track, trackPayloadJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, "write", message.Type)
+
+	message, err = trackMessage(track, trackPayloadCompact)
+	assert.NoError(t, err)
+	assert.Equal(t, commsproto.TypeCompact, message.Type)
+
+	message = withAge(message, 90*time.Second)
+	decoded, err := classpayload.Decode(message.Payload)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int32{"possum": 87}, decoded.Species)
+	assert.Equal(t, 90*time.Second, decoded.Age)
+
+	// The payload goes on the wire as it is.
+	frame, err := commsproto.Encode(message)
+	assert.NoError(t, err)
+	assert.Equal(t, message.Payload, frame[2:len(frame)-1])
+}
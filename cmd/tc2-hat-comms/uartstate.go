@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// The baud rate found by probing and the wiring found by detect-esl are learnt by the service,
+// so they are saved to a file of its own next to the config rather than in the config. The
+// baud-rate and aux-uart-wiring set in the comms section of the config are used over them.
+const uartStateFileName = "comms-uart.json"
+
+type uartState struct {
+	BaudRate int    `json:"baudRate,omitempty"`
+	Wiring   string `json:"wiring,omitempty"`
+}
+
+// loadUARTState returns the learnt UART settings, nothing is learnt if the file doesn't exist.
+func loadUARTState(file string) (uartState, error) {
+	s := uartState{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+func saveUARTState(file string, s uartState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// apply fills in the settings that aren't set in the config with the learnt ones.
+func (s uartState) apply(uart *uartConfig) {
+	if uart.BaudRate == 0 {
+		uart.BaudRate = s.BaudRate
+	}
+	if uart.Wiring == "" {
+		uart.Wiring = s.Wiring
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUARTStateRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), uartStateFileName)
+	s, err := loadUARTState(file)
+	assert.NoError(t, err)
+	assert.Equal(t, uartState{}, s)
+
+	c := &CommsConfig{uartStateFile: file}
+	assert.NoError(t, c.saveESLDetection(eslDetection{Wiring: wiringSwapped, Baud: 4800}))
+	assert.NoError(t, c.saveBaudRate(9600))
+	assert.Equal(t, 9600, c.BaudRate)
+	assert.Equal(t, wiringSwapped, c.UartWiring)
+
+	s, err = loadUARTState(file)
+	assert.NoError(t, err)
+	assert.Equal(t, uartState{BaudRate: 9600, Wiring: wiringSwapped}, s)
+
+	// Only used where the config doesn't set them.
+	uart := uartConfig{}
+	s.apply(&uart)
+	assert.Equal(t, 9600, uart.BaudRate)
+	assert.Equal(t, wiringSwapped, uart.Wiring)
+	uart = uartConfig{BaudRate: 115200, Wiring: wiringStraight}
+	s.apply(&uart)
+	assert.Equal(t, 115200, uart.BaudRate)
+	assert.Equal(t, wiringStraight, uart.Wiring)
+}
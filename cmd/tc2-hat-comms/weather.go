@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/rainstate"
+	"github.com/tarm/serial"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
+)
+
+// A rain gauge or a serial weather module can be connected so the trap isn't triggered
+// during heavy rain, when rain on the lens makes the classifications less reliable.
+// A tipping bucket rain gauge is read as pulses on a GPIO pin. A weather module on a serial
+// port sends a line of JSON for each reading, with the rain rate in mm/h as "rainRate" and
+// any other readings (temperature, wind...) as numbers that are logged with the events.
+// Heavy rain is cleared once the rain rate has been below the threshold for clear-duration.
+// The heavy rain state is saved with the events for the other services, see rainstate.
+const (
+	weatherConfigKey          = "weather"
+	weatherSourceGPIO         = "gpio"
+	weatherSourceSerial       = "serial"
+	defaultMMPerPulse         = 0.2794 // Common tipping bucket rain gauges.
+	defaultHeavyRainMMPerHour = 4.0
+	defaultRainWindow         = 15 * time.Minute
+	defaultRainClearDuration  = 30 * time.Minute
+	defaultWeatherSerialBaud  = 9600
+	rainPulseDebounce         = 50 * time.Millisecond
+	weatherCheckInterval      = time.Minute
+	weatherEventInterval      = time.Hour
+)
+
+// weatherConfig is read from the "weather" section of the config.
+type weatherConfig struct {
+	Source             string        `mapstructure:"source"` // "gpio", "serial" or empty for no weather input.
+	Pin                string        `mapstructure:"pin"`
+	MMPerPulse         float64       `mapstructure:"mm-per-pulse"`
+	SerialDevice       string        `mapstructure:"serial-device"`
+	SerialBaud         int           `mapstructure:"serial-baud"`
+	HeavyRainMMPerHour float64       `mapstructure:"heavy-rain-mm-per-hour"`
+	RainWindow         time.Duration `mapstructure:"rain-window"`
+	ClearDuration      time.Duration `mapstructure:"clear-duration"`
+	SuppressTrap       bool          `mapstructure:"suppress-trap"`
+}
+
+func defaultWeatherConfig() weatherConfig {
+	return weatherConfig{
+		MMPerPulse:         defaultMMPerPulse,
+		SerialBaud:         defaultWeatherSerialBaud,
+		HeavyRainMMPerHour: defaultHeavyRainMMPerHour,
+		RainWindow:         defaultRainWindow,
+		ClearDuration:      defaultRainClearDuration,
+		SuppressTrap:       true,
+	}
+}
+
+func loadWeatherConfig(conf *goconfig.Config) (weatherConfig, error) {
+	w := defaultWeatherConfig()
+	if err := configcompat.Unmarshal(conf, weatherConfigKey, &w); err != nil {
+		return w, err
+	}
+	switch w.Source {
+	case "", weatherSourceGPIO, weatherSourceSerial:
+	default:
+		return w, fmt.Errorf("unknown weather source '%s'", w.Source)
+	}
+	if w.RainWindow <= 0 {
+		w.RainWindow = defaultRainWindow
+	}
+	return w, nil
+}
+
+type weatherState struct {
+	RainRate float64            `json:"rainRateMMPerHour"`
+	Heavy    bool               `json:"heavyRain"`
+	Readings map[string]float64 `json:"readings,omitempty"`
+}
+
+// weatherMonitor tracks the rain rate from the weather input and decides if it is raining heavily.
+type weatherMonitor struct {
+	config weatherConfig
+	now    func() time.Time
+	// Sent the new heavy rain state when it changes.
+	changes chan bool
+	// Shares the rain with the other services, replaced in the tests.
+	saveRain func(rainstate.State) error
+
+	mu           sync.Mutex
+	pulses       []time.Time
+	lastPulse    time.Time
+	moduleRate   float64
+	moduleRead   time.Time
+	readings     map[string]float64
+	heavy        bool
+	lastHeavyAt  time.Time
+	lastEventAt  time.Time
+	currentState weatherState
+}
+
+func newWeatherMonitor(config weatherConfig) *weatherMonitor {
+	return &weatherMonitor{
+		config:   config,
+		now:      time.Now,
+		changes:  make(chan bool, 1),
+		saveRain: rainstate.Save,
+	}
+}
+
+// startWeatherMonitor starts reading from the configured weather input. Returns nil if
+// there is no weather input.
+func startWeatherMonitor(config weatherConfig) (*weatherMonitor, error) {
+	if config.Source == "" {
+		return nil, nil
+	}
+	m := newWeatherMonitor(config)
+	switch config.Source {
+	case weatherSourceGPIO:
+		if _, err := host.Init(); err != nil {
+			return nil, fmt.Errorf("failed to initialize periph: %v", err)
+		}
+		pin := gpioreg.ByName(config.Pin)
+		if pin == nil {
+			return nil, fmt.Errorf("failed to find rain gauge pin '%s'", config.Pin)
+		}
+		if err := pin.In(gpio.PullUp, gpio.FallingEdge); err != nil {
+			return nil, fmt.Errorf("failed to set up rain gauge pin: %v", err)
+		}
+		go m.countPulses(pin)
+	case weatherSourceSerial:
+		port, err := serial.OpenPort(&serial.Config{Name: config.SerialDevice, Baud: config.SerialBaud})
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := m.readModule(port); err != nil {
+				log.Errorf("Error reading weather module: %v", err)
+			}
+		}()
+	}
+	log.Infof("Reading weather from %s input", config.Source)
+	go func() {
+		for {
+			m.update()
+			time.Sleep(weatherCheckInterval)
+		}
+	}()
+	return m, nil
+}
+
+// countPulses records each tip of the rain gauge bucket.
+func (m *weatherMonitor) countPulses(pin gpio.PinIn) {
+	for {
+		if pin.WaitForEdge(-1) {
+			m.addPulse(m.now())
+		}
+	}
+}
+
+func (m *weatherMonitor) addPulse(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.Sub(m.lastPulse) < rainPulseDebounce {
+		return
+	}
+	m.lastPulse = t
+	m.pulses = append(m.pulses, t)
+}
+
+// readModule reads the lines of JSON sent by a weather module.
+func (m *weatherMonitor) readModule(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		readings, err := parseWeatherLine(scanner.Bytes())
+		if err != nil {
+			log.Debugf("Ignoring weather module line: %v", err)
+			continue
+		}
+		m.setReadings(readings, m.now())
+	}
+	return scanner.Err()
+}
+
+func parseWeatherLine(line []byte) (map[string]float64, error) {
+	readings := map[string]float64{}
+	if err := json.Unmarshal(line, &readings); err != nil {
+		return nil, err
+	}
+	if _, ok := readings["rainRate"]; !ok {
+		return nil, fmt.Errorf("no rainRate in '%s'", line)
+	}
+	return readings, nil
+}
+
+func (m *weatherMonitor) setReadings(readings map[string]float64, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.moduleRate = readings["rainRate"]
+	m.moduleRead = t
+	m.readings = readings
+}
+
+// rainRate returns the rain rate in mm/h over the rain window.
+func (m *weatherMonitor) rainRate(now time.Time) float64 {
+	if m.config.Source == weatherSourceSerial {
+		if now.Sub(m.moduleRead) > m.config.RainWindow {
+			return 0 // Stale, the module has stopped sending.
+		}
+		return m.moduleRate
+	}
+	start := now.Add(-m.config.RainWindow)
+	i := 0
+	for i < len(m.pulses) && m.pulses[i].Before(start) {
+		i++
+	}
+	m.pulses = m.pulses[i:]
+	return float64(len(m.pulses)) * m.config.MMPerPulse / m.config.RainWindow.Hours()
+}
+
+// update recalculates the weather state, reporting an event when heavy rain starts or
+// stops and a weather event every weatherEventInterval.
+func (m *weatherMonitor) update() weatherState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	rate := m.rainRate(now)
+	if rate >= m.config.HeavyRainMMPerHour {
+		m.lastHeavyAt = now
+	}
+	heavy := !m.lastHeavyAt.IsZero() && now.Sub(m.lastHeavyAt) < m.config.ClearDuration
+	m.currentState = weatherState{
+		RainRate: math.Round(rate*10) / 10,
+		Heavy:    heavy,
+		Readings: m.readings,
+	}
+	if heavy != m.heavy {
+		m.heavy = heavy
+		eventType := eventhelper.HeavyRainStopped
+		if heavy {
+			eventType = eventhelper.HeavyRainStarted
+		}
+		log.Infof("%s, rain rate %.1fmm/h", eventType, rate)
+		m.report(eventType, now)
+		select {
+		case m.changes <- heavy:
+		default:
+		}
+	} else if now.Sub(m.lastEventAt) >= weatherEventInterval {
+		m.report(eventhelper.Weather, now)
+	}
+	return m.currentState
+}
+
+func (m *weatherMonitor) report(eventType string, now time.Time) {
+	m.lastEventAt = now
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventType, now, eventhelper.WeatherReading{
+		RainRate:  m.currentState.RainRate,
+		HeavyRain: m.currentState.Heavy,
+		Source:    m.config.Source,
+		Readings:  m.currentState.Readings,
+	})); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+	if err := m.saveRain(rainstate.State{
+		Heavy:    m.currentState.Heavy,
+		RainRate: m.currentState.RainRate,
+		Updated:  now,
+	}); err != nil {
+		log.Errorf("Error saving rain state: %v", err)
+	}
+}
+
+// suppressTrap returns true if the trap shouldn't be triggered because of heavy rain.
+// Safe to call on a nil monitor when there is no weather input.
+func (m *weatherMonitor) suppressTrap() bool {
+	if m == nil || !m.config.SuppressTrap {
+		return false
+	}
+	return m.update().Heavy
+}
+
+// heavyRainChanges returns a channel that is sent the heavy rain state when it changes,
+// nil if there is no weather input.
+func (m *weatherMonitor) heavyRainChanges() <-chan bool {
+	if m == nil {
+		return nil
+	}
+	return m.changes
+}
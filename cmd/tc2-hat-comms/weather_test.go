@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/rainstate"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWeatherMonitor(source string, now *time.Time) *weatherMonitor {
+	config := defaultWeatherConfig()
+	config.Source = source
+	m := newWeatherMonitor(config)
+	m.now = func() time.Time { return *now }
+	m.saveRain = func(rainstate.State) error { return nil }
+	return m
+}
+
+func TestRainGaugeHeavyRain(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	m := newTestWeatherMonitor(weatherSourceGPIO, &now)
+	saved := []rainstate.State{}
+	m.saveRain = func(s rainstate.State) error {
+		saved = append(saved, s)
+		return nil
+	}
+
+	assert.False(t, m.suppressTrap())
+	assert.Equal(t, "weather", events.Events()[0].Type)
+
+	// 4 tips in 15 minutes is about 4.5mm/h, a bounce is ignored.
+	for i := 0; i < 4; i++ {
+		m.addPulse(now.Add(time.Duration(i) * time.Minute))
+	}
+	m.addPulse(now.Add(3*time.Minute + 10*time.Millisecond))
+	now = now.Add(5 * time.Minute)
+	assert.True(t, m.suppressTrap())
+	assert.Equal(t, "heavyRainStarted", events.Events()[1].Type)
+	assert.True(t, <-m.heavyRainChanges())
+	if assert.Len(t, saved, 2) {
+		assert.True(t, saved[1].Heavy)
+		assert.Equal(t, now, saved[1].Updated)
+	}
+
+	// Rain has stopped but heavy rain isn't cleared until clear-duration has passed.
+	now = now.Add(20 * time.Minute)
+	assert.InDelta(t, 0, m.update().RainRate, 0.01)
+	assert.True(t, m.suppressTrap())
+	now = now.Add(20 * time.Minute)
+	assert.False(t, m.suppressTrap())
+	assert.Equal(t, "heavyRainStopped", events.Events()[2].Type)
+
+	var nilMonitor *weatherMonitor
+	assert.False(t, nilMonitor.suppressTrap())
+	assert.Nil(t, nilMonitor.heavyRainChanges())
+}
+
+func TestWeatherModule(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	m := newTestWeatherMonitor(weatherSourceSerial, &now)
+
+	input := "garbage\n{\"temp\": 12.5}\n{\"rainRate\": 8.2, \"temp\": 11.0, \"wind\": 4}\n"
+	assert.NoError(t, m.readModule(strings.NewReader(input)))
+	state := m.update()
+	assert.True(t, state.Heavy)
+	assert.Equal(t, 8.2, state.RainRate)
+	assert.Equal(t, "heavyRainStarted", events.Events()[0].Type)
+	assert.Equal(t, 11.0, events.Events()[0].Details["temp"])
+
+	// Readings go stale if the module stops sending.
+	now = now.Add(time.Hour)
+	assert.Equal(t, 0.0, m.update().RainRate)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// Files written by the hat services, these need to match the paths in the services.
+const (
+	temperatureCSVFile  = "/var/log/temperature.csv"
+	batteryReadingsFile = "/var/log/battery-readings.csv"
+	batteryStateFile    = "/etc/cacophony/battery_state.json"
+)
+
+// fileAudit is the result of auditing one file.
+type fileAudit struct {
+	File        string `json:"file"`
+	Lines       int    `json:"lines,omitempty"`
+	BadLines    int    `json:"badLines,omitempty"`
+	Quarantined string `json:"quarantined,omitempty"` // Where corrupt data was moved to.
+	Error       string `json:"error,omitempty"`
+}
+
+func (f fileAudit) ok() bool {
+	return f.BadLines == 0 && f.Quarantined == "" && f.Error == ""
+}
+
+// runAudit checks all the files the hat services persist, repairing or quarantining
+// any that are corrupt, then reports a summary event.
+func runAudit() error {
+	results := []fileAudit{
+		// Readings estimated from the SoC have an extra column, see tc2-hat-temp.
+		auditCSV(temperatureCSVFile, 2, 3),
+		// Older battery readings don't have the quality flags.
+		auditCSV(batteryReadingsFile, 3, 4),
+		auditJSON(batteryStateFile),
+		auditEEPROM(),
+	}
+	audit := eventhelper.DataAudit{}
+	for _, r := range results {
+		audit.Files = append(audit.Files, eventhelper.AuditedFile(r))
+		if r.ok() {
+			log.Printf("%s: OK", r.File)
+			continue
+		}
+		audit.Problems++
+		log.Printf("%s: %d bad lines, quarantined '%s', error '%s'", r.File, r.BadLines, r.Quarantined, r.Error)
+	}
+	log.Printf("Audit found problems with %d of %d files", audit.Problems, len(results))
+	return eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.DataAudited, time.Now(), audit))
+}
+
+// validCSVLine checks a line is a timestamp followed by one of the numbers of float values.
+func validCSVLine(line string, values ...int) bool {
+	fields := strings.Split(line, ",")
+	if !slices.Contains(values, len(fields)-1) {
+		return false
+	}
+	if _, err := csvtime.Parse(fields[0]); err != nil {
+		return false
+	}
+	for _, f := range fields[1:] {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(f), 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// auditCSV removes lines that are truncated or garbled from the CSV file, the bad lines
+// are appended to a .corrupt file next to it.
+func auditCSV(filePath string, values ...int) fileAudit {
+	result := fileAudit{File: filePath}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	good := []string{}
+	bad := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			// A header, such as the schema of the battery readings.
+			good = append(good, line)
+			continue
+		}
+		result.Lines++
+		if validCSVLine(line, values...) {
+			good = append(good, line)
+		} else {
+			bad = append(bad, line)
+		}
+	}
+	err = scanner.Err()
+	file.Close()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.BadLines = len(bad)
+	if len(bad) == 0 {
+		return result
+	}
+
+	quarantine := filePath + ".corrupt"
+	if err := appendLines(quarantine, bad); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Quarantined = quarantine
+	tmpFile := filePath + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(strings.Join(good, "\n")+"\n"), 0644); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := os.Rename(tmpFile, filePath); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func appendLines(filePath string, lines []string) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+// auditJSON moves a JSON file that can't be parsed aside so the service starts with a new one.
+func auditJSON(filePath string) fileAudit {
+	result := fileAudit{File: filePath}
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if json.Valid(data) {
+		return result
+	}
+	quarantine := fmt.Sprintf("%s.corrupt-%s", filePath, time.Now().Format("20060102-150405"))
+	if err := os.Rename(filePath, quarantine); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Quarantined = quarantine
+	return result
+}
+
+// auditEEPROM checks the EEPROM checksum and rewrites the EEPROM data file from the chip
+// if the file doesn't match.
+func auditEEPROM() fileAudit {
+	result := fileAudit{File: eeprom.EEPROM_FILE}
+	err := eeprom.VerifyEEPROM()
+	if err == nil {
+		return result
+	}
+	log.Printf("EEPROM check failed, rewriting the EEPROM data file: %v", err)
+	result.Error = err.Error()
+	if err := eeprom.RepairEEPROMFile(); err != nil {
+		result.Error += fmt.Sprintf(", repair failed: %v", err)
+		return result
+	}
+	result.Quarantined = eeprom.EEPROM_FILE + ".*.bak"
+	return result
+}
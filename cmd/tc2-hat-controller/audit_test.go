@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditCSV(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "battery-readings.csv")
+	lines := []string{
+		"# battery-readings schema 2: time, hv, lv, rtc, flags",
+		"2024-05-01 10:00:00, 12.10, 12.05, 3.01",
+		"2024-05-01 10:02:00, 12.09, 12.0",      // Truncated.
+		"2024-05-01 10:04:00, 12.08, abc, 3.01", // Garbled.
+		"2024-05-01 10:06:00, 12.07, 12.02, 3.01, 2",
+	}
+	assert.NoError(t, os.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644))
+
+	result := auditCSV(file, 3, 4)
+	assert.Equal(t, 4, result.Lines)
+	assert.Equal(t, 2, result.BadLines)
+	assert.Empty(t, result.Error)
+
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, lines[0]+"\n"+lines[1]+"\n"+lines[4]+"\n", string(data))
+	corrupt, err := os.ReadFile(result.Quarantined)
+	assert.NoError(t, err)
+	assert.Equal(t, lines[2]+"\n"+lines[3]+"\n", string(corrupt))
+
+	// Nothing to do the second time.
+	assert.True(t, auditCSV(file, 3, 4).ok())
+}
+
+func TestAuditJSON(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "battery_state.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"chemistry": "li-ion"}`), 0644))
+	assert.True(t, auditJSON(file).ok())
+
+	assert.NoError(t, os.WriteFile(file, []byte(`{"chemistry": "li-`), 0644))
+	result := auditJSON(file)
+	assert.NotEmpty(t, result.Quarantined)
+	assert.NoFileExists(t, file)
+	assert.FileExists(t, result.Quarantined)
+
+	assert.True(t, auditJSON(filepath.Join(dir, "missing.json")).ok())
+}
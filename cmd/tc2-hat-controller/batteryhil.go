@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+)
+
+// The battery hardware-in-the-loop test drives a bench PSU in place of the battery, stepping
+// the voltage along a discharge curve, while tc2-hat-attiny reads the real ADC values. The
+// readings and detected battery state it saves are then checked against what was emulated, so
+// the battery detection can be regression tested on real hardware.
+
+const (
+	defaultHILStep             = 10 * time.Minute
+	defaultHILSettle           = 5 * time.Minute
+	defaultHILCurrentLimit     = 3
+	defaultHILPercentTolerance = 10
+	defaultHILVoltageTolerance = 0.3
+)
+
+// hilScenarios are the scenarios to run, loaded from JSON.
+type hilScenarios struct {
+	Name      string        `json:"name"`
+	Scenarios []hilScenario `json:"scenarios"`
+}
+
+// hilScenario discharges the emulated battery from StartPercent to EndPercent over Duration.
+type hilScenario struct {
+	Name         string      `json:"name"`
+	Chemistry    string      `json:"chemistry"`       // Curve to emulate, li-ion or lime.
+	Curve        *hilCurve   `json:"curve,omitempty"` // Curve for other chemistries.
+	StartPercent float64     `json:"startPercent"`
+	EndPercent   float64     `json:"endPercent"`
+	Duration     duration    `json:"duration"`
+	Step         duration    `json:"step,omitempty"`
+	Settle       duration    `json:"settle,omitempty"` // Time for the battery to be detected before checking.
+	CurrentLimit float64     `json:"currentLimit,omitempty"`
+	Expect       hilExpected `json:"expect"`
+}
+
+type hilCurve struct {
+	Voltages []float32 `json:"voltages"`
+	Percents []float32 `json:"percents"`
+}
+
+// hilExpected is what tc2-hat-attiny should detect, Chemistry is optional.
+type hilExpected struct {
+	Chemistry        string  `json:"chemistry,omitempty"`
+	PercentTolerance float64 `json:"percentTolerance,omitempty"`
+	VoltageTolerance float64 `json:"voltageTolerance,omitempty"`
+}
+
+type hilReport struct {
+	Name      string              `json:"name"`
+	Passed    bool                `json:"passed"`
+	Scenarios []hilScenarioReport `json:"scenarios"`
+}
+
+type hilScenarioReport struct {
+	Name              string    `json:"name"`
+	Start             time.Time `json:"start"`
+	End               time.Time `json:"end"`
+	Samples           int       `json:"samples"`
+	VoltageFailures   int       `json:"voltageFailures"`
+	PercentFailures   int       `json:"percentFailures"`
+	ChemistryFailures int       `json:"chemistryFailures"`
+	MaxVoltageError   float64   `json:"maxVoltageError"`
+	MaxPercentError   float64   `json:"maxPercentError"`
+	DetectedChemistry string    `json:"detectedChemistry,omitempty"`
+	Errors            []string  `json:"errors,omitempty"`
+	Passed            bool      `json:"passed"`
+}
+
+// hilBatteryState is the part of the battery state saved by tc2-hat-attiny that is checked.
+type hilBatteryState struct {
+	Chemistry   string    `json:"chemistry"`
+	LastPercent float64   `json:"lastPercent"`
+	LastReading time.Time `json:"lastReading"`
+}
+
+// hilRunner runs the scenarios, the readings, clock and sleep can be replaced for testing.
+type hilRunner struct {
+	psu         benchPSU
+	readVoltage func() (time.Time, float64, error)
+	readState   func() (hilBatteryState, error)
+	now         func() time.Time
+	sleep       func(time.Duration)
+}
+
+func (s hilScenario) curve() (hilCurve, error) {
+	if s.Curve != nil {
+		if len(s.Curve.Voltages) < 2 || len(s.Curve.Voltages) != len(s.Curve.Percents) {
+			return hilCurve{}, fmt.Errorf("curve needs matching voltages and percents")
+		}
+		return *s.Curve, nil
+	}
+	switch s.Chemistry {
+	case "li-ion":
+		return hilCurve{goconfig.LiIonVoltage, goconfig.LiIonPercent}, nil
+	case "lime":
+		return hilCurve{goconfig.LimeVoltage, goconfig.LimePercent}, nil
+	}
+	return hilCurve{}, fmt.Errorf("no curve for chemistry '%s'", s.Chemistry)
+}
+
+// voltage interpolates the voltage for the percentage of charge, the percents are ascending.
+func (c hilCurve) voltage(percent float64) float64 {
+	last := len(c.Percents) - 1
+	if percent <= float64(c.Percents[0]) {
+		return float64(c.Voltages[0])
+	}
+	if percent >= float64(c.Percents[last]) {
+		return float64(c.Voltages[last])
+	}
+	i := 1
+	for float64(c.Percents[i]) < percent {
+		i++
+	}
+	p0, p1 := float64(c.Percents[i-1]), float64(c.Percents[i])
+	v0, v1 := float64(c.Voltages[i-1]), float64(c.Voltages[i])
+	return v0 + (v1-v0)*(percent-p0)/(p1-p0)
+}
+
+func (r *hilRunner) run(scenarios hilScenarios) hilReport {
+	report := hilReport{Name: scenarios.Name, Passed: true}
+	for _, s := range scenarios.Scenarios {
+		log.Printf("Starting scenario '%s'", s.Name)
+		sr := r.runScenario(s)
+		if sr.Passed {
+			log.Printf("Scenario '%s' passed", s.Name)
+		} else {
+			log.Printf("Scenario '%s' failed", s.Name)
+			report.Passed = false
+		}
+		report.Scenarios = append(report.Scenarios, sr)
+	}
+	if err := r.psu.setOutput(false); err != nil {
+		log.Printf("Failed to turn off PSU output: %v", err)
+	}
+	return report
+}
+
+func (r *hilRunner) runScenario(s hilScenario) (sr hilScenarioReport) {
+	sr = hilScenarioReport{Name: s.Name, Start: r.now()}
+	defer func() { sr.End = r.now() }()
+	fail := func(err error) hilScenarioReport {
+		sr.Errors = append(sr.Errors, err.Error())
+		return sr
+	}
+
+	curve, err := s.curve()
+	if err != nil {
+		return fail(err)
+	}
+	step := time.Duration(s.Step)
+	if step <= 0 {
+		step = defaultHILStep
+	}
+	settle := time.Duration(s.Settle)
+	if settle <= 0 {
+		settle = defaultHILSettle
+	}
+	currentLimit := s.CurrentLimit
+	if currentLimit <= 0 {
+		currentLimit = defaultHILCurrentLimit
+	}
+	expect := s.Expect
+	if expect.PercentTolerance <= 0 {
+		expect.PercentTolerance = defaultHILPercentTolerance
+	}
+	if expect.VoltageTolerance <= 0 {
+		expect.VoltageTolerance = defaultHILVoltageTolerance
+	}
+
+	if err := r.psu.setCurrentLimit(currentLimit); err != nil {
+		return fail(err)
+	}
+	if err := r.psu.setVoltage(curve.voltage(s.StartPercent)); err != nil {
+		return fail(err)
+	}
+	if err := r.psu.setOutput(true); err != nil {
+		return fail(err)
+	}
+	r.sleep(settle)
+
+	duration := time.Duration(s.Duration)
+	for elapsed := time.Duration(0); ; elapsed += step {
+		percent := s.EndPercent
+		if elapsed < duration {
+			percent = s.StartPercent + (s.EndPercent-s.StartPercent)*float64(elapsed)/float64(duration)
+		}
+		volts := curve.voltage(percent)
+		if err := r.psu.setVoltage(volts); err != nil {
+			return fail(err)
+		}
+		stepStart := r.now()
+		r.sleep(step)
+		r.check(&sr, expect, stepStart, volts, percent)
+		if elapsed >= duration {
+			break
+		}
+	}
+	sr.Passed = sr.Samples > 0 && len(sr.Errors) == 0 &&
+		sr.VoltageFailures == 0 && sr.PercentFailures == 0 && sr.ChemistryFailures == 0
+	return sr
+}
+
+// check compares the readings made since the step started with what was emulated.
+func (r *hilRunner) check(sr *hilScenarioReport, expect hilExpected, stepStart time.Time, volts, percent float64) {
+	addError := func(err error) {
+		if len(sr.Errors) < 10 {
+			sr.Errors = append(sr.Errors, err.Error())
+		}
+	}
+	readingTime, adcVolts, err := r.readVoltage()
+	if err != nil {
+		addError(err)
+		return
+	}
+	if readingTime.Before(stepStart) {
+		addError(fmt.Errorf("no battery reading since %s", stepStart.Format(time.DateTime)))
+		return
+	}
+	sr.Samples++
+	voltageError := math.Abs(adcVolts - volts)
+	sr.MaxVoltageError = max(sr.MaxVoltageError, voltageError)
+	if voltageError > expect.VoltageTolerance {
+		sr.VoltageFailures++
+	}
+
+	state, err := r.readState()
+	if err != nil {
+		addError(err)
+		return
+	}
+	if state.LastReading.Before(stepStart) {
+		// The battery state is only saved when it changes.
+		return
+	}
+	sr.DetectedChemistry = state.Chemistry
+	if expect.Chemistry != "" && state.Chemistry != expect.Chemistry {
+		sr.ChemistryFailures++
+	}
+	percentError := math.Abs(state.LastPercent - percent)
+	sr.MaxPercentError = max(sr.MaxPercentError, percentError)
+	if percentError > expect.PercentTolerance {
+		sr.PercentFailures++
+	}
+}
+
+// readHILVoltage returns the last battery voltage read by tc2-hat-attiny. The PSU is only
+// connected to one of the battery rails so the highest one is used.
+func readHILVoltage() (time.Time, float64, error) {
+	t, values, err := readLastCSVLine(batteryReadingsFile)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if len(values) < 2 {
+		return time.Time{}, 0, fmt.Errorf("no battery voltages in %s", batteryReadingsFile)
+	}
+	return t, max(values[0], values[1]), nil
+}
+
+func readHILBatteryState() (hilBatteryState, error) {
+	state := hilBatteryState{}
+	data, err := os.ReadFile(batteryStateFile)
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+// runBatteryHIL runs the scenarios against the PSU and writes the report as JSON.
+func runBatteryHIL(args *BatteryHIL) error {
+	data, err := os.ReadFile(args.Scenarios)
+	if err != nil {
+		return err
+	}
+	scenarios := hilScenarios{}
+	if err := json.Unmarshal(data, &scenarios); err != nil {
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("failed to parse scenarios: %v", err))
+	}
+	psu, err := openSCPIPSU(args.PSU)
+	if err != nil {
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
+	}
+	defer psu.Close()
+
+	r := &hilRunner{
+		psu:         psu,
+		readVoltage: readHILVoltage,
+		readState:   readHILBatteryState,
+		now:         time.Now,
+		sleep:       time.Sleep,
+	}
+	report := r.run(scenarios)
+
+	reportData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if args.Report == "" {
+		fmt.Println(string(reportData))
+	} else if err := os.WriteFile(args.Report, reportData, 0644); err != nil {
+		return err
+	}
+	if !report.Passed {
+		return fmt.Errorf("battery scenarios '%s' failed", scenarios.Name)
+	}
+	log.Printf("Battery scenarios '%s' passed", scenarios.Name)
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHIL is a PSU and a device reading it through an ADC with an offset.
+type fakeHIL struct {
+	now       time.Time
+	volts     float64
+	on        bool
+	adcOffset float64
+}
+
+func (f *fakeHIL) setVoltage(volts float64) error     { f.volts = volts; return nil }
+func (f *fakeHIL) setCurrentLimit(amps float64) error { return nil }
+func (f *fakeHIL) setOutput(on bool) error            { f.on = on; return nil }
+func (f *fakeHIL) measureVoltage() (float64, error)   { return f.volts, nil }
+
+func (f *fakeHIL) readVoltage() (time.Time, float64, error) {
+	if !f.on {
+		return f.now, 0, nil
+	}
+	return f.now, f.volts + f.adcOffset, nil
+}
+
+// readState detects the battery from the ADC voltage by inverting the li-ion curve.
+func (f *fakeHIL) readState() (hilBatteryState, error) {
+	_, volts, _ := f.readVoltage()
+	s, _ := hilScenario{Chemistry: "li-ion"}.curve()
+	inverted := hilCurve{Voltages: s.Percents, Percents: s.Voltages}
+	return hilBatteryState{Chemistry: "li-ion", LastPercent: inverted.voltage(volts), LastReading: f.now}, nil
+}
+
+func newFakeHILRunner(f *fakeHIL) *hilRunner {
+	return &hilRunner{
+		psu:         f,
+		readVoltage: f.readVoltage,
+		readState:   f.readState,
+		now:         func() time.Time { return f.now },
+		sleep:       func(d time.Duration) { f.now = f.now.Add(d) },
+	}
+}
+
+func loadTestScenarios(t *testing.T) hilScenarios {
+	data, err := os.ReadFile(filepath.Join("testdata", "battery-hil.json"))
+	assert.NoError(t, err)
+	scenarios := hilScenarios{}
+	assert.NoError(t, json.Unmarshal(data, &scenarios))
+	return scenarios
+}
+
+func TestHILCurveVoltage(t *testing.T) {
+	c := hilCurve{Voltages: []float32{3, 4}, Percents: []float32{0, 100}}
+	assert.InDelta(t, 3.5, c.voltage(50), 1e-6)
+	assert.InDelta(t, 3, c.voltage(-10), 1e-6)
+	assert.InDelta(t, 4, c.voltage(110), 1e-6)
+
+	_, err := hilScenario{Chemistry: "nimh"}.curve()
+	assert.Error(t, err)
+}
+
+func TestBatteryHILPasses(t *testing.T) {
+	f := &fakeHIL{now: time.Now(), adcOffset: 0.005}
+	report := newFakeHILRunner(f).run(loadTestScenarios(t))
+
+	assert.True(t, report.Passed, "%+v", report)
+	assert.Len(t, report.Scenarios, 1)
+	s := report.Scenarios[0]
+	assert.Equal(t, 25, s.Samples)
+	assert.Equal(t, "li-ion", s.DetectedChemistry)
+	assert.Equal(t, defaultHILSettle+4*time.Hour+10*time.Minute, s.End.Sub(s.Start))
+	assert.False(t, f.on, "PSU output is turned off at the end")
+}
+
+func TestBatteryHILFails(t *testing.T) {
+	f := &fakeHIL{now: time.Now(), adcOffset: 0.3}
+	report := newFakeHILRunner(f).run(loadTestScenarios(t))
+
+	assert.False(t, report.Passed)
+	s := report.Scenarios[0]
+	assert.Equal(t, s.Samples, s.VoltageFailures)
+	assert.Greater(t, s.PercentFailures, 0)
+	assert.InDelta(t, 0.3, s.MaxVoltageError, 1e-6)
+}
+
+func TestSCPIPSU(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	received := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			received <- scanner.Text()
+			if scanner.Text() == "MEAS:VOLT?" {
+				server.Write([]byte("12.345\n"))
+			}
+		}
+	}()
+
+	p := newSCPIPSU(client)
+	assert.NoError(t, p.setVoltage(12.3456))
+	assert.Equal(t, "VOLT 12.346", <-received)
+	assert.NoError(t, p.setOutput(true))
+	assert.Equal(t, "OUTP ON", <-received)
+	v, err := p.measureVoltage()
+	assert.NoError(t, err)
+	assert.Equal(t, 12.345, v)
+}
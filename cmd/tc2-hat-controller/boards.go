@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/boardconfig"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+)
+
+// configuredBoards returns the names of the expansion boards in the config.
+func configuredBoards() []string {
+	config, err := goconfig.New(goconfig.DefaultConfigDir)
+	if err != nil {
+		log.Errorf("Failed to load config: %v", err)
+		return nil
+	}
+	boards, err := boardconfig.Load(config)
+	if err != nil {
+		log.Errorf("Failed to read expansion board config: %v", err)
+		return nil
+	}
+	return boardconfig.Names(boards)
+}
+
+// printBoards prints the expansion boards found on the I2C bus.
+func printBoards() error {
+	boards := eeprom.EnumerateBoards()
+	data, err := json.MarshalIndent(boards, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
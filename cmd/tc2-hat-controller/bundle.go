@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+)
+
+// A bundle is a tar.gz of the hat data files for sharing when debugging a device.
+// With redaction the device and hat IDs are replaced with hashes that are only consistent
+// within the bundle, and timestamps are shifted back by a random number of days and rounded
+// so readings can't be matched up with sunrise/sunset or other data to find the location.
+// The time of day and the intervals between readings are kept as they are useful for debugging.
+
+const (
+	redactTimeResolution = 10 * time.Minute
+	redactMinDayShift    = 30
+	redactMaxDayShift    = 395
+
+	protectedSightingsFile = "/etc/cacophony/protected-sightings.json" // From tc2-hat-comms.
+)
+
+// redactedKeys are JSON keys with identifying values, compared in lower case.
+var redactedKeys = map[string]bool{
+	"id":       true,
+	"deviceid": true,
+	"group":    true,
+	"name":     true,
+}
+
+type bundleFile struct {
+	name   string
+	path   string
+	format string // "csv" or "json", for knowing how to redact the file.
+}
+
+var bundleFiles = []bundleFile{
+	{"temperature.csv", temperatureCSVFile, "csv"},
+	{"battery-readings.csv", batteryReadingsFile, "csv"},
+	{"battery-state.json", batteryStateFile, "json"},
+	{"eeprom-data.json", eeprom.EEPROM_FILE, "json"},
+	{"thermal-profile.json", thermalProfileFile, "json"},
+	{"camera-power.json", cameraPowerFile, "json"},
+	{"protected-sightings.json", protectedSightingsFile, "json"},
+}
+
+type bundleManifest struct {
+	Created  time.Time `json:"created"`
+	Version  string    `json:"version"`
+	Redacted bool      `json:"redacted"`
+	Files    []string  `json:"files"`
+	Missing  []string  `json:"missing,omitempty"`
+	// Lines dropped from CSV files as they couldn't be redacted.
+	DroppedLines int `json:"droppedLines,omitempty"`
+}
+
+type redactor struct {
+	dayShift int
+	salt     []byte
+	dropped  int
+}
+
+func newRedactor() (*redactor, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(redactMaxDayShift-redactMinDayShift+1))
+	if err != nil {
+		return nil, err
+	}
+	return &redactor{dayShift: redactMinDayShift + int(n.Int64()), salt: salt}, nil
+}
+
+func (r *redactor) time(t time.Time) time.Time {
+	return t.AddDate(0, 0, -r.dayShift).Round(redactTimeResolution)
+}
+
+// id replaces an identifier with a hash so the same value still matches within the bundle.
+func (r *redactor) id(v string) string {
+	h := sha256.Sum256(append(r.salt, v...))
+	return "redacted-" + hex.EncodeToString(h[:4])
+}
+
+// csv redacts the timestamp at the start of each line, lines without a valid timestamp are dropped.
+func (r *redactor) csv(data []byte) []byte {
+	out := &bytes.Buffer{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fmt.Fprintln(out, line)
+			continue
+		}
+		timeStr, rest, _ := strings.Cut(line, ",")
+		t, err := csvtime.Parse(timeStr)
+		if err != nil {
+			r.dropped++
+			continue
+		}
+		// Keep the timestamps in the same format as the file.
+		legacy := csvtime.IsLegacy(strings.TrimSpace(timeStr))
+		fmt.Fprintf(out, "%s,%s\n", csvtime.Format(r.time(t), legacy), rest)
+	}
+	return out.Bytes()
+}
+
+func (r *redactor) json(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(r.value("", v), "", "  ")
+}
+
+// value redacts identifying values and timestamps in a decoded JSON value.
+func (r *redactor) value(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, e := range val {
+			val[k] = r.value(k, e)
+		}
+		return val
+	case []interface{}:
+		for i, e := range val {
+			val[i] = r.value(key, e)
+		}
+		return val
+	case json.Number:
+		if redactedKeys[strings.ToLower(key)] {
+			return r.id(val.String())
+		}
+	case string:
+		if redactedKeys[strings.ToLower(key)] {
+			return r.id(val)
+		}
+		if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+			return r.time(t).Format(time.RFC3339)
+		}
+	}
+	return v
+}
+
+func deviceInfo() map[string]interface{} {
+	info := map[string]interface{}{}
+	config, err := goconfig.New(goconfig.DefaultConfigDir)
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return info
+	}
+	device := goconfig.Device{}
+	if err := config.Unmarshal(goconfig.DeviceKey, &device); err != nil {
+		log.Printf("Failed to read device config: %v", err)
+		return info
+	}
+	info["deviceID"] = device.ID
+	info["group"] = device.Group
+	info["name"] = device.Name
+	if v, err := eeprom.GetMainPCBVersion(); err == nil {
+		info["mainPCB"] = v
+	}
+	if v, err := eeprom.GetPowerPCBVersion(); err == nil {
+		info["powerPCB"] = v
+	}
+	return info
+}
+
+// writeBundle writes the files to a tar.gz, redacting them if r isn't nil.
+func writeBundle(outPath string, files []bundleFile, device map[string]interface{}, r *redactor) (*bundleManifest, error) {
+	manifest := &bundleManifest{Created: time.Now(), Version: version, Redacted: r != nil}
+	contents := map[string][]byte{}
+	for _, f := range files {
+		data, err := os.ReadFile(f.path)
+		if os.IsNotExist(err) {
+			manifest.Missing = append(manifest.Missing, f.name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			if f.format == "csv" {
+				data = r.csv(data)
+			} else if data, err = r.json(data); err != nil {
+				return nil, fmt.Errorf("failed to redact %s: %v", f.path, err)
+			}
+		}
+		contents[f.name] = data
+		manifest.Files = append(manifest.Files, f.name)
+	}
+
+	deviceData, err := json.MarshalIndent(device, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		if deviceData, err = r.json(deviceData); err != nil {
+			return nil, err
+		}
+		manifest.Created = r.time(manifest.Created)
+		manifest.DroppedLines = r.dropped
+	}
+	contents["device.json"] = deviceData
+	manifest.Files = append(manifest.Files, "device.json")
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	prefix := strings.TrimSuffix(filepath.Base(outPath), ".tar.gz")
+	write := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    filepath.Join(prefix, name),
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: manifest.Created,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+	if err := write("manifest.json", manifestData); err != nil {
+		return nil, err
+	}
+	for _, name := range manifest.Files {
+		if err := write(name, contents[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, out.Close()
+}
+
+func runBundle(args *Bundle) error {
+	var r *redactor
+	if args.Redact {
+		var err error
+		if r, err = newRedactor(); err != nil {
+			return err
+		}
+	}
+	manifest, err := writeBundle(args.Output, bundleFiles, deviceInfo(), r)
+	if err != nil {
+		return err
+	}
+	if len(manifest.Missing) > 0 {
+		log.Printf("Files not found: %s", strings.Join(manifest.Missing, ", "))
+	}
+	if manifest.DroppedLines > 0 {
+		log.Printf("Dropped %d lines that couldn't be redacted", manifest.DroppedLines)
+	}
+	log.Printf("Wrote %s", args.Output)
+	return nil
+}
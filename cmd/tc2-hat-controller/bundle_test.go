@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readBundle(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		files[filepath.Base(h.Name)] = string(data)
+	}
+	return files
+}
+
+func TestRedactedBundle(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "temperature.csv")
+	jsonFile := filepath.Join(dir, "eeprom-data.json")
+	assert.NoError(t, os.WriteFile(csvFile, []byte("2024-03-10 14:03:12, 21.50, 60.00\ngarbled\n2024-03-10 14:13:12, 21.00, 61.00\n"), 0644))
+	assert.NoError(t, os.WriteFile(jsonFile, []byte(`{"id": 9007199254740993, "time": "2024-03-10T14:03:12Z", "mainPCB": "0.2.0"}`), 0644))
+	files := []bundleFile{
+		{"temperature.csv", csvFile, "csv"},
+		{"eeprom-data.json", jsonFile, "json"},
+		{"missing.json", filepath.Join(dir, "missing.json"), "json"},
+	}
+	device := map[string]interface{}{"deviceID": 1234, "group": "backyard", "name": "trap-1"}
+
+	r := &redactor{dayShift: 100, salt: []byte("salt")}
+	out := filepath.Join(dir, "bundle.tar.gz")
+	manifest, err := writeBundle(out, files, device, r)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"missing.json"}, manifest.Missing)
+	assert.Equal(t, 1, manifest.DroppedLines)
+
+	bundle := readBundle(t, out)
+	assert.Len(t, bundle, 4)
+	assert.Equal(t, "2023-12-01 14:00:00, 21.50, 60.00\n2023-12-01 14:10:00, 21.00, 61.00\n", bundle["temperature.csv"])
+
+	eepromData := map[string]string{}
+	assert.NoError(t, json.Unmarshal([]byte(bundle["eeprom-data.json"]), &eepromData))
+	assert.Equal(t, r.id("9007199254740993"), eepromData["id"])
+	assert.Equal(t, "2023-12-01T14:00:00Z", eepromData["time"])
+	assert.Equal(t, "0.2.0", eepromData["mainPCB"])
+
+	for _, s := range []string{"1234", "backyard", "trap-1", "2024"} {
+		assert.NotContains(t, bundle["device.json"]+bundle["manifest.json"], s)
+	}
+	assert.True(t, strings.HasPrefix(r.id("backyard"), "redacted-"))
+}
+
+func TestUnredactedBundle(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "temperature.csv")
+	csvData := "2024-03-10 14:03:12, 21.50, 60.00\n"
+	assert.NoError(t, os.WriteFile(csvFile, []byte(csvData), 0644))
+	out := filepath.Join(dir, "bundle.tar.gz")
+	manifest, err := writeBundle(out, []bundleFile{{"temperature.csv", csvFile, "csv"}}, map[string]interface{}{"group": "backyard"}, nil)
+	assert.NoError(t, err)
+	assert.False(t, manifest.Redacted)
+	assert.WithinDuration(t, time.Now(), manifest.Created, time.Minute)
+
+	bundle := readBundle(t, out)
+	assert.Equal(t, csvData, bundle["temperature.csv"])
+	assert.Contains(t, bundle["device.json"], "backyard")
+}
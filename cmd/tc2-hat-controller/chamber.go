@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/godbus/dbus"
+)
+
+// The chamber test steps through a script for hardware qualification in a thermal chamber.
+// Readings come from the running hat services, the CSV files written by tc2-hat-temp and
+// tc2-hat-attiny and the RTC time from tc2-hat-rtc, so the same code paths as in the field
+// are tested. The services write the CSV files in batches, so set flush-interval = "0" in the
+// [csv-writes] section of the config on the device under test to have every reading written.
+
+const (
+	chamberPollInterval = time.Minute
+	// Readings older than this are stale, the services write them every 1-2 minutes.
+	maxReadingAge = 5 * time.Minute
+)
+
+// chamberScript is the test script, loaded from JSON.
+type chamberScript struct {
+	Name  string        `json:"name"`
+	Steps []chamberStep `json:"steps"`
+}
+
+// chamberStep optionally waits for a condition, then checks the assertions for the duration
+// of the step, or once if there is no duration.
+type chamberStep struct {
+	Name       string             `json:"name"`
+	WaitFor    *chamberAssertion  `json:"waitFor,omitempty"`
+	Timeout    duration           `json:"timeout,omitempty"` // How long to wait for WaitFor.
+	Duration   duration           `json:"duration,omitempty"`
+	Assertions []chamberAssertion `json:"assertions,omitempty"`
+}
+
+// chamberAssertion checks a sensor reading is within a range, Min and Max are optional.
+type chamberAssertion struct {
+	Sensor string   `json:"sensor"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+}
+
+// errTooSoon is returned when a reading isn't available yet, it isn't counted as a failure.
+var errTooSoon = errors.New("not enough time to measure")
+
+// duration is a time.Duration that is a string like "1h30m" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type chamberReport struct {
+	Name   string              `json:"name"`
+	Start  time.Time           `json:"start"`
+	End    time.Time           `json:"end"`
+	Passed bool                `json:"passed"`
+	Steps  []chamberStepReport `json:"steps"`
+}
+
+type chamberStepReport struct {
+	Name       string                   `json:"name"`
+	Start      time.Time                `json:"start"`
+	End        time.Time                `json:"end"`
+	Passed     bool                     `json:"passed"`
+	Waited     duration                 `json:"waited,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+	Assertions []chamberAssertionReport `json:"assertions,omitempty"`
+}
+
+type chamberAssertionReport struct {
+	chamberAssertion
+	Samples     int      `json:"samples"`
+	ObservedMin *float64 `json:"observedMin,omitempty"`
+	ObservedMax *float64 `json:"observedMax,omitempty"`
+	Failures    int      `json:"failures"`
+	Errors      []string `json:"errors,omitempty"`
+	Passed      bool     `json:"passed"`
+}
+
+func (a chamberAssertion) check(v float64) bool {
+	return (a.Min == nil || v >= *a.Min) && (a.Max == nil || v <= *a.Max)
+}
+
+func (a chamberAssertion) String() string {
+	s := a.Sensor
+	if a.Min != nil {
+		s = fmt.Sprintf("%g <= %s", *a.Min, s)
+	}
+	if a.Max != nil {
+		s = fmt.Sprintf("%s <= %g", s, *a.Max)
+	}
+	return s
+}
+
+func (r *chamberAssertionReport) add(v float64, err error) {
+	if errors.Is(err, errTooSoon) {
+		return
+	}
+	if err != nil {
+		if len(r.Errors) < 10 {
+			r.Errors = append(r.Errors, err.Error())
+		}
+		r.Failures++
+		return
+	}
+	r.Samples++
+	if r.ObservedMin == nil || v < *r.ObservedMin {
+		r.ObservedMin = &v
+	}
+	if r.ObservedMax == nil || v > *r.ObservedMax {
+		r.ObservedMax = &v
+	}
+	if !r.check(v) {
+		r.Failures++
+	}
+}
+
+// chamberRunner runs a script, the readings, clock and sleep can be replaced for testing.
+type chamberRunner struct {
+	read  func(sensor string) (float64, error)
+	now   func() time.Time
+	sleep func(time.Duration)
+	rtc   *rtcDriftMeter
+}
+
+func (c *chamberRunner) run(script chamberScript) chamberReport {
+	report := chamberReport{Name: script.Name, Start: c.now(), Passed: true}
+	for _, step := range script.Steps {
+		log.Printf("Starting step '%s'", step.Name)
+		stepReport := c.runStep(step)
+		if stepReport.Passed {
+			log.Printf("Step '%s' passed", step.Name)
+		} else {
+			log.Printf("Step '%s' failed %s", step.Name, stepReport.Error)
+			report.Passed = false
+		}
+		report.Steps = append(report.Steps, stepReport)
+	}
+	report.End = c.now()
+	return report
+}
+
+func (c *chamberRunner) runStep(step chamberStep) (r chamberStepReport) {
+	r = chamberStepReport{Name: step.Name, Start: c.now(), Passed: true}
+	defer func() { r.End = c.now() }()
+
+	if step.WaitFor != nil {
+		deadline := r.Start.Add(time.Duration(step.Timeout))
+		for {
+			v, err := c.read(step.WaitFor.Sensor)
+			if err == nil && step.WaitFor.check(v) {
+				break
+			}
+			if step.Timeout > 0 && !c.now().Before(deadline) {
+				r.Passed = false
+				r.Error = fmt.Sprintf("timed out waiting for %s, last reading %.2f", step.WaitFor, v)
+				if err != nil {
+					r.Error = fmt.Sprintf("timed out waiting for %s: %v", step.WaitFor, err)
+				}
+				return r
+			}
+			c.sleep(chamberPollInterval)
+		}
+		r.Waited = duration(c.now().Sub(r.Start))
+	}
+
+	if c.rtc != nil {
+		c.rtc.start()
+	}
+	reports := make([]chamberAssertionReport, len(step.Assertions))
+	for i, a := range step.Assertions {
+		reports[i].chamberAssertion = a
+	}
+	end := c.now().Add(time.Duration(step.Duration))
+	for {
+		for i := range reports {
+			reports[i].add(c.read(reports[i].Sensor))
+		}
+		if !c.now().Before(end) {
+			break
+		}
+		c.sleep(chamberPollInterval)
+	}
+	for i := range reports {
+		reports[i].Passed = reports[i].Failures == 0 && reports[i].Samples > 0
+		if !reports[i].Passed {
+			r.Passed = false
+		}
+	}
+	r.Assertions = reports
+	return r
+}
+
+// readLastCSVValues returns the values on the last line of a CSV file written by the hat
+// services, checking the reading isn't stale.
+func readLastCSVValues(filePath string, now time.Time) ([]float64, error) {
+	t, values, err := readLastCSVLine(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if now.Sub(t) > maxReadingAge {
+		return nil, fmt.Errorf("last reading in %s is from %s", filePath, t.Format(time.DateTime))
+	}
+	return values, nil
+}
+
+// readLastCSVLine returns the time and values on the last line of a CSV file written by the
+// hat services.
+func readLastCSVLine(filePath string) (time.Time, []float64, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	fields := strings.Split(lines[len(lines)-1], ",")
+	if len(fields) < 2 {
+		return time.Time{}, nil, fmt.Errorf("no readings in %s", filePath)
+	}
+	t, err := csvtime.Parse(fields[0])
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	values := []float64{}
+	for _, f := range fields[1:] {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		values = append(values, v)
+	}
+	return t, values, nil
+}
+
+// csvSensors maps sensor names to the file and column they are read from.
+var csvSensors = map[string]struct {
+	file   string
+	column int
+}{
+	"temperature": {temperatureCSVFile, 0},
+	"humidity":    {temperatureCSVFile, 1},
+	"hvBattery":   {batteryReadingsFile, 0},
+	"lvBattery":   {batteryReadingsFile, 1},
+	"rtcBattery":  {batteryReadingsFile, 2},
+}
+
+// rtcDriftMeter measures how fast the RTC drifts from the system clock, which should be
+// synced with NTP, from the start of each step.
+type rtcDriftMeter struct {
+	readRTC     func() (time.Time, error)
+	now         func() time.Time
+	startOffset time.Duration
+	startTime   time.Time
+}
+
+func (m *rtcDriftMeter) offset() (time.Duration, time.Time, error) {
+	rtcTime, err := m.readRTC()
+	now := m.now()
+	return rtcTime.Sub(now), now, err
+}
+
+func (m *rtcDriftMeter) start() {
+	offset, now, err := m.offset()
+	if err != nil {
+		log.Printf("Failed to read RTC: %v", err)
+		m.startTime = time.Time{}
+		return
+	}
+	m.startOffset, m.startTime = offset, now
+}
+
+// ppm returns the drift since the start of the step in parts per million. The RTC only has a
+// resolution of one second so the step needs to be long for an accurate measurement.
+func (m *rtcDriftMeter) ppm() (float64, error) {
+	if m.startTime.IsZero() {
+		return 0, fmt.Errorf("no RTC reading at the start of the step")
+	}
+	offset, now, err := m.offset()
+	if err != nil {
+		return 0, err
+	}
+	elapsed := now.Sub(m.startTime)
+	if elapsed < time.Minute {
+		return 0, errTooSoon
+	}
+	return math.Abs(float64(offset-m.startOffset)) / float64(elapsed) * 1e6, nil
+}
+
+func readRTCTime() (time.Time, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var timeStr string
+	var integrity bool
+	obj := conn.Object("org.cacophony.RTC", "/org/cacophony/RTC")
+	if err := obj.Call("org.cacophony.RTC.GetTime", 0).Store(&timeStr, &integrity); err != nil {
+		return time.Time{}, err
+	}
+	if !integrity {
+		return time.Time{}, fmt.Errorf("RTC time doesn't have integrity")
+	}
+	return time.Parse(time.RFC3339, timeStr)
+}
+
+func (c *chamberRunner) readSensor(sensor string) (float64, error) {
+	if sensor == "rtcDriftPPM" {
+		if c.rtc == nil {
+			return 0, fmt.Errorf("RTC drift can't be measured")
+		}
+		return c.rtc.ppm()
+	}
+	s, ok := csvSensors[sensor]
+	if !ok {
+		return 0, fmt.Errorf("unknown sensor '%s'", sensor)
+	}
+	values, err := readLastCSVValues(s.file, c.now())
+	if err != nil {
+		return 0, err
+	}
+	if s.column >= len(values) {
+		return 0, fmt.Errorf("no '%s' value in %s", sensor, s.file)
+	}
+	return values[s.column], nil
+}
+
+// runChamberTest runs the script and writes the report as JSON.
+func runChamberTest(args *Chamber) error {
+	data, err := os.ReadFile(args.Script)
+	if err != nil {
+		return err
+	}
+	script := chamberScript{}
+	if err := json.Unmarshal(data, &script); err != nil {
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("failed to parse script: %v", err))
+	}
+	c := &chamberRunner{
+		now:   time.Now,
+		sleep: time.Sleep,
+		rtc:   &rtcDriftMeter{readRTC: readRTCTime, now: time.Now},
+	}
+	c.read = c.readSensor
+	report := c.run(script)
+
+	reportData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if args.Report == "" {
+		fmt.Println(string(reportData))
+	} else if err := os.WriteFile(args.Report, reportData, 0644); err != nil {
+		return err
+	}
+	if !report.Passed {
+		return fmt.Errorf("chamber test '%s' failed", script.Name)
+	}
+	log.Printf("Chamber test '%s' passed", script.Name)
+	return nil
+}
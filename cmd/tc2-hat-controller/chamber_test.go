@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChamber cools down by 1°C a minute to -11°C, with the RTC running 10 ppm fast.
+type fakeChamber struct {
+	start   time.Time
+	now     time.Time
+	battery float64
+}
+
+func (f *fakeChamber) read(sensor string) (float64, error) {
+	switch sensor {
+	case "temperature":
+		return max(-11, 20-f.now.Sub(f.start).Minutes()), nil
+	case "lvBattery":
+		return f.battery, nil
+	}
+	return 0, fmt.Errorf("unknown sensor '%s'", sensor)
+}
+
+func newFakeChamberRunner(f *fakeChamber) *chamberRunner {
+	c := &chamberRunner{
+		now:   func() time.Time { return f.now },
+		sleep: func(d time.Duration) { f.now = f.now.Add(d) },
+		rtc: &rtcDriftMeter{
+			readRTC: func() (time.Time, error) {
+				return f.now.Add(time.Duration(float64(f.now.Sub(f.start)) * 10e-6)), nil
+			},
+			now: func() time.Time { return f.now },
+		},
+	}
+	c.read = func(sensor string) (float64, error) {
+		if sensor == "rtcDriftPPM" {
+			return c.rtc.ppm()
+		}
+		return f.read(sensor)
+	}
+	return c
+}
+
+func loadTestScript(t *testing.T) chamberScript {
+	data, err := os.ReadFile(filepath.Join("testdata", "chamber-cold.json"))
+	assert.NoError(t, err)
+	script := chamberScript{}
+	assert.NoError(t, json.Unmarshal(data, &script))
+	return script
+}
+
+func TestChamberTestPasses(t *testing.T) {
+	start := time.Now()
+	f := &fakeChamber{start: start, now: start, battery: 12.2}
+	report := newFakeChamberRunner(f).run(loadTestScript(t))
+
+	assert.True(t, report.Passed, "%+v", report)
+	assert.Len(t, report.Steps, 2)
+	assert.Equal(t, duration(30*time.Minute), report.Steps[0].Waited)
+	soak := report.Steps[1]
+	assert.Len(t, soak.Assertions, 3)
+	assert.Equal(t, 121, soak.Assertions[0].Samples)
+	// First drift reading is taken at the start of the step and is too short to measure.
+	assert.Equal(t, 120, soak.Assertions[2].Samples)
+	assert.InDelta(t, 10, *soak.Assertions[2].ObservedMax, 1)
+	assert.Equal(t, 2*time.Hour+30*time.Minute, report.End.Sub(report.Start))
+}
+
+func TestChamberTestFails(t *testing.T) {
+	start := time.Now()
+	f := &fakeChamber{start: start, now: start, battery: 11.0}
+	script := loadTestScript(t)
+	report := newFakeChamberRunner(f).run(script)
+	assert.False(t, report.Passed)
+	assert.True(t, report.Steps[0].Passed)
+	assert.False(t, report.Steps[1].Passed)
+	assert.False(t, report.Steps[1].Assertions[1].Passed)
+	assert.Equal(t, float64(11), *report.Steps[1].Assertions[1].ObservedMin)
+
+	// Never gets cold enough.
+	f = &fakeChamber{start: start, now: start}
+	limit := -20.0
+	script.Steps[0].WaitFor.Max = &limit
+	report = newFakeChamberRunner(f).run(script)
+	assert.False(t, report.Steps[0].Passed)
+	assert.Contains(t, report.Steps[0].Error, "timed out")
+}
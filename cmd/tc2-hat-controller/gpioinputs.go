@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/gpioevents"
+)
+
+// hasGPIOInputs returns true if there are GPIO inputs or a tamper sensor in the config.
+func hasGPIOInputs() bool {
+	config, err := goconfig.New(goconfig.DefaultConfigDir)
+	if err != nil {
+		log.Errorf("Failed to load config: %v", err)
+		return false
+	}
+	inputs, err := gpioevents.Load(config)
+	if err != nil {
+		log.Errorf("Failed to read GPIO input config: %v", err)
+		return false
+	}
+	tamper, err := gpioevents.LoadTamper(config)
+	if err != nil {
+		log.Errorf("Failed to read tamper config: %v", err)
+		return len(inputs) > 0
+	}
+	return len(inputs) > 0 || tamper.Enabled()
+}
+
+// runGPIOEvents adds events for the GPIO inputs and the tamper sensor until it is stopped.
+func runGPIOEvents() error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return gpioEventsWorker(ctx)
+}
+
+// gpioEventsWorker adds events for the GPIO inputs and the tamper sensor until the context is
+// done. The supervisor runs it as a goroutine.
+func gpioEventsWorker(ctx context.Context) error {
+	config, err := goconfig.New(goconfig.DefaultConfigDir)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, err)
+	}
+	inputs, err := gpioevents.Load(config)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, err)
+	}
+	tamper, err := gpioevents.LoadTamper(config)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, err)
+	}
+	if len(inputs) == 0 && !tamper.Enabled() {
+		log.Info("No GPIO inputs in the config")
+	}
+	if err := gpioevents.Start(inputs); err != nil {
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
+	}
+	if err := gpioevents.StartTamper(tamper); err != nil {
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
+	}
+	<-ctx.Done()
+	return nil
+}
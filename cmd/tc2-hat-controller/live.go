@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/livefeed"
+	"github.com/godbus/dbus"
+)
+
+// printLiveFeed prints the samples from the live feed as JSON lines until it is stopped.
+func printLiveFeed() error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	samples, err := livefeed.Subscribe(conn)
+	if err != nil {
+		return err
+	}
+	for sample := range samples {
+		data, err := json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
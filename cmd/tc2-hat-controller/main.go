@@ -0,0 +1,182 @@
+/*
+tc2-hat-controller - Supervises the TC2 hat services
+Copyright (C) 2024, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+)
+
+type Args struct {
+	All     *subcommand `arg:"subcommand:all"     help:"Run and supervise all the hat services."`
+	Status  *subcommand `arg:"subcommand:status"  help:"Print the status of the supervised services."`
+	Audit   *subcommand `arg:"subcommand:audit"   help:"Check the data files saved by the hat services, repairing or quarantining corrupt files."`
+	Chamber *Chamber    `arg:"subcommand:chamber" help:"Run a thermal chamber qualification test script against the running hat services."`
+	Bundle  *Bundle     `arg:"subcommand:bundle"  help:"Make a tar.gz of the hat data files for debugging."`
+	Boards  *subcommand `arg:"subcommand:boards"  help:"List the expansion boards stacked on the hat."`
+	Twin    *subcommand `arg:"subcommand:twin"    help:"Print the last published device twin."`
+	Live    *subcommand `arg:"subcommand:live"    help:"Print the temperature, battery and ATtiny state samples as JSON lines as they happen."`
+	Shadow  *Shadow     `arg:"subcommand:shadow"  help:"Print how the state files compare to the shadow copy on the boot partition."`
+	Thermal *subcommand `arg:"subcommand:thermal" help:"Print the daily thermal profile from the temperature history."`
+
+	Timeline *Timeline `arg:"subcommand:timeline" help:"Merge the temperature, battery and event histories into one timeline, corrected for clock steps."`
+
+	Telemetry *Telemetry `arg:"subcommand:telemetry" help:"Make a compressed telemetry bundle for sending over a constrained link."`
+
+	GPIOEvents *subcommand `arg:"subcommand:gpio-events" help:"Add events for changes on the GPIO inputs in the config."`
+
+	BatteryHIL *BatteryHIL `arg:"subcommand:battery-hil" help:"Run battery detection scenarios with a bench PSU emulating the battery."`
+	logging.LogArgs
+}
+
+type subcommand struct {
+}
+
+type Chamber struct {
+	Script string `arg:"positional,required" help:"JSON test script."`
+	Report string `arg:"--report" help:"File to write the JSON report to, printed if not set."`
+}
+
+type BatteryHIL struct {
+	Scenarios string `arg:"positional,required" help:"JSON scenarios file."`
+	PSU       string `arg:"--psu,required" help:"SCPI PSU address, tcp://host:port or a device file such as /dev/usbtmc0."`
+	Report    string `arg:"--report" help:"File to write the JSON report to, printed if not set."`
+}
+
+type Bundle struct {
+	Output string `arg:"-o,--output" default:"hat-bundle.tar.gz" help:"File to write the bundle to."`
+	Redact bool   `arg:"--redact" help:"Redact IDs and coarsen timestamps so the bundle can be shared publicly."`
+}
+
+type Telemetry struct {
+	Period   string        `arg:"--period" default:"day" help:"Period of the bundle, hour or day."`
+	Interval time.Duration `arg:"--interval" help:"Bucket interval, overriding the default for the period."`
+	Output   string        `arg:"-o,--output" default:"hat-telemetry.bin" help:"File to write the bundle to."`
+	Decode   string        `arg:"--decode" help:"Print a bundle file as JSON instead of making one."`
+}
+
+var (
+	log     = logging.NewLogger("info")
+	version = "<not set>"
+)
+
+func (Args) Version() string {
+	return version
+}
+
+func procArgs() Args {
+	args := Args{}
+	exitcode.MustParse(&args)
+	return args
+}
+
+func main() {
+	err := runMain()
+	if err != nil {
+		log.Error(err)
+		os.Exit(exitcode.Code(err))
+	}
+}
+
+func runMain() error {
+	args := procArgs()
+	log = logging.NewLogger(args.LogLevel)
+
+	if args.Status != nil {
+		status, err := getStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Println(status)
+		return nil
+	}
+
+	if args.Audit != nil {
+		return runAudit()
+	}
+	if args.Chamber != nil {
+		return runChamberTest(args.Chamber)
+	}
+	if args.BatteryHIL != nil {
+		return runBatteryHIL(args.BatteryHIL)
+	}
+	if args.Bundle != nil {
+		return runBundle(args.Bundle)
+	}
+	if args.Telemetry != nil {
+		return runTelemetry(args.Telemetry)
+	}
+	if args.Twin != nil {
+		return printTwin()
+	}
+	if args.Boards != nil {
+		return printBoards()
+	}
+	if args.Live != nil {
+		return printLiveFeed()
+	}
+	if args.Shadow != nil {
+		return runShadow(args.Shadow)
+	}
+	if args.Thermal != nil {
+		profile, err := getThermalProfile()
+		if err != nil {
+			return err
+		}
+		fmt.Println(profile)
+		return nil
+	}
+	if args.GPIOEvents != nil {
+		return runGPIOEvents()
+	}
+	if args.Timeline != nil {
+		return runTimeline(args.Timeline)
+	}
+
+	if args.All == nil {
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("no subcommand given, run with --help for usage"))
+	}
+
+	log.Infof("Running version: %s", version)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	restoreShadowState()
+	s := newSupervisor(defaultWorkers(configuredBoards(), hasGPIOInputs()))
+	thermal := newThermalAdvisor()
+	if err := startService(s, thermal); err != nil {
+		return err
+	}
+	go newTwinPublisher().run(ctx)
+	go thermal.run(ctx)
+	go syncShadowState(ctx)
+	s.run(ctx)
+	// Catch any state saved by the services as they stopped.
+	syncShadowOnce()
+	log.Info("All services stopped")
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scpiTimeout is how long to wait for a response from the PSU.
+const scpiTimeout = 5 * time.Second
+
+// benchPSU is a programmable power supply used to emulate a battery.
+type benchPSU interface {
+	setVoltage(volts float64) error
+	setCurrentLimit(amps float64) error
+	setOutput(on bool) error
+	measureVoltage() (float64, error)
+}
+
+// scpiPSU drives a bench PSU with SCPI commands, over ethernet (raw socket, usually port 5025)
+// or a USB device file such as /dev/usbtmc0 or /dev/ttyACM0.
+type scpiPSU struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+}
+
+// openSCPIPSU connects to the PSU, the address is "tcp://host:port" or a device file.
+func openSCPIPSU(address string) (*scpiPSU, error) {
+	var conn io.ReadWriteCloser
+	var err error
+	if strings.HasPrefix(address, "tcp://") {
+		conn, err = net.DialTimeout("tcp", strings.TrimPrefix(address, "tcp://"), scpiTimeout)
+	} else {
+		conn, err = os.OpenFile(address, os.O_RDWR, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PSU at '%s': %v", address, err)
+	}
+	p := newSCPIPSU(conn)
+	id, err := p.query("*IDN?")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("PSU at '%s' didn't identify itself: %v", address, err)
+	}
+	log.Printf("Connected to PSU '%s'", id)
+	return p, nil
+}
+
+func newSCPIPSU(conn io.ReadWriteCloser) *scpiPSU {
+	return &scpiPSU{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (p *scpiPSU) Close() error {
+	return p.conn.Close()
+}
+
+// command sends a command that has no response.
+func (p *scpiPSU) command(cmd string) error {
+	p.setDeadline()
+	_, err := io.WriteString(p.conn, cmd+"\n")
+	return err
+}
+
+// query sends a command and returns the response line.
+func (p *scpiPSU) query(cmd string) (string, error) {
+	if err := p.command(cmd); err != nil {
+		return "", err
+	}
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// setDeadline stops a PSU that has stopped responding from blocking forever. Device files
+// don't support deadlines so the error is ignored.
+func (p *scpiPSU) setDeadline() {
+	if c, ok := p.conn.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = c.SetDeadline(time.Now().Add(scpiTimeout))
+	}
+}
+
+func (p *scpiPSU) setVoltage(volts float64) error {
+	return p.command(fmt.Sprintf("VOLT %.3f", volts))
+}
+
+func (p *scpiPSU) setCurrentLimit(amps float64) error {
+	return p.command(fmt.Sprintf("CURR %.3f", amps))
+}
+
+func (p *scpiPSU) setOutput(on bool) error {
+	if on {
+		return p.command("OUTP ON")
+	}
+	return p.command("OUTP OFF")
+}
+
+func (p *scpiPSU) measureVoltage() (float64, error) {
+	res, err := p.query("MEAS:VOLT?")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(res, 64)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusapi"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusauth"
+	"github.com/TheCacophonyProject/tc2-hat-controller/gpioevents"
+	"github.com/godbus/dbus"
+)
+
+const (
+	dbusName = "org.cacophony.TC2HatController"
+	dbusPath = "/org/cacophony/TC2HatController"
+)
+
+// api is the version and capabilities of the D-Bus API, see the dbusapi package.
+var api = dbusapi.API{
+	Version:      1,
+	Capabilities: []string{"status", "tamper", "thermalProfile"},
+}
+
+type service struct {
+	supervisor     *supervisor
+	thermal        *thermalAdvisor
+	auth           *dbusauth.Authorizer
+	setTamperArmed func(armed bool) error
+}
+
+func startService(s *supervisor, thermal *thermalAdvisor) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return errors.New("name already taken")
+	}
+
+	svc := &service{
+		supervisor:     s,
+		thermal:        thermal,
+		auth:           dbusauth.Load(conn, dbusName, goconfig.DefaultConfigDir),
+		setTamperArmed: gpioevents.SetTamperArmed,
+	}
+	_, err = dbusapi.Export(conn, svc, dbusPath, dbusName, api, nil)
+	return err
+}
+
+// Status returns the status of all the supervised services as JSON.
+func (s service) Status() (string, *dbus.Error) {
+	data, err := json.Marshal(s.supervisor.statuses())
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(data), nil
+}
+
+// GetThermalProfile returns the highest temperature in each hour of the day over the
+// temperature history, and the heat peaks in it, as JSON.
+func (s service) GetThermalProfile() (string, *dbus.Error) {
+	data, err := json.Marshal(s.thermal.profile())
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(data), nil
+}
+
+// ArmTamper arms the tamper detection, it is armed unless it has been disarmed.
+func (s service) ArmTamper(sender dbus.Sender) *dbus.Error {
+	if err := s.auth.Check(sender, "ArmTamper"); err != nil {
+		return err
+	}
+	if err := s.setTamperArmed(true); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	log.Info("Tamper detection armed")
+	return nil
+}
+
+// DisarmTamper disarms the tamper detection, such as while the device is being serviced.
+func (s service) DisarmTamper(sender dbus.Sender) *dbus.Error {
+	if err := s.auth.Check(sender, "DisarmTamper"); err != nil {
+		return err
+	}
+	if err := s.setTamperArmed(false); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	log.Info("Tamper detection disarmed")
+	return nil
+}
+
+// TamperArmed returns true if the tamper detection is armed.
+func (s service) TamperArmed() (bool, *dbus.Error) {
+	return gpioevents.TamperArmed(), nil
+}
+
+// getStatus gets the status from the running supervisor.
+func getStatus() (string, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return "", err
+	}
+	status := ""
+	err = conn.Object(dbusName, dbusPath).Call(dbusName+".Status", 0).Store(&status)
+	return status, err
+}
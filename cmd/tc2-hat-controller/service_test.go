@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusauth"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTamperAuth(t *testing.T) {
+	events := eventtest.Capture(t)
+	armed := []bool{}
+	s := service{
+		auth:           dbusauth.NewWithUsers(dbusName, dbusauth.DefaultConfig(), map[string]uint32{"root": 0, "pi": 1000, "www-data": 33}),
+		setTamperArmed: func(a bool) error { armed = append(armed, a); return nil },
+	}
+
+	// Other users can't disarm the tamper detection, or arm it.
+	for _, sender := range []string{"www-data", "unknown"} {
+		err := s.DisarmTamper(dbus.Sender(sender))
+		if assert.NotNil(t, err, sender) {
+			assert.Equal(t, dbusauth.ErrAccessDenied, err.Name)
+		}
+		assert.NotNil(t, s.ArmTamper(dbus.Sender(sender)), sender)
+	}
+	assert.Empty(t, armed)
+	assert.Equal(t, []string{"dbusAccessDenied", "dbusAccessDenied", "dbusAccessDenied", "dbusAccessDenied"}, events.Types())
+
+	assert.Nil(t, s.DisarmTamper(dbus.Sender("pi")))
+	assert.Nil(t, s.ArmTamper(dbus.Sender("root")))
+	assert.Equal(t, []bool{false, true}, armed)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/shadowstate"
+)
+
+// The state files are restored from the shadow on the boot partition before the services are
+// started, then the shadow is synced periodically and when stopping. The shadow is only
+// written when a file has changed.
+const shadowSyncInterval = 6 * time.Hour
+
+type Shadow struct {
+	Sync    bool `arg:"--sync" help:"Copy the state files that have changed into the shadow."`
+	Restore bool `arg:"--restore" help:"Restore the state files that are missing from the shadow."`
+}
+
+// restoreShadowState restores the state files lost by re-imaging the rootfs, making a
+// shadowStateRestored event if any were.
+func restoreShadowState() {
+	store, err := shadowstate.Find()
+	if err != nil {
+		log.Errorf("Not restoring shadow state: %v", err)
+		return
+	}
+	restored, err := store.Restore(shadowstate.Files)
+	if err != nil {
+		log.Errorf("Failed to restore shadow state: %v", err)
+	}
+	if len(restored) == 0 {
+		return
+	}
+	log.Infof("Restored %v from '%s'", restored, store.Path())
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ShadowStateRestored, time.Now(), eventhelper.ShadowRestore{
+		Files: restored,
+	})); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+}
+
+// syncShadowState syncs the shadow every shadowSyncInterval until stopped.
+func syncShadowState(ctx context.Context) {
+	for {
+		syncShadowOnce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(shadowSyncInterval):
+		}
+	}
+}
+
+func syncShadowOnce() {
+	store, err := shadowstate.Find()
+	if err != nil {
+		log.Errorf("Not syncing shadow state: %v", err)
+		return
+	}
+	updated, err := store.Sync(shadowstate.Files, time.Now())
+	if err != nil {
+		log.Errorf("Failed to sync shadow state: %v", err)
+	} else if len(updated) > 0 {
+		log.Infof("Synced %v to '%s'", updated, store.Path())
+	}
+}
+
+// runShadow syncs or restores the shadow state, printing how the state files compare to it.
+func runShadow(args *Shadow) error {
+	store, err := shadowstate.Find()
+	if err != nil {
+		return err
+	}
+	if args.Restore {
+		restored, err := store.Restore(shadowstate.Files)
+		if err != nil {
+			return err
+		}
+		log.Infof("Restored %d files", len(restored))
+	}
+	if args.Sync {
+		updated, err := store.Sync(shadowstate.Files, time.Now())
+		if err != nil {
+			return err
+		}
+		log.Infof("Synced %d files", len(updated))
+	}
+	statuses, err := store.Status(shadowstate.Files)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
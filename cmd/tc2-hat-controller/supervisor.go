@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/readiness"
+	"github.com/godbus/dbus"
+)
+
+const (
+	healthCheckInterval = 30 * time.Second
+	startupGracePeriod  = time.Minute // Time a service has to get onto dbus before health checks start.
+	maxHealthFailures   = 3           // Failed health checks in a row before the service is restarted.
+	stopTimeout         = 10 * time.Second
+	dependencyTimeout   = 30 * time.Second
+)
+
+const (
+	stateStarting  = "starting"
+	stateRunning   = "running"
+	stateUnhealthy = "unhealthy"
+	stateBackoff   = "backoff"
+	stateStopped   = "stopped"
+)
+
+// restartPolicy is how a service is restarted after it exits. The wait between restarts
+// doubles each time up to MaxBackoff, and is reset once the service has run for ResetAfter.
+type restartPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	ResetAfter     time.Duration
+}
+
+func (p restartPolicy) backoff(failures int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < failures && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// WorkerStatus is the status of a supervised service.
+type WorkerStatus struct {
+	Name                string    `json:"name"`
+	State               string    `json:"state"`
+	PID                 int       `json:"pid,omitempty"`
+	Healthy             bool      `json:"healthy"`
+	Restarts            int       `json:"restarts"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastStart           time.Time `json:"lastStart,omitempty"`
+	LastExit            string    `json:"lastExit,omitempty"`
+}
+
+// worker is one of the hat services. The services with their own binary are run as their own
+// process so a crash or log.Fatal in one service doesn't take down the others, the services
+// that are part of this binary are run as a goroutine.
+type worker struct {
+	name     string
+	command  []string                        // The process to run.
+	run      func(ctx context.Context) error // Run as a goroutine instead of command, until ctx is done.
+	dbusName string                          // If set the service is only healthy when it owns this name.
+	ready    string                          // If set the service announces when it is ready under this name.
+	policy   restartPolicy
+
+	// Returns true if the dbus name has an owner, nameHasOwner unless replaced in tests.
+	hasOwner func(name string) (bool, error)
+
+	mu             sync.Mutex
+	status         WorkerStatus
+	stop           func() // Stops the running service, nil when it isn't running.
+	healthFailures int
+}
+
+var (
+	// The other services need the I2C bus and the ATtiny keeps the RPi powered, so those are
+	// restarted quickly and often.
+	corePolicy = restartPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		ResetAfter:     5 * time.Minute,
+	}
+	defaultPolicy = restartPolicy{
+		InitialBackoff: 5 * time.Second,
+		MaxBackoff:     5 * time.Minute,
+		ResetAfter:     10 * time.Minute,
+	}
+	// The comms output can't do much until the trap or camera recovers, so back off further.
+	commsPolicy = restartPolicy{
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     15 * time.Minute,
+		ResetAfter:     30 * time.Minute,
+	}
+)
+
+// defaultWorkers returns the hat services, with a temperature monitor for each expansion board
+// and the GPIO input events if there are any inputs configured. The services are started with
+// --replace, like their systemd units, so they take over from an instance left running.
+func defaultWorkers(boards []string, gpioInputs bool) []*worker {
+	// Ordered so services are started after the ones they depend on.
+	workers := []*worker{
+		{name: "i2c", command: []string{"/usr/bin/tc2-hat-i2c", "service", "--replace"}, dbusName: "org.cacophony.i2c", ready: readiness.I2C, policy: corePolicy},
+		{name: "rtc", command: []string{"/usr/bin/tc2-hat-rtc", "service", "--replace"}, dbusName: "org.cacophony.RTC", ready: readiness.RTC, policy: defaultPolicy},
+		{name: "attiny", command: []string{"/usr/bin/tc2-hat-attiny", "--replace"}, dbusName: "org.cacophony.ATtiny", ready: readiness.ATtiny, policy: corePolicy},
+		{name: "temp", command: []string{"/usr/bin/tc2-hat-temp", "--replace"}, ready: readiness.Temp, policy: defaultPolicy},
+		{name: "comms", command: []string{"/usr/bin/tc2-hat-comms", "--replace"}, dbusName: "org.cacophony.TC2HatComms", ready: readiness.Comms, policy: commsPolicy},
+	}
+	for _, board := range boards {
+		workers = append(workers, &worker{name: "temp-" + board, command: []string{"/usr/bin/tc2-hat-temp", "--board", board, "--replace"}, ready: readiness.Temp + "-" + board, policy: defaultPolicy})
+	}
+	if gpioInputs {
+		workers = append(workers, &worker{name: "gpio-events", run: gpioEventsWorker, policy: defaultPolicy})
+	}
+	return workers
+}
+
+type supervisor struct {
+	workers []*worker
+}
+
+func newSupervisor(workers []*worker) *supervisor {
+	for _, w := range workers {
+		w.status = WorkerStatus{Name: w.name, State: stateStopped}
+		if w.hasOwner == nil {
+			w.hasOwner = nameHasOwner
+		}
+	}
+	return &supervisor{workers: workers}
+}
+
+// run starts all the workers and keeps them running until the context is cancelled.
+func (s *supervisor) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, w := range s.workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.loop(ctx)
+		}(w)
+		go w.healthLoop(ctx)
+		w.waitHealthy(ctx, dependencyTimeout)
+	}
+	wg.Wait()
+}
+
+func (s *supervisor) statuses() []WorkerStatus {
+	statuses := []WorkerStatus{}
+	for _, w := range s.workers {
+		statuses = append(statuses, w.getStatus())
+	}
+	return statuses
+}
+
+func (w *worker) getStatus() WorkerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+func (w *worker) setState(state string) {
+	w.mu.Lock()
+	w.status.State = state
+	w.mu.Unlock()
+}
+
+// loop runs the service, restarting it when it stops until the context is cancelled.
+func (w *worker) loop(ctx context.Context) {
+	for {
+		startTime := time.Now()
+		err := w.runOnce(ctx)
+		if ctx.Err() != nil {
+			w.setState(stateStopped)
+			return
+		}
+
+		w.mu.Lock()
+		if time.Since(startTime) > w.policy.ResetAfter {
+			w.status.ConsecutiveFailures = 0
+		}
+		w.status.ConsecutiveFailures++
+		w.status.Restarts++
+		w.status.State = stateBackoff
+		w.status.Healthy = false
+		w.status.PID = 0
+		if err != nil {
+			w.status.LastExit = err.Error()
+		} else {
+			w.status.LastExit = "exited"
+		}
+		backoff := w.policy.backoff(w.status.ConsecutiveFailures)
+		w.mu.Unlock()
+
+		log.Printf("Service '%s' stopped (%v), restarting in %s", w.name, err, backoff)
+		select {
+		case <-ctx.Done():
+			w.setState(stateStopped)
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (w *worker) runOnce(ctx context.Context) error {
+	log.Printf("Starting service '%s'", w.name)
+	if w.run != nil {
+		return w.runGoroutine(ctx)
+	}
+	return w.runProcess(ctx)
+}
+
+func (w *worker) started(pid int, stop func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stop = stop
+	w.healthFailures = 0
+	w.status.PID = pid
+	w.status.LastStart = time.Now()
+	w.status.State = stateStarting
+	if w.dbusName == "" {
+		w.status.State = stateRunning
+		w.status.Healthy = true
+	}
+}
+
+func (w *worker) stopped() {
+	w.mu.Lock()
+	w.stop = nil
+	w.mu.Unlock()
+}
+
+func (w *worker) runGoroutine(ctx context.Context) (err error) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.started(0, cancel)
+	defer w.stopped()
+	// A panic is restarted like a process crashing rather than taking down the supervisor.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if err := w.run(runCtx); err != nil {
+		return err
+	}
+	if ctx.Err() == nil && runCtx.Err() != nil {
+		return errors.New("stopped by health check")
+	}
+	return nil
+}
+
+func (w *worker) runProcess(ctx context.Context) error {
+	cmd := exec.Command(w.command[0], w.command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w.started(cmd.Process.Pid, func() { _ = cmd.Process.Kill() })
+	defer w.stopped()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		log.Printf("Stopping service '%s'", w.name)
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case err = <-done:
+		case <-time.After(stopTimeout):
+			_ = cmd.Process.Kill()
+			err = <-done
+		}
+	}
+	return err
+}
+
+// healthLoop checks that the service is on dbus, restarting it if it is not.
+func (w *worker) healthLoop(ctx context.Context) {
+	if w.dbusName == "" {
+		return
+	}
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		w.checkHealth()
+	}
+}
+
+func (w *worker) checkHealth() {
+	w.mu.Lock()
+	stop := w.stop
+	started := w.status.LastStart
+	w.mu.Unlock()
+	if stop == nil {
+		return
+	}
+
+	healthy, err := w.hasOwner(w.dbusName)
+	if err != nil {
+		log.Printf("Error checking health of '%s': %v", w.name, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Healthy = healthy
+	if healthy {
+		w.status.State = stateRunning
+		w.healthFailures = 0
+		return
+	}
+	if time.Since(started) < startupGracePeriod {
+		return
+	}
+	w.status.State = stateUnhealthy
+	w.healthFailures++
+	if w.healthFailures >= maxHealthFailures {
+		log.Printf("Service '%s' is not on dbus as '%s', restarting it", w.name, w.dbusName)
+		stop()
+	}
+}
+
+// waitHealthy waits for the service to be ready and healthy so services depending on it can
+// be started.
+func (w *worker) waitHealthy(ctx context.Context, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if w.ready != "" {
+		if notReady := readiness.Wait(ctx, timeout, w.ready); len(notReady) > 0 {
+			log.Printf("Service '%s' is not ready after %s, starting other services anyway", w.name, timeout)
+			return
+		}
+	}
+	if w.dbusName == "" {
+		return
+	}
+	for time.Now().Before(deadline) {
+		if healthy, err := w.hasOwner(w.dbusName); err == nil && healthy {
+			w.mu.Lock()
+			w.status.Healthy = true
+			w.status.State = stateRunning
+			w.mu.Unlock()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	log.Printf("Service '%s' is not healthy after %s, starting other services anyway", w.name, timeout)
+}
+
+func nameHasOwner(name string) (bool, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false, err
+	}
+	hasOwner := false
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, name).Store(&hasOwner)
+	if err != nil {
+		return false, errors.New("failed to check dbus name owner: " + err.Error())
+	}
+	return hasOwner, nil
+}
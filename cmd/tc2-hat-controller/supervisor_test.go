@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	p := restartPolicy{
+		InitialBackoff: 5 * time.Second,
+		MaxBackoff:     time.Minute,
+	}
+	assert.Equal(t, 5*time.Second, p.backoff(1))
+	assert.Equal(t, 10*time.Second, p.backoff(2))
+	assert.Equal(t, 40*time.Second, p.backoff(4))
+	assert.Equal(t, time.Minute, p.backoff(5))
+	assert.Equal(t, time.Minute, p.backoff(100))
+}
+
+func TestBoardWorkers(t *testing.T) {
+	workers := defaultWorkers([]string{"board1", "board3"}, false)
+	assert.Len(t, workers, 7)
+	assert.Equal(t, "temp-board3", workers[6].name)
+	assert.Equal(t, []string{"/usr/bin/tc2-hat-temp", "--board", "board3", "--replace"}, workers[6].command)
+	// The services take over from an instance that was started outside the supervisor.
+	for _, w := range workers {
+		assert.Contains(t, w.command, "--replace", w.name)
+	}
+
+	workers = defaultWorkers(nil, true)
+	assert.Len(t, workers, 6)
+	assert.Equal(t, "gpio-events", workers[5].name)
+	assert.NotNil(t, workers[5].run)
+	assert.Nil(t, workers[5].command)
+}
+
+// Each supervised service is checked on the D-Bus name it requests, the dbusName constant in
+// its package.
+func TestWorkerDBusNames(t *testing.T) {
+	for _, w := range defaultWorkers(nil, false) {
+		if w.dbusName == "" {
+			continue
+		}
+		dir := filepath.Join("..", filepath.Base(w.command[0]))
+		assert.Equal(t, serviceDBusName(t, dir), w.dbusName, w.name)
+	}
+}
+
+// serviceDBusName returns the value of the dbusName constant in the package.
+func serviceDBusName(t *testing.T, dir string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	assert.NoError(t, err)
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				value := spec.(*ast.ValueSpec)
+				for i, ident := range value.Names {
+					if ident.Name != "dbusName" || i >= len(value.Values) {
+						continue
+					}
+					if lit, ok := value.Values[i].(*ast.BasicLit); ok {
+						name, _ := strconv.Unquote(lit.Value)
+						return name
+					}
+				}
+			}
+		}
+	}
+	t.Errorf("no dbusName in %s", dir)
+	return ""
+}
+
+// waitFor waits for up to a couple of seconds for the worker status to match.
+func waitFor(t *testing.T, w *worker, match func(WorkerStatus) bool) WorkerStatus {
+	for i := 0; i < 200; i++ {
+		if status := w.getStatus(); match(status) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s, status %+v", w.name, w.getStatus())
+	return WorkerStatus{}
+}
+
+func TestWorkerRestarts(t *testing.T) {
+	w := &worker{
+		name:    "fails",
+		command: []string{"sh", "-c", "exit 3"},
+		policy:  restartPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, ResetAfter: time.Hour},
+	}
+	s := newSupervisor([]*worker{w})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.loop(ctx)
+		close(done)
+	}()
+
+	status := waitFor(t, w, func(s WorkerStatus) bool { return s.Restarts >= 3 })
+	assert.Equal(t, "exit status 3", status.LastExit)
+	assert.GreaterOrEqual(t, status.ConsecutiveFailures, 3)
+	assert.Equal(t, "fails", s.statuses()[0].Name)
+
+	cancel()
+	<-done
+	assert.Equal(t, stateStopped, w.getStatus().State)
+}
+
+func TestWorkerHealth(t *testing.T) {
+	mu := sync.Mutex{}
+	owned := false
+	w := &worker{
+		name:     "service",
+		command:  []string{"sleep", "10"},
+		dbusName: "org.cacophony.test",
+		policy:   restartPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour, ResetAfter: time.Hour},
+		hasOwner: func(name string) (bool, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return owned, nil
+		},
+	}
+	newSupervisor([]*worker{w})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.loop(ctx)
+
+	// Starting until it is on dbus.
+	status := waitFor(t, w, func(s WorkerStatus) bool { return s.PID != 0 })
+	assert.Equal(t, stateStarting, status.State)
+	assert.False(t, status.Healthy)
+	mu.Lock()
+	owned = true
+	mu.Unlock()
+	w.checkHealth()
+	status = w.getStatus()
+	assert.Equal(t, stateRunning, status.State)
+	assert.True(t, status.Healthy)
+
+	// Restarted once it has been off dbus for too many checks after starting up.
+	mu.Lock()
+	owned = false
+	mu.Unlock()
+	w.mu.Lock()
+	w.status.LastStart = w.status.LastStart.Add(-startupGracePeriod)
+	w.mu.Unlock()
+	for i := 0; i < maxHealthFailures-1; i++ {
+		w.checkHealth()
+	}
+	assert.Equal(t, stateUnhealthy, w.getStatus().State)
+	assert.Equal(t, 0, w.getStatus().Restarts)
+	w.checkHealth()
+	status = waitFor(t, w, func(s WorkerStatus) bool { return s.Restarts == 1 })
+	assert.Equal(t, stateBackoff, status.State)
+	assert.Equal(t, "signal: killed", status.LastExit)
+	assert.Equal(t, 0, status.PID)
+}
+
+func TestGoroutineWorker(t *testing.T) {
+	runs := make(chan int, 10)
+	count := 0
+	w := &worker{
+		name: "goroutine",
+		run: func(ctx context.Context) error {
+			count++
+			runs <- count
+			switch count {
+			case 1:
+				panic("first run")
+			case 2:
+				return errors.New("second run")
+			}
+			<-ctx.Done()
+			return nil
+		},
+		policy: restartPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, ResetAfter: time.Hour},
+	}
+	newSupervisor([]*worker{w})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.loop(ctx)
+		close(done)
+	}()
+
+	// Restarted after a panic and an error, then keeps running.
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, i, <-runs)
+	}
+	status := waitFor(t, w, func(s WorkerStatus) bool { return s.State == stateRunning })
+	assert.Equal(t, 2, status.Restarts)
+	assert.Equal(t, "second run", status.LastExit)
+	assert.True(t, status.Healthy)
+	assert.Equal(t, 0, status.PID)
+
+	cancel()
+	<-done
+	assert.Equal(t, stateStopped, w.getStatus().State)
+	assert.Equal(t, 2, w.getStatus().Restarts)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/telemetry"
+	"github.com/godbus/dbus"
+)
+
+// telemetryPeriods is the bucket interval and number of buckets for each bundle period.
+var telemetryPeriods = map[string]struct {
+	interval time.Duration
+	buckets  int
+}{
+	"hour": {5 * time.Minute, 12},
+	"day":  {time.Hour, 24},
+}
+
+// telemetryColumns maps the columns of the CSV files to telemetry channels.
+var telemetryColumns = []struct {
+	file     string
+	channels []telemetry.Channel
+}{
+	{temperatureCSVFile, []telemetry.Channel{telemetry.Temperature, telemetry.Humidity}},
+	{batteryReadingsFile, []telemetry.Channel{telemetry.HVBattery, telemetry.LVBattery, telemetry.RTCBattery}},
+}
+
+// addCSVReadings adds the readings from a CSV file written by the hat services to the
+// bundle, skipping lines that can't be parsed. Returns the number of readings added.
+func addCSVReadings(b *telemetry.Bundle, filePath string, channels []telemetry.Channel) (int, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	added := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 2 {
+			continue
+		}
+		t, err := csvtime.Parse(fields[0])
+		if err != nil {
+			continue
+		}
+		for i, c := range channels {
+			if i+1 >= len(fields) {
+				break
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(fields[i+1]), 64)
+			if err != nil {
+				continue
+			}
+			if b.Add(c, t, v) {
+				added++
+			}
+		}
+	}
+	return added, scanner.Err()
+}
+
+// readTelemetryState reads the battery percentage and the ATtiny link stats. The ATtiny is
+// taken as present if tc2-hat-attiny answers.
+func readTelemetryState() telemetry.State {
+	state := telemetry.State{}
+	if batteryState, err := readHILBatteryState(); err != nil {
+		log.Printf("Failed to read battery state: %v", err)
+	} else {
+		state.BatteryPercent = uint8(math.Round(max(0, min(100, batteryState.LastPercent))))
+	}
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		log.Printf("Failed to connect to DBus: %v", err)
+		return state
+	}
+	var statsJSON string
+	obj := conn.Object("org.cacophony.ATtiny", "/org/cacophony/ATtiny")
+	if err := obj.Call("org.cacophony.ATtiny.GetLinkStats", 0).Store(&statsJSON); err != nil {
+		log.Printf("Failed to get ATtiny link stats: %v", err)
+		return state
+	}
+	state.ATtinyPresent = true
+	stats := struct {
+		FailureRatePercent float64 `json:"failureRatePercent"`
+	}{}
+	if err := json.Unmarshal([]byte(statsJSON), &stats); err != nil {
+		log.Printf("Failed to parse ATtiny link stats: %v", err)
+		return state
+	}
+	state.LinkFailurePerMille = uint16(math.Round(max(0, min(1000, stats.FailureRatePercent*10))))
+	return state
+}
+
+// makeTelemetryBundle makes a bundle for the period ending at the start of the current bucket.
+func makeTelemetryBundle(args *Telemetry, now time.Time) (*telemetry.Bundle, error) {
+	period, ok := telemetryPeriods[args.Period]
+	if !ok {
+		return nil, exitcode.Wrap(exitcode.Usage, fmt.Errorf("unknown period '%s', must be 'hour' or 'day'", args.Period))
+	}
+	interval, buckets := period.interval, period.buckets
+	if args.Interval != 0 {
+		if args.Interval < time.Second {
+			return nil, fmt.Errorf("interval must be at least a second")
+		}
+		buckets = int(time.Duration(buckets) * interval / args.Interval)
+		interval = args.Interval
+	}
+	end := now.Truncate(interval)
+	b := telemetry.New(end.Add(-time.Duration(buckets)*interval), interval, buckets)
+	for _, csv := range telemetryColumns {
+		added, err := addCSVReadings(b, csv.file, csv.channels)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", csv.file, err)
+		}
+		log.Debugf("Added %d readings from %s", added, csv.file)
+	}
+	return b, nil
+}
+
+// runTelemetry writes a compressed telemetry bundle, or prints a decoded one.
+func runTelemetry(args *Telemetry) error {
+	if args.Decode != "" {
+		data, err := os.ReadFile(args.Decode)
+		if err != nil {
+			return err
+		}
+		b, err := telemetry.Decode(data)
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	b, err := makeTelemetryBundle(args, time.Now())
+	if err != nil {
+		return err
+	}
+	b.State = readTelemetryState()
+	data, err := telemetry.Encode(b)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(args.Output, data, 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d byte telemetry bundle for %s to %s to %s",
+		len(data), b.Start.Format(time.DateTime), b.End().Format(time.DateTime), args.Output)
+	return nil
+}
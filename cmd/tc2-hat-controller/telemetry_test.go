@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/telemetry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddCSVReadings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "temperature.csv")
+	csv := "2024-03-10 14:03:12, 21.50, 60.00\ngarbled\n2024-03-10 14:13:12, 22.50, bad\n2024-03-10 16:00:00, 30, 50\n"
+	assert.NoError(t, os.WriteFile(file, []byte(csv), 0644))
+
+	start := time.Date(2024, 3, 10, 14, 0, 0, 0, time.Local)
+	b := telemetry.New(start, time.Hour, 2)
+	added, err := addCSVReadings(b, file, []telemetry.Channel{telemetry.Temperature, telemetry.Humidity})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, added)
+	assert.Equal(t, 22.0, b.Series[telemetry.Temperature][0])
+	assert.Equal(t, 60.0, b.Series[telemetry.Humidity][0])
+}
+
+func TestMakeTelemetryBundlePeriod(t *testing.T) {
+	now := time.Date(2024, 3, 10, 14, 7, 0, 0, time.UTC)
+	b, err := makeTelemetryBundle(&Telemetry{Period: "hour"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, b.Buckets())
+	assert.Equal(t, time.Date(2024, 3, 10, 14, 5, 0, 0, time.UTC), b.End())
+
+	b, err = makeTelemetryBundle(&Telemetry{Period: "day", Interval: 2 * time.Hour}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, b.Buckets())
+
+	_, err = makeTelemetryBundle(&Telemetry{Period: "week"}, now)
+	assert.Error(t, err)
+}
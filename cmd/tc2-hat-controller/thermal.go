@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/godbus/dbus"
+)
+
+// The highest temperature in each hour of the day is kept for the last history-days days, so
+// the times of day the enclosure gets too hot can be found even though temperature.csv only
+// keeps a day or so of readings:
+//
+//	[thermal-advisory]
+//	threshold = 45.0
+//	min-days = 3
+//	history-days = 14
+//
+// An hour is a heat peak when the temperature went over threshold, in °C, on at least
+// min-days days and on at least half of the days with readings in that hour. Heat peak hours
+// next to each other are advised as one window, e.g. "enclosure exceeds 45°C daily
+// 13:00-15:00", in a thermalAdvisory event whenever the windows change, so the recording
+// scheduler can avoid running the camera through them. A thermalAdvisoryCleared event is made
+// when there are no windows left. The daily profile can be fetched with GetThermalProfile.
+const (
+	thermalConfigKey      = "thermal-advisory"
+	thermalProfileFile    = "/etc/cacophony/thermal-profile.json"
+	thermalCheckInterval  = time.Hour
+	thermalMinHotFraction = 0.5
+)
+
+type thermalConfig struct {
+	Threshold   float64 `mapstructure:"threshold"`
+	MinDays     int     `mapstructure:"min-days"`
+	HistoryDays int     `mapstructure:"history-days"`
+}
+
+func defaultThermalConfig() thermalConfig {
+	return thermalConfig{
+		Threshold:   45,
+		MinDays:     3,
+		HistoryDays: 14,
+	}
+}
+
+// loadThermalConfig returns the thermal advisory config, the default config is returned with
+// the error if it can't be read.
+func loadThermalConfig() (thermalConfig, error) {
+	c := defaultThermalConfig()
+	config, err := goconfig.New(goconfig.DefaultConfigDir)
+	if err != nil {
+		return c, err
+	}
+	if err := configcompat.Unmarshal(config, thermalConfigKey, &c); err != nil {
+		return defaultThermalConfig(), err
+	}
+	if c.MinDays < 1 || c.HistoryDays < c.MinDays {
+		return defaultThermalConfig(), fmt.Errorf("%s min-days must be positive and no more than history-days", thermalConfigKey)
+	}
+	return c, nil
+}
+
+// thermalDay is the highest temperature in each hour of a day, nil for hours without readings.
+type thermalDay struct {
+	Date string       `json:"date"` // Local time, YYYY-MM-DD.
+	Max  [24]*float64 `json:"max"`
+}
+
+// thermalHistory is what is saved in thermalProfileFile.
+type thermalHistory struct {
+	LastReading time.Time     `json:"lastReading"`
+	Days        []*thermalDay `json:"days"`
+	Advised     []heatWindow  `json:"advised"` // The windows in the last event.
+}
+
+// add records the reading in the hour it was made.
+func (h *thermalHistory) add(t time.Time, temp float64) {
+	t = t.Local()
+	date := t.Format(time.DateOnly)
+	var day *thermalDay
+	for i := len(h.Days) - 1; i >= 0; i-- {
+		if h.Days[i].Date == date {
+			day = h.Days[i]
+			break
+		}
+	}
+	if day == nil {
+		day = &thermalDay{Date: date}
+		h.Days = append(h.Days, day)
+		sort.Slice(h.Days, func(i, j int) bool { return h.Days[i].Date < h.Days[j].Date })
+	}
+	if m := day.Max[t.Hour()]; m == nil || temp > *m {
+		day.Max[t.Hour()] = &temp
+	}
+	if t.After(h.LastReading) {
+		h.LastReading = t
+	}
+}
+
+// trim removes the days from before the history.
+func (h *thermalHistory) trim(now time.Time, days int) {
+	cutoff := now.Local().AddDate(0, 0, -days).Format(time.DateOnly)
+	kept := []*thermalDay{}
+	for _, d := range h.Days {
+		if d.Date > cutoff {
+			kept = append(kept, d)
+		}
+	}
+	h.Days = kept
+}
+
+// heatWindow is a time of day the enclosure is often over the threshold, from the start of
+// its first hour to the end of its last.
+type heatWindow struct {
+	Start   string  `json:"start"` // HH:MM
+	End     string  `json:"end"`
+	MaxTemp float64 `json:"maxTemp"` // Highest temperature in the window over the history.
+	HotDays int     `json:"hotDays"` // Most days an hour in the window was over the threshold.
+}
+
+func (w heatWindow) advisory(threshold float64) string {
+	return fmt.Sprintf("enclosure exceeds %g°C daily %s-%s", threshold, w.Start, w.End)
+}
+
+// thermalHour is an hour of the day over the history.
+type thermalHour struct {
+	Hour     int     `json:"hour"`
+	Days     int     `json:"days"` // Days with readings in the hour.
+	MeanMax  float64 `json:"meanMax"`
+	Max      float64 `json:"max"`
+	HotDays  int     `json:"hotDays"`
+	HeatPeak bool    `json:"heatPeak"`
+}
+
+// thermalProfile is the daily thermal profile.
+type thermalProfile struct {
+	Threshold   float64       `json:"threshold"`
+	Days        int           `json:"days"`
+	LastReading time.Time     `json:"lastReading"`
+	Hours       []thermalHour `json:"hours"`
+	HeatPeaks   []heatWindow  `json:"heatPeaks"`
+}
+
+// thermalAdvisor keeps the temperature history and advises when the heat peaks are.
+type thermalAdvisor struct {
+	config  thermalConfig
+	file    string
+	csvFile string
+	now     func() time.Time
+
+	mu      sync.Mutex
+	history thermalHistory
+}
+
+func newThermalAdvisor() *thermalAdvisor {
+	c, err := loadThermalConfig()
+	if err != nil {
+		log.Errorf("Failed to read thermal advisory config, using defaults: %v", err)
+	}
+	a := &thermalAdvisor{
+		config:  c,
+		file:    thermalProfileFile,
+		csvFile: temperatureCSVFile,
+		now:     time.Now,
+	}
+	if err := a.load(); err != nil {
+		log.Errorf("Failed to load the thermal profile, starting a new one: %v", err)
+	}
+	return a
+}
+
+func (a *thermalAdvisor) load() error {
+	data, err := os.ReadFile(a.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h := thermalHistory{}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return err
+	}
+	a.history = h
+	return nil
+}
+
+func (a *thermalAdvisor) save() error {
+	data, err := json.MarshalIndent(a.history, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := a.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, a.file)
+}
+
+// readNew adds the readings made since the last one in the history. Lines that can't be
+// parsed and readings from the future, made before the clock was set, are skipped.
+func (a *thermalAdvisor) readNew(now time.Time) error {
+	file, err := os.Open(a.csvFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 2 {
+			continue
+		}
+		t, err := csvtime.Parse(fields[0])
+		if err != nil || !t.After(a.history.LastReading) || t.After(now.Add(time.Hour)) {
+			continue
+		}
+		temp, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			continue
+		}
+		a.history.add(t, temp)
+	}
+	return scanner.Err()
+}
+
+// profile returns the daily thermal profile from the history.
+func (a *thermalAdvisor) profile() thermalProfile {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.profileLocked()
+}
+
+func (a *thermalAdvisor) profileLocked() thermalProfile {
+	p := thermalProfile{
+		Threshold:   a.config.Threshold,
+		Days:        len(a.history.Days),
+		LastReading: a.history.LastReading,
+	}
+	for hour := 0; hour < 24; hour++ {
+		h := thermalHour{Hour: hour}
+		sum := 0.0
+		for _, d := range a.history.Days {
+			m := d.Max[hour]
+			if m == nil {
+				continue
+			}
+			if h.Days == 0 || *m > h.Max {
+				h.Max = *m
+			}
+			h.Days++
+			sum += *m
+			if *m > a.config.Threshold {
+				h.HotDays++
+			}
+		}
+		if h.Days > 0 {
+			h.MeanMax = math.Round(sum/float64(h.Days)*10) / 10
+		}
+		h.HeatPeak = h.HotDays >= a.config.MinDays && float64(h.HotDays) >= thermalMinHotFraction*float64(h.Days)
+		p.Hours = append(p.Hours, h)
+	}
+	p.HeatPeaks = heatWindows(p.Hours)
+	return p
+}
+
+// heatWindows joins the heat peak hours next to each other into windows.
+func heatWindows(hours []thermalHour) []heatWindow {
+	windows := []heatWindow{}
+	var w *heatWindow
+	for _, h := range hours {
+		if !h.HeatPeak {
+			w = nil
+			continue
+		}
+		if w == nil {
+			windows = append(windows, heatWindow{Start: fmt.Sprintf("%02d:00", h.Hour), MaxTemp: h.Max})
+			w = &windows[len(windows)-1]
+		}
+		w.End = fmt.Sprintf("%02d:00", (h.Hour+1)%24)
+		w.MaxTemp = max(w.MaxTemp, h.Max)
+		w.HotDays = max(w.HotDays, h.HotDays)
+	}
+	// A window running up to midnight carries on into the one starting at midnight.
+	if n := len(windows); n > 1 && windows[0].Start == "00:00" && windows[n-1].End == "00:00" {
+		windows[n-1].End = windows[0].End
+		windows[n-1].MaxTemp = max(windows[n-1].MaxTemp, windows[0].MaxTemp)
+		windows[n-1].HotDays = max(windows[n-1].HotDays, windows[0].HotDays)
+		windows = windows[1:]
+	}
+	return windows
+}
+
+// sameWindows returns true if the windows cover the same times, the temperatures in them
+// change every day so aren't compared.
+func sameWindows(a, b []heatWindow) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Start != b[i].Start || a[i].End != b[i].End {
+			return false
+		}
+	}
+	return true
+}
+
+// update adds the new readings to the history, making an event if the heat peaks have changed.
+func (a *thermalAdvisor) update() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if err := a.readNew(now); err != nil {
+		return err
+	}
+	a.history.trim(now, a.config.HistoryDays)
+	p := a.profileLocked()
+	if !sameWindows(p.HeatPeaks, a.history.Advised) {
+		if err := a.report(p, now); err != nil {
+			log.Errorf("Error adding event: %v", err)
+		}
+		a.history.Advised = p.HeatPeaks
+	}
+	return a.save()
+}
+
+func (a *thermalAdvisor) report(p thermalProfile, now time.Time) error {
+	if len(p.HeatPeaks) == 0 {
+		log.Info("No heat peaks in the temperature history")
+		return eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ThermalAdvisoryCleared, now, eventhelper.ThermalAdvisory{
+			Threshold: p.Threshold,
+			Days:      p.Days,
+		}))
+	}
+	advisory := eventhelper.ThermalAdvisory{Threshold: p.Threshold, Days: p.Days}
+	for _, w := range p.HeatPeaks {
+		advisory.Advisories = append(advisory.Advisories, w.advisory(p.Threshold))
+		advisory.HeatPeaks = append(advisory.HeatPeaks, eventhelper.HeatPeak{
+			Start:   w.Start,
+			End:     w.End,
+			MaxTemp: w.MaxTemp,
+			HotDays: w.HotDays,
+		})
+	}
+	log.Infof("Thermal advisory: %s", strings.Join(advisory.Advisories, ", "))
+	return eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ThermalAdvisoryRaised, now, advisory))
+}
+
+// run updates the history every thermalCheckInterval until the context is cancelled.
+func (a *thermalAdvisor) run(ctx context.Context) {
+	for {
+		if err := a.update(); err != nil {
+			log.Errorf("Failed to update the thermal profile: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(thermalCheckInterval):
+		}
+	}
+}
+
+// getThermalProfile gets the daily thermal profile from the running controller.
+func getThermalProfile() (string, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return "", err
+	}
+	profile := ""
+	err = conn.Object(dbusName, dbusPath).Call(dbusName+".GetThermalProfile", 0).Store(&profile)
+	return profile, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThermalAdvisor(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "temperature.csv")
+	start := time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)
+	now := start
+	events := eventtest.Capture(t)
+	a := &thermalAdvisor{
+		config:  defaultThermalConfig(),
+		file:    filepath.Join(dir, "thermal-profile.json"),
+		csvFile: csvFile,
+		now:     func() time.Time { return now },
+	}
+
+	// Readings every 10 minutes, over 45°C from 13:00 to 15:00.
+	writeDays := func(days int, hot bool) {
+		lines := []string{}
+		for i := 0; i < days*24*6; i++ {
+			ts := now.Add(time.Duration(i) * 10 * time.Minute)
+			temp := 25.0
+			if hot && ts.Hour() >= 13 && ts.Hour() < 15 {
+				temp = 48
+			}
+			lines = append(lines, fmt.Sprintf("%s, %.2f, 40.00", csvtime.Format(ts, false), temp))
+		}
+		now = now.AddDate(0, 0, days)
+		assert.NoError(t, os.WriteFile(csvFile, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+	}
+
+	writeDays(2, true)
+	assert.NoError(t, a.update())
+	assert.Empty(t, events.Events(), "not enough hot days yet")
+
+	writeDays(2, true)
+	assert.NoError(t, a.update())
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "thermalAdvisory", events.Events()[0].Type)
+		assert.Equal(t, []string{"enclosure exceeds 45°C daily 13:00-15:00"}, events.Events()[0].Details["advisories"])
+	}
+	p := a.profile()
+	assert.Equal(t, 4, p.Days)
+	assert.Equal(t, 4, p.Hours[13].HotDays)
+	assert.Equal(t, 48.0, p.Hours[14].Max)
+	assert.Equal(t, 25.0, p.Hours[15].MeanMax)
+
+	// The same window isn't advised again, and is kept over restarts.
+	writeDays(1, true)
+	assert.NoError(t, a.update())
+	assert.Len(t, events.Events(), 1)
+	reloaded := &thermalAdvisor{config: a.config, file: a.file}
+	assert.NoError(t, reloaded.load())
+	assert.Equal(t, a.history.Advised, reloaded.history.Advised)
+
+	// Cooler days outnumber the hot ones once the old days are out of the history.
+	writeDays(12, false)
+	assert.NoError(t, a.update())
+	if assert.Len(t, events.Events(), 2) {
+		assert.Equal(t, "thermalAdvisoryCleared", events.Events()[1].Type)
+	}
+}
+
+func TestHeatWindows(t *testing.T) {
+	hours := make([]thermalHour, 24)
+	for i := range hours {
+		hours[i] = thermalHour{Hour: i, HeatPeak: i <= 1 || i == 12 || i == 23, Max: float64(40 + i)}
+	}
+	windows := heatWindows(hours)
+	assert.Equal(t, []heatWindow{
+		{Start: "12:00", End: "13:00", MaxTemp: 52},
+		{Start: "23:00", End: "02:00", MaxTemp: 63},
+	}, windows)
+}
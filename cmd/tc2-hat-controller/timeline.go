@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
+	"github.com/TheCacophonyProject/tc2-hat-controller/timeline"
+)
+
+type Timeline struct {
+	Temperature string        `arg:"--temperature" help:"Temperature CSV file, defaults to the one on this device."`
+	Battery     string        `arg:"--battery" help:"Battery readings CSV file, defaults to the one on this device."`
+	Events      string        `arg:"--events" help:"Events file with a JSON event on each line, defaults to the one of a standalone datalogger."`
+	ClockSteps  string        `arg:"--clock-steps" help:"Clock steps file, defaults to the one on this device."`
+	Tolerance   time.Duration `arg:"--tolerance" help:"How far a jump in a file can be from a clock step for it to be taken as the step, longer than the time between readings."`
+	Output      string        `arg:"-o,--output" help:"File to write the CSV timeline to, printed if not set."`
+}
+
+// timelineSource is a history to merge into the timeline.
+type timelineSource struct {
+	name  string
+	path  string
+	given bool // The file was given on the command line, so it must exist.
+	read  func(r io.Reader, source string) ([]timeline.Entry, int, error)
+}
+
+// runTimeline merges the temperature, battery and event histories into one timeline,
+// correcting for the clock steps.
+func runTimeline(args *Timeline) error {
+	eventsFile := args.Events
+	if eventsFile == "" && standalone.Enabled() {
+		if c, err := standalone.LoadConfig(); err == nil {
+			eventsFile = filepath.Join(c.DataDir, standalone.EventsFileName)
+		}
+	}
+	sources := []timelineSource{
+		{"temperature", orDefault(args.Temperature, temperatureCSVFile), args.Temperature != "", func(r io.Reader, source string) ([]timeline.Entry, int, error) {
+			return timeline.ReadCSV(r, source, []string{"temp", "humidity"})
+		}},
+		{"battery", orDefault(args.Battery, batteryReadingsFile), args.Battery != "", timeline.ReadBatteryCSV},
+	}
+	if eventsFile != "" {
+		sources = append(sources, timelineSource{"events", eventsFile, args.Events != "", timeline.ReadEvents})
+	}
+	tolerance := args.Tolerance
+	if tolerance <= 0 {
+		tolerance = timeline.DefaultTolerance
+	}
+
+	steps := []timeline.ClockStep{}
+	if f, err := os.Open(orDefault(args.ClockSteps, timeline.ClockStepsFile)); err == nil {
+		steps, _, err = timeline.ReadClockSteps(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	histories := [][]timeline.Entry{}
+	for _, s := range sources {
+		f, err := os.Open(s.path)
+		if os.IsNotExist(err) && !s.given {
+			log.Printf("No %s history at %s", s.name, s.path)
+			continue
+		}
+		if err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		entries, bad, err := s.read(f, s.name)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", s.path, err)
+		}
+		found := timeline.Correct(entries, steps, tolerance)
+		log.Printf("Read %d %s entries, skipped %d lines, found %d of %d clock steps", len(entries), s.name, bad, found, len(steps))
+		histories = append(histories, entries)
+	}
+
+	out := os.Stdout
+	if args.Output != "" {
+		f, err := os.Create(args.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return timeline.WriteCSV(out, timeline.Merge(histories...))
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
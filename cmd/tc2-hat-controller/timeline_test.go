@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTimeline(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		file := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(file, []byte(data), 0644))
+		return file
+	}
+	args := &Timeline{
+		Temperature: write("temperature.csv", "2026-06-01T09:50:00Z, 10.50, 80.00\n2026-06-02T10:10:00Z, 11.00, 78.00\n"),
+		Battery:     write("battery-readings.csv", "2026-06-02T10:05:00Z, 24.00, 0.00, 3.10, 0\n"),
+		ClockSteps:  write("clock-steps.csv", "2026-06-02T10:00:30Z, 86400.000\n"),
+		Output:      filepath.Join(dir, "timeline.csv"),
+	}
+	assert.NoError(t, runTimeline(args))
+	data, err := os.ReadFile(args.Output)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 1+2+4+2)
+	assert.Equal(t, "2026-06-02T09:50:00Z,2026-06-01T09:50:00Z,temperature,reading,humidity,80.00", lines[1])
+	assert.True(t, strings.HasPrefix(lines[3], "2026-06-02T10:05:00Z,2026-06-02T10:05:00Z,battery"))
+
+	// Files given on the command line must exist.
+	args.Events = filepath.Join(dir, "missing.jsonl")
+	assert.Error(t, runTimeline(args))
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/godbus/dbus"
+)
+
+// The device twin is a single document with the current state of the hat. It is saved to
+// twinFile and sent as a deviceTwin event whenever a significant field changes, so the
+// server can get the current state of the hat from the latest event without replaying the
+// event history. Small changes in the readings, less than the thresholds below, don't
+// count as a change. The revision is increased each time the twin is sent.
+const (
+	twinFile            = "/etc/cacophony/device-twin.json"
+	cameraPowerFile     = "/etc/cacophony/camera-power.json"
+	twinCheckInterval   = time.Minute
+	twinBatteryPercent  = 5  // Percentage points.
+	twinTemp            = 2  // °C
+	twinHumidity        = 10 // %
+	twinMaxReadingAge   = 30 * time.Minute
+	configFileName      = "config.toml"
+	trapActiveFile      = "/etc/cacophony/trap-active"
+	trapDisarmedFile    = "/etc/cacophony/trap-disarmed"
+	twinRefreshInterval = 24 * time.Hour // Sent at least this often even without changes.
+)
+
+type twinBattery struct {
+	Percent float64 `json:"percent"`
+	Voltage float64 `json:"voltage"`
+}
+
+type twinEnvironment struct {
+	Temp     float64 `json:"temp"`
+	Humidity float64 `json:"humidity"`
+	// The temperature is estimated from the SoC, there is no humidity.
+	Estimated bool `json:"estimated,omitempty"`
+	// The humidity sensor is saturated or recovering from it.
+	HumiditySuspect bool `json:"humiditySuspect,omitempty"`
+}
+
+type twinTrap struct {
+	Active   bool `json:"active"`
+	Disarmed bool `json:"disarmed"`
+}
+
+// twinCameraPower is the camera power cycles, powered on hours and average boot duration
+// counted by tc2-hat-attiny.
+type twinCameraPower struct {
+	PowerCycles    int     `json:"powerCycles"`
+	PoweredOnHours float64 `json:"poweredOnHours"`
+	AvgBootSeconds float64 `json:"avgBootSeconds"`
+}
+
+type twinVersions struct {
+	Controller string `json:"controller"`
+	ATtiny     int    `json:"attiny,omitempty"`
+	MainPCB    string `json:"mainPCB,omitempty"`
+	PowerPCB   string `json:"powerPCB,omitempty"`
+}
+
+// deviceTwin is the state of the hat. Readings that couldn't be made are nil.
+type deviceTwin struct {
+	Revision    int              `json:"revision"`
+	Updated     time.Time        `json:"updated"`
+	Battery     *twinBattery     `json:"battery,omitempty"`
+	Environment *twinEnvironment `json:"environment,omitempty"`
+	CameraState string           `json:"cameraState,omitempty"`
+	CameraPower *twinCameraPower `json:"cameraPower,omitempty"`
+	Trap        twinTrap         `json:"trap"`
+	Versions    twinVersions     `json:"versions"`
+	ConfigHash  string           `json:"configHash,omitempty"`
+}
+
+// changes returns the significant fields that are different from the previous twin.
+func (t deviceTwin) changes(prev *deviceTwin) []string {
+	if prev == nil {
+		return []string{"all"}
+	}
+	changed := []string{}
+	if (t.Battery == nil) != (prev.Battery == nil) ||
+		(t.Battery != nil && math.Abs(t.Battery.Percent-prev.Battery.Percent) >= twinBatteryPercent) {
+		changed = append(changed, "battery")
+	}
+	if (t.Environment == nil) != (prev.Environment == nil) ||
+		(t.Environment != nil && (math.Abs(t.Environment.Temp-prev.Environment.Temp) >= twinTemp ||
+			math.Abs(t.Environment.Humidity-prev.Environment.Humidity) >= twinHumidity ||
+			t.Environment.Estimated != prev.Environment.Estimated ||
+			t.Environment.HumiditySuspect != prev.Environment.HumiditySuspect)) {
+		changed = append(changed, "environment")
+	}
+	if t.CameraState != prev.CameraState {
+		changed = append(changed, "cameraState")
+	}
+	// The powered on hours go up all the time, so only a new power cycle counts.
+	if (t.CameraPower == nil) != (prev.CameraPower == nil) ||
+		(t.CameraPower != nil && t.CameraPower.PowerCycles != prev.CameraPower.PowerCycles) {
+		changed = append(changed, "cameraPower")
+	}
+	if t.Trap != prev.Trap {
+		changed = append(changed, "trap")
+	}
+	if t.Versions != prev.Versions {
+		changed = append(changed, "versions")
+	}
+	if t.ConfigHash != prev.ConfigHash {
+		changed = append(changed, "configHash")
+	}
+	return changed
+}
+
+func loadTwin(file string) (*deviceTwin, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &deviceTwin{}
+	return t, json.Unmarshal(data, t)
+}
+
+func saveTwin(file string, t *deviceTwin) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// twinPublisher reads the state of the hat and publishes the twin when it changes.
+type twinPublisher struct {
+	file string
+	read func() deviceTwin
+	now  func() time.Time
+
+	last *deviceTwin
+}
+
+func newTwinPublisher() *twinPublisher {
+	p := &twinPublisher{
+		file: twinFile,
+		read: readDeviceTwin,
+		now:  time.Now,
+	}
+	last, err := loadTwin(p.file)
+	if err != nil {
+		log.Errorf("Failed to load device twin, starting a new one: %v", err)
+	}
+	p.last = last
+	return p
+}
+
+// update reads the state and publishes it if it changed. Returns true if it was published.
+func (p *twinPublisher) update() (bool, error) {
+	t := p.read()
+	changed := t.changes(p.last)
+	if len(changed) == 0 && p.now().Sub(p.last.Updated) < twinRefreshInterval {
+		return false, nil
+	}
+	if p.last != nil {
+		t.Revision = p.last.Revision + 1
+	}
+	t.Updated = p.now()
+	if err := saveTwin(p.file, &t); err != nil {
+		return false, err
+	}
+	p.last = &t
+	log.Printf("Device twin revision %d, changed: %v", t.Revision, changed)
+
+	state := map[string]interface{}{}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, err
+	}
+	return true, eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.DeviceTwinPublished, t.Updated, eventhelper.DeviceTwin{
+		Changed: changed,
+		State:   state,
+	}))
+}
+
+// run updates the twin every twinCheckInterval until the context is cancelled.
+func (p *twinPublisher) run(ctx context.Context) {
+	for {
+		if _, err := p.update(); err != nil {
+			log.Errorf("Failed to publish device twin: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(twinCheckInterval):
+		}
+	}
+}
+
+// readDeviceTwin reads the current state of the hat from the files saved by the hat services
+// and from tc2-hat-attiny.
+func readDeviceTwin() deviceTwin {
+	now := time.Now()
+	t := deviceTwin{
+		Trap: twinTrap{
+			Active:   fileExists(trapActiveFile),
+			Disarmed: fileExists(trapDisarmedFile),
+		},
+		Versions: twinVersions{Controller: version},
+	}
+	if values, ok := readTwinCSV(batteryReadingsFile, now); ok {
+		battery := &twinBattery{Voltage: math.Round(max(values[0], values[1])*100) / 100}
+		if state, err := readHILBatteryState(); err == nil {
+			battery.Percent = math.Round(state.LastPercent)
+		}
+		t.Battery = battery
+	}
+	if values, ok := readTwinCSV(temperatureCSVFile, now); ok {
+		t.Environment = &twinEnvironment{Temp: math.Round(values[0]*10) / 10}
+		// The fourth column flags estimated readings and suspect humidities, see tc2-hat-temp.
+		if len(values) > 2 && values[2] == 1 {
+			t.Environment.Estimated = true
+		} else {
+			t.Environment.Humidity = math.Round(values[1])
+			t.Environment.HumiditySuspect = len(values) > 2 && values[2] == 2
+		}
+	}
+	if state, attinyVersion, err := readCameraState(); err != nil {
+		log.Debugf("Failed to read camera state: %v", err)
+	} else {
+		t.CameraState = state
+		t.Versions.ATtiny = attinyVersion
+	}
+	if power, err := readCameraPower(); err != nil {
+		log.Debugf("Failed to read camera power stats: %v", err)
+	} else {
+		t.CameraPower = power
+	}
+	if v, err := eeprom.GetMainPCBVersion(); err == nil {
+		t.Versions.MainPCB = v
+	}
+	if v, err := eeprom.GetPowerPCBVersion(); err == nil {
+		t.Versions.PowerPCB = v
+	}
+	if hash, err := configHash(filepath.Join(goconfig.DefaultConfigDir, configFileName)); err == nil {
+		t.ConfigHash = hash
+	}
+	return t
+}
+
+// readTwinCSV returns the last readings in the CSV file if there are at least two values
+// and they aren't older than twinMaxReadingAge.
+func readTwinCSV(file string, now time.Time) ([]float64, bool) {
+	t, values, err := readLastCSVLine(file)
+	if err != nil {
+		log.Debugf("Failed to read %s: %v", file, err)
+		return nil, false
+	}
+	return values, len(values) >= 2 && now.Sub(t) <= twinMaxReadingAge
+}
+
+func readCameraState() (string, int, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return "", 0, err
+	}
+	var state string
+	var attinyVersion int32
+	obj := conn.Object("org.cacophony.ATtiny", "/org/cacophony/ATtiny")
+	if err := obj.Call("org.cacophony.ATtiny.GetCameraState", 0).Store(&state, &attinyVersion); err != nil {
+		return "", 0, err
+	}
+	return state, int(attinyVersion), nil
+}
+
+// readCameraPower reads the camera power stats saved by tc2-hat-attiny.
+func readCameraPower() (*twinCameraPower, error) {
+	data, err := os.ReadFile(cameraPowerFile)
+	if err != nil {
+		return nil, err
+	}
+	stats := struct {
+		Total struct {
+			PowerCycles      int     `json:"powerCycles"`
+			PoweredOnSeconds float64 `json:"poweredOnSeconds"`
+			Boots            int     `json:"boots"`
+			BootSeconds      float64 `json:"bootSeconds"`
+		} `json:"total"`
+	}{}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, err
+	}
+	power := &twinCameraPower{
+		PowerCycles:    stats.Total.PowerCycles,
+		PoweredOnHours: math.Round(stats.Total.PoweredOnSeconds/36) / 100,
+	}
+	if stats.Total.Boots > 0 {
+		power.AvgBootSeconds = math.Round(stats.Total.BootSeconds/float64(stats.Total.Boots)*10) / 10
+	}
+	return power, nil
+}
+
+// configHash returns a short hash of the config file so config changes can be seen.
+func configHash(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// printTwin prints the last published device twin.
+func printTwin() error {
+	t, err := loadTwin(twinFile)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("no device twin has been published yet")
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTwinChanges(t *testing.T) {
+	prev := deviceTwin{
+		Battery:     &twinBattery{Percent: 80, Voltage: 12.5},
+		Environment: &twinEnvironment{Temp: 20, Humidity: 60},
+		CameraState: "Powered On",
+	}
+	assert.Equal(t, []string{"all"}, prev.changes(nil))
+
+	small := prev
+	small.Battery = &twinBattery{Percent: 78, Voltage: 12.4}
+	small.Environment = &twinEnvironment{Temp: 21, Humidity: 65}
+	assert.Empty(t, small.changes(&prev))
+
+	big := prev
+	big.Battery = nil
+	big.Environment = &twinEnvironment{Temp: 23, Humidity: 60}
+	big.Trap.Active = true
+	big.ConfigHash = "abcd"
+	assert.Equal(t, []string{"battery", "environment", "trap", "configHash"}, big.changes(&prev))
+
+	prev.CameraPower = &twinCameraPower{PowerCycles: 10, PoweredOnHours: 20}
+	on := prev
+	on.CameraPower = &twinCameraPower{PowerCycles: 10, PoweredOnHours: 21}
+	assert.Empty(t, on.changes(&prev))
+	on.CameraPower = &twinCameraPower{PowerCycles: 11, PoweredOnHours: 21}
+	assert.Equal(t, []string{"cameraPower"}, on.changes(&prev))
+}
+
+func TestTwinPublisher(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	state := deviceTwin{CameraState: "Powered On", Versions: twinVersions{Controller: "1.0.0"}}
+	events := eventtest.Capture(t)
+	p := &twinPublisher{
+		file: filepath.Join(t.TempDir(), "twin.json"),
+		read: func() deviceTwin { return state },
+		now:  func() time.Time { return now },
+	}
+
+	published, err := p.update()
+	assert.NoError(t, err)
+	assert.True(t, published)
+	published, err = p.update()
+	assert.NoError(t, err)
+	assert.False(t, published)
+
+	state.CameraState = "Powering Off"
+	now = now.Add(time.Minute)
+	published, err = p.update()
+	assert.NoError(t, err)
+	assert.True(t, published)
+	assert.Len(t, events.Events(), 2)
+	assert.Equal(t, "deviceTwin", events.Events()[1].Type)
+	assert.Equal(t, "Powering Off", events.Events()[1].Details["cameraState"])
+	assert.Equal(t, []string{"cameraState"}, events.Events()[1].Details["changed"])
+
+	// The twin is saved so the revision carries on after a restart.
+	saved, err := loadTwin(p.file)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, saved.Revision)
+
+	// Sent again after the refresh interval even without changes.
+	now = now.Add(twinRefreshInterval)
+	published, err = p.update()
+	assert.NoError(t, err)
+	assert.True(t, published)
+}
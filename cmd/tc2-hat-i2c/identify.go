@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+// Devices found with find are identified by reading registers that only the known device
+// classes have, like a WHO_AM_I register, trying each class that can be at the address until
+// one matches. Most of the parts don't have an ID register so the signatures are the fixed
+// values and reserved bits of their registers, which makes the part a best guess. The
+// signature reads only set the register pointer, they don't write to the devices.
+const (
+	identifyTimeout = 1000 // ms
+
+	// Addresses scanned by find --all, the others are reserved.
+	firstScanAddress = 0x03
+	lastScanAddress  = 0x77
+
+	pcf8563Control1Reg = 0x00
+	aht20StatusReg     = 0x71
+	mcp23017IOCONA     = 0x0A
+	mcp23017IOCONB     = 0x0B
+)
+
+// busTx reads readLen bytes from the device after writing to it, with a CRC if crc is set.
+type busTx func(address byte, write []byte, readLen int, crc bool) ([]byte, error)
+
+// deviceIdentity is the best guess at what a device is.
+type deviceIdentity struct {
+	Class    string
+	Part     string
+	Revision string // Empty when the part doesn't report one.
+}
+
+func (d deviceIdentity) String() string {
+	s := fmt.Sprintf("%s (%s)", d.Part, d.Class)
+	if d.Revision != "" {
+		s += ", revision " + d.Revision
+	}
+	return s
+}
+
+// deviceSignature is a class of device that can be identified by reading its registers.
+type deviceSignature struct {
+	class     string
+	addresses []byte
+	probe     func(tx busTx, address byte) (deviceIdentity, bool)
+}
+
+func (s deviceSignature) at(address byte) bool {
+	for _, a := range s.addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+func addressRange(first, last byte) []byte {
+	addresses := []byte{}
+	for a := first; a <= last; a++ {
+		addresses = append(addresses, a)
+	}
+	return addresses
+}
+
+// The signatures are tried in order, so the ones that are the most certain are first.
+var deviceSignatures = []deviceSignature{
+	{class: "power controller", addresses: []byte{attiny.Address}, probe: probeATtiny},
+	{class: "EEPROM", addresses: addressRange(eeprom.EEPROM_ADDRESS, eeprom.EXPANSION_EEPROM_LAST_ADDRESS), probe: probeEEPROM},
+	{class: "RTC", addresses: []byte{0x51}, probe: probePCF8563},
+	{class: "temperature and humidity sensor", addresses: []byte{0x38, 0x39}, probe: probeAHT20},
+	{class: "GPIO expander", addresses: addressRange(0x20, 0x27), probe: probeMCP23017},
+}
+
+// probeATtiny checks the type register, the revision is the firmware version.
+func probeATtiny(tx busTx, address byte) (deviceIdentity, bool) {
+	regs := []attiny.Register{attiny.TypeReg, attiny.MajorVersionReg, attiny.MinorVersionReg, attiny.PatchVersionReg}
+	values := make([]byte, len(regs))
+	for i, reg := range regs {
+		r, err := tx(address, []byte{byte(reg)}, 1, true)
+		if err != nil || len(r) != 1 {
+			return deviceIdentity{}, false
+		}
+		values[i] = r[0]
+	}
+	if values[0] != attiny.TypeVal {
+		return deviceIdentity{}, false
+	}
+	return deviceIdentity{Part: "ATtiny1616", Revision: fmt.Sprintf("v%d.%d.%d", values[1], values[2], values[3])}, true
+}
+
+// probeEEPROM checks the first byte of the hat data, the revision is the data version.
+func probeEEPROM(tx busTx, address byte) (deviceIdentity, bool) {
+	r, err := tx(address, []byte{0x00}, 2, false)
+	if err != nil || len(r) != 2 || r[0] != eeprom.EEPROM_FIRST_BYTE {
+		return deviceIdentity{}, false
+	}
+	part := "hat EEPROM"
+	if address != eeprom.EEPROM_ADDRESS {
+		part = eeprom.BoardName(address) + " EEPROM"
+	}
+	return deviceIdentity{Part: part, Revision: fmt.Sprintf("data v%d", r[1])}, true
+}
+
+// probePCF8563 checks the unused bits of the control registers, which always read as 0.
+func probePCF8563(tx busTx, address byte) (deviceIdentity, bool) {
+	r, err := tx(address, []byte{pcf8563Control1Reg}, 2, false)
+	if err != nil || len(r) != 2 || r[0]&0x57 != 0 || r[1]&0xE0 != 0 {
+		return deviceIdentity{}, false
+	}
+	return deviceIdentity{Part: "PCF8563"}, true
+}
+
+// probeAHT20 checks the status register has the calibrated bit set and the busy bit clear.
+func probeAHT20(tx busTx, address byte) (deviceIdentity, bool) {
+	r, err := tx(address, []byte{aht20StatusReg}, 1, false)
+	if err != nil || len(r) != 1 || r[0]&0x88 != 0x08 {
+		return deviceIdentity{}, false
+	}
+	return deviceIdentity{Part: "AHT20"}, true
+}
+
+// probeMCP23017 checks that IOCON reads the same from both its addresses, with the unused
+// bit 0 clear.
+func probeMCP23017(tx busTx, address byte) (deviceIdentity, bool) {
+	a, err := tx(address, []byte{mcp23017IOCONA}, 1, false)
+	if err != nil || len(a) != 1 {
+		return deviceIdentity{}, false
+	}
+	b, err := tx(address, []byte{mcp23017IOCONB}, 1, false)
+	if err != nil || len(b) != 1 || a[0] != b[0] || a[0]&0x01 != 0 {
+		return deviceIdentity{}, false
+	}
+	return deviceIdentity{Part: "MCP23017"}, true
+}
+
+// identifyDevice returns the first signature that matches the device, ok is false if none of
+// the known device classes match.
+func identifyDevice(tx busTx, address byte) (deviceIdentity, bool) {
+	for _, s := range deviceSignatures {
+		if !s.at(address) {
+			continue
+		}
+		if d, ok := s.probe(tx, address); ok {
+			d.Class = s.class
+			return d, true
+		}
+	}
+	return deviceIdentity{}, false
+}
+
+// describeDevice returns what the device at the address is for printing.
+func describeDevice(tx busTx, address byte) string {
+	if d, ok := identifyDevice(tx, address); ok {
+		return fmt.Sprintf("0x%02X: %s", address, d)
+	}
+	return fmt.Sprintf("0x%02X: unknown device", address)
+}
+
+func i2cTx(address byte, write []byte, readLen int, crc bool) ([]byte, error) {
+	if crc {
+		return i2crequest.TxWithCRC(address, write, readLen, identifyTimeout)
+	}
+	return i2crequest.Tx(address, write, readLen, identifyTimeout)
+}
+
+// findAll identifies every device that responds on the bus.
+func findAll(check func(address byte) error, tx busTx) ([]string, error) {
+	found := []string{}
+	for address := byte(firstScanAddress); address <= lastScanAddress; address++ {
+		if check(address) != nil {
+			continue
+		}
+		found = append(found, describeDevice(tx, address))
+	}
+	if len(found) == 0 {
+		return nil, exitcode.Wrap(exitcode.HardwareMissing, errors.New("no i2c devices found"))
+	}
+	return found, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindAll(t *testing.T) {
+	attinyRegs := [256]byte{}
+	attinyRegs[0x00] = 0xCA
+	attinyRegs[0x01] = 1
+	attinyRegs[0x08] = 2
+	attinyRegs[0x0B] = 3
+	eepromRegs := [256]byte{0xCA, 2}
+	rtcRegs := [256]byte{0x08, 0x02}
+	ahtRegs := [256]byte{}
+	ahtRegs[0x71] = 0x1C
+	expanderRegs := [256]byte{}
+	expanderRegs[0x0A] = 0x20
+	expanderRegs[0x0B] = 0x20
+	bus := &fakeBus{regs: map[byte][256]byte{
+		0x20: expanderRegs,
+		0x25: attinyRegs,
+		0x38: ahtRegs,
+		0x50: eepromRegs,
+		0x51: rtcRegs,
+		0x52: eepromRegs,
+		0x60: {},
+	}}
+	// The CRC is checked by i2crequest, so it is left out of the fake bus.
+	tx := func(address byte, write []byte, readLen int, crc bool) ([]byte, error) {
+		return bus.tx(address, write, readLen)
+	}
+	check := func(address byte) error {
+		_, err := bus.tx(address, []byte{0}, 1)
+		return err
+	}
+
+	found, err := findAll(check, tx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"0x20: MCP23017 (GPIO expander)",
+		"0x25: ATtiny1616 (power controller), revision v1.2.3",
+		"0x38: AHT20 (temperature and humidity sensor)",
+		"0x50: hat EEPROM (EEPROM), revision data v2",
+		"0x51: PCF8563 (RTC)",
+		"0x52: board2 EEPROM (EEPROM), revision data v2",
+		"0x60: unknown device",
+	}, found)
+
+	// A busy AHT20 or a reserved bit set doesn't match.
+	ahtRegs[0x71] = 0x98
+	bus.regs[0x38] = ahtRegs
+	rtcRegs[0x00] = 0x01
+	bus.regs[0x51] = rtcRegs
+	assert.Equal(t, "0x38: unknown device", describeDevice(tx, 0x38))
+	assert.Equal(t, "0x51: unknown device", describeDevice(tx, 0x51))
+
+	_, err = findAll(func(address byte) error { return errors.New("no device") }, tx)
+	assert.Error(t, err)
+}
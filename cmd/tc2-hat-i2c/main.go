@@ -3,16 +3,23 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/TheCacophonyProject/go-utils/logging"
 	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
 	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
-	"github.com/alexflint/go-arg"
+	"github.com/TheCacophonyProject/tc2-hat-controller/instancelock"
+	"github.com/TheCacophonyProject/tc2-hat-controller/readiness"
+	"github.com/TheCacophonyProject/tc2-hat-controller/safemode"
 )
 
+const safeModeService = "tc2-hat-i2c"
+
 var version = "<not set>"
 var log = logging.NewLogger("info")
 
@@ -21,15 +28,53 @@ type Args struct {
 	Read     *Read       `arg:"subcommand:read"    help:"Read from a register."`
 	Service  *subcommand `arg:"subcommand:service" help:"Start the dbus service."`
 	Find     *Find       `arg:"subcommand:find"    help:"Find i2c devices."`
-	EEPROM   *subcommand `arg:"subcommand:eeprom"  help:"Run EEPROM check."`
+	EEPROM   *EEPROMCmd  `arg:"subcommand:eeprom"  help:"Run EEPROM check."`
+	Repair   *Repair     `arg:"subcommand:repair"  help:"Repair the EEPROM data file or config so services can leave safe mode."`
+	Sim      *Sim        `arg:"subcommand:sim"     help:"Start the dbus service with simulated hat devices instead of the I2C bus."`
+	Run      *Run        `arg:"subcommand:run"     help:"Run a script of reads, writes, waits and checks."`
+	Trace    *Trace      `arg:"subcommand:trace"   help:"Print the raw frames to and from an address as the service sends them."`
 	LogLevel string      `arg:"-l, --log-level" default:"info" help:"Set the logging level (debug, info, warn, error)"`
 }
 
 type subcommand struct {
+	Replace bool `arg:"--replace" help:"Stop another running instance of the service and take over from it."`
+}
+
+type EEPROMCmd struct {
+	Provision *Provision `arg:"subcommand:provision" help:"Write the hardware versions to the EEPROM and verify them."`
+}
+
+type Provision struct {
+	HardwareVersion string `arg:"--hardware-version,required" help:"Hardware version (x.y.z) of the main PCB, also used for the other PCBs unless they are set."`
+	PowerPCB        string `arg:"--power-pcb" help:"Hardware version of the power PCB."`
+	TouchPCB        string `arg:"--touch-pcb" help:"Hardware version of the touch PCB."`
+	MicrophonePCB   string `arg:"--microphone-pcb" help:"Hardware version of the microphone PCB."`
+	AudioOnly       bool   `arg:"--audio-only" help:"Board is for an audio only device."`
+	WriteProtectPin string `arg:"--write-protect-pin" help:"GPIO connected to the EEPROM write protect pin, held low while writing and set high after."`
+	Force           bool   `arg:"--force" help:"Overwrite a board that has already been provisioned with different data."`
+}
+
+type Repair struct {
+	EEPROM    bool   `arg:"--eeprom" help:"Rewrite the EEPROM data file from the EEPROM chip."`
+	Config    bool   `arg:"--config" help:"Reset the config sections that can't be parsed so the defaults are used for them."`
+	ConfigDir string `arg:"-c,--config-dir" default:"/etc/cacophony" help:"Configuration folder."`
+}
+
+type Sim struct {
+	Speed               float64 `arg:"--speed" default:"1" help:"How many times faster than real time the simulated devices run."`
+	BatteryVoltage      float32 `arg:"--battery-voltage" default:"12.6" help:"Starting voltage of the simulated battery."`
+	BatteryEmptyVoltage float32 `arg:"--battery-empty-voltage" default:"9.6" help:"Voltage the simulated battery stops draining at."`
+	BatteryDrain        float32 `arg:"--battery-drain" default:"0.02" help:"Volts per (simulated) hour the battery drains."`
+	ATtinyVersion       string  `arg:"--attiny-version" default:"1.0.0" help:"Firmware version reported by the simulated ATtiny."`
+}
+
+type Run struct {
+	Script string `arg:"positional,required" help:"The YAML script file to run."`
 }
 
 type Find struct {
-	Address string `arg:"required" help:"The address of the device you want to find, in hex (0xnn)"`
+	Address string `arg:"positional" help:"The address of the device you want to find, in hex (0xnn)"`
+	All     bool   `arg:"--all" help:"Find and identify every device on the bus."`
 }
 
 type Write struct {
@@ -49,14 +94,15 @@ func (Args) Version() string {
 
 func procArgs() Args {
 	args := Args{}
-	arg.MustParse(&args)
+	exitcode.MustParse(&args)
 	return args
 }
 
 func main() {
 	err := runMain()
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(exitcode.Code(err))
 	}
 }
 
@@ -75,14 +121,38 @@ func runMain() error {
 	if args.Find != nil {
 		return find(args.Find)
 	}
+	if args.Repair != nil {
+		return repair(args.Repair)
+	}
+	if args.Sim != nil {
+		return runSim(args.Sim)
+	}
+	if args.Run != nil {
+		return runScript(args.Run)
+	}
+	if args.Trace != nil {
+		return runTrace(args.Trace)
+	}
 
 	if args.Service != nil {
+		if _, err := instancelock.Acquire(safeModeService, args.Service.Replace); err != nil {
+			return err
+		}
+		if err := readiness.Clear(readiness.I2C); err != nil {
+			log.Errorf("Failed to clear readiness: %v", err)
+		}
 		if err := startService(); err != nil {
 			return err
 		}
+		if err := readiness.Announce(readiness.I2C); err != nil {
+			log.Errorf("Failed to announce readiness: %v", err)
+		}
 
 		if err := eeprom.InitEEPROM(); err != nil {
 			log.Error(err)
+			eventhelper.ReportSafeMode(safeModeService, fmt.Errorf("eeprom: %v", err))
+		} else if err := safemode.Exit(safeModeService); err != nil {
+			log.Error(err)
 		}
 
 		for {
@@ -90,6 +160,9 @@ func runMain() error {
 		}
 	}
 	if args.EEPROM != nil {
+		if args.EEPROM.Provision != nil {
+			return provision(args.EEPROM.Provision)
+		}
 		if err := eeprom.InitEEPROM(); err != nil {
 			log.Error(err)
 		}
@@ -99,6 +172,20 @@ func runMain() error {
 }
 
 func find(find *Find) error {
+	if find.All {
+		log.Printf("Finding all devices")
+		found, err := findAll(func(address byte) error { return i2crequest.CheckAddress(address, 1000) }, i2cTx)
+		if err != nil {
+			return err
+		}
+		for _, device := range found {
+			log.Println(device)
+		}
+		return nil
+	}
+	if find.Address == "" {
+		return exitcode.Wrap(exitcode.Usage, errors.New("an address or --all is needed"))
+	}
 	address, err := hexStringToByte(find.Address)
 	if err != nil {
 		return err
@@ -107,8 +194,9 @@ func find(find *Find) error {
 	log.Printf("Finding address 0x%X", address)
 	err = i2crequest.CheckAddress(address, 1000)
 	if err != nil {
-		return errors.New("i2c device not found")
+		return exitcode.Wrap(exitcode.HardwareMissing, errors.New("i2c device not found"))
 	}
+	log.Println(describeDevice(i2cTx, address))
 	return nil
 }
 
@@ -131,7 +219,7 @@ func read(read *Read) error {
 		response, err = i2crequest.Tx(address, []byte{write}, 1, 1000)
 	}
 	if err != nil {
-		return err
+		return exitcode.Wrap(exitcode.BusError, err)
 	}
 	log.Println(response)
 	return nil
@@ -161,21 +249,21 @@ func write(args *Write) error {
 		_, err = i2crequest.Tx(address, write, 0, 1000)
 	}
 	if err != nil {
-		return err
+		return exitcode.Wrap(exitcode.BusError, err)
 	}
 	return nil
 }
 
 func hexStringToByte(hexStr string) (byte, error) {
 	if len(hexStr) != 4 {
-		return 0, fmt.Errorf("invalid hex string length: %d", len(hexStr))
+		return 0, exitcode.Wrap(exitcode.Usage, fmt.Errorf("invalid hex string length: %d", len(hexStr)))
 	}
 	if !strings.HasPrefix(hexStr, "0x") {
-		return 0, fmt.Errorf("invalid hex string prefix, should be '0x': %s", hexStr)
+		return 0, exitcode.Wrap(exitcode.Usage, fmt.Errorf("invalid hex string prefix, should be '0x': %s", hexStr))
 	}
 	val, err := strconv.ParseUint(hexStr[2:], 16, 8) // 16 for base, 8 for bit size
 	if err != nil {
-		return 0, err
+		return 0, exitcode.Wrap(exitcode.Usage, err)
 	}
 	return byte(val), nil
 }
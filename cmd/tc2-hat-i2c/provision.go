@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
+)
+
+func provision(args *Provision) error {
+	mainPCB, err := parseSemVer(args.HardwareVersion)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("invalid hardware version '%s': %v", args.HardwareVersion, err))
+	}
+	opts := eeprom.ProvisionOptions{
+		MainPCB:       *mainPCB,
+		PowerPCB:      *mainPCB,
+		TouchPCB:      *mainPCB,
+		MicrophonePCB: *mainPCB,
+		AudioOnly:     args.AudioOnly,
+		Force:         args.Force,
+	}
+	for _, v := range []struct {
+		arg    string
+		semVer *eeprom.SemVer
+	}{
+		{args.PowerPCB, &opts.PowerPCB},
+		{args.TouchPCB, &opts.TouchPCB},
+		{args.MicrophonePCB, &opts.MicrophonePCB},
+	} {
+		if v.arg == "" {
+			continue
+		}
+		semVer, err := parseSemVer(v.arg)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Usage, fmt.Errorf("invalid PCB version '%s': %v", v.arg, err))
+		}
+		*v.semVer = *semVer
+	}
+	if args.WriteProtectPin != "" {
+		if _, err := host.Init(); err != nil {
+			return err
+		}
+		pin := gpioreg.ByName(args.WriteProtectPin)
+		if pin == nil {
+			return exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("failed to find write protect pin '%s'", args.WriteProtectPin))
+		}
+		opts.SetWriteProtect = func(protect bool) error {
+			level := gpio.Low
+			if protect {
+				level = gpio.High
+			}
+			return pin.Out(level)
+		}
+	}
+
+	result, err := eeprom.Provision(opts)
+	if err != nil {
+		return err
+	}
+	if result.Written {
+		log.Printf("EEPROM provisioned and verified: %+v", *result.Data)
+	} else {
+		log.Printf("EEPROM already provisioned: %+v", *result.Data)
+	}
+	// Update the EEPROM data file to match the chip.
+	return eeprom.InitEEPROM()
+}
+
+// parseSemVer parses a version with or without the leading 'v'.
+func parseSemVer(version string) (*eeprom.SemVer, error) {
+	return eeprom.NewSemVer("v" + strings.TrimPrefix(version, "v"))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/safemode"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const configFileName = "config.toml"
+
+func repair(args *Repair) error {
+	if !args.EEPROM && !args.Config {
+		return fmt.Errorf("nothing to repair, use --eeprom and/or --config")
+	}
+	if args.EEPROM {
+		log.Info("Repairing EEPROM data file")
+		if err := eeprom.RepairEEPROMFile(); err != nil {
+			return fmt.Errorf("failed to repair EEPROM data file: %v", err)
+		}
+	}
+	if args.Config {
+		if err := repairConfig(args.ConfigDir); err != nil {
+			return fmt.Errorf("failed to repair config: %v", err)
+		}
+	}
+	if err := safemode.Clear(); err != nil {
+		return err
+	}
+	log.Info("Repair done, restart the tc2-hat services to leave safe mode")
+	return nil
+}
+
+// repairConfig resets the sections of the config file that can't be parsed, so the services
+// use the defaults for them and keep the rest of the config. The original file is kept as a
+// .corrupt backup. If the config still can't be loaded it is removed so the defaults are used.
+func repairConfig(configDir string) error {
+	configFile := filepath.Join(configDir, configFileName)
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		log.Info("No config file to repair")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = parseTOML(data)
+	if err == nil {
+		log.Info("Config is OK")
+		return nil
+	}
+	log.Errorf("Config can't be parsed: %v", err)
+
+	backup := fmt.Sprintf("%s.%s.corrupt", configFile, time.Now().Format("20060102-150405"))
+	log.Infof("Saving the original config to %s", backup)
+	if err := os.WriteFile(backup, data, 0644); err != nil {
+		return err
+	}
+	repaired, reset := repairTOML(data)
+	log.Infof("Reset config sections %v, keeping the rest", reset)
+	if err := writeConfig(configFile, repaired); err != nil {
+		return err
+	}
+	if _, err := goconfig.New(configDir); err != nil {
+		log.Errorf("Repaired config can't be loaded, removing it: %v", err)
+		if err := os.Remove(configFile); err != nil {
+			return err
+		}
+		_, err = goconfig.New(configDir)
+		return err
+	}
+	return nil
+}
+
+// configHeader matches a table header line, such as [battery] or [[gpio-inputs.door]].
+var configHeader = regexp.MustCompile(`^\s*\[\[?\s*[\w\-."' ]+\s*\]\]?\s*(#.*)?$`)
+
+// repairTOML returns the config without the sections that can't be parsed, or that conflict
+// with the sections before them, and the names of the sections left out. Settings before
+// the first table are the "top-level" section.
+func repairTOML(data []byte) ([]byte, []string) {
+	type section struct {
+		name  string
+		lines []string
+	}
+	sections := []section{{name: "top-level"}}
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if configHeader.MatchString(strings.TrimRight(line, "\r\n")) {
+			name := strings.Trim(strings.TrimSpace(strings.SplitN(line, "#", 2)[0]), "[] ")
+			sections = append(sections, section{name: name})
+		}
+		last := &sections[len(sections)-1]
+		last.lines = append(last.lines, line)
+	}
+
+	kept := ""
+	reset := []string{}
+	for _, s := range sections {
+		text := strings.Join(s.lines, "")
+		if text == "" {
+			continue
+		}
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		if err := parseTOML([]byte(kept + text)); err != nil {
+			log.Errorf("Resetting config section '%s': %v", s.name, err)
+			reset = append(reset, s.name)
+			continue
+		}
+		kept += text
+	}
+	return []byte(kept), reset
+}
+
+func parseTOML(data []byte) error {
+	return toml.Unmarshal(data, &map[string]interface{}{})
+}
+
+func writeConfig(file string, data []byte) error {
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
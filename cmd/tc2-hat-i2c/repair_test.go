@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairTOML(t *testing.T) {
+	config := `version = 1
+
+[battery]
+chemistry = "lifepo4"
+
+[comms]
+# A missing quote.
+type = "uart
+
+[temp]
+min-temp = 0 # Celsius
+
+[battery]
+chemistry = "li-ion"
+
+[[gpio-inputs.door]]
+pin = "GPIO16"
+`
+	repaired, reset := repairTOML([]byte(config))
+	assert.Equal(t, []string{"comms", "battery"}, reset)
+	assert.Equal(t, `version = 1
+
+[battery]
+chemistry = "lifepo4"
+
+[temp]
+min-temp = 0 # Celsius
+
+[[gpio-inputs.door]]
+pin = "GPIO16"
+`, string(repaired))
+	assert.NoError(t, parseTOML(repaired))
+
+	repaired, reset = repairTOML([]byte("version = \n[battery]\nchemistry = \"lifepo4\""))
+	assert.Equal(t, []string{"top-level"}, reset)
+	assert.Equal(t, "[battery]\nchemistry = \"lifepo4\"\n", string(repaired))
+}
+
+func TestRepairConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, configFileName)
+	assert.NoError(t, repairConfig(dir))
+
+	good := "[battery]\nchemistry = \"lifepo4\"\n"
+	assert.NoError(t, os.WriteFile(file, []byte(good), 0644))
+	assert.NoError(t, repairConfig(dir))
+	backups, _ := filepath.Glob(file + ".*.corrupt")
+	assert.Empty(t, backups)
+
+	corrupt := good + "[comms]\ntype = \"uart\n"
+	assert.NoError(t, os.WriteFile(file, []byte(corrupt), 0644))
+	assert.NoError(t, repairConfig(dir))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, good, string(data))
+	backups, _ = filepath.Glob(file + ".*.corrupt")
+	if assert.Len(t, backups, 1) {
+		data, err := os.ReadFile(backups[0])
+		assert.NoError(t, err)
+		assert.Equal(t, corrupt, string(data))
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"gopkg.in/yaml.v3"
+)
+
+// A script is a list of steps run in order against the I2C devices, for repeatable bring-up
+// and test scripts:
+//
+//	name: ATtiny bring-up
+//	steps:
+//	  - name: ATtiny is on the bus
+//	    find: 0x25
+//	  - name: Type register
+//	    read: {address: 0x25, reg: 0x00}
+//	    expect: 0xCA
+//	  - write: {address: 0x25, reg: 0x04, values: [0x01]}
+//	  - wait: 500ms
+//	  - name: Camera powered on
+//	    read: {address: 0x25, reg: 0x02}
+//	    expect: 0x01
+//	    mask: 0x0F
+//	    timeout: 10s
+//
+// A read with expect is a check, the read values are masked and compared with the expected
+// values, retrying until the timeout if there is one. The script stops at the first failed
+// step unless continue-on-failure is set. The ATtiny, at 0x25, is read and written with a CRC.
+const (
+	scriptTxTimeout     = 1000
+	scriptRetryInterval = 200 * time.Millisecond
+)
+
+type script struct {
+	Name              string       `yaml:"name"`
+	ContinueOnFailure bool         `yaml:"continue-on-failure"`
+	Steps             []scriptStep `yaml:"steps"`
+}
+
+type scriptStep struct {
+	Name    string        `yaml:"name"`
+	Find    *uint8        `yaml:"find"`
+	Read    *scriptRead   `yaml:"read"`
+	Write   *scriptWrite  `yaml:"write"`
+	Wait    time.Duration `yaml:"wait"`
+	Expect  byteList      `yaml:"expect"`
+	Mask    byteList      `yaml:"mask"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type scriptRead struct {
+	Address uint8 `yaml:"address"`
+	Reg     uint8 `yaml:"reg"`
+	Length  int   `yaml:"length"`
+}
+
+type scriptWrite struct {
+	Address uint8    `yaml:"address"`
+	Reg     uint8    `yaml:"reg"`
+	Values  byteList `yaml:"values"`
+}
+
+// byteList can be a single value or a list of values in the script.
+type byteList []byte
+
+func (b *byteList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var v uint8
+		if err := value.Decode(&v); err != nil {
+			return err
+		}
+		*b = byteList{v}
+		return nil
+	}
+	var values []uint8
+	if err := value.Decode(&values); err != nil {
+		return err
+	}
+	*b = values
+	return nil
+}
+
+func (b byteList) String() string {
+	s := make([]string, len(b))
+	for i, v := range b {
+		s[i] = fmt.Sprintf("0x%02X", v)
+	}
+	return strings.Join(s, " ")
+}
+
+func parseScript(data []byte) (*script, error) {
+	s := &script{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	for i := range s.Steps {
+		if err := s.Steps[i].validate(); err != nil {
+			return nil, fmt.Errorf("step %d (%s): %v", i+1, s.Steps[i].description(), err)
+		}
+	}
+	return s, nil
+}
+
+func (st *scriptStep) validate() error {
+	ops := 0
+	if st.Find != nil {
+		ops++
+	}
+	if st.Read != nil {
+		ops++
+		if st.Read.Length == 0 {
+			st.Read.Length = max(1, len(st.Expect))
+		}
+		if len(st.Expect) > 0 && len(st.Expect) != st.Read.Length {
+			return fmt.Errorf("expected %d values but reading %d", len(st.Expect), st.Read.Length)
+		}
+		if len(st.Mask) > 1 && len(st.Mask) != len(st.Expect) {
+			return fmt.Errorf("mask should be one value or one for each expected value")
+		}
+	}
+	if st.Write != nil {
+		ops++
+		if len(st.Write.Values) == 0 {
+			return fmt.Errorf("no values to write")
+		}
+	}
+	if st.Wait != 0 {
+		ops++
+	}
+	if ops != 1 {
+		return fmt.Errorf("step should have one of find, read, write or wait")
+	}
+	if (len(st.Expect) > 0 || len(st.Mask) > 0 || st.Timeout != 0) && st.Read == nil {
+		return fmt.Errorf("expect, mask and timeout can only be used with read")
+	}
+	return nil
+}
+
+func (st *scriptStep) description() string {
+	switch {
+	case st.Name != "":
+		return st.Name
+	case st.Find != nil:
+		return fmt.Sprintf("find 0x%02X", *st.Find)
+	case st.Read != nil:
+		return fmt.Sprintf("read 0x%02X register 0x%02X", st.Read.Address, st.Read.Reg)
+	case st.Write != nil:
+		return fmt.Sprintf("write %s to 0x%02X register 0x%02X", st.Write.Values, st.Write.Address, st.Write.Reg)
+	default:
+		return fmt.Sprintf("wait %s", st.Wait)
+	}
+}
+
+// scriptRunner runs the steps of a script.
+type scriptRunner struct {
+	tx    func(address byte, write []byte, readLen int) ([]byte, error)
+	find  func(address byte) error
+	sleep func(time.Duration)
+	now   func() time.Time
+}
+
+func newScriptRunner() *scriptRunner {
+	return &scriptRunner{
+		tx: func(address byte, write []byte, readLen int) ([]byte, error) {
+			if address == 0x25 { // Add CRC for attiny at address 0x25
+				return i2crequest.TxWithCRC(address, write, readLen, scriptTxTimeout)
+			}
+			return i2crequest.Tx(address, write, readLen, scriptTxTimeout)
+		},
+		find:  func(address byte) error { return i2crequest.CheckAddress(address, scriptTxTimeout) },
+		sleep: time.Sleep,
+		now:   time.Now,
+	}
+}
+
+type stepResult struct {
+	Step   string
+	Passed bool
+	Detail string
+}
+
+// run runs the steps, returning the result of each step that was run.
+func (r *scriptRunner) run(s *script) []stepResult {
+	results := []stepResult{}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		detail, err := r.runStep(step)
+		result := stepResult{Step: step.description(), Passed: err == nil, Detail: detail}
+		if err != nil {
+			result.Detail = err.Error()
+		}
+		results = append(results, result)
+		if err != nil && !s.ContinueOnFailure {
+			break
+		}
+	}
+	return results
+}
+
+func (r *scriptRunner) runStep(st *scriptStep) (string, error) {
+	switch {
+	case st.Find != nil:
+		if err := r.find(*st.Find); err != nil {
+			return "", fmt.Errorf("device not found: %v", err)
+		}
+		return "found", nil
+	case st.Write != nil:
+		write := append([]byte{st.Write.Reg}, st.Write.Values...)
+		_, err := r.tx(st.Write.Address, write, 0)
+		return "", err
+	case st.Read != nil:
+		deadline := r.now().Add(st.Timeout)
+		for {
+			values, err := r.tx(st.Read.Address, []byte{st.Read.Reg}, st.Read.Length)
+			if err == nil && len(st.Expect) == 0 {
+				return byteList(values).String(), nil
+			}
+			if err == nil {
+				masked := st.masked(values)
+				if string(masked) == string(st.Expect) {
+					return masked.String(), nil
+				}
+				err = fmt.Errorf("read %s, expected %s", masked, st.Expect)
+			}
+			if !r.now().Before(deadline) {
+				return "", err
+			}
+			r.sleep(scriptRetryInterval)
+		}
+	default:
+		r.sleep(st.Wait)
+		return "", nil
+	}
+}
+
+func (st *scriptStep) masked(values []byte) byteList {
+	masked := make(byteList, len(values))
+	for i, v := range values {
+		switch len(st.Mask) {
+		case 0:
+			masked[i] = v
+		case 1:
+			masked[i] = v & st.Mask[0]
+		default:
+			masked[i] = v & st.Mask[i]
+		}
+	}
+	return masked
+}
+
+// runScript runs the script file and prints the result of each step and a summary.
+func runScript(args *Run) error {
+	data, err := os.ReadFile(args.Script)
+	if err != nil {
+		return err
+	}
+	s, err := parseScript(data)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, err)
+	}
+	if s.Name != "" {
+		log.Printf("Running '%s'", s.Name)
+	}
+	results := newScriptRunner().run(s)
+	failed := 0
+	for i, result := range results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+			failed++
+		}
+		if result.Detail != "" {
+			log.Printf("%d. %s %s: %s", i+1, status, result.Step, result.Detail)
+		} else {
+			log.Printf("%d. %s %s", i+1, status, result.Step)
+		}
+	}
+	skipped := len(s.Steps) - len(results)
+	log.Printf("%d steps, %d passed, %d failed, %d skipped", len(s.Steps), len(results)-failed, failed, skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d steps failed", failed)
+	}
+	return nil
+}
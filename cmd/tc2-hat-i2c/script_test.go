@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testScript = `
+name: ATtiny bring-up
+steps:
+  - name: ATtiny is on the bus
+    find: 0x25
+  - name: Type register
+    read: {address: 0x25, reg: 0x00}
+    expect: 0xCA
+  - write: {address: 0x25, reg: 0x04, values: [0x01]}
+  - wait: 500ms
+  - name: Camera powered on
+    read: {address: 0x25, reg: 0x02}
+    expect: 0x01
+    mask: 0x0F
+    timeout: 2s
+`
+
+// fakeBus has the registers of one device.
+type fakeBus struct {
+	regs   map[byte][256]byte
+	writes int
+}
+
+func (b *fakeBus) tx(address byte, write []byte, readLen int) ([]byte, error) {
+	regs, ok := b.regs[address]
+	if !ok {
+		return nil, errors.New("no device")
+	}
+	if len(write) > 1 {
+		b.writes++
+		copy(regs[write[0]:], write[1:])
+		b.regs[address] = regs
+	}
+	return append([]byte{}, regs[write[0]:int(write[0])+readLen]...), nil
+}
+
+func newTestRunner(bus *fakeBus) (*scriptRunner, *time.Time) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	return &scriptRunner{
+		tx: bus.tx,
+		find: func(address byte) error {
+			_, err := bus.tx(address, []byte{0}, 0)
+			return err
+		},
+		sleep: func(d time.Duration) { now = now.Add(d) },
+		now:   func() time.Time { return now },
+	}, &now
+}
+
+func TestParseScript(t *testing.T) {
+	s, err := parseScript([]byte(testScript))
+	assert.NoError(t, err)
+	assert.Equal(t, "ATtiny bring-up", s.Name)
+	assert.Len(t, s.Steps, 5)
+	assert.Equal(t, byteList{0xCA}, s.Steps[1].Expect)
+	assert.Equal(t, 1, s.Steps[1].Read.Length)
+	assert.Equal(t, 500*time.Millisecond, s.Steps[3].Wait)
+	assert.Equal(t, "write 0x01 to 0x25 register 0x04", s.Steps[2].description())
+
+	_, err = parseScript([]byte("steps:\n  - find: 0x25\n    wait: 1s\n"))
+	assert.Error(t, err)
+	_, err = parseScript([]byte("steps:\n  - wait: 1s\n    expect: 0x01\n"))
+	assert.Error(t, err)
+	_, err = parseScript([]byte("steps:\n  - read: {address: 0x25, reg: 0, length: 2}\n    expect: 0x01\n"))
+	assert.Error(t, err)
+}
+
+func TestRunScript(t *testing.T) {
+	regs := [256]byte{}
+	regs[0x00] = 0xCA
+	regs[0x02] = 0xF1
+	bus := &fakeBus{regs: map[byte][256]byte{0x25: regs}}
+	r, _ := newTestRunner(bus)
+	s, err := parseScript([]byte(testScript))
+	assert.NoError(t, err)
+
+	results := r.run(s)
+	assert.Len(t, results, 5)
+	for _, result := range results {
+		assert.True(t, result.Passed, result.Step)
+	}
+	assert.Equal(t, 1, bus.writes)
+	assert.Equal(t, byte(0x01), bus.regs[0x25][0x04])
+}
+
+func TestRunScriptStopsOnFailure(t *testing.T) {
+	bus := &fakeBus{regs: map[byte][256]byte{0x25: {}}}
+	r, now := newTestRunner(bus)
+	s, err := parseScript([]byte(testScript))
+	assert.NoError(t, err)
+
+	start := *now
+	results := r.run(s)
+	assert.Len(t, results, 2)
+	assert.False(t, results[1].Passed)
+	assert.Equal(t, "read 0x00, expected 0xCA", results[1].Detail)
+	assert.Equal(t, start, *now)
+
+	s.ContinueOnFailure = true
+	results = r.run(s)
+	assert.Len(t, results, 5)
+	assert.False(t, results[4].Passed)
+	// The last check was retried until the timeout.
+	assert.True(t, now.Sub(start) >= 2*time.Second)
+}
@@ -6,8 +6,11 @@ import (
 	"sync"
 	"time"
 
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusapi"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusauth"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
 	"github.com/godbus/dbus"
-	"github.com/godbus/dbus/introspect"
 	"periph.io/x/conn/v3/gpio"
 	"periph.io/x/conn/v3/gpio/gpioreg"
 	"periph.io/x/conn/v3/i2c"
@@ -20,52 +23,67 @@ const (
 	dbusPath = "/org/cacophony/i2c"
 )
 
+// api is the version and capabilities of the D-Bus API, see the dbusapi package.
+var api = dbusapi.API{
+	Version:      1,
+	Capabilities: []string{"tx", "tx-context", "trace"},
+}
+
 type service struct {
 	requests     chan Request // Channel to queue requests
 	busyPin      gpio.PinIO
 	bus          i2c.Bus
 	mutex        sync.Mutex
 	requestCount int
+	auth         *dbusauth.Authorizer // Checks callers can write to the I2C devices.
+	trace        *tracer
 }
 
 func startService() error {
-	log.Info("Starting I2C service")
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		return err
-	}
-	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
-	if err != nil {
-		return err
-	}
-	if reply != dbus.RequestNameReplyPrimaryOwner {
-		return errors.New("name already taken")
-	}
-
 	log.Debug("Initializing host")
 	if _, err := host.Init(); err != nil {
 		return err
 	}
 	bus, err := i2creg.Open("")
 	if err != nil {
-		return err
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
 	}
 
 	pinName := "GPIO13"
 	log.Debugf("Initializing pin '%s'", pinName)
 	pin := gpioreg.ByName(pinName)
 	if pin == nil {
-		return fmt.Errorf("GPIO pin %s not found", pinName)
+		return exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("GPIO pin %s not found", pinName))
 	}
 	if err := pin.In(gpio.Float, gpio.NoEdge); err != nil {
 		return err
 	}
+	return startServiceWithBus(bus, pin)
+}
+
+// startServiceWithBus starts the dbus service using the given bus. The busy pin is used
+// to share the bus with the RP2040, it can be nil if the bus isn't shared, as when simulating.
+func startServiceWithBus(bus i2c.Bus, pin gpio.PinIO) error {
+	log.Info("Starting I2C service")
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return errors.New("name already taken")
+	}
 
 	s := &service{
 		busyPin:  pin,
 		bus:      bus,
 		mutex:    sync.Mutex{},
 		requests: make(chan Request, 20),
+		auth:     dbusauth.Load(conn, dbusName, goconfig.DefaultConfigDir),
+		trace:    newTracer(conn),
 	}
 
 	// Start a goroutine to process requests sequentially
@@ -76,19 +94,8 @@ func startService() error {
 		}
 	}()
 
-	conn.Export(s, dbusPath, dbusName)
-	conn.Export(genIntrospectable(s), dbusPath, "org.freedesktop.DBus.Introspectable")
-	return nil
-}
-
-func genIntrospectable(v interface{}) introspect.Introspectable {
-	node := &introspect.Node{
-		Interfaces: []introspect.Interface{{
-			Name:    dbusName,
-			Methods: introspect.Methods(v),
-		}},
-	}
-	return introspect.NewIntrospectable(node)
+	_, err = dbusapi.Export(conn, s, dbusPath, dbusName, api, nil)
+	return err
 }
 
 /*
@@ -106,8 +113,27 @@ int32:100
 */
 
 // Tx sends a transaction to the I2C device, used for reading and writing to registers.
-// If reading/writing to the ATtiny remember the CRC bytes.
-func (s *service) Tx(address byte, write []byte, readLen int, timeout int) ([]byte, *dbus.Error) {
+// If reading/writing to the ATtiny remember the CRC bytes. The timeout is for waiting for the
+// bus once the request is taken from the queue.
+func (s *service) Tx(sender dbus.Sender, address byte, write []byte, readLen int, timeout int) ([]byte, *dbus.Error) {
+	if err := s.auth.Check(sender, "Tx"); err != nil {
+		return nil, err
+	}
+	return s.queue(address, write, readLen, timeout, false)
+}
+
+// TxContext is Tx for clients that give up after the timeout, as i2crequest.TxContext does.
+// The timeout covers the time the request is queued as well, and the request isn't started or
+// retried once it has passed.
+func (s *service) TxContext(sender dbus.Sender, address byte, write []byte, readLen int, timeout int) ([]byte, *dbus.Error) {
+	if err := s.auth.Check(sender, "Tx"); err != nil {
+		return nil, err
+	}
+	return s.queue(address, write, readLen, timeout, true)
+}
+
+// queue adds the request to the queue and waits for the response.
+func (s *service) queue(address byte, write []byte, readLen int, timeout int, expires bool) ([]byte, *dbus.Error) {
 	s.mutex.Lock()
 	requestID := s.requestCount
 	s.requestCount++
@@ -121,6 +147,7 @@ func (s *service) Tx(address byte, write []byte, readLen int, timeout int) ([]by
 		Write:       write,
 		ReadLen:     readLen,
 		Timeout:     timeout,
+		Expires:     expires,
 		Response:    responseChan,
 	}
 	log.Debugf("Adding request '%d' to the queue", requestID)
@@ -138,9 +165,19 @@ type Request struct {
 	Write       []byte
 	ReadLen     int
 	Timeout     int
+	Expires     bool          // The timeout started when the request was queued, from TxContext.
 	Response    chan Response // Channel for sending back the response
 }
 
+// deadline is when the request times out. From TxContext the client stops waiting then, so
+// the timeout covers the time queued, otherwise it starts when the request is processed.
+func (req Request) deadline(startTime time.Time) time.Time {
+	if req.Expires {
+		startTime = req.RequestTime
+	}
+	return startTime.Add(time.Duration(req.Timeout) * time.Millisecond)
+}
+
 type Response struct {
 	Data []byte
 	Err  *dbus.Error
@@ -150,30 +187,21 @@ func (s *service) processTransaction(req Request) Response {
 	startTime := time.Now()
 	log.Debugf("Waited %s for request to be processed.", startTime.Sub(req.RequestTime))
 	log.Debugf("Processing request '%d'", req.RequestID)
-	log.Debug("Waiting for I2C busy pin to go low.")
-	for {
-		if s.busyPin.Read() == gpio.Low {
-			log.Debugf("Waited %s for I2C busy pin to go low.", time.Since(startTime))
-			log.Debug("I2C busy pin went low.")
-			if err := s.busyPin.Out(gpio.High); err != nil {
-				return Response{
-					Err: dbus.NewError("org.cacophony.i2c.ErrorUsingBusyBusPin ", nil),
-				}
-			}
-			break
+	if req.Expires && startTime.After(req.deadline(startTime)) {
+		// Don't use the bus for a request the client has given up on.
+		log.Debugf("Request '%d' timed out in the queue", req.RequestID)
+		return Response{
+			Err: dbus.NewError("org.cacophony.i2c.Timeout", nil),
 		}
-		if time.Since(startTime) > time.Duration(req.Timeout)*time.Millisecond {
-			log.Debugf("Request '%d' timed out waiting for bus pin", req.RequestID)
-			return Response{
-				Err: dbus.NewError("org.cacophony.i2c.BusyTimeout", nil),
-			}
+	}
+	if s.busyPin != nil {
+		if res, ok := s.lockBusyPin(req, startTime); !ok {
+			return res
 		}
-		time.Sleep(10 * time.Millisecond)
+		defer s.busyPin.In(gpio.Float, gpio.NoEdge)
+		log.Debug("Driving pin high and locked the transaction.")
 	}
 
-	defer s.busyPin.In(gpio.Float, gpio.NoEdge)
-	log.Debug("Driving pin high and locked the transaction.")
-
 	read := make([]byte, req.ReadLen)
 	retries := 2
 	log.Debugf("Writing %v", req.Write)
@@ -181,6 +209,16 @@ func (s *service) processTransaction(req Request) Response {
 	for i := 0; i <= retries; i++ {
 		txStartTime := time.Now()
 		err := s.bus.Tx(uint16(req.Address), req.Write, read)
+		s.trace.frame(traceFrame{
+			Time:      txStartTime,
+			RequestID: req.RequestID,
+			Attempt:   i + 1,
+			Address:   req.Address,
+			Write:     req.Write,
+			Read:      read,
+			Took:      time.Since(txStartTime),
+			Err:       err,
+		})
 		if err == nil {
 			endTime := time.Now()
 			log.Debugf("I2C Tx succeeded after %d retries", i)
@@ -192,7 +230,10 @@ func (s *service) processTransaction(req Request) Response {
 			}
 		}
 
-		if i < retries {
+		if i < retries && req.Expires && time.Now().After(req.deadline(startTime)) {
+			log.Debugf("Request '%d' timed out, not retrying: %s", req.RequestID, err)
+			break
+		} else if i < retries {
 			log.Debugf("I2C Tx failed, retrying %d more times: %s", retries-i, err)
 			time.Sleep(20 * time.Millisecond)
 		}
@@ -202,3 +243,28 @@ func (s *service) processTransaction(req Request) Response {
 		Err: dbus.NewError("org.cacophony.i2c.ErrorUsingI2CBus", nil),
 	}
 }
+
+// lockBusyPin waits for the I2C busy pin to go low then drives it high so the RP2040
+// doesn't use the bus during the transaction.
+func (s *service) lockBusyPin(req Request, startTime time.Time) (Response, bool) {
+	log.Debug("Waiting for I2C busy pin to go low.")
+	for {
+		if s.busyPin.Read() == gpio.Low {
+			log.Debugf("Waited %s for I2C busy pin to go low.", time.Since(startTime))
+			log.Debug("I2C busy pin went low.")
+			if err := s.busyPin.Out(gpio.High); err != nil {
+				return Response{
+					Err: dbus.NewError("org.cacophony.i2c.ErrorUsingBusyBusPin ", nil),
+				}, false
+			}
+			return Response{}, true
+		}
+		if time.Now().After(req.deadline(startTime)) {
+			log.Debugf("Request '%d' timed out waiting for bus pin", req.RequestID)
+			return Response{
+				Err: dbus.NewError("org.cacophony.i2c.BusyTimeout", nil),
+			}, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
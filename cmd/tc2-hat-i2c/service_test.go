@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/physic"
+)
+
+// countingBus answers every transaction with zeros, counting them.
+type countingBus struct {
+	txs int
+}
+
+func (b *countingBus) String() string                    { return "counting" }
+func (b *countingBus) SetSpeed(f physic.Frequency) error { return nil }
+
+func (b *countingBus) Tx(addr uint16, w, r []byte) error {
+	b.txs++
+	return nil
+}
+
+func TestQueueTimeout(t *testing.T) {
+	bus := &countingBus{}
+	s := &service{bus: bus}
+	// Queued for longer than the timeout.
+	req := Request{RequestTime: time.Now().Add(-time.Second), Address: 0x25, Write: []byte{0}, ReadLen: 1, Timeout: 100}
+
+	// Tx times out from when the request is processed, so it still uses the bus.
+	res := s.processTransaction(req)
+	assert.Nil(t, res.Err)
+	assert.Equal(t, []byte{0}, res.Data)
+	assert.Equal(t, 1, bus.txs)
+
+	// TxContext clients have given up on it, so the bus isn't used.
+	req.Expires = true
+	res = s.processTransaction(req)
+	if assert.NotNil(t, res.Err) {
+		assert.Equal(t, "org.cacophony.i2c.Timeout", res.Err.Name)
+	}
+	assert.Equal(t, 1, bus.txs)
+
+	req.RequestTime = time.Now()
+	assert.Nil(t, s.processTransaction(req).Err)
+	assert.Equal(t, 2, bus.txs)
+}
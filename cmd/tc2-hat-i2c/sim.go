@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/simulator"
+)
+
+// runSim runs the dbus service against simulated hat devices so the other hat services
+// can be run without the hardware, see _sim/ for running it all in Docker.
+func runSim(args *Sim) error {
+	config := simulator.DefaultConfig()
+	config.Speed = args.Speed
+	config.BatteryVoltage = args.BatteryVoltage
+	config.BatteryEmptyVoltage = args.BatteryEmptyVoltage
+	config.BatteryDrainPerHour = args.BatteryDrain
+	version, err := eeprom.NewSemVer("v" + strings.TrimPrefix(args.ATtinyVersion, "v"))
+	if err != nil {
+		return fmt.Errorf("invalid ATtiny version: %v", err)
+	}
+	config.ATtinyMajor = version.Major
+	config.ATtinyMinor = version.Minor
+	config.ATtinyPatch = version.Patch
+
+	log.Printf("Simulating hat devices at %.1fx speed", config.Speed)
+	if err := startServiceWithBus(simulator.NewBus(config), nil); err != nil {
+		return err
+	}
+	if err := eeprom.InitEEPROM(); err != nil {
+		log.Error(err)
+	}
+	for {
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/godbus/dbus"
+)
+
+// The raw frames to and from an address can be logged while the service is running, to debug
+// the protocol with a device such as the ATtiny without a bus analyser:
+//
+//	tc2-hat-i2c trace --address 0x25 --duration 60s
+//
+// Tracing is started over D-Bus with StartTrace so the service doesn't need restarting, and
+// stops by itself after the duration. Each attempt at a transaction is logged by the service
+// and sent as a Frame signal with the address and the formatted frame, which the trace
+// command prints. Frames to the ATtiny are decoded with the register names and the CRCs checked.
+const (
+	maxTraceDuration = time.Hour
+	traceSignal      = dbusName + ".Frame"
+)
+
+type Trace struct {
+	Address  string        `arg:"required" help:"The address to trace, in hex (0xnn)"`
+	Duration time.Duration `arg:"--duration" default:"60s" help:"How long to trace for."`
+}
+
+// traceFrame is one attempt at a transaction on the bus.
+type traceFrame struct {
+	Time      time.Time
+	RequestID int
+	Attempt   int
+	Address   byte
+	Write     []byte
+	Read      []byte
+	Took      time.Duration
+	Err       error
+}
+
+func (f traceFrame) String() string {
+	s := fmt.Sprintf("%s 0x%02x request %d attempt %d write [% x]", f.Time.Format(time.RFC3339Nano), f.Address, f.RequestID, f.Attempt, f.Write)
+	if f.Err != nil {
+		s += fmt.Sprintf(" failed after %s: %v", f.Took, f.Err)
+	} else {
+		s += fmt.Sprintf(" read [% x] %s", f.Read, f.Took)
+	}
+	if decoded := decodeFrame(f.Address, f.Write, f.Read, f.Err == nil); decoded != "" {
+		s += ", " + decoded
+	}
+	return s
+}
+
+// decodeFrame decodes a frame to the ATtiny, returning "" for other addresses.
+func decodeFrame(address byte, write, read []byte, ok bool) string {
+	if address != attiny.Address || len(write) < 3 {
+		return ""
+	}
+	data := write[:len(write)-2]
+	name, known := attiny.RegisterName(attiny.Register(data[0]))
+	if !known {
+		name = fmt.Sprintf("register 0x%02x", data[0])
+	}
+	parts := []string{}
+	if len(data) == 1 {
+		s := "read " + name
+		if ok && len(read) > 2 {
+			s += fmt.Sprintf(" = [% x]", read[:len(read)-2])
+		}
+		parts = append(parts, s)
+	} else {
+		parts = append(parts, fmt.Sprintf("write %s = [% x]", name, data[1:]))
+	}
+	if !crcMatches(write) {
+		parts = append(parts, "bad write CRC")
+	}
+	if ok && len(read) > 2 && !crcMatches(read) {
+		parts = append(parts, "bad read CRC")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// crcMatches checks the CRC at the end of the data.
+func crcMatches(data []byte) bool {
+	n := len(data) - 2
+	return i2crequest.CalculateCRC(data[:n]) == uint16(data[n])<<8|uint16(data[n+1])
+}
+
+// tracer logs the frames to and from the addresses being traced.
+type tracer struct {
+	mu    sync.Mutex
+	until map[byte]time.Time
+	now   func() time.Time
+	emit  func(address byte, frame string) error
+}
+
+func newTracer(conn *dbus.Conn) *tracer {
+	return &tracer{
+		until: map[byte]time.Time{},
+		now:   time.Now,
+		emit: func(address byte, frame string) error {
+			return conn.Emit(dbusPath, traceSignal, address, frame)
+		},
+	}
+}
+
+func (t *tracer) start(address byte, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.until[address] = t.now().Add(d)
+	log.Infof("Tracing I2C frames for 0x%02x for %s", address, d)
+}
+
+func (t *tracer) stop(address byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.until[address]; ok {
+		delete(t.until, address)
+		log.Infof("Stopped tracing I2C frames for 0x%02x", address)
+	}
+}
+
+func (t *tracer) tracing(address byte) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.until[address]
+	if ok && t.now().After(until) {
+		delete(t.until, address)
+		log.Infof("Finished tracing I2C frames for 0x%02x", address)
+		return false
+	}
+	return ok
+}
+
+// frame logs the frame if its address is being traced.
+func (t *tracer) frame(f traceFrame) {
+	if !t.tracing(f.Address) {
+		return
+	}
+	s := f.String()
+	log.Info("I2C trace: ", s)
+	if err := t.emit(f.Address, s); err != nil {
+		log.Errorf("Failed to send I2C trace frame: %v", err)
+	}
+}
+
+// StartTrace logs the frames to and from the address for the number of seconds.
+func (s *service) StartTrace(sender dbus.Sender, address byte, seconds int32) *dbus.Error {
+	if err := s.auth.Check(sender, "StartTrace"); err != nil {
+		return err
+	}
+	d := time.Duration(seconds) * time.Second
+	if d <= 0 || d > maxTraceDuration {
+		return dbus.MakeFailedError(fmt.Errorf("duration must be from 1s to %s", maxTraceDuration))
+	}
+	s.trace.start(address, d)
+	return nil
+}
+
+// StopTrace stops logging the frames to and from the address.
+func (s *service) StopTrace(sender dbus.Sender, address byte) *dbus.Error {
+	if err := s.auth.Check(sender, "StopTrace"); err != nil {
+		return err
+	}
+	s.trace.stop(address)
+	return nil
+}
+
+// runTrace starts tracing the address in the service and prints the frames until the
+// duration is up.
+func runTrace(args *Trace) error {
+	address, err := hexStringToByte(args.Address)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, err)
+	}
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	rule := fmt.Sprintf("type='signal',interface='%s',member='Frame'", dbusName)
+	if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule); call.Err != nil {
+		return call.Err
+	}
+	signals := make(chan *dbus.Signal, 100)
+	conn.Signal(signals)
+
+	obj := conn.Object(dbusName, dbusPath)
+	seconds := int32((args.Duration + time.Second - 1) / time.Second)
+	if err := obj.Call(dbusName+".StartTrace", 0, address, seconds).Err; err != nil {
+		return err
+	}
+	defer func() {
+		if err := obj.Call(dbusName+".StopTrace", 0, address).Err; err != nil {
+			log.Errorf("Failed to stop tracing: %v", err)
+		}
+	}()
+	timeout := time.After(args.Duration)
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Name != traceSignal || len(signal.Body) != 2 {
+				continue
+			}
+			if a, ok := signal.Body[0].(byte); !ok || a != address {
+				continue
+			}
+			if frame, ok := signal.Body[1].(string); ok {
+				fmt.Println(frame)
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/stretchr/testify/assert"
+)
+
+func withCRC(data ...byte) []byte {
+	crc := i2crequest.CalculateCRC(data)
+	return append(data, byte(crc>>8), byte(crc&0xFF))
+}
+
+func TestDecodeFrame(t *testing.T) {
+	read := withCRC(byte(attiny.MajorVersionReg))
+	assert.Equal(t, "read MajorVersion = [04]", decodeFrame(attiny.Address, read, withCRC(0x04), true))
+	assert.Equal(t, "read MajorVersion", decodeFrame(attiny.Address, read, nil, false))
+
+	write := withCRC(byte(attiny.CameraStateReg), 0x02)
+	assert.Equal(t, "write CameraState = [02]", decodeFrame(attiny.Address, write, nil, true))
+
+	bad := withCRC(0xF0)
+	bad[1]++
+	assert.Equal(t, "read register 0xf0 = [01], bad write CRC, bad read CRC", decodeFrame(attiny.Address, bad, []byte{0x01, 0x00, 0x00}, true))
+
+	assert.Equal(t, "", decodeFrame(0x51, []byte{0x00, 0x01, 0x02}, nil, true))
+}
+
+func TestTracer(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	frames := []string{}
+	tr := &tracer{
+		until: map[byte]time.Time{},
+		now:   func() time.Time { return now },
+		emit: func(address byte, frame string) error {
+			frames = append(frames, frame)
+			return nil
+		},
+	}
+	f := traceFrame{Time: now, RequestID: 3, Attempt: 1, Address: 0x51, Write: []byte{0x00}, Read: []byte{0x12}, Took: time.Millisecond}
+	tr.frame(f)
+	assert.Empty(t, frames)
+
+	tr.start(0x51, time.Minute)
+	tr.frame(f)
+	f.Err = errors.New("nack")
+	tr.frame(f)
+	tr.frame(traceFrame{Address: 0x25})
+	assert.Equal(t, []string{
+		"2024-06-01T12:00:00Z 0x51 request 3 attempt 1 write [00] read [12] 1ms",
+		"2024-06-01T12:00:00Z 0x51 request 3 attempt 1 write [00] failed after 1ms: nack",
+	}, frames)
+
+	now = now.Add(2 * time.Minute)
+	tr.frame(f)
+	assert.Len(t, frames, 2)
+	assert.False(t, tr.tracing(0x51))
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"time"
 
-	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
 	"github.com/TheCacophonyProject/go-utils/logging"
-	"github.com/alexflint/go-arg"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/firmware"
 	"periph.io/x/conn/v3/gpio"
 	"periph.io/x/conn/v3/gpio/gpioreg"
 	"periph.io/x/host/v3"
@@ -25,6 +30,13 @@ type Args struct {
 	ELF         string `arg:"--elf" help:".elf file to program the RP2040 with."`
 	RunPin      string `arg:"--run-pin" help:"Run GPIO pin for the RP2040."`
 	BootModePin string `arg:"--boot-mode-pin" help:"Boot mode GPIO pin for the RP2040."`
+	Monitor     bool   `arg:"--monitor" help:"Monitor the RP2040 heartbeat and reset it if it stops responding."`
+	// For automated provisioning.
+	NonInteractive bool          `arg:"--non-interactive" help:"Don't wait for enter to be pressed. Requires --elf or --manual-wait."`
+	ManualWait     time.Duration `arg:"--manual-wait" help:"Without --elf, how long to hold the RP2040 in boot mode for it to be programmed by another tool when non-interactive."`
+	Timeout        time.Duration `arg:"--timeout" help:"Timeout for programming with openocd."`
+	JSON           bool          `arg:"--json" help:"Write progress to stdout as JSON lines."`
+	AllowUnsigned  bool          `arg:"--allow-unsigned" help:"Program the elf file even if it has no signature or pinned SHA-256 in the config."`
 	logging.LogArgs
 }
 
@@ -36,15 +48,17 @@ func procArgs() Args {
 	args := Args{
 		RunPin:      "GPIO23",
 		BootModePin: "GPIO5",
+		Timeout:     2 * time.Minute,
 	}
-	arg.MustParse(&args)
+	exitcode.MustParse(&args)
 	return args
 }
 
 func main() {
 	err := runMain()
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(exitcode.Code(err))
 	}
 }
 
@@ -60,82 +74,180 @@ func runMain() error {
 
 	log.Printf("Running version: %s", version)
 
+	if args.Monitor {
+		if _, err := host.Init(); err != nil {
+			return err
+		}
+		runPin := gpioreg.ByName(args.RunPin)
+		if runPin == nil {
+			return fmt.Errorf("failed to find GPIO pin '%s'", args.RunPin)
+		}
+		return runMonitor(runPin)
+	}
+
+	p := &progress{json: args.JSON, out: os.Stdout, now: time.Now}
+	err := program(args, p)
+	p.done(err)
+	return err
+}
+
+// program puts the RP2040 into boot mode and programs it, either with openocd or by
+// waiting for it to be programmed manually.
+func program(args Args, p *progress) error {
+	if args.NonInteractive && args.ELF == "" && args.ManualWait <= 0 {
+		return exitcode.Wrap(exitcode.Usage, errors.New("--elf or --manual-wait is required with --non-interactive"))
+	}
+
 	// Check if openocd is installed
 	if args.ELF != "" {
 		cmd := exec.Command("openocd", "--version")
 		if err := cmd.Run(); err != nil {
 			log.Println(openOCDNotFoundMessage)
-			return errors.New("openocd not found")
+			return exitcode.Wrap(exitcode.Usage, errors.New("openocd not found"))
 		}
 	}
+	p.stage(stageStart, "Starting RP2040 programming.")
 
-	if _, err := host.Init(); err != nil {
-		return err
+	// Verify the image before touching the RP2040 so a bad image leaves it running.
+	var verification *firmware.Result
+	if args.ELF != "" {
+		result, err := verifyELF(args.ELF, args.AllowUnsigned)
+		verification = &result
+		if err != nil {
+			addProgrammingEvent(err, verification)
+			return err
+		}
+		if result.Verified {
+			p.stage(stageVerified, fmt.Sprintf("Firmware verified by %s, SHA-256 %s.", result.Method, result.SHA256))
+		} else {
+			p.stage(stageVerified, fmt.Sprintf("Firmware not verified, programming it anyway as unsigned images are allowed, SHA-256 %s.", result.SHA256))
+		}
 	}
 
-	runPin := gpioreg.ByName(args.RunPin) // replace with your pin number
+	if _, err := host.Init(); err != nil {
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
+	}
+	runPin := gpioreg.ByName(args.RunPin)
 	if runPin == nil {
-		return fmt.Errorf("failed to find GPIO pin '%s'", args.RunPin)
+		return exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("failed to find GPIO pin '%s'", args.RunPin))
 	}
-
-	bootModePin := gpioreg.ByName(args.BootModePin) // replace with your pin number
+	bootModePin := gpioreg.ByName(args.BootModePin)
 	if bootModePin == nil {
-		return fmt.Errorf("failed to find GPIO pin '%s'", args.BootModePin)
+		return exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("failed to find GPIO pin '%s'", args.BootModePin))
+	}
+
+	// Stop the monitor from resetting the RP2040 while it is being programmed.
+	if err := os.WriteFile(programmingFlagFile, nil, 0644); err != nil {
+		log.Printf("Failed to write %s: %v", programmingFlagFile, err)
 	}
+	defer os.Remove(programmingFlagFile)
 
-	log.Println("Driving boot pin low so on next restart the RP2040 will boot in USB mode. Can also be programmed from SWD in this mode.")
+	p.stage(stageBootMode, "Driving boot pin low so on next restart the RP2040 will boot in USB mode. Can also be programmed from SWD in this mode.")
 	if err := bootModePin.Out(gpio.Low); err != nil {
-		return err
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
 	}
 	time.Sleep(1 * time.Second)
 
-	log.Println("Restarting RP2040...")
+	p.stage(stageReset, "Restarting RP2040...")
 	if err := runPin.Out(gpio.Low); err != nil {
-		return err
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
 	}
 	time.Sleep(time.Second)
 	if err := runPin.Out(gpio.High); err != nil {
-		return err
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
 	}
 
 	time.Sleep(10 * time.Second)
 	if err := bootModePin.Out(gpio.High); err != nil {
-		return err
+		return exitcode.Wrap(exitcode.HardwareMissing, err)
 	}
 
-	log.Println("RP2400 read for programming.")
+	p.stage(stageReady, "RP2040 ready for programming.")
 
-	success := true
+	var programErr error
 	if args.ELF == "" {
-		log.Println("No elf program provided so assuming programming is done manually.")
-		log.Println("Press enter when programming is done.")
-		_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+		if args.NonInteractive {
+			p.stage(stageManual, fmt.Sprintf("No elf program provided, waiting %s for programming to be done manually.", args.ManualWait))
+			time.Sleep(args.ManualWait)
+		} else {
+			p.stage(stageManual, "No elf program provided so assuming programming is done manually.")
+			log.Println("Press enter when programming is done.")
+			_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+		}
 	} else {
-		log.Printf("Programming '%s' using 'openocd' file to RP2040\n", args.ELF)
-		cmd := exec.Command("openocd", "-f", "/etc/cacophony/raspberrypi-swd.cfg", "-f", "/target/rp2040.cfg", "-c",
-			fmt.Sprintf("program %s verify reset exit", args.ELF))
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			success = false
-			log.Printf("Error programming RP2040: %s\n", err)
+		p.stage(stageProgramming, fmt.Sprintf("Programming '%s' using 'openocd' file to RP2040", args.ELF))
+		programErr = runOpenOCD(args.ELF, args.Timeout)
+		if programErr != nil {
+			log.Printf("Error programming RP2040: %s\n", programErr)
 		}
 	}
 
-	log.Println("Releasing Run and Boot mode pins.")
-	if err := runPin.In(gpio.Float, gpio.NoEdge); err != nil {
-		return err
+	p.stage(stageRelease, "Releasing Run and Boot mode pins.")
+	releaseErr := runPin.In(gpio.Float, gpio.NoEdge)
+	if releaseErr == nil {
+		releaseErr = bootModePin.In(gpio.Float, gpio.NoEdge)
 	}
-	if err := bootModePin.In(gpio.Float, gpio.NoEdge); err != nil {
-		return err
+
+	addProgrammingEvent(programErr, verification)
+
+	if programErr != nil {
+		return programErr
 	}
+	return exitcode.Wrap(exitcode.HardwareMissing, releaseErr)
+}
 
-	eventclient.AddEvent(eventclient.Event{
-		Timestamp: time.Now(),
-		Type:      "programmingRP2040",
-		Details:   map[string]interface{}{"success": success},
-	})
+// verifyELF checks the elf file with its signature or the SHA-256 pinned in the config, see
+// the firmware package.
+func verifyELF(elf string, allowUnsigned bool) (firmware.Result, error) {
+	c := firmware.Config{}
+	if config, err := goconfig.New(goconfig.DefaultConfigDir); err != nil {
+		log.Printf("Failed to read config, only unsigned images can be programmed: %v", err)
+	} else if c, err = firmware.LoadConfig(config); err != nil {
+		return firmware.Result{}, exitcode.Wrap(exitcode.Usage, err)
+	}
+	result, err := c.Verify(elf, c.RP2040SHA256, allowUnsigned)
+	if err != nil {
+		return result, exitcode.Wrap(exitcode.FirmwareUnverified, err)
+	}
+	return result, nil
+}
 
-	log.Println("Done.")
+// addProgrammingEvent records the programming, with how the image was verified if an image
+// was given.
+func addProgrammingEvent(err error, verification *firmware.Result) {
+	programming := eventhelper.RP2040Programming{
+		Success:  err == nil,
+		ExitCode: exitcode.Code(err),
+	}
+	if verification != nil {
+		programming.SHA256 = verification.SHA256
+		programming.Verification = verification.Method
+		programming.Verified = verification.Verified
+		programming.VerificationError = verification.Error
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ProgrammingRP2040, time.Now(), programming)); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+}
+
+// runOpenOCD programs the RP2040 over SWD. The openocd output is checked to tell if it
+// failed to connect to the RP2040 or failed to program it.
+func runOpenOCD(elf string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "openocd", "-f", "/etc/cacophony/raspberrypi-swd.cfg", "-f", "/target/rp2040.cfg", "-c",
+		fmt.Sprintf("program %s verify reset exit", elf))
+	// openocd output goes to stderr so stdout only has the progress when it is JSON.
+	output := &bytes.Buffer{}
+	w := io.MultiWriter(os.Stderr, output)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return exitcode.Wrap(exitcode.Timeout, fmt.Errorf("programming timed out after %s", timeout))
+	}
+	if err != nil {
+		return exitcode.Wrap(classifyOpenOCDFailure(output.String()), err)
+	}
 	return nil
 }
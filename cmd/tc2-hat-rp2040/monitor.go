@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// RP2040 firmware that supports health monitoring has an I2C interface with a heartbeat
+// counter that is incremented every second and the firmware version. Firmware without it
+// won't respond at the address so the monitor won't start.
+const (
+	rp2040I2CAddress    = 0x26
+	rp2040HeartbeatReg  = 0x01
+	rp2040MajorVersion  = 0x02
+	rp2040MinorVersion  = 0x03
+	rp2040PatchVersion  = 0x04
+	heartbeatInterval   = 10 * time.Second
+	maxMissedHeartbeats = 3
+	maxResets           = 3 // Resets before giving up until the heartbeat comes back.
+	programmingFlagFile = "/var/run/tc2-hat-rp2040-programming"
+)
+
+// heartbeatMonitor checks the RP2040 heartbeat and resets it if it stops.
+type heartbeatMonitor struct {
+	readHeartbeat func() (uint8, error)
+	reset         func() error
+	paused        func() bool
+
+	lastHeartbeat uint8
+	seen          bool // Only reset the RP2040 after its heartbeat has been seen working.
+	missed        int
+	resets        int
+	lastAlive     time.Time
+}
+
+func readRP2040Version() (string, error) {
+	version := make([]byte, 3)
+	for i, reg := range []byte{rp2040MajorVersion, rp2040MinorVersion, rp2040PatchVersion} {
+		val, err := i2crequest.TxWithCRC(rp2040I2CAddress, []byte{reg}, 1, 1000)
+		if err != nil {
+			return "", err
+		}
+		version[i] = val[0]
+	}
+	return fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2]), nil
+}
+
+func readRP2040Heartbeat() (uint8, error) {
+	val, err := i2crequest.TxWithCRC(rp2040I2CAddress, []byte{rp2040HeartbeatReg}, 1, 1000)
+	if err != nil {
+		return 0, err
+	}
+	return val[0], nil
+}
+
+// resetRP2040 restarts the RP2040 by pulling the run pin low.
+func resetRP2040(runPin gpio.PinIO) error {
+	if err := runPin.Out(gpio.Low); err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+	if err := runPin.Out(gpio.High); err != nil {
+		return err
+	}
+	return runPin.In(gpio.Float, gpio.NoEdge)
+}
+
+func runMonitor(runPin gpio.PinIO) error {
+	version, err := readRP2040Version()
+	if err != nil {
+		// Exit cleanly so the service isn't restarted.
+		log.Printf("Failed to read RP2040 firmware version, it might not support health monitoring: %v", err)
+		return nil
+	}
+	log.Printf("RP2040 firmware version %s", version)
+	m := &heartbeatMonitor{
+		readHeartbeat: readRP2040Heartbeat,
+		reset:         func() error { return resetRP2040(runPin) },
+		paused: func() bool {
+			_, err := os.Stat(programmingFlagFile)
+			return err == nil
+		},
+	}
+	for {
+		m.check()
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// check reads the heartbeat, counting it as missed if it can't be read or hasn't changed.
+func (m *heartbeatMonitor) check() {
+	if m.paused() {
+		log.Debug("RP2040 is being programmed, not checking heartbeat")
+		m.missed = 0
+		return
+	}
+	now := time.Now()
+	heartbeat, err := m.readHeartbeat()
+	if err == nil && (!m.seen || heartbeat != m.lastHeartbeat) {
+		if m.resets > 0 {
+			log.Printf("RP2040 heartbeat is back after %d resets", m.resets)
+		}
+		m.seen = true
+		m.lastHeartbeat = heartbeat
+		m.lastAlive = now
+		m.missed = 0
+		m.resets = 0
+		return
+	}
+	if !m.seen {
+		return
+	}
+	m.missed++
+	if err != nil {
+		log.Printf("Failed to read RP2040 heartbeat (%d missed): %v", m.missed, err)
+	} else {
+		log.Printf("RP2040 heartbeat hasn't changed (%d missed)", m.missed)
+	}
+	if m.missed < maxMissedHeartbeats {
+		return
+	}
+
+	m.missed = 0
+	if m.resets > maxResets {
+		return // Already given up, wait for the heartbeat to come back.
+	}
+	reset := m.resets < maxResets
+	unresponsive := eventhelper.RP2040Heartbeat{
+		LastHeartbeat: m.lastAlive,
+		Resets:        m.resets,
+		Resetting:     reset,
+	}
+	if err != nil {
+		unresponsive.Error = err.Error()
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.RP2040Unresponsive, now, unresponsive)); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+	m.resets++
+	if !reset {
+		log.Printf("RP2040 still unresponsive after %d resets, not resetting again", maxResets)
+		return
+	}
+	log.Printf("Resetting unresponsive RP2040 (reset %d of %d)", m.resets, maxResets)
+	if err := m.reset(); err != nil {
+		log.Errorf("Failed to reset RP2040: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMonitor(heartbeat *uint8, readErr *error, resets *int) *heartbeatMonitor {
+	return &heartbeatMonitor{
+		readHeartbeat: func() (uint8, error) { return *heartbeat, *readErr },
+		reset: func() error {
+			*resets++
+			return nil
+		},
+		paused: func() bool { return false },
+	}
+}
+
+func TestHeartbeatMonitor(t *testing.T) {
+	var heartbeat uint8
+	var readErr error
+	resets := 0
+	events := eventtest.Capture(t)
+	m := newTestMonitor(&heartbeat, &readErr, &resets)
+
+	for i := 0; i < 5; i++ {
+		heartbeat++
+		m.check()
+	}
+	assert.Zero(t, resets)
+
+	// Heartbeat stops, reset after the max missed heartbeats.
+	for i := 0; i < maxMissedHeartbeats; i++ {
+		m.check()
+	}
+	assert.Equal(t, 1, resets)
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "rp2040Unresponsive", events.Events()[0].Type)
+
+	// Keeps failing, give up after the max resets and only report it once.
+	readErr = errors.New("no response")
+	for i := 0; i < maxMissedHeartbeats*(maxResets+3); i++ {
+		m.check()
+	}
+	assert.Equal(t, maxResets, resets)
+	assert.Len(t, events.Events(), maxResets+1)
+
+	// Heartbeat comes back.
+	readErr = nil
+	heartbeat++
+	m.check()
+	assert.Zero(t, m.resets)
+}
+
+func TestHeartbeatMonitorNeverSeen(t *testing.T) {
+	var heartbeat uint8
+	readErr := errors.New("no response")
+	resets := 0
+	events := eventtest.Capture(t)
+	m := newTestMonitor(&heartbeat, &readErr, &resets)
+
+	for i := 0; i < maxMissedHeartbeats*2; i++ {
+		m.check()
+	}
+	assert.Zero(t, resets)
+	assert.Empty(t, events.Events())
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+)
+
+// Stages reported in the progress output.
+const (
+	stageStart       = "start"
+	stageVerified    = "verified"
+	stageBootMode    = "boot-mode"
+	stageReset       = "reset"
+	stageReady       = "ready"
+	stageProgramming = "programming"
+	stageManual      = "manual"
+	stageRelease     = "release-pins"
+	stageDone        = "done"
+)
+
+// openocd output that means it couldn't talk to the RP2040, rather than the programming failing.
+var openOCDWiringErrors = []string{
+	"Error connecting DP",
+	"DAP init failed",
+	"Failed to connect multidrop",
+	"Could not find MEM-AP",
+	"Could not initialize the debug port",
+	"Error: Failed to read memory",
+	"Error: No Valid JTAG Interface Configured",
+}
+
+// classifyOpenOCDFailure returns the exit code for a failed openocd run from its output, so
+// provisioning scripts can tell a wiring problem from a bad firmware image.
+func classifyOpenOCDFailure(output string) int {
+	for _, s := range openOCDWiringErrors {
+		if strings.Contains(output, s) {
+			return exitcode.HardwareMissing
+		}
+	}
+	return exitcode.BusError
+}
+
+type progressLine struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Message  string    `json:"message,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	ExitCode *int      `json:"exitCode,omitempty"`
+	Class    string    `json:"errorClass,omitempty"` // Such as "hardware-missing", see the exitcode package.
+}
+
+// progress reports each stage of programming, as log lines or as JSON lines for scripts.
+type progress struct {
+	json bool
+	out  io.Writer
+	now  func() time.Time
+}
+
+func (p *progress) stage(stage, message string) {
+	if !p.json {
+		log.Println(message)
+		return
+	}
+	p.write(progressLine{Time: p.now(), Stage: stage, Message: message})
+}
+
+// done reports the final result with the exit code for err.
+func (p *progress) done(err error) {
+	code := exitcode.Code(err)
+	if !p.json {
+		if err == nil {
+			log.Println("Done.")
+		}
+		return
+	}
+	line := progressLine{Time: p.now(), Stage: stageDone, ExitCode: &code}
+	if err != nil {
+		line.Error = err.Error()
+		line.Class = exitcode.Name(code)
+	}
+	p.write(line)
+}
+
+func (p *progress) write(line progressLine) {
+	data, err := json.Marshal(line)
+	if err != nil {
+		log.Printf("Failed to marshal progress: %v", err)
+		return
+	}
+	fmt.Fprintln(p.out, string(data))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyOpenOCDFailure(t *testing.T) {
+	assert.Equal(t, exitcode.HardwareMissing, classifyOpenOCDFailure("Info : SWD DPIDR 0x0bc12477\nError connecting DP: cannot read IDR"))
+	assert.Equal(t, exitcode.BusError, classifyOpenOCDFailure("** Programming Started **\n** Verify Failed **"))
+}
+
+func TestJSONProgress(t *testing.T) {
+	out := &bytes.Buffer{}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	p := &progress{json: true, out: out, now: func() time.Time { return now }}
+	p.stage(stageReady, "RP2040 ready for programming.")
+	p.done(exitcode.Wrap(exitcode.BusError, errors.New("exit status 1")))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	var line progressLine
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &line))
+	assert.Equal(t, stageReady, line.Stage)
+	assert.Nil(t, line.ExitCode)
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &line))
+	assert.Equal(t, stageDone, line.Stage)
+	assert.Equal(t, "exit status 1", line.Error)
+	assert.Equal(t, exitcode.BusError, *line.ExitCode)
+	assert.Equal(t, "bus-error", line.Class)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/window"
+)
+
+// The RTC alarm wakes the device at the start of the next power on window. Devices have been
+// found with an alarm that will never match, or with the alarm interrupt disabled or its flag
+// left set, so they never wake. The alarm is checked against the power on window while the
+// device is running and repaired if it's wrong.
+//
+// The first check is made after alarmCheckInterval so an alarm flag left set from the alarm
+// that woke the device will have been handled by then.
+const (
+	alarmCheckInterval = 10 * time.Minute
+
+	pcf8563AlarmReg = 0x09
+	// Bit 7 of the alarm registers disables that part of the alarm.
+	pcf8563AlarmDisable = 0x80
+)
+
+// alarmRegisters is the raw alarm setup read from the RTC.
+type alarmRegisters struct {
+	Minute  byte
+	Hour    byte
+	Day     byte
+	Weekday byte
+	Enabled bool // Alarm interrupt enabled.
+	Flag    bool // Alarm has triggered and not been cleared.
+}
+
+func (a alarmRegisters) alarmTime() AlarmTime {
+	return AlarmTime{
+		Minute: fromBCD(a.Minute & 0x7F),
+		Hour:   fromBCD(a.Hour & 0x3F),
+		Day:    fromBCD(a.Day & 0x3F),
+	}
+}
+
+// ReadAlarmRegisters reads the alarm registers and the alarm flags.
+func (rtc *pcf8563) ReadAlarmRegisters() (alarmRegisters, error) {
+	b, err := readBytes(pcf8563AlarmReg, 4)
+	if err != nil {
+		return alarmRegisters{}, err
+	}
+	state, err := readByte(PCF8563_STAT2_REG)
+	if err != nil {
+		return alarmRegisters{}, err
+	}
+	return alarmRegisters{
+		Minute:  b[0],
+		Hour:    b[1],
+		Day:     b[2],
+		Weekday: b[3],
+		Enabled: state&PCF8563_ALARM_AIE != 0,
+		Flag:    state&PCF8563_ALARM_AF != 0,
+	}, nil
+}
+
+type alarmRTC interface {
+	GetTime() (time.Time, bool, error)
+	ReadAlarmRegisters() (alarmRegisters, error)
+	SetAlarmTime(AlarmTime) error
+	SetAlarmEnabled(bool) error
+	ClearAlarmFlag() error
+}
+
+// alarmProblems returns what is wrong with the alarm. expected is nil when there is no
+// power on window, then only the registers are checked.
+func alarmProblems(regs alarmRegisters, expected *AlarmTime) []string {
+	problems := registerProblems(regs)
+	if regs.Flag {
+		problems = append(problems, "alarm flag is stuck set")
+	}
+	if expected != nil {
+		if regs.alarmTime() != *expected {
+			problems = append(problems, fmt.Sprintf("alarm set to %s, expected %s", regs.alarmTime(), *expected))
+		}
+		if !regs.Enabled {
+			problems = append(problems, "alarm interrupt is disabled")
+		}
+	}
+	return problems
+}
+
+// registerProblems checks the alarm registers have valid values and only the minute, hour
+// and day alarms are enabled, as set by SetAlarmTime.
+func registerProblems(regs alarmRegisters) []string {
+	problems := []string{}
+	if !validBCD(regs.Minute&0x7F, 59) || !validBCD(regs.Hour&0x3F, 23) || !validBCD(regs.Day&0x3F, 31) || regs.Day&0x3F == 0 {
+		problems = append(problems, fmt.Sprintf("alarm registers have invalid values %02X %02X %02X", regs.Minute, regs.Hour, regs.Day))
+	}
+	if regs.Minute&pcf8563AlarmDisable != 0 || regs.Hour&pcf8563AlarmDisable != 0 || regs.Day&pcf8563AlarmDisable != 0 {
+		problems = append(problems, "minute, hour or day alarm is disabled")
+	}
+	if regs.Weekday&pcf8563AlarmDisable == 0 {
+		problems = append(problems, "weekday alarm is enabled")
+	}
+	return problems
+}
+
+func validBCD(b byte, maxVal int) bool {
+	return b&0x0F <= 9 && b>>4 <= 9 && fromBCD(b) <= maxVal
+}
+
+// alarmChecker checks the alarm against the next power on time and repairs it.
+type alarmChecker struct {
+	rtc alarmRTC
+	// Returns the next time the device should wake, false if there is no power on window.
+	nextWake func() (time.Time, bool)
+	now      func() time.Time
+}
+
+// check repairs the alarm if there is something wrong with it and reports what was wrong.
+func (c *alarmChecker) check() error {
+	regs, err := c.rtc.ReadAlarmRegisters()
+	if err != nil {
+		return err
+	}
+	var expected *AlarmTime
+	if wake, ok := c.nextWake(); ok {
+		// The alarm is matched against the RTC time so allow for the RTC being off.
+		rtcTime, _, err := c.rtc.GetTime()
+		if err != nil {
+			return err
+		}
+		a := AlarmTimeFromTime(wake.Add(rtcTime.Sub(c.now()).Round(time.Minute)))
+		expected = &a
+	}
+	problems := alarmProblems(regs, expected)
+	if len(problems) == 0 {
+		return nil
+	}
+	log.Printf("Repairing RTC alarm: %v", problems)
+
+	repairErr := c.repair(regs, expected)
+	payload := eventhelper.RTCAlarmCorrection{
+		Problems:     problems,
+		AlarmTime:    regs.alarmTime().String(),
+		AlarmEnabled: regs.Enabled,
+		Repaired:     repairErr == nil,
+	}
+	if expected != nil {
+		payload.ExpectedAlarmTime = expected.String()
+	}
+	if repairErr != nil {
+		payload.Error = repairErr.Error()
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.RTCAlarmCorrected, c.now(), payload)); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+	return repairErr
+}
+
+func (c *alarmChecker) repair(regs alarmRegisters, expected *AlarmTime) error {
+	if regs.Flag {
+		if err := c.rtc.ClearAlarmFlag(); err != nil {
+			return err
+		}
+	}
+	registersValid := len(registerProblems(regs)) == 0
+	if expected == nil {
+		// Nothing to set the alarm to, so stop a bad alarm from waking the device at a random time.
+		if regs.Enabled && !registersValid {
+			return c.rtc.SetAlarmEnabled(false)
+		}
+		return nil
+	}
+	if !registersValid || regs.alarmTime() != *expected {
+		if err := c.rtc.SetAlarmTime(*expected); err != nil {
+			return err
+		}
+	}
+	if !regs.Enabled {
+		return c.rtc.SetAlarmEnabled(true)
+	}
+	return nil
+}
+
+// powerOnWindow returns the next power on time from the windows config.
+func powerOnWindow(configDir string) (func() (time.Time, bool), error) {
+	conf, err := goconfig.New(configDir)
+	if err != nil {
+		return nil, err
+	}
+	windows := goconfig.DefaultWindows()
+	if err := conf.Unmarshal(goconfig.WindowsKey, &windows); err != nil {
+		return nil, err
+	}
+	if windows.PowerOn == "" || windows.PowerOn == windows.PowerOff {
+		// Always on, so no alarm is needed.
+		return func() (time.Time, bool) { return time.Time{}, false }, nil
+	}
+	location := goconfig.DefaultWindowLocation()
+	if err := conf.Unmarshal(goconfig.LocationKey, &location); err != nil {
+		return nil, err
+	}
+	w, err := window.New(windows.PowerOn, windows.PowerOff, float64(location.Latitude), float64(location.Longitude))
+	if err != nil {
+		return nil, err
+	}
+	return func() (time.Time, bool) { return w.NextStart(), true }, nil
+}
+
+// alarmCheckLoop checks the alarm every alarmCheckInterval.
+func alarmCheckLoop(rtc alarmRTC, configDir string) {
+	nextWake, err := powerOnWindow(configDir)
+	if err != nil {
+		log.Printf("Failed to read power on window, not checking the RTC alarm: %v", err)
+		return
+	}
+	c := &alarmChecker{
+		rtc:      rtc,
+		nextWake: nextWake,
+		now:      time.Now,
+	}
+	for {
+		time.Sleep(alarmCheckInterval)
+		if err := c.check(); err != nil {
+			log.Printf("Error checking RTC alarm: %v", err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAlarmRTC struct {
+	offset time.Duration // RTC time - system time.
+	now    time.Time
+	regs   alarmRegisters
+}
+
+func (f *fakeAlarmRTC) GetTime() (time.Time, bool, error) {
+	return f.now.Add(f.offset), true, nil
+}
+
+func (f *fakeAlarmRTC) ReadAlarmRegisters() (alarmRegisters, error) {
+	return f.regs, nil
+}
+
+func (f *fakeAlarmRTC) SetAlarmTime(a AlarmTime) error {
+	f.regs.Minute = toBCD(a.Minute)
+	f.regs.Hour = toBCD(a.Hour)
+	f.regs.Day = toBCD(a.Day)
+	f.regs.Weekday = pcf8563AlarmDisable
+	return nil
+}
+
+func (f *fakeAlarmRTC) SetAlarmEnabled(enabled bool) error {
+	f.regs.Enabled = enabled
+	return nil
+}
+
+func (f *fakeAlarmRTC) ClearAlarmFlag() error {
+	f.regs.Flag = false
+	return nil
+}
+
+func newTestAlarmChecker(rtc *fakeAlarmRTC, wake *time.Time) *alarmChecker {
+	return &alarmChecker{
+		rtc: rtc,
+		nextWake: func() (time.Time, bool) {
+			return *wake, !wake.IsZero()
+		},
+		now: func() time.Time { return rtc.now },
+	}
+}
+
+func TestAlarmCheckerRepairs(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	wake := time.Date(2024, 6, 2, 5, 30, 0, 0, time.UTC)
+	rtc := &fakeAlarmRTC{now: now}
+	events := eventtest.Capture(t)
+	c := newTestAlarmChecker(rtc, &wake)
+
+	// Correct alarm, nothing to do.
+	assert.NoError(t, rtc.SetAlarmTime(AlarmTimeFromTime(wake)))
+	rtc.regs.Enabled = true
+	assert.NoError(t, c.check())
+	assert.Empty(t, events.Events())
+
+	// Invalid day and the alarm interrupt stuck off.
+	rtc.regs.Day = 0x32
+	rtc.regs.Enabled = false
+	assert.NoError(t, c.check())
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "rtcAlarmCorrected", events.Events()[0].Type)
+	assert.Len(t, events.Events()[0].Details["problems"], 3)
+	assert.Equal(t, AlarmTimeFromTime(wake), rtc.regs.alarmTime())
+	assert.True(t, rtc.regs.Enabled)
+
+	// The expected alarm allows for the RTC being 2 minutes fast.
+	rtc.offset = 2 * time.Minute
+	rtc.regs.Flag = true
+	assert.NoError(t, c.check())
+	assert.Len(t, events.Events(), 2)
+	assert.Equal(t, AlarmTime{Minute: 32, Hour: 5, Day: 2}, rtc.regs.alarmTime())
+	assert.False(t, rtc.regs.Flag)
+
+	assert.NoError(t, c.check())
+	assert.Len(t, events.Events(), 2)
+}
+
+func TestAlarmCheckerWithoutWindow(t *testing.T) {
+	rtc := &fakeAlarmRTC{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	wake := time.Time{}
+	events := eventtest.Capture(t)
+	c := newTestAlarmChecker(rtc, &wake)
+
+	// Any alarm time is fine when always on, but a bad alarm is disabled.
+	assert.NoError(t, rtc.SetAlarmTime(AlarmTime{Minute: 10, Hour: 3, Day: 9}))
+	assert.NoError(t, c.check())
+	assert.Empty(t, events.Events())
+
+	rtc.regs.Enabled = true
+	rtc.regs.Weekday = 0x01
+	assert.NoError(t, c.check())
+	assert.Len(t, events.Events(), 1)
+	assert.False(t, rtc.regs.Enabled)
+}
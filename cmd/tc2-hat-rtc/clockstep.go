@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/timeline"
+)
+
+// The system clock can be stepped by this service setting it from the RTC or GPS, and by NTP,
+// which leaves the timestamps in the CSV and event files out of order. The steps are found by
+// comparing how far the system clock has moved with how far the monotonic clock has moved,
+// which isn't affected by the steps, and are appended to timeline.ClockStepsFile so the
+// histories can be put back in order, see the timeline package.
+const (
+	clockStepCheckInterval = 10 * time.Second
+	// Smaller differences are NTP slewing the clock or the check being late.
+	minClockStep = 2 * time.Second
+)
+
+// clockStepDetector records steps of the system clock.
+type clockStepDetector struct {
+	file string
+}
+
+// step returns the step from the wall clock and monotonic clock time between two checks,
+// ok is false if the clock wasn't stepped.
+func (d *clockStepDetector) step(now time.Time, wallElapsed, monotonicElapsed time.Duration) (timeline.ClockStep, bool) {
+	offset := wallElapsed - monotonicElapsed
+	if offset > -minClockStep && offset < minClockStep {
+		return timeline.ClockStep{}, false
+	}
+	return timeline.ClockStep{Time: now, Offset: offset}, true
+}
+
+func (d *clockStepDetector) record(s timeline.ClockStep) error {
+	f, err := os.OpenFile(d.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(s.String() + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// run checks for clock steps every clockStepCheckInterval.
+func (d *clockStepDetector) run() {
+	last := time.Now()
+	for {
+		time.Sleep(clockStepCheckInterval)
+		now := time.Now()
+		// Round(0) strips the monotonic reading so Sub uses the wall clock.
+		s, ok := d.step(now.Round(0), now.Round(0).Sub(last.Round(0)), now.Sub(last))
+		last = now
+		if !ok {
+			continue
+		}
+		log.Printf("System clock was stepped by %s", s.Offset)
+		if err := d.record(s); err != nil {
+			log.Printf("Failed to record clock step: %v", err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/timeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockStepDetector(t *testing.T) {
+	d := &clockStepDetector{file: filepath.Join(t.TempDir(), "clock-steps.csv")}
+	now := time.Date(2026, 6, 1, 9, 12, 44, 0, time.UTC)
+
+	_, ok := d.step(now, 10*time.Second+500*time.Millisecond, 10*time.Second)
+	assert.False(t, ok)
+	s, ok := d.step(now, 24*time.Hour+10*time.Second, 10*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 24*time.Hour, s.Offset)
+	back, ok := d.step(now, 5*time.Second, 10*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, -5*time.Second, back.Offset)
+
+	assert.NoError(t, d.record(s))
+	assert.NoError(t, d.record(back))
+	f, err := os.Open(d.file)
+	assert.NoError(t, err)
+	defer f.Close()
+	steps, bad, err := timeline.ReadClockSteps(f)
+	assert.NoError(t, err)
+	assert.Zero(t, bad)
+	assert.Equal(t, []time.Duration{24 * time.Hour, -5 * time.Second}, []time.Duration{steps[0].Offset, steps[1].Offset})
+}
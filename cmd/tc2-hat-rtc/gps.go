@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/tarm/serial"
+)
+
+// An optional GPS module on the aux UART can be used as a time source for devices that
+// never get a network connection. The RMC and GGA NMEA sentences are read, and once the fix
+// is good enough the system clock and RTC are set from it, as long as NTP isn't synchronised.
+// The position is reported with a gpsFix event.
+//
+//	[gps]
+//	enable = true
+//	serial-device = "/dev/ttyAMA1"
+//	baud = 9600
+//	min-satellites = 4
+//	max-hdop = 5.0
+//	sync-interval = "1h"
+//
+// The RMC time is the start of the second the sentence is sent in, which is well within the
+// one second resolution of the RTC.
+const (
+	gpsConfigKey = "gps"
+	// The clock is only set if it is off by more than this.
+	gpsMinClockOffset = 2 * time.Second
+	// A gpsFix event is sent at least this often while there is a fix.
+	gpsFixEventInterval = 24 * time.Hour
+)
+
+type gpsConfig struct {
+	Enable        bool          `mapstructure:"enable"`
+	SerialDevice  string        `mapstructure:"serial-device"`
+	Baud          int           `mapstructure:"baud"`
+	MinSatellites int           `mapstructure:"min-satellites"`
+	MaxHDOP       float64       `mapstructure:"max-hdop"`
+	SyncInterval  time.Duration `mapstructure:"sync-interval"`
+}
+
+func defaultGPSConfig() gpsConfig {
+	return gpsConfig{
+		SerialDevice:  "/dev/ttyAMA1",
+		Baud:          9600,
+		MinSatellites: 4,
+		MaxHDOP:       5,
+		SyncInterval:  time.Hour,
+	}
+}
+
+func loadGPSConfig(configDir string) (gpsConfig, error) {
+	c := defaultGPSConfig()
+	conf, err := goconfig.New(configDir)
+	if err != nil {
+		return c, err
+	}
+	if err := configcompat.Unmarshal(conf, gpsConfigKey, &c); err != nil {
+		return c, err
+	}
+	if c.SyncInterval < time.Minute {
+		return c, fmt.Errorf("%s sync-interval must be at least a minute", gpsConfigKey)
+	}
+	return c, nil
+}
+
+// gpsFix is made from the RMC and GGA sentences for the same second.
+type gpsFix struct {
+	Time       time.Time
+	Valid      bool // RMC status is active.
+	Quality    int  // GGA fix quality, 0 is no fix.
+	Satellites int
+	HDOP       float64
+	Latitude   float64
+	Longitude  float64
+	Altitude   float64 // Metres above mean sea level.
+}
+
+// usable returns an error if the fix isn't good enough to set the time from.
+func (f gpsFix) usable(c gpsConfig) error {
+	switch {
+	case !f.Valid || f.Quality == 0:
+		return fmt.Errorf("no fix")
+	case f.Satellites < c.MinSatellites:
+		return fmt.Errorf("only %d satellites", f.Satellites)
+	case f.HDOP > c.MaxHDOP:
+		return fmt.Errorf("HDOP %.1f is above %.1f", f.HDOP, c.MaxHDOP)
+	case f.Time.Before(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)):
+		// Some modules report a time from the last GPS week rollover before they have the almanac.
+		return fmt.Errorf("time %s is too early", f.Time.Format(time.DateTime))
+	}
+	return nil
+}
+
+// parseNMEA checks the checksum of the sentence and returns its fields, the first field is
+// the sentence type without the talker ID, e.g. "RMC" for "$GPRMC" and "$GNRMC".
+func parseNMEA(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("not an NMEA sentence")
+	}
+	body, checksum, found := strings.Cut(line[1:], "*")
+	if !found {
+		return nil, fmt.Errorf("no checksum")
+	}
+	want, err := strconv.ParseUint(checksum, 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum '%s'", checksum)
+	}
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	if sum != byte(want) {
+		return nil, fmt.Errorf("checksum is 0x%02X, expected 0x%02X", sum, want)
+	}
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 {
+		return nil, fmt.Errorf("unknown sentence '%s'", fields[0])
+	}
+	fields[0] = fields[0][2:]
+	return fields, nil
+}
+
+// parseCoordinate parses a ddmm.mmmm or dddmm.mmmm value with its hemisphere into degrees.
+func parseCoordinate(value, hemisphere string) (float64, error) {
+	dot := strings.Index(value, ".")
+	if dot < 3 {
+		return 0, fmt.Errorf("invalid coordinate '%s'", value)
+	}
+	degrees, err := strconv.ParseFloat(value[:dot-2], 64)
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.ParseFloat(value[dot-2:], 64)
+	if err != nil {
+		return 0, err
+	}
+	coordinate := degrees + minutes/60
+	switch hemisphere {
+	case "S", "W":
+		return -coordinate, nil
+	case "N", "E":
+		return coordinate, nil
+	default:
+		return 0, fmt.Errorf("invalid hemisphere '%s'", hemisphere)
+	}
+}
+
+// gpsReader combines the RMC and GGA sentences into fixes.
+type gpsReader struct {
+	rmc      gpsFix
+	rmcTime  string
+	gga      gpsFix
+	ggaTime  string
+	complete string // Time of the last fix returned, so it isn't returned twice.
+}
+
+// addSentence adds the NMEA sentence, returning the fix once there are both RMC and GGA
+// sentences for the same second.
+func (r *gpsReader) addSentence(line string) (*gpsFix, error) {
+	fields, err := parseNMEA(line)
+	if err != nil {
+		return nil, err
+	}
+	switch fields[0] {
+	case "RMC":
+		// $GPRMC,hhmmss.ss,A,ddmm.mm,N,dddmm.mm,E,speed,course,ddmmyy,...
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("RMC sentence is too short")
+		}
+		fix := gpsFix{Valid: fields[2] == "A"}
+		if fix.Valid {
+			if fix.Time, err = time.Parse("020106 150405", fields[9]+" "+fields[1][:min(6, len(fields[1]))]); err != nil {
+				return nil, err
+			}
+			if fix.Latitude, err = parseCoordinate(fields[3], fields[4]); err != nil {
+				return nil, err
+			}
+			if fix.Longitude, err = parseCoordinate(fields[5], fields[6]); err != nil {
+				return nil, err
+			}
+		}
+		r.rmc, r.rmcTime = fix, fields[1]
+	case "GGA":
+		// $GPGGA,hhmmss.ss,ddmm.mm,N,dddmm.mm,E,quality,satellites,hdop,altitude,M,...
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("GGA sentence is too short")
+		}
+		fix := gpsFix{}
+		fix.Quality, _ = strconv.Atoi(fields[6])
+		fix.Satellites, _ = strconv.Atoi(fields[7])
+		fix.HDOP = math.Inf(1)
+		if hdop, err := strconv.ParseFloat(fields[8], 64); err == nil {
+			fix.HDOP = hdop
+		}
+		fix.Altitude, _ = strconv.ParseFloat(fields[9], 64)
+		r.gga, r.ggaTime = fix, fields[1]
+	default:
+		return nil, nil
+	}
+	if r.rmcTime == "" || r.rmcTime != r.ggaTime || r.rmcTime == r.complete {
+		return nil, nil
+	}
+	r.complete = r.rmcTime
+	fix := r.rmc
+	fix.Quality = r.gga.Quality
+	fix.Satellites = r.gga.Satellites
+	fix.HDOP = r.gga.HDOP
+	fix.Altitude = r.gga.Altitude
+	return &fix, nil
+}
+
+type gpsRTC interface {
+	SetTime(time.Time) error
+}
+
+// gpsTimeSync sets the clocks from the GPS fixes when NTP isn't available.
+type gpsTimeSync struct {
+	config         gpsConfig
+	rtc            gpsRTC
+	setSystemClock func(time.Time) error
+	ntpSynced      func() (bool, error)
+	now            func() time.Time
+
+	lastSync      time.Time // GPS time the clocks were last checked.
+	lastFixEvent  time.Time
+	lastFixStatus string
+}
+
+func newGPSTimeSync(c gpsConfig, rtc gpsRTC) *gpsTimeSync {
+	return &gpsTimeSync{
+		config:         c,
+		rtc:            rtc,
+		setSystemClock: setSystemClock,
+		ntpSynced:      ntpSynchronized,
+		now:            time.Now,
+	}
+}
+
+// handleFix sets the clocks from the fix if it is good enough and it is time to sync, and
+// reports the position.
+func (g *gpsTimeSync) handleFix(fix gpsFix) {
+	if err := fix.usable(g.config); err != nil {
+		if status := err.Error(); status != g.lastFixStatus {
+			log.Printf("Not using GPS fix: %s", status)
+			g.lastFixStatus = status
+		}
+		return
+	}
+	if g.lastFixStatus != "" || g.lastFixEvent.IsZero() {
+		log.Printf("GPS fix with %d satellites, HDOP %.1f", fix.Satellites, fix.HDOP)
+		g.lastFixStatus = ""
+	}
+
+	timeSet := false
+	offset := fix.Time.Sub(g.now())
+	if g.lastSync.IsZero() || fix.Time.Sub(g.lastSync) >= g.config.SyncInterval {
+		g.lastSync = fix.Time
+		synced, err := g.ntpSynced()
+		if err != nil {
+			log.Printf("Failed to check NTP status: %v", err)
+		}
+		if !synced && offset.Abs() > gpsMinClockOffset {
+			log.Printf("Setting the clocks from GPS, system clock is off by %s", offset.Round(time.Second))
+			if err := g.setSystemClock(fix.Time); err != nil {
+				log.Printf("Failed to set the system clock from GPS: %v", err)
+			} else {
+				timeSet = true
+			}
+			if err := g.rtc.SetTime(fix.Time); err != nil {
+				log.Printf("Failed to set the RTC from GPS: %v", err)
+			}
+		}
+	}
+
+	if !timeSet && !g.lastFixEvent.IsZero() && fix.Time.Sub(g.lastFixEvent) < gpsFixEventInterval {
+		return
+	}
+	g.lastFixEvent = fix.Time
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.GPSFix, fix.Time, eventhelper.GPSPosition{
+		Latitude:           fix.Latitude,
+		Longitude:          fix.Longitude,
+		Altitude:           fix.Altitude,
+		Satellites:         fix.Satellites,
+		HDOP:               fix.HDOP,
+		FixQuality:         fix.Quality,
+		TimeSet:            timeSet,
+		ClockOffsetSeconds: math.Round(offset.Seconds()),
+	})); err != nil {
+		log.Printf("Error adding gpsFix event: %v", err)
+	}
+}
+
+// read reads the NMEA sentences from the GPS module until there is an error.
+func (g *gpsTimeSync) read(r io.Reader) error {
+	reader := &gpsReader{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fix, err := reader.addSentence(scanner.Text())
+		if err != nil {
+			log.Debugf("Ignoring GPS sentence: %v", err)
+			continue
+		}
+		if fix != nil {
+			g.handleFix(*fix)
+		}
+	}
+	return scanner.Err()
+}
+
+// run reads from the GPS module, opening the serial port again after any errors.
+func (g *gpsTimeSync) run() {
+	log.Printf("Reading GPS from %s", g.config.SerialDevice)
+	for {
+		port, err := serial.OpenPort(&serial.Config{Name: g.config.SerialDevice, Baud: g.config.Baud})
+		if err != nil {
+			log.Printf("Failed to open GPS serial port: %v", err)
+		} else {
+			if err := g.read(port); err != nil {
+				log.Printf("Error reading GPS: %v", err)
+			}
+			port.Close()
+		}
+		time.Sleep(time.Minute)
+	}
+}
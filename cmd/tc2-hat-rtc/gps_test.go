@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// nmea adds the $ and checksum to the sentence body.
+func nmea(body string) string {
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	return fmt.Sprintf("$%s*%02X", body, sum)
+}
+
+func TestParseNMEA(t *testing.T) {
+	fields, err := parseNMEA("$GPGGA,092750.000,5321.6802,N,00630.3372,W,1,8,1.03,61.7,M,55.2,M,,*76")
+	assert.NoError(t, err)
+	assert.Equal(t, "GGA", fields[0])
+	assert.Equal(t, "092750.000", fields[1])
+
+	_, err = parseNMEA("$GPGGA,092750.000,5321.6802,N,00630.3372,W,1,8,1.03,61.7,M,55.2,M,,*77")
+	assert.Error(t, err)
+	_, err = parseNMEA("$GPGGA,092750.000")
+	assert.Error(t, err)
+}
+
+func TestParseCoordinate(t *testing.T) {
+	lat, err := parseCoordinate("4330.0000", "S")
+	assert.NoError(t, err)
+	assert.InDelta(t, -43.5, lat, 1e-9)
+	lon, err := parseCoordinate("17236.0000", "E")
+	assert.NoError(t, err)
+	assert.InDelta(t, 172.6, lon, 1e-9)
+	_, err = parseCoordinate("4330.0000", "X")
+	assert.Error(t, err)
+}
+
+func TestGPSReaderCombinesSentences(t *testing.T) {
+	r := &gpsReader{}
+	fix, err := r.addSentence(nmea("GNRMC,013000.00,A,4330.0000,S,17236.0000,E,0.0,0.0,150626,,,A"))
+	assert.NoError(t, err)
+	assert.Nil(t, fix)
+	fix, err = r.addSentence(nmea("GNGGA,013000.00,4330.0000,S,17236.0000,E,1,07,1.2,35.0,M,10.0,M,,"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, fix) {
+		assert.Equal(t, time.Date(2026, 6, 15, 1, 30, 0, 0, time.UTC), fix.Time)
+		assert.True(t, fix.Valid)
+		assert.Equal(t, 7, fix.Satellites)
+		assert.Equal(t, 1.2, fix.HDOP)
+		assert.Equal(t, 35.0, fix.Altitude)
+		assert.InDelta(t, -43.5, fix.Latitude, 1e-9)
+		assert.NoError(t, fix.usable(defaultGPSConfig()))
+	}
+
+	// Sentences for a new second without a fix.
+	fix, err = r.addSentence(nmea("GNGGA,013001.00,,,,,0,00,99.99,,,,,,"))
+	assert.NoError(t, err)
+	assert.Nil(t, fix)
+	fix, err = r.addSentence(nmea("GNRMC,013001.00,V,,,,,,,150626,,,N"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, fix) {
+		assert.Error(t, fix.usable(defaultGPSConfig()))
+	}
+}
+
+type fakeGPSRTC struct {
+	set []time.Time
+}
+
+func (r *fakeGPSRTC) SetTime(t time.Time) error {
+	r.set = append(r.set, t)
+	return nil
+}
+
+func TestGPSTimeSync(t *testing.T) {
+	systemTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtc := &fakeGPSRTC{}
+	events := eventtest.Capture(t)
+	synced := false
+	g := &gpsTimeSync{
+		config: defaultGPSConfig(),
+		rtc:    rtc,
+		setSystemClock: func(t time.Time) error {
+			systemTime = t
+			return nil
+		},
+		ntpSynced: func() (bool, error) { return synced, nil },
+		now:       func() time.Time { return systemTime },
+	}
+	fix := gpsFix{
+		Time:       time.Date(2026, 6, 15, 1, 30, 0, 0, time.UTC),
+		Valid:      true,
+		Quality:    1,
+		Satellites: 6,
+		HDOP:       1.5,
+		Latitude:   -43.5,
+		Longitude:  172.6,
+	}
+
+	// Poor fixes are ignored.
+	poor := fix
+	poor.Satellites = 2
+	g.handleFix(poor)
+	assert.Empty(t, rtc.set)
+	assert.Empty(t, events.Events())
+
+	g.handleFix(fix)
+	assert.Equal(t, fix.Time, systemTime)
+	assert.Equal(t, []time.Time{fix.Time}, rtc.set)
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "gpsFix", events.Events()[0].Type)
+		assert.Equal(t, true, events.Events()[0].Details["timeSet"])
+		assert.Equal(t, -43.5, events.Events()[0].Details["latitude"])
+	}
+
+	// Not synced again until the sync interval.
+	fix.Time = fix.Time.Add(10 * time.Minute)
+	g.handleFix(fix)
+	assert.Len(t, rtc.set, 1)
+	assert.Len(t, events.Events(), 1)
+
+	// The clocks aren't set while NTP is synchronised.
+	synced = true
+	fix.Time = fix.Time.Add(2 * time.Hour)
+	g.handleFix(fix)
+	assert.Len(t, rtc.set, 1)
+	assert.Len(t, events.Events(), 1)
+}
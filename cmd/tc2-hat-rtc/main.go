@@ -19,10 +19,20 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	goconfig "github.com/TheCacophonyProject/go-config"
 	"github.com/TheCacophonyProject/go-utils/logging"
-	"github.com/alexflint/go-arg"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/instancelock"
+	"github.com/TheCacophonyProject/tc2-hat-controller/readiness"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
+	"github.com/TheCacophonyProject/tc2-hat-controller/timeline"
 )
 
 type Args struct {
@@ -32,11 +42,18 @@ type Args struct {
 }
 
 type subcommand struct {
+	Replace bool `arg:"--replace" help:"Stop another running instance of the service and take over from it."`
 }
 
 var (
 	log     = logging.NewLogger("info")
 	version = "<not set>"
+	// buildDate is the RFC3339 time the binary was built, the RTC time can't be before it.
+	buildDate = ""
+
+	// serviceCtx is cancelled when the service is asked to stop, so a hung I2C request
+	// doesn't hold up stopping the service.
+	serviceCtx = context.Background()
 )
 
 func (Args) Version() string {
@@ -45,13 +62,14 @@ func (Args) Version() string {
 
 func procArgs() Args {
 	args := Args{}
-	arg.MustParse(&args)
+	exitcode.MustParse(&args)
 	return args
 }
 func main() {
 	err := runMain()
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(exitcode.Code(err))
 	}
 }
 
@@ -61,21 +79,32 @@ func runMain() error {
 	log = logging.NewLogger(args.LogLevel)
 
 	log.Printf("running version: %s", version)
+	configcompat.SetBinary("tc2-hat-rtc", version)
 
 	if args.Service != nil {
-		if err := startService(); err != nil {
+		if _, err := instancelock.Acquire("tc2-hat-rtc", args.Service.Replace); err != nil {
 			return err
 		}
-		for {
-			time.Sleep(time.Second)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		serviceCtx = ctx
+		if err := readiness.Clear(readiness.RTC); err != nil {
+			log.Printf("Failed to clear readiness: %v", err)
+		}
+		readiness.WaitFor(ctx, readiness.RTC, readiness.I2C)
+		if err := startService(); err != nil {
+			return err
 		}
+		<-ctx.Done()
+		log.Println("Stopping service")
+		return nil
 	} else if args.SetTime != "" {
 		rtc := &pcf8563{}
 		newTime, err := time.Parse("2006-01-02 15:04:05", args.SetTime)
 		if err != nil {
-			return err
+			return exitcode.Wrap(exitcode.Usage, err)
 		}
-		return rtc.SetTime(newTime)
+		return exitcode.Wrap(exitcode.BusError, rtc.SetTime(newTime))
 	}
 	return nil
 }
@@ -88,10 +117,44 @@ func startService() error {
 	}
 	log.Println("Starting RTC service.")
 	if err := startRTCService(rtc); err != nil {
-		return err
+		if !standalone.Enabled() {
+			return err
+		}
+		// A datalogger keeps the time without the D-Bus API.
+		log.Printf("Failed to start RTC D-Bus service: %v", err)
 	}
-	if err := rtc.SetSystemTime(); err != nil {
+	configDir := standalone.ConfigDirOr(goconfig.DefaultConfigDir)
+	gps, err := loadGPSConfig(configDir)
+	if err != nil {
+		log.Printf("Failed to read GPS config: %v", err)
+		gps.Enable = false
+	}
+	guard, err := loadTimeGuardConfig(configDir)
+	if err != nil {
+		log.Printf("Failed to read RTC time guard config, using defaults: %v", err)
+	}
+	alternate := ""
+	if gps.Enable {
+		alternate = "gps"
+	}
+	// Started first so the clock being set from the RTC is recorded.
+	go (&clockStepDetector{file: timeline.ClockStepsFile}).run()
+	if err := rtc.SetSystemTime(guard, alternate); err != nil {
 		log.Println(err)
 	}
+	// Services that save timestamps wait for the system time to be set.
+	if err := readiness.Announce(readiness.RTC); err != nil {
+		log.Printf("Failed to announce readiness: %v", err)
+	}
+	go alarmCheckLoop(rtc, configDir)
+	tempComp, err := loadTempCompConfig(configDir)
+	if err != nil {
+		log.Printf("Failed to read RTC temperature compensation config: %v", err)
+	} else if tempComp.Enable {
+		go newTempCompensator(tempComp, rtc).run()
+	}
+	if gps.Enable {
+		go newGPSTimeSync(gps, rtc).run()
+	}
 	return nil
 }
@@ -8,7 +8,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
 	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
 )
 
@@ -29,8 +30,8 @@ type pcf8563 struct{}
 
 func InitPCF9564() (*pcf8563, error) {
 	// Check that a device is present on I2C bus at the PCF8563 address.
-	if err := i2crequest.CheckAddress(pcf8563Address, 1000); err != nil {
-		return nil, fmt.Errorf("failed to find pcf8563 device on i2c bus: %v", err)
+	if err := i2crequest.CheckAddressContext(serviceCtx, pcf8563Address); err != nil {
+		return nil, exitcode.Wrap(exitcode.HardwareMissing, fmt.Errorf("failed to find pcf8563 device on i2c bus: %v", err))
 	}
 	rtc := &pcf8563{}
 	go rtc.checkNtpSyncLoop()
@@ -41,15 +42,13 @@ func (rtc *pcf8563) checkNtpSyncLoop() {
 	hasSynced := false
 	log.Println("Starting ntp sync loop")
 	for {
-		cmd := exec.Command("timedatectl", "status")
-		out, err := cmd.CombinedOutput()
+		synced, err := ntpSynchronized()
 		if err != nil {
-			log.Printf("Error executing '%s' command: %v\n", strings.Join(cmd.Args, " "), err)
-			log.Printf("Combined Output: %s\n", string(out))
+			log.Println(err)
 			return
 		}
 
-		if strings.Contains(string(out), "synchronized: yes") {
+		if synced {
 			log.Println("Writing time to RTC")
 			ntpTime := time.Now().UTC() // Close enough to NTP time as it has synchronized. //TODO find a way of checking how long ago the RPi did the NTP sync.
 
@@ -69,6 +68,16 @@ func (rtc *pcf8563) checkNtpSyncLoop() {
 	}
 }
 
+// ntpSynchronized checks if the system clock has been synchronised with NTP.
+func ntpSynchronized() (bool, error) {
+	cmd := exec.Command("timedatectl", "status")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("error executing '%s' command: %v, output: %s", strings.Join(cmd.Args, " "), err, string(out))
+	}
+	return strings.Contains(string(out), "synchronized: yes"), nil
+}
+
 func checkRtcDrift(ntpTime time.Time, rtcTime time.Time, rtcIntegrity bool) error {
 	// Get last time RTC was updated
 	timeRaw, err := os.ReadFile(lastRtcWriteTimeFile)
@@ -113,20 +122,16 @@ func checkRtcDrift(ntpTime time.Time, rtcTime time.Time, rtcIntegrity bool) erro
 		log.Println("RTC drift per month in seconds:", secondsToDuration(rtcDriftSecondsPerMonth))
 		log.Println("RTC drift per month error +-", secondsToDuration(driftPerMonthError))
 
-		eventType := "rtcNtpDrift"
+		eventType := eventhelper.RTCNtpDrift
 		if rtcDriftSecondsPerMonth > 600 { // TODO find a good value to have this as.
-			eventType = "rtcNtpDriftHigh"
+			eventType = eventhelper.RTCNtpDriftHigh
 		}
 
-		eventclient.AddEvent(eventclient.Event{
-			Timestamp: time.Now(),
-			Type:      eventType,
-			Details: map[string]interface{}{
-				"rtcDriftSecondsPerMonth": int(rtcDriftSecondsPerMonth),
-				"rtcDriftSeconds":         int(rtcDriftSeconds),
-				"integrity":               rtcIntegrity,
-			},
-		})
+		eventhelper.AddEvent(eventhelper.NewEvent(eventType, time.Now(), eventhelper.RTCDrift{
+			DriftSecondsPerMonth: int(rtcDriftSecondsPerMonth),
+			DriftSeconds:         int(rtcDriftSeconds),
+			Integrity:            rtcIntegrity,
+		}))
 	}
 	return nil
 }
@@ -140,13 +145,9 @@ func secondsToDuration(seconds float64) time.Duration {
 func (rtc *pcf8563) SetTime(newTime time.Time) error {
 	rtcTime, integrity, err := rtc.GetTime()
 	if !integrity {
-		eventclient.AddEvent(eventclient.Event{
-			Timestamp: time.Now(),
-			Type:      "rtcIntegrityLost",
-			Details: map[string]interface{}{
-				"rtcTime": rtcTime.Format("2006-01-02 15:04:05"),
-			},
-		})
+		eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.RTCIntegrityLost, time.Now(), eventhelper.RTCIntegrity{
+			RTCTime: rtcTime.Format("2006-01-02 15:04:05"),
+		}))
 	}
 	if err != nil {
 		return err
@@ -156,16 +157,7 @@ func (rtc *pcf8563) SetTime(newTime time.Time) error {
 	}
 
 	newTime = newTime.UTC().Truncate(time.Second)
-	err = writeBytes([]byte{
-		0x02,
-		toBCD(newTime.Second()),
-		toBCD(newTime.Minute()),
-		toBCD(newTime.Hour()),
-		toBCD(newTime.Day()),
-		toBCD(int(newTime.Weekday())),
-		toBCD(int(newTime.Month())),
-		toBCD(newTime.Year() % 100)}) // PCF8563 RTC is only 2-digit year
-	if err != nil {
+	if err := writeTime(newTime); err != nil {
 		return err
 	}
 
@@ -192,25 +184,61 @@ func (rtc *pcf8563) SetTime(newTime time.Time) error {
 	return nil
 }
 
-func (rtc *pcf8563) SetSystemTime() error {
+// writeTime writes the time registers.
+func writeTime(t time.Time) error {
+	t = t.UTC()
+	return writeBytes([]byte{
+		0x02,
+		toBCD(t.Second()),
+		toBCD(t.Minute()),
+		toBCD(t.Hour()),
+		toBCD(t.Day()),
+		toBCD(int(t.Weekday())),
+		toBCD(int(t.Month())),
+		toBCD(t.Year() % 100)}) // PCF8563 RTC is only 2-digit year
+}
+
+// SetSystemTime sets the system clock from the RTC, unless NTP has already set it or the RTC
+// time is suspicious. alternate is the source that will set the clock instead of a suspicious
+// RTC, empty if there isn't one.
+func (rtc *pcf8563) SetSystemTime(guard timeGuardConfig, alternate string) error {
+	if synced, err := ntpSynchronized(); err != nil {
+		log.Println(err)
+	} else if synced {
+		log.Println("System clock is synchronised with NTP, not setting it from the RTC.")
+		return nil
+	}
 	now, integrity, err := rtc.GetTime()
 	if err != nil {
 		return err
 	}
 	if !integrity {
-		eventclient.AddEvent(eventclient.Event{
-			Timestamp: time.Now(),
-			Type:      "rtcIntegrityError",
-		})
+		eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.RTCIntegrityError, time.Now(), eventhelper.RTCIntegrity{}))
 		return fmt.Errorf("rtc clock does't have integrity  RTC time is %s", now.Format(time.DateTime))
 	}
-	if now.Before(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)) {
-		// TODO make wrong RTC time event to report to user.
-		log.Println("RTC time is before 2023, not writing to system clock.")
+	systemTime := time.Now()
+	lastWrite, _ := lastRTCWriteTime()
+	if reason := guard.suspiciousReason(now, systemTime, lastWrite, earliestValidTime()); reason != "" {
+		log.Printf("%s, not writing to system clock.", reason)
+		payload := eventhelper.RTCSuspiciousTime{
+			RTCTime:         now.Format(time.DateTime),
+			SystemTime:      systemTime.UTC().Format(time.DateTime),
+			Reason:          reason,
+			AlternateSource: alternate,
+		}
+		if !lastWrite.IsZero() {
+			payload.LastRTCWriteTime = lastWrite.Format(time.DateTime)
+		}
+		eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.SuspiciousRTCTime, systemTime, payload))
 		return nil
 	}
 
-	timeStr := now.Format(time.DateTime)
+	return setSystemClock(now)
+}
+
+// setSystemClock sets the system clock to the time.
+func setSystemClock(now time.Time) error {
+	timeStr := now.UTC().Format(time.DateTime)
 
 	before, err := time.Parse(time.DateTime, time.Now().Format(time.DateTime))
 	if err != nil {
@@ -380,7 +408,7 @@ func toBCD(n int) byte {
 
 // writeBytes writes the given bytes to the I2C device.
 func writeBytes(data []byte) error {
-	_, err := i2crequest.Tx(pcf8563Address, data, 0, 1000)
+	_, err := i2crequest.TxContext(serviceCtx, pcf8563Address, data, 0)
 	return err
 }
 
@@ -390,7 +418,7 @@ func fromBCD(b byte) int {
 
 // readByte reads a byte from the I2C device from a given register.
 func readByte(register byte) (byte, error) {
-	response, err := i2crequest.Tx(pcf8563Address, []byte{register}, 1, 1000)
+	response, err := i2crequest.TxContext(serviceCtx, pcf8563Address, []byte{register}, 1)
 	if err != nil {
 		return 0, err
 	}
@@ -404,5 +432,5 @@ func writeByte(register byte, data byte) error {
 
 // readBytes reads bytes from the I2C device starting from a given register.
 func readBytes(register byte, length int) ([]byte, error) {
-	return i2crequest.Tx(pcf8563Address, []byte{register}, length, 1000)
+	return i2crequest.TxContext(serviceCtx, pcf8563Address, []byte{register}, length)
 }
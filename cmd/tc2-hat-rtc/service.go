@@ -24,8 +24,11 @@ import (
 	"strings"
 	"time"
 
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusapi"
+	"github.com/TheCacophonyProject/tc2-hat-controller/dbusauth"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
 	"github.com/godbus/dbus"
-	"github.com/godbus/dbus/introspect"
 )
 
 const (
@@ -33,8 +36,15 @@ const (
 	dbusPath = "/org/cacophony/RTC"
 )
 
+// api is the version and capabilities of the D-Bus API, see the dbusapi package.
+var api = dbusapi.API{
+	Version:      1,
+	Capabilities: []string{"getTime", "setTime"},
+}
+
 type rtcService struct {
-	rtc *pcf8563
+	rtc  *pcf8563
+	auth *dbusauth.Authorizer
 }
 
 func startRTCService(a *pcf8563) error {
@@ -51,11 +61,11 @@ func startRTCService(a *pcf8563) error {
 	}
 
 	s := &rtcService{
-		rtc: a,
+		rtc:  a,
+		auth: dbusauth.Load(conn, dbusName, standalone.ConfigDirOr(goconfig.DefaultConfigDir)),
 	}
-	conn.Export(s, dbusPath, dbusName)
-	conn.Export(genIntrospectable(s), dbusPath, "org.freedesktop.DBus.Introspectable")
-	return nil
+	_, err = dbusapi.Export(conn, s, dbusPath, dbusName, api, nil)
+	return err
 }
 
 func (s rtcService) GetTime() (string, bool, *dbus.Error) {
@@ -67,7 +77,10 @@ func (s rtcService) GetTime() (string, bool, *dbus.Error) {
 	return t.Format("2006-01-02T15:04:05Z07:00"), integrity, nil
 }
 
-func (s rtcService) SetTime(timeStr string) *dbus.Error {
+func (s rtcService) SetTime(sender dbus.Sender, timeStr string) *dbus.Error {
+	if err := s.auth.Check(sender, "SetTime"); err != nil {
+		return err
+	}
 	t, err := time.Parse("2006-01-02T15:04:05Z07:00", timeStr)
 	if err != nil {
 		log.Println(err)
@@ -80,16 +93,6 @@ func (s rtcService) SetTime(timeStr string) *dbus.Error {
 	return nil
 }
 
-func genIntrospectable(v interface{}) introspect.Introspectable {
-	node := &introspect.Node{
-		Interfaces: []introspect.Interface{{
-			Name:    dbusName,
-			Methods: introspect.Methods(v),
-		}},
-	}
-	return introspect.NewIntrospectable(node)
-}
-
 func dbusErr(err error) *dbus.Error {
 	if err == nil {
 		return nil
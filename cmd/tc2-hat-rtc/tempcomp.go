@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+)
+
+// The PCF8563 has no temperature compensation, its tuning fork crystal runs slow as the
+// temperature moves away from the turnover temperature, by about 0.034ppm/°C². At 0°C that
+// is almost 2 seconds a day, which adds up over a long period without NTP. The temperature
+// logged by tc2-hat-temp is used to estimate the drift and the RTC is moved forward a second
+// at a time as the estimated error builds up.
+//
+// The state is saved so the time the device is off is also compensated for on the next
+// start, using the last temperature as the temperature while it was off. Compensation is
+// reset while NTP is synchronised, as the RTC is then set from the system clock.
+//
+//	[rtc-temp-compensation]
+//	enable = true
+//	turnover-temp = 25.0
+//	coefficient = 0.034
+//	interval = "10m"
+const (
+	tempCompConfigKey   = "rtc-temp-compensation"
+	tempCompStateFile   = "/etc/cacophony/rtc-temp-compensation.json"
+	temperatureCSVFile  = "/var/log/temperature.csv"
+	maxTempReadingAge   = time.Hour
+	maxCompensatePeriod = 90 * 24 * time.Hour
+)
+
+type tempCompConfig struct {
+	Enable       bool          `mapstructure:"enable"`
+	TurnoverTemp float64       `mapstructure:"turnover-temp"`
+	Coefficient  float64       `mapstructure:"coefficient"` // ppm/°C²
+	Interval     time.Duration `mapstructure:"interval"`
+}
+
+func defaultTempCompConfig() tempCompConfig {
+	return tempCompConfig{
+		TurnoverTemp: 25,
+		Coefficient:  0.034,
+		Interval:     10 * time.Minute,
+	}
+}
+
+func loadTempCompConfig(configDir string) (tempCompConfig, error) {
+	c := defaultTempCompConfig()
+	conf, err := goconfig.New(configDir)
+	if err != nil {
+		return c, err
+	}
+	if err := configcompat.Unmarshal(conf, tempCompConfigKey, &c); err != nil {
+		return c, err
+	}
+	if c.Interval < time.Minute {
+		return c, fmt.Errorf("%s interval must be at least a minute", tempCompConfigKey)
+	}
+	return c, nil
+}
+
+// driftPPM returns the frequency error of the crystal at the temperature, negative is slow.
+func (c tempCompConfig) driftPPM(temp float64) float64 {
+	d := temp - c.TurnoverTemp
+	return -c.Coefficient * d * d
+}
+
+// tempCompState is saved between updates. Offset is the estimated error of the RTC that
+// hasn't been corrected yet, negative if the RTC is behind.
+type tempCompState struct {
+	Updated   time.Time `json:"updated"` // RTC time.
+	Temp      float64   `json:"temp"`
+	Offset    float64   `json:"offsetSeconds"`
+	Corrected int       `json:"correctedSeconds"` // Since NTP was last synchronised.
+}
+
+type compRTC interface {
+	GetTime() (time.Time, bool, error)
+	AdjustTime(seconds int) error
+}
+
+type tempCompensator struct {
+	config    tempCompConfig
+	file      string
+	rtc       compRTC
+	readTemp  func() (float64, error)
+	ntpSynced func() (bool, error)
+
+	state tempCompState
+}
+
+func newTempCompensator(c tempCompConfig, rtc compRTC) *tempCompensator {
+	t := &tempCompensator{
+		config:    c,
+		file:      tempCompStateFile,
+		rtc:       rtc,
+		readTemp:  func() (float64, error) { return readLastTemperature(temperatureCSVFile, time.Now()) },
+		ntpSynced: ntpSynchronized,
+	}
+	data, err := os.ReadFile(t.file)
+	if err == nil {
+		err = json.Unmarshal(data, &t.state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read RTC temperature compensation state, starting again: %v", err)
+		t.state = tempCompState{}
+	}
+	return t
+}
+
+// update adds the drift since the last update to the offset and corrects the RTC once the
+// offset is a second or more.
+func (t *tempCompensator) update() error {
+	now, integrity, err := t.rtc.GetTime()
+	if err != nil {
+		return err
+	}
+	if !integrity {
+		t.state = tempCompState{}
+		return fmt.Errorf("RTC doesn't have integrity, not compensating")
+	}
+	temp, err := t.readTemp()
+	if err != nil {
+		if t.state.Updated.IsZero() {
+			return fmt.Errorf("no temperature reading: %v", err)
+		}
+		log.Debugf("Using last temperature %.1f°C: %v", t.state.Temp, err)
+		temp = t.state.Temp
+	}
+
+	synced, err := t.ntpSynced()
+	if err != nil {
+		log.Printf("Failed to check NTP status: %v", err)
+	}
+	elapsed := now.Sub(t.state.Updated)
+	switch {
+	case synced:
+		t.state.Offset = 0
+		t.state.Corrected = 0
+	case t.state.Updated.IsZero() || elapsed < 0 || elapsed > maxCompensatePeriod:
+		// First update, or the RTC has been set since the last one.
+		t.state.Offset = 0
+	default:
+		// Use the average temperature for the time since the last update.
+		ppm := t.config.driftPPM((t.state.Temp + temp) / 2)
+		t.state.Offset += ppm * 1e-6 * elapsed.Seconds()
+	}
+
+	if seconds := -int(t.state.Offset); seconds != 0 {
+		log.Printf("Adjusting RTC by %ds for temperature drift", seconds)
+		if err := t.rtc.AdjustTime(seconds); err != nil {
+			return err
+		}
+		t.state.Offset += float64(seconds)
+		t.state.Corrected += seconds
+		now = now.Add(time.Duration(seconds) * time.Second)
+	}
+	t.state.Updated = now
+	t.state.Temp = temp
+	return t.save()
+}
+
+func (t *tempCompensator) save() error {
+	data, err := json.Marshal(t.state)
+	if err != nil {
+		return err
+	}
+	tmpFile := t.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.file)
+}
+
+// run updates the compensation every interval.
+func (t *tempCompensator) run() {
+	log.Printf("Compensating RTC for temperature, turnover %.1f°C, coefficient %.3fppm/°C²",
+		t.config.TurnoverTemp, t.config.Coefficient)
+	for {
+		if err := t.update(); err != nil {
+			log.Printf("RTC temperature compensation: %v", err)
+		}
+		time.Sleep(t.config.Interval)
+	}
+}
+
+// readLastTemperature returns the last temperature in the CSV file from tc2-hat-temp.
+func readLastTemperature(file string, now time.Time) (float64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	fields := strings.Split(lines[len(lines)-1], ",")
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("no temperature readings in %s", file)
+	}
+	t, err := csvtime.Parse(fields[0])
+	if err != nil {
+		return 0, err
+	}
+	if now.Sub(t) > maxTempReadingAge {
+		return 0, fmt.Errorf("last temperature reading is from %s", t.Format(time.DateTime))
+	}
+	temp, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(temp) {
+		return 0, fmt.Errorf("invalid temperature reading")
+	}
+	return temp, nil
+}
+
+// AdjustTime moves the RTC time by the given seconds. Writing the time resets the divider
+// chain, so it is written just after the seconds change to keep the fraction of a second.
+func (rtc *pcf8563) AdjustTime(seconds int) error {
+	start, _, err := rtc.GetTime()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for {
+		now, _, err := rtc.GetTime()
+		if err != nil {
+			return err
+		}
+		if !now.Equal(start) {
+			return writeTime(now.Add(time.Duration(seconds) * time.Second))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("RTC seconds didn't change")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
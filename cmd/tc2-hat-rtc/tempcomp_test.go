@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCompRTC struct {
+	now      time.Time
+	adjusted []int
+}
+
+func (r *fakeCompRTC) GetTime() (time.Time, bool, error) {
+	return r.now, true, nil
+}
+
+func (r *fakeCompRTC) AdjustTime(seconds int) error {
+	r.adjusted = append(r.adjusted, seconds)
+	r.now = r.now.Add(time.Duration(seconds) * time.Second)
+	return nil
+}
+
+func newTestCompensator(t *testing.T, rtc *fakeCompRTC, temp float64, synced bool) *tempCompensator {
+	return &tempCompensator{
+		config:    defaultTempCompConfig(),
+		file:      filepath.Join(t.TempDir(), "state.json"),
+		rtc:       rtc,
+		readTemp:  func() (float64, error) { return temp, nil },
+		ntpSynced: func() (bool, error) { return synced, nil },
+	}
+}
+
+func TestDriftPPM(t *testing.T) {
+	c := defaultTempCompConfig()
+	assert.Equal(t, 0.0, c.driftPPM(25))
+	assert.InDelta(t, -21.25, c.driftPPM(0), 1e-9)
+	assert.Equal(t, c.driftPPM(15), c.driftPPM(35))
+}
+
+func TestTempCompensation(t *testing.T) {
+	rtc := &fakeCompRTC{now: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)}
+	c := newTestCompensator(t, rtc, 0, false)
+	assert.NoError(t, c.update())
+
+	// At 0°C the RTC loses about 1.84s a day.
+	for i := 0; i < 24*6; i++ {
+		rtc.now = rtc.now.Add(10 * time.Minute)
+		assert.NoError(t, c.update())
+	}
+	assert.Equal(t, []int{1}, rtc.adjusted)
+	assert.Equal(t, 1, c.state.Corrected)
+	assert.InDelta(t, -0.84, c.state.Offset, 0.01)
+	_, err := os.Stat(c.file)
+	assert.NoError(t, err)
+
+	// The offset is reset while NTP is synchronised.
+	c.ntpSynced = func() (bool, error) { return true, nil }
+	rtc.now = rtc.now.Add(10 * time.Minute)
+	assert.NoError(t, c.update())
+	assert.Equal(t, 0.0, c.state.Offset)
+	assert.Equal(t, 0, c.state.Corrected)
+}
+
+func TestTempCompensationIgnoresClockJumps(t *testing.T) {
+	rtc := &fakeCompRTC{now: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)}
+	c := newTestCompensator(t, rtc, 0, false)
+	assert.NoError(t, c.update())
+	rtc.now = rtc.now.Add(-time.Hour)
+	assert.NoError(t, c.update())
+	rtc.now = rtc.now.Add(365 * 24 * time.Hour)
+	assert.NoError(t, c.update())
+	assert.Empty(t, rtc.adjusted)
+}
+
+func TestReadLastTemperature(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "temperature.csv")
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.Local)
+	data := "2026-06-01 11:40:00, 10.50, 80.00\n2026-06-01 11:50:00, 11.25, 79.00\n"
+	assert.NoError(t, os.WriteFile(file, []byte(data), 0644))
+
+	temp, err := readLastTemperature(file, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 11.25, temp)
+
+	_, err = readLastTemperature(file, now.Add(2*time.Hour))
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+)
+
+// The system clock is set from the RTC at startup, unless the RTC time is obviously wrong,
+// such as 2001 after the RTC briefly lost power:
+//
+//	[rtc-time-guard]
+//	max-backwards = "10m"
+//
+// The RTC time isn't used if it is before the build date of this binary, before the time the
+// RTC was last set, or would move the system clock back by more than max-backwards. A
+// suspiciousRtcTime event is made instead. The RTC isn't used at all when NTP has already
+// synchronised the system clock, and when the GPS is enabled it sets the clock once it has a fix.
+const timeGuardConfigKey = "rtc-time-guard"
+
+// earliestTime is the earliest plausible time when the build date isn't set.
+var earliestTime = time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type timeGuardConfig struct {
+	MaxBackwards time.Duration `mapstructure:"max-backwards"`
+}
+
+func defaultTimeGuardConfig() timeGuardConfig {
+	return timeGuardConfig{MaxBackwards: 10 * time.Minute}
+}
+
+func loadTimeGuardConfig(configDir string) (timeGuardConfig, error) {
+	c := defaultTimeGuardConfig()
+	conf, err := goconfig.New(configDir)
+	if err != nil {
+		return c, err
+	}
+	if err := configcompat.Unmarshal(conf, timeGuardConfigKey, &c); err != nil {
+		return defaultTimeGuardConfig(), err
+	}
+	if c.MaxBackwards < 0 {
+		return defaultTimeGuardConfig(), fmt.Errorf("%s max-backwards can't be negative", timeGuardConfigKey)
+	}
+	return c, nil
+}
+
+// earliestValidTime returns the build date of the binary, or earliestTime if it isn't set.
+func earliestValidTime() time.Time {
+	if t, err := time.Parse(time.RFC3339, buildDate); err == nil && t.After(earliestTime) {
+		return t
+	}
+	return earliestTime
+}
+
+// lastRTCWriteTime returns the time the RTC was last set, ok is false if it isn't known.
+func lastRTCWriteTime() (time.Time, bool) {
+	data, err := os.ReadFile(lastRtcWriteTimeFile)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.DateTime, string(data))
+	return t, err == nil
+}
+
+// suspiciousReason returns why the RTC time shouldn't be used to set the system clock, an
+// empty string if it can be. lastWrite is zero if it isn't known.
+func (c timeGuardConfig) suspiciousReason(rtcTime, systemTime, lastWrite, earliest time.Time) string {
+	switch {
+	case rtcTime.Before(earliest):
+		return fmt.Sprintf("RTC time is before %s", earliest.Format(time.DateOnly))
+	case !lastWrite.IsZero() && rtcTime.Before(lastWrite.Add(-c.MaxBackwards)):
+		return fmt.Sprintf("RTC time is before it was last set at %s", lastWrite.Format(time.DateTime))
+	case systemTime.Sub(rtcTime) > c.MaxBackwards:
+		return fmt.Sprintf("RTC time would move the system clock back by %s", systemTime.Sub(rtcTime).Round(time.Second))
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuspiciousRTCTime(t *testing.T) {
+	c := defaultTimeGuardConfig()
+	earliest := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	system := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	lastWrite := time.Date(2024, 5, 20, 8, 0, 0, 0, time.UTC)
+
+	// Later than the system clock, after it was restored from the last shutdown.
+	assert.Empty(t, c.suspiciousReason(system.Add(3*time.Hour), system, lastWrite, earliest))
+	assert.Empty(t, c.suspiciousReason(system.Add(-5*time.Minute), system, lastWrite, earliest))
+	assert.Empty(t, c.suspiciousReason(system.Add(3*time.Hour), system, time.Time{}, earliest))
+
+	assert.Contains(t, c.suspiciousReason(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC), system, lastWrite, earliest), "before 2024-03-01")
+	assert.Contains(t, c.suspiciousReason(lastWrite.Add(-time.Hour), time.Time{}, lastWrite, earliest), "last set")
+	assert.Contains(t, c.suspiciousReason(system.Add(-time.Hour), system, lastWrite, earliest), "back by 1h0m0s")
+}
+
+func TestEarliestValidTime(t *testing.T) {
+	defer func(d string) { buildDate = d }(buildDate)
+	buildDate = ""
+	assert.Equal(t, earliestTime, earliestValidTime())
+	buildDate = "2024-03-01T10:00:00Z"
+	assert.Equal(t, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), earliestValidTime())
+}
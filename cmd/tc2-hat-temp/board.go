@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/boardconfig"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
+)
+
+// boardCSVFile is where the readings from the sensor on an expansion board are saved.
+func boardCSVFile(board string) string {
+	return fmt.Sprintf("/var/log/temperature-%s.csv", board)
+}
+
+// loadBoardSensor returns the address of the temperature sensor on an expansion board,
+// checking the board is connected.
+func loadBoardSensor(board string) (byte, error) {
+	config, err := goconfig.New(standalone.ConfigDirOr(goconfig.DefaultConfigDir))
+	if err != nil {
+		return 0, exitcode.Wrap(exitcode.Usage, err)
+	}
+	boardConfig, err := boardconfig.Get(config, board)
+	if err != nil {
+		return 0, exitcode.Wrap(exitcode.Usage, err)
+	}
+	if boardConfig.TempSensorAddress == 0 {
+		return 0, exitcode.Wrap(exitcode.Usage, fmt.Errorf("no temp-sensor-address configured for board '%s'", board))
+	}
+	eepromAddress, err := eeprom.BoardAddress(board)
+	if err != nil {
+		return 0, exitcode.Wrap(exitcode.Usage, err)
+	}
+	if _, err := eeprom.ReadBoard(eepromAddress); err != nil {
+		return 0, exitcode.Wrap(exitcode.HardwareMissing, err)
+	}
+	return byte(boardConfig.TempSensorAddress), nil
+}
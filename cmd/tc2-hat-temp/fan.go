@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/host/v3"
+)
+
+// Some enclosures have a small fan, driven from a GPIO with PWM. The fan turns on at on-temp
+// and off again at off-temp, and in between its speed goes from min-duty at on-temp up to
+// max-duty at full-temp. When the battery is low the speed is limited so the fan doesn't
+// flatten it:
+//
+//	[fan]
+//	enable = true
+//	pin = "GPIO18"
+//	frequency = 25000
+//	on-temp = 45
+//	off-temp = 40
+//	full-temp = 55
+//	min-duty = 40
+//	max-duty = 100
+//	low-battery-percent = 20
+//	low-battery-max-duty = 0
+//
+// The temperatures are in Celsius and the duties are percentages. A frequency of 0 switches
+// the fan on and off without PWM. How long the fan ran is reported each day with a
+// fanDailySummary event.
+const (
+	fanConfigKey        = "fan"
+	fanSummaryInterval  = 24 * time.Hour
+	defaultFanFrequency = 25000 // Hz, the PWM frequency of most 4 wire fans.
+)
+
+type fanConfig struct {
+	Enable            bool    `mapstructure:"enable"`
+	Pin               string  `mapstructure:"pin"`
+	Frequency         int     `mapstructure:"frequency"`
+	OnTemp            float32 `mapstructure:"on-temp"`
+	OffTemp           float32 `mapstructure:"off-temp"`
+	FullTemp          float32 `mapstructure:"full-temp"`
+	MinDuty           float64 `mapstructure:"min-duty"`
+	MaxDuty           float64 `mapstructure:"max-duty"`
+	LowBatteryPercent float64 `mapstructure:"low-battery-percent"`
+	LowBatteryMaxDuty float64 `mapstructure:"low-battery-max-duty"`
+}
+
+func defaultFanConfig() fanConfig {
+	return fanConfig{
+		Pin:               "GPIO18",
+		Frequency:         defaultFanFrequency,
+		OnTemp:            45,
+		OffTemp:           40,
+		FullTemp:          55,
+		MinDuty:           40,
+		MaxDuty:           100,
+		LowBatteryPercent: 20,
+	}
+}
+
+// loadFanConfig returns the fan config, the fan isn't enabled if there is no config.
+func loadFanConfig(config *goconfig.Config) (fanConfig, error) {
+	c := defaultFanConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, fanConfigKey, &c); err != nil {
+		return defaultFanConfig(), err
+	}
+	switch {
+	case c.OffTemp >= c.OnTemp:
+		return defaultFanConfig(), fmt.Errorf("%s off-temp must be below on-temp", fanConfigKey)
+	case c.FullTemp < c.OnTemp:
+		return defaultFanConfig(), fmt.Errorf("%s full-temp can't be below on-temp", fanConfigKey)
+	case c.MinDuty < 0 || c.MinDuty > c.MaxDuty || c.MaxDuty > 100:
+		return defaultFanConfig(), fmt.Errorf("%s duties must be from 0 to 100 with min-duty below max-duty", fanConfigKey)
+	case c.LowBatteryMaxDuty < 0 || c.LowBatteryMaxDuty > 100:
+		return defaultFanConfig(), fmt.Errorf("%s low-battery-max-duty must be from 0 to 100", fanConfigKey)
+	}
+	return c, nil
+}
+
+// fanStats is how the fan has run since the last summary.
+type fanStats struct {
+	runTime        time.Duration
+	dutyTime       float64 // Seconds at full speed the run time is equivalent to.
+	starts         int
+	batteryLimited time.Duration
+	maxTemp        float32
+}
+
+// fanController sets the fan speed from the temperature. A nil fanController doesn't do
+// anything, so it can be used when there is no fan.
+type fanController struct {
+	config         fanConfig
+	setDuty        func(percent float64) error
+	batteryPercent func() (float64, bool)
+	now            func() time.Time
+
+	on           bool
+	duty         float64
+	limited      bool
+	lastUpdate   time.Time
+	stats        fanStats
+	summaryStart time.Time
+}
+
+func newFanController(c fanConfig, setDuty func(float64) error, batteryPercent func() (float64, bool)) *fanController {
+	return &fanController{
+		config:         c,
+		setDuty:        setDuty,
+		batteryPercent: batteryPercent,
+		now:            time.Now,
+	}
+}
+
+// startFan returns the fan controller for the config, nil if the fan isn't enabled.
+func startFan(c fanConfig, batteryPercent func() (float64, bool)) (*fanController, error) {
+	if !c.Enable {
+		return nil, nil
+	}
+	if _, err := host.Init(); err != nil {
+		return nil, err
+	}
+	pin := gpioreg.ByName(c.Pin)
+	if pin == nil {
+		return nil, fmt.Errorf("failed to find fan pin '%s'", c.Pin)
+	}
+	frequency := physic.Frequency(c.Frequency) * physic.Hertz
+	setDuty := func(percent float64) error {
+		switch {
+		case percent <= 0:
+			return pin.Out(gpio.Low)
+		case c.Frequency <= 0 || percent >= 100:
+			return pin.Out(gpio.High)
+		default:
+			return pin.PWM(gpio.Duty(percent/100*float64(gpio.DutyMax)), frequency)
+		}
+	}
+	if err := setDuty(0); err != nil {
+		return nil, err
+	}
+	log.Infof("Controlling fan on %s, on at %.1fC and off at %.1fC", c.Pin, c.OnTemp, c.OffTemp)
+	return newFanController(c, setDuty, batteryPercent), nil
+}
+
+// wantedDuty returns if the fan should be on for the temperature, the duty, and if the duty
+// was limited by the battery.
+func (f *fanController) wantedDuty(temp float32) (on bool, duty float64, limited bool) {
+	c := f.config
+	on = f.on
+	if !on && temp >= c.OnTemp {
+		on = true
+	} else if on && temp <= c.OffTemp {
+		on = false
+	}
+	if !on {
+		return false, 0, false
+	}
+	duty = c.MaxDuty
+	if temp < c.FullTemp {
+		// Below on-temp while cooling down the fan keeps running at min-duty.
+		fraction := max(0, float64(temp-c.OnTemp)/float64(c.FullTemp-c.OnTemp))
+		duty = c.MinDuty + (c.MaxDuty-c.MinDuty)*fraction
+	}
+	if percent, ok := f.batteryPercent(); ok && percent <= c.LowBatteryPercent && duty > c.LowBatteryMaxDuty {
+		return true, c.LowBatteryMaxDuty, true
+	}
+	return true, duty, false
+}
+
+// update sets the fan speed for a new temperature reading, reporting the daily summary when
+// it is due.
+func (f *fanController) update(temp float32) {
+	if f == nil {
+		return
+	}
+	now := f.now()
+	f.addRunTime(now)
+	if f.summaryStart.IsZero() {
+		f.summaryStart = now
+		f.stats.maxTemp = temp
+	}
+	f.stats.maxTemp = max(f.stats.maxTemp, temp)
+
+	// The fan stays on when limited to a duty of 0, so it starts again when the battery
+	// is charged without waiting for on-temp.
+	on, duty, limited := f.wantedDuty(temp)
+	f.on = on
+	if limited != f.limited {
+		if limited {
+			log.Infof("Battery is low, limiting the fan to %.0f%%", duty)
+		}
+		f.limited = limited
+	}
+	if duty != f.duty {
+		if err := f.setDuty(duty); err != nil {
+			log.Errorf("Failed to set the fan speed: %v", err)
+		} else {
+			if f.duty == 0 {
+				log.Infof("Fan on at %.1fC", temp)
+				f.stats.starts++
+			} else if duty == 0 {
+				log.Infof("Fan off at %.1fC", temp)
+			}
+			f.duty = duty
+		}
+	}
+	if now.Sub(f.summaryStart) >= fanSummaryInterval {
+		f.reportSummary(now, temp)
+	}
+}
+
+// addRunTime adds the time since the last update at the current speed to the stats.
+func (f *fanController) addRunTime(now time.Time) {
+	if !f.lastUpdate.IsZero() && now.After(f.lastUpdate) {
+		elapsed := now.Sub(f.lastUpdate)
+		if f.duty > 0 {
+			f.stats.runTime += elapsed
+			f.stats.dutyTime += elapsed.Seconds() * f.duty / 100
+		}
+		if f.limited {
+			f.stats.batteryLimited += elapsed
+		}
+	}
+	f.lastUpdate = now
+}
+
+func (f *fanController) reportSummary(now time.Time, temp float32) {
+	s := f.stats
+	averageDuty := 0.0
+	if s.runTime > 0 {
+		averageDuty = s.dutyTime / s.runTime.Seconds() * 100
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.FanDailySummary, now, eventhelper.FanSummary{
+		RunSeconds:            int(s.runTime.Seconds()),
+		AverageDuty:           averageDuty,
+		Starts:                s.starts,
+		BatteryLimitedSeconds: int(s.batteryLimited.Seconds()),
+		MaxTemp:               s.maxTemp,
+		PeriodSeconds:         int(now.Sub(f.summaryStart).Seconds()),
+	})); err != nil {
+		log.Errorf("Error adding fan summary event: %v", err)
+	}
+	f.stats = fanStats{maxTemp: temp}
+	f.summaryStart = now
+}
+
+// stop turns the fan off when the service stops.
+func (f *fanController) stop() {
+	if f == nil || f.duty == 0 {
+		return
+	}
+	if err := f.setDuty(0); err != nil {
+		log.Errorf("Failed to turn off the fan: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanHysteresis(t *testing.T) {
+	duty := 0.0
+	battery, batteryOK := 80.0, true
+	f := newFanController(defaultFanConfig(), func(d float64) error { duty = d; return nil },
+		func() (float64, bool) { return battery, batteryOK })
+	eventtest.Capture(t)
+
+	f.update(44)
+	assert.Equal(t, 0.0, duty)
+	f.update(45)
+	assert.Equal(t, 40.0, duty)
+	f.update(50)
+	assert.Equal(t, 70.0, duty)
+	f.update(60)
+	assert.Equal(t, 100.0, duty)
+	// Keeps running at the min duty until it is below off-temp.
+	f.update(42)
+	assert.Equal(t, 40.0, duty)
+	f.update(40)
+	assert.Equal(t, 0.0, duty)
+	f.update(44)
+	assert.Equal(t, 0.0, duty)
+
+	// Limited when the battery is low, starting again once it is charged.
+	battery = 15
+	f.update(50)
+	assert.Equal(t, 0.0, duty)
+	battery = 60
+	f.update(44)
+	assert.Equal(t, 40.0, duty)
+
+	// The battery isn't known.
+	batteryOK = false
+	battery = 15
+	f.update(60)
+	assert.Equal(t, 100.0, duty)
+}
+
+func TestFanDailySummary(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	f := newFanController(defaultFanConfig(), func(float64) error { return nil },
+		func() (float64, bool) { return 0, false })
+	f.now = func() time.Time { return now }
+
+	f.update(20)
+	now = now.Add(12 * time.Hour)
+	f.update(60)
+	now = now.Add(2 * time.Hour)
+	f.update(45)
+	now = now.Add(2 * time.Hour)
+	f.update(30)
+	assert.Empty(t, events.Events())
+	now = now.Add(8 * time.Hour)
+	f.update(25)
+	if assert.Len(t, events.Events(), 1) {
+		e := events.Events()[0]
+		assert.Equal(t, "fanDailySummary", e.Type)
+		assert.Equal(t, 4*60*60, e.Details["runSeconds"])
+		assert.InDelta(t, 70, e.Details["averageDuty"], 0.001)
+		assert.Equal(t, 1, e.Details["starts"])
+		assert.Equal(t, float32(60), e.Details["maxTemp"])
+	}
+
+	var nilFan *fanController
+	nilFan.update(60)
+	nilFan.stop()
+}
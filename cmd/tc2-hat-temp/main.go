@@ -19,19 +19,33 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
 	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/cadence"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvbuffer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/exitcode"
 	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
-	arg "github.com/alexflint/go-arg"
+	"github.com/TheCacophonyProject/tc2-hat-controller/instancelock"
+	"github.com/TheCacophonyProject/tc2-hat-controller/journal"
+	"github.com/TheCacophonyProject/tc2-hat-controller/livefeed"
+	"github.com/TheCacophonyProject/tc2-hat-controller/rainstate"
+	"github.com/TheCacophonyProject/tc2-hat-controller/readiness"
+	"github.com/TheCacophonyProject/tc2-hat-controller/selfmonitor"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
 	"github.com/sigurn/crc8"
 )
 
@@ -47,16 +61,25 @@ var version = "No version provided"
 
 var log = logging.NewLogger("info")
 
+// serviceCtx is cancelled when the service is asked to stop, so a hung I2C request doesn't
+// hold up stopping the service.
+var serviceCtx = context.Background()
+
 type argSpec struct {
-	LowTemp               int `arg:"--low-temp" help:"Temperatures below this will be reported as low"`
-	MinTemp               int `arg:"--min-temp" help:"Temperatures below this will result in powering off the system //TODO"` //TODO
-	HighTemp              int `arg:"--high-temp" help:"Temperatures above this will be reported as high"`
-	MaxTemp               int `arg:"--max-temp" help:"Temperatures above this will result is powering off the system //TODO"` //TODO
-	HighHumidity          int `arg:"--high-humidity" help:"Humidities above this will be reported as high"`
-	MaxHumidity           int `arg:"--max-humidity" help:"Humidities above this will result in powering off the system //TODO"` //TODO
-	SampleRateSeconds     int `arg:"--sample-rate" help:"Sample rate in seconds"`
-	LogRateMinutes        int `arg:"--log-rate" help:"Log rate in minutes"`
-	ReportIntervalMinutes int `arg:"--report-interval" help:"Max time between temperature reports in minutes"`
+	LowTemp               int     `arg:"--low-temp" help:"Temperatures below this will be reported as low"`
+	MinTemp               int     `arg:"--min-temp" help:"Temperatures below this will result in powering off the system //TODO"` //TODO
+	HighTemp              int     `arg:"--high-temp" help:"Temperatures above this will be reported as high"`
+	MaxTemp               int     `arg:"--max-temp" help:"Temperatures above this will result is powering off the system //TODO"` //TODO
+	HighHumidity          int     `arg:"--high-humidity" help:"Humidities above this will be reported as high"`
+	MaxHumidity           int     `arg:"--max-humidity" help:"Humidities above this will result in powering off the system //TODO"` //TODO
+	SampleRateSeconds     int     `arg:"--sample-rate" help:"Sample rate in seconds"`
+	LogRateMinutes        int     `arg:"--log-rate" help:"Log rate in minutes"`
+	ReportIntervalMinutes int     `arg:"--report-interval" help:"Max time between temperature reports in minutes"`
+	ExternalSensorAddress int     `arg:"--external-sensor-address" help:"I2C address of an external AHT20 compatible humidity probe, used for checking the enclosure seal"`
+	SealCorrelation       float64 `arg:"--seal-correlation" help:"Correlation between internal and external humidity above which the enclosure seal is reported as degraded"`
+	Board                 string  `arg:"--board" help:"Monitor the sensor on this expansion board, e.g. board1, instead of the main hat"`
+	TempSource            string  `arg:"--temp-source" help:"Where to read the temperature from: aht20, attiny (the reading cached by the ATtiny), soc (estimated from the RPi SoC) or auto to switch to the ATtiny, or the SoC, when the AHT20 can't be read"`
+	Replace               bool    `arg:"--replace" help:"Stop another running instance monitoring the same sensor and take over from it"`
 	logging.LogArgs
 }
 
@@ -75,15 +98,18 @@ func procArgs() argSpec {
 		SampleRateSeconds:     60,
 		LogRateMinutes:        5,
 		ReportIntervalMinutes: 120,
+		SealCorrelation:       0.8,
+		TempSource:            sourceAuto,
 	}
-	arg.MustParse(&args)
+	exitcode.MustParse(&args)
 	return args
 }
 
 func main() {
 	err := runMain()
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Error(err)
+		os.Exit(exitcode.Code(err))
 	}
 }
 
@@ -91,8 +117,12 @@ func runMain() error {
 	args := procArgs()
 
 	log = logging.NewLogger(args.LogLevel)
+	if args.SampleRateSeconds <= 0 {
+		return exitcode.Wrap(exitcode.Usage, fmt.Errorf("--sample-rate must be positive, not %d", args.SampleRateSeconds))
+	}
 
 	log.Info("Running version: ", version)
+	configcompat.SetBinary("tc2-hat-temp", version)
 
 	lastReportTime := time.Time{}
 	reportInterval := time.Duration(args.ReportIntervalMinutes) * time.Minute
@@ -104,105 +134,353 @@ func runMain() error {
 
 	sampleRateDuration := time.Duration(args.SampleRateSeconds) * time.Second
 
+	lockName := "tc2-hat-temp"
+	if args.Board != "" {
+		lockName += "-" + args.Board
+	}
+	if _, err := instancelock.Acquire(lockName, args.Replace); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serviceCtx = ctx
+	if err := readiness.Clear(lockName); err != nil {
+		log.Errorf("Failed to clear readiness: %v", err)
+	}
+	// The readings are saved with timestamps, so the RTC needs to have set the time first.
+	readiness.WaitFor(ctx, lockName, readiness.I2C, readiness.RTC)
+
+	csvFile := temperatureCSVFile
+	sensorAddress := byte(AHT20Address)
+	if args.Board != "" {
+		var err error
+		if sensorAddress, err = loadBoardSensor(args.Board); err != nil {
+			return err
+		}
+		csvFile = boardCSVFile(args.Board)
+		log.Infof("Monitoring sensor at 0x%X on %s", sensorAddress, args.Board)
+	}
+
 	// Limit the number of temperatures readings
-	if err := keepLastLines(temperatureCSVFile, maxTempReadings); err != nil {
+	if err := keepLastLines(csvFile, maxTempReadings); err != nil {
 		return err
 	}
 	trimTempFileTime := time.Now()
 
+	// Use a day of samples so the daily humidity cycle outside is included.
+	seal := newSealMonitor(int(24*time.Hour/sampleRateDuration), args.SealCorrelation)
+	if args.ExternalSensorAddress != 0 {
+		log.Infof("Checking enclosure seal with external sensor at 0x%X", args.ExternalSensorAddress)
+	}
+
+	cadenceConfig := cadence.DefaultConfig()
+	reporting := defaultReportingConfig()
+	journalConfig := journal.Config{}
+	fanConf := defaultFanConfig()
+	health := selfmonitor.DefaultConfig()
+	soc := defaultSoCConfig()
+	csvWrites := csvbuffer.DefaultConfig()
+	if config, err := goconfig.New(standalone.ConfigDirOr(goconfig.DefaultConfigDir)); err != nil {
+		log.Errorf("Failed to read config, using the default reporting cadence and units: %v", err)
+	} else {
+		if cadenceConfig, err = cadence.LoadConfig(config); err != nil {
+			log.Errorf("Failed to read reporting cadence config, using defaults: %v", err)
+		}
+		if reporting, err = loadReportingConfig(config); err != nil {
+			log.Errorf("Failed to read temperature reporting config, using defaults: %v", err)
+		}
+		if journalConfig, err = journal.LoadConfig(config); err != nil {
+			log.Errorf("Failed to read journal telemetry config: %v", err)
+		}
+		if fanConf, err = loadFanConfig(config); err != nil {
+			log.Errorf("Failed to read fan config, not controlling the fan: %v", err)
+		}
+		if health, err = selfmonitor.LoadConfig(config); err != nil {
+			log.Errorf("Failed to read service health config, using defaults: %v", err)
+		}
+		if soc, err = loadSoCConfig(config); err != nil {
+			log.Errorf("Failed to read SoC temperature config, using the default model: %v", err)
+		}
+		if csvWrites, err = csvbuffer.LoadConfig(config); err != nil {
+			log.Errorf("Failed to read CSV write config, using defaults: %v", err)
+		}
+	}
+	// Readings are written in batches to save wear on the SD card.
+	readings := csvbuffer.New(csvFile, "", csvWrites)
+	defer func() {
+		if err := readings.Flush(); err != nil {
+			log.Errorf("Failed to write readings to %s: %v", csvFile, err)
+		}
+	}()
+
+	// The ATtiny and SoC are only for the main hat.
+	var readATtiny, readSoC func() (sensorReading, error)
+	if args.Board == "" && args.TempSource != sourceAHT20 {
+		if args.TempSource != sourceSoC {
+			readATtiny = attinyTempReader()
+		}
+		if args.TempSource != sourceATtiny {
+			readSoC = socTempReader(soc, socThermalZone)
+		}
+	}
+	readAHT20 := func() (sensorReading, error) {
+		temp, humidity, err := readSensor(sensorAddress)
+		return sensorReading{temp: temp, humidity: humidity}, err
+	}
+	source, err := newTempSource(args.TempSource, readAHT20, readATtiny, readSoC)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Usage, err)
+	}
+	journalWriter := journal.New(journalConfig, lockName)
+	liveFeed := livefeed.New(lockName)
+	reportCadence := cadence.New(cadenceConfig)
+	lastLevel := cadence.Normal
+	selfmonitor.Start(lockName, health)
+	// The loop has stopped if it hasn't gone around in a few of the longest sample intervals.
+	loopMaxGap := 3*reportCadence.IntervalFor(cadence.Critical, sampleRateDuration) + time.Minute
+
+	// The fan is controlled from the sensor on the main hat.
+	var fan *fanController
+	if args.Board == "" {
+		if fan, err = startFan(fanConf, reportCadence.BatteryPercent); err != nil {
+			log.Errorf("Failed to start fan control: %v", err)
+		}
+		defer fan.stop()
+	}
+
+	if err := readiness.Announce(lockName); err != nil {
+		log.Errorf("Failed to announce readiness: %v", err)
+	}
+	faults := &sensorFaultDetector{}
+	saturation := newSaturationMonitor(sensorAddress, args.Board)
 	for {
+		selfmonitor.Beat("sensor", loopMaxGap)
+		// Sample and report less often when the battery is low.
+		level := reportCadence.Level()
+		if level != lastLevel {
+			log.Infof("Reporting cadence is now %s with the %s power profile, sampling every %s", level, reportCadence.ProfileFor(level), reportCadence.IntervalFor(level, sampleRateDuration))
+			lastLevel = level
+		}
+		sampleInterval := reportCadence.IntervalFor(level, sampleRateDuration)
+
 		if time.Since(trimTempFileTime) > 24*time.Hour {
-			if err := keepLastLines(temperatureCSVFile, maxTempReadings); err != nil {
+			if err := readings.Flush(); err != nil {
+				return err
+			}
+			if err := keepLastLines(csvFile, maxTempReadings); err != nil {
 				return err
 			}
 			trimTempFileTime = time.Now()
 		}
 
-		temp, humidity, crc, err := makeReading()
+		reading, readFrom, err := source.read()
+		if err != nil && ctx.Err() != nil {
+			log.Info("Stopping service")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		temp, humidity := reading.temp, reading.humidity
+
+		// Don't record or act on readings from a faulty sensor. Estimates aren't from a sensor.
+		if !reading.estimated {
+			if fault := faults.check(reading); fault != "" {
+				handleSensorFault(faults, fault, reading, sensorAddress, args.Board, reporting)
+				if !waitForNextSample(sampleInterval) {
+					return nil
+				}
+				continue
+			}
+			reading.suspect = saturation.check(reading)
+		}
 
-		// Some sensors don't have a working CRC so in that case we make multiple readings quickly and check that they are about the same.
-		if err == errBadCRC && crc == 0xFF {
+		fan.update(temp)
 
-			previousTemp := temp
-			previousHumidity := humidity
-			temp, humidity, crc, err = makeReading()
-			if err == errBadCRC && crc == 0xFF {
-				log.Debug("No CRC, checking with multiple readings")
-				if math.Abs(float64(temp-previousTemp)) > 1 || math.Abs(float64(humidity-previousHumidity)) > 1 {
-					log.Errorf("CRC failed, got 0X%X, temp: %.2f, humidity: %.2f", crc, temp, humidity)
-					return errBadCRC
-				}
-				// Values are close enough to previous reading so likely to be correct.
-			} else if err != nil {
-				log.Errorf("CRC failed got 0X%X, temp: %.2f, humidity: %.2f", crc, temp, humidity)
-				return err
+		if !reading.estimated && !reading.suspect {
+			if args.ExternalSensorAddress != 0 {
+				checkEnclosureSeal(seal, humidity, byte(args.ExternalSensorAddress), args.Board)
 			}
-		} else if err != nil {
-			return err
+			checkRainResponse(seal, humidity, args.Board)
 		}
 
-		if time.Since(lastLogTime) > logRate {
+		if reading.estimated {
+			log.Debugf("Temp estimated from the SoC: %.2f", temp)
+		} else if time.Since(lastLogTime) > logRate {
 			log.Infof("Temp: %.2f, Humidity: %.2f", temp, humidity)
 			lastLogTime = time.Now()
 		} else {
 			log.Debugf("Temp: %.2f, Humidity: %.2f", temp, humidity)
 		}
 
-		file, err := os.OpenFile(temperatureCSVFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-		if err != nil {
+		if err := readings.Write(reporting.readingCSVLine(time.Now(), reading)); err != nil {
 			return err
 		}
-		line := fmt.Sprintf("%s, %.2f, %.2f", time.Now().Format("2006-01-02 15:04:05"), temp, humidity)
-		_, err = file.WriteString(line + "\n")
-		if err != nil {
-			return err
+		if err := journalWriter.Send(fmt.Sprintf("Temp: %.2f, Humidity: %.2f", temp, humidity), journalFields(reading, readFrom, args.Board)); err != nil {
+			log.Debugf("Failed to send reading to the journal: %v", err)
 		}
-		if err := file.Close(); err != nil {
-			return err
+		if err := liveFeed.Send(livefeed.Temperature, livefeed.TemperatureSample{
+			Time:        time.Now(),
+			Board:       args.Board,
+			Temperature: temp,
+			Humidity:    humidity,
+			Estimated:   reading.estimated,
+		}); err != nil {
+			log.Debugf("Failed to send reading to the live feed: %v", err)
 		}
 
 		reportType := ""
 
-		if time.Since(lastReportTime) > reportInterval {
-			reportType = "tempHumidity"
+		if time.Since(lastReportTime) > reportCadence.IntervalFor(level, reportInterval) {
+			reportType = eventhelper.TempHumidity
 		}
 
 		if temp > float32(args.HighTemp) {
 			log.Info("Temp too high!")
-			reportType = "tempTooHigh"
+			reportType = eventhelper.TempTooHigh
 		}
 		if temp < float32(args.LowTemp) {
 			log.Info("Temp too low!")
-			reportType = "tempTooLow"
+			reportType = eventhelper.TempTooLow
 		}
 		if humidity > float32(args.HighHumidity) {
 			log.Info("Humidity too high!")
-			reportType = "humidityTooHigh"
+			reportType = eventhelper.HumidityTooHigh
 		}
 
 		if reportType != "" {
 			log.Println("Reporting", reportType)
-			err := eventclient.AddEvent(eventclient.Event{
-				Timestamp: time.Now(),
-				Type:      reportType,
-				Details: map[string]interface{}{
-					"temp":     temp,
-					"humidity": humidity,
-				},
-			})
+			err := eventhelper.AddEvent(eventhelper.NewEvent(reportType, time.Now(), reporting.tempReading(reading, readFrom, args.Board)))
 			if err != nil {
 				return err
 			}
 			lastReportTime = time.Now()
 		}
 
-		time.Sleep(sampleRateDuration)
+		if !waitForNextSample(sampleInterval) {
+			return nil
+		}
+	}
+}
+
+// waitForNextSample waits for the sample interval, returning false if the service is stopping.
+func waitForNextSample(interval time.Duration) bool {
+	select {
+	case <-time.After(interval):
+		return true
+	case <-serviceCtx.Done():
+		log.Info("Stopping service")
+		return false
+	}
+}
+
+// journalFields returns the journal fields for the reading, the temperature is in Celsius
+// like the CSV file.
+func journalFields(r sensorReading, source, board string) map[string]string {
+	fields := map[string]string{
+		"TEMP":        fmt.Sprintf("%.2f", r.temp),
+		"HUM":         fmt.Sprintf("%.2f", r.humidity),
+		"TEMP_SOURCE": source,
+	}
+	if r.estimated {
+		delete(fields, "HUM")
+		fields["TEMP_ESTIMATED"] = "1"
+	}
+	if r.suspect {
+		fields["HUM_SUSPECT"] = "1"
+	}
+	if board != "" {
+		fields["BOARD"] = board
+	}
+	return fields
+}
+
+// readSensor reads the temperature and humidity from the AHT20 sensor at the given address.
+func readSensor(address byte) (float32, float32, error) {
+	temp, humidity, crc, err := makeReading(address)
+
+	// Some sensors don't have a working CRC so in that case we make multiple readings quickly and check that they are about the same.
+	if err == errBadCRC && crc == 0xFF {
+
+		previousTemp := temp
+		previousHumidity := humidity
+		temp, humidity, crc, err = makeReading(address)
+		if err == errBadCRC && crc == 0xFF {
+			log.Debug("No CRC, checking with multiple readings")
+			if math.Abs(float64(temp-previousTemp)) > 1 || math.Abs(float64(humidity-previousHumidity)) > 1 {
+				log.Errorf("CRC failed, got 0X%X, temp: %.2f, humidity: %.2f", crc, temp, humidity)
+				return 0, 0, errBadCRC
+			}
+			// Values are close enough to previous reading so likely to be correct.
+		} else if err != nil {
+			log.Errorf("CRC failed got 0X%X, temp: %.2f, humidity: %.2f", crc, temp, humidity)
+			return 0, 0, err
+		}
+	} else if err != nil {
+		return 0, 0, err
+	}
+	return temp, humidity, nil
+}
+
+// checkEnclosureSeal reads the external probe and reports if the humidity inside the
+// enclosure is following the humidity outside, meaning the seal has likely failed.
+func checkEnclosureSeal(seal *sealMonitor, internalHumidity float32, externalAddress byte, board string) {
+	_, externalHumidity, err := readSensor(externalAddress)
+	if err != nil {
+		log.Errorf("Error reading external humidity probe: %v", err)
+		return
+	}
+	seal.addSample(internalHumidity, externalHumidity)
+	corr, degraded := seal.degraded(time.Now())
+	log.Debugf("External humidity: %.2f, seal correlation: %.2f", externalHumidity, corr)
+	if !degraded {
+		return
+	}
+	log.Infof("Enclosure seal degraded, internal/external humidity correlation %.2f", corr)
+	err = eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.EnclosureSealDegraded, time.Now(), eventhelper.SealDegradation{
+		Method:           sealMethodCorrelation,
+		Correlation:      corr,
+		Threshold:        seal.threshold,
+		Humidity:         internalHumidity,
+		ExternalHumidity: externalHumidity,
+		Board:            board,
+	}))
+	if err != nil {
+		log.Println("Error adding event:", err)
+	}
+}
+
+// checkRainResponse reports if the humidity inside the enclosure rises with heavy rain from
+// the weather input of tc2-hat-comms, meaning the seal has likely failed.
+func checkRainResponse(seal *sealMonitor, humidity float32, board string) {
+	now := time.Now()
+	rain, ok, err := rainstate.Load(now)
+	if err != nil {
+		log.Errorf("Error reading rain state: %v", err)
+	}
+	rise, degraded := seal.rainResponse(now, humidity, ok && rain.Heavy)
+	if rise != 0 {
+		log.Debugf("Humidity rose %.1f%% with heavy rain", rise)
+	}
+	if !degraded {
+		return
+	}
+	log.Infof("Enclosure seal degraded, humidity rose %.1f%% with the last %d heavy rain events", rise, seal.rainResponses)
+	err = eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.EnclosureSealDegraded, now, eventhelper.SealDegradation{
+		Method:       sealMethodRain,
+		Threshold:    sealRainRise,
+		Humidity:     humidity,
+		HumidityRise: rise,
+		RainEvents:   seal.rainResponses,
+		Board:        board,
+	}))
+	if err != nil {
+		log.Println("Error adding event:", err)
 	}
 }
 
-func makeReading() (float32, float32, uint8, error) {
+func makeReading(address byte) (float32, float32, uint8, error) {
 	// Get status
-	statusResult, err := i2crequest.Tx(AHT20Address, []byte{0x71}, 1, 1000)
+	statusResult, err := i2crequest.TxContext(serviceCtx, address, []byte{0x71}, 1)
 	if err != nil {
 		return 0, 0, 0, err
 	}
@@ -211,7 +489,7 @@ func makeReading() (float32, float32, uint8, error) {
 	}
 
 	// Trigger reading
-	_, err = i2crequest.Tx(AHT20Address, []byte{0xAC, 0x33, 0x00}, 0, 1000)
+	_, err = i2crequest.TxContext(serviceCtx, address, []byte{0xAC, 0x33, 0x00}, 0)
 	if err != nil {
 		return 0, 0, 0, err
 	}
@@ -222,7 +500,7 @@ func makeReading() (float32, float32, uint8, error) {
 	var rawData []byte
 	for i := 0; i < maxTxAttempts; i++ {
 		// Check reading is ready by checking bit[7] is 0 of the status register (0x71).
-		rawData, err = i2crequest.Tx(AHT20Address, []byte{0x71}, 7, 1000)
+		rawData, err = i2crequest.TxContext(serviceCtx, address, []byte{0x71}, 7)
 		if err != nil {
 			return 0, 0, 0, err
 		}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// After a long time above saturatedHumidity the AHT20 can read high until it is baked. The
+// AHT20 doesn't have a heater, so once it has been saturated for saturationRecoveryAfter it is
+// recovered by reading it back to back for recoveryDuration, which heats the die, and then
+// resetting it. The humidity readings are suspect from when the saturation is too long until
+// the sensor has cooled for recoverySettle after the recovery. Suspect readings are written
+// to the CSV file with a 2 in a fourth column and events from them have "humiditySuspect" set.
+// The recovery is reported with humidityRecoveryStarted and humidityRecoveryFinished events.
+// If the humidity is still high after the recovery it really is saturated, the recovery is
+// run again if it stays that way for another saturationRecoveryAfter.
+const (
+	saturatedHumidity       = 95 // %
+	saturationRecoveryAfter = 12 * time.Hour
+	recoveryDuration        = 2 * time.Minute
+	recoverySettle          = 30 * time.Minute
+	suspectCSVValue         = 2
+)
+
+// saturationMonitor recovers the sensor after it has been saturated for too long.
+type saturationMonitor struct {
+	now func() time.Time
+	// heat heats the sensor for the duration and then resets it.
+	heat  func(time.Duration) error
+	board string
+
+	saturatedSince   time.Time
+	settleUntil      time.Time // Zero unless the sensor is settling after a recovery.
+	recoveryHumidity float32   // Humidity when the last recovery started.
+	recoveryErr      error
+}
+
+func newSaturationMonitor(address byte, board string) *saturationMonitor {
+	return &saturationMonitor{
+		now:   time.Now,
+		heat:  func(d time.Duration) error { return heatSensor(address, d) },
+		board: board,
+	}
+}
+
+// check returns true if the humidity of the reading is suspect, running the recovery when the
+// sensor has been saturated for too long.
+func (m *saturationMonitor) check(r sensorReading) bool {
+	now := m.now()
+	if !m.settleUntil.IsZero() {
+		if now.Before(m.settleUntil) {
+			return true
+		}
+		m.finishRecovery(r, now)
+	}
+	if r.humidity < saturatedHumidity {
+		m.saturatedSince = time.Time{}
+		return false
+	}
+	if m.saturatedSince.IsZero() {
+		m.saturatedSince = now
+	}
+	if now.Sub(m.saturatedSince) < saturationRecoveryAfter {
+		return false
+	}
+	m.recover(r, now)
+	return true
+}
+
+func (m *saturationMonitor) recover(r sensorReading, now time.Time) {
+	saturated := now.Sub(m.saturatedSince)
+	log.Infof("Humidity has been above %d%% for %s, recovering the sensor", saturatedHumidity, saturated.Round(time.Minute))
+	m.report(eventhelper.HumidityRecoveryStarted, eventhelper.HumidityRecoveryStart{
+		Humidity:       r.humidity,
+		SaturatedHours: math.Round(saturated.Hours()*10) / 10,
+		Board:          m.board,
+	}, now)
+	m.recoveryHumidity = r.humidity
+	m.recoveryErr = m.heat(recoveryDuration)
+	if m.recoveryErr != nil {
+		log.Errorf("Failed to recover the humidity sensor: %v", m.recoveryErr)
+	}
+	m.settleUntil = m.now().Add(recoverySettle)
+}
+
+func (m *saturationMonitor) finishRecovery(r sensorReading, now time.Time) {
+	log.Infof("Humidity sensor recovery finished, humidity %.2f%% from %.2f%%", r.humidity, m.recoveryHumidity)
+	payload := eventhelper.HumidityRecoveryResult{
+		Humidity:       r.humidity,
+		BeforeHumidity: m.recoveryHumidity,
+		StillSaturated: r.humidity >= saturatedHumidity,
+		Board:          m.board,
+	}
+	if m.recoveryErr != nil {
+		payload.Error = m.recoveryErr.Error()
+	}
+	m.report(eventhelper.HumidityRecoveryFinished, payload, now)
+	m.settleUntil = time.Time{}
+	m.saturatedSince = time.Time{}
+}
+
+func (m *saturationMonitor) report(eventType string, payload interface{}, now time.Time) {
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventType, now, payload)); err != nil {
+		log.Println("Error adding event:", err)
+	}
+}
+
+// heatSensor heats the AHT20 by reading it back to back for the duration, then resets it.
+func heatSensor(address byte, d time.Duration) error {
+	end := time.Now().Add(d)
+	readings := 0
+	for time.Now().Before(end) {
+		if _, _, _, err := makeReading(address); err != nil && err != errBadCRC {
+			return fmt.Errorf("failed after %d readings: %v", readings, err)
+		}
+		readings++
+		if serviceCtx.Err() != nil {
+			return serviceCtx.Err()
+		}
+	}
+	log.Debugf("Heated humidity sensor with %d readings", readings)
+	return resetSensor(address)
+}
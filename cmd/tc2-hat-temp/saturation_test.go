@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaturationRecovery(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	heated := time.Duration(0)
+	m := &saturationMonitor{
+		now: func() time.Time { return now },
+		heat: func(d time.Duration) error {
+			heated += d
+			now = now.Add(d)
+			return nil
+		},
+	}
+
+	// A short time saturated is fine.
+	assert.False(t, m.check(sensorReading{temp: 10, humidity: 99}))
+	now = now.Add(time.Hour)
+	assert.False(t, m.check(sensorReading{temp: 10, humidity: 90}))
+
+	for i := 0; i <= 12; i++ {
+		now = now.Add(time.Hour)
+		if !m.check(sensorReading{temp: 10, humidity: 99}) {
+			continue
+		}
+		assert.Equal(t, 12, i)
+	}
+	assert.Equal(t, recoveryDuration, heated)
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "humidityRecoveryStarted", events.Events()[0].Type)
+
+	// Suspect until the sensor has settled.
+	now = now.Add(recoverySettle / 2)
+	assert.True(t, m.check(sensorReading{temp: 10, humidity: 80}))
+	now = now.Add(recoverySettle / 2)
+	assert.False(t, m.check(sensorReading{temp: 10, humidity: 80}))
+	assert.Len(t, events.Events(), 2)
+	assert.Equal(t, "humidityRecoveryFinished", events.Events()[1].Type)
+	assert.Equal(t, false, events.Events()[1].Details["stillSaturated"])
+}
+
+func TestReadingCSVLine(t *testing.T) {
+	now := time.Date(2026, 9, 27, 2, 15, 0, 0, time.UTC)
+	c := defaultReportingConfig()
+	assert.Equal(t, "2026-09-27T02:15:00Z, 12.00, 99.00, 2", c.readingCSVLine(now, sensorReading{temp: 12, humidity: 99, suspect: true}))
+	assert.Equal(t, "2026-09-27T02:15:00Z, 12.00, NaN, 1", c.readingCSVLine(now, sensorReading{temp: 12, estimated: true}))
+	assert.Equal(t, "2026-09-27T02:15:00Z, 12.00, 80.00", c.readingCSVLine(now, sensorReading{temp: 12, humidity: 80}))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	sealMinSamples    = 60
+	sealMinExternalSD = 2.0 // External humidity needs to vary to tell if the inside is following it.
+	sealEventInterval = 24 * time.Hour
+	sealRainWindow    = 6 * time.Hour // How long after heavy rain starts the humidity is watched.
+	sealRainRise      = 10.0          // %RH rise inside that counts as following the rain.
+	sealRainMinEvents = 2             // Heavy rain events in a row the humidity has to follow.
+
+	sealMethodCorrelation = "correlation"
+	sealMethodRain        = "rain"
+)
+
+// sealMonitor checks the health of the enclosure seal by comparing the humidity inside
+// the enclosure with the humidity outside, when there is an external probe, and with heavy
+// rain from the weather input. If the seal is good the humidity inside should not follow
+// the humidity outside or rise with the rain.
+type sealMonitor struct {
+	internal      []float64
+	external      []float64
+	windowSize    int
+	threshold     float64
+	lastEventTime time.Time
+
+	raining       bool      // Heavy rain at the last sample.
+	rainStart     time.Time // Start of the heavy rain being watched, zero if there isn't one.
+	rainBaseline  float64   // Humidity inside when it started.
+	rainRise      float64   // Highest rise in humidity since it started.
+	rainResponses int       // Heavy rain events in a row that the humidity rose with.
+}
+
+func newSealMonitor(windowSize int, threshold float64) *sealMonitor {
+	return &sealMonitor{
+		windowSize: windowSize,
+		threshold:  threshold,
+	}
+}
+
+func (m *sealMonitor) addSample(internalHumidity, externalHumidity float32) {
+	m.internal = append(m.internal, float64(internalHumidity))
+	m.external = append(m.external, float64(externalHumidity))
+	if len(m.internal) > m.windowSize {
+		m.internal = m.internal[1:]
+		m.external = m.external[1:]
+	}
+}
+
+// correlation returns the correlation between the internal and external humidity over the window.
+// Returns false if there is not enough data.
+func (m *sealMonitor) correlation() (float64, bool) {
+	if len(m.internal) < sealMinSamples || standardDeviation(m.external) < sealMinExternalSD {
+		return 0, false
+	}
+	return pearsonCorrelation(m.internal, m.external), true
+}
+
+// degraded returns true if an enclosureSealDegraded event should be made.
+func (m *sealMonitor) degraded(now time.Time) (float64, bool) {
+	corr, ok := m.correlation()
+	if !ok || corr < m.threshold || now.Sub(m.lastEventTime) < sealEventInterval {
+		return corr, false
+	}
+	m.lastEventTime = now
+	return corr, true
+}
+
+// rainResponse records the humidity inside with whether it is raining heavily. When
+// sealRainWindow has passed since heavy rain started it returns the rise in humidity over
+// that time, and degraded is true if an enclosureSealDegraded event should be made because
+// the humidity rose with the last sealRainMinEvents heavy rain events.
+func (m *sealMonitor) rainResponse(now time.Time, humidity float32, heavyRain bool) (rise float64, degraded bool) {
+	started := heavyRain && !m.raining
+	m.raining = heavyRain
+	if m.rainStart.IsZero() {
+		if started {
+			m.rainStart = now
+			m.rainBaseline = float64(humidity)
+			m.rainRise = 0
+		}
+		return 0, false
+	}
+	m.rainRise = math.Max(m.rainRise, float64(humidity)-m.rainBaseline)
+	if now.Sub(m.rainStart) < sealRainWindow {
+		return 0, false
+	}
+	m.rainStart = time.Time{}
+	if m.rainRise < sealRainRise {
+		m.rainResponses = 0
+		return m.rainRise, false
+	}
+	m.rainResponses++
+	if m.rainResponses < sealRainMinEvents || now.Sub(m.lastEventTime) < sealEventInterval {
+		return m.rainRise, false
+	}
+	m.lastEventTime = now
+	return m.rainRise, true
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func standardDeviation(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	m := mean(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
+
+func pearsonCorrelation(a, b []float64) float64 {
+	meanA := mean(a)
+	meanB := mean(b)
+	var cov, varA, varB float64
+	for i := range a {
+		da := a[i] - meanA
+		db := b[i] - meanB
+		cov += da * db
+		varA += da * da
+		varB += db * db
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varA*varB)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealMonitor(t *testing.T) {
+	now := time.Now()
+
+	// Sealed enclosure, internal humidity stays steady while the outside cycles.
+	sealed := newSealMonitor(100, 0.8)
+	for i := 0; i < 100; i++ {
+		external := float32(60 + 20*math.Sin(float64(i)/10))
+		sealed.addSample(40+float32(i%3)*0.1, external)
+	}
+	_, degraded := sealed.degraded(now)
+	assert.False(t, degraded)
+
+	// Leaking enclosure, internal humidity follows the outside.
+	leaking := newSealMonitor(100, 0.8)
+	for i := 0; i < sealMinSamples-1; i++ {
+		external := float32(60 + 20*math.Sin(float64(i)/10))
+		leaking.addSample(external-5, external)
+	}
+	_, degraded = leaking.degraded(now)
+	assert.False(t, degraded, "not enough samples yet")
+	leaking.addSample(55, 60)
+	corr, degraded := leaking.degraded(now)
+	assert.True(t, degraded)
+	assert.Greater(t, corr, 0.9)
+
+	// Only report once per interval.
+	_, degraded = leaking.degraded(now.Add(time.Hour))
+	assert.False(t, degraded)
+	_, degraded = leaking.degraded(now.Add(sealEventInterval + time.Second))
+	assert.True(t, degraded)
+}
+
+func TestSealRainResponse(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := newSealMonitor(100, 0.8)
+
+	// rain runs heavy rain for an hour, watching the humidity until the rain window has
+	// passed, with the humidity inside rising by rise.
+	rain := func(rise float32) (float64, bool) {
+		m.rainResponse(now, 50, false)
+		for i := 0; i <= int(sealRainWindow/(10*time.Minute)); i++ {
+			now = now.Add(10 * time.Minute)
+			heavy := i < 6
+			humidity := float32(50)
+			if i > 0 {
+				humidity += rise
+			}
+			if got, degraded := m.rainResponse(now, humidity, heavy); got != 0 || degraded {
+				return got, degraded
+			}
+		}
+		return 0, false
+	}
+
+	// A sealed enclosure barely changes.
+	rise, degraded := rain(2)
+	assert.Equal(t, 2.0, rise)
+	assert.False(t, degraded)
+
+	// The seal is reported once the humidity has risen with the rain twice in a row.
+	rise, degraded = rain(15)
+	assert.Equal(t, 15.0, rise)
+	assert.False(t, degraded)
+	rise, degraded = rain(15)
+	assert.Equal(t, 15.0, rise)
+	assert.True(t, degraded)
+	assert.Equal(t, 2, m.rainResponses)
+
+	// Only reported once per interval.
+	now = now.Add(time.Hour)
+	_, degraded = rain(15)
+	assert.False(t, degraded)
+
+	// A dry spell on its own doesn't count as a response.
+	m.rainResponses = 0
+	for i := 0; i < 100; i++ {
+		now = now.Add(10 * time.Minute)
+		rise, degraded = m.rainResponse(now, 90, false)
+		assert.Zero(t, rise)
+		assert.False(t, degraded)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+)
+
+// Faulty AHT20 sensors can get stuck returning the same reading or return readings that spike
+// to the ends of the range. Those readings are dropped so they aren't acted on.
+const (
+	sensorMinTemp       = -40 // Operating range of the AHT20.
+	sensorMaxTemp       = 85
+	sensorMaxTempStep   = 10 // Max plausible change in °C between samples.
+	sensorStuckSamples  = 30 // Identical readings in a row before the sensor is stuck.
+	spikeConfirmSamples = 3  // Readings in a row at a new level before it's accepted.
+	faultEventInterval  = time.Hour
+)
+
+const (
+	faultSpike = "spike"
+	faultStuck = "stuck"
+)
+
+type sensorReading struct {
+	temp      float32
+	humidity  float32
+	estimated bool // Estimated from the SoC, without a humidity, see soc.go.
+	suspect   bool // The humidity is suspect as the sensor is saturated, see saturation.go.
+}
+
+// sensorFaultDetector checks each reading for faults.
+type sensorFaultDetector struct {
+	lastGood      *sensorReading
+	identical     int
+	stepSpikes    int // Readings in a row rejected for changing too quickly.
+	lastFault     string
+	lastEventTime time.Time
+}
+
+// check returns the fault with the reading, or "" if the reading is good.
+func (d *sensorFaultDetector) check(r sensorReading) string {
+	if r.temp < sensorMinTemp || r.temp > sensorMaxTemp || r.humidity < 0 || r.humidity > 100 {
+		return faultSpike
+	}
+	if d.lastGood == nil {
+		d.lastGood = &r
+		return ""
+	}
+	if math.Abs(float64(r.temp-d.lastGood.temp)) > sensorMaxTempStep {
+		d.stepSpikes++
+		if d.stepSpikes < spikeConfirmSamples {
+			return faultSpike
+		}
+		// The temperature really has changed quickly, accept the new level.
+	}
+	d.stepSpikes = 0
+	if r == *d.lastGood {
+		d.identical++
+	} else {
+		d.identical = 0
+	}
+	d.lastGood = &r
+	if d.identical >= sensorStuckSamples-1 {
+		return faultStuck
+	}
+	return ""
+}
+
+// reset clears the history after the sensor has been re-initialised.
+func (d *sensorFaultDetector) reset() {
+	d.lastGood = nil
+	d.identical = 0
+	d.stepSpikes = 0
+}
+
+// shouldReport returns true if the fault should be reported, a fault is reported when it first
+// happens and then at most once per interval.
+func (d *sensorFaultDetector) shouldReport(fault string, now time.Time) bool {
+	if fault == d.lastFault && now.Sub(d.lastEventTime) < faultEventInterval {
+		return false
+	}
+	d.lastFault = fault
+	d.lastEventTime = now
+	return true
+}
+
+// handleSensorFault reports the fault and re-initialises the sensor.
+func handleSensorFault(d *sensorFaultDetector, fault string, r sensorReading, address byte, board string, reporting reportingConfig) {
+	log.Errorf("Temperature sensor fault '%s', temp: %.2f, humidity: %.2f", fault, r.temp, r.humidity)
+	if d.shouldReport(fault, time.Now()) {
+		err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.TempSensorFault, time.Now(), eventhelper.SensorFault{
+			Fault:    fault,
+			Temp:     reporting.temp(r.temp),
+			TempUnit: reporting.Unit,
+			Humidity: r.humidity,
+			Address:  address,
+			Board:    board,
+		}))
+		if err != nil {
+			log.Println("Error adding event:", err)
+		}
+	}
+	if fault == faultStuck {
+		if err := resetSensor(address); err != nil {
+			log.Errorf("Failed to reset sensor: %v", err)
+		}
+		d.reset()
+	}
+}
+
+// resetSensor soft resets the AHT20 and then calibrates it again.
+func resetSensor(address byte) error {
+	log.Infof("Resetting temperature sensor at 0x%X", address)
+	if _, err := i2crequest.TxContext(serviceCtx, address, []byte{0xBA}, 0); err != nil {
+		return err
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := i2crequest.TxContext(serviceCtx, address, []byte{0xBE, 0x08, 0x00}, 0); err != nil {
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
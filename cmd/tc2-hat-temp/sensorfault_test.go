@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSensorFaultSpikes(t *testing.T) {
+	d := &sensorFaultDetector{}
+	assert.Equal(t, faultSpike, d.check(sensorReading{temp: -50, humidity: 50}))
+	assert.Equal(t, faultSpike, d.check(sensorReading{temp: 150, humidity: 50}))
+	assert.Equal(t, faultSpike, d.check(sensorReading{temp: 20, humidity: 101}))
+	assert.Equal(t, "", d.check(sensorReading{temp: 20, humidity: 50}))
+
+	// A single jump is rejected, but a sustained change is accepted.
+	assert.Equal(t, faultSpike, d.check(sensorReading{temp: 45, humidity: 50}))
+	assert.Equal(t, "", d.check(sensorReading{temp: 21, humidity: 50}))
+	for i := 0; i < spikeConfirmSamples-1; i++ {
+		assert.Equal(t, faultSpike, d.check(sensorReading{temp: 40, humidity: 30}))
+	}
+	assert.Equal(t, "", d.check(sensorReading{temp: 40, humidity: 30}))
+}
+
+func TestSensorFaultStuck(t *testing.T) {
+	d := &sensorFaultDetector{}
+	r := sensorReading{temp: 18.5, humidity: 60}
+	for i := 0; i < sensorStuckSamples-1; i++ {
+		assert.Equal(t, "", d.check(r))
+	}
+	assert.Equal(t, faultStuck, d.check(r))
+
+	d.reset()
+	assert.Equal(t, "", d.check(r))
+}
+
+func TestSensorFaultReporting(t *testing.T) {
+	d := &sensorFaultDetector{}
+	now := time.Now()
+	assert.True(t, d.shouldReport(faultStuck, now))
+	assert.False(t, d.shouldReport(faultStuck, now.Add(time.Minute)))
+	assert.True(t, d.shouldReport(faultSpike, now.Add(2*time.Minute)))
+	assert.True(t, d.shouldReport(faultSpike, now.Add(2*time.Minute+faultEventInterval)))
+}
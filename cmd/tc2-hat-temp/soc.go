@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+)
+
+// Hats assembled without an AHT20 have nothing to measure the enclosure temperature with, so
+// when neither the AHT20 nor the ATtiny cached reading can be read the temperature is
+// estimated from the SoC thermal zone of the RPi instead, so the high and low temperature
+// protection still works. The SoC runs hotter than the enclosure, the estimate is
+//
+//	estimate = scale * soc + offset
+//
+// with the model from the config, fitted from readings of a hat with an AHT20 in the same
+// enclosure:
+//
+//	[soc-temperature]
+//	scale = 0.9
+//	offset = -12
+//
+// Humidity can't be estimated. Estimated readings are written to the CSV file with NaN for
+// the humidity and a 1 in a fourth column, and events from them have "estimated" set.
+const (
+	socConfigKey      = "soc-temperature"
+	socThermalZone    = "/sys/class/thermal/thermal_zone0/temp"
+	defaultSoCScale   = 1.0
+	defaultSoCOffset  = -15.0 // °C, the SoC runs about this much above the enclosure when idle.
+	estimatedCSVValue = 1
+)
+
+type socConfig struct {
+	Scale  float64 `mapstructure:"scale"`
+	Offset float64 `mapstructure:"offset"`
+}
+
+func defaultSoCConfig() socConfig {
+	return socConfig{Scale: defaultSoCScale, Offset: defaultSoCOffset}
+}
+
+// loadSoCConfig returns the SoC temperature model, the default model is returned with the
+// error if it can't be read.
+func loadSoCConfig(config *goconfig.Config) (socConfig, error) {
+	c := defaultSoCConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, socConfigKey, &c); err != nil {
+		return defaultSoCConfig(), err
+	}
+	if c.Scale <= 0 {
+		return defaultSoCConfig(), fmt.Errorf("%s scale must be positive", socConfigKey)
+	}
+	return c, nil
+}
+
+// estimate returns the estimated enclosure temperature for the SoC temperature.
+func (c socConfig) estimate(soc float64) float32 {
+	return float32(c.Scale*soc + c.Offset)
+}
+
+// socTempReader returns a function for estimating the temperature from the SoC, or nil if the
+// SoC thermal zone can't be read.
+func socTempReader(c socConfig, file string) func() (sensorReading, error) {
+	if _, err := readSoCTemp(file); err != nil {
+		log.Debugf("SoC temperature not available: %v", err)
+		return nil
+	}
+	return func() (sensorReading, error) {
+		soc, err := readSoCTemp(file)
+		if err != nil {
+			return sensorReading{}, err
+		}
+		return sensorReading{temp: c.estimate(soc), estimated: true}, nil
+	}
+}
+
+// readSoCTemp reads the thermal zone, which is in millidegrees Celsius.
+func readSoCTemp(file string) (float64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse SoC temperature: %v", err)
+	}
+	return float64(milli) / 1000, nil
+}
+
+// estimatedCSVLine returns the line for the temperature CSV file for an estimated reading.
+func (c reportingConfig) estimatedCSVLine(t time.Time, temp float32) string {
+	return fmt.Sprintf("%s, %.2f, NaN, %d", csvtime.Format(t, c.LegacyCSVTime), temp, estimatedCSVValue)
+}
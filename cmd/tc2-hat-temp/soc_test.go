@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoCTempReader(t *testing.T) {
+	assert.Nil(t, socTempReader(defaultSoCConfig(), filepath.Join(t.TempDir(), "missing")))
+
+	file := filepath.Join(t.TempDir(), "temp")
+	assert.NoError(t, os.WriteFile(file, []byte("52500\n"), 0644))
+	read := socTempReader(socConfig{Scale: 0.8, Offset: -10}, file)
+	r, err := read()
+	assert.NoError(t, err)
+	assert.Equal(t, sensorReading{temp: 32, estimated: true}, r)
+}
+
+func TestEstimatedCSVLine(t *testing.T) {
+	now := time.Date(2026, 9, 27, 2, 15, 0, 0, time.UTC)
+	c := defaultReportingConfig()
+	assert.Equal(t, "2026-09-27T02:15:00Z, 32.00, NaN, 1", c.estimatedCSVLine(now, 32))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+// On some hats the ATtiny also reads the AHT20 and caches the reading. When reading the AHT20
+// directly keeps failing, because of contention with other traffic on the bus, the cached
+// reading is used instead. The AHT20 is tried again every sourceProbeInterval and used again
+// once it can be read. While both can be read they are checked against each other so a
+// sensor or cache giving bad readings is reported. If the cached reading can't be read either
+// the temperature is estimated from the SoC, see soc.go.
+const (
+	sourceAuto   = "auto"
+	sourceAHT20  = "aht20"
+	sourceATtiny = "attiny"
+	sourceSoC    = "soc"
+
+	sourceSwitchFailures     = 3 // AHT20 failures in a row before switching to the ATtiny or SoC.
+	sourceProbeInterval      = 10 * time.Minute
+	sourceCrossCheckInterval = 30 * time.Minute
+	maxCachedReadingAge      = 3 * time.Minute
+	maxSourceTempDiff        = 2  // °C
+	maxSourceHumidityDiff    = 10 // %
+	mismatchEventInterval    = 6 * time.Hour
+)
+
+// tempSource picks where to read the temperature from.
+type tempSource struct {
+	mode       string
+	readAHT20  func() (sensorReading, error)
+	readATtiny func() (sensorReading, error) // nil if the ATtiny doesn't cache readings.
+	readSoC    func() (sensorReading, error) // nil if the SoC temperature can't be read.
+	now        func() time.Time
+
+	current           string
+	aht20Failures     int
+	lastProbe         time.Time
+	lastCrossCheck    time.Time
+	lastMismatchEvent time.Time
+}
+
+func newTempSource(mode string, readAHT20, readATtiny, readSoC func() (sensorReading, error)) (*tempSource, error) {
+	s := &tempSource{
+		mode:       mode,
+		readAHT20:  readAHT20,
+		readATtiny: readATtiny,
+		readSoC:    readSoC,
+		now:        time.Now,
+		current:    sourceAHT20,
+	}
+	switch mode {
+	case sourceAuto, sourceAHT20:
+	case sourceATtiny:
+		if readATtiny == nil {
+			return nil, fmt.Errorf("ATtiny doesn't cache temperature readings")
+		}
+		s.current = sourceATtiny
+	case sourceSoC:
+		if readSoC == nil {
+			return nil, fmt.Errorf("SoC temperature can't be read")
+		}
+		s.current = sourceSoC
+	default:
+		return nil, fmt.Errorf("unknown temperature source '%s'", mode)
+	}
+	return s, nil
+}
+
+// read returns a reading and the source it came from.
+func (s *tempSource) read() (sensorReading, string, error) {
+	if s.mode != sourceAuto || (s.readATtiny == nil && s.readSoC == nil) {
+		switch s.current {
+		case sourceATtiny:
+			r, err := s.readATtiny()
+			return r, sourceATtiny, err
+		case sourceSoC:
+			r, err := s.readSoC()
+			return r, sourceSoC, err
+		}
+		r, err := s.readAHT20()
+		return r, sourceAHT20, err
+	}
+
+	now := s.now()
+	if s.current != sourceAHT20 && now.Sub(s.lastProbe) < sourceProbeInterval {
+		r, from, err := s.readFallback()
+		if err == nil && from != s.current {
+			s.switchTo(from, nil)
+		}
+		return r, from, err
+	}
+	s.lastProbe = now
+
+	r, err := s.readAHT20()
+	if err == nil {
+		s.aht20Failures = 0
+		if s.current == sourceATtiny {
+			s.switchTo(sourceAHT20, nil)
+		}
+		if s.readATtiny != nil && now.Sub(s.lastCrossCheck) >= sourceCrossCheckInterval {
+			s.lastCrossCheck = now
+			if cached, err := s.readATtiny(); err == nil {
+				s.crossCheck(r, cached)
+			} else {
+				log.Debugf("Not cross checking temperature, ATtiny reading failed: %v", err)
+			}
+		}
+		return r, sourceAHT20, nil
+	}
+
+	s.aht20Failures++
+	log.Debugf("Failed to read AHT20 (%d in a row): %v", s.aht20Failures, err)
+	fallback, from, fallbackErr := s.readFallback()
+	if fallbackErr != nil {
+		return sensorReading{}, s.current, err
+	}
+	if s.current == sourceAHT20 && s.aht20Failures >= sourceSwitchFailures {
+		s.switchTo(from, err)
+	} else if s.current != sourceAHT20 && from != s.current {
+		s.switchTo(from, nil)
+	}
+	return fallback, from, nil
+}
+
+// readFallback reads the ATtiny cached reading, or estimates it from the SoC if that can't
+// be read.
+func (s *tempSource) readFallback() (sensorReading, string, error) {
+	var err error
+	if s.readATtiny != nil {
+		var r sensorReading
+		if r, err = s.readATtiny(); err == nil {
+			return r, sourceATtiny, nil
+		}
+	}
+	if s.readSoC != nil {
+		r, socErr := s.readSoC()
+		if socErr == nil || err == nil {
+			return r, sourceSoC, socErr
+		}
+	}
+	return sensorReading{}, sourceATtiny, err
+}
+
+func (s *tempSource) switchTo(source string, reason error) {
+	log.Infof("Switching temperature source from %s to %s", s.current, source)
+	payload := eventhelper.TempSourceChange{From: s.current, To: source}
+	if reason != nil {
+		payload.Reason = reason.Error()
+	}
+	s.current = source
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.TempSourceChanged, s.now(), payload)); err != nil {
+		log.Println("Error adding event:", err)
+	}
+}
+
+// crossCheck reports if the AHT20 and ATtiny readings don't agree.
+func (s *tempSource) crossCheck(aht20, cached sensorReading) {
+	tempDiff := math.Abs(float64(aht20.temp - cached.temp))
+	humidityDiff := math.Abs(float64(aht20.humidity - cached.humidity))
+	if tempDiff <= maxSourceTempDiff && humidityDiff <= maxSourceHumidityDiff {
+		return
+	}
+	log.Errorf("AHT20 reading (%.2f°C, %.2f%%) doesn't match ATtiny reading (%.2f°C, %.2f%%)",
+		aht20.temp, aht20.humidity, cached.temp, cached.humidity)
+	now := s.now()
+	if !s.lastMismatchEvent.IsZero() && now.Sub(s.lastMismatchEvent) < mismatchEventInterval {
+		return
+	}
+	s.lastMismatchEvent = now
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.TempSourceMismatch, now, eventhelper.TempSourceDisagreement{
+		Temp:           aht20.temp,
+		Humidity:       aht20.humidity,
+		ATtinyTemp:     cached.temp,
+		ATtinyHumidity: cached.humidity,
+	})); err != nil {
+		log.Println("Error adding event:", err)
+	}
+}
+
+// attinyTempReader returns a function for reading the temperature cached by the ATtiny, or
+// nil if the ATtiny doesn't cache readings.
+func attinyTempReader() func() (sensorReading, error) {
+	client := attinyclient.NewI2CClientContext(serviceCtx)
+	if _, ok, err := client.ReadCachedTemperature(); err != nil || !ok {
+		log.Debugf("ATtiny cached temperature not available (err: %v)", err)
+		return nil
+	}
+	return func() (sensorReading, error) {
+		cached, ok, err := client.ReadCachedTemperature()
+		if err != nil {
+			return sensorReading{}, err
+		}
+		if !ok {
+			return sensorReading{}, fmt.Errorf("no cached temperature reading on the ATtiny")
+		}
+		if cached.Age > maxCachedReadingAge {
+			return sensorReading{}, fmt.Errorf("cached temperature reading is %s old", cached.Age)
+		}
+		return sensorReading{temp: cached.Temp, humidity: cached.Humidity}, nil
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTempSources struct {
+	now       time.Time
+	aht20     sensorReading
+	aht20Err  error
+	attiny    sensorReading
+	attinyErr error
+	events    *eventtest.Recorder
+}
+
+func (f *fakeTempSources) newSource(t *testing.T, mode string) *tempSource {
+	s, err := newTempSource(mode,
+		func() (sensorReading, error) { return f.aht20, f.aht20Err },
+		func() (sensorReading, error) { return f.attiny, f.attinyErr },
+		nil)
+	assert.NoError(t, err)
+	s.now = func() time.Time { return f.now }
+	f.events = eventtest.Capture(t)
+	return s
+}
+
+func TestTempSourceSwitchover(t *testing.T) {
+	f := &fakeTempSources{
+		now:    time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC),
+		aht20:  sensorReading{temp: 20, humidity: 50},
+		attiny: sensorReading{temp: 20.5, humidity: 51},
+	}
+	s := f.newSource(t, sourceAuto)
+
+	r, from, err := s.read()
+	assert.NoError(t, err)
+	assert.Equal(t, sourceAHT20, from)
+	assert.Equal(t, f.aht20, r)
+
+	// Failed AHT20 reads use the ATtiny reading, switching over after a few in a row.
+	f.aht20Err = errors.New("bus busy")
+	for i := 0; i < sourceSwitchFailures; i++ {
+		f.now = f.now.Add(time.Minute)
+		r, from, err = s.read()
+		assert.NoError(t, err)
+		assert.Equal(t, sourceATtiny, from)
+		assert.Equal(t, f.attiny, r)
+	}
+	assert.Equal(t, sourceATtiny, s.current)
+	assert.Len(t, f.events.Events(), 1)
+	assert.Equal(t, "tempSourceChanged", f.events.Events()[0].Type)
+
+	// The AHT20 isn't tried again until the probe interval.
+	f.aht20Err = nil
+	f.now = f.now.Add(time.Minute)
+	_, from, _ = s.read()
+	assert.Equal(t, sourceATtiny, from)
+
+	f.now = f.now.Add(sourceProbeInterval)
+	_, from, _ = s.read()
+	assert.Equal(t, sourceAHT20, from)
+	assert.Len(t, f.events.Events(), 2)
+}
+
+func TestTempSourceBothFail(t *testing.T) {
+	f := &fakeTempSources{aht20Err: errors.New("aht20"), attinyErr: errors.New("attiny")}
+	s := f.newSource(t, sourceAuto)
+	_, _, err := s.read()
+	if assert.Error(t, err) {
+		assert.Equal(t, "aht20", err.Error())
+	}
+}
+
+func TestTempSourceCrossCheck(t *testing.T) {
+	f := &fakeTempSources{
+		now:    time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC),
+		aht20:  sensorReading{temp: 20, humidity: 50},
+		attiny: sensorReading{temp: 25, humidity: 50},
+	}
+	s := f.newSource(t, sourceAuto)
+	_, _, err := s.read()
+	assert.NoError(t, err)
+	assert.Len(t, f.events.Events(), 1)
+	assert.Equal(t, "tempSourceMismatch", f.events.Events()[0].Type)
+
+	// Only checked every cross check interval, and reported at most every event interval.
+	f.now = f.now.Add(time.Minute)
+	s.read()
+	f.now = f.now.Add(sourceCrossCheckInterval)
+	s.read()
+	assert.Len(t, f.events.Events(), 1)
+}
+
+func TestTempSourceModes(t *testing.T) {
+	_, err := newTempSource(sourceATtiny, nil, nil, nil)
+	assert.Error(t, err)
+	_, err = newTempSource(sourceSoC, nil, nil, nil)
+	assert.Error(t, err)
+	_, err = newTempSource("sht3x", nil, nil, nil)
+	assert.Error(t, err)
+
+	f := &fakeTempSources{aht20Err: errors.New("aht20")}
+	s := f.newSource(t, sourceAHT20)
+	_, from, err := s.read()
+	assert.Error(t, err)
+	assert.Equal(t, sourceAHT20, from)
+}
+
+func TestTempSourceSoCFallback(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	aht20Err := errors.New("no ack")
+	estimate := sensorReading{temp: 31, estimated: true}
+	events := eventtest.Capture(t)
+	s, err := newTempSource(sourceAuto,
+		func() (sensorReading, error) { return sensorReading{temp: 20, humidity: 50}, aht20Err },
+		nil,
+		func() (sensorReading, error) { return estimate, nil })
+	assert.NoError(t, err)
+	s.now = func() time.Time { return now }
+
+	// Without an AHT20 or ATtiny cached reading the temperature is estimated from the SoC.
+	for i := 0; i < sourceSwitchFailures; i++ {
+		now = now.Add(time.Minute)
+		r, from, err := s.read()
+		assert.NoError(t, err)
+		assert.Equal(t, sourceSoC, from)
+		assert.Equal(t, estimate, r)
+	}
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, sourceSoC, events.Events()[0].Details["to"])
+
+	// The AHT20 is used again once it can be read.
+	aht20Err = nil
+	now = now.Add(sourceProbeInterval)
+	r, from, err := s.read()
+	assert.NoError(t, err)
+	assert.Equal(t, sourceAHT20, from)
+	assert.False(t, r.estimated)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// The temperature in events can be reported in Fahrenheit for partners that use it, and the
+// CSV timestamps can be kept in the old local time format for parsers that haven't been
+// updated to RFC3339:
+//
+//	[temperature-reporting]
+//	unit = "F"
+//	legacy-csv-time = true
+//
+// The CSV file and the thresholds are always in Celsius.
+const (
+	reportingConfigKey = "temperature-reporting"
+	unitCelsius        = "C"
+	unitFahrenheit     = "F"
+)
+
+type reportingConfig struct {
+	Unit          string `mapstructure:"unit"`
+	LegacyCSVTime bool   `mapstructure:"legacy-csv-time"`
+}
+
+func defaultReportingConfig() reportingConfig {
+	return reportingConfig{Unit: unitCelsius}
+}
+
+// loadReportingConfig returns the reporting config, the default config is returned with the
+// error if it can't be read.
+func loadReportingConfig(config *goconfig.Config) (reportingConfig, error) {
+	c := defaultReportingConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, reportingConfigKey, &c); err != nil {
+		return defaultReportingConfig(), err
+	}
+	c.Unit = strings.ToUpper(c.Unit)
+	if c.Unit != unitCelsius && c.Unit != unitFahrenheit {
+		return defaultReportingConfig(), fmt.Errorf("%s unit should be C or F, not '%s'", reportingConfigKey, c.Unit)
+	}
+	return c, nil
+}
+
+// temp converts the temperature in Celsius to the reporting unit.
+func (c reportingConfig) temp(celsius float32) float32 {
+	if c.Unit == unitFahrenheit {
+		return celsius*9/5 + 32
+	}
+	return celsius
+}
+
+// tempReading returns the event payload for the reading, with the temperature in the
+// reporting unit.
+func (c reportingConfig) tempReading(r sensorReading, source, board string) eventhelper.TempReading {
+	payload := eventhelper.TempReading{
+		Temp:            c.temp(r.temp),
+		TempUnit:        c.Unit,
+		Source:          source,
+		Estimated:       r.estimated,
+		HumiditySuspect: r.suspect,
+		Board:           board,
+	}
+	if !r.estimated {
+		humidity := r.humidity
+		payload.Humidity = &humidity
+	}
+	return payload
+}
+
+// csvLine returns the line for the temperature CSV file.
+func (c reportingConfig) csvLine(t time.Time, temp, humidity float32) string {
+	return fmt.Sprintf("%s, %.2f, %.2f", csvtime.Format(t, c.LegacyCSVTime), temp, humidity)
+}
+
+// readingCSVLine returns the line for the temperature CSV file for the reading, with a fourth
+// column flagging readings that are estimated or have a suspect humidity.
+func (c reportingConfig) readingCSVLine(t time.Time, r sensorReading) string {
+	switch {
+	case r.estimated:
+		return c.estimatedCSVLine(t, r.temp)
+	case r.suspect:
+		return fmt.Sprintf("%s, %d", c.csvLine(t, r.temp, r.humidity), suspectCSVValue)
+	}
+	return c.csvLine(t, r.temp, r.humidity)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportingUnits(t *testing.T) {
+	c := defaultReportingConfig()
+	assert.Equal(t, float32(25), c.temp(25))
+	assert.Equal(t, "C", c.Unit)
+
+	c.Unit = unitFahrenheit
+	assert.Equal(t, float32(-40), c.temp(-40))
+	assert.InDelta(t, 77, c.temp(25), 0.001)
+}
+
+func TestTempReadingEvent(t *testing.T) {
+	c := defaultReportingConfig()
+	now := time.Now()
+	e := eventhelper.NewEvent(eventhelper.TempHumidity, now, c.tempReading(sensorReading{temp: 20, humidity: 96, suspect: true}, sourceAHT20, "ext"))
+	assert.NoError(t, eventhelper.Validate(e))
+	assert.Equal(t, map[string]interface{}{
+		"temp":            float32(20),
+		"tempUnit":        "C",
+		"humidity":        float32(96),
+		"source":          sourceAHT20,
+		"humiditySuspect": true,
+		"board":           "ext",
+	}, e.Details)
+
+	// Estimated readings have no humidity.
+	e = eventhelper.NewEvent(eventhelper.TempTooHigh, now, c.tempReading(sensorReading{temp: 45, estimated: true}, sourceSoC, ""))
+	assert.NoError(t, eventhelper.Validate(e))
+	assert.NotContains(t, e.Details, "humidity")
+	assert.Equal(t, true, e.Details["estimated"])
+}
+
+func TestCSVLine(t *testing.T) {
+	now := time.Date(2026, 9, 27, 2, 15, 0, 0, time.FixedZone("NZDT", 13*60*60))
+	c := defaultReportingConfig()
+	assert.Equal(t, "2026-09-27T02:15:00+13:00, 21.50, 60.25", c.csvLine(now, 21.5, 60.25))
+
+	c.LegacyCSVTime = true
+	assert.Equal(t, "2026-09-27 02:15:00, 21.50, 60.25", c.csvLine(now, 21.5, 60.25))
+}
@@ -0,0 +1,165 @@
+// Package configcompat lets the hat services keep running when the fleet pushes a config
+// written for a newer version of them, so a staged rollout doesn't break older devices.
+// Fields in a section that the service doesn't know about are ignored, and their names are
+// logged once and reported with a configSchemaMismatch event. The config can also say which
+// version of the schema it was written for:
+//
+//	[config-schema]
+//	version = 2
+//
+// A version newer than SchemaVersion is reported the same way. Sections that the service
+// doesn't know about are never read, so are ignored already.
+package configcompat
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+const (
+	// SchemaVersion is the version of the config schema this binary was built for. It should be
+	// increased when a section or field is added.
+	SchemaVersion = 1
+	SchemaKey     = "config-schema"
+	// go-config adds this to a section when it is written.
+	updatedField = "updated"
+)
+
+var (
+	log = logging.NewLogger("info")
+
+	mu            sync.Mutex
+	service       = "unknown"
+	binaryVersion = "<not set>"
+	logged        = map[string]bool{}
+)
+
+// SetBinary sets the service and its version for the configSchemaMismatch events.
+func SetBinary(serviceName, version string) {
+	mu.Lock()
+	defer mu.Unlock()
+	service = serviceName
+	binaryVersion = version
+}
+
+// Unmarshal reads the section of the config into each of raws, like goconfig.Config.Unmarshal.
+// A section that is split between several structs should be read with them all at once, so
+// that only the fields none of them have are reported.
+func Unmarshal(config *goconfig.Config, key string, raws ...interface{}) error {
+	for _, raw := range raws {
+		if err := config.Unmarshal(key, raw); err != nil {
+			return err
+		}
+	}
+	section, _ := config.Get(key).(map[string]interface{})
+	check(key, section, schemaVersion(config.Get(SchemaKey+".version")), raws...)
+	return nil
+}
+
+func schemaVersion(v interface{}) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// check logs and reports the fields in the section that aren't in the raws, and a newer
+// config schema version, if they haven't been reported before.
+func check(key string, section map[string]interface{}, configVersion int, raws ...interface{}) {
+	unknown := UnknownFields(section, raws...)
+	mu.Lock()
+	newFields := []string{}
+	for _, field := range unknown {
+		name := key + "." + field
+		if !logged[name] {
+			logged[name] = true
+			newFields = append(newFields, name)
+		}
+	}
+	newVersion := false
+	if configVersion > SchemaVersion && !logged[SchemaKey] {
+		logged[SchemaKey] = true
+		newVersion = true
+	}
+	mismatch := eventhelper.ConfigMismatch{
+		Service:             service,
+		BinaryVersion:       binaryVersion,
+		BinarySchemaVersion: SchemaVersion,
+		ConfigSchemaVersion: configVersion,
+	}
+	mu.Unlock()
+
+	if len(newFields) == 0 && !newVersion {
+		return
+	}
+	if newVersion {
+		log.Printf("Config schema version %d is newer than %d, unknown settings will be ignored", configVersion, SchemaVersion)
+	}
+	if len(newFields) > 0 {
+		log.Printf("Ignoring unknown config fields: %s", strings.Join(newFields, ", "))
+		mismatch.Section = key
+		mismatch.UnknownFields = newFields
+	}
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ConfigSchemaMismatch, time.Now(), mismatch)); err != nil {
+		log.Printf("Error adding configSchemaMismatch event: %v", err)
+	}
+}
+
+// UnknownFields returns the fields in the section, sorted, that none of the raws have.
+func UnknownFields(section map[string]interface{}, raws ...interface{}) []string {
+	known := map[string]bool{updatedField: true}
+	for _, raw := range raws {
+		t := reflect.TypeOf(raw)
+		for t != nil && t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t == nil || t.Kind() != reflect.Struct {
+			// Maps and other values take any field.
+			return nil
+		}
+		addFields(known, t)
+	}
+	unknown := []string{}
+	for field := range section {
+		if !known[strings.ToLower(field)] {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// addFields adds the field names that mapstructure uses for the struct.
+func addFields(known map[string]bool, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "squash") && f.Type.Kind() == reflect.Struct {
+			addFields(known, f.Type)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		known[strings.ToLower(name)] = true
+	}
+}
@@ -0,0 +1,61 @@
+package configcompat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type baseConfig struct {
+	Enable bool   `mapstructure:"enable"`
+	Pin    string `mapstructure:"pin"`
+}
+
+type extraConfig struct {
+	Base     baseConfig    `mapstructure:",squash"`
+	Interval time.Duration `mapstructure:"interval"`
+	Ignored  string        `mapstructure:"-"`
+	Untagged int
+}
+
+func TestUnknownFields(t *testing.T) {
+	section := map[string]interface{}{
+		"enable":   true,
+		"pin":      "GPIO1",
+		"interval": "1m",
+		"untagged": 1,
+		"updated":  "2026-10-01T00:00:00Z",
+		"new-mode": "fast",
+		"ignored":  "x",
+	}
+	assert.Equal(t, []string{"ignored", "new-mode"}, UnknownFields(section, &extraConfig{}))
+	assert.Equal(t, []string{"ignored", "interval", "new-mode", "untagged"}, UnknownFields(section, &baseConfig{}))
+	assert.Empty(t, UnknownFields(section, &map[string]interface{}{}))
+	assert.Empty(t, UnknownFields(nil, &baseConfig{}))
+}
+
+func TestCheckReportsOnce(t *testing.T) {
+	events := eventtest.Capture(t)
+
+	logged = map[string]bool{}
+	SetBinary("tc2-hat-test", "1.2.3")
+
+	section := map[string]interface{}{"enable": true, "new-mode": "fast"}
+	check("fan", section, 0, &baseConfig{})
+	check("fan", section, 0, &baseConfig{})
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "configSchemaMismatch", events.Events()[0].Type)
+		assert.Equal(t, []string{"fan.new-mode"}, events.Events()[0].Details["unknownFields"])
+		assert.Equal(t, "1.2.3", events.Events()[0].Details["binaryVersion"])
+	}
+
+	// A newer schema version is reported even without unknown fields.
+	check("buzzer", map[string]interface{}{"enable": true}, SchemaVersion+1, &baseConfig{})
+	check("buzzer", map[string]interface{}{"enable": true}, SchemaVersion+1, &baseConfig{})
+	if assert.Len(t, events.Events(), 2) {
+		assert.Equal(t, SchemaVersion+1, events.Events()[1].Details["configSchemaVersion"])
+		assert.NotContains(t, events.Events()[1].Details, "unknownFields")
+	}
+}
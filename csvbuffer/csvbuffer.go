@@ -0,0 +1,175 @@
+// Package csvbuffer batches the lines appended to the CSV files written by the hat services,
+// so the SD card isn't written to for every sample. Lines are held in memory and appended in
+// one write when max-lines are waiting, or flush-interval after the oldest of them was added:
+//
+//	[csv-writes]
+//	flush-interval = "10m"
+//	max-lines = 60
+//	fsync = true
+//
+// With fsync the file is synced after each flush, so flushed lines survive losing power and
+// at most flush-interval of readings are lost, otherwise it is left to the kernel. The
+// services flush when they stop and before anything else reads or rewrites the files, such as
+// trimming them. A flush-interval of 0 writes each line straight away.
+package csvbuffer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+)
+
+const (
+	ConfigKey = "csv-writes"
+	// Lines kept while flushing keeps failing, the oldest are dropped past this.
+	maxHeldLines = 10000
+)
+
+// Config is read from the "csv-writes" section of the config.
+type Config struct {
+	FlushInterval time.Duration `mapstructure:"flush-interval"`
+	MaxLines      int           `mapstructure:"max-lines"`
+	Fsync         bool          `mapstructure:"fsync"`
+}
+
+func DefaultConfig() Config {
+	return Config{FlushInterval: 10 * time.Minute, MaxLines: 60, Fsync: true}
+}
+
+// LoadConfig returns the CSV write config, the default config is returned with the error if
+// it can't be read.
+func LoadConfig(config *goconfig.Config) (Config, error) {
+	c := DefaultConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, ConfigKey, &c); err != nil {
+		return DefaultConfig(), err
+	}
+	if c.FlushInterval < 0 || c.MaxLines < 1 {
+		return DefaultConfig(), fmt.Errorf("%s flush-interval can't be negative and max-lines must be positive", ConfigKey)
+	}
+	return c, nil
+}
+
+// Writer appends lines to a file in batches.
+type Writer struct {
+	file   string
+	header string // Written first when the file is empty, "" for none.
+	config Config
+
+	mu    sync.Mutex
+	lines []string
+	timer *time.Timer
+	err   error // From the last flush in the background, returned by the next Write.
+
+	write func(f *os.File, data string) (int, error)
+}
+
+// New returns a writer appending to the file, the header is written first to an empty file.
+func New(file, header string, config Config) *Writer {
+	return &Writer{
+		file:   file,
+		header: header,
+		config: config,
+		write:  (*os.File).WriteString,
+	}
+}
+
+// Write adds a line to the batch, flushing if the batch is full. The error can be from an
+// earlier flush in the background, the line is still kept to be written.
+func (w *Writer) Write(line string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines = append(w.lines, line)
+	if len(w.lines) > maxHeldLines {
+		w.lines = w.lines[len(w.lines)-maxHeldLines:]
+	}
+	if w.config.FlushInterval <= 0 || len(w.lines) >= w.config.MaxLines {
+		return w.flushLocked()
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.config.FlushInterval, w.flushInBackground)
+	}
+	err := w.err
+	w.err = nil
+	return err
+}
+
+func (w *Writer) flushInBackground() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer = nil
+	w.err = w.flushLocked()
+	// Try again later rather than holding the lines until the next Write.
+	if w.err != nil && len(w.lines) > 0 && w.config.FlushInterval > 0 {
+		w.timer = time.AfterFunc(w.config.FlushInterval, w.flushInBackground)
+	}
+}
+
+// Flush writes the waiting lines to the file. Safe to call on a nil writer.
+func (w *Writer) Flush() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+func (w *Writer) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.lines) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(w.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	data := &strings.Builder{}
+	if info.Size() == 0 && w.header != "" {
+		data.WriteString(w.header + "\n")
+	}
+	for _, line := range w.lines {
+		data.WriteString(line + "\n")
+	}
+	// The lines are kept to be written again, so anything written by a failed flush is cut
+	// off so they aren't duplicated.
+	if _, err := w.write(f, data.String()); err != nil {
+		f.Truncate(info.Size())
+		f.Close()
+		return err
+	}
+	if w.config.Fsync {
+		if err := f.Sync(); err != nil {
+			f.Truncate(info.Size())
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	w.lines = nil
+	return nil
+}
+
+// Pending returns the number of lines waiting to be written.
+func (w *Writer) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.lines)
+}
@@ -0,0 +1,110 @@
+package csvbuffer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterBatches(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "readings.csv")
+	w := New(file, "time, value", Config{FlushInterval: time.Hour, MaxLines: 3})
+
+	assert.NoError(t, w.Write("a, 1"))
+	assert.NoError(t, w.Write("b, 2"))
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 2, w.Pending())
+
+	// The batch is full at the third line.
+	assert.NoError(t, w.Write("c, 3"))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "time, value\na, 1\nb, 2\nc, 3\n", string(data))
+	assert.Equal(t, 0, w.Pending())
+
+	// The header is only written to an empty file.
+	assert.NoError(t, w.Write("d, 4"))
+	assert.NoError(t, w.Flush())
+	data, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "time, value\na, 1\nb, 2\nc, 3\nd, 4\n", string(data))
+}
+
+func TestWriterFlushesAfterInterval(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "readings.csv")
+	w := New(file, "", Config{FlushInterval: 10 * time.Millisecond, MaxLines: 100, Fsync: true})
+	assert.NoError(t, w.Write("a, 1"))
+	for i := 0; i < 100 && w.Pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "a, 1\n", string(data))
+}
+
+func TestWriterKeepsLinesOnError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	file := filepath.Join(dir, "readings.csv")
+	w := New(file, "", Config{MaxLines: 1})
+	assert.Error(t, w.Write("a, 1"))
+	assert.Equal(t, 1, w.Pending())
+
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	assert.NoError(t, w.Write("b, 2"))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "a, 1\nb, 2\n", string(data))
+}
+
+func TestNilWriterFlush(t *testing.T) {
+	var w *Writer
+	assert.NoError(t, w.Flush())
+}
+
+func TestWriterTruncatesPartialWrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "readings.csv")
+	w := New(file, "time, value", Config{FlushInterval: time.Hour, MaxLines: 2})
+	assert.NoError(t, w.Write("a, 1"))
+	assert.NoError(t, w.Write("b, 2"))
+
+	// Only part of the batch makes it to the file.
+	w.write = func(f *os.File, data string) (int, error) {
+		n, _ := f.WriteString(data[:len(data)/2])
+		return n, errors.New("no space left on device")
+	}
+	assert.NoError(t, w.Write("c, 3"))
+	assert.Error(t, w.Write("d, 4"))
+	assert.Equal(t, 2, w.Pending())
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "time, value\na, 1\nb, 2\n", string(data))
+
+	w.write = (*os.File).WriteString
+	assert.NoError(t, w.Flush())
+	data, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "time, value\na, 1\nb, 2\nc, 3\nd, 4\n", string(data))
+}
+
+func TestWriterRetriesFailedBackgroundFlush(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	file := filepath.Join(dir, "readings.csv")
+	w := New(file, "", Config{FlushInterval: 10 * time.Millisecond, MaxLines: 100})
+	assert.NoError(t, w.Write("a, 1"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, w.Pending())
+
+	// Written by the next background flush without another Write.
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	for i := 0; i < 100 && w.Pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "a, 1\n", string(data))
+}
@@ -0,0 +1,35 @@
+// Package csvtime is the timestamp format of the CSV files written by the hat services.
+// Timestamps are written as RFC3339 with the timezone offset, so they aren't ambiguous
+// around daylight saving changes. Files can still have lines in the old format, local time
+// without a timezone, so both are accepted when parsing.
+package csvtime
+
+import (
+	"strings"
+	"time"
+)
+
+// Legacy is the old format, in local time.
+const Legacy = "2006-01-02 15:04:05"
+
+// Format formats the time for a CSV file, in the legacy format if legacy is true.
+func Format(t time.Time, legacy bool) string {
+	if legacy {
+		return t.Format(Legacy)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Parse parses a timestamp in either format, legacy timestamps are taken as local time.
+func Parse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if IsLegacy(s) {
+		return time.ParseInLocation(Legacy, s, time.Local)
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// IsLegacy returns true if the timestamp looks like it is in the legacy format.
+func IsLegacy(s string) bool {
+	return !strings.Contains(s, "T")
+}
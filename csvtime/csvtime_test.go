@@ -0,0 +1,27 @@
+package csvtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatAndParse(t *testing.T) {
+	zone := time.FixedZone("NZDT", 13*60*60)
+	now := time.Date(2026, 4, 5, 2, 30, 0, 0, zone)
+
+	s := Format(now, false)
+	assert.Equal(t, "2026-04-05T02:30:00+13:00", s)
+	parsed, err := Parse(s)
+	assert.NoError(t, err)
+	assert.True(t, now.Equal(parsed))
+
+	assert.Equal(t, "2026-04-05 02:30:00", Format(now, true))
+	parsed, err = Parse(" 2026-04-05 02:30:00")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 4, 5, 2, 30, 0, 0, time.Local), parsed)
+
+	_, err = Parse("yesterday")
+	assert.Error(t, err)
+}
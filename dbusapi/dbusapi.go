@@ -0,0 +1,157 @@
+// Package dbusapi adds an API version and a list of capabilities to the hat D-Bus services
+// so clients can check what a device supports instead of failing on a missing method.
+//
+// The version is increased when a method is removed or its signature changes. The old
+// method is kept working for at least one release by adding it to API.Legacy under its old
+// name, with a function that calls the new method.
+package dbusapi
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/introspect"
+	"github.com/godbus/dbus/prop"
+)
+
+const (
+	VersionProperty      = "APIVersion"
+	CapabilitiesProperty = "Capabilities"
+)
+
+// API describes the D-Bus API of a service.
+type API struct {
+	Version      int
+	Capabilities []string
+	// Methods with an old signature, by name, that are kept for older clients.
+	Legacy map[string]interface{}
+}
+
+// Export exports the methods of v and the legacy methods on the interface, along with the
+// API properties, any extra properties and the introspection data.
+func Export(conn *dbus.Conn, v interface{}, path dbus.ObjectPath, iface string, api API, extraProps map[string]*prop.Prop) (*prop.Properties, error) {
+	methods, err := methodTable(v, api.Legacy)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.ExportMethodTable(methods, path, iface); err != nil {
+		return nil, err
+	}
+	props := map[string]*prop.Prop{
+		VersionProperty:      {Value: int32(api.Version), Emit: prop.EmitFalse},
+		CapabilitiesProperty: {Value: api.Capabilities, Emit: prop.EmitFalse},
+	}
+	for name, p := range extraProps {
+		props[name] = p
+	}
+	properties := prop.New(conn, path, map[string]map[string]*prop.Prop{iface: props})
+	node := &introspect.Node{
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{
+				Name:       iface,
+				Methods:    introspect.Methods(v),
+				Properties: properties.Introspection(iface),
+			},
+		},
+	}
+	if err := conn.Export(introspect.NewIntrospectable(node), path, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
+
+var dbusErrType = reflect.TypeOf((*dbus.Error)(nil))
+
+// isDBusMethod checks the function returns a *dbus.Error last, like methods exported by dbus.
+func isDBusMethod(t reflect.Type) bool {
+	return t.Kind() == reflect.Func && t.NumOut() > 0 && t.Out(t.NumOut()-1) == dbusErrType
+}
+
+// methodTable returns the D-Bus methods of v with the legacy methods added. A legacy
+// method can't have the same name as a current method.
+func methodTable(v interface{}, legacy map[string]interface{}) (map[string]interface{}, error) {
+	methods := map[string]interface{}{}
+	val := reflect.ValueOf(v)
+	for i := 0; i < val.NumMethod(); i++ {
+		if isDBusMethod(val.Method(i).Type()) {
+			methods[val.Type().Method(i).Name] = val.Method(i).Interface()
+		}
+	}
+	for name, f := range legacy {
+		if _, ok := methods[name]; ok {
+			return nil, fmt.Errorf("legacy method %s clashes with a current method", name)
+		}
+		if !isDBusMethod(reflect.TypeOf(f)) {
+			return nil, fmt.Errorf("legacy method %s needs to be a function returning *dbus.Error last", name)
+		}
+		methods[name] = f
+	}
+	return methods, nil
+}
+
+// GetAPI reads the API of a service. Services from before the API was versioned don't have
+// the properties and are returned as version 0 with no capabilities.
+func GetAPI(obj dbus.BusObject, iface string) (API, error) {
+	v, err := obj.GetProperty(iface + "." + VersionProperty)
+	if isMissingProperty(err) {
+		return API{}, nil
+	}
+	if err != nil {
+		return API{}, err
+	}
+	version, ok := v.Value().(int32)
+	if !ok {
+		return API{}, fmt.Errorf("unexpected %s type %T", VersionProperty, v.Value())
+	}
+	api := API{Version: int(version)}
+	v, err = obj.GetProperty(iface + "." + CapabilitiesProperty)
+	if err != nil {
+		return api, err
+	}
+	if api.Capabilities, ok = v.Value().([]string); !ok {
+		return api, fmt.Errorf("unexpected %s type %T", CapabilitiesProperty, v.Value())
+	}
+	return api, nil
+}
+
+// missingPropertyErrors are the errors returned when getting a property a service doesn't have.
+var missingPropertyErrors = []string{
+	"org.freedesktop.DBus.Error.UnknownInterface",
+	"org.freedesktop.DBus.Error.UnknownMethod",
+	"org.freedesktop.DBus.Error.UnknownProperty",
+	"org.freedesktop.DBus.Properties.Error.PropertyNotFound",
+}
+
+func isMissingProperty(err error) bool {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) {
+		return slices.Contains(missingPropertyErrors, dbusErr.Name)
+	}
+	var dbusErrPtr *dbus.Error
+	if errors.As(err, &dbusErrPtr) {
+		return slices.Contains(missingPropertyErrors, dbusErrPtr.Name)
+	}
+	return false
+}
+
+// Supports returns if the service has the capability.
+func (a API) Supports(capability string) bool {
+	return slices.Contains(a.Capabilities, capability)
+}
+
+// Require returns an error saying what is missing if the service doesn't have the capability.
+func Require(obj dbus.BusObject, iface, capability string) error {
+	api, err := GetAPI(obj, iface)
+	if err != nil {
+		return err
+	}
+	if !api.Supports(capability) {
+		return fmt.Errorf("%s API version %d doesn't support '%s', the device may need updating", iface, api.Version, capability)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package dbusapi
+
+import (
+	"testing"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+type testService struct{}
+
+func (testService) StayOnFor(seconds int) *dbus.Error { return nil }
+func (testService) Status() (string, *dbus.Error)     { return "", nil }
+func (testService) Helper() string                    { return "" }
+
+func TestMethodTable(t *testing.T) {
+	s := testService{}
+	legacy := map[string]interface{}{
+		// Old signature taking minutes, calls the new method.
+		"StayOnForMinutes": func(minutes int) *dbus.Error { return s.StayOnFor(minutes * 60) },
+	}
+	methods, err := methodTable(s, legacy)
+	assert.NoError(t, err)
+	assert.Len(t, methods, 3)
+	assert.Contains(t, methods, "StayOnFor")
+	assert.Contains(t, methods, "StayOnForMinutes")
+	assert.NotContains(t, methods, "Helper")
+
+	_, err = methodTable(s, map[string]interface{}{"Status": func() *dbus.Error { return nil }})
+	assert.Error(t, err)
+	_, err = methodTable(s, map[string]interface{}{"Old": func() error { return nil }})
+	assert.Error(t, err)
+}
+
+func TestSupports(t *testing.T) {
+	api := API{Version: 1, Capabilities: []string{"auxPower"}}
+	assert.True(t, api.Supports("auxPower"))
+	assert.False(t, api.Supports("powerPolicy"))
+	assert.False(t, API{}.Supports("auxPower"))
+
+	assert.True(t, isMissingProperty(dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownInterface"}))
+	assert.False(t, isMissingProperty(dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}))
+}
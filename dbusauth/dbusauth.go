@@ -0,0 +1,231 @@
+// Package dbusauth checks that the caller of a dangerous method on the hat D-Bus services,
+// such as keeping the RPi on or writing to an I2C register, is allowed to call it.
+//
+// By default only the users in allow-users can call them. The users can be set for each
+// method, or polkit can be used instead with the actions in org.cacophony.hat.policy:
+//
+//	[dbus-access]
+//	allow-users = ["root", "pi"]
+//	[dbus-access.methods]
+//	"org.cacophony.ATtiny.StayOnFor" = ["root", "pi", "salt"]
+//
+// Denied calls are logged and reported with a dbusAccessDenied event.
+package dbusauth
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/godbus/dbus"
+)
+
+const (
+	ConfigKey       = "dbus-access"
+	ErrAccessDenied = "org.cacophony.Error.AccessDenied"
+)
+
+var log = logging.NewLogger("info")
+
+// Config is the access policy.
+type Config struct {
+	Enable     bool     `mapstructure:"enable"`
+	Polkit     bool     `mapstructure:"polkit"`
+	AllowUsers []string `mapstructure:"allow-users"`
+	// Users allowed to call a method, by the full method name, in place of AllowUsers.
+	Methods map[string][]string `mapstructure:"methods"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Enable:     true,
+		AllowUsers: []string{"root", "pi"},
+	}
+}
+
+// LoadConfig returns the access policy from the config. The default policy is returned
+// with the error if the config can't be read, so the methods are still protected.
+func LoadConfig(configDir string) (Config, error) {
+	c := DefaultConfig()
+	config, err := goconfig.New(configDir)
+	if err != nil {
+		return c, err
+	}
+	if err := configcompat.Unmarshal(config, ConfigKey, &c); err != nil {
+		return DefaultConfig(), err
+	}
+	return c, nil
+}
+
+// Authorizer checks the callers of the methods on a D-Bus interface. A nil Authorizer
+// allows all calls.
+type Authorizer struct {
+	iface  string
+	config Config
+
+	callerUID   func(sender string) (uint32, error)
+	lookupUser  func(name string) (uint32, error)
+	polkitCheck func(sender, action string) (bool, error)
+}
+
+func New(conn *dbus.Conn, iface string, config Config) *Authorizer {
+	return &Authorizer{
+		iface:  iface,
+		config: config,
+		callerUID: func(sender string) (uint32, error) {
+			var uid uint32
+			err := conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, sender).Store(&uid)
+			return uid, err
+		},
+		lookupUser: lookupUser,
+		polkitCheck: func(sender, action string) (bool, error) {
+			return checkPolkit(conn, sender, action)
+		},
+	}
+}
+
+// NewWithUsers returns an Authorizer that takes the senders as user names, with the UIDs of
+// the users from the map and polkit refusing everything. It is for testing the checks in the
+// services without a bus.
+func NewWithUsers(iface string, config Config, uids map[string]uint32) *Authorizer {
+	lookup := func(name string) (uint32, error) {
+		uid, ok := uids[name]
+		if !ok {
+			return 0, fmt.Errorf("no user %s", name)
+		}
+		return uid, nil
+	}
+	return &Authorizer{
+		iface:       iface,
+		config:      config,
+		callerUID:   lookup,
+		lookupUser:  lookup,
+		polkitCheck: func(sender, action string) (bool, error) { return false, nil },
+	}
+}
+
+// Check returns an access denied error if the sender isn't allowed to call the method.
+func (a *Authorizer) Check(sender dbus.Sender, method string) *dbus.Error {
+	if a == nil || !a.config.Enable {
+		return nil
+	}
+	fullMethod := a.iface + "." + method
+	uid, err := a.callerUID(string(sender))
+	if err != nil {
+		return a.deny(fullMethod, string(sender), -1, fmt.Sprintf("failed to get caller user: %v", err))
+	}
+	if uid == 0 {
+		return nil
+	}
+	if a.config.Polkit {
+		allowed, err := a.polkitCheck(string(sender), PolkitAction(fullMethod))
+		if err != nil {
+			return a.deny(fullMethod, string(sender), int64(uid), fmt.Sprintf("polkit check failed: %v", err))
+		}
+		if !allowed {
+			return a.deny(fullMethod, string(sender), int64(uid), "not authorised by polkit")
+		}
+		return nil
+	}
+	users, ok := a.config.Methods[fullMethod]
+	if !ok {
+		users = a.config.AllowUsers
+	}
+	for _, name := range users {
+		allowedUID, err := a.lookupUser(name)
+		if err != nil {
+			log.Debugf("Unknown user '%s' in %s config: %v", name, ConfigKey, err)
+			continue
+		}
+		if allowedUID == uid {
+			return nil
+		}
+	}
+	return a.deny(fullMethod, string(sender), int64(uid), "user not allowed")
+}
+
+// CheckOwner returns an access denied error if the sender isn't the owner, the sender that
+// registered something such as a stay on hold, or root. Anything without an owner can be
+// changed by any sender.
+func (a *Authorizer) CheckOwner(sender dbus.Sender, owner, method string) *dbus.Error {
+	if a == nil || !a.config.Enable || owner == "" || string(sender) == owner {
+		return nil
+	}
+	fullMethod := a.iface + "." + method
+	uid, err := a.callerUID(string(sender))
+	if err != nil {
+		return a.deny(fullMethod, string(sender), -1, fmt.Sprintf("failed to get caller user: %v", err))
+	}
+	if uid == 0 {
+		return nil
+	}
+	return a.deny(fullMethod, string(sender), int64(uid), fmt.Sprintf("registered by %s", owner))
+}
+
+func (a *Authorizer) deny(method, sender string, uid int64, reason string) *dbus.Error {
+	log.Printf("Denied call to %s from %s (uid %d): %s", method, sender, uid, reason)
+	err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.DBusAccessDenied, time.Now(), eventhelper.AccessDenial{
+		Method: method,
+		Sender: sender,
+		UID:    uid,
+		Reason: reason,
+	}))
+	if err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+	return dbus.NewError(ErrAccessDenied, []interface{}{fmt.Sprintf("not allowed to call %s", method)})
+}
+
+// PolkitAction returns the polkit action ID for the method, polkit only allows lower case IDs.
+func PolkitAction(method string) string {
+	return strings.ToLower(method)
+}
+
+func lookupUser(name string) (uint32, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+type polkitSubject struct {
+	Kind    string
+	Details map[string]dbus.Variant
+}
+
+type polkitResult struct {
+	IsAuthorized bool
+	IsChallenge  bool
+	Details      map[string]string
+}
+
+// checkPolkit asks polkit if the sender is authorised for the action, without prompting.
+func checkPolkit(conn *dbus.Conn, sender, action string) (bool, error) {
+	subject := polkitSubject{
+		Kind:    "system-bus-name",
+		Details: map[string]dbus.Variant{"name": dbus.MakeVariant(sender)},
+	}
+	result := polkitResult{}
+	obj := conn.Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority")
+	err := obj.Call("org.freedesktop.PolicyKit1.Authority.CheckAuthorization", 0,
+		subject, action, map[string]string{}, uint32(0), "").Store(&result)
+	return result.IsAuthorized, err
+}
+
+// Load returns an Authorizer with the policy from the config, falling back to the default
+// policy if the config can't be read.
+func Load(conn *dbus.Conn, iface, configDir string) *Authorizer {
+	config, err := LoadConfig(configDir)
+	if err != nil {
+		log.Printf("Failed to read %s config, using the default policy: %v", ConfigKey, err)
+	}
+	return New(conn, iface, config)
+}
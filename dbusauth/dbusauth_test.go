@@ -0,0 +1,96 @@
+package dbusauth
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAuthorizer(config Config) *Authorizer {
+	uids := map[string]uint32{"root": 0, "pi": 1000, "salt": 1001}
+	return &Authorizer{
+		iface:  "org.cacophony.ATtiny",
+		config: config,
+		callerUID: func(sender string) (uint32, error) {
+			uid, ok := uids[sender]
+			if !ok {
+				return 0, fmt.Errorf("no connection %s", sender)
+			}
+			return uid, nil
+		},
+		lookupUser: func(name string) (uint32, error) {
+			uid, ok := uids[name]
+			if !ok {
+				return 0, fmt.Errorf("no user %s", name)
+			}
+			return uid, nil
+		},
+		polkitCheck: func(sender, action string) (bool, error) {
+			return sender == "salt" && action == "org.cacophony.attiny.stayonfor", nil
+		},
+	}
+}
+
+func TestCheckAllowUsers(t *testing.T) {
+	events := eventtest.Capture(t)
+	config := DefaultConfig()
+	config.AllowUsers = []string{"pi", "nobody"}
+	config.Methods = map[string][]string{"org.cacophony.ATtiny.StayOnFor": {"salt"}}
+	a := newTestAuthorizer(config)
+
+	assert.Nil(t, a.Check("root", "SetAuxPower"), "root is always allowed")
+	assert.Nil(t, a.Check("pi", "SetAuxPower"))
+	assert.NotNil(t, a.Check("salt", "SetAuxPower"))
+	assert.Nil(t, a.Check("salt", "StayOnFor"))
+	err := a.Check("pi", "StayOnFor")
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrAccessDenied, err.Name)
+	assert.NotNil(t, a.Check("unknown", "SetAuxPower"))
+
+	assert.Len(t, events.Events(), 3)
+	assert.Equal(t, "dbusAccessDenied", events.Events()[0].Type)
+	assert.Equal(t, "org.cacophony.ATtiny.SetAuxPower", events.Events()[0].Details["method"])
+	assert.Equal(t, int64(1001), events.Events()[0].Details["uid"])
+}
+
+func TestCheckPolkit(t *testing.T) {
+	events := eventtest.Capture(t)
+	config := DefaultConfig()
+	config.Polkit = true
+	a := newTestAuthorizer(config)
+
+	assert.Nil(t, a.Check("salt", "StayOnFor"))
+	assert.NotNil(t, a.Check("pi", "StayOnFor"), "allow-users isn't used with polkit")
+	assert.Len(t, events.Events(), 1)
+}
+
+func TestCheckDisabled(t *testing.T) {
+	events := eventtest.Capture(t)
+	a := newTestAuthorizer(Config{})
+	assert.Nil(t, a.Check("unknown", "StayOnFor"))
+
+	var nilAuthorizer *Authorizer
+	assert.Nil(t, nilAuthorizer.Check("unknown", "StayOnFor"))
+	assert.Empty(t, events.Events())
+}
+
+func TestCheckOwner(t *testing.T) {
+	events := eventtest.Capture(t)
+	a := newTestAuthorizer(DefaultConfig())
+
+	assert.Nil(t, a.CheckOwner("pi", "pi", "StayOnFinished"))
+	assert.Nil(t, a.CheckOwner("root", "pi", "StayOnFinished"), "root can change anything")
+	assert.Nil(t, a.CheckOwner("salt", "", "StayOnFinished"), "nothing has been registered")
+	err := a.CheckOwner("salt", "pi", "StayOnFinished")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrAccessDenied, err.Name)
+	}
+	assert.NotNil(t, a.CheckOwner("unknown", "pi", "QuiesceDone"))
+	assert.Equal(t, []string{"dbusAccessDenied", "dbusAccessDenied"}, events.Types())
+	assert.Equal(t, "registered by pi", events.Events()[0].Details["reason"])
+
+	var nilAuthorizer *Authorizer
+	assert.Nil(t, nilAuthorizer.CheckOwner("salt", "pi", "StayOnFinished"))
+}
@@ -0,0 +1,74 @@
+package eeprom
+
+import (
+	"fmt"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+)
+
+// Expansion boards stacked on the hat have their EEPROM at one of the alternate addresses
+// set by the address pins on the board. The main hat is always at EEPROM_ADDRESS.
+const (
+	EXPANSION_EEPROM_FIRST_ADDRESS = 0x51
+	EXPANSION_EEPROM_LAST_ADDRESS  = 0x57
+)
+
+// Board is an expansion board found on the I2C bus.
+type Board struct {
+	Name    string        `json:"name"`
+	Address byte          `json:"address"`
+	Data    *EepromDataV2 `json:"data"`
+}
+
+// BoardName is the name of the expansion board with the EEPROM at the address, this is used
+// to namespace the board's settings in the config and tag its events.
+func BoardName(address byte) string {
+	return fmt.Sprintf("board%d", address-EEPROM_ADDRESS)
+}
+
+// BoardAddress returns the EEPROM address of the expansion board with the name.
+func BoardAddress(name string) (byte, error) {
+	for address := byte(EXPANSION_EEPROM_FIRST_ADDRESS); address <= EXPANSION_EEPROM_LAST_ADDRESS; address++ {
+		if BoardName(address) == name {
+			return address, nil
+		}
+	}
+	return 0, fmt.Errorf("'%s' is not a valid board name", name)
+}
+
+// ReadBoard reads the EEPROM of the expansion board at the address. Expansion boards only
+// use V2 EEPROM data.
+func ReadBoard(address byte) (*Board, error) {
+	if err := i2crequest.CheckAddress(address, 1000); err != nil {
+		return nil, fmt.Errorf("no board found at 0x%X: %v", address, err)
+	}
+	version, err := getEEPROMDataVersion(address)
+	if err != nil {
+		return nil, err
+	}
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported EEPROM data version %d on board at 0x%X", version, address)
+	}
+	data, err := readEEPROMV2FromChip(address)
+	if err != nil {
+		return nil, err
+	}
+	return &Board{Name: BoardName(address), Address: address, Data: data}, nil
+}
+
+// EnumerateBoards returns the expansion boards found on the I2C bus.
+func EnumerateBoards() []Board {
+	boards := []Board{}
+	for address := byte(EXPANSION_EEPROM_FIRST_ADDRESS); address <= EXPANSION_EEPROM_LAST_ADDRESS; address++ {
+		if i2crequest.CheckAddress(address, 1000) != nil {
+			continue
+		}
+		board, err := ReadBoard(address)
+		if err != nil {
+			log.Printf("Error reading expansion board at 0x%X: %v", address, err)
+			continue
+		}
+		boards = append(boards, *board)
+	}
+	return boards
+}
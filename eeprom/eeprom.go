@@ -12,7 +12,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
 	"github.com/TheCacophonyProject/go-utils/logging"
 	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
 )
@@ -36,6 +35,11 @@ var noEEPROMChipData = &EepromDataV1{
 
 var log = logging.NewLogger("info")
 
+// DataChanged reports the EEPROM data on the chip not matching the data in the file, the data
+// is whichever version was read. eventhelper sets it to make the eepromDataChanged event, it
+// imports this package so it can't be used here.
+var DataChanged = func(fromFile, fromChip interface{}) error { return nil }
+
 // GenerateRandomID generates a 64-bit random identifier
 func GenerateRandomID() uint64 {
 	var id [8]byte
@@ -83,7 +87,7 @@ func InitEEPROM() error {
 		eepromData = noEEPROMChipData
 	} else {
 		// Check what version of data we have on the EEPROM chip.
-		eepromDataVersion, err = getEEPROMDataVersion()
+		eepromDataVersion, err = getEEPROMDataVersion(EEPROM_ADDRESS)
 		if err != nil {
 			return err
 		}
@@ -97,7 +101,7 @@ func InitEEPROM() error {
 				return err
 			}
 		case 0x02:
-			eepromData, err = readEEPROMV2FromChip()
+			eepromData, err = readEEPROMV2FromChip(EEPROM_ADDRESS)
 			if err != nil {
 				return err
 			}
@@ -127,14 +131,9 @@ func InitEEPROM() error {
 	log.Printf("EEPROM data on chip: %+v\n", eepromData)
 	log.Printf("EEPROM data saved to file: %+v\n", eepromDataFromFile)
 	log.Println("The EEPROM data has changed. This is probably because of a change in hardware.")
-	eventclient.AddEvent(eventclient.Event{
-		Timestamp: time.Now(),
-		Type:      "eepromDataChanged",
-		Details: map[string]interface{}{
-			"eepromDataFromFile": eepromDataFromFile,
-			"eepromDataFromChip": eepromData,
-		},
-	})
+	if err := DataChanged(eepromDataFromFile, eepromData); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
 
 	log.Println("Writing new EEPROM data to file.")
 	err = writeEEPROMToFile(eepromData)
@@ -145,9 +144,58 @@ func InitEEPROM() error {
 	return nil
 }
 
-func getEEPROMDataVersion() (byte, error) {
+// RepairEEPROMFile moves the EEPROM data file aside and writes a new one from the EEPROM chip.
+func RepairEEPROMFile() error {
+	if _, err := os.Stat(EEPROM_FILE); err == nil {
+		backup := fmt.Sprintf("%s.%s.bak", EEPROM_FILE, time.Now().Format("20060102-150405"))
+		log.Printf("Moving %s to %s", EEPROM_FILE, backup)
+		if err := os.Rename(EEPROM_FILE, backup); err != nil {
+			return err
+		}
+	}
+	if err := InitEEPROM(); err != nil {
+		return err
+	}
+	_, err := readEEPROMFromFile()
+	return err
+}
+
+// VerifyEEPROM checks the checksum of the data on the EEPROM chip and that the EEPROM data
+// file can be read and matches the chip.
+func VerifyEEPROM() error {
+	if noEEPROMChip() {
+		_, err := readEEPROMFromFile()
+		return err
+	}
+	version, err := getEEPROMDataVersion(EEPROM_ADDRESS)
+	if err != nil {
+		return err
+	}
+	var chipData interface{}
+	switch version {
+	case 0x01:
+		chipData, err = readEEPROMV1FromChip()
+	case 0x02:
+		chipData, err = readEEPROMV2FromChip(EEPROM_ADDRESS)
+	default:
+		return fmt.Errorf("unknown EEPROM data version: %d", version)
+	}
+	if err != nil {
+		return err
+	}
+	fileData, err := readEEPROMFromFile()
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(chipData, fileData) {
+		return errors.New("EEPROM data file doesn't match the EEPROM chip")
+	}
+	return nil
+}
+
+func getEEPROMDataVersion(address byte) (byte, error) {
 	// Read first byte to check what version of eeprom data we have.
-	data, err := i2crequest.Tx(EEPROM_ADDRESS, []byte{0x00}, 2, 1000)
+	data, err := i2crequest.Tx(address, []byte{0x00}, 2, 1000)
 	if err != nil {
 		return 0xFF, err
 	}
@@ -305,3 +353,20 @@ func GetPowerPCBVersion() (string, error) {
 		return "", fmt.Errorf("unknown eeprom data type")
 	}
 }
+
+// GetHatID returns the random ID written into the hat EEPROM when it was provisioned.
+func GetHatID() (uint64, error) {
+	eepromData, err := readEEPROMFromFile()
+	if err != nil {
+		return 0, err
+	}
+
+	switch eepromData := eepromData.(type) {
+	case *EepromDataV1:
+		return eepromData.ID, nil
+	case *EepromDataV2:
+		return eepromData.ID, nil
+	default:
+		return 0, fmt.Errorf("unknown eeprom data type")
+	}
+}
@@ -107,3 +107,12 @@ func TestDeepEqualV2(t *testing.T) {
 	assert.True(t, reflect.DeepEqual(data1V2, data2V2))
 	assert.False(t, reflect.DeepEqual(data1V2, data3V2))
 }
+
+func TestBoardNames(t *testing.T) {
+	assert.Equal(t, "board1", BoardName(EXPANSION_EEPROM_FIRST_ADDRESS))
+	address, err := BoardAddress("board7")
+	assert.NoError(t, err)
+	assert.Equal(t, byte(EXPANSION_EEPROM_LAST_ADDRESS), address)
+	_, err = BoardAddress("board0") // The main hat isn't an expansion board.
+	assert.Error(t, err)
+}
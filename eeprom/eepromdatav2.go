@@ -19,7 +19,14 @@ type EepromDataV2 struct {
 	AudioOnly     bool      `json:"audioOnly"`
 }
 
-func readEEPROMV2FromChip() (*EepromDataV2, error) {
+// txFunc makes an I2C transaction, matching i2crequest.Tx.
+type txFunc func(address byte, write []byte, readLen, timeout int) ([]byte, error)
+
+func readEEPROMV2FromChip(address byte) (*EepromDataV2, error) {
+	return readEEPROMV2(i2crequest.Tx, address)
+}
+
+func readEEPROMV2(tx txFunc, address byte) (*EepromDataV2, error) {
 	// Length of data:
 	// Magic: 1
 	// Version: 1
@@ -34,7 +41,7 @@ func readEEPROMV2FromChip() (*EepromDataV2, error) {
 	data := []byte{}
 	for i := 0; i < eepromDataLength; i += pageLength {
 		readLen := min(pageLength, eepromDataLength-i)
-		pageData, err := i2crequest.Tx(EEPROM_ADDRESS, []byte{byte(i)}, readLen, 1000)
+		pageData, err := tx(address, []byte{byte(i)}, readLen, 1000)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,134 @@
+package eeprom
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+)
+
+const (
+	eepromPageLength = 16 // Writes can't cross a page boundary on the EEPROM chip.
+	eepromWriteCycle = 10 * time.Millisecond
+)
+
+// provisioner writes to the EEPROM chip through tx, waiting for each write cycle with sleep.
+type provisioner struct {
+	tx    txFunc
+	sleep func(time.Duration)
+}
+
+func newProvisioner() *provisioner {
+	return &provisioner{
+		tx:    i2crequest.Tx,
+		sleep: time.Sleep,
+	}
+}
+
+// ProvisionOptions is the data to provision a board with.
+type ProvisionOptions struct {
+	MainPCB       SemVer
+	PowerPCB      SemVer
+	TouchPCB      SemVer
+	MicrophonePCB SemVer
+	AudioOnly     bool
+	// Overwrite a board that has already been provisioned with different data.
+	Force bool
+	// If set this is called to disable the write protection before writing and to
+	// enable it again after the data has been verified.
+	SetWriteProtect func(protect bool) error
+}
+
+// ProvisionResult describes what Provision did.
+type ProvisionResult struct {
+	Data *EepromDataV2
+	// False if the board already had the same data so nothing was written.
+	Written bool
+}
+
+// Provision writes the hardware versions to the main EEPROM chip, then reads it back and
+// checks the data and CRC. If the chip already has the same hardware versions nothing is
+// written, so it is safe to run again. A board that has been provisioned with different
+// data is only overwritten with Force, the board ID is kept when it is overwritten.
+func Provision(opts ProvisionOptions) (*ProvisionResult, error) {
+	return newProvisioner().provision(opts)
+}
+
+func (p *provisioner) provision(opts ProvisionOptions) (*ProvisionResult, error) {
+	existing, err := readEEPROMV2(p.tx, EEPROM_ADDRESS)
+	provisioned := err == nil || errors.Is(err, errEepromCRCFail)
+	if err != nil && !errors.Is(err, errEepromEmptyError) {
+		log.Printf("Existing EEPROM data can't be used: %v", err)
+	}
+
+	data := &EepromDataV2{
+		Version:       2,
+		MainPCB:       opts.MainPCB,
+		PowerPCB:      opts.PowerPCB,
+		TouchPCB:      opts.TouchPCB,
+		MicrophonePCB: opts.MicrophonePCB,
+		AudioOnly:     opts.AudioOnly,
+		ID:            GenerateRandomID(),
+		Time:          time.Now().Truncate(time.Second),
+	}
+	if err == nil {
+		if sameHardware(existing, data) {
+			log.Println("EEPROM is already provisioned with this data")
+			return &ProvisionResult{Data: existing}, nil
+		}
+		if !opts.Force {
+			return nil, fmt.Errorf("EEPROM is already provisioned with %+v, use force to overwrite it", *existing)
+		}
+		data.ID = existing.ID
+	} else if provisioned && !opts.Force {
+		return nil, fmt.Errorf("EEPROM has data that failed the CRC check, use force to overwrite it")
+	}
+
+	if opts.SetWriteProtect != nil {
+		if err := opts.SetWriteProtect(false); err != nil {
+			return nil, fmt.Errorf("failed to disable write protection: %v", err)
+		}
+	}
+	if err := p.writeChip(EEPROM_ADDRESS, data.WriteData()); err != nil {
+		return nil, err
+	}
+	readBack, err := readEEPROMV2(p.tx, EEPROM_ADDRESS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify EEPROM data: %v", err)
+	}
+	if !sameHardware(readBack, data) || readBack.ID != data.ID || !readBack.Time.Equal(data.Time) {
+		return nil, fmt.Errorf("EEPROM data read back %+v doesn't match what was written %+v", *readBack, *data)
+	}
+	if opts.SetWriteProtect != nil {
+		if err := opts.SetWriteProtect(true); err != nil {
+			return nil, fmt.Errorf("failed to enable write protection: %v", err)
+		}
+	}
+	log.Printf("Provisioned EEPROM with %+v", *data)
+	return &ProvisionResult{Data: data, Written: true}, nil
+}
+
+// sameHardware checks if the data describes the same hardware, ignoring the ID and time.
+func sameHardware(a, b *EepromDataV2) bool {
+	return a.Version == b.Version &&
+		a.MainPCB == b.MainPCB &&
+		a.PowerPCB == b.PowerPCB &&
+		a.TouchPCB == b.TouchPCB &&
+		a.MicrophonePCB == b.MicrophonePCB &&
+		a.AudioOnly == b.AudioOnly
+}
+
+// writeChip writes the data from the start of the EEPROM one page at a time,
+// waiting for the write cycle of each page to finish.
+func (p *provisioner) writeChip(address byte, data []byte) error {
+	for i := 0; i < len(data); i += eepromPageLength {
+		end := min(i+eepromPageLength, len(data))
+		write := append([]byte{byte(i)}, data[i:end]...)
+		if _, err := p.tx(address, write, 0, 1000); err != nil {
+			return fmt.Errorf("failed to write EEPROM page at 0x%02X: %v", i, err)
+		}
+		p.sleep(eepromWriteCycle)
+	}
+	return nil
+}
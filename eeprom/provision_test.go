@@ -0,0 +1,75 @@
+package eeprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChip returns a provisioner that uses an in memory EEPROM chip.
+func fakeChip() (*provisioner, []byte) {
+	mem := make([]byte, 256)
+	for i := range mem {
+		mem[i] = 0xFF
+	}
+	p := &provisioner{
+		sleep: func(time.Duration) {},
+		tx: func(address byte, write []byte, readLen, timeout int) ([]byte, error) {
+			offset := int(write[0])
+			copy(mem[offset:], write[1:])
+			return append([]byte{}, mem[offset:offset+readLen]...), nil
+		},
+	}
+	return p, mem
+}
+
+func TestProvision(t *testing.T) {
+	p, mem := fakeChip()
+	opts := ProvisionOptions{
+		MainPCB:  SemVer{Major: 0, Minor: 3, Patch: 0},
+		PowerPCB: SemVer{Major: 0, Minor: 7, Patch: 0},
+	}
+	protected := []bool{}
+	opts.SetWriteProtect = func(protect bool) error {
+		protected = append(protected, protect)
+		return nil
+	}
+
+	result, err := p.provision(opts)
+	assert.NoError(t, err)
+	assert.True(t, result.Written)
+	assert.Equal(t, []bool{false, true}, protected)
+	assert.Equal(t, byte(EEPROM_FIRST_BYTE), mem[0])
+	id := result.Data.ID
+
+	// Running again with the same versions doesn't write anything.
+	result, err = p.provision(opts)
+	assert.NoError(t, err)
+	assert.False(t, result.Written)
+	assert.Equal(t, id, result.Data.ID)
+
+	// Different versions need force, the ID is kept.
+	opts.PowerPCB = SemVer{Major: 0, Minor: 8, Patch: 0}
+	_, err = p.provision(opts)
+	assert.Error(t, err)
+	opts.Force = true
+	result, err = p.provision(opts)
+	assert.NoError(t, err)
+	assert.True(t, result.Written)
+	assert.Equal(t, id, result.Data.ID)
+	assert.Equal(t, opts.PowerPCB, result.Data.PowerPCB)
+}
+
+func TestProvisionCorruptData(t *testing.T) {
+	p, mem := fakeChip()
+	data := (&EepromDataV2{Version: 2, ID: 1, Time: time.Unix(1000, 0)}).WriteData()
+	data[5] ^= 0xFF
+	copy(mem, data)
+
+	_, err := p.provision(ProvisionOptions{})
+	assert.Error(t, err)
+	result, err := p.provision(ProvisionOptions{Force: true})
+	assert.NoError(t, err)
+	assert.True(t, result.Written)
+}
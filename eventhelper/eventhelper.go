@@ -0,0 +1,146 @@
+package eventhelper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+	"github.com/TheCacophonyProject/tc2-hat-controller/safemode"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
+)
+
+const (
+	deploymentKey          = "deployment"
+	safeModeKey            = "safeMode"
+	metadataReloadInterval = 10 * time.Minute
+)
+
+var (
+	log = logging.NewLogger("info")
+
+	ConfigDir = standalone.ConfigDirOr(goconfig.DefaultConfigDir)
+
+	mu             sync.Mutex
+	metadata       map[string]interface{}
+	metadataLoaded time.Time
+
+	sinkMu sync.Mutex
+	sink   func(eventclient.Event) error
+)
+
+// AddEvent adds the deployment metadata (device group, ID and name, location and hardware
+// versions) to the event details and then sends the event to the event-reporter.
+// If any service is running in safe mode that is also added to the event.
+// Events that don't match the definition of their type are logged but still sent. When
+// running standalone the event is written to the local events file instead.
+func AddEvent(event eventclient.Event) error {
+	if event.Details == nil {
+		event.Details = map[string]interface{}{}
+	}
+	if err := Validate(event); err != nil {
+		log.Errorf("%s event doesn't match its definition: %v", event.Type, err)
+	}
+	sinkMu.Lock()
+	send := sink
+	sinkMu.Unlock()
+	if send != nil {
+		return send(event)
+	}
+	if _, ok := event.Details[deploymentKey]; !ok {
+		event.Details[deploymentKey] = getMetadata()
+	}
+	if reasons, err := safemode.Reasons(); err == nil && len(reasons) > 0 {
+		event.Details[safeModeKey] = reasons
+	}
+	if standalone.Enabled() {
+		return standalone.WriteEvent(event)
+	}
+	return eventclient.AddEvent(event)
+}
+
+// SetSink sends the events to the function instead of the event-reporter, without the
+// metadata, until restore is called. It is for tests, see the eventtest package.
+func SetSink(send func(eventclient.Event) error) (restore func()) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	previous := sink
+	sink = send
+	return func() {
+		sinkMu.Lock()
+		defer sinkMu.Unlock()
+		sink = previous
+	}
+}
+
+// ReportSafeMode records that the service is running in safe mode and makes an event for it.
+func ReportSafeMode(service string, reason error) {
+	if err := safemode.Enter(service, reason.Error()); err != nil {
+		log.Printf("Error recording safe mode: %v", err)
+	}
+	err := AddEvent(NewEvent(SafeModeEntered, time.Now(), SafeMode{
+		Service: service,
+		Reason:  reason.Error(),
+	}))
+	if err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+}
+
+func init() {
+	eeprom.DataChanged = func(fromFile, fromChip interface{}) error {
+		return AddEvent(NewEvent(EEPROMDataChanged, time.Now(), EEPROMChange{
+			FromFile: fromFile,
+			FromChip: fromChip,
+		}))
+	}
+}
+
+func getMetadata() map[string]interface{} {
+	mu.Lock()
+	defer mu.Unlock()
+	if metadata == nil || time.Since(metadataLoaded) > metadataReloadInterval {
+		metadata = loadMetadata()
+		metadataLoaded = time.Now()
+	}
+	return metadata
+}
+
+func loadMetadata() map[string]interface{} {
+	m := map[string]interface{}{}
+
+	config, err := goconfig.New(ConfigDir)
+	if err != nil {
+		log.Printf("Error loading config for event metadata: %v", err)
+	} else {
+		device := goconfig.Device{}
+		if err := config.Unmarshal(goconfig.DeviceKey, &device); err != nil {
+			log.Printf("Error reading device config for event metadata: %v", err)
+		} else {
+			m["group"] = device.Group
+			m["deviceID"] = device.ID
+			m["name"] = device.Name
+		}
+		location := goconfig.Location{}
+		if err := config.Unmarshal(goconfig.LocationKey, &location); err != nil {
+			log.Printf("Error reading location config for event metadata: %v", err)
+		} else if location.Latitude != 0 || location.Longitude != 0 {
+			m["location"] = map[string]interface{}{
+				"latitude":  location.Latitude,
+				"longitude": location.Longitude,
+				"altitude":  location.Altitude,
+				"accuracy":  location.Accuracy,
+			}
+		}
+	}
+
+	if version, err := eeprom.GetMainPCBVersion(); err == nil {
+		m["mainPCB"] = version
+	}
+	if version, err := eeprom.GetPowerPCBVersion(); err == nil {
+		m["powerPCB"] = version
+	}
+	return m
+}
@@ -0,0 +1,780 @@
+package eventhelper
+
+import "time"
+
+// Event types with defined details, see schema.go.
+const (
+	// All services
+	SafeModeEntered      = "safeModeEntered"
+	InstanceDisplaced    = "instanceDisplaced"
+	DependencyNotReady   = "dependencyNotReady"
+	ServiceDegraded      = "serviceDegraded"
+	DBusAccessDenied     = "dbusAccessDenied"
+	ConfigSchemaMismatch = "configSchemaMismatch"
+	EEPROMDataChanged    = "eepromDataChanged"
+
+	// tc2-hat-controller
+	DeviceTwinPublished    = "deviceTwin"
+	ShadowStateRestored    = "shadowStateRestored"
+	ThermalAdvisoryRaised  = "thermalAdvisory"
+	ThermalAdvisoryCleared = "thermalAdvisoryCleared"
+	DataAudited            = "dataAudit"
+	TamperDetected         = "tamperDetected"
+
+	// tc2-hat-rp2040
+	ProgrammingRP2040  = "programmingRP2040"
+	RP2040Unresponsive = "rp2040Unresponsive"
+
+	// tc2-hat-temp
+	TempHumidity             = "tempHumidity"
+	TempTooHigh              = "tempTooHigh"
+	TempTooLow               = "tempTooLow"
+	HumidityTooHigh          = "humidityTooHigh"
+	TempSourceChanged        = "tempSourceChanged"
+	TempSourceMismatch       = "tempSourceMismatch"
+	TempSensorFault          = "tempSensorFault"
+	EnclosureSealDegraded    = "enclosureSealDegraded"
+	HumidityRecoveryStarted  = "humidityRecoveryStarted"
+	HumidityRecoveryFinished = "humidityRecoveryFinished"
+	FanDailySummary          = "fanDailySummary"
+
+	// tc2-hat-attiny
+	RPiBattery              = "rpiBattery"
+	ReportingCadenceChanged = "reportingCadenceChanged"
+	EmergencyBeaconSent     = "emergencyBeacon"
+	BatteryImpedanceHigh    = "batteryImpedanceHigh"
+	BatteryDisconnected     = "batteryDisconnected"
+	BatteryReconnected      = "batteryReconnected"
+	BatteryReplaced         = "batteryReplaced"
+	BatteryChemistryFound   = "batteryChemistryDetected"
+	BatteryTransient        = "batteryTransient"
+	ChargerConnected        = "chargerConnected"
+	ChargeComplete          = "chargeComplete"
+	ChargerDisconnected     = "chargerDisconnected"
+	ATtinyError             = "ATtinyError"
+	ATtinyLinkDegraded      = "attinyLinkDegraded"
+	ProgrammingATtiny       = "programmingAttiny"
+	HatPowerQuality         = "hatPowerQuality"
+	HardwarePairingChanged  = "hardwarePairingChanged"
+	AuxPowerOvercurrent     = "auxPowerOvercurrent"
+	CameraPowerDailySummary = "cameraPowerDailySummary"
+	PowerPolicyAdjusted     = "powerPolicyAdjusted"
+	PowerOffPostponed       = "powerOffPostponed"
+	QuiesceTimedOut         = "quiesceTimeout"
+	RTCHoldupShort          = "rtcHoldupShort"
+	ConsumableLow           = "consumableLow"
+	ConsumableLevels        = "consumableLevels"
+
+	// tc2-hat-rtc
+	RTCNtpDrift       = "rtcNtpDrift"
+	RTCNtpDriftHigh   = "rtcNtpDriftHigh"
+	RTCIntegrityLost  = "rtcIntegrityLost"
+	RTCIntegrityError = "rtcIntegrityError"
+	SuspiciousRTCTime = "suspiciousRtcTime"
+	RTCAlarmCorrected = "rtcAlarmCorrected"
+	GPSFix            = "gpsFix"
+
+	// tc2-hat-comms
+	ProtectedSpeciesSighted = "protectedSpeciesSighted"
+	TrackLatencyExceeded    = "trackLatencyExceeded"
+	ESLNotDetected          = "eslNotDetected"
+	MaintenanceModeStarted  = "maintenanceModeStarted"
+	MaintenanceModeEnded    = "maintenanceModeEnded"
+	CommsHealth             = "commsHealth"
+	Weather                 = "weather"
+	HeavyRainStarted        = "heavyRainStarted"
+	HeavyRainStopped        = "heavyRainStopped"
+	TrapOverrideStarted     = "trapOverrideStarted"
+	TrapOverrideEnded       = "trapOverrideEnded"
+	TrapFailSafeTripped     = "trapFailSafeTripped"
+	TrapScheduleChanged     = "trapScheduleChanged"
+	RemoteCommandRun        = "remoteCommand"
+	SpeciesCalibrated       = "speciesCalibration"
+	RelayBoardFault         = "relayBoardFault"
+	RelayBoardRecovered     = "relayBoardRecovered"
+)
+
+// registrations are the payloads of the event types, registered by init.
+var registrations = []struct {
+	payload    interface{}
+	eventTypes []string
+}{
+	{SafeMode{}, []string{SafeModeEntered}},
+	{InstanceDisplacement{}, []string{InstanceDisplaced}},
+	{DependencyWait{}, []string{DependencyNotReady}},
+	{ServiceDegradation{}, []string{ServiceDegraded}},
+	{AccessDenial{}, []string{DBusAccessDenied}},
+	{ConfigMismatch{}, []string{ConfigSchemaMismatch}},
+	{EEPROMChange{}, []string{EEPROMDataChanged}},
+
+	{DeviceTwin{}, []string{DeviceTwinPublished}},
+	{ShadowRestore{}, []string{ShadowStateRestored}},
+	{ThermalAdvisory{}, []string{ThermalAdvisoryRaised, ThermalAdvisoryCleared}},
+	{DataAudit{}, []string{DataAudited}},
+	{Tamper{}, []string{TamperDetected}},
+
+	{RP2040Programming{}, []string{ProgrammingRP2040}},
+	{RP2040Heartbeat{}, []string{RP2040Unresponsive}},
+
+	{TempReading{}, []string{TempHumidity, TempTooHigh, TempTooLow, HumidityTooHigh}},
+	{TempSourceChange{}, []string{TempSourceChanged}},
+	{TempSourceDisagreement{}, []string{TempSourceMismatch}},
+	{SensorFault{}, []string{TempSensorFault}},
+	{SealDegradation{}, []string{EnclosureSealDegraded}},
+	{HumidityRecoveryStart{}, []string{HumidityRecoveryStarted}},
+	{HumidityRecoveryResult{}, []string{HumidityRecoveryFinished}},
+	{FanSummary{}, []string{FanDailySummary}},
+
+	{BatteryReading{}, []string{RPiBattery}},
+	{CadenceChange{}, []string{ReportingCadenceChanged}},
+	{EmergencyBeacon{}, []string{EmergencyBeaconSent}},
+	{BatteryImpedance{}, []string{BatteryImpedanceHigh}},
+	{RailChange{}, []string{BatteryDisconnected, BatteryReconnected}},
+	{PackSwap{}, []string{BatteryReplaced}},
+	{ChemistryDetection{}, []string{BatteryChemistryFound}},
+	{Transient{}, []string{BatteryTransient}},
+	{ChargerConnection{}, []string{ChargerConnected}},
+	{ChargeCompletion{}, []string{ChargeComplete}},
+	{ChargerDisconnection{}, []string{ChargerDisconnected}},
+	{ATtinyErrors{}, []string{ATtinyError}},
+	{LinkDegradation{}, []string{ATtinyLinkDegraded}},
+	{FirmwareProgramming{}, []string{ProgrammingATtiny}},
+	{PowerQuality{}, []string{HatPowerQuality}},
+	{PairingChange{}, []string{HardwarePairingChanged}},
+	{AuxOvercurrent{}, []string{AuxPowerOvercurrent}},
+	{CameraPowerSummary{}, []string{CameraPowerDailySummary}},
+	{PowerPolicyChange{}, []string{PowerPolicyAdjusted}},
+	{PowerOffPostponement{}, []string{PowerOffPostponed}},
+	{QuiesceTimeout{}, []string{QuiesceTimedOut}},
+	{RTCHoldup{}, []string{RTCHoldupShort}},
+	{ConsumableAlert{}, []string{ConsumableLow}},
+	{ConsumableReport{}, []string{ConsumableLevels}},
+
+	{RTCDrift{}, []string{RTCNtpDrift, RTCNtpDriftHigh}},
+	{RTCIntegrity{}, []string{RTCIntegrityLost, RTCIntegrityError}},
+	{RTCSuspiciousTime{}, []string{SuspiciousRTCTime}},
+	{RTCAlarmCorrection{}, []string{RTCAlarmCorrected}},
+	{GPSPosition{}, []string{GPSFix}},
+
+	{ProtectedSighting{}, []string{ProtectedSpeciesSighted}},
+	{TrackLatency{}, []string{TrackLatencyExceeded}},
+	{WiringDiagnosis{}, []string{ESLNotDetected}},
+	{MaintenancePresence{}, []string{MaintenanceModeStarted, MaintenanceModeEnded}},
+	{CommsHealthReport{}, []string{CommsHealth}},
+	{WeatherReading{}, []string{Weather, HeavyRainStarted, HeavyRainStopped}},
+	{TrapOverride{}, []string{TrapOverrideStarted, TrapOverrideEnded}},
+	{FailSafeTrip{}, []string{TrapFailSafeTripped}},
+	{TrapSchedule{}, []string{TrapScheduleChanged}},
+	{RemoteCommand{}, []string{RemoteCommandRun}},
+	{SpeciesCalibration{}, []string{SpeciesCalibrated}},
+	{RelayBoardStatus{}, []string{RelayBoardFault, RelayBoardRecovered}},
+}
+
+func init() {
+	for _, r := range registrations {
+		// A service shouldn't fail to start over this, the events are still sent without
+		// being checked. TestRegistrations catches it.
+		if err := Register(r.payload, r.eventTypes...); err != nil {
+			log.Errorf("Failed to register event payload: %v", err)
+		}
+	}
+}
+
+// SafeMode is a service running in safe mode, with why.
+type SafeMode struct {
+	Service string `event:"service"`
+	Reason  string `event:"reason"`
+}
+
+// InstanceDisplacement is another instance of the service being stopped, or killed if it
+// didn't stop, by one started with --replace.
+type InstanceDisplacement struct {
+	Service    string `event:"service"`
+	PID        int    `event:"pid"`
+	ReplacedBy int    `event:"replacedBy"`
+	Killed     bool   `event:"killed"`
+}
+
+// DependencyWait is the services a service depends on not being ready in time.
+type DependencyWait struct {
+	Service       string   `event:"service"`
+	NotReady      []string `event:"notReady"`
+	WaitedSeconds int      `event:"waitedSeconds"`
+}
+
+// ServiceDegradation is a service using too many resources or with a stalled loop.
+type ServiceDegradation struct {
+	Service    string   `event:"service"`
+	Reasons    []string `event:"reasons"`
+	Goroutines int      `event:"goroutines"`
+	HeapMB     float64  `event:"heapMB"`
+	Restarting bool     `event:"restarting"`
+}
+
+// AccessDenial is a D-Bus call that was refused.
+type AccessDenial struct {
+	Method string `event:"method"`
+	Sender string `event:"sender"`
+	UID    int64  `event:"uid"`
+	Reason string `event:"reason"`
+}
+
+// ConfigMismatch is the config having fields, or a schema version, the service doesn't know.
+type ConfigMismatch struct {
+	Service             string   `event:"service"`
+	BinaryVersion       string   `event:"binaryVersion"`
+	BinarySchemaVersion int      `event:"binarySchemaVersion"`
+	ConfigSchemaVersion int      `event:"configSchemaVersion"`
+	Section             string   `event:"section,omitempty"`
+	UnknownFields       []string `event:"unknownFields,omitempty"`
+}
+
+// EEPROMChange is the EEPROM data on the chip not matching the saved data, probably from a
+// change in hardware. The data is whichever version of it was read.
+type EEPROMChange struct {
+	FromFile interface{} `event:"eepromDataFromFile"`
+	FromChip interface{} `event:"eepromDataFromChip"`
+}
+
+// DeviceTwin is the state of the device, with the parts that changed since it was last
+// published. The state keys are from the JSON of the twin.
+type DeviceTwin struct {
+	Changed []string               `event:"changed"`
+	State   map[string]interface{} `event:",inline"`
+}
+
+// ShadowRestore is files restored from the shadow copy after they were lost.
+type ShadowRestore struct {
+	Files []string `event:"files"`
+}
+
+// HeatPeak is a time of day the enclosure gets too hot.
+type HeatPeak struct {
+	Start   string  `event:"start"` // HH:MM
+	End     string  `event:"end"`
+	MaxTemp float64 `event:"maxTemp"`
+	HotDays int     `event:"hotDays"`
+}
+
+// ThermalAdvisory is the heat peaks in the temperature history, none when it is cleared.
+type ThermalAdvisory struct {
+	Advisories []string   `event:"advisories,omitempty"`
+	HeatPeaks  []HeatPeak `event:"heatPeaks,omitempty"`
+	Threshold  float64    `event:"threshold"`
+	Days       int        `event:"days"`
+}
+
+// AuditedFile is the result of checking a data file, the quarantined file has the bad lines.
+type AuditedFile struct {
+	File        string `event:"file"`
+	Lines       int    `event:"lines,omitempty"`
+	BadLines    int    `event:"badLines,omitempty"`
+	Quarantined string `event:"quarantined,omitempty"`
+	Error       string `event:"error,omitempty"`
+}
+
+// DataAudit is the data files being checked, with how many had problems.
+type DataAudit struct {
+	Problems int           `event:"problems"`
+	Files    []AuditedFile `event:"files"`
+}
+
+// Tamper is a burst of pulses from the tamper sensor, the intensity is the number of pulses.
+type Tamper struct {
+	Pin            string `event:"pin"`
+	Intensity      int    `event:"intensity"`
+	DurationMs     int64  `event:"durationMs"`
+	PhotoRequested bool   `event:"photoRequested"`
+}
+
+// GPIOInput is a GPIO input changing, its event types are set in the config so they are
+// registered when it is loaded. The details are also from the config.
+type GPIOInput struct {
+	Input   string                 `event:"input"`
+	Pin     string                 `event:"pin"`
+	Active  bool                   `event:"active"`
+	Details map[string]interface{} `event:",inline"`
+}
+
+// TempReading is a temperature and humidity reading. The humidity is nil for readings
+// estimated from the SoC.
+type TempReading struct {
+	Temp            float32  `event:"temp"` // In TempUnit.
+	TempUnit        string   `event:"tempUnit"`
+	Humidity        *float32 `event:"humidity,omitempty"`
+	Source          string   `event:"source"`
+	Estimated       bool     `event:"estimated,omitempty"`
+	HumiditySuspect bool     `event:"humiditySuspect,omitempty"`
+	Board           string   `event:"board,omitempty"` // Empty for the main hat.
+}
+
+// TempSourceChange is the temperature source changing, the reason is why the last source
+// can't be used.
+type TempSourceChange struct {
+	From   string `event:"from"`
+	To     string `event:"to"`
+	Reason string `event:"reason,omitempty"`
+}
+
+// TempSourceDisagreement is the AHT20 and ATtiny readings not agreeing.
+type TempSourceDisagreement struct {
+	Temp           float32 `event:"temp"`
+	Humidity       float32 `event:"humidity"`
+	ATtinyTemp     float32 `event:"attinyTemp"`
+	ATtinyHumidity float32 `event:"attinyHumidity"`
+}
+
+// SensorFault is the temperature sensor giving readings that can't be right.
+type SensorFault struct {
+	Fault    string  `event:"fault"`
+	Temp     float32 `event:"temp"` // In TempUnit.
+	TempUnit string  `event:"tempUnit"`
+	Humidity float32 `event:"humidity"`
+	Address  uint8   `event:"address"`
+	Board    string  `event:"board,omitempty"`
+}
+
+// SealDegradation is the humidity inside the enclosure following the humidity outside, by
+// the "correlation" method, or rising with heavy rain, by the "rain" method. The threshold is
+// of the correlation, or of the rise in humidity with the rain.
+type SealDegradation struct {
+	Method           string  `event:"method"`
+	Correlation      float64 `event:"correlation,omitempty"`
+	Threshold        float64 `event:"threshold"`
+	Humidity         float32 `event:"humidity"`
+	ExternalHumidity float32 `event:"externalHumidity,omitempty"`
+	HumidityRise     float64 `event:"humidityRise,omitempty"` // %RH
+	RainEvents       int     `event:"rainEvents,omitempty"`
+	Board            string  `event:"board,omitempty"`
+}
+
+// HumidityRecoveryStart is the humidity sensor being heated after it has been saturated.
+type HumidityRecoveryStart struct {
+	Humidity       float32 `event:"humidity"`
+	SaturatedHours float64 `event:"saturatedHours"`
+	Board          string  `event:"board,omitempty"`
+}
+
+// HumidityRecoveryResult is the humidity after the sensor has been heated, the error is why
+// heating it failed.
+type HumidityRecoveryResult struct {
+	Humidity       float32 `event:"humidity"`
+	BeforeHumidity float32 `event:"beforeHumidity"`
+	StillSaturated bool    `event:"stillSaturated"`
+	Error          string  `event:"error,omitempty"`
+	Board          string  `event:"board,omitempty"`
+}
+
+// FanSummary is how the fan ran over the day.
+type FanSummary struct {
+	RunSeconds            int     `event:"runSeconds"`
+	AverageDuty           float64 `event:"averageDuty"` // %
+	Starts                int     `event:"starts"`
+	BatteryLimitedSeconds int     `event:"batteryLimitedSeconds"`
+	MaxTemp               float32 `event:"maxTemp"`
+	PeriodSeconds         int     `event:"periodSeconds"`
+}
+
+// BatteryReading is the battery level. The hours remaining is nil when it can't be estimated.
+type BatteryReading struct {
+	Battery                float64  `event:"battery"` // %
+	BatteryType            string   `event:"batteryType"`
+	Voltage                float32  `event:"voltage"`
+	HoursRemaining         *float64 `event:"hoursRemaining,omitempty"`
+	Charger                string   `event:"charger,omitempty"`
+	InternalResistanceOhms float64  `event:"internalResistanceOhms,omitempty"`
+}
+
+// CadenceChange is the reporting cadence changing with the battery level.
+type CadenceChange struct {
+	Level   string  `event:"level"`
+	Profile string  `event:"profile"`
+	Battery float64 `event:"battery"` // %
+}
+
+// EmergencyBeacon is an SOS broadcast for a condition the device can't recover from, with the
+// channels it was sent and failed to be sent over, comma separated.
+type EmergencyBeacon struct {
+	Condition string  `event:"condition"`
+	Sent      string  `event:"sent"`
+	Failed    string  `event:"failed,omitempty"`
+	Battery   float64 `event:"battery"` // %, -1 if it isn't known.
+}
+
+// BatteryImpedance is the internal resistance of the pack rising from where it started, which
+// usually means it is failing.
+type BatteryImpedance struct {
+	Chemistry        string  `event:"chemistry"`
+	BaselineOhms     float64 `event:"baselineOhms"`
+	RecentOhms       float64 `event:"recentOhms"`
+	Rise             float64 `event:"rise"` // Of the recent over the baseline.
+	RiseLimit        float64 `event:"riseLimit"`
+	TrendOhmsPerWeek float64 `event:"trendOhmsPerWeek"`
+	Sessions         int     `event:"sessions"`
+}
+
+// RailChange is a battery rail dropping out or coming back. The level and type are left out
+// for the RTC rail.
+type RailChange struct {
+	Rail              string    `event:"rail"`
+	LastVoltage       float32   `event:"lastVoltage"`
+	LastConnectedTime time.Time `event:"lastConnectedTime"`
+	LastPercent       *float64  `event:"lastPercent,omitempty"`
+	BatteryType       string    `event:"batteryType,omitempty"`
+}
+
+// PackSwap is the battery pack being replaced, with what was learnt about the old pack.
+type PackSwap struct {
+	OldPack                   string    `event:"oldPack"`
+	NewPack                   string    `event:"newPack"`
+	OldPackCycles             float64   `event:"oldPackCycles"` // Discharge in equivalent full cycles.
+	OldChemistry              string    `event:"oldChemistry"`
+	OldLastPercent            float64   `event:"oldLastPercent"`
+	OldPackInstalled          time.Time `event:"oldPackInstalled,omitempty"`
+	OldInternalResistanceOhms float64   `event:"oldInternalResistanceOhms,omitempty"`
+}
+
+// ChemistryDetection is the battery chemistry found from the shape of the discharge curve
+// not being the one guessed from the voltage range.
+type ChemistryDetection struct {
+	Chemistry   string  `event:"chemistry"`
+	RangeGuess  string  `event:"rangeGuess"`
+	Confidence  float64 `event:"confidence"`
+	PlateauRate float64 `event:"plateauRate"`
+	Knee        float64 `event:"knee"`
+	Method      string  `event:"method"`
+}
+
+// Transient is a voltage sag on a battery rail from a load starting. The internal resistance
+// and load current are left out if they couldn't be worked out.
+type Transient struct {
+	Reason                 string  `event:"reason"`
+	Rail                   string  `event:"rail"`
+	BaselineVoltage        float32 `event:"baselineVoltage"`
+	MinVoltage             float32 `event:"minVoltage"`
+	SagVoltage             float32 `event:"sagVoltage"`
+	InternalResistanceOhms float64 `event:"internalResistanceOhms,omitempty"`
+	LoadCurrentA           float64 `event:"loadCurrentA,omitempty"`
+}
+
+// ChargerConnection is the battery starting to charge.
+type ChargerConnection struct {
+	Voltage float32 `event:"voltage"`
+	Battery float64 `event:"battery"` // %
+}
+
+// ChargeCompletion is the battery being fully charged.
+type ChargeCompletion struct {
+	Voltage      float32 `event:"voltage"`
+	Battery      float64 `event:"battery"` // %
+	FloatVoltage float32 `event:"floatVoltage"`
+	ChargeHours  float64 `event:"chargeHours"`
+}
+
+// ChargerDisconnection is the charger being removed, the float voltage is left out if the
+// charge didn't complete.
+type ChargerDisconnection struct {
+	Voltage         float32 `event:"voltage"`
+	Battery         float64 `event:"battery"` // %
+	ConnectedHours  float64 `event:"connectedHours"`
+	MaxVoltage      float32 `event:"maxVoltage"`
+	ChargeCompleted bool    `event:"chargeCompleted"`
+	FloatVoltage    float32 `event:"floatVoltage,omitempty"`
+}
+
+// ATtinyErrors are errors reported by the ATtiny. Errors from its error log only have the
+// approximate time they happened.
+type ATtinyErrors struct {
+	Errors          []string `event:"error"`
+	FromErrorLog    bool     `event:"fromErrorLog,omitempty"`
+	ApproximateTime bool     `event:"approximateTime,omitempty"`
+}
+
+// LinkDegradation is the I2C link to the ATtiny failing too often.
+type LinkDegradation struct {
+	FailureRatePercent float64 `event:"failureRatePercent"`
+	ThresholdPercent   float64 `event:"thresholdPercent"`
+	CRCFailures        int     `event:"crcFailures"`
+	OtherFailures      int     `event:"otherFailures"`
+	Retries            int     `event:"retries"`
+	FailedTransactions int     `event:"failedTransactions"`
+	AvgLatencyMs       float64 `event:"avgLatencyMs"`
+}
+
+// FirmwareProgramming is an attempt to program the ATtiny, with how the firmware was verified.
+type FirmwareProgramming struct {
+	SHA256            string `event:"firmwareSHA256"`
+	Verification      string `event:"firmwareVerification"`
+	Verified          bool   `event:"firmwareVerified"`
+	VerificationError string `event:"firmwareVerificationError,omitempty"`
+	Success           bool   `event:"success"`
+}
+
+// PowerQuality is the resets of the ATtiny since the last RPi boot.
+type PowerQuality struct {
+	LastResetCause string    `event:"lastResetCause"`
+	Resets         uint16    `event:"resets"`
+	BrownOuts      uint16    `event:"brownOuts"`
+	WatchdogResets uint16    `event:"watchdogResets"`
+	TotalBrownOuts uint16    `event:"totalBrownOuts"`
+	Since          time.Time `event:"since,omitempty"`
+}
+
+// PairingChange is the hat or the RPi being swapped. The previous pairing is left out if it
+// wasn't saved.
+type PairingChange struct {
+	Change           string  `event:"change"`
+	DeviceID         uint32  `event:"deviceID"`
+	HatDeviceID      uint32  `event:"hatDeviceID"`
+	HatID            string  `event:"hatID,omitempty"`
+	PreviousDeviceID *uint32 `event:"previousDeviceID,omitempty"`
+	PreviousHatID    string  `event:"previousHatID,omitempty"`
+}
+
+// AuxOvercurrent is the aux power being turned off for drawing too much current. The current
+// is left out if it couldn't be read.
+type AuxOvercurrent struct {
+	LimitMA   int    `event:"limitMA"`
+	TrippedBy string `event:"trippedBy"`
+	CurrentMA *int   `event:"currentMA,omitempty"`
+}
+
+// CameraPowerTotals are the camera power cycles and on time.
+type CameraPowerTotals struct {
+	PowerCycles    int     `event:"powerCycles"`
+	PoweredOnHours float64 `event:"poweredOnHours"`
+	AvgBootSeconds float64 `event:"avgBootSeconds"`
+}
+
+// CameraPowerSummary is the camera power over the day, and in total.
+type CameraPowerSummary struct {
+	PowerCycles    int               `event:"powerCycles"`
+	PoweredOnHours float64           `event:"poweredOnHours"`
+	AvgBootSeconds float64           `event:"avgBootSeconds"`
+	PeriodSeconds  int               `event:"periodSeconds"`
+	OnPercent      float64           `event:"onPercent"`
+	Total          CameraPowerTotals `event:"total"`
+}
+
+// PowerPolicyChange is the power policy changing with the battery left.
+type PowerPolicyChange struct {
+	Level           string    `event:"level"`
+	PreviousLevel   string    `event:"previousLevel"`
+	HoursRemaining  float64   `event:"hoursRemaining"`
+	HoursNeeded     float64   `event:"hoursNeeded"`
+	NextUploadEnd   time.Time `event:"nextUploadEnd"`
+	SkipLowPriority bool      `event:"skipLowPriority"`
+	RecordingCutoff time.Time `event:"recordingCutoff,omitempty"`
+}
+
+// PowerOffPostponement is powering off being postponed, capped if it hit the limit.
+type PowerOffPostponement struct {
+	Postponements    int     `event:"postponements"`
+	PostponedMinutes float64 `event:"postponedMinutes"`
+	Reason           string  `event:"reason"`
+	Capped           bool    `event:"capped"`
+}
+
+// QuiesceTimeout is the services that didn't quiesce before powering off.
+type QuiesceTimeout struct {
+	Services      []string `event:"services"`
+	BudgetSeconds int      `event:"budgetSeconds"`
+}
+
+// RTCHoldup is the RTC supercap not lasting until the next power on.
+type RTCHoldup struct {
+	PlannedOffHours float64 `event:"plannedOffHours"`
+	HoldupHours     float64 `event:"holdupHours"`
+	RTCVoltage      float32 `event:"rtcVoltage"`
+	Learnt          bool    `event:"learnt"`
+}
+
+// ConsumableAlert is a consumable such as bait running low.
+type ConsumableAlert struct {
+	Name          string   `event:"name"`
+	LevelPercent  float64  `event:"levelPercent"`
+	LowPercent    float64  `event:"lowPercent"`
+	DaysRemaining *float64 `event:"daysRemaining,omitempty"`
+}
+
+// ConsumableLevel is the level of a consumable and how fast it is being used.
+type ConsumableLevel struct {
+	LevelPercent      float64  `event:"levelPercent"`
+	Raw               float64  `event:"raw"`
+	UsedPercentPerDay float64  `event:"usedPercentPerDay"`
+	Refills           int      `event:"refills"`
+	Low               bool     `event:"low"`
+	DaysRemaining     *float64 `event:"daysRemaining,omitempty"`
+}
+
+// ConsumableReport is the levels of the consumables, by name.
+type ConsumableReport struct {
+	Consumables   map[string]ConsumableLevel `event:"consumables"`
+	PeriodSeconds int                        `event:"periodSeconds"`
+}
+
+// RTCDrift is the drift of the RTC from the NTP time.
+type RTCDrift struct {
+	DriftSecondsPerMonth int  `event:"rtcDriftSecondsPerMonth"`
+	DriftSeconds         int  `event:"rtcDriftSeconds"`
+	Integrity            bool `event:"integrity"`
+}
+
+// RTCIntegrity is the RTC losing its integrity, the time is left out if it can't be read.
+type RTCIntegrity struct {
+	RTCTime string `event:"rtcTime,omitempty"`
+}
+
+// RTCSuspiciousTime is an RTC time that wasn't used to set the system clock.
+type RTCSuspiciousTime struct {
+	RTCTime          string `event:"rtcTime"`
+	SystemTime       string `event:"systemTime"`
+	Reason           string `event:"reason"`
+	AlternateSource  string `event:"alternateSource,omitempty"`
+	LastRTCWriteTime string `event:"lastRtcWriteTime,omitempty"`
+}
+
+// RTCAlarmCorrection is the RTC alarm being found wrong and repaired.
+type RTCAlarmCorrection struct {
+	Problems          []string `event:"problems"`
+	AlarmTime         string   `event:"alarmTime"`
+	AlarmEnabled      bool     `event:"alarmEnabled"`
+	Repaired          bool     `event:"repaired"`
+	ExpectedAlarmTime string   `event:"expectedAlarmTime,omitempty"`
+	Error             string   `event:"error,omitempty"`
+}
+
+// GPSPosition is a GPS fix, with the offset of the system clock from it.
+type GPSPosition struct {
+	Latitude           float64 `event:"latitude"`
+	Longitude          float64 `event:"longitude"`
+	Altitude           float64 `event:"altitude"`
+	Satellites         int     `event:"satellites"`
+	HDOP               float64 `event:"hdop"`
+	FixQuality         int     `event:"fixQuality"`
+	TimeSet            bool    `event:"timeSet"`
+	ClockOffsetSeconds float64 `event:"clockOffsetSeconds"`
+}
+
+// ProtectedSighting is a sighting of a protected species and what was done with the traps.
+type ProtectedSighting struct {
+	Species    string `event:"species"`
+	Confidence int32  `event:"confidence"`
+	Action     string `event:"action"`
+	Count      int    `event:"count"` // Sightings of the species so far.
+}
+
+// TrackLatency is a track taking too long from the tracking signal to the output acting on it.
+type TrackLatency struct {
+	Output    string  `event:"output"`
+	LatencyMs int64   `event:"latencyMs"`
+	MaxMs     int64   `event:"maxMs"`
+	Exceeded  uint64  `event:"exceeded"` // Tracks over the max since tc2-hat-comms started.
+	P90Ms     float64 `event:"p90Ms"`
+}
+
+// WiringDiagnosis is what is most likely wrong with the wiring of a trap that didn't respond.
+type WiringDiagnosis struct {
+	Diagnosis string `event:"diagnosis"`
+	Attempts  int    `event:"attempts"` // Wiring and baud rate combinations tried.
+}
+
+// MaintenancePresence is a technician's phone being seen nearby, or leaving after it has been
+// in maintenance mode for DurationSeconds.
+type MaintenancePresence struct {
+	Technician      string `event:"technician"` // The address or IRK that matched.
+	RSSI            int    `event:"rssi"`
+	DurationSeconds int64  `event:"durationSeconds,omitempty"`
+}
+
+// CommsChannel is the counts of the frames sent over a comms output.
+type CommsChannel struct {
+	FramesSent   uint64    `event:"framesSent"`
+	AcksReceived uint64    `event:"acksReceived"`
+	Nacks        uint64    `event:"nacks"`
+	Retries      uint64    `event:"retries"`
+	CRCErrors    uint64    `event:"crcErrors"`
+	Errors       uint64    `event:"errors"`
+	LastSuccess  time.Time `event:"lastSuccess,omitempty"`
+}
+
+// CommsHealthReport is the counts of the comms outputs that have been used.
+type CommsHealthReport struct {
+	Since  time.Time     `event:"since"`
+	UART   *CommsChannel `event:"uart,omitempty"`
+	Simple *CommsChannel `event:"simple,omitempty"`
+}
+
+// WeatherReading is the rain rate, in mm/h, with any other readings from a weather module.
+type WeatherReading struct {
+	RainRate  float64            `event:"rainRate"`
+	HeavyRain bool               `event:"heavyRain"`
+	Source    string             `event:"source"`
+	Readings  map[string]float64 `event:",inline"`
+}
+
+// TrapOverride is the trap being turned on by hand, until it is started or from when it
+// started when it ends.
+type TrapOverride struct {
+	Trigger         string    `event:"trigger"`
+	DurationSeconds int       `event:"durationSeconds,omitempty"`
+	Until           time.Time `event:"until,omitempty"`
+	Start           time.Time `event:"start,omitempty"`
+}
+
+// FailSafeTrip is the trap being turned off by the fail-safe when tc2-hat-comms stopped.
+type FailSafeTrip struct {
+	KeepAlive   bool      `event:"keepAlive"`
+	ActiveSince time.Time `event:"activeSince,omitempty"`
+}
+
+// TrapSchedule is the schedule allowing or stopping the trap.
+type TrapSchedule struct {
+	Allowed  bool   `event:"allowed"`
+	Override bool   `event:"override"`
+	Reason   string `event:"reason,omitempty"`
+}
+
+// RemoteCommand is a command received over the radio, the error is why it was rejected.
+type RemoteCommand struct {
+	Command  string `event:"command"`
+	Code     string `event:"code"`
+	Accepted bool   `event:"accepted"`
+	Error    string `event:"error,omitempty"`
+}
+
+// SpeciesCalibration is the species thresholds being changed from the corrections.
+type SpeciesCalibration struct {
+	TrapSpecies    map[string]int32 `event:"trapSpecies"`
+	ProtectSpecies map[string]int32 `event:"protectSpecies"`
+	Corrections    int              `event:"corrections"`
+}
+
+// RelayBoardStatus is the relay board stopping acknowledging, with the error, or coming back
+// after FaultSeconds.
+type RelayBoardStatus struct {
+	Type         string `event:"type"`
+	Address      int    `event:"address"`
+	Error        string `event:"error,omitempty"`
+	FaultSeconds int    `event:"faultSeconds,omitempty"`
+}
+
+// RP2040Programming is an attempt to program the RP2040, with how the firmware was verified
+// when an image was given.
+type RP2040Programming struct {
+	Success           bool   `event:"success"`
+	ExitCode          int    `event:"exitCode"`
+	SHA256            string `event:"firmwareSHA256,omitempty"`
+	Verification      string `event:"firmwareVerification,omitempty"`
+	Verified          bool   `event:"firmwareVerified,omitempty"`
+	VerificationError string `event:"firmwareVerificationError,omitempty"`
+}
+
+// RP2040Heartbeat is the RP2040 not sending heartbeats, resetting is false once it has been
+// reset too many times.
+type RP2040Heartbeat struct {
+	LastHeartbeat time.Time `event:"lastHeartbeat"`
+	Resets        int       `event:"resets"`
+	Resetting     bool      `event:"resetting"`
+	Error         string    `event:"error,omitempty"`
+}
@@ -0,0 +1,113 @@
+package eventhelper
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Packages whose events all have registered payloads.
+var registeredEmitters = []string{
+	"../cmd/tc2-hat-temp",
+	"../cmd/tc2-hat-attiny",
+	"../cmd/tc2-hat-rtc",
+	"../cmd/tc2-hat-comms",
+	"../pkg/battery",
+	"../cmd/tc2-hat-controller",
+	"../cmd/tc2-hat-rp2040",
+	"../instancelock",
+	"../readiness",
+	"../selfmonitor",
+	"../dbusauth",
+	"../configcompat",
+	"../gpioevents",
+	"../eeprom",
+}
+
+// Every event made by the registered emitters is of a registered type, made with NewEvent
+// and not an eventclient.Event literal.
+func TestEmittedTypesRegistered(t *testing.T) {
+	consts := eventTypeConsts(t)
+	for _, dir := range registeredEmitters {
+		files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if !assert.NoError(t, err, dir) || !assert.NotEmpty(t, files, dir) {
+			continue
+		}
+		fset := token.NewFileSet()
+		for _, name := range files {
+			if strings.HasSuffix(name, "_test.go") {
+				continue
+			}
+			file, err := parser.ParseFile(fset, name, nil, 0)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			ast.Inspect(file, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.CompositeLit:
+					if isSelector(n.Type, "eventclient", "Event") {
+						t.Errorf("%s: event made without a payload", fset.Position(n.Pos()))
+					}
+				case *ast.SelectorExpr:
+					// Event type constants passed on to NewEvent by helpers.
+					if value, ok := consts[selectorName(n, "eventhelper")]; ok {
+						assert.Contains(t, EventTypes(), value, fset.Position(n.Pos()).String())
+					}
+				case *ast.CallExpr:
+					if isSelector(n.Fun, "eventhelper", "NewEvent") && len(n.Args) > 0 {
+						if lit, ok := n.Args[0].(*ast.BasicLit); ok {
+							value, _ := strconv.Unquote(lit.Value)
+							assert.Contains(t, EventTypes(), value, fset.Position(n.Pos()).String())
+						}
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+// eventTypeConsts returns the event type constants in events.go by name.
+func eventTypeConsts(t *testing.T) map[string]string {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "events.go", nil, 0)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	consts := map[string]string{}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			for i, name := range value.Names {
+				if lit, ok := value.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					consts[name.Name], _ = strconv.Unquote(lit.Value)
+				}
+			}
+		}
+	}
+	assert.NotEmpty(t, consts)
+	return consts
+}
+
+func isSelector(expr ast.Expr, pkg, name string) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	return ok && selectorName(sel, pkg) == name
+}
+
+// selectorName returns the name selected from the package, empty if it isn't from it.
+func selectorName(sel *ast.SelectorExpr, pkg string) string {
+	if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == pkg {
+		return sel.Sel.Name
+	}
+	return ""
+}
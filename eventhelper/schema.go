@@ -0,0 +1,287 @@
+package eventhelper
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+// The details of the events made by the hat services are defined by the payload structs in
+// events.go, so the same detail has the same key and type in every event. The keys come from
+// the `event` tags of the fields, fields tagged with omitempty are left out when they are the
+// zero value, or nil for pointers:
+//
+//	type TempReading struct {
+//		Temp     float32  `event:"temp"`
+//		Humidity *float32 `event:"humidity,omitempty"`
+//	}
+//
+// A field that is a payload struct, or a map or slice of them, is a nested object with the
+// details of that payload. A map tagged `event:",inline"` adds its entries to the details, for
+// readings that aren't known in advance such as those from a weather module, entries with the
+// key of another detail are left out. Interface fields and inline maps of them aren't checked.
+//
+// The payloads are registered for their event types, and events of a registered type are
+// checked against the definition from the payload by AddEvent. Events of types that haven't
+// been registered aren't checked. Payloads can be given as structs or pointers to them.
+
+// Kind is the type of a detail value in an event.
+type Kind string
+
+const (
+	KindNumber Kind = "number"
+	KindString Kind = "string"
+	KindBool   Kind = "bool"
+	KindObject Kind = "object"
+	KindAny    Kind = "any" // For interface fields, the value isn't checked.
+)
+
+// Field is a detail of an event.
+type Field struct {
+	Kind     Kind
+	Required bool
+}
+
+// Definition is the details of an event type.
+type Definition struct {
+	Type   string
+	Fields map[string]Field
+	Extra  Kind // Kind of the inline details, empty if the payload doesn't have any.
+}
+
+// Details added to every event by AddEvent, these are allowed in any event.
+var commonDetails = []string{deploymentKey, safeModeKey}
+
+var definitions = map[string]Definition{}
+
+// Register defines the event types as having the details of the payload struct. An error is
+// returned if the payload isn't a struct or a type is already registered.
+func Register(payload interface{}, eventTypes ...string) error {
+	t := reflect.TypeOf(payload)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("payload for %v should be a struct, not %v", eventTypes, t)
+	}
+	d := Definition{Fields: map[string]Field{}}
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := eventTag(t.Field(i))
+		if !ok {
+			continue
+		}
+		if tag.inline {
+			d.Extra = kindOf(t.Field(i).Type.Elem())
+			continue
+		}
+		d.Fields[tag.name] = Field{Kind: kindOf(t.Field(i).Type), Required: !tag.omitEmpty}
+	}
+	for _, eventType := range eventTypes {
+		if _, ok := definitions[eventType]; ok {
+			return fmt.Errorf("event type '%s' is already registered", eventType)
+		}
+	}
+	for _, eventType := range eventTypes {
+		d.Type = eventType
+		definitions[eventType] = d
+	}
+	return nil
+}
+
+// Lookup returns the definition of the event type, ok is false if it isn't registered.
+func Lookup(eventType string) (Definition, bool) {
+	d, ok := definitions[eventType]
+	return d, ok
+}
+
+// EventTypes returns the registered event types, sorted.
+func EventTypes() []string {
+	types := make([]string, 0, len(definitions))
+	for t := range definitions {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewEvent returns an event of the type with the details from the payload.
+func NewEvent(eventType string, timestamp time.Time, payload interface{}) eventclient.Event {
+	return eventclient.Event{
+		Timestamp: timestamp,
+		Type:      eventType,
+		Details:   Details(payload),
+	}
+}
+
+// Details returns the event details of the payload struct, or pointer to one.
+func Details(payload interface{}) map[string]interface{} {
+	details := map[string]interface{}{}
+	v := reflect.Indirect(reflect.ValueOf(payload))
+	if v.Kind() != reflect.Struct {
+		return details
+	}
+	inline := []reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		tag, ok := eventTag(v.Type().Field(i))
+		if !ok {
+			continue
+		}
+		value := v.Field(i)
+		if tag.inline {
+			inline = append(inline, value)
+			continue
+		}
+		if tag.omitEmpty && value.IsZero() {
+			continue
+		}
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		details[tag.name] = detailValue(value)
+	}
+	for _, value := range inline {
+		iter := value.MapRange()
+		for iter.Next() {
+			if _, ok := details[iter.Key().String()]; !ok {
+				details[iter.Key().String()] = iter.Value().Interface()
+			}
+		}
+	}
+	return details
+}
+
+// detailValue returns the value for a detail, payload structs are turned into their details.
+func detailValue(value reflect.Value) interface{} {
+	switch {
+	case isPayload(value.Type()):
+		return Details(value.Interface())
+	case value.Kind() == reflect.Map && isPayload(value.Type().Elem()):
+		m := map[string]interface{}{}
+		iter := value.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = detailValue(reflect.Indirect(iter.Value()))
+		}
+		return m
+	case value.Kind() == reflect.Slice && isPayload(value.Type().Elem()):
+		s := make([]interface{}, value.Len())
+		for i := range s {
+			s[i] = detailValue(reflect.Indirect(value.Index(i)))
+		}
+		return s
+	}
+	return value.Interface()
+}
+
+// isPayload returns true if the type is a struct with event details.
+func isPayload(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := eventTag(t.Field(i)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the details of the event against the definition of its type. Events of
+// types that aren't registered are valid.
+func Validate(event eventclient.Event) error {
+	d, ok := definitions[event.Type]
+	if !ok {
+		return nil
+	}
+	errs := []error{}
+	for name, field := range d.Fields {
+		value, ok := event.Details[name]
+		if !ok {
+			if field.Required {
+				errs = append(errs, fmt.Errorf("'%s' is missing", name))
+			}
+			continue
+		}
+		if kind := kindOfValue(value); field.Kind != KindAny && kind != field.Kind {
+			errs = append(errs, fmt.Errorf("'%s' should be a %s, not a %s", name, field.Kind, kind))
+		}
+	}
+	for name, value := range event.Details {
+		if _, ok := d.Fields[name]; ok || isCommonDetail(name) {
+			continue
+		}
+		if d.Extra == "" {
+			errs = append(errs, fmt.Errorf("'%s' isn't a detail of %s events", name, event.Type))
+		} else if kind := kindOfValue(value); d.Extra != KindAny && kind != d.Extra {
+			errs = append(errs, fmt.Errorf("'%s' should be a %s, not a %s", name, d.Extra, kind))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isCommonDetail(name string) bool {
+	for _, common := range commonDetails {
+		if name == common {
+			return true
+		}
+	}
+	return false
+}
+
+// tag is the `event` tag of a field.
+type tag struct {
+	name      string
+	omitEmpty bool
+	inline    bool
+}
+
+// eventTag returns the `event` tag of the field, ok is false if the field isn't a detail.
+func eventTag(f reflect.StructField) (tag, bool) {
+	s, ok := f.Tag.Lookup("event")
+	if !ok || s == "-" {
+		return tag{}, false
+	}
+	name, options, _ := strings.Cut(s, ",")
+	return tag{
+		name:      name,
+		omitEmpty: options == "omitempty",
+		inline:    options == "inline" && f.Type.Kind() == reflect.Map,
+	}, true
+}
+
+func kindOf(t reflect.Type) Kind {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return KindAny
+	case reflect.Bool:
+		return KindBool
+	case reflect.String:
+		return KindString
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return KindNumber
+	default:
+		return KindObject
+	}
+}
+
+func kindOfValue(value interface{}) Kind {
+	if value == nil {
+		return KindObject
+	}
+	return kindOf(reflect.TypeOf(value))
+}
@@ -0,0 +1,294 @@
+package eventhelper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetails(t *testing.T) {
+	humidity := float32(55.5)
+	assert.Equal(t, map[string]interface{}{
+		"temp":     float32(21),
+		"tempUnit": "C",
+		"humidity": float32(55.5),
+		"source":   "aht20",
+	}, Details(TempReading{Temp: 21, TempUnit: "C", Humidity: &humidity, Source: "aht20"}))
+
+	// Empty optional details are left out.
+	assert.Equal(t, map[string]interface{}{
+		"temp":      float32(30),
+		"tempUnit":  "F",
+		"source":    "soc",
+		"estimated": true,
+	}, Details(TempReading{Temp: 30, TempUnit: "F", Source: "soc", Estimated: true}))
+
+	// Required details are kept even when they are zero.
+	assert.Equal(t, map[string]interface{}{
+		"rtcDriftSecondsPerMonth": 0,
+		"rtcDriftSeconds":         0,
+		"integrity":               false,
+	}, Details(RTCDrift{}))
+
+	// Pointers to payloads are the same as the payloads.
+	assert.Equal(t, Details(TempReading{Temp: 21, TempUnit: "C", Humidity: &humidity, Source: "aht20"}),
+		Details(&TempReading{Temp: 21, TempUnit: "C", Humidity: &humidity, Source: "aht20"}))
+	assert.Equal(t, map[string]interface{}{}, Details(nil))
+	assert.Equal(t, map[string]interface{}{}, Details((*TempReading)(nil)))
+	assert.Equal(t, map[string]interface{}{}, Details("temp"))
+}
+
+func TestNestedDetails(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"powerCycles":    2,
+		"poweredOnHours": 1.5,
+		"avgBootSeconds": 30.0,
+		"periodSeconds":  86400,
+		"onPercent":      6.3,
+		"total": map[string]interface{}{
+			"powerCycles":    10,
+			"poweredOnHours": 20.0,
+			"avgBootSeconds": 31.0,
+		},
+	}, Details(CameraPowerSummary{
+		PowerCycles: 2, PoweredOnHours: 1.5, AvgBootSeconds: 30, PeriodSeconds: 86400, OnPercent: 6.3,
+		Total: CameraPowerTotals{PowerCycles: 10, PoweredOnHours: 20, AvgBootSeconds: 31},
+	}))
+
+	days := 4.0
+	assert.Equal(t, map[string]interface{}{
+		"consumables": map[string]interface{}{
+			"bait": map[string]interface{}{
+				"levelPercent":      80.0,
+				"raw":               740.0,
+				"usedPercentPerDay": 20.0,
+				"refills":           0,
+				"low":               false,
+				"daysRemaining":     4.0,
+			},
+		},
+		"periodSeconds": 86400,
+	}, Details(ConsumableReport{
+		Consumables:   map[string]ConsumableLevel{"bait": {LevelPercent: 80, Raw: 740, UsedPercentPerDay: 20, DaysRemaining: &days}},
+		PeriodSeconds: 86400,
+	}))
+
+	// Only the outputs that have been used are in the comms health.
+	assert.Equal(t, map[string]interface{}{
+		"since": time.Time{},
+		"uart": map[string]interface{}{
+			"framesSent":   uint64(3),
+			"acksReceived": uint64(2),
+			"nacks":        uint64(1),
+			"retries":      uint64(0),
+			"crcErrors":    uint64(0),
+			"errors":       uint64(0),
+		},
+	}, Details(CommsHealthReport{UART: &CommsChannel{FramesSent: 3, AcksReceived: 2, Nacks: 1}}))
+}
+
+func TestSliceDetails(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"problems": 1,
+		"files": []interface{}{
+			map[string]interface{}{"file": "battery.csv", "lines": 10, "badLines": 1},
+			map[string]interface{}{"file": "state.json"},
+		},
+	}, Details(DataAudit{Problems: 1, Files: []AuditedFile{{File: "battery.csv", Lines: 10, BadLines: 1}, {File: "state.json"}}}))
+}
+
+func TestInlineDetails(t *testing.T) {
+	e := NewEvent(Weather, time.Now(), WeatherReading{
+		RainRate: 1.5,
+		Source:   "uart",
+		Readings: map[string]float64{"temp": 11, "rainRate": 2},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"rainRate":  1.5,
+		"heavyRain": false,
+		"source":    "uart",
+		"temp":      11.0,
+	}, e.Details)
+	assert.NoError(t, Validate(e))
+
+	e.Details["windDirection"] = "NW"
+	assert.Error(t, Validate(e))
+
+	// Inline details of any type.
+	e = NewEvent("doorOpened", time.Now(), GPIOInput{
+		Input:   "door",
+		Pin:     "GPIO16",
+		Details: map[string]interface{}{"location": "enclosure", "pin": "overridden", "floor": 1},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"input":    "door",
+		"pin":      "GPIO16",
+		"active":   false,
+		"location": "enclosure",
+		"floor":    1,
+	}, e.Details)
+}
+
+func TestRegister(t *testing.T) {
+	registered := definitions
+	defer func() { definitions = registered }()
+	definitions = map[string]Definition{}
+
+	assert.NoError(t, Register(&TempReading{}, "pointerReading"))
+	d, ok := Lookup("pointerReading")
+	assert.True(t, ok)
+	assert.Equal(t, Field{Kind: KindNumber, Required: true}, d.Fields["temp"])
+
+	assert.Error(t, Register(TempReading{}, "pointerReading"))
+	assert.Error(t, Register("temp", "notAStruct"))
+	assert.Error(t, Register(nil, "nothing"))
+	assert.Equal(t, []string{"pointerReading"}, EventTypes())
+
+	assert.NoError(t, Register(WeatherReading{}, "weatherReading"))
+	d, _ = Lookup("weatherReading")
+	assert.Equal(t, KindNumber, d.Extra)
+	assert.NotContains(t, d.Fields, "")
+}
+
+// The payloads register without errors, init only logs them.
+func TestRegistrations(t *testing.T) {
+	registered := definitions
+	defer func() { definitions = registered }()
+	definitions = map[string]Definition{}
+
+	for _, r := range registrations {
+		assert.NoError(t, Register(r.payload, r.eventTypes...), r.eventTypes)
+	}
+	assert.Equal(t, registered, definitions)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	e := NewEvent(RPiBattery, now, BatteryReading{Battery: 80, BatteryType: "li-ion", Voltage: 12.4})
+	assert.NoError(t, Validate(e))
+	e.Details[deploymentKey] = map[string]interface{}{"group": "test"}
+	assert.NoError(t, Validate(e))
+
+	// An inconsistent key, a missing detail and the wrong type.
+	e = eventclient.Event{Type: TempHumidity, Details: map[string]interface{}{
+		"temperature": 21.0,
+		"tempUnit":    "C",
+		"humidity":    "55",
+	}}
+	err := Validate(e)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "'temperature' isn't a detail of tempHumidity events")
+		assert.Contains(t, err.Error(), "'temp' is missing")
+		assert.Contains(t, err.Error(), "'source' is missing")
+		assert.Contains(t, err.Error(), "'humidity' should be a number, not a string")
+	}
+
+	// Types that aren't registered aren't checked.
+	assert.NoError(t, Validate(eventclient.Event{Type: "somethingElse", Details: map[string]interface{}{"temperature": 1}}))
+}
+
+// Each of the registered event types is valid with its own payload.
+func TestRegisteredTypes(t *testing.T) {
+	hours := 10.0
+	payloads := map[string]interface{}{
+		TempHumidity:            TempReading{Temp: 20, TempUnit: "C", Source: "aht20"},
+		TempTooHigh:             TempReading{Temp: 50, TempUnit: "C", Source: "aht20"},
+		TempTooLow:              TempReading{Temp: -5, TempUnit: "C", Source: "aht20"},
+		HumidityTooHigh:         TempReading{Temp: 20, TempUnit: "C", Source: "aht20"},
+		TempSourceChanged:       TempSourceChange{From: "aht20", To: "attiny", Reason: "no response"},
+		TempSourceMismatch:      TempSourceDisagreement{Temp: 20, Humidity: 50, ATtinyTemp: 25, ATtinyHumidity: 50},
+		RPiBattery:              BatteryReading{Battery: 50, BatteryType: "lime", Voltage: 12, HoursRemaining: &hours},
+		ReportingCadenceChanged: CadenceChange{Level: "low", Profile: "balanced", Battery: 20},
+		EmergencyBeaconSent:     EmergencyBeacon{Condition: "batteryCritical", Sent: "wifi,ble", Failed: "lora", Battery: 8},
+		BatteryImpedanceHigh:    BatteryImpedance{Chemistry: "lifepo4", BaselineOhms: 0.1, RecentOhms: 0.16, Rise: 1.6, RiseLimit: 1.5, TrendOhmsPerWeek: 0.002, Sessions: 40},
+		RTCNtpDrift:             RTCDrift{DriftSecondsPerMonth: 20, DriftSeconds: 2, Integrity: true},
+		RTCNtpDriftHigh:         RTCDrift{DriftSecondsPerMonth: 700, DriftSeconds: 60, Integrity: true},
+		RTCIntegrityLost:        RTCIntegrity{RTCTime: "2026-01-01 00:00:00"},
+		RTCIntegrityError:       RTCIntegrity{},
+		SuspiciousRTCTime:       RTCSuspiciousTime{RTCTime: "2000-01-01 00:00:00", SystemTime: "2026-01-01 00:00:00", Reason: "before the build"},
+		ProtectedSpeciesSighted: ProtectedSighting{Species: "kiwi", Confidence: 90, Action: "trapKeptOff", Count: 1},
+		TrackLatencyExceeded:    TrackLatency{Output: "uart", LatencyMs: 2500, MaxMs: 2000, Exceeded: 1, P90Ms: 300},
+		ESLNotDetected:          WiringDiagnosis{Diagnosis: "nothing responded", Attempts: 10},
+		MaintenanceModeStarted:  MaintenancePresence{Technician: "5C:F3:70:12:34:56", RSSI: -60},
+		MaintenanceModeEnded:    MaintenancePresence{Technician: "5C:F3:70:12:34:56", RSSI: -80, DurationSeconds: 1800},
+
+		SafeModeEntered:          SafeMode{Service: "tc2-hat-temp", Reason: "no sensor"},
+		TempSensorFault:          SensorFault{Fault: "stuck", Temp: 20, TempUnit: "C", Humidity: 50, Address: 0x38},
+		EnclosureSealDegraded:    SealDegradation{Method: "correlation", Correlation: 0.9, Threshold: 0.8, Humidity: 80, ExternalHumidity: 85},
+		HumidityRecoveryStarted:  HumidityRecoveryStart{Humidity: 100, SaturatedHours: 6},
+		HumidityRecoveryFinished: HumidityRecoveryResult{Humidity: 70, BeforeHumidity: 100},
+		FanDailySummary:          FanSummary{RunSeconds: 3600, AverageDuty: 50, Starts: 3, MaxTemp: 40, PeriodSeconds: 86400},
+
+		BatteryDisconnected:     RailChange{Rail: "rtc", LastVoltage: 3, LastConnectedTime: time.Now()},
+		BatteryReconnected:      RailChange{Rail: "hv", LastVoltage: 12, LastConnectedTime: time.Now(), LastPercent: &hours, BatteryType: "lifepo4"},
+		BatteryReplaced:         PackSwap{OldPack: "A1", NewPack: "B2", OldPackCycles: 0.5, OldChemistry: "li-ion", OldLastPercent: 20},
+		BatteryChemistryFound:   ChemistryDetection{Chemistry: "lifepo4", RangeGuess: "li-ion", Confidence: 0.9, PlateauRate: 0.01, Knee: 0.8, Method: "curveShape"},
+		BatteryTransient:        Transient{Reason: "cameraOn", Rail: "hv", BaselineVoltage: 12.4, MinVoltage: 11.9, SagVoltage: 0.5},
+		ChargerConnected:        ChargerConnection{Voltage: 13, Battery: 50},
+		ChargeComplete:          ChargeCompletion{Voltage: 14.4, Battery: 100, FloatVoltage: 13.6, ChargeHours: 5},
+		ChargerDisconnected:     ChargerDisconnection{Voltage: 13.2, Battery: 100, ConnectedHours: 8, MaxVoltage: 14.4},
+		ATtinyError:             ATtinyErrors{Errors: []string{"WatchdogReset"}},
+		ATtinyLinkDegraded:      LinkDegradation{FailureRatePercent: 10, ThresholdPercent: 5, CRCFailures: 8, Retries: 12},
+		ProgrammingATtiny:       FirmwareProgramming{SHA256: "ab", Verification: "sha256", Verified: true, Success: true},
+		HatPowerQuality:         PowerQuality{LastResetCause: "brownOut", Resets: 1, BrownOuts: 1, TotalBrownOuts: 3},
+		HardwarePairingChanged:  PairingChange{Change: "hatSwapped", DeviceID: 1, HatDeviceID: 2},
+		AuxPowerOvercurrent:     AuxOvercurrent{LimitMA: 500, TrippedBy: "software"},
+		CameraPowerDailySummary: CameraPowerSummary{PowerCycles: 2, PeriodSeconds: 86400},
+		PowerPolicyAdjusted:     PowerPolicyChange{Level: "shortened", PreviousLevel: "normal", HoursRemaining: 10, HoursNeeded: 20, NextUploadEnd: time.Now()},
+		PowerOffPostponed:       PowerOffPostponement{Postponements: 2, PostponedMinutes: 20, Reason: "uploading"},
+		QuiesceTimedOut:         QuiesceTimeout{Services: []string{"thermal-recorder"}, BudgetSeconds: 30},
+		RTCHoldupShort:          RTCHoldup{PlannedOffHours: 12, HoldupHours: 6, RTCVoltage: 2.5},
+		ConsumableLow:           ConsumableAlert{Name: "bait", LevelPercent: 12.5, LowPercent: 20, DaysRemaining: &hours},
+		ConsumableLevels:        ConsumableReport{Consumables: map[string]ConsumableLevel{"bait": {LevelPercent: 80}}, PeriodSeconds: 86400},
+
+		RTCAlarmCorrected: RTCAlarmCorrection{Problems: []string{"flag set"}, AlarmTime: "00:00", Repaired: true},
+		GPSFix:            GPSPosition{Latitude: -43.5, Longitude: 172.6, Satellites: 8, HDOP: 1.2, FixQuality: 1},
+
+		CommsHealth:         CommsHealthReport{Since: time.Now(), Simple: &CommsChannel{FramesSent: 1}},
+		Weather:             WeatherReading{RainRate: 1, Source: "uart", Readings: map[string]float64{"temp": 11}},
+		HeavyRainStarted:    WeatherReading{RainRate: 10, HeavyRain: true, Source: "uart"},
+		HeavyRainStopped:    WeatherReading{RainRate: 0, Source: "uart"},
+		TrapOverrideStarted: TrapOverride{Trigger: "button", DurationSeconds: 3600, Until: time.Now()},
+		TrapOverrideEnded:   TrapOverride{Trigger: "button", Start: time.Now()},
+		TrapFailSafeTripped: FailSafeTrip{KeepAlive: true},
+		TrapScheduleChanged: TrapSchedule{Allowed: false, Reason: "outside the schedule"},
+		RemoteCommandRun:    RemoteCommand{Command: "disarm", Code: "1234", Accepted: true},
+		SpeciesCalibrated:   SpeciesCalibration{TrapSpecies: map[string]int32{"possum": 80}, ProtectSpecies: map[string]int32{"kiwi": 50}, Corrections: 12},
+		RelayBoardFault:     RelayBoardStatus{Type: "pcf8574", Address: 0x20, Error: "no ack"},
+		RelayBoardRecovered: RelayBoardStatus{Type: "pcf8574", Address: 0x20, FaultSeconds: 60},
+
+		InstanceDisplaced:      InstanceDisplacement{Service: "tc2-hat-temp", PID: 100, ReplacedBy: 200},
+		DependencyNotReady:     DependencyWait{Service: "tc2-hat-temp", NotReady: []string{"tc2-hat-i2c"}, WaitedSeconds: 30},
+		ServiceDegraded:        ServiceDegradation{Service: "tc2-hat-temp", Reasons: []string{"250 goroutines is above 200"}, Goroutines: 250, HeapMB: 20},
+		DBusAccessDenied:       AccessDenial{Method: "ArmTamper", Sender: ":1.5", UID: 1000, Reason: "not in the allowed users"},
+		ConfigSchemaMismatch:   ConfigMismatch{Service: "tc2-hat-temp", BinaryVersion: "1.0.0", BinarySchemaVersion: 1, ConfigSchemaVersion: 2},
+		EEPROMDataChanged:      EEPROMChange{FromFile: map[string]interface{}{"id": 1}, FromChip: map[string]interface{}{"id": 2}},
+		DeviceTwinPublished:    DeviceTwin{Changed: []string{"cameraState"}, State: map[string]interface{}{"revision": 2, "cameraState": "Powered On"}},
+		ShadowStateRestored:    ShadowRestore{Files: []string{"config.toml"}},
+		ThermalAdvisoryRaised:  ThermalAdvisory{Advisories: []string{"enclosure exceeds 45°C daily 13:00-15:00"}, HeatPeaks: []HeatPeak{{Start: "13:00", End: "15:00", MaxTemp: 48, HotDays: 5}}, Threshold: 45, Days: 7},
+		ThermalAdvisoryCleared: ThermalAdvisory{Threshold: 45, Days: 7},
+		DataAudited:            DataAudit{Problems: 1, Files: []AuditedFile{{File: "battery.csv", Lines: 10, BadLines: 1}}},
+		TamperDetected:         Tamper{Pin: "GPIO16", Intensity: 4, DurationMs: 1500},
+		ProgrammingRP2040:      RP2040Programming{Success: true, SHA256: "abcd", Verification: "signature", Verified: true},
+		RP2040Unresponsive:     RP2040Heartbeat{LastHeartbeat: time.Now(), Resets: 1, Resetting: true},
+	}
+	assert.ElementsMatch(t, EventTypes(), keys(payloads))
+	for eventType, payload := range payloads {
+		assert.NoError(t, Validate(NewEvent(eventType, time.Now(), payload)), eventType)
+	}
+
+	d, ok := Lookup(RPiBattery)
+	assert.True(t, ok)
+	assert.Equal(t, Field{Kind: KindNumber, Required: false}, d.Fields["hoursRemaining"])
+	assert.Equal(t, Field{Kind: KindString, Required: true}, d.Fields["batteryType"])
+}
+
+func keys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
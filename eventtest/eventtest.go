@@ -0,0 +1,67 @@
+// Package eventtest captures the events made with eventhelper.AddEvent in tests, so they
+// aren't sent to the event-reporter. It is only imported by tests.
+package eventtest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// Recorder has the events made since Capture was called.
+type Recorder struct {
+	mu     sync.Mutex
+	events []eventclient.Event
+	err    error
+}
+
+// Capture records the events until the end of the test.
+func Capture(t *testing.T) *Recorder {
+	r := &Recorder{}
+	t.Cleanup(eventhelper.SetSink(r.add))
+	return r
+}
+
+func (r *Recorder) add(event eventclient.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+// Events returns the events recorded so far.
+func (r *Recorder) Events() []eventclient.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]eventclient.Event{}, r.events...)
+}
+
+// Types returns the types of the events recorded so far.
+func (r *Recorder) Types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := []string{}
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+// Fail makes adding events fail with the error, nil to accept them again.
+func (r *Recorder) Fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// Reset forgets the events recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
@@ -0,0 +1,123 @@
+// Package exitcode is the exit codes shared by the hat binaries, so scripts can tell a device
+// that isn't there from bad arguments or a failing bus instead of everything exiting with 1.
+// A failure is given its class by wrapping the error with Wrap where the cause is known,
+// errors that aren't wrapped exit with Error.
+package exitcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/alexflint/go-arg"
+)
+
+const (
+	OK                 = 0
+	Error              = 1 // Anything not covered below.
+	Usage              = 2 // Invalid arguments or config, or a tool that is needed isn't installed.
+	HardwareMissing    = 3 // The device, or a GPIO pin or serial port it needs, wasn't found.
+	BusError           = 4 // Talking to the device failed, such as an I2C, UART or SWD error.
+	Timeout            = 5 // The device or a service didn't respond in time.
+	FirmwareMismatch   = 6 // The device responded but isn't running the expected firmware.
+	FirmwareUnverified = 7 // The firmware image failed verification so wasn't programmed.
+)
+
+var names = map[int]string{
+	OK:                 "ok",
+	Error:              "error",
+	Usage:              "usage",
+	HardwareMissing:    "hardware-missing",
+	BusError:           "bus-error",
+	Timeout:            "timeout",
+	FirmwareMismatch:   "firmware-mismatch",
+	FirmwareUnverified: "firmware-unverified",
+}
+
+// Help documents the exit codes, it is added to the end of the --help output.
+const Help = `Exit codes:
+  0  success
+  1  error, any failure not covered below
+  2  usage, invalid arguments or config, or a tool that is needed isn't installed
+  3  hardware-missing, the device or a GPIO pin or serial port it needs wasn't found
+  4  bus-error, talking to the device failed
+  5  timeout, the device or a service didn't respond in time
+  6  firmware-mismatch, the device isn't running the expected firmware
+  7  firmware-unverified, the firmware image failed verification so wasn't programmed`
+
+// Name returns the class of the exit code for machine readable output, such as "bus-error".
+func Name(code int) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return names[Error]
+}
+
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codeError) Unwrap() error {
+	return e.err
+}
+
+// Wrap returns the error with the exit code for it, nil if err is nil.
+func Wrap(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codeError{code: code, err: err}
+}
+
+// Code returns the exit code for the error. The outermost code is used when the error has
+// been wrapped more than once. Errors without one exit with Timeout if they are from a
+// deadline passing and Error otherwise.
+func Code(err error) int {
+	if err == nil {
+		return OK
+	}
+	var e *codeError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return Timeout
+	}
+	return Error
+}
+
+// MustParse parses the command line arguments into dest like arg.MustParse, but exits with
+// Usage when they are invalid and adds the exit codes to the --help output.
+func MustParse(dest ...interface{}) *arg.Parser {
+	p, err := arg.NewParser(arg.Config{}, dest...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(Error)
+	}
+	err = p.Parse(os.Args[1:])
+	switch {
+	case err == arg.ErrHelp:
+		p.WriteHelpForSubcommand(os.Stdout, p.SubcommandNames()...)
+		fmt.Println()
+		fmt.Println(Help)
+		os.Exit(OK)
+	case err == arg.ErrVersion:
+		for _, d := range dest {
+			if v, ok := d.(arg.Versioned); ok {
+				fmt.Println(v.Version())
+			}
+		}
+		os.Exit(OK)
+	case err != nil:
+		p.WriteUsageForSubcommand(os.Stderr, p.SubcommandNames()...)
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(Usage)
+	}
+	return p
+}
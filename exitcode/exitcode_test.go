@@ -0,0 +1,29 @@
+package exitcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, OK, Code(nil))
+	assert.Equal(t, Error, Code(errors.New("failed")))
+	err := fmt.Errorf("connecting: %w", Wrap(HardwareMissing, errors.New("no device")))
+	assert.Equal(t, HardwareMissing, Code(err))
+	assert.Equal(t, "connecting: no device", err.Error())
+	assert.NoError(t, Wrap(BusError, nil))
+
+	// The outermost code is used.
+	assert.Equal(t, Usage, Code(Wrap(Usage, Wrap(BusError, errors.New("bad value")))))
+	assert.Equal(t, Timeout, Code(fmt.Errorf("reading: %w", context.DeadlineExceeded)))
+}
+
+func TestName(t *testing.T) {
+	assert.Equal(t, "hardware-missing", Name(HardwareMissing))
+	assert.Equal(t, "firmware-mismatch", Name(FirmwareMismatch))
+	assert.Equal(t, "error", Name(42))
+}
@@ -0,0 +1,163 @@
+// Package firmware verifies firmware images before they are programmed into the ATtiny or
+// RP2040, so a corrupted or tampered file isn't flashed. An image is verified with a detached
+// ed25519 signature, in a file next to it with SignatureExt added, from one of the public keys
+// in the config. Images without a signature are checked against a pinned SHA-256 instead:
+//
+//	[firmware]
+//	public-keys = ["MCowBQYDK2VwAyEA..."]
+//	attiny-sha256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+//	rp2040-sha256 = ""
+//
+// The public keys are base64 ed25519 keys, either the raw 32 bytes or PKIX DER. The signature
+// file is the base64 signature of the image. A bad signature or a hash that doesn't match is
+// always refused, images with neither a signature nor a pinned hash are only programmed when
+// unsigned images are allowed.
+package firmware
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+)
+
+const (
+	ConfigKey    = "firmware"
+	SignatureExt = ".sig"
+
+	MethodSignature = "signature"
+	MethodSHA256    = "sha256"
+	MethodUnsigned  = "unsigned"
+)
+
+// Config is read from the "firmware" section of the config.
+type Config struct {
+	PublicKeys   []string `mapstructure:"public-keys"`
+	ATtinySHA256 string   `mapstructure:"attiny-sha256"`
+	RP2040SHA256 string   `mapstructure:"rp2040-sha256"`
+}
+
+// LoadConfig returns the firmware config, checking the public keys can be read.
+func LoadConfig(config *goconfig.Config) (Config, error) {
+	c := Config{}
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, ConfigKey, &c); err != nil {
+		return c, err
+	}
+	if _, err := c.keys(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (c Config) keys() ([]ed25519.PublicKey, error) {
+	keys := []ed25519.PublicKey{}
+	for _, s := range c.PublicKeys {
+		key, err := parsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s public key '%s': %v", ConfigKey, s, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(data), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ed25519 key")
+	}
+	return edKey, nil
+}
+
+// Result is how an image was verified, for the programming event.
+type Result struct {
+	SHA256   string
+	Method   string // MethodSignature, MethodSHA256 or MethodUnsigned, empty if it failed.
+	Verified bool
+	Error    string
+}
+
+// Verify checks the image with its signature, or with the pinned SHA-256 if it isn't signed.
+// An error is returned if the image can't be verified, unless it is unsigned without a pinned
+// hash and allowUnsigned is set.
+func (c Config) Verify(file, pinnedSHA256 string, allowUnsigned bool) (Result, error) {
+	r, err := c.verify(file, pinnedSHA256, allowUnsigned)
+	if err != nil {
+		r.Method = ""
+		r.Verified = false
+		r.Error = err.Error()
+	}
+	return r, err
+}
+
+func (c Config) verify(file, pinnedSHA256 string, allowUnsigned bool) (Result, error) {
+	r := Result{}
+	image, err := os.ReadFile(file)
+	if err != nil {
+		return r, err
+	}
+	sum := sha256.Sum256(image)
+	r.SHA256 = hex.EncodeToString(sum[:])
+
+	sigData, err := os.ReadFile(file + SignatureExt)
+	if err == nil {
+		keys, err := c.keys()
+		if err != nil {
+			return r, err
+		}
+		if len(keys) == 0 {
+			return r, fmt.Errorf("'%s' is signed but there are no %s public keys in the config", file, ConfigKey)
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+		if err != nil {
+			return r, fmt.Errorf("failed to read the signature of '%s': %v", file, err)
+		}
+		for _, key := range keys {
+			if ed25519.Verify(key, image, sig) {
+				r.Method = MethodSignature
+				r.Verified = true
+				return r, nil
+			}
+		}
+		return r, fmt.Errorf("signature of '%s' doesn't match any of the public keys", file)
+	} else if !os.IsNotExist(err) {
+		return r, err
+	}
+
+	if pinnedSHA256 != "" {
+		if !strings.EqualFold(pinnedSHA256, r.SHA256) {
+			return r, fmt.Errorf("SHA-256 of '%s' is %s, expecting %s", file, r.SHA256, pinnedSHA256)
+		}
+		r.Method = MethodSHA256
+		r.Verified = true
+		return r, nil
+	}
+
+	if !allowUnsigned {
+		return r, fmt.Errorf("'%s' has no signature or pinned SHA-256, refusing to program it without --allow-unsigned", file)
+	}
+	r.Method = MethodUnsigned
+	return r, nil
+}
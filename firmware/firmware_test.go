@@ -0,0 +1,67 @@
+package firmware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "firmware.hex")
+	image := []byte(":100000000C9434000C9446000C9446000C9446006A\n")
+	assert.NoError(t, os.WriteFile(file, image, 0644))
+	sum := sha256.Sum256(image)
+	hash := hex.EncodeToString(sum[:])
+
+	// Unsigned without a pinned hash is only allowed when asked for.
+	c := Config{}
+	_, err := c.Verify(file, "", false)
+	assert.Error(t, err)
+	r, err := c.Verify(file, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{SHA256: hash, Method: MethodUnsigned}, r)
+
+	// A pinned hash has to match, even if unsigned images are allowed.
+	r, err = c.Verify(file, hash, false)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{SHA256: hash, Method: MethodSHA256, Verified: true}, r)
+	r, err = c.Verify(file, "abcd", true)
+	assert.Error(t, err)
+	assert.False(t, r.Verified)
+	assert.Equal(t, err.Error(), r.Error)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(private, image))
+	assert.NoError(t, os.WriteFile(file+SignatureExt, []byte(sig+"\n"), 0644))
+
+	// A signed image needs a key to check it with.
+	_, err = c.Verify(file, "", true)
+	assert.Error(t, err)
+	c.PublicKeys = []string{base64.StdEncoding.EncodeToString(public)}
+	r, err = c.Verify(file, "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{SHA256: hash, Method: MethodSignature, Verified: true}, r)
+
+	// A tampered image is refused.
+	assert.NoError(t, os.WriteFile(file, append(image, '0'), 0644))
+	_, err = c.Verify(file, "", true)
+	assert.Error(t, err)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	_, err := Config{PublicKeys: []string{"not a key"}}.keys()
+	assert.Error(t, err)
+	// PKIX DER, as written by openssl pkey -pubout.
+	key, err := parsePublicKey("MCowBQYDK2VwAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE=")
+	assert.NoError(t, err)
+	assert.Len(t, key, ed25519.PublicKeySize)
+}
@@ -0,0 +1,232 @@
+// Package gpioevents turns GPIO inputs, such as a door switch, tamper sensor or an external
+// trigger, into events. Each input has its own section in the config:
+//
+//	[gpio-inputs.door]
+//	pin = "GPIO16"
+//	pull = "up"
+//	active-low = true
+//	debounce = "50ms"
+//	event = "doorOpened"
+//	inactive-event = "doorClosed"
+//	[gpio-inputs.door.details]
+//	location = "enclosure"
+//
+// An event is made when the input changes to active, and when it changes back if an
+// inactive-event is set. The details from the config are added to the event. The event types
+// are registered for the GPIOInput payload, so they can't be the type of another event.
+package gpioevents
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
+)
+
+const (
+	ConfigKey       = "gpio-inputs"
+	defaultDebounce = 50 * time.Millisecond
+)
+
+var log = logging.NewLogger("info")
+
+var (
+	registeredMu sync.Mutex
+	registered   = map[string]bool{} // Event types registered for the inputs.
+)
+
+// Input is the config for one GPIO input.
+type Input struct {
+	Pin string `mapstructure:"pin"`
+	// "up", "down" or "none".
+	Pull string `mapstructure:"pull"`
+	// The input is active when the pin is low, such as a switch to ground with a pull up.
+	ActiveLow bool `mapstructure:"active-low"`
+	// How long the pin has to be stable for a change to count.
+	Debounce time.Duration `mapstructure:"debounce"`
+	// Changes closer together than this after an event are ignored, so a flapping input
+	// doesn't flood the events.
+	MinInterval   time.Duration          `mapstructure:"min-interval"`
+	Event         string                 `mapstructure:"event"`
+	InactiveEvent string                 `mapstructure:"inactive-event"`
+	Details       map[string]interface{} `mapstructure:"details"`
+}
+
+// Load returns the config for each input, checking it is valid.
+func Load(config *goconfig.Config) (map[string]Input, error) {
+	inputs := map[string]Input{}
+	if err := configcompat.Unmarshal(config, ConfigKey, &inputs); err != nil {
+		return nil, err
+	}
+	for name, input := range inputs {
+		if err := input.validate(); err != nil {
+			return nil, fmt.Errorf("gpio input '%s': %v", name, err)
+		}
+		if err := input.register(); err != nil {
+			return nil, fmt.Errorf("gpio input '%s': %v", name, err)
+		}
+		if input.Debounce == 0 {
+			input.Debounce = defaultDebounce
+			inputs[name] = input
+		}
+	}
+	return inputs, nil
+}
+
+func (i Input) validate() error {
+	if i.Pin == "" {
+		return fmt.Errorf("no pin set")
+	}
+	if i.Event == "" {
+		return fmt.Errorf("no event set")
+	}
+	if _, err := i.pull(); err != nil {
+		return err
+	}
+	if i.Debounce < 0 || i.MinInterval < 0 {
+		return fmt.Errorf("debounce and min-interval can't be negative")
+	}
+	return nil
+}
+
+// register registers the GPIOInput payload for the event types of the input, unless they
+// already are for another input. An error is returned if another event uses the type.
+func (i Input) register() error {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	for _, eventType := range []string{i.Event, i.InactiveEvent} {
+		if eventType == "" || registered[eventType] {
+			continue
+		}
+		if err := eventhelper.Register(eventhelper.GPIOInput{}, eventType); err != nil {
+			return err
+		}
+		registered[eventType] = true
+	}
+	return nil
+}
+
+func (i Input) pull() (gpio.Pull, error) {
+	switch i.Pull {
+	case "", "none":
+		return gpio.Float, nil
+	case "up":
+		return gpio.PullUp, nil
+	case "down":
+		return gpio.PullDown, nil
+	}
+	return gpio.Float, fmt.Errorf("unknown pull '%s'", i.Pull)
+}
+
+// monitor tracks the state of an input and makes the events for it.
+type monitor struct {
+	name  string
+	input Input
+	now   func() time.Time
+
+	mu        sync.Mutex
+	active    bool
+	lastEvent time.Time
+}
+
+func newMonitor(name string, input Input) *monitor {
+	return &monitor{
+		name:  name,
+		input: input,
+		now:   time.Now,
+	}
+}
+
+// set records the debounced state of the input, reporting an event if it changed.
+func (m *monitor) set(active bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if active == m.active {
+		return
+	}
+	m.active = active
+	eventType := m.input.Event
+	if !active {
+		eventType = m.input.InactiveEvent
+	}
+	if eventType == "" {
+		return
+	}
+	now := m.now()
+	if !m.lastEvent.IsZero() && now.Sub(m.lastEvent) < m.input.MinInterval {
+		log.Debugf("Ignoring %s from '%s', too soon after the last event", eventType, m.name)
+		return
+	}
+	m.lastEvent = now
+	log.Infof("GPIO input '%s' is %s, adding %s event", m.name, activeString(active), eventType)
+
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventType, now, eventhelper.GPIOInput{
+		Input:   m.name,
+		Pin:     m.input.Pin,
+		Active:  active,
+		Details: m.input.Details,
+	})); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+}
+
+// watch waits for the pin to change and settle for the debounce time before reading it.
+func (m *monitor) watch(pin gpio.PinIn) {
+	for {
+		pin.WaitForEdge(-1)
+		for pin.WaitForEdge(m.input.Debounce) {
+		}
+		m.set(m.isActive(pin.Read()))
+	}
+}
+
+func (m *monitor) isActive(level gpio.Level) bool {
+	return level == gpio.Level(!m.input.ActiveLow)
+}
+
+func activeString(active bool) string {
+	if active {
+		return "active"
+	}
+	return "inactive"
+}
+
+// Start sets up the pins for the inputs and starts making events for them. The starting
+// state of each input is read without making an event.
+func Start(inputs map[string]Input) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	if _, err := host.Init(); err != nil {
+		return fmt.Errorf("failed to initialize periph: %v", err)
+	}
+	names := []string{}
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		input := inputs[name]
+		pin := gpioreg.ByName(input.Pin)
+		if pin == nil {
+			return fmt.Errorf("failed to find GPIO pin '%s' for input '%s'", input.Pin, name)
+		}
+		pull, _ := input.pull()
+		if err := pin.In(pull, gpio.BothEdges); err != nil {
+			return fmt.Errorf("failed to set up pin '%s' for input '%s': %v", input.Pin, name, err)
+		}
+		m := newMonitor(name, input)
+		m.active = m.isActive(pin.Read())
+		log.Infof("Watching GPIO input '%s' on %s, currently %s", name, input.Pin, activeString(m.active))
+		go m.watch(pin)
+	}
+	return nil
+}
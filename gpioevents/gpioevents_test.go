@@ -0,0 +1,118 @@
+package gpioevents
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+	"periph.io/x/conn/v3/gpio"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Input{Pin: "GPIO16", Event: "doorOpened", Pull: "up"}.validate())
+	assert.Error(t, Input{Event: "doorOpened"}.validate())
+	assert.Error(t, Input{Pin: "GPIO16"}.validate())
+	assert.Error(t, Input{Pin: "GPIO16", Event: "doorOpened", Pull: "sideways"}.validate())
+}
+
+func TestRegister(t *testing.T) {
+	door := Input{Pin: "GPIO16", Event: "doorOpened", InactiveEvent: "doorClosed"}
+	assert.NoError(t, door.register())
+	assert.NoError(t, door.register())
+	_, ok := eventhelper.Lookup("doorClosed")
+	assert.True(t, ok)
+	assert.Error(t, Input{Pin: "GPIO17", Event: eventhelper.TamperDetected}.register())
+}
+
+func TestMonitorEvents(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	m := newMonitor("door", Input{
+		Pin:           "GPIO16",
+		ActiveLow:     true,
+		MinInterval:   time.Minute,
+		Event:         "doorOpened",
+		InactiveEvent: "doorClosed",
+		Details:       map[string]interface{}{"location": "enclosure"},
+	})
+	m.now = func() time.Time { return now }
+
+	assert.True(t, m.isActive(gpio.Low))
+	m.set(true)
+	m.set(true)
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, "doorOpened", events.Events()[0].Type)
+	assert.Equal(t, "enclosure", events.Events()[0].Details["location"])
+	assert.Equal(t, "door", events.Events()[0].Details["input"])
+
+	// Too soon after the last event.
+	now = now.Add(10 * time.Second)
+	m.set(false)
+	assert.Len(t, events.Events(), 1)
+
+	now = now.Add(time.Minute)
+	m.set(true)
+	assert.Len(t, events.Events(), 2)
+	assert.Equal(t, "doorOpened", events.Events()[1].Type)
+	now = now.Add(time.Minute)
+	m.set(false)
+	assert.Len(t, events.Events(), 3)
+	assert.Equal(t, "doorClosed", events.Events()[2].Type)
+	assert.Equal(t, false, events.Events()[2].Details["active"])
+}
+func TestTamperDetector(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	events := eventtest.Capture(t)
+	photos := 0
+	armed := true
+	c := defaultTamperConfig()
+	c.Pin = "GPIO26"
+	c.MinPulses = 3
+	c.TriggerPhoto = true
+	d := newTamperDetector(c)
+	d.now = func() time.Time { return now }
+	d.armed = func() bool { return armed }
+	d.triggerPhoto = func() { photos++ }
+	pulses := func(n int, gap time.Duration) {
+		for i := 0; i < n; i++ {
+			d.pulse()
+			now = now.Add(gap)
+		}
+	}
+
+	// Ringing within the debounce time counts as one pulse, too few for tamper.
+	pulses(5, time.Millisecond)
+	now = now.Add(3 * time.Second)
+	d.check()
+	assert.Empty(t, events.Events())
+
+	// The photo is requested when the burst reaches min-pulses, the event when it ends.
+	pulses(4, 500*time.Millisecond)
+	assert.Equal(t, 1, photos)
+	assert.Empty(t, events.Events())
+	now = now.Add(3 * time.Second)
+	d.check()
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "tamperDetected", events.Events()[0].Type)
+		assert.Equal(t, 4, events.Events()[0].Details["intensity"])
+		assert.Equal(t, int64(1500), events.Events()[0].Details["durationMs"])
+		assert.Equal(t, true, events.Events()[0].Details["photoRequested"])
+	}
+
+	// Too soon after the last tamper.
+	pulses(4, 500*time.Millisecond)
+	now = now.Add(3 * time.Second)
+	d.check()
+	assert.Len(t, events.Events(), 1)
+
+	// Nothing is reported while disarmed.
+	now = now.Add(time.Minute)
+	armed = false
+	pulses(4, 500*time.Millisecond)
+	now = now.Add(3 * time.Second)
+	d.check()
+	assert.Len(t, events.Events(), 1)
+	assert.Equal(t, 1, photos)
+}
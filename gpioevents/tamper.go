@@ -0,0 +1,255 @@
+package gpioevents
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/godbus/dbus"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
+)
+
+// A piezo or vibration sensor on the enclosure gives a burst of pulses when the enclosure is
+// knocked or moved, so instead of making an event for each change the pulses are counted:
+//
+//	[tamper]
+//	pin = "GPIO26"
+//	pull = "down"
+//	debounce = "5ms"
+//	window = "2s"
+//	min-pulses = 5
+//	min-interval = "1m"
+//	trigger-photo = true
+//
+// Pulses with less than window between them are one burst. A burst of at least min-pulses is
+// tamper, smaller ones are ignored as the wind or an animal brushing past. A tamperDetected
+// event is made when the burst ends, with the number of pulses as the intensity and how long
+// it lasted. If trigger-photo is set the camera is asked to take a recording as soon as the
+// burst reaches min-pulses, while whoever is tampering is still in view. Tamper detection can
+// be disarmed over D-Bus, such as while the device is being serviced.
+const (
+	TamperConfigKey = "tamper"
+	// TamperDisarmedFile is there while tamper detection is disarmed, so it is kept over
+	// restarts and can be set by the controller while the detector is running in another process.
+	TamperDisarmedFile = "/etc/cacophony/tamper-disarmed"
+
+	thermalRecorderName = "org.cacophony.thermalrecorder"
+	thermalRecorderPath = "/org/cacophony/thermalrecorder"
+)
+
+// TamperConfig is the config for the tamper sensor, it is disabled if there is no pin.
+type TamperConfig struct {
+	Pin       string `mapstructure:"pin"`
+	Pull      string `mapstructure:"pull"`
+	ActiveLow bool   `mapstructure:"active-low"`
+	// Pulses closer together than this are counted as one, a piezo rings after a knock.
+	Debounce time.Duration `mapstructure:"debounce"`
+	// The longest gap between pulses in a burst.
+	Window    time.Duration `mapstructure:"window"`
+	MinPulses int           `mapstructure:"min-pulses"`
+	// Bursts starting closer together than this after a tamper are ignored.
+	MinInterval  time.Duration `mapstructure:"min-interval"`
+	TriggerPhoto bool          `mapstructure:"trigger-photo"`
+}
+
+func defaultTamperConfig() TamperConfig {
+	return TamperConfig{
+		Debounce:    5 * time.Millisecond,
+		Window:      2 * time.Second,
+		MinPulses:   5,
+		MinInterval: time.Minute,
+	}
+}
+
+// LoadTamper returns the config for the tamper sensor, checking it is valid.
+func LoadTamper(config *goconfig.Config) (TamperConfig, error) {
+	c := defaultTamperConfig()
+	if err := configcompat.Unmarshal(config, TamperConfigKey, &c); err != nil {
+		return defaultTamperConfig(), err
+	}
+	if !c.Enabled() {
+		return c, nil
+	}
+	input := Input{Pin: c.Pin, Pull: c.Pull, Event: eventhelper.TamperDetected, Debounce: c.Debounce, MinInterval: c.MinInterval}
+	if err := input.validate(); err != nil {
+		return defaultTamperConfig(), fmt.Errorf("%s: %v", TamperConfigKey, err)
+	}
+	if c.Window <= 0 || c.MinPulses < 1 {
+		return defaultTamperConfig(), fmt.Errorf("%s window and min-pulses must be positive", TamperConfigKey)
+	}
+	return c, nil
+}
+
+// Enabled returns true if a tamper sensor is set up.
+func (c TamperConfig) Enabled() bool {
+	return c.Pin != ""
+}
+
+// SetTamperArmed arms or disarms tamper detection.
+func SetTamperArmed(armed bool) error {
+	if armed {
+		err := os.Remove(TamperDisarmedFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.WriteFile(TamperDisarmedFile, []byte(time.Now().Format(time.RFC3339)), 0644)
+}
+
+// TamperArmed returns true unless tamper detection has been disarmed.
+func TamperArmed() bool {
+	_, err := os.Stat(TamperDisarmedFile)
+	return err != nil
+}
+
+// tamperDetector counts the pulses from the sensor into bursts.
+type tamperDetector struct {
+	config       TamperConfig
+	now          func() time.Time
+	armed        func() bool
+	triggerPhoto func()
+
+	mu             sync.Mutex
+	pulses         int
+	first          time.Time
+	last           time.Time
+	detected       bool // The burst has reached min-pulses.
+	photoRequested bool
+	lastDetected   time.Time
+}
+
+func newTamperDetector(c TamperConfig) *tamperDetector {
+	return &tamperDetector{
+		config: c,
+		now:    time.Now,
+		armed:  TamperArmed,
+		triggerPhoto: func() {
+			go func() {
+				if err := requestPhoto(); err != nil {
+					log.Errorf("Failed to request a photo from the camera: %v", err)
+				}
+			}()
+		},
+	}
+}
+
+// pulse records a pulse from the sensor.
+func (d *tamperDetector) pulse() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	if d.pulses > 0 && now.Sub(d.last) < d.config.Debounce {
+		return
+	}
+	if d.pulses > 0 && now.Sub(d.last) > d.config.Window {
+		d.finish()
+	}
+	if d.pulses == 0 {
+		d.first = now
+	}
+	d.pulses++
+	d.last = now
+	if d.detected || d.pulses < d.config.MinPulses {
+		return
+	}
+	if !d.lastDetected.IsZero() && d.first.Sub(d.lastDetected) < d.config.MinInterval {
+		log.Debug("Ignoring tamper, too soon after the last one")
+		return
+	}
+	if !d.armed() {
+		log.Debug("Ignoring tamper, detection is disarmed")
+		return
+	}
+	d.detected = true
+	d.lastDetected = d.first
+	log.Infof("Tamper detected, %d pulses", d.pulses)
+	if d.config.TriggerPhoto {
+		d.photoRequested = true
+		d.triggerPhoto()
+	}
+}
+
+// check ends the burst if there have been no pulses for the window.
+func (d *tamperDetector) check() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pulses > 0 && d.now().Sub(d.last) > d.config.Window {
+		d.finish()
+	}
+}
+
+// finish ends the burst, making a tamperDetected event if it reached min-pulses.
+func (d *tamperDetector) finish() {
+	if d.detected {
+		duration := d.last.Sub(d.first)
+		log.Infof("Tamper ended after %s, %d pulses", duration, d.pulses)
+		if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.TamperDetected, d.first, eventhelper.Tamper{
+			Pin:            d.config.Pin,
+			Intensity:      d.pulses,
+			DurationMs:     duration.Milliseconds(),
+			PhotoRequested: d.photoRequested,
+		})); err != nil {
+			log.Errorf("Error adding event: %v", err)
+		}
+	}
+	d.pulses = 0
+	d.detected = false
+	d.photoRequested = false
+}
+
+// watch counts the pulses on the pin, checking for the end of a burst when there are none.
+func (d *tamperDetector) watch(pin gpio.PinIn) {
+	for {
+		if pin.WaitForEdge(d.config.Window) {
+			d.pulse()
+		} else {
+			d.check()
+		}
+	}
+}
+
+// requestPhoto asks the camera to take a recording.
+func requestPhoto() error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	obj := conn.Object(thermalRecorderName, thermalRecorderPath)
+	return obj.Call(thermalRecorderName+".TakeTestRecording", 0).Err
+}
+
+// StartTamper sets up the pin for the tamper sensor and starts counting the pulses from it.
+func StartTamper(c TamperConfig) error {
+	if !c.Enabled() {
+		return nil
+	}
+	if _, err := host.Init(); err != nil {
+		return fmt.Errorf("failed to initialize periph: %v", err)
+	}
+	pin := gpioreg.ByName(c.Pin)
+	if pin == nil {
+		return fmt.Errorf("failed to find GPIO pin '%s' for the tamper sensor", c.Pin)
+	}
+	pull, _ := Input{Pull: c.Pull}.pull()
+	edge := gpio.RisingEdge
+	if c.ActiveLow {
+		edge = gpio.FallingEdge
+	}
+	if err := pin.In(pull, edge); err != nil {
+		return fmt.Errorf("failed to set up pin '%s' for the tamper sensor: %v", c.Pin, err)
+	}
+	armed := "armed"
+	if !TamperArmed() {
+		armed = "disarmed"
+	}
+	log.Infof("Watching tamper sensor on %s, %s", c.Pin, armed)
+	go newTamperDetector(c).watch(pin)
+	return nil
+}
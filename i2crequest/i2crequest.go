@@ -1,6 +1,7 @@
 package i2crequest
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -11,25 +12,81 @@ import (
 const (
 	dbusName = "org.cacophony.i2c"
 	dbusPath = "/org/cacophony/i2c"
+
+	txMethod = dbusName + ".Tx"
+	// txContextMethod is Tx with the timeout covering the time the request is queued in
+	// tc2-hat-i2c, so it isn't started once the client has given up. Versions of tc2-hat-i2c
+	// without it are sent Tx instead.
+	txContextMethod = dbusName + ".TxContext"
+
+	// defaultTimeout is the request timeout in milliseconds used by the context functions when
+	// the context has no deadline.
+	defaultTimeout = 1000
+	// How long to wait for tc2-hat-i2c to start.
+	serviceWaitTime = 10 * time.Second
 )
 
-func Tx(address byte, write []byte, readLen, timeout int) ([]byte, error) {
+// ErrCRCMismatch is returned when the CRC of a response doesn't match the data.
+var ErrCRCMismatch = errors.New("CRC mismatch")
+
+// busObject returns the tc2-hat-i2c D-Bus object, replaced in the tests and benchmarks.
+var busObject = func() (dbus.BusObject, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return nil, err
 	}
+	return conn.Object(dbusName, dbus.ObjectPath(dbusPath)), nil
+}
 
-	var response []byte
+// Tx sends a transaction to the I2C device through tc2-hat-i2c. The timeout is in
+// milliseconds.
+func Tx(address byte, write []byte, readLen, timeout int) ([]byte, error) {
+	return tx(context.Background(), txMethod, address, write, readLen, timeout)
+}
+
+// TxContext sends a transaction to the I2C device through tc2-hat-i2c, returning as soon as
+// the context is done. The time left until the context deadline is sent as the request
+// timeout, so tc2-hat-i2c doesn't use the bus for a request that has been given up on.
+func TxContext(ctx context.Context, address byte, write []byte, readLen int) ([]byte, error) {
+	timeout, err := contextTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tx(ctx, txContextMethod, address, write, readLen, timeout)
+}
+
+func contextTimeout(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return defaultTimeout, nil
+	}
+	timeout := int(time.Until(deadline).Milliseconds())
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
 
-	// Retry mechanism with a maximum wait time of 10 seconds
-	maxWaitTime := 10 * time.Second
+func tx(ctx context.Context, method string, address byte, write []byte, readLen, timeout int) ([]byte, error) {
+	obj, err := busObject()
+	if err != nil {
+		return nil, err
+	}
+
+	var response []byte
 	startTime := time.Now()
 
 	for {
-		obj := conn.Object(dbusName, dbus.ObjectPath(dbusPath))
-
 		// Try to call the method on the service
-		call := obj.Call(dbusName+".Tx", 0, address, write, readLen, timeout)
+		call := obj.Go(method, 0, make(chan *dbus.Call, 1), address, write, readLen, timeout)
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if call.Err == nil {
 			if err := call.Store(&response); err != nil {
 				return nil, err
@@ -37,13 +94,21 @@ func Tx(address byte, write []byte, readLen, timeout int) ([]byte, error) {
 			return response, nil
 		}
 
+		if method != txMethod && isUnknownMethod(call.Err) {
+			method = txMethod
+			continue
+		}
 		// Check if the error is due to the service being unavailable
 		if dbusErr, ok := call.Err.(dbus.Error); ok && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
 			// Service is not available, wait and retry
-			if time.Since(startTime) > maxWaitTime {
+			if time.Since(startTime) > serviceWaitTime {
 				return nil, errors.New("dbus service not available within the timeout period")
 			}
-			time.Sleep(500 * time.Millisecond) // Wait 500ms before retrying
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		} else {
 			// The error is not due to the service being unavailable
 			return nil, call.Err
@@ -51,19 +116,44 @@ func Tx(address byte, write []byte, readLen, timeout int) ([]byte, error) {
 	}
 }
 
+// isUnknownMethod returns true if the error is from calling a method tc2-hat-i2c doesn't have.
+func isUnknownMethod(err error) bool {
+	dbusErr, ok := err.(dbus.Error)
+	return ok && dbusErr.Name == "org.freedesktop.DBus.Error.UnknownMethod"
+}
+
 func CheckAddress(address byte, timeout int) error {
 	_, err := Tx(address, []byte{0x00}, 1, timeout)
 	return err
 }
 
+// CheckAddressContext checks that there is a device at the address, see TxContext.
+func CheckAddressContext(ctx context.Context, address byte) error {
+	_, err := TxContext(ctx, address, []byte{0x00}, 1)
+	return err
+}
+
 func TxWithCRC(address byte, write []byte, readLen, timeout int) ([]byte, error) {
+	return txWithCRC(context.Background(), txMethod, address, write, readLen, timeout)
+}
+
+// TxWithCRCContext sends a transaction with a CRC, see TxContext.
+func TxWithCRCContext(ctx context.Context, address byte, write []byte, readLen int) ([]byte, error) {
+	timeout, err := contextTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return txWithCRC(ctx, txContextMethod, address, write, readLen, timeout)
+}
+
+func txWithCRC(ctx context.Context, method string, address byte, write []byte, readLen, timeout int) ([]byte, error) {
 	writeCRC := CalculateCRC(write)
 	writeWithCRC := append(write, byte(writeCRC>>8), byte(writeCRC&0xFF))
 
 	if readLen != 0 {
 		readLen += 2
 	}
-	response, err := Tx(address, writeWithCRC, readLen, timeout)
+	response, err := tx(ctx, method, address, writeWithCRC, readLen, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +161,7 @@ func TxWithCRC(address byte, write []byte, readLen, timeout int) ([]byte, error)
 		calculatedCRC := CalculateCRC(response[:len(response)-2])
 		receivedCRC := uint16(response[len(response)-2])<<8 | uint16(response[len(response)-1])
 		if calculatedCRC != receivedCRC {
-			return nil, fmt.Errorf("CRC mismatch: received 0x%X, calculated 0x%X", receivedCRC, calculatedCRC)
+			return nil, fmt.Errorf("%w: received 0x%X, calculated 0x%X", ErrCRCMismatch, receivedCRC, calculatedCRC)
 		}
 	}
 	if readLen == 0 {
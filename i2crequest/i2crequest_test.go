@@ -0,0 +1,139 @@
+package i2crequest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextTimeout(t *testing.T) {
+	timeout, err := contextTimeout(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, defaultTimeout, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	timeout, err = contextTimeout(ctx)
+	assert.NoError(t, err)
+	assert.InDelta(t, 300, timeout, 50)
+
+	cancel()
+	_, err = contextTimeout(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	_, err = contextTimeout(expired)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// fakeI2C answers the Tx calls straight away with the register number as the value.
+type fakeI2C struct {
+	dbus.BusObject
+	corrupt     bool
+	noTxContext bool     // Like a tc2-hat-i2c from before TxContext.
+	methods     []string // Called, in order.
+}
+
+func (f *fakeI2C) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	f.methods = append(f.methods, method)
+	if f.noTxContext && method == txContextMethod {
+		call := &dbus.Call{Done: ch, Err: dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod"}}
+		ch <- call
+		return call
+	}
+	write := args[1].([]byte)
+	response := []byte{write[0]}
+	if args[2].(int) == 3 {
+		crc := CalculateCRC(response)
+		response = append(response, byte(crc>>8), byte(crc&0xFF))
+	}
+	if f.corrupt {
+		response[0]++
+	}
+	call := &dbus.Call{Done: ch, Body: []interface{}{response}}
+	ch <- call
+	return call
+}
+
+func useFakeI2C(t testing.TB, f *fakeI2C) *int {
+	objects := 0
+	original := busObject
+	busObject = func() (dbus.BusObject, error) {
+		objects++
+		return f, nil
+	}
+	t.Cleanup(func() { busObject = original })
+	return &objects
+}
+
+func TestRegisterReader(t *testing.T) {
+	f := &fakeI2C{}
+	objects := useFakeI2C(t, f)
+	r := NewRegisterReader(0x25, true)
+	for _, register := range []byte{0x12, 0x34} {
+		value, err := r.ReadRegister(context.Background(), register)
+		assert.NoError(t, err)
+		assert.Equal(t, register, value)
+	}
+	assert.Equal(t, 1, *objects)
+
+	f.corrupt = true
+	_, err := r.ReadRegister(context.Background(), 0x12)
+	assert.ErrorIs(t, err, ErrCRCMismatch)
+
+	// Without a CRC the response is just the value.
+	value, err := NewRegisterReader(0x25, false).ReadRegister(context.Background(), 0x12)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x13), value)
+}
+
+func TestTxContextFallback(t *testing.T) {
+	f := &fakeI2C{}
+	useFakeI2C(t, f)
+	_, err := Tx(0x25, []byte{0x12}, 1, 100)
+	assert.NoError(t, err)
+	_, err = TxContext(context.Background(), 0x25, []byte{0x12}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{txMethod, txContextMethod}, f.methods)
+
+	// Tx is used when tc2-hat-i2c doesn't have TxContext.
+	f.noTxContext = true
+	f.methods = nil
+	_, err = TxContext(context.Background(), 0x25, []byte{0x12}, 1)
+	assert.NoError(t, err)
+	r := NewRegisterReader(0x25, true)
+	for i := 0; i < 2; i++ {
+		_, err = r.ReadRegister(context.Background(), 0x12)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{txContextMethod, txMethod, txContextMethod, txMethod, txMethod}, f.methods)
+}
+
+// The benchmarks compare a register read through TxWithCRCContext with the RegisterReader,
+// with a D-Bus object that answers straight away so only the overhead of each is measured.
+func BenchmarkTxWithCRC(b *testing.B) {
+	useFakeI2C(b, &fakeI2C{})
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := TxWithCRCContext(ctx, 0x25, []byte{0x12}, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRegisterReader(b *testing.B) {
+	useFakeI2C(b, &fakeI2C{})
+	ctx := context.Background()
+	r := NewRegisterReader(0x25, true)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadRegister(ctx, 0x12); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
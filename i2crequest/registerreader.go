@@ -0,0 +1,109 @@
+package i2crequest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus"
+)
+
+// RegisterReader reads single registers of a device over and over, for polling at a high
+// rate. Each Tx gets the system bus, makes the D-Bus object and allocates the request and
+// the reply. The RegisterReader keeps the object and reuses the request buffer and reply
+// channel, and takes the response straight from the reply without reflection, so only the
+// D-Bus message itself is allocated for each read. Reads are made one at a time, and aren't
+// retried when tc2-hat-i2c isn't running.
+type RegisterReader struct {
+	address byte
+	crc     bool
+
+	mu     sync.Mutex
+	obj    dbus.BusObject
+	method string // TxContext, or Tx if tc2-hat-i2c doesn't have it.
+	write  []byte
+	done   chan *dbus.Call
+}
+
+// NewRegisterReader returns a reader for the device at the address. With crc the requests and
+// responses have a CRC, like TxWithCRC.
+func NewRegisterReader(address byte, crc bool) *RegisterReader {
+	return &RegisterReader{
+		address: address,
+		crc:     crc,
+		method:  txContextMethod,
+		write:   make([]byte, 3),
+		done:    make(chan *dbus.Call, 1),
+	}
+}
+
+// ReadRegister reads the register, returning as soon as the context is done.
+func (r *RegisterReader) ReadRegister(ctx context.Context, register byte) (byte, error) {
+	timeout, err := contextTimeout(ctx)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.obj == nil {
+		if r.obj, err = busObject(); err != nil {
+			return 0, err
+		}
+	}
+
+	write := r.write[:1]
+	write[0] = register
+	readLen := 1
+	if r.crc {
+		crc := CalculateCRC(write)
+		write = append(write, byte(crc>>8), byte(crc&0xFF))
+		readLen += 2
+	}
+	call, err := r.call(ctx, write, readLen, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if r.method != txMethod && isUnknownMethod(call.Err) {
+		r.method = txMethod
+		if call, err = r.call(ctx, write, readLen, timeout); err != nil {
+			return 0, err
+		}
+	}
+	if call.Err != nil {
+		if _, ok := call.Err.(dbus.Error); !ok {
+			// Not an error from tc2-hat-i2c, get the bus again for the next read.
+			r.obj = nil
+		}
+		return 0, call.Err
+	}
+
+	var response []byte
+	if len(call.Body) == 1 {
+		response, _ = call.Body[0].([]byte)
+	}
+	if len(response) != readLen {
+		return 0, fmt.Errorf("expected a %d byte response, got %v", readLen, call.Body)
+	}
+	if r.crc {
+		calculatedCRC := CalculateCRC(response[:1])
+		receivedCRC := uint16(response[1])<<8 | uint16(response[2])
+		if calculatedCRC != receivedCRC {
+			return 0, fmt.Errorf("%w: received 0x%X, calculated 0x%X", ErrCRCMismatch, receivedCRC, calculatedCRC)
+		}
+	}
+	return response[0], nil
+}
+
+// call sends the request, returning as soon as the context is done.
+func (r *RegisterReader) call(ctx context.Context, write []byte, readLen, timeout int) (*dbus.Call, error) {
+	call := r.obj.Go(r.method, 0, r.done, r.address, write, readLen, timeout)
+	select {
+	case <-call.Done:
+		return call, nil
+	case <-ctx.Done():
+		// The request could still be sent and answered, so don't reuse its buffer or channel.
+		r.write = make([]byte, 3)
+		r.done = make(chan *dbus.Call, 1)
+		return nil, ctx.Err()
+	}
+}
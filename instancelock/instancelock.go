@@ -0,0 +1,172 @@
+// Package instancelock stops two copies of a hat service from driving the same hardware,
+// such as during a botched upgrade where the old service is still running.
+//
+// Each service holds an exclusive lock on a file in /var/run for as long as it runs, the
+// lock is released by the kernel when the process exits so it can't be left stale by a
+// crash. The PID of the holder is written to the file. A new instance started with replace
+// asks the running one to stop with SIGTERM, then SIGKILL if it hasn't released the lock
+// after replaceTimeout, and reports the displaced instance with an instanceDisplaced event.
+package instancelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+const (
+	replaceTimeout = 10 * time.Second
+	killTimeout    = 5 * time.Second
+	pollInterval   = 100 * time.Millisecond
+)
+
+var (
+	log = logging.NewLogger("info")
+
+	lockDir = "/var/run"
+	signal  = syscall.Kill
+
+	// Held locks are kept here so the files aren't closed, releasing the lock, when the
+	// caller doesn't keep the Lock.
+	mu   sync.Mutex
+	held = map[*Lock]bool{}
+)
+
+// RunningError is returned when another instance holds the lock.
+type RunningError struct {
+	Name string
+	PID  int
+}
+
+func (e *RunningError) Error() string {
+	return fmt.Sprintf("another instance of %s is running (pid %d), use --replace to take over from it", e.Name, e.PID)
+}
+
+// Lock is held by the running instance of a service.
+type Lock struct {
+	name string
+	file *os.File
+}
+
+// Acquire takes the lock for the named service. If another instance holds it a
+// RunningError is returned, unless replace is true, then the other instance is stopped.
+func Acquire(name string, replace bool) (*Lock, error) {
+	path := filepath.Join(lockDir, name+".lock")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLock(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !locked {
+		pid := holderPID(path)
+		if !replace {
+			file.Close()
+			return nil, &RunningError{Name: name, PID: pid}
+		}
+		if err := displace(file, name, pid); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	l := &Lock{name: name, file: file}
+	mu.Lock()
+	held[l] = true
+	mu.Unlock()
+	return l, nil
+}
+
+// Release releases the lock, it is also released when the process exits.
+func (l *Lock) Release() error {
+	mu.Lock()
+	delete(held, l)
+	mu.Unlock()
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		return err
+	}
+	return l.file.Close()
+}
+
+func tryLock(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func holderPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// displace stops the instance holding the lock and takes the lock.
+func displace(file *os.File, name string, pid int) error {
+	if pid <= 0 || pid == os.Getpid() {
+		return fmt.Errorf("can't replace the instance of %s holding the lock, unknown pid %d", name, pid)
+	}
+	log.Printf("Replacing the running instance of %s (pid %d)", name, pid)
+	killed := false
+	if err := signal(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to stop pid %d: %v", pid, err)
+	}
+	locked, err := waitForLock(file, replaceTimeout)
+	if err == nil && !locked {
+		log.Printf("Instance of %s (pid %d) didn't stop, killing it", name, pid)
+		killed = true
+		if err := signal(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to kill pid %d: %v", pid, err)
+		}
+		locked, err = waitForLock(file, killTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("instance of %s (pid %d) didn't release the lock", name, pid)
+	}
+
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.InstanceDisplaced, time.Now(), eventhelper.InstanceDisplacement{
+		Service:    name,
+		PID:        pid,
+		ReplacedBy: os.Getpid(),
+		Killed:     killed,
+	})); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+	return nil
+}
+
+func waitForLock(file *os.File, timeout time.Duration) (bool, error) {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(pollInterval) {
+		locked, err := tryLock(file)
+		if err != nil || locked {
+			return locked, err
+		}
+	}
+	return false, nil
+}
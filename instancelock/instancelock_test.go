@@ -0,0 +1,54 @@
+package instancelock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquire(t *testing.T) {
+	lockDir = t.TempDir()
+	l, err := Acquire("tc2-hat-test", false)
+	assert.NoError(t, err)
+
+	_, err = Acquire("tc2-hat-test", false)
+	var running *RunningError
+	if assert.True(t, errors.As(err, &running)) {
+		assert.Equal(t, os.Getpid(), running.PID)
+	}
+
+	assert.NoError(t, l.Release())
+	l, err = Acquire("tc2-hat-test", false)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Release())
+}
+
+func TestReplace(t *testing.T) {
+	lockDir = t.TempDir()
+	old, err := Acquire("tc2-hat-test", false)
+	assert.NoError(t, err)
+	// Pretend the lock is held by another process.
+	_, err = old.file.WriteAt([]byte("99999\n"), 0)
+	assert.NoError(t, err)
+
+	signals := []syscall.Signal{}
+	signal = func(pid int, sig syscall.Signal) error {
+		assert.Equal(t, 99999, pid)
+		signals = append(signals, sig)
+		return old.Release()
+	}
+	events := eventtest.Capture(t)
+
+	l, err := Acquire("tc2-hat-test", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []syscall.Signal{syscall.SIGTERM}, signals)
+	if assert.Len(t, events.Events(), 1) {
+		assert.Equal(t, "instanceDisplaced", events.Events()[0].Type)
+		assert.Equal(t, 99999, events.Events()[0].Details["pid"])
+	}
+	assert.NoError(t, l.Release())
+}
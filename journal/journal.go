@@ -0,0 +1,128 @@
+// Package journal sends readings to the systemd journal as structured fields, so sites that
+// ship their logs from journald get the hat telemetry without collecting the CSV files. It is
+// written alongside the CSV files when enabled:
+//
+//	[journal-telemetry]
+//	enable = true
+//
+// Entries are sent to the journald socket with the native protocol.
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
+)
+
+const (
+	ConfigKey  = "journal-telemetry"
+	socketPath = "/run/systemd/journal/socket"
+	// Priority of the entries, LOG_INFO.
+	priorityInfo = "6"
+)
+
+// Config is read from the "journal-telemetry" section of the config.
+type Config struct {
+	Enable bool `mapstructure:"enable"`
+}
+
+// LoadConfig returns the journal config, it isn't enabled if there is no config.
+func LoadConfig(config *goconfig.Config) (Config, error) {
+	c := Config{}
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, ConfigKey, &c); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Writer sends entries to the journal. A nil Writer doesn't send anything, so it can be used
+// when journal telemetry isn't enabled.
+type Writer struct {
+	identifier string
+	send       func([]byte) error
+}
+
+// New returns a writer for entries from the service, nil if it isn't enabled or when
+// running standalone.
+func New(c Config, identifier string) *Writer {
+	if !c.Enable || standalone.Enabled() {
+		return nil
+	}
+	return &Writer{identifier: identifier, send: sendToSocket}
+}
+
+// Send sends an entry with the message and fields. Field names are upper case letters, digits
+// and underscores, e.g. TEMP or BATT_PCT.
+func (w *Writer) Send(message string, fields map[string]string) error {
+	if w == nil {
+		return nil
+	}
+	for name := range fields {
+		if !validFieldName(name) {
+			return fmt.Errorf("invalid journal field name '%s'", name)
+		}
+	}
+	all := map[string]string{
+		"MESSAGE":           message,
+		"PRIORITY":          priorityInfo,
+		"SYSLOG_IDENTIFIER": w.identifier,
+	}
+	for name, value := range fields {
+		all[name] = value
+	}
+	return w.send(encode(all))
+}
+
+func validFieldName(name string) bool {
+	if name == "" || name[0] == '_' || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// encode encodes the fields with the journal native protocol. Values with a new line are
+// sent as the name, a new line, the little endian 64 bit length and the value.
+func encode(fields map[string]string) []byte {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b := &bytes.Buffer{}
+	for _, name := range names {
+		value := fields[name]
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(b, "%s=%s\n", name, value)
+			continue
+		}
+		b.WriteString(name + "\n")
+		_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value + "\n")
+	}
+	return b.Bytes()
+}
+
+func sendToSocket(data []byte) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(data)
+	return err
+}
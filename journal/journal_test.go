@@ -0,0 +1,30 @@
+package journal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSend(t *testing.T) {
+	var sent []byte
+	w := &Writer{identifier: "tc2-hat-temp", send: func(data []byte) error {
+		sent = data
+		return nil
+	}}
+	assert.NoError(t, w.Send("Temp: 21.50", map[string]string{"TEMP": "21.50", "HUM": "60.25"}))
+	assert.Equal(t, "HUM=60.25\nMESSAGE=Temp: 21.50\nPRIORITY=6\nSYSLOG_IDENTIFIER=tc2-hat-temp\nTEMP=21.50\n", string(sent))
+
+	assert.Error(t, w.Send("", map[string]string{"temp": "1"}))
+	assert.Error(t, w.Send("", map[string]string{"_PID": "1"}))
+
+	var nilWriter *Writer
+	assert.NoError(t, nilWriter.Send("not sent", nil))
+	assert.Nil(t, New(Config{}, "tc2-hat-temp"))
+}
+
+func TestEncodeMultiline(t *testing.T) {
+	assert.Equal(t,
+		"MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n",
+		string(encode(map[string]string{"MESSAGE": "a\nb"})))
+}
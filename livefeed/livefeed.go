@@ -0,0 +1,124 @@
+// Package livefeed pushes each new temperature, battery and ATtiny state sample to subscribers
+// as it happens, so the management UI can show live graphs while a device is being installed
+// instead of polling the CSV files. Samples are sent as D-Bus signals on the system bus, all
+// the hat services use the same interface so one match rule gets them all:
+//
+//	type='signal',interface='org.cacophony.TC2HatLive'
+//
+// The signal is named for the kind of sample, with the service that sent it and the sample
+// as JSON, e.g. org.cacophony.TC2HatLive.Battery("tc2-hat-attiny", `{"time":...}`). Signals
+// are dropped by the bus when no one is subscribed, so they are always sent.
+package livefeed
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/standalone"
+	"github.com/godbus/dbus"
+)
+
+const (
+	Interface = "org.cacophony.TC2HatLive"
+	Path      = "/org/cacophony/TC2HatLive"
+)
+
+// The kinds of sample.
+const (
+	Temperature = "Temperature"
+	Battery     = "Battery"
+	ATtinyState = "ATtinyState"
+)
+
+// TemperatureSample is a reading from a temperature and humidity sensor.
+type TemperatureSample struct {
+	Time        time.Time `json:"time"`
+	Board       string    `json:"board,omitempty"`     // Empty for the sensor on the main hat.
+	Temperature float32   `json:"temperature"`         // °C
+	Humidity    float32   `json:"humidity"`            // %
+	Estimated   bool      `json:"estimated,omitempty"` // Estimated from the SoC, without a humidity.
+}
+
+// ATtinyStateSample is the state of the camera as set on the ATtiny.
+type ATtinyStateSample struct {
+	Time            time.Time `json:"time"`
+	CameraState     string    `json:"cameraState"`
+	ConnectionState string    `json:"connectionState"`
+}
+
+// Feed sends the samples from a service. A nil Feed doesn't send anything, so it can be used
+// when replaying readings.
+type Feed struct {
+	source string
+	send   func(name string, source, sample string) error
+}
+
+// New returns a feed for the samples from the service, nil when running standalone.
+func New(source string) *Feed {
+	if standalone.Enabled() {
+		return nil
+	}
+	return &Feed{source: source, send: emit}
+}
+
+// Send sends the sample, which is marshalled to JSON.
+func (f *Feed) Send(kind string, sample interface{}) error {
+	if f == nil {
+		return nil
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	return f.send(Interface+"."+kind, f.source, string(data))
+}
+
+func emit(name string, source, sample string) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	return conn.Emit(Path, name, source, sample)
+}
+
+// Sample is a sample received from the feed.
+type Sample struct {
+	Kind   string          `json:"kind"`
+	Source string          `json:"source"`
+	Sample json.RawMessage `json:"sample"`
+}
+
+// Subscribe returns the samples sent by the hat services until the connection is closed.
+func Subscribe(conn *dbus.Conn) (<-chan Sample, error) {
+	rule := fmt.Sprintf("type='signal',interface='%s'", Interface)
+	if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule); call.Err != nil {
+		return nil, call.Err
+	}
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+	samples := make(chan Sample, 10)
+	go func() {
+		defer close(samples)
+		for signal := range signals {
+			if s, ok := parseSignal(signal); ok {
+				samples <- s
+			}
+		}
+	}()
+	return samples, nil
+}
+
+func parseSignal(signal *dbus.Signal) (Sample, bool) {
+	kind, ok := strings.CutPrefix(signal.Name, Interface+".")
+	if !ok || len(signal.Body) != 2 {
+		return Sample{}, false
+	}
+	source, ok1 := signal.Body[0].(string)
+	sample, ok2 := signal.Body[1].(string)
+	if !ok1 || !ok2 || !json.Valid([]byte(sample)) {
+		return Sample{}, false
+	}
+	return Sample{Kind: kind, Source: source, Sample: json.RawMessage(sample)}, true
+}
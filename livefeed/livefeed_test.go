@@ -0,0 +1,31 @@
+package livefeed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendAndParse(t *testing.T) {
+	var signal *dbus.Signal
+	f := &Feed{source: "tc2-hat-temp", send: func(name string, source, sample string) error {
+		signal = &dbus.Signal{Name: name, Body: []interface{}{source, sample}}
+		return nil
+	}}
+	sample := TemperatureSample{Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), Temperature: 21.5, Humidity: 60}
+	assert.NoError(t, f.Send(Temperature, sample))
+
+	s, ok := parseSignal(signal)
+	assert.True(t, ok)
+	assert.Equal(t, Temperature, s.Kind)
+	assert.Equal(t, "tc2-hat-temp", s.Source)
+	assert.Equal(t, `{"time":"2024-06-01T12:00:00Z","temperature":21.5,"humidity":60}`, string(s.Sample))
+
+	_, ok = parseSignal(&dbus.Signal{Name: "org.cacophony.thermalrecorder.Tracking", Body: []interface{}{"a", "{}"}})
+	assert.False(t, ok)
+
+	var nilFeed *Feed
+	assert.NoError(t, nilFeed.Send(Battery, sample))
+}
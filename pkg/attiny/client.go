@@ -0,0 +1,274 @@
+package attiny
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+)
+
+const (
+	defaultTxAttempts   = 3
+	txRetryInterval     = 100 * time.Millisecond
+	analogReadingDelay  = 200 * time.Millisecond
+	analogPollInterval  = 5 * time.Millisecond
+	analogReadings      = 5
+	analogMaxDifference = 50
+)
+
+// TxFunc sends a transaction to the ATtiny, the CRC is added to the write and checked and
+// removed from the read.
+type TxFunc func(write, read []byte) error
+
+// Client reads and writes the ATtiny registers.
+type Client struct {
+	tx    TxFunc
+	sleep func(time.Duration)
+	// Used by ReadAnalogFast to poll the registers, nil to use ReadRegister.
+	fastRead func(Register) (uint8, error)
+}
+
+// NewClient returns a client that uses tx for the transactions, such as one that records
+// statistics about the link.
+func NewClient(tx TxFunc) *Client {
+	return &Client{tx: tx, sleep: time.Sleep}
+}
+
+// NewI2CClient returns a client that sends the transactions through tc2-hat-i2c, retrying
+// failed transactions.
+func NewI2CClient() *Client {
+	return NewI2CClientContext(context.Background())
+}
+
+// NewI2CClientContext returns a client like NewI2CClient that gives up on the transactions
+// once the context is done.
+func NewI2CClientContext(ctx context.Context) *Client {
+	return NewClient(func(write, read []byte) error {
+		var err error
+		for attempt := 0; attempt < defaultTxAttempts; attempt++ {
+			if err = TxWithCRCContext(ctx, write, read); err == nil || ctx.Err() != nil {
+				return err
+			}
+			time.Sleep(txRetryInterval)
+		}
+		return err
+	})
+}
+
+// TxWithCRC sends a single transaction to the ATtiny through tc2-hat-i2c.
+func TxWithCRC(write, read []byte) error {
+	return TxWithCRCContext(context.Background(), write, read)
+}
+
+// TxWithCRCContext sends a single transaction to the ATtiny through tc2-hat-i2c, returning
+// once the context is done.
+func TxWithCRCContext(ctx context.Context, write, read []byte) error {
+	response, err := i2crequest.TxWithCRCContext(ctx, Address, write, len(read))
+	if err != nil {
+		return err
+	}
+	copy(read, response)
+	return nil
+}
+
+// ReadRegister reads the value of the register.
+func (c *Client) ReadRegister(register Register) (uint8, error) {
+	read := make([]byte, 1)
+	if err := c.tx([]byte{byte(register)}, read); err != nil {
+		return 0, err
+	}
+	return read[0], nil
+}
+
+// WriteRegister writes the data to the register. If retries is 0 or above it will verify the
+// write by reading the register back, retrying up to retries times.
+// Set retries to -1 if you are not wanting to verify the write operation.
+func (c *Client) WriteRegister(register Register, data uint8, retries int) error {
+	if err := c.tx([]byte{byte(register), data}, nil); err != nil {
+		if retries <= 0 {
+			return err
+		}
+		c.sleep(txRetryInterval)
+		return c.WriteRegister(register, data, retries-1)
+	}
+
+	if retries <= -1 {
+		return nil
+	}
+
+	// Verify the write operation by reading back the data
+	registerVal, err := c.ReadRegister(register)
+	if err != nil {
+		if retries == 0 {
+			return err
+		}
+		c.sleep(txRetryInterval)
+		return c.WriteRegister(register, data, retries-1)
+	}
+	if registerVal != data {
+		if retries == 0 {
+			return fmt.Errorf("error writing 0x%x to register %d. Register value is 0x%x", data, register, registerVal)
+		}
+		c.sleep(txRetryInterval)
+		return c.WriteRegister(register, data, retries-1)
+	}
+	return nil
+}
+
+// ReadErrorCodes returns the errors flagged in the error registers, optionally clearing them.
+func (c *Client) ReadErrorCodes(clearErrors bool) ([]ErrorCode, error) {
+	errorIdCounter := 0
+	errorCodes := []ErrorCode{}
+	for i := 0; i < ErrorRegisters; i++ {
+		errors, err := c.ReadRegister(Register(int(Errors1Reg) + i))
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < 8; j++ {
+			if errors&(1<<j) != 0 {
+				errorCodes = append(errorCodes, ErrorCode(errorIdCounter))
+			}
+			errorIdCounter++
+		}
+	}
+	if clearErrors {
+		if err := c.WriteRegister(ClearErrorReg, 0, 3); err != nil {
+			return nil, err
+		}
+	}
+	return errorCodes, nil
+}
+
+// ReadAnalog makes an analog reading, reg1 and reg2 are the high and low registers.
+func (c *Client) ReadAnalog(reg1, reg2 Register) (uint16, error) {
+	// Write to the 7th bit to trigger an analog reading.
+	if err := c.WriteRegister(reg1, AnalogReadingStart, -1); err != nil {
+		return 0, err
+	}
+
+	// Wait for ATtiny to make the analog reading
+	c.sleep(analogReadingDelay)
+
+	val1, err := c.ReadRegister(reg1)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check if the 7th bit has been set back to 0, indicating the analog reading has been made.
+	if val1&AnalogReadingStart != 0 {
+		return 0, fmt.Errorf("analog reading not made")
+	}
+
+	val2, err := c.ReadRegister(reg2)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(val1)<<8 | uint16(val2), nil
+}
+
+// ReadAveragedAnalog makes several analog readings and returns the average and the
+// difference between the highest and lowest. The readings are rejected if they vary too much.
+func (c *Client) ReadAveragedAnalog(reg1, reg2 Register) (uint16, uint16, error) {
+	readings := make([]uint16, analogReadings)
+	maxVal := uint16(0)
+	minVal := uint16(0xFFFF)
+	sum := 0
+	for i := range readings {
+		val, err := c.ReadAnalog(reg1, reg2)
+		if err != nil {
+			return 0, 0, err
+		}
+		readings[i] = val
+		maxVal = max(maxVal, val)
+		minVal = min(minVal, val)
+		sum += int(val)
+	}
+	diff := maxVal - minVal
+	if diff > analogMaxDifference {
+		return 0, 0, fmt.Errorf("difference in max and min analog readings was %d, readings were %v", diff, readings)
+	}
+	return uint16(sum / analogReadings), diff, nil
+}
+
+// ReadAnalogFast makes an analog reading, polling for the reading to finish instead of
+// waiting the full reading delay. Used for sampling the voltage quickly.
+func (c *Client) ReadAnalogFast(reg1, reg2 Register) (uint16, error) {
+	if err := c.WriteRegister(reg1, AnalogReadingStart, -1); err != nil {
+		return 0, err
+	}
+	for waited := time.Duration(0); ; waited += analogPollInterval {
+		c.sleep(analogPollInterval)
+		val1, err := c.pollRegister(reg1)
+		if err != nil {
+			return 0, err
+		}
+		if val1&AnalogReadingStart == 0 {
+			val2, err := c.pollRegister(reg2)
+			if err != nil {
+				return 0, err
+			}
+			return uint16(val1)<<8 | uint16(val2), nil
+		}
+		if waited >= analogReadingDelay {
+			return 0, fmt.Errorf("analog reading not made")
+		}
+	}
+}
+
+// SetFastRead sets how ReadAnalogFast polls the registers, such as with an
+// i2crequest.RegisterReader that doesn't need a new D-Bus request set up for each poll.
+func (c *Client) SetFastRead(read func(Register) (uint8, error)) {
+	c.fastRead = read
+}
+
+func (c *Client) pollRegister(register Register) (uint8, error) {
+	if c.fastRead != nil {
+		return c.fastRead(register)
+	}
+	return c.ReadRegister(register)
+}
+
+// SetAuxPower turns the aux power on or off, which also clears the tripped flag.
+func (c *Client) SetAuxPower(on bool) error {
+	var val uint8
+	if on {
+		val = AuxPowerOnFlag
+	}
+	return c.WriteRegister(AuxPowerCtrlReg, val, 3)
+}
+
+// ReadAuxPower returns if the aux power is on and if it was cut because of a short circuit.
+func (c *Client) ReadAuxPower() (on, tripped bool, err error) {
+	val, err := c.ReadRegister(AuxPowerCtrlReg)
+	if err != nil {
+		return false, false, err
+	}
+	return val&AuxPowerOnFlag != 0, val&AuxPowerTrippedFlag != 0, nil
+}
+
+// ReadAuxCurrent returns the current drawn from the aux power in mA, if it is supported.
+func (c *Client) ReadAuxCurrent() (mA int, supported bool, err error) {
+	val1, err := c.ReadRegister(AuxCurrent1Reg)
+	if err != nil {
+		return 0, false, err
+	}
+	val2, err := c.ReadRegister(AuxCurrent2Reg)
+	if err != nil {
+		return 0, false, err
+	}
+	current := int(val1)<<8 | int(val2)
+	if current == AuxCurrentUnsupported {
+		return 0, false, nil
+	}
+	return current, true, nil
+}
+
+// SetBuzzer turns the buzzer on or off.
+func (c *Client) SetBuzzer(on bool) error {
+	var val uint8
+	if on {
+		val = BuzzerOnFlag
+	}
+	return c.WriteRegister(BuzzerCtrlReg, val, 3)
+}
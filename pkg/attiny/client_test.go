@@ -0,0 +1,155 @@
+package attiny
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeATtiny has registers that can be read and written, analog readings are made instantly.
+type fakeATtiny struct {
+	regs      [256]uint8
+	analog    uint16
+	failWrite int // Number of writes to fail.
+}
+
+func (f *fakeATtiny) tx(write, read []byte) error {
+	reg := write[0]
+	if len(write) > 1 {
+		if f.failWrite > 0 {
+			f.failWrite--
+			return errors.New("write failed")
+		}
+		f.regs[reg] = write[1]
+		if write[1]&AnalogReadingStart != 0 {
+			f.regs[reg] = uint8(f.analog >> 8)
+			f.regs[reg+1] = uint8(f.analog)
+		}
+	}
+	copy(read, f.regs[reg:])
+	return nil
+}
+
+func newFakeClient(f *fakeATtiny) *Client {
+	c := NewClient(f.tx)
+	c.sleep = func(time.Duration) {}
+	return c
+}
+
+func TestWriteRegisterRetries(t *testing.T) {
+	f := &fakeATtiny{failWrite: 2}
+	c := newFakeClient(f)
+	assert.NoError(t, c.WriteRegister(CameraStateReg, uint8(StatePoweredOn), 3))
+	val, err := c.ReadRegister(CameraStateReg)
+	assert.NoError(t, err)
+	assert.Equal(t, StatePoweredOn, CameraState(val))
+
+	f.failWrite = 2
+	assert.Error(t, c.WriteRegister(CameraStateReg, 0, 1))
+}
+
+func TestReadErrorCodes(t *testing.T) {
+	f := &fakeATtiny{}
+	f.regs[Errors1Reg] = 1<<POWER_ON_FAILED | 1<<WATCHDOG_TIMEOUT
+	f.regs[Errors2Reg] = 1 << (CRC_ERROR - 8)
+	c := newFakeClient(f)
+	codes, err := c.ReadErrorCodes(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []ErrorCode{POWER_ON_FAILED, WATCHDOG_TIMEOUT, CRC_ERROR}, codes)
+}
+
+func TestReadAveragedAnalog(t *testing.T) {
+	f := &fakeATtiny{analog: 512}
+	c := newFakeClient(f)
+	avg, diff, err := c.ReadAveragedAnalog(BatteryLVDivVal1Reg, BatteryLVDivVal2Reg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(512), avg)
+	assert.Equal(t, uint16(0), diff)
+}
+
+func TestReadAnalogFast(t *testing.T) {
+	f := &fakeATtiny{analog: 300}
+	c := newFakeClient(f)
+	slept := time.Duration(0)
+	c.sleep = func(d time.Duration) { slept += d }
+	val, err := c.ReadAnalogFast(BatteryHVDivVal1Reg, BatteryHVDivVal2Reg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(300), val)
+	assert.Equal(t, analogPollInterval, slept)
+
+	// The polls go through the fast read when it is set.
+	polls := 0
+	c.SetFastRead(func(r Register) (uint8, error) {
+		polls++
+		return c.ReadRegister(r)
+	})
+	val, err = c.ReadAnalogFast(BatteryHVDivVal1Reg, BatteryHVDivVal2Reg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(300), val)
+	assert.Equal(t, 2, polls)
+}
+
+func TestReadCachedTemperature(t *testing.T) {
+	f := &fakeATtiny{}
+	c := newFakeClient(f)
+	_, ok, err := c.ReadCachedTemperature()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	temp := int16(-525)
+	f.regs[TemperatureCacheReg] = TemperatureCachedFlag
+	f.regs[Temperature1Reg] = uint8(uint16(temp) >> 8)
+	f.regs[Temperature2Reg] = uint8(uint16(temp))
+	f.regs[Humidity1Reg] = 6543 >> 8
+	f.regs[Humidity2Reg] = 6543 & 0xFF
+	f.regs[TemperatureAgeReg] = 12
+	cached, ok, err := c.ReadCachedTemperature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float32(-5.25), cached.Temp)
+	assert.InDelta(t, 65.43, cached.Humidity, 0.001)
+	assert.Equal(t, 12*time.Second, cached.Age)
+}
+
+func TestReadResetCounters(t *testing.T) {
+	f := &fakeATtiny{}
+	c := newFakeClient(f)
+	f.regs[ResetCauseReg] = uint8(ResetBrownOutFlag | ResetPowerOnFlag)
+	f.regs[ResetCount1Reg] = 0x01
+	f.regs[ResetCount2Reg] = 0x02
+	f.regs[BrownOutCount2Reg] = 7
+	f.regs[WatchdogResetCount2Reg] = 3
+	counters, err := c.ReadResetCounters()
+	assert.NoError(t, err)
+	assert.Equal(t, ResetCounters{
+		LastCause:      ResetBrownOutFlag | ResetPowerOnFlag,
+		Resets:         0x0102,
+		BrownOuts:      7,
+		WatchdogResets: 3,
+	}, counters)
+	assert.Equal(t, "powerOn,brownOut", counters.LastCause.String())
+	assert.Equal(t, "unknown", ResetCause(0).String())
+}
+
+func TestPairedDeviceID(t *testing.T) {
+	f := &fakeATtiny{}
+	for i := 0; i < 4; i++ {
+		f.regs[int(PairedDeviceID1Reg)+i] = 0xFF
+	}
+	c := newFakeClient(f)
+	_, ok, err := c.ReadPairedDeviceID()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, c.WritePairedDeviceID(0x01020304))
+	assert.Equal(t, uint8(0x01), f.regs[PairedDeviceID1Reg])
+	assert.Equal(t, uint8(0x04), f.regs[PairedDeviceID4Reg])
+	id, ok, err := c.ReadPairedDeviceID()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0x01020304), id)
+
+	assert.Error(t, c.WritePairedDeviceID(0))
+}
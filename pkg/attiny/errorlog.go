@@ -0,0 +1,65 @@
+package attiny
+
+import (
+	"fmt"
+	"time"
+)
+
+// The ATtiny keeps a history of errors in its EEPROM so errors that happen while the
+// RPi is off are not lost. The firmware counts how many minutes ago each error happened,
+// this is used to estimate when the error occurred. No released firmware has the error log
+// registers yet, so callers only use them when asked to.
+const (
+	ErrorLogMinMajorVersion = 2 // First ATtiny firmware expected to have the persistent error log.
+	errorLogClearVal        = 0xA5
+	errorLogMaxEntries      = 32
+)
+
+type ErrorLogEntry struct {
+	Code       ErrorCode `json:"code"`
+	Error      string    `json:"error"`
+	AgeMinutes uint32    `json:"ageMinutes"`
+	Time       time.Time `json:"time"` // Approximate, calculated from the age when the log was read.
+}
+
+// ReadErrorLog downloads and decodes the persistent error log, oldest entry first.
+// readTime is when the log is read, used to calculate the time of the errors.
+func (c *Client) ReadErrorLog(readTime time.Time) ([]ErrorLogEntry, error) {
+	count, err := c.ReadRegister(ErrorLogCountReg)
+	if err != nil {
+		return nil, err
+	}
+	if count > errorLogMaxEntries {
+		return nil, fmt.Errorf("invalid error log count %d", count)
+	}
+	entries := []ErrorLogEntry{}
+	for i := uint8(0); i < count; i++ {
+		if err := c.WriteRegister(ErrorLogSelectReg, i, 3); err != nil {
+			return nil, err
+		}
+		code, err := c.ReadRegister(ErrorLogCodeReg)
+		if err != nil {
+			return nil, err
+		}
+		var age uint32
+		for _, reg := range []Register{ErrorLogAge1Reg, ErrorLogAge2Reg, ErrorLogAge3Reg, ErrorLogAge4Reg} {
+			val, err := c.ReadRegister(reg)
+			if err != nil {
+				return nil, err
+			}
+			age = age<<8 | uint32(val)
+		}
+		entries = append(entries, ErrorLogEntry{
+			Code:       ErrorCode(code),
+			Error:      ErrorCode(code).String(),
+			AgeMinutes: age,
+			Time:       readTime.Add(-time.Duration(age) * time.Minute),
+		})
+	}
+	return entries, nil
+}
+
+// ClearErrorLog clears the persistent error log.
+func (c *Client) ClearErrorLog() error {
+	return c.WriteRegister(ErrorLogClearReg, errorLogClearVal, -1)
+}
@@ -0,0 +1,39 @@
+package attiny
+
+import "fmt"
+
+// The RPi writes its device ID into the ATtiny EEPROM at startup, so a hat that has been
+// moved to another RPi, or an RPi that has been given another hat, can be detected. Erased
+// EEPROM reads as 0xFF, so 0 and 0xFFFFFFFF are never used as a device ID.
+const (
+	PairingMinMajorVersion = 4 // First ATtiny firmware with the paired device ID.
+	pairedDeviceIDUnset    = 0xFFFFFFFF
+)
+
+// ReadPairedDeviceID reads the device ID of the RPi the ATtiny was last paired with in one
+// transaction, ok is false if it has never been paired.
+func (c *Client) ReadPairedDeviceID() (id uint32, ok bool, err error) {
+	read := make([]byte, 4)
+	if err := c.tx([]byte{byte(PairedDeviceID1Reg)}, read); err != nil {
+		return 0, false, err
+	}
+	id = uint32(read[0])<<24 | uint32(read[1])<<16 | uint32(read[2])<<8 | uint32(read[3])
+	if id == 0 || id == pairedDeviceIDUnset {
+		return 0, false, nil
+	}
+	return id, true, nil
+}
+
+// WritePairedDeviceID writes the device ID of the RPi into the ATtiny, verifying each byte.
+func (c *Client) WritePairedDeviceID(id uint32) error {
+	if id == 0 || id == pairedDeviceIDUnset {
+		return fmt.Errorf("invalid device ID %d", id)
+	}
+	regs := []Register{PairedDeviceID1Reg, PairedDeviceID2Reg, PairedDeviceID3Reg, PairedDeviceID4Reg}
+	for i, reg := range regs {
+		if err := c.WriteRegister(reg, uint8(id>>(24-8*i)), 3); err != nil {
+			return err
+		}
+	}
+	return nil
+}
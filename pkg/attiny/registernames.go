@@ -0,0 +1,67 @@
+package attiny
+
+// registerNames are the names of the registers, for decoding raw I2C frames.
+var registerNames = map[Register]string{
+	TypeReg:                "Type",
+	MajorVersionReg:        "MajorVersion",
+	CameraStateReg:         "CameraState",
+	CameraConnectionReg:    "CameraConnection",
+	PiCommandsReg:          "PiCommands",
+	RP2040PiPowerCtrlReg:   "RP2040PiPowerCtrl",
+	AuxTerminalReg:         "AuxTerminal",
+	TC2AgentReadyReg:       "TC2AgentReady",
+	MinorVersionReg:        "MinorVersion",
+	FlashErrorsReg:         "FlashErrors",
+	ClearErrorReg:          "ClearError",
+	PatchVersionReg:        "PatchVersion",
+	BatteryCheckCtrlReg:    "BatteryCheckCtrl",
+	BatteryLow1Reg:         "BatteryLow1",
+	BatteryLow2Reg:         "BatteryLow2",
+	BatteryLVDivVal1Reg:    "BatteryLVDivVal1",
+	BatteryLVDivVal2Reg:    "BatteryLVDivVal2",
+	BatteryHVDivVal1Reg:    "BatteryHVDivVal1",
+	BatteryHVDivVal2Reg:    "BatteryHVDivVal2",
+	RTCBattery1Reg:         "RTCBattery1",
+	RTCBattery2Reg:         "RTCBattery2",
+	Errors1Reg:             "Errors1",
+	Errors2Reg:             "Errors2",
+	Errors3Reg:             "Errors3",
+	Errors4Reg:             "Errors4",
+	ErrorLogCountReg:       "ErrorLogCount",
+	ErrorLogSelectReg:      "ErrorLogSelect",
+	ErrorLogCodeReg:        "ErrorLogCode",
+	ErrorLogAge1Reg:        "ErrorLogAge1",
+	ErrorLogAge2Reg:        "ErrorLogAge2",
+	ErrorLogAge3Reg:        "ErrorLogAge3",
+	ErrorLogAge4Reg:        "ErrorLogAge4",
+	ErrorLogClearReg:       "ErrorLogClear",
+	AuxPowerCtrlReg:        "AuxPowerCtrl",
+	AuxCurrent1Reg:         "AuxCurrent1",
+	AuxCurrent2Reg:         "AuxCurrent2",
+	TemperatureCacheReg:    "TemperatureCache",
+	Temperature1Reg:        "Temperature1",
+	Temperature2Reg:        "Temperature2",
+	Humidity1Reg:           "Humidity1",
+	Humidity2Reg:           "Humidity2",
+	TemperatureAgeReg:      "TemperatureAge",
+	ResetCauseReg:          "ResetCause",
+	ResetCount1Reg:         "ResetCount1",
+	ResetCount2Reg:         "ResetCount2",
+	BrownOutCount1Reg:      "BrownOutCount1",
+	BrownOutCount2Reg:      "BrownOutCount2",
+	WatchdogResetCount1Reg: "WatchdogResetCount1",
+	WatchdogResetCount2Reg: "WatchdogResetCount2",
+	BuzzerCtrlReg:          "BuzzerCtrl",
+	PairedDeviceID1Reg:     "PairedDeviceID1",
+	PairedDeviceID2Reg:     "PairedDeviceID2",
+	PairedDeviceID3Reg:     "PairedDeviceID3",
+	PairedDeviceID4Reg:     "PairedDeviceID4",
+	ExternalAnalog1Reg:     "ExternalAnalog1",
+	ExternalAnalog2Reg:     "ExternalAnalog2",
+}
+
+// RegisterName returns the name of the register, false if it isn't known.
+func RegisterName(r Register) (string, bool) {
+	name, ok := registerNames[r]
+	return name, ok
+}
@@ -0,0 +1,256 @@
+// Package attiny is a client for the ATtiny on the TC2 hat, which controls the power to the
+// RPi and makes the battery readings. The registers are read and written over I2C, with a
+// CRC, through the tc2-hat-i2c service.
+package attiny
+
+import "fmt"
+
+const (
+	Address            = 0x25
+	TypeVal            = 0xCA   // Value of TypeReg, used to check the device is an ATtiny.
+	AnalogReadingStart = 1 << 7 // Set in the first register of an analog reading to start it.
+)
+
+type Register uint8
+
+const (
+	TypeReg Register = iota
+	MajorVersionReg
+	CameraStateReg
+	CameraConnectionReg
+	PiCommandsReg
+	RP2040PiPowerCtrlReg
+	AuxTerminalReg
+	TC2AgentReadyReg
+	MinorVersionReg
+	FlashErrorsReg
+	ClearErrorReg
+	PatchVersionReg
+)
+
+const (
+	BatteryCheckCtrlReg Register = iota + 0x10
+	BatteryLow1Reg
+	BatteryLow2Reg
+	BatteryLVDivVal1Reg
+	BatteryLVDivVal2Reg
+	BatteryHVDivVal1Reg
+	BatteryHVDivVal2Reg
+	RTCBattery1Reg
+	RTCBattery2Reg
+)
+
+const (
+	Errors1Reg Register = iota + 0x20
+	Errors2Reg
+	Errors3Reg
+	Errors4Reg
+	ErrorRegisters = 4
+)
+
+// The ATtiny keeps a history of errors in its EEPROM, see ReadErrorLog.
+const (
+	ErrorLogCountReg Register = iota + 0x30
+	ErrorLogSelectReg
+	ErrorLogCodeReg
+	ErrorLogAge1Reg
+	ErrorLogAge2Reg
+	ErrorLogAge3Reg
+	ErrorLogAge4Reg
+	ErrorLogClearReg
+)
+
+// Power to the aux connector is switched by the ATtiny. Power PCBs with a current sense
+// resistor on the aux output report the load current in mA, others report AuxCurrentUnsupported.
+const (
+	AuxPowerCtrlReg Register = iota + 0x40
+	AuxCurrent1Reg
+	AuxCurrent2Reg
+)
+
+const (
+	AuxPowerOnFlag        = 1 << 0
+	AuxPowerTrippedFlag   = 1 << 1
+	AuxCurrentUnsupported = 0xFFFF
+)
+
+// Some ATtiny firmware also reads the temperature sensor and caches the last reading, see
+// ReadCachedTemperature.
+const (
+	TemperatureCacheReg Register = iota + 0x50
+	Temperature1Reg
+	Temperature2Reg
+	Humidity1Reg
+	Humidity2Reg
+	TemperatureAgeReg
+)
+
+const (
+	TemperatureCachedFlag = 1 << 0 // Set in TemperatureCacheReg when there is a cached reading.
+)
+
+// The ATtiny counts its resets, by cause, in EEPROM, see ReadResetCounters.
+const (
+	ResetCauseReg Register = iota + 0x60
+	ResetCount1Reg
+	ResetCount2Reg
+	BrownOutCount1Reg
+	BrownOutCount2Reg
+	WatchdogResetCount1Reg
+	WatchdogResetCount2Reg
+)
+
+// ResetCause flags, from the reset flag register of the ATtiny, set in ResetCauseReg.
+const (
+	ResetPowerOnFlag ResetCause = 1 << iota
+	ResetBrownOutFlag
+	ResetExternalFlag
+	ResetWatchdogFlag
+	ResetSoftwareFlag
+	ResetUPDIFlag
+)
+
+// Some power PCBs have a buzzer driven by the ATtiny, see SetBuzzer.
+const (
+	BuzzerCtrlReg Register = iota + 0x70
+)
+
+const (
+	BuzzerOnFlag = 1 << 0
+)
+
+// The ATtiny keeps the device ID of the RPi it was last paired with in EEPROM, big endian,
+// see ReadPairedDeviceID.
+const (
+	PairedDeviceID1Reg Register = iota + 0x80
+	PairedDeviceID2Reg
+	PairedDeviceID3Reg
+	PairedDeviceID4Reg
+)
+
+// Some ATtiny firmware reads an external sensor, such as a bait level or gas pressure sensor,
+// on a spare ADC channel of the aux connector. It is read like the battery voltages, with
+// AnalogReadingStart set in the first register.
+const (
+	ExternalAnalog1Reg Register = iota + 0x90
+	ExternalAnalog2Reg
+)
+
+const ExternalAnalogMinMajorVersion = 5 // First ATtiny firmware with the external analog channel.
+
+// PiCommandFlags
+const (
+	WriteCameraStateFlag = 1 << iota
+	ReadErrorsFlag
+	EnableWifiFlag
+	PowerDownFlag
+	ToggleAuxTerminalFlag
+)
+
+type CameraState uint8
+
+const (
+	StatePoweringOn CameraState = iota
+	StatePoweredOn
+	StatePoweringOff
+	StatePoweredOff
+	StatePowerOnTimeout
+	StateRebooting
+)
+
+func (s CameraState) String() string {
+	switch s {
+	case StatePoweringOn:
+		return "Powering On"
+	case StatePoweredOn:
+		return "Powered On"
+	case StatePoweringOff:
+		return "Powering Off"
+	case StatePoweredOff:
+		return "Powered Off"
+	case StatePowerOnTimeout:
+		return "Power On Timeout"
+	case StateRebooting:
+		return "Rebooting"
+	default:
+		return fmt.Sprintf("Unknown (%d)", int(s))
+	}
+}
+
+type ConnectionState uint8
+
+const (
+	ConnStateWifiNoConnection ConnectionState = iota
+	ConnStateWifiConnected
+	ConnStateHotspot
+	ConnStateWifiSettingUp
+	ConnStateHotspotSettingUp
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnStateWifiNoConnection:
+		return "WIFI, no connection"
+	case ConnStateWifiConnected:
+		return "Wifi, connected"
+	case ConnStateHotspot:
+		return "Hosting Hotspot"
+	case ConnStateWifiSettingUp:
+		return "Setting up WIFI"
+	case ConnStateHotspotSettingUp:
+		return "Setting up hotspot"
+	default:
+		return fmt.Sprintf("Unknown (%d)", int(s))
+	}
+}
+
+type ErrorCode uint8
+
+const (
+	POWER_ON_FAILED               ErrorCode = 0x02
+	WATCHDOG_TIMEOUT              ErrorCode = 0x03
+	INVALID_CAMERA_STATE          ErrorCode = 0x04
+	WRITE_TO_READ_ONLY            ErrorCode = 0x05
+	LOW_BATTERY_LEVEL_SET_TOO_LOW ErrorCode = 0x06
+	INVALID_REG_ADDRESS           ErrorCode = 0x07
+	INVALID_ERROR_CODE            ErrorCode = 0x08
+	NO_PING_RESPONSE              ErrorCode = 0x09
+	RTC_TIMEOUT                   ErrorCode = 0x0A
+	CRC_ERROR                     ErrorCode = 0x0B
+	BAD_I2C_LENGTH_SHORT          ErrorCode = 0x0C
+	BAD_I2C_LENGTH_LONG           ErrorCode = 0x0D
+	BAD_I2C                       ErrorCode = 0x0E
+)
+
+func (e ErrorCode) String() string {
+	switch e {
+	case POWER_ON_FAILED:
+		return "POWER_ON_FAILED"
+	case WATCHDOG_TIMEOUT:
+		return "WATCHDOG_TIMEOUT"
+	case INVALID_CAMERA_STATE:
+		return "INVALID_CAMERA_STATE"
+	case WRITE_TO_READ_ONLY:
+		return "WRITE_TO_READ_ONLY"
+	case LOW_BATTERY_LEVEL_SET_TOO_LOW:
+		return "LOW_BATTERY_LEVEL_SET_TOO_LOW"
+	case INVALID_REG_ADDRESS:
+		return "INVALID_REG_ADDRESS"
+	case INVALID_ERROR_CODE:
+		return "INVALID_ERROR_CODE"
+	case NO_PING_RESPONSE:
+		return "NO_PING_RESPONSE"
+	case RTC_TIMEOUT:
+		return "RTC_TIMEOUT"
+	case CRC_ERROR:
+		return "CRC_ERROR"
+	case BAD_I2C_LENGTH_LONG:
+		return "BAD_I2C_LENGTH_LONG"
+	case BAD_I2C_LENGTH_SHORT:
+		return "BAD_I2C_LENGTH_SHORT"
+	case BAD_I2C:
+		return "BAD_I2C"
+	default:
+		return fmt.Sprintf("UNKNOWN_ERROR_CODE 0x%02X", uint8(e))
+	}
+}
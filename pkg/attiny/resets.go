@@ -0,0 +1,59 @@
+package attiny
+
+import "strings"
+
+// The ATtiny keeps counts of its resets in EEPROM so resets while the RPi is off, such as
+// brown-outs from a weak battery overnight, are not lost. The counts are 16 bit and wrap.
+const (
+	ResetCountersMinMajorVersion = 3 // First ATtiny firmware with the reset counters.
+	resetCounterRegisters        = 7
+)
+
+type ResetCause uint8
+
+var resetCauseNames = []struct {
+	flag ResetCause
+	name string
+}{
+	{ResetPowerOnFlag, "powerOn"},
+	{ResetBrownOutFlag, "brownOut"},
+	{ResetExternalFlag, "external"},
+	{ResetWatchdogFlag, "watchdog"},
+	{ResetSoftwareFlag, "software"},
+	{ResetUPDIFlag, "updi"},
+}
+
+func (r ResetCause) String() string {
+	names := []string{}
+	for _, c := range resetCauseNames {
+		if r&c.flag != 0 {
+			names = append(names, c.name)
+		}
+	}
+	if len(names) == 0 {
+		return "unknown"
+	}
+	return strings.Join(names, ",")
+}
+
+// ResetCounters are the reset counts and the cause of the last reset of the ATtiny.
+type ResetCounters struct {
+	LastCause      ResetCause
+	Resets         uint16
+	BrownOuts      uint16
+	WatchdogResets uint16
+}
+
+// ReadResetCounters reads the reset counters in one transaction.
+func (c *Client) ReadResetCounters() (ResetCounters, error) {
+	read := make([]byte, resetCounterRegisters)
+	if err := c.tx([]byte{byte(ResetCauseReg)}, read); err != nil {
+		return ResetCounters{}, err
+	}
+	return ResetCounters{
+		LastCause:      ResetCause(read[0]),
+		Resets:         uint16(read[1])<<8 | uint16(read[2]),
+		BrownOuts:      uint16(read[3])<<8 | uint16(read[4]),
+		WatchdogResets: uint16(read[5])<<8 | uint16(read[6]),
+	}, nil
+}
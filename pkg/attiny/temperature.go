@@ -0,0 +1,34 @@
+package attiny
+
+import "time"
+
+// The cached temperature is in hundredths of a °C as a signed value and the humidity in
+// hundredths of a percent. The age is the seconds since the reading was made, stopping at 255.
+const temperatureCacheRegisters = 6
+
+// CachedTemperature is the last temperature sensor reading made by the ATtiny.
+type CachedTemperature struct {
+	Temp     float32
+	Humidity float32
+	Age      time.Duration
+}
+
+// ReadCachedTemperature returns the temperature reading cached by the ATtiny. Returns false
+// if the firmware doesn't cache readings or hasn't made one yet. The registers are read in
+// one transaction so the values are all from the same reading.
+func (c *Client) ReadCachedTemperature() (CachedTemperature, bool, error) {
+	read := make([]byte, temperatureCacheRegisters)
+	if err := c.tx([]byte{byte(TemperatureCacheReg)}, read); err != nil {
+		return CachedTemperature{}, false, err
+	}
+	if read[0]&TemperatureCachedFlag == 0 {
+		return CachedTemperature{}, false, nil
+	}
+	temp := int16(uint16(read[1])<<8 | uint16(read[2]))
+	humidity := uint16(read[3])<<8 | uint16(read[4])
+	return CachedTemperature{
+		Temp:     float32(temp) / 100,
+		Humidity: float32(humidity) / 100,
+		Age:      time.Duration(read[5]) * time.Second,
+	}, true, nil
+}
@@ -0,0 +1,139 @@
+package attiny
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ Voltage Divider Circuit Diagram
+
+  V_bat
+   |
+  R1
+   |-- V_out
+  R2
+   |
+  GND
+
+ V_bat = V_in * ((R1 + R2)/R2)
+*/
+
+// Divider is the ADC reference voltage and voltage divider resistors used from a power
+// PCB version onwards.
+type Divider struct {
+	HardwareVersion Version
+	Vref, R1, R2    float32
+}
+
+var LVDividers = []Divider{
+	{"0.1.4", 3.3, 2000, 560 + 33},
+	{"0.1.5", 3.325, 2000, 680},
+	{"0.7.0", 3.3, 2000, 470},
+}
+
+var HVDividers = []Divider{
+	{"0.1.4", 3.3, 2000, 150 + 22},
+	{"0.1.5", 3.325, 2000, 168},
+	{"0.7.0", 3.3, 2000, 168},
+}
+
+var RTCDividers = []Divider{
+	{"0.1.4", 3.3, 0, 1},
+	{"0.1.5", 3.325, 0, 1},
+	{"0.7.0", 3.3, 0, 1},
+}
+
+// adcMax is the raw reading of the ATtiny ADC at the reference voltage.
+const adcMax = 1023
+
+// BatteryVoltage converts a raw ADC reading to the battery voltage using the divider for
+// the power PCB version.
+func BatteryVoltage(raw uint16, pcbVersion Version, dividers []Divider) (float32, error) {
+	d, err := dividerForVersion(pcbVersion, dividers)
+	if err != nil {
+		return 0, err
+	}
+	c := AnalogConfig{Vref: d.Vref, ADCMax: adcMax}
+	return c.Voltage(raw, Channel{R1: d.R1, R2: d.R2}), nil
+}
+
+// Channel is the voltage divider in front of an ADC channel, and an offset in volts that is
+// added to the voltage to correct for the ADC or divider on a particular board.
+type Channel struct {
+	R1, R2 float32
+	Offset float32
+}
+
+// AnalogConfig is how the raw ADC readings of a power PCB are converted to voltages.
+type AnalogConfig struct {
+	Vref   float32
+	ADCMax float32 // Raw reading at Vref.
+	LV     Channel
+	HV     Channel
+	RTC    Channel
+}
+
+// AnalogConfigForVersion returns the analog config for the power PCB version, from the
+// divider tables.
+func AnalogConfigForVersion(pcbVersion Version) (AnalogConfig, error) {
+	c := AnalogConfig{ADCMax: adcMax}
+	for _, ch := range []struct {
+		channel  *Channel
+		dividers []Divider
+	}{
+		{&c.LV, LVDividers},
+		{&c.HV, HVDividers},
+		{&c.RTC, RTCDividers},
+	} {
+		d, err := dividerForVersion(pcbVersion, ch.dividers)
+		if err != nil {
+			return AnalogConfig{}, err
+		}
+		*ch.channel = Channel{R1: d.R1, R2: d.R2}
+		// The dividers all use the ATtiny supply as the reference.
+		c.Vref = d.Vref
+	}
+	return c, nil
+}
+
+// Voltage converts a raw ADC reading of the channel to the voltage before the divider.
+func (c AnalogConfig) Voltage(raw uint16, ch Channel) float32 {
+	v := float32(raw) * c.Vref / c.ADCMax // raw is from 0 to ADCMax, 0 at 0V and ADCMax at Vref
+	return v*(ch.R1+ch.R2)/ch.R2 + ch.Offset
+}
+
+func dividerForVersion(hardwareVer Version, dividers []Divider) (Divider, error) {
+	found := Divider{}
+	for _, d := range dividers {
+		newer, err := hardwareVer.IsNewerOrEqual(d.HardwareVersion)
+		if err != nil {
+			return Divider{}, err
+		}
+		if newer {
+			found = d
+		}
+	}
+	return found, nil
+}
+
+// Version is a hardware version, "major.minor.patch".
+type Version string
+
+func (v Version) IsNewerOrEqual(other Version) (bool, error) {
+	parts := strings.Split(string(v), ".")
+	if len(parts) != 3 {
+		return false, fmt.Errorf("invalid version format '%s", v)
+	}
+	partsOther := strings.Split(string(other), ".")
+	if len(partsOther) != 3 {
+		return false, fmt.Errorf("invalid version format '%s", other)
+	}
+	if parts[0] != partsOther[0] {
+		return parts[0] > partsOther[0], nil
+	}
+	if parts[1] != partsOther[1] {
+		return parts[1] > partsOther[1], nil
+	}
+	return parts[2] >= partsOther[2], nil
+}
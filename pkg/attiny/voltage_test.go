@@ -1,4 +1,4 @@
-package main
+package attiny
 
 import (
 	"testing"
@@ -7,8 +7,8 @@ import (
 )
 
 func TestComparingVersions(t *testing.T) {
-	newVersion := versionStr("1.2.3")
-	oldVersion := versionStr("1.2.2")
+	newVersion := Version("1.2.3")
+	oldVersion := Version("1.2.2")
 
 	newer, err := newVersion.IsNewerOrEqual(oldVersion)
 	assert.NoError(t, err)
@@ -18,8 +18,8 @@ func TestComparingVersions(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, notNewer)
 
-	newVersion = versionStr("1.2.3")
-	oldVersion = versionStr("1.1.5")
+	newVersion = Version("1.2.3")
+	oldVersion = Version("1.1.5")
 
 	newer, err = newVersion.IsNewerOrEqual(oldVersion)
 	assert.NoError(t, err)
@@ -29,8 +29,8 @@ func TestComparingVersions(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, notNewer)
 
-	newVersion = versionStr("1.2.3")
-	oldVersion = versionStr("0.4.4")
+	newVersion = Version("1.2.3")
+	oldVersion = Version("0.4.4")
 
 	newer, err = newVersion.IsNewerOrEqual(oldVersion)
 	assert.NoError(t, err)
@@ -50,33 +50,55 @@ func TestCalculatingBatteryVoltages(t *testing.T) {
 	raw := uint16(1023)
 
 	// Low battery voltage check for version 0.1.4
-	batteryVal, err := calculateBatteryVoltage(raw, versionStr("0.1.4"), lvResistorVals)
+	batteryVal, err := BatteryVoltage(raw, Version("0.1.4"), LVDividers)
 	assert.NoError(t, err)
 	assert.InDelta(t, float32(14.4298482293), batteryVal, tolerance)
 
 	// High battery voltage check for version 0.1.4
-	batteryVal, err = calculateBatteryVoltage(raw, versionStr("0.1.4"), hvResistorVals)
+	batteryVal, err = BatteryVoltage(raw, Version("0.1.4"), HVDividers)
 	assert.NoError(t, err)
 	assert.InDelta(t, float32(41.6720930233), batteryVal, tolerance)
 
 	// Low battery voltage check for version 0.4.0
-	batteryVal, err = calculateBatteryVoltage(raw, versionStr("0.4.0"), lvResistorVals)
+	batteryVal, err = BatteryVoltage(raw, Version("0.4.0"), LVDividers)
 	assert.NoError(t, err)
 	assert.InDelta(t, float32(13.1044117647), batteryVal, tolerance)
 
 	// High battery voltage check for version 0.1.4
-	batteryVal, err = calculateBatteryVoltage(raw, versionStr("0.4.0"), hvResistorVals)
+	batteryVal, err = BatteryVoltage(raw, Version("0.4.0"), HVDividers)
 	assert.NoError(t, err)
 	assert.InDelta(t, float32(42.9083333333), batteryVal, tolerance)
 
 	// Low battery voltage check for version 0.7.0
-	batteryVal, err = calculateBatteryVoltage(raw, versionStr("0.7.0"), lvResistorVals)
+	batteryVal, err = BatteryVoltage(raw, Version("0.7.0"), LVDividers)
 	assert.NoError(t, err)
 	assert.InDelta(t, float32(17.3425531915), batteryVal, tolerance)
 
 	// High battery voltage check for version 0.7.0
-	batteryVal, err = calculateBatteryVoltage(raw, versionStr("0.7.0"), hvResistorVals)
+	batteryVal, err = BatteryVoltage(raw, Version("0.7.0"), HVDividers)
 	assert.NoError(t, err)
 	assert.InDelta(t, float32(42.5857142857), batteryVal, tolerance)
 
 }
+
+func TestAnalogConfig(t *testing.T) {
+	raw := uint16(1023)
+	for _, version := range []Version{"0.1.4", "0.4.0", "0.7.0"} {
+		c, err := AnalogConfigForVersion(version)
+		assert.NoError(t, err)
+		lv, err := BatteryVoltage(raw, version, LVDividers)
+		assert.NoError(t, err)
+		assert.InDelta(t, lv, c.Voltage(raw, c.LV), 0.001)
+		hv, err := BatteryVoltage(raw, version, HVDividers)
+		assert.NoError(t, err)
+		assert.InDelta(t, hv, c.Voltage(raw, c.HV), 0.001)
+	}
+
+	c, err := AnalogConfigForVersion("0.7.0")
+	assert.NoError(t, err)
+	assert.InDelta(t, 3.3, c.Voltage(raw, c.RTC), 0.001)
+	c.RTC.Offset = 0.1
+	assert.InDelta(t, 3.4, c.Voltage(raw, c.RTC), 0.001)
+	c.Vref = 3.0
+	assert.InDelta(t, 3.1, c.Voltage(raw, c.RTC), 0.001)
+}
@@ -0,0 +1,133 @@
+package battery
+
+import (
+	"math"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// Devices on a mains charger spend most of their time with the battery being charged or held
+// at the float voltage, where the discharge rate can't be learned. A rise in the battery level
+// while the RPi is on is taken as a charger being connected. Once the voltage has held steady
+// near full for chargeCompleteTime the charge is complete and the voltage it is held at is the
+// float voltage. The charger is taken to be disconnected when the voltage drops
+// chargerDropFraction below the highest voltage while charging. Learning the discharge rate is
+// suspended while the charger is connected, keeping the averages learned before, and starts
+// again from the level when it is disconnected.
+const (
+	chargeStartPercent  = 5    // Rise in the level that is taken as charging.
+	chargeStableVolts   = 0.05 // Change in voltage that is still steady.
+	chargeCompleteTime  = time.Hour
+	chargeFullPercent   = 95
+	chargerDropFraction = 0.02
+)
+
+// ChargerState is what is known about a connected charger, it is saved with the battery state.
+type ChargerState struct {
+	Since        time.Time `json:"since"`
+	MaxVoltage   float32   `json:"maxVoltage"`
+	Complete     bool      `json:"complete"`
+	CompletedAt  time.Time `json:"completedAt,omitempty"`
+	FloatVoltage float32   `json:"floatVoltage,omitempty"`
+	// Voltage the charge is steady around and since when, for detecting it is complete.
+	SteadyVoltage float32   `json:"steadyVoltage"`
+	SteadySince   time.Time `json:"steadySince"`
+}
+
+type ChargerChange int
+
+const (
+	ChargerUnchanged ChargerChange = iota
+	ChargerConnected
+	ChargeComplete
+	ChargerDisconnected
+)
+
+// ChargerStatus is "charging" or "float" when a charger is connected, "" if not.
+func (s *State) ChargerStatus() string {
+	switch {
+	case s.Charger == nil:
+		return ""
+	case s.Charger.Complete:
+		return "float"
+	}
+	return "charging"
+}
+
+// UpdateCharger detects a charger being connected, finishing charging and being disconnected
+// from a new reading, returning the change and the charger it was for. It is called before
+// Update with the same reading.
+func (s *State) UpdateCharger(voltage, percent float32, now time.Time) (ChargerChange, *ChargerState) {
+	c := s.Charger
+	if c == nil {
+		if s.refTime.IsZero() || percent <= s.refPercent+chargeStartPercent {
+			return ChargerUnchanged, nil
+		}
+		s.Charger = &ChargerState{Since: now, MaxVoltage: voltage, SteadyVoltage: voltage, SteadySince: now}
+		return ChargerConnected, s.Charger
+	}
+	if voltage < c.MaxVoltage*(1-chargerDropFraction) {
+		// Measure the discharge from here, not from the level while charging.
+		s.Charger = nil
+		s.refPercent = percent
+		s.refTime = now
+		return ChargerDisconnected, c
+	}
+	c.MaxVoltage = max(c.MaxVoltage, voltage)
+	if math.Abs(float64(voltage-c.SteadyVoltage)) > chargeStableVolts {
+		c.SteadyVoltage = voltage
+		c.SteadySince = now
+		return ChargerUnchanged, c
+	}
+	if !c.Complete && percent >= chargeFullPercent && now.Sub(c.SteadySince) >= chargeCompleteTime {
+		c.Complete = true
+		c.CompletedAt = now
+		c.FloatVoltage = voltage
+		return ChargeComplete, c
+	}
+	return ChargerUnchanged, c
+}
+
+func (m *Monitor) reportChargerChange(change ChargerChange, c *ChargerState, voltage, percent float32, now time.Time) {
+	if change == ChargerUnchanged {
+		return
+	}
+	eventType := ""
+	var payload interface{}
+	switch change {
+	case ChargerConnected:
+		eventType = eventhelper.ChargerConnected
+		payload = eventhelper.ChargerConnection{
+			Voltage: voltage,
+			Battery: math.Round(float64(percent)),
+		}
+		log.Printf("Battery is charging, %.0f%% at %.2fV", percent, voltage)
+	case ChargeComplete:
+		eventType = eventhelper.ChargeComplete
+		payload = eventhelper.ChargeCompletion{
+			Voltage:      voltage,
+			Battery:      math.Round(float64(percent)),
+			FloatVoltage: c.FloatVoltage,
+			ChargeHours:  math.Round(now.Sub(c.Since).Hours()*10) / 10,
+		}
+		log.Printf("Battery charge complete, float voltage %.2fV", c.FloatVoltage)
+	case ChargerDisconnected:
+		eventType = eventhelper.ChargerDisconnected
+		disconnection := eventhelper.ChargerDisconnection{
+			Voltage:         voltage,
+			Battery:         math.Round(float64(percent)),
+			ConnectedHours:  math.Round(now.Sub(c.Since).Hours()*10) / 10,
+			MaxVoltage:      c.MaxVoltage,
+			ChargeCompleted: c.Complete,
+		}
+		if c.Complete {
+			disconnection.FloatVoltage = c.FloatVoltage
+		}
+		payload = disconnection
+		log.Printf("Charger disconnected after %s, battery %.0f%% at %.2fV", now.Sub(c.Since).Truncate(time.Second), percent, voltage)
+	}
+	if err := m.addEvent(eventhelper.NewEvent(eventType, now, payload)); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package battery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChargerConnected(t *testing.T) {
+	state := &State{}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	reading := func(voltage, percent float32) ChargerChange {
+		change, _ := state.UpdateCharger(voltage, percent, now)
+		state.Update("li-ion", voltage, percent, now)
+		now = now.Add(10 * time.Minute)
+		return change
+	}
+
+	// Discharging, 10% over 5 hours.
+	assert.Equal(t, ChargerUnchanged, reading(12.0, 60))
+	now = now.Add(5*time.Hour - 10*time.Minute)
+	assert.Equal(t, ChargerUnchanged, reading(11.8, 50))
+	assert.InDelta(t, 2, state.Discharge.AvgPercentPerHour, 0.01)
+
+	// A charger is connected and charges the battery.
+	assert.Equal(t, ChargerConnected, reading(12.2, 70))
+	assert.Equal(t, "charging", state.ChargerStatus())
+	assert.Equal(t, float64(-1), state.HoursRemaining())
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, ChargerUnchanged, reading(12.3+float32(i)*0.06, 80+float32(i)*4))
+	}
+	// Held at the float voltage, with small dips that aren't learned as discharging.
+	complete := false
+	for i := 0; i < 8; i++ {
+		percent := float32(99)
+		if i%2 == 0 {
+			percent = 97
+		}
+		if reading(12.6, percent) == ChargeComplete {
+			complete = true
+		}
+	}
+	assert.True(t, complete)
+	assert.Equal(t, "float", state.ChargerStatus())
+	assert.Equal(t, float32(12.6), state.Charger.FloatVoltage)
+	assert.Equal(t, 1, state.Discharge.Samples)
+
+	// Disconnected, discharging is learned again from the level after the charger with the
+	// average from before.
+	change, charger := state.UpdateCharger(12.3, 95, now)
+	assert.Equal(t, ChargerDisconnected, change)
+	assert.True(t, charger.Complete)
+	assert.Nil(t, state.Charger)
+	state.Update("li-ion", 12.3, 95, now)
+	now = now.Add(10 * time.Hour)
+	assert.Equal(t, ChargerUnchanged, reading(12.0, 75))
+	assert.Equal(t, 2, state.Discharge.Samples)
+	assert.InDelta(t, 2, state.Discharge.AvgPercentPerHour, 0.01)
+	assert.InDelta(t, 37.5, state.HoursRemaining(), 0.01)
+}
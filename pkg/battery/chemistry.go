@@ -0,0 +1,183 @@
+package battery
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// The chemistry guessed from the voltage range often confuses LiFePO4 and Li-ion packs, as
+// their voltage ranges overlap for common cell counts. The shape of the discharge curve over
+// the first hours is a second opinion. A LiFePO4 pack drops quickly from its charged voltage
+// and then sits on a very flat plateau, while a Li-ion pack keeps dropping at a steady rate.
+const (
+	ShapeWindow = 6 * time.Hour
+	// Fewer samples than this over the window isn't enough to judge the shape.
+	shapeMinSamples = 30
+	// A rise of this fraction above the lowest voltage is charging, and starts the observation again.
+	shapeChargeRise = 0.01
+	// Plateau drop rates, in % of the voltage per hour, at or below which the curve is flat,
+	// and at or above which it is sloped.
+	shapeFlatRate   = 0.04
+	shapeSlopedRate = 0.08
+)
+
+// cellRanges are the resting voltage ranges of a single cell in normal use, from deeply
+// discharged to charged. They leave gaps between the cell counts, e.g. a 4S LiFePO4 plateau
+// around 13.1V is above a charged 3S Li-ion pack and below a discharged 4S pack.
+var cellRanges = map[string][2]float32{
+	"li-ion":  {3.3, 4.2},
+	"lifepo4": {3.0, 3.45},
+}
+
+// cellCurves are the resting voltage curves of a single cell, for chemistries that the config
+// doesn't have a curve for.
+var cellCurves = map[string]struct{ voltages, percents []float32 }{
+	"lifepo4": {
+		voltages: []float32{2.50, 3.00, 3.20, 3.22, 3.25, 3.26, 3.27, 3.28, 3.30, 3.33, 3.40},
+		percents: []float32{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100},
+	},
+	"li-ion": {
+		voltages: []float32{3.00, 3.45, 3.60, 3.70, 3.77, 3.87, 3.98, 4.10, 4.20},
+		percents: []float32{0, 5, 15, 30, 50, 70, 85, 95, 100},
+	},
+}
+
+// PackCurve returns the voltage curve of a pack of the chemistry with the number of cells,
+// ok is false if there is no curve for the chemistry.
+func PackCurve(chemistry string, cells int) (voltages, percents []float32, ok bool) {
+	curve, ok := cellCurves[strings.ToLower(chemistry)]
+	if !ok || cells <= 0 {
+		return nil, nil, false
+	}
+	voltages = make([]float32, len(curve.voltages))
+	for i, v := range curve.voltages {
+		voltages[i] = v * float32(cells)
+	}
+	return voltages, curve.percents, true
+}
+
+// FitsChemistry returns true if the pack voltage is in the operating range of a whole
+// number of cells of the chemistry.
+func FitsChemistry(chemistry string, voltage float32) bool {
+	r, ok := cellRanges[strings.ToLower(chemistry)]
+	if !ok || voltage <= 0 {
+		return false
+	}
+	// The fewest cells that could reach the voltage, more cells would only be further below it.
+	cells := float32(math.Ceil(float64(voltage / r[1])))
+	return cells*r[0] <= voltage
+}
+
+// ShapeResult is the chemistry from the shape of the discharge curve.
+type ShapeResult struct {
+	// "lifepo4" for a flat plateau, "li-ion" for a steady slope, or "" if it isn't clear.
+	Chemistry  string
+	Confidence float64
+	// How fast the voltage drops after the first third of the window, in % per hour.
+	PlateauRate float64
+	// Fraction of the window at which 80% of the total drop had happened.
+	KneePosition float64
+}
+
+type shapeSample struct {
+	voltage float32
+	time    time.Time
+}
+
+// ShapeClassifier collects the voltages over the first ShapeWindow of discharging and
+// classifies the chemistry from the shape of the curve.
+type ShapeClassifier struct {
+	samples []shapeSample
+	lowest  float32
+}
+
+// Reset starts the observation again, e.g. when the battery has been changed.
+func (c *ShapeClassifier) Reset() {
+	c.samples = nil
+	c.lowest = 0
+}
+
+// Add adds a voltage reading, readings after the window has been observed are ignored.
+func (c *ShapeClassifier) Add(voltage float32, t time.Time) {
+	if voltage <= 0 || c.complete() {
+		return
+	}
+	if len(c.samples) > 0 && voltage > c.lowest*(1+shapeChargeRise) {
+		// Charging, the discharge curve needs to be observed from the start.
+		c.Reset()
+	}
+	if len(c.samples) == 0 || voltage < c.lowest {
+		c.lowest = voltage
+	}
+	c.samples = append(c.samples, shapeSample{voltage: voltage, time: t})
+}
+
+func (c *ShapeClassifier) complete() bool {
+	return len(c.samples) > 0 && c.samples[len(c.samples)-1].time.Sub(c.samples[0].time) >= ShapeWindow
+}
+
+// average returns the average voltage of the samples between the fractions of the window.
+func (c *ShapeClassifier) average(from, to float64) float64 {
+	start := c.samples[0].time
+	sum, n := 0.0, 0
+	for _, s := range c.samples {
+		f := float64(s.time.Sub(start)) / float64(ShapeWindow)
+		if f >= from && f <= to {
+			sum += float64(s.voltage)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// Result returns the chemistry from the curve shape, ok is false until the window has been
+// observed.
+func (c *ShapeClassifier) Result() (result ShapeResult, ok bool) {
+	if !c.complete() || len(c.samples) < shapeMinSamples {
+		return ShapeResult{}, false
+	}
+	// Averaging over a short part of the window at each point smooths out the reading noise.
+	const edge = 0.05
+	mean := c.average(0, 1)
+	start := c.average(0, edge)
+	end := c.average(1-edge, 1)
+	plateauStart := c.average(1.0/3-edge, 1.0/3)
+	plateauHours := ShapeWindow.Hours() * 2 / 3
+	result.PlateauRate = (plateauStart - end) / mean * 100 / plateauHours
+
+	drop := start - end
+	if drop/mean > 0.002 {
+		for f := edge; f <= 1; f += edge / 2 {
+			if c.average(f-edge, f) <= start-0.8*drop {
+				result.KneePosition = f
+				break
+			}
+		}
+	}
+
+	switch {
+	case result.PlateauRate <= shapeFlatRate:
+		result.Chemistry = "lifepo4"
+		result.Confidence = 0.75
+		if result.KneePosition <= 0.4 {
+			// The drop from the charged voltage onto the plateau is typical of LiFePO4.
+			result.Confidence = 0.9
+		}
+	case result.PlateauRate >= shapeSlopedRate:
+		result.Chemistry = "li-ion"
+		result.Confidence = 0.7
+		if result.KneePosition >= 0.6 {
+			result.Confidence = 0.85
+		}
+	default:
+		return result, true
+	}
+	if !FitsChemistry(result.Chemistry, float32(mean)) {
+		result.Confidence /= 2
+	}
+	return result, true
+}
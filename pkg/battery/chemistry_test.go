@@ -0,0 +1,56 @@
+package battery
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func classify(voltage func(hours float64) float64) (ShapeResult, bool) {
+	c := &ShapeClassifier{}
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for t := time.Duration(0); t <= ShapeWindow; t += 2 * time.Minute {
+		c.Add(float32(voltage(t.Hours())), start.Add(t))
+	}
+	return c.Result()
+}
+
+func TestShapeClassifier(t *testing.T) {
+	// 4S LiFePO4, drops from the charged voltage onto the plateau.
+	result, ok := classify(func(h float64) float64 {
+		return 13.2 + 0.4*math.Exp(-h*3) - 0.002*h
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "lifepo4", result.Chemistry)
+	assert.InDelta(t, 0.9, result.Confidence, 0.001)
+
+	// 3S Li-ion, dropping steadily.
+	result, ok = classify(func(h float64) float64 { return 12.0 - 0.04*h })
+	assert.True(t, ok)
+	assert.Equal(t, "li-ion", result.Chemistry)
+	assert.InDelta(t, 0.85, result.Confidence, 0.001)
+
+	// Charging part way through starts the observation again.
+	c := &ShapeClassifier{}
+	start := time.Now()
+	c.Add(12, start)
+	c.Add(12.5, start.Add(time.Hour))
+	c.Add(12.4, start.Add(ShapeWindow))
+	_, ok = c.Result()
+	assert.False(t, ok)
+}
+
+func TestFitsChemistry(t *testing.T) {
+	assert.True(t, FitsChemistry("lifepo4", 13.1))
+	assert.False(t, FitsChemistry("li-ion", 12.9))
+	assert.True(t, FitsChemistry("li-ion", 11.1))
+	assert.False(t, FitsChemistry("lifepo4", 11.1))
+	assert.False(t, FitsChemistry("nimh", 12))
+
+	voltages, percents, ok := PackCurve("lifepo4", 4)
+	assert.True(t, ok)
+	assert.InDelta(t, 13.6, voltages[len(voltages)-1], 0.001)
+	assert.Equal(t, float32(100), percents[len(percents)-1])
+}
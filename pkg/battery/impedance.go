@@ -0,0 +1,205 @@
+package battery
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// A failing pack usually shows its internal resistance rising weeks before it dies, so the
+// resistance measured from the voltage sag of each known load step, see Transients, is kept
+// as a session of the pack. The median of the first sessions after the pack is installed is
+// its baseline. When the median of the latest sessions rises above the baseline by more than
+// the limit for the chemistry a batteryImpedanceHigh event is made, at most every
+// impedanceAlarmInterval while it stays high.
+//
+//	[battery-impedance]
+//	enable = true
+//	load-reasons = ["camera-powered-on"]
+//	rise-limits = { lifepo4 = 1.5 }
+//
+// The load reasons are the transients with a load that is the same each time, the camera
+// powering on needs its power in load-watts of the battery-transients section. The rise
+// limits are ratios of the baseline and replace the defaults for the chemistries given. The
+// sessions are part of the battery state, so they start again when the pack is replaced.
+const (
+	ImpedanceConfigKey = "battery-impedance"
+	// Sessions making the baseline, and the latest sessions compared with it. The medians
+	// keep a cold morning or a busy camera from setting off the alarm.
+	impedanceBaselineSessions = 5
+	impedanceRecentSessions   = 5
+	impedanceMaxSessions      = 100
+	impedanceAlarmInterval    = 7 * 24 * time.Hour
+	// Rise limit for chemistries without their own.
+	defaultImpedanceRiseLimit = 1.75
+)
+
+// End of life is usually taken as the internal resistance doubling for Li-ion and NiMH,
+// LiFePO4 and lead-acid packs lose their capacity with a smaller rise.
+var defaultImpedanceRiseLimits = map[string]float64{
+	"li-ion":    2.0,
+	"lipo":      2.0,
+	"nimh":      2.0,
+	"lifepo4":   1.5,
+	"lead-acid": 1.5,
+}
+
+// ImpedanceConfig is read from the "battery-impedance" section of the config.
+type ImpedanceConfig struct {
+	Enable      bool               `mapstructure:"enable"`
+	LoadReasons []string           `mapstructure:"load-reasons"`
+	RiseLimits  map[string]float64 `mapstructure:"rise-limits"`
+}
+
+func DefaultImpedanceConfig() ImpedanceConfig {
+	return ImpedanceConfig{Enable: true, LoadReasons: []string{"camera-powered-on"}}
+}
+
+func LoadImpedanceConfig(config *goconfig.Config) (ImpedanceConfig, error) {
+	c := DefaultImpedanceConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, ImpedanceConfigKey, &c); err != nil {
+		return DefaultImpedanceConfig(), err
+	}
+	for chemistry, limit := range c.RiseLimits {
+		if limit <= 1 {
+			return DefaultImpedanceConfig(), fmt.Errorf("%s rise limit for '%s' must be more than 1", ImpedanceConfigKey, chemistry)
+		}
+	}
+	return c, nil
+}
+
+// RiseLimit returns the rise over the baseline that is too high for the chemistry.
+func (c ImpedanceConfig) RiseLimit(chemistry string) float64 {
+	chemistry = strings.ToLower(chemistry)
+	if limit, ok := c.RiseLimits[chemistry]; ok {
+		return limit
+	}
+	if limit, ok := defaultImpedanceRiseLimits[chemistry]; ok {
+		return limit
+	}
+	return defaultImpedanceRiseLimit
+}
+
+// ImpedanceSession is the internal resistance measured when the known load was switched on.
+type ImpedanceSession struct {
+	Time time.Time `json:"time"`
+	Ohms float64   `json:"ohms"`
+}
+
+// ImpedanceTrend is the internal resistance history of the pack.
+type ImpedanceTrend struct {
+	Sessions     []ImpedanceSession `json:"sessions"`
+	BaselineOhms float64            `json:"baselineOhms,omitempty"` // 0 until there are enough sessions.
+	LastAlarm    time.Time          `json:"lastAlarm,omitempty"`
+}
+
+// Add records a session, setting the baseline once there are enough sessions.
+func (t *ImpedanceTrend) Add(s ImpedanceSession) {
+	t.Sessions = append(t.Sessions, s)
+	if t.BaselineOhms == 0 && len(t.Sessions) >= impedanceBaselineSessions {
+		t.BaselineOhms = medianOhms(t.Sessions[:impedanceBaselineSessions])
+	}
+	if len(t.Sessions) > impedanceMaxSessions {
+		t.Sessions = t.Sessions[len(t.Sessions)-impedanceMaxSessions:]
+	}
+}
+
+// RecentOhms returns the median of the latest sessions, 0 if there aren't enough since the
+// baseline was set.
+func (t *ImpedanceTrend) RecentOhms() float64 {
+	if t.BaselineOhms == 0 || len(t.Sessions) < impedanceBaselineSessions+impedanceRecentSessions {
+		return 0
+	}
+	return medianOhms(t.Sessions[len(t.Sessions)-impedanceRecentSessions:])
+}
+
+// OhmsPerWeek returns the least squares slope of the sessions.
+func (t *ImpedanceTrend) OhmsPerWeek() float64 {
+	if len(t.Sessions) < 2 {
+		return 0
+	}
+	start := t.Sessions[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range t.Sessions {
+		x := s.Time.Sub(start).Hours() / (7 * 24)
+		sumX += x
+		sumY += s.Ohms
+		sumXY += x * s.Ohms
+		sumXX += x * x
+	}
+	n := float64(len(t.Sessions))
+	d := n*sumXX - sumX*sumX
+	if d == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / d
+}
+
+func medianOhms(sessions []ImpedanceSession) float64 {
+	ohms := make([]float64, len(sessions))
+	for i, s := range sessions {
+		ohms[i] = s.Ohms
+	}
+	slices.Sort(ohms)
+	mid := len(ohms) / 2
+	if len(ohms)%2 == 0 {
+		return (ohms[mid-1] + ohms[mid]) / 2
+	}
+	return ohms[mid]
+}
+
+// checkImpedance adds the measurements from the known load steps to the pack's sessions,
+// reporting if the internal resistance has risen too far. It returns true if the state changed.
+func (m *Monitor) checkImpedance(state *State, now time.Time) bool {
+	measurements := m.takeMeasurements()
+	if !m.Impedance.Enable {
+		return false
+	}
+	changed := false
+	for _, r := range measurements {
+		if !slices.Contains(m.Impedance.LoadReasons, r.Reason) {
+			continue
+		}
+		if state.Impedance == nil {
+			state.Impedance = &ImpedanceTrend{}
+		}
+		state.Impedance.Add(ImpedanceSession{Time: r.Time, Ohms: r.Ohms})
+		changed = true
+	}
+	if !changed {
+		return false
+	}
+	trend := state.Impedance
+	recent := trend.RecentOhms()
+	limit := m.Impedance.RiseLimit(state.Chemistry)
+	if recent == 0 || recent < trend.BaselineOhms*limit {
+		return true
+	}
+	if !trend.LastAlarm.IsZero() && now.Sub(trend.LastAlarm) < impedanceAlarmInterval {
+		return true
+	}
+	trend.LastAlarm = now
+	rise := recent / trend.BaselineOhms
+	log.Errorf("Battery internal resistance is %.3f ohms, %.1f times the %.3f ohms it started at, the pack is probably failing", recent, rise, trend.BaselineOhms)
+	if err := m.addEvent(eventhelper.NewEvent(eventhelper.BatteryImpedanceHigh, now, eventhelper.BatteryImpedance{
+		Chemistry:        state.Chemistry,
+		BaselineOhms:     math.Round(trend.BaselineOhms*1000) / 1000,
+		RecentOhms:       math.Round(recent*1000) / 1000,
+		Rise:             math.Round(rise*100) / 100,
+		RiseLimit:        limit,
+		TrendOhmsPerWeek: math.Round(trend.OhmsPerWeek()*10000) / 10000,
+		Sessions:         len(trend.Sessions),
+	})); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+	return true
+}
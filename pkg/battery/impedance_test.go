@@ -0,0 +1,106 @@
+package battery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTransients returns the measurements added to pending.
+type testTransients struct {
+	ohms    float64
+	pending []ResistanceMeasurement
+}
+
+func (t *testTransients) InternalResistance() float64 {
+	return t.ohms
+}
+
+func (t *testTransients) SetInternalResistance(ohms float64) {
+	t.ohms = ohms
+}
+
+func (t *testTransients) TakeMeasurements() []ResistanceMeasurement {
+	m := t.pending
+	t.pending = nil
+	return m
+}
+
+func TestImpedanceTrend(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	trend := &ImpedanceTrend{}
+	for i, ohms := range []float64{0.10, 0.30, 0.11, 0.09, 0.10} {
+		trend.Add(ImpedanceSession{Time: start.Add(time.Duration(i) * 24 * time.Hour), Ohms: ohms})
+	}
+	// The median ignores the odd high reading.
+	assert.InDelta(t, 0.10, trend.BaselineOhms, 0.001)
+	assert.Zero(t, trend.RecentOhms())
+
+	for i := 5; i < 10; i++ {
+		trend.Add(ImpedanceSession{Time: start.Add(time.Duration(i) * 24 * time.Hour), Ohms: 0.2})
+	}
+	assert.InDelta(t, 0.2, trend.RecentOhms(), 0.001)
+	assert.Greater(t, trend.OhmsPerWeek(), 0.0)
+	// The baseline is kept.
+	assert.InDelta(t, 0.10, trend.BaselineOhms, 0.001)
+
+	assert.Equal(t, 1.5, ImpedanceConfig{}.RiseLimit("LiFePO4"))
+	assert.Equal(t, 1.2, ImpedanceConfig{RiseLimits: map[string]float64{"lifepo4": 1.2}}.RiseLimit("lifepo4"))
+	assert.Equal(t, defaultImpedanceRiseLimit, ImpedanceConfig{}.RiseLimit("unknown"))
+}
+
+func TestCheckImpedance(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	events := []eventclient.Event{}
+	transients := &testTransients{}
+	m := &Monitor{
+		Transients: transients,
+		Impedance:  DefaultImpedanceConfig(),
+		AddEvent: func(e eventclient.Event) error {
+			events = append(events, e)
+			return nil
+		},
+	}
+	state := &State{Chemistry: "lifepo4"}
+	session := func(reason string, ohms float64) {
+		transients.pending = append(transients.pending, ResistanceMeasurement{Reason: reason, Time: now, Ohms: ohms})
+		now = now.Add(24 * time.Hour)
+	}
+
+	assert.False(t, m.checkImpedance(state, now))
+	// Only the known load steps are sessions.
+	session("aux-power-on", 1)
+	assert.False(t, m.checkImpedance(state, now))
+	assert.Nil(t, state.Impedance)
+
+	for i := 0; i < 5; i++ {
+		session("camera-powered-on", 0.1)
+		assert.True(t, m.checkImpedance(state, now))
+	}
+	for i := 0; i < 5; i++ {
+		session("camera-powered-on", 0.14)
+		m.checkImpedance(state, now)
+	}
+	assert.Empty(t, events)
+
+	// Rising past 1.5 times the baseline for LiFePO4.
+	for i := 0; i < 3; i++ {
+		session("camera-powered-on", 0.16)
+		m.checkImpedance(state, now)
+	}
+	assert.Len(t, events, 1)
+	assert.Equal(t, eventhelper.BatteryImpedanceHigh, events[0].Type)
+	assert.Equal(t, 1.6, events[0].Details["rise"])
+
+	// Not reported again until the alarm interval has passed.
+	session("camera-powered-on", 0.16)
+	m.checkImpedance(state, now)
+	assert.Len(t, events, 1)
+	now = now.Add(impedanceAlarmInterval)
+	session("camera-powered-on", 0.16)
+	m.checkImpedance(state, now)
+	assert.Len(t, events, 2)
+}
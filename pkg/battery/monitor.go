@@ -0,0 +1,419 @@
+package battery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+	"github.com/TheCacophonyProject/tc2-hat-controller/buzzer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/cadence"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvbuffer"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/TheCacophonyProject/tc2-hat-controller/journal"
+	"github.com/TheCacophonyProject/tc2-hat-controller/livefeed"
+	"github.com/TheCacophonyProject/tc2-hat-controller/selfmonitor"
+)
+
+var log = logging.NewLogger("info")
+
+const ReadingInterval = 2 * time.Minute
+
+// The battery loop waits at most the reading interval at the critical cadence, so it has
+// stopped if it hasn't gone around in this long.
+const loopMaxGap = 30 * time.Minute
+
+// Reader is what the battery monitor reads the voltages from. This is the ATtiny, or a CSV
+// file when replaying readings. A reader returning io.EOF stops the monitor.
+type Reader interface {
+	ReadHVBattery() (float32, error)
+	ReadLVBattery() (float32, error)
+	ReadRTCBattery() (float32, error)
+}
+
+// ResistanceMeasurement is the internal resistance measured from a single load step.
+type ResistanceMeasurement struct {
+	Reason string
+	Time   time.Time
+	Ohms   float64
+}
+
+// Transients estimates the internal resistance of the battery from the voltage sag when
+// loads are switched.
+type Transients interface {
+	InternalResistance() float64
+	// SetInternalResistance sets the starting estimate, from the saved battery state.
+	SetInternalResistance(ohms float64)
+	// TakeMeasurements returns the measurements since it was last called.
+	TakeMeasurements() []ResistanceMeasurement
+}
+
+// Monitor makes the battery readings, logs them, learns the battery state and reports the
+// battery level. The fields marked optional can be left unset.
+type Monitor struct {
+	Reader       Reader
+	Config       *goconfig.Battery
+	ReadingsFile string
+	StateFile    string
+	MaxReadings  int                           // Lines kept in the readings file, 0 keeps them all.
+	Now          func() time.Time              // Optional, time.Now by default.
+	Sleep        func(time.Duration)           // Optional, waits for the next reading in place of a timer that RequestSwap can end early.
+	AddEvent     func(eventclient.Event) error // Optional, eventhelper.AddEvent by default.
+	Transients   Transients                    // Optional, source of the internal resistance estimate.
+	Cadence      *cadence.Policy               // Optional, slows the readings when the battery is low.
+	Buzzer       *buzzer.Buzzer                // Optional, beeps when the battery gets low.
+	Journal      *journal.Writer               // Optional, also sends the readings to the journal.
+	Live         *livefeed.Feed                // Optional, pushes the readings to live subscribers.
+	Impedance    ImpedanceConfig
+	Readings     *csvbuffer.Writer // Optional, writes the readings in batches, straight away if nil.
+	LegacyTime   bool              // Writes the readings with the old local timestamps in place of RFC3339.
+
+	// Optional, called with each reading.
+	OnStatus func(Status)
+	// Optional, called with the estimate of the hours left in the battery after each reading
+	// of a connected battery, -1 if there isn't one.
+	OnHoursRemaining func(hours float64, now time.Time)
+	// Optional, called with the cadence level of the battery after each reading of a connected battery.
+	OnLevel func(cadence.Level)
+
+	shape ShapeClassifier
+
+	swapMu sync.Mutex
+	swap   *Swap         // Waiting to be applied at the next reading.
+	wake   chan struct{} // Ends the wait for the next reading early.
+}
+
+// NewMonitor returns a monitor reading the battery from the reader.
+func NewMonitor(reader Reader, config *goconfig.Battery, readingsFile, stateFile string) *Monitor {
+	return &Monitor{
+		Reader:       reader,
+		Config:       config,
+		ReadingsFile: readingsFile,
+		StateFile:    stateFile,
+		Impedance:    DefaultImpedanceConfig(),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+func (m *Monitor) now() time.Time {
+	if m.Now == nil {
+		return time.Now()
+	}
+	return m.Now()
+}
+
+func (m *Monitor) addEvent(event eventclient.Event) error {
+	if m.AddEvent == nil {
+		return eventhelper.AddEvent(event)
+	}
+	return m.AddEvent(event)
+}
+
+// Run makes battery readings until the reader returns io.EOF. It returns an error if the
+// readings can't be written.
+func (m *Monitor) Run() error {
+	if m.Readings == nil {
+		m.Readings = csvbuffer.New(m.ReadingsFile, batterycsv.Header(), csvbuffer.Config{})
+	}
+	defer m.FlushReadings()
+	m.trimReadings()
+	state, err := LoadState(m.StateFile)
+	if err != nil {
+		log.Printf("Error loading battery state, starting with a new state: %v", err)
+		state = &State{}
+	}
+	if state.InternalResistance > 0 && m.Transients != nil {
+		m.Transients.SetInternalResistance(state.InternalResistance)
+	}
+	var batteryPercent float32 = -1.0
+	hvRail := NewRail("hv")
+	lvRail := NewRail("lv")
+	rtcRail := NewRail("rtc")
+	startTime := m.now()
+	i := 5
+	for {
+		selfmonitor.Beat("battery", loopMaxGap)
+		// Start the quality afresh, a failed reading could have left some behind.
+		m.takeReadingQuality()
+		hvBat, err := m.Reader.ReadHVBattery()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		lvBat, err := m.Reader.ReadLVBattery()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		rtcBat, err := m.Reader.ReadRTCBattery()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		now := m.now()
+		if m.applySwap(state, now) {
+			batteryPercent = -1 // Report the level of the new pack.
+		}
+		if now.Sub(startTime) > time.Duration(24*time.Hour) {
+			m.FlushReadings()
+			if m.trimReadings() {
+				startTime = now
+			}
+		}
+		for _, r := range []struct {
+			rail    *Rail
+			voltage float32
+		}{{hvRail, hvBat}, {lvRail, lvBat}, {rtcRail, rtcBat}} {
+			switch r.rail.Update(r.voltage, now) {
+			case RailDisconnected:
+				m.reportRailChange(eventhelper.BatteryDisconnected, r.rail, state, now)
+			case RailReconnected:
+				m.reportRailChange(eventhelper.BatteryReconnected, r.rail, state, now)
+				batteryPercent = -1 // Report the battery level again.
+				if r.rail != rtcRail {
+					// It could be a different battery, so detect the chemistry again, and
+					// don't take a charged battery for a charger.
+					m.resetChemistryShape(state)
+					state.Charger = nil
+					state.refTime = time.Time{}
+				}
+			}
+		}
+		quality := m.takeReadingQuality()
+		quality.Ambiguous = RailAmbiguous(hvBat, hvRail, lvRail)
+		status := Status{
+			Time:       now,
+			HVBattery:  hvBat,
+			LVBattery:  lvBat,
+			RTCBattery: rtcBat,
+			Percent:    -1,
+			Quality:    quality,
+			Flags:      quality.Flags(),
+		}
+
+		line := batterycsv.Row{Time: now, HV: hvBat, LV: lvBat, RTC: rtcBat, Flags: status.Flags}.Format(m.LegacyTime)
+		if i >= 5 {
+			log.Println("Battery reading:", line)
+			i = 0
+		}
+		i++
+		if err := m.Readings.Write(line); err != nil {
+			return fmt.Errorf("failed to write battery reading to %s: %w", m.ReadingsFile, err)
+		}
+
+		if (hvRail.Dropped() || lvRail.Dropped()) && !hvRail.Connected() && !lvRail.Connected() {
+			// Don't try to detect the battery chemistry or report the level from a
+			// disconnected battery, wait for a plausible voltage to come back.
+			m.sendStatus(line, status)
+			m.wait(ReadingInterval)
+			continue
+		}
+
+		newPercent, batteryType, voltage := percentFor(m.Config, hvBat, lvBat)
+		batteryType, newPercent = m.checkChemistryShape(state, batteryType, newPercent, voltage, now)
+		if state.VoltageCurve != nil && state.Chemistry == batteryType && voltage > 0 {
+			// Use the voltage curve from an imported battery profile.
+			newPercent = percentFromCurve(state.VoltageCurve.Voltages, state.VoltageCurve.Percents, voltage)
+		}
+		chargerChanged := false
+		if voltage > 0 && !state.InSwapGrace(now) {
+			change, charger := state.UpdateCharger(voltage, newPercent, now)
+			m.reportChargerChange(change, charger, voltage, newPercent, now)
+			chargerChanged = change != ChargerUnchanged
+		}
+		status.Percent, status.BatteryType, status.Charger = newPercent, batteryType, state.ChargerStatus()
+		m.sendStatus(line, status)
+		if m.Transients != nil {
+			if r := m.Transients.InternalResistance(); r > 0 {
+				state.InternalResistance = r
+			}
+		}
+		impedanceChanged := m.checkImpedance(state, now)
+		if voltage > 0 && (state.Update(batteryType, voltage, newPercent, now) || chargerChanged || impedanceChanged) {
+			if err := state.Save(m.StateFile); err != nil {
+				log.Printf("Error saving battery state: %v", err)
+			}
+		}
+		if m.OnHoursRemaining != nil {
+			m.OnHoursRemaining(state.HoursRemaining(), now)
+		}
+		level := m.Cadence.LevelFor(float64(newPercent))
+		if newPercent >= 0 && m.OnLevel != nil {
+			m.OnLevel(level)
+		}
+		if m.Cadence.Update(float64(newPercent), now) {
+			m.reportCadenceChange(level, newPercent, now)
+			// Save the reading so the other services see the new level.
+			if err := state.Save(m.StateFile); err != nil {
+				log.Printf("Error saving battery state: %v", err)
+			}
+		}
+		if batteryPercent == -1 || math.Abs(float64(batteryPercent-newPercent)) >= 10 {
+			//log battery percent
+			batteryPercent = newPercent
+			payload := eventhelper.BatteryReading{
+				Battery:     math.Round((float64(batteryPercent))),
+				BatteryType: batteryType,
+				Voltage:     voltage,
+				Charger:     state.ChargerStatus(),
+			}
+			if hours := state.HoursRemaining(); hours >= 0 {
+				hours = math.Round(hours)
+				payload.HoursRemaining = &hours
+			}
+			if state.InternalResistance > 0 {
+				payload.InternalResistanceOhms = math.Round(state.InternalResistance*1000) / 1000
+			}
+			if err := m.addEvent(eventhelper.NewEvent(eventhelper.RPiBattery, now, payload)); err != nil {
+				log.Printf("Error adding event: %v", err)
+			}
+		}
+		m.wait(m.Cadence.IntervalFor(level, ReadingInterval))
+	}
+}
+
+// FlushReadings writes the readings waiting to be written to the readings file. Safe to call
+// on a nil monitor.
+func (m *Monitor) FlushReadings() {
+	if m == nil {
+		return
+	}
+	if err := m.Readings.Flush(); err != nil {
+		log.Printf("Could not write readings to %s %v", m.ReadingsFile, err)
+	}
+}
+
+// trimReadings keeps the readings file to MaxReadings lines in the current schema, returning
+// false if it couldn't be trimmed.
+func (m *Monitor) trimReadings() bool {
+	trimmed := true
+	if m.MaxReadings > 0 {
+		if err := trimReadings(m.ReadingsFile, m.MaxReadings); err != nil {
+			log.Printf("Could not truncate %s %v", m.ReadingsFile, err)
+			trimmed = false
+		}
+	}
+	if err := MigrateReadingsFile(m.ReadingsFile, nil); err != nil {
+		log.Printf("Could not migrate %s %v", m.ReadingsFile, err)
+	}
+	return trimmed
+}
+
+// takeReadingQuality returns the quality of the readings since it was last called, readers
+// that don't know the quality have good readings.
+func (m *Monitor) takeReadingQuality() ReadingQuality {
+	if r, ok := m.Reader.(QualityReader); ok {
+		return r.TakeReadingQuality()
+	}
+	return ReadingQuality{}
+}
+
+func (m *Monitor) takeMeasurements() []ResistanceMeasurement {
+	if m.Transients == nil {
+		return nil
+	}
+	return m.Transients.TakeMeasurements()
+}
+
+// sendStatus passes the reading on to the journal, the live feed and OnStatus.
+func (m *Monitor) sendStatus(line string, status Status) {
+	m.sendToJournal(line, status)
+	m.sendToLiveFeed(status)
+	if m.OnStatus != nil {
+		m.OnStatus(status)
+	}
+}
+
+// sendToJournal sends the reading to the journal, without the battery percentage if it is negative.
+func (m *Monitor) sendToJournal(line string, status Status) {
+	fields := map[string]string{
+		"BATT_HV":      fmt.Sprintf("%.2f", status.HVBattery),
+		"BATT_LV":      fmt.Sprintf("%.2f", status.LVBattery),
+		"BATT_RTC":     fmt.Sprintf("%.2f", status.RTCBattery),
+		"BATT_QUALITY": fmt.Sprintf("%d", status.Flags),
+	}
+	if status.Percent >= 0 {
+		fields["BATT_PCT"] = fmt.Sprintf("%.0f", status.Percent)
+		fields["BATT_TYPE"] = status.BatteryType
+	}
+	if status.Charger != "" {
+		fields["BATT_CHARGER"] = status.Charger
+	}
+	if err := m.Journal.Send("Battery reading: "+line, fields); err != nil {
+		log.Debugf("Failed to send battery reading to the journal: %v", err)
+	}
+}
+
+// sendToLiveFeed pushes the reading to anyone watching the live feed.
+func (m *Monitor) sendToLiveFeed(status Status) {
+	if err := m.Live.Send(livefeed.Battery, status); err != nil {
+		log.Debugf("Failed to send battery reading to the live feed: %v", err)
+	}
+}
+
+func (m *Monitor) reportRailChange(eventType string, rail *Rail, state *State, now time.Time) {
+	lastVoltage, lastActive := rail.LastVoltage()
+	log.Printf("%s on %s rail, last voltage %.2fV at %s", eventType, rail.Name, lastVoltage, lastActive.Format(time.RFC3339))
+	if rail.Name != "rtc" && state.InSwapGrace(now) {
+		log.Println("Not reporting it, the battery pack was just replaced")
+		return
+	}
+	payload := eventhelper.RailChange{
+		Rail:              rail.Name,
+		LastVoltage:       lastVoltage,
+		LastConnectedTime: lastActive,
+	}
+	if rail.Name != "rtc" {
+		lastPercent := math.Round(float64(state.LastPercent))
+		payload.LastPercent = &lastPercent
+		payload.BatteryType = state.Chemistry
+	}
+	if err := m.addEvent(eventhelper.NewEvent(eventType, now, payload)); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+}
+
+func (m *Monitor) reportCadenceChange(level cadence.Level, percent float32, now time.Time) {
+	interval := m.Cadence.IntervalFor(level, ReadingInterval)
+	profile := m.Cadence.ProfileFor(level)
+	log.Printf("Battery at %.0f%%, reporting cadence is now %s with the %s power profile, reading the battery every %s", percent, level, profile, interval)
+	if err := m.addEvent(eventhelper.NewEvent(eventhelper.ReportingCadenceChanged, now, eventhelper.CadenceChange{
+		Level:   string(level),
+		Profile: string(profile),
+		Battery: math.Round(float64(percent)),
+	})); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+	if level != cadence.Normal {
+		m.Buzzer.PlayAsync(buzzer.LowBattery)
+	}
+}
+
+// percentFor returns the battery percentage, type and voltage of the rail the battery is on.
+func percentFor(batteryConfig *goconfig.Battery, hvBat float32, lvBat float32) (float32, string, float32) {
+	batVolt := SelectVoltage(hvBat, lvBat)
+	batType, voltages, percents := batteryConfig.GetBatteryVoltageThresholds(batVolt)
+	if batVolt == 0 {
+		return 100, batType, 0
+	}
+	return percentFromCurve(voltages, percents, batVolt), batType, batVolt
+}
+
+// percentFromCurve interpolates the battery percentage from the voltage curve.
+func percentFromCurve(voltages, percents []float32, batVolt float32) float32 {
+	percent, ok := PercentFromCurve(voltages, percents, batVolt)
+	if !ok {
+		// probably have wrong battery config
+		log.Printf("Could not find a matching voltage range in config for %vV", batVolt)
+	}
+	return percent
+}
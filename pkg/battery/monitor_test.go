@@ -0,0 +1,104 @@
+package battery
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/stretchr/testify/assert"
+)
+
+type testReading struct {
+	time    time.Time
+	hv      float32
+	lv      float32
+	rtc     float32
+	quality ReadingQuality
+}
+
+// testReader replays readings in place of the ATtiny, and is the clock for the monitor.
+type testReader struct {
+	readings []testReading
+	current  int
+}
+
+// newTestReader returns a reader of LV readings at the reading interval.
+func newTestReader(start time.Time, lv ...float32) *testReader {
+	r := &testReader{current: -1}
+	for i, v := range lv {
+		r.readings = append(r.readings, testReading{
+			time: start.Add(time.Duration(i) * ReadingInterval),
+			lv:   v,
+			rtc:  3,
+		})
+	}
+	return r
+}
+
+func (r *testReader) ReadHVBattery() (float32, error) {
+	if r.current+1 >= len(r.readings) {
+		return 0, io.EOF
+	}
+	r.current++
+	return r.readings[r.current].hv, nil
+}
+
+func (r *testReader) ReadLVBattery() (float32, error) {
+	return r.readings[r.current].lv, nil
+}
+
+func (r *testReader) ReadRTCBattery() (float32, error) {
+	return r.readings[r.current].rtc, nil
+}
+
+func (r *testReader) TakeReadingQuality() ReadingQuality {
+	if r.current < 0 {
+		return ReadingQuality{}
+	}
+	return r.readings[r.current].quality
+}
+
+func (r *testReader) now() time.Time {
+	if r.current < 0 {
+		return r.readings[0].time
+	}
+	return r.readings[r.current].time
+}
+
+// newTestMonitor returns a monitor of the reader writing to a temporary directory, with the
+// events it makes added to events.
+func newTestMonitor(t *testing.T, reader *testReader, events *[]eventclient.Event) *Monitor {
+	dir := t.TempDir()
+	config := goconfig.DefaultBattery()
+	m := NewMonitor(reader, &config, filepath.Join(dir, "out.csv"), filepath.Join(dir, "state.json"))
+	m.Now = reader.now
+	m.Sleep = func(time.Duration) {}
+	m.AddEvent = func(e eventclient.Event) error {
+		*events = append(*events, e)
+		return nil
+	}
+	return m
+}
+
+func eventTypes(events []eventclient.Event) []string {
+	types := []string{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestMonitorDisconnect(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	reader := newTestReader(start, 12.4, 12.4, 0, 0, 0, 0, 0, 12.3)
+	events := []eventclient.Event{}
+	m := newTestMonitor(t, reader, &events)
+	assert.NoError(t, m.Run())
+
+	assert.Equal(t, []string{"rpiBattery", "batteryDisconnected", "batteryReconnected", "rpiBattery"}, eventTypes(events))
+	assert.Equal(t, "lv", events[1].Details["rail"])
+	assert.Equal(t, float32(12.4), events[1].Details["lastVoltage"])
+}
@@ -0,0 +1,76 @@
+package battery
+
+import (
+	"math"
+	"time"
+)
+
+// Each battery reading has flags saying how far it can be trusted, so the analysis of the
+// readings can throw away the bad ones. The flags are written as a number after the voltages
+// in battery-readings.csv, 0 is a good reading:
+//
+//	1 noisy      the raw ADC values that were averaged were spread out
+//	2 retried    the I2C link had to retry transactions while reading
+//	4 ambiguous  it isn't clear which rail the battery is on, or a rail has just dropped
+const (
+	QualityNoisy = 1 << iota
+	QualityRetried
+	QualityAmbiguous
+)
+
+const (
+	// A spread in the raw ADC values above this is noisy. Readings with a bigger spread are
+	// thrown away by the ATtiny reader already.
+	NoisyADCDifference = 20
+	// An HV reading this close to LVThreshold could be from either rail.
+	railAmbiguityMargin = 0.5
+)
+
+// ReadingQuality is how good a battery reading is.
+type ReadingQuality struct {
+	Noise     uint16 `json:"noise"`     // Largest spread in the raw ADC values of the voltages.
+	Retries   int    `json:"retries"`   // I2C retries while reading the voltages.
+	Ambiguous bool   `json:"ambiguous"` // The rail the battery is on isn't clear.
+}
+
+// Flags returns the quality flags, 0 if the reading is good.
+func (q ReadingQuality) Flags() int {
+	flags := 0
+	if q.Noise > NoisyADCDifference {
+		flags |= QualityNoisy
+	}
+	if q.Retries > 0 {
+		flags |= QualityRetried
+	}
+	if q.Ambiguous {
+		flags |= QualityAmbiguous
+	}
+	return flags
+}
+
+// RailAmbiguous returns true if the rail the battery is on can't be told from the reading.
+func RailAmbiguous(hvBat float32, hvRail, lvRail *Rail) bool {
+	if hvRail.Dropped() || lvRail.Dropped() {
+		return true
+	}
+	return math.Abs(float64(hvBat-LVThreshold)) < railAmbiguityMargin
+}
+
+// QualityReader is a battery reader that knows the quality of its readings.
+type QualityReader interface {
+	// TakeReadingQuality returns the quality of the readings since it was last called.
+	TakeReadingQuality() ReadingQuality
+}
+
+// Status is the last battery reading and how good it was.
+type Status struct {
+	Time        time.Time      `json:"time"`
+	HVBattery   float32        `json:"hvBattery"`
+	LVBattery   float32        `json:"lvBattery"`
+	RTCBattery  float32        `json:"rtcBattery"`
+	Percent     float32        `json:"percent"` // -1 when no battery is connected.
+	BatteryType string         `json:"batteryType,omitempty"`
+	Charger     string         `json:"charger,omitempty"` // "charging" or "float" while a charger is connected.
+	Quality     ReadingQuality `json:"quality"`
+	Flags       int            `json:"qualityFlags"`
+}
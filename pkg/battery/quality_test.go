@@ -0,0 +1,53 @@
+package battery
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadingQualityFlags(t *testing.T) {
+	assert.Equal(t, 0, ReadingQuality{Noise: NoisyADCDifference}.Flags())
+	assert.Equal(t, QualityNoisy, ReadingQuality{Noise: NoisyADCDifference + 1}.Flags())
+	assert.Equal(t, QualityRetried|QualityAmbiguous, ReadingQuality{Retries: 2, Ambiguous: true}.Flags())
+}
+
+func TestRailAmbiguous(t *testing.T) {
+	now := time.Now()
+	hv, lv := NewRail("hv"), NewRail("lv")
+	hv.Update(0, now)
+	lv.Update(12.4, now)
+	assert.False(t, RailAmbiguous(0, hv, lv))
+	assert.True(t, RailAmbiguous(LVThreshold+0.2, hv, lv))
+	assert.False(t, RailAmbiguous(24, hv, lv))
+}
+
+func TestMonitorQuality(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	reader := newTestReader(start, 12.4, 12.4)
+	reader.readings[1].quality = ReadingQuality{Noise: 30, Retries: 1}
+	events := []eventclient.Event{}
+	m := newTestMonitor(t, reader, &events)
+	var status Status
+	m.OnStatus = func(s Status) { status = s }
+	assert.NoError(t, m.Run())
+
+	out, err := os.ReadFile(m.ReadingsFile)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	assert.Equal(t, []string{
+		batterycsv.Header(),
+		"2024-05-01T10:00:00Z, 0.00, 12.40, 3.00, 0",
+		"2024-05-01T10:02:00Z, 0.00, 12.40, 3.00, 3",
+	}, lines)
+
+	assert.Equal(t, reader.readings[1].time, status.Time)
+	assert.Equal(t, QualityNoisy|QualityRetried, status.Flags)
+	assert.Equal(t, uint16(30), status.Quality.Noise)
+	assert.True(t, status.Percent >= 0)
+}
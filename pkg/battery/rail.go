@@ -0,0 +1,79 @@
+package battery
+
+import (
+	"time"
+)
+
+const (
+	RailActiveVoltage      = 1.0 // Above this the rail has a battery connected.
+	RailDisconnectDuration = 6 * time.Minute
+)
+
+// Rail tracks if a battery is connected to one of the rails that are measured.
+// A rail is only reported as disconnected if it was previously active and has read
+// close to 0V for RailDisconnectDuration, this stops a single bad reading or a rail
+// that has never had a battery on it from being reported.
+type Rail struct {
+	Name         string
+	active       bool
+	disconnected bool
+	lastVoltage  float32
+	lastActive   time.Time
+	lowSince     time.Time
+}
+
+type RailChange int
+
+const (
+	RailNoChange RailChange = iota
+	RailDisconnected
+	RailReconnected
+)
+
+// NewRail returns a rail that has not had a battery on it yet.
+func NewRail(name string) *Rail {
+	return &Rail{Name: name}
+}
+
+// Update records a voltage reading from the rail and returns if the battery was
+// disconnected or reconnected.
+func (r *Rail) Update(voltage float32, now time.Time) RailChange {
+	if voltage >= RailActiveVoltage {
+		change := RailNoChange
+		if r.disconnected {
+			change = RailReconnected
+		}
+		r.active = true
+		r.disconnected = false
+		r.lastVoltage = voltage
+		r.lastActive = now
+		r.lowSince = time.Time{}
+		return change
+	}
+	if !r.active || r.disconnected {
+		return RailNoChange
+	}
+	if r.lowSince.IsZero() {
+		r.lowSince = now
+	}
+	if now.Sub(r.lowSince) >= RailDisconnectDuration {
+		r.disconnected = true
+		return RailDisconnected
+	}
+	return RailNoChange
+}
+
+// Connected returns true if the rail currently has a battery on it.
+func (r *Rail) Connected() bool {
+	return r.active && !r.disconnected && r.lowSince.IsZero()
+}
+
+// Dropped returns true if the rail had a battery on it but is now reading close to 0V.
+func (r *Rail) Dropped() bool {
+	return r.active && (r.disconnected || !r.lowSince.IsZero())
+}
+
+// LastVoltage returns the last voltage read while a battery was connected, and when it was read.
+func (r *Rail) LastVoltage() (float32, time.Time) {
+	return r.lastVoltage, r.lastActive
+}
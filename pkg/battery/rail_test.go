@@ -0,0 +1,34 @@
+package battery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatteryRail(t *testing.T) {
+	now := time.Now()
+	rail := NewRail("lv")
+
+	// Never active, so not reported as disconnected.
+	assert.Equal(t, RailNoChange, rail.Update(0, now))
+	assert.Equal(t, RailNoChange, rail.Update(0, now.Add(time.Hour)))
+
+	assert.Equal(t, RailNoChange, rail.Update(12.4, now))
+	assert.True(t, rail.Connected())
+
+	// A short drop is not a disconnect.
+	assert.Equal(t, RailNoChange, rail.Update(0.1, now.Add(2*time.Minute)))
+	assert.Equal(t, RailNoChange, rail.Update(12.3, now.Add(4*time.Minute)))
+
+	assert.Equal(t, RailNoChange, rail.Update(0, now.Add(6*time.Minute)))
+	assert.Equal(t, RailDisconnected, rail.Update(0, now.Add(12*time.Minute)))
+	assert.False(t, rail.Connected())
+	lastVoltage, _ := rail.LastVoltage()
+	assert.Equal(t, float32(12.3), lastVoltage)
+	assert.Equal(t, RailNoChange, rail.Update(0, now.Add(14*time.Minute)))
+
+	assert.Equal(t, RailReconnected, rail.Update(12.2, now.Add(20*time.Minute)))
+	assert.True(t, rail.Connected())
+}
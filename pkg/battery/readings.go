@@ -0,0 +1,74 @@
+package battery
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+)
+
+// MigrateReadingsFile rewrites the battery readings file in the current schema with the
+// header. If it had readings from an older schema the old file is kept as a backup. If dryRun
+// isn't nil the migrated readings are written to it instead.
+func MigrateReadingsFile(filePath string, dryRun io.Writer) error {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		log.Printf("No battery readings file at %s, nothing to migrate", filePath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	migrated, fromVersion, changed := batterycsv.Migrate(data)
+	if !changed {
+		log.Printf("Battery readings are already at schema version %d", batterycsv.Version)
+		return nil
+	}
+	if fromVersion == batterycsv.Version {
+		// Trimming the file drops the header.
+		log.Printf("Adding the schema header to %s", filePath)
+	} else {
+		log.Printf("Migrating battery readings from schema version %d to %d", fromVersion, batterycsv.Version)
+	}
+	if dryRun != nil {
+		_, err := dryRun.Write(migrated)
+		return err
+	}
+	if fromVersion != batterycsv.Version {
+		backup := fmt.Sprintf("%s.v%d.bak", filePath, fromVersion)
+		if err := os.WriteFile(backup, data, 0644); err != nil {
+			return err
+		}
+		log.Printf("Old battery readings saved to %s", backup)
+	}
+	return writeFile(filePath, migrated)
+}
+
+// trimReadings keeps the last maxLines lines of the readings file.
+func trimReadings(filePath string, maxLines int) error {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= maxLines {
+		return nil
+	}
+	return writeFile(filePath, bytes.Join(lines[len(lines)-maxLines:], nil))
+}
+
+func writeFile(filePath string, data []byte) error {
+	tmpFile := filePath + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filePath)
+}
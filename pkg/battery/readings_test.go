@@ -0,0 +1,56 @@
+package battery
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateReadingsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "battery-readings.csv")
+	old := "2024-05-01 10:00:00, 0.00, 12.40, 3.00\n2024-05-01 10:02:00, 0.00, 12.39, 3.00, 2\n"
+	assert.NoError(t, os.WriteFile(file, []byte(old), 0644))
+
+	// A dry run leaves the file alone.
+	out := &bytes.Buffer{}
+	assert.NoError(t, MigrateReadingsFile(file, out))
+	assert.True(t, strings.HasPrefix(out.String(), batterycsv.Header()+"\n"))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, old, string(data))
+
+	assert.NoError(t, MigrateReadingsFile(file, nil))
+	data, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, out.String(), string(data))
+	assert.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 3)
+	backup, err := os.ReadFile(file + ".v1.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, old, string(backup))
+}
+
+func TestTrimReadings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "battery-readings.csv")
+	assert.NoError(t, trimReadings(file, 2))
+
+	lines := ""
+	for i := 0; i < 5; i++ {
+		lines += fmt.Sprintf("line %d\n", i)
+	}
+	assert.NoError(t, os.WriteFile(file, []byte(lines), 0644))
+	assert.NoError(t, trimReadings(file, 10))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, lines, string(data))
+
+	assert.NoError(t, trimReadings(file, 2))
+	data, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "line 3\nline 4\n", string(data))
+}
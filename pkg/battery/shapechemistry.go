@@ -0,0 +1,81 @@
+package battery
+
+import (
+	"math"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// When the battery type isn't set in the config the chemistry is guessed from the voltage
+// range, which often mistakes LiFePO4 packs for Li-ion. The shape of the discharge curve over
+// the first hours is used as a second opinion, see chemistry.go. Once it is confident enough
+// its chemistry is used in place of the voltage range guess, with the voltage curve for that
+// chemistry, until the battery is changed.
+const shapeOverrideConfidence = 0.8
+
+// ShapeChemistry is the chemistry detected from the shape of the discharge curve.
+type ShapeChemistry struct {
+	Chemistry  string    `json:"chemistry"`
+	Confidence float64   `json:"confidence"`
+	RangeGuess string    `json:"rangeGuess"` // The chemistry from the voltage range when it was detected.
+	Detected   time.Time `json:"detected"`
+}
+
+// checkChemistryShape adds the reading to the curve shape classifier and returns the
+// chemistry and percentage to use, from the curve shape if it has been detected.
+func (m *Monitor) checkChemistryShape(state *State, batteryType string, percent, voltage float32, now time.Time) (string, float32) {
+	if m.Config.BatteryType != "" || voltage <= 0 {
+		return batteryType, percent
+	}
+	if state.ShapeChemistry != nil && state.ShapeChemistry.RangeGuess != batteryType {
+		// The voltage range has changed, so it is likely a different battery.
+		m.resetChemistryShape(state)
+	}
+	if state.ShapeChemistry == nil {
+		m.shape.Add(voltage, now)
+		result, ok := m.shape.Result()
+		if !ok || result.Chemistry == "" || result.Confidence < shapeOverrideConfidence {
+			return batteryType, percent
+		}
+		state.ShapeChemistry = &ShapeChemistry{
+			Chemistry:  result.Chemistry,
+			Confidence: result.Confidence,
+			RangeGuess: batteryType,
+			Detected:   now,
+		}
+		m.reportChemistryShape(result, batteryType, now)
+	}
+	chemistry := state.ShapeChemistry.Chemistry
+	if chemistry == batteryType {
+		return batteryType, percent
+	}
+	cells := EstimateCellCount(chemistry, voltage)
+	if voltages, percents, ok := PackCurve(chemistry, cells); ok {
+		percent = percentFromCurve(voltages, percents, voltage)
+	}
+	return chemistry, percent
+}
+
+func (m *Monitor) resetChemistryShape(state *State) {
+	m.shape.Reset()
+	state.ShapeChemistry = nil
+}
+
+func (m *Monitor) reportChemistryShape(result ShapeResult, rangeGuess string, now time.Time) {
+	if result.Chemistry == rangeGuess {
+		log.Printf("Discharge curve shape agrees the battery is '%s'", rangeGuess)
+		return
+	}
+	log.Printf("Discharge curve shape shows the battery is '%s' not '%s', confidence %.2f", result.Chemistry, rangeGuess, result.Confidence)
+	if err := m.addEvent(eventhelper.NewEvent(eventhelper.BatteryChemistryFound, now, eventhelper.ChemistryDetection{
+		Chemistry:   result.Chemistry,
+		RangeGuess:  rangeGuess,
+		Confidence:  result.Confidence,
+		PlateauRate: math.Round(result.PlateauRate*1000) / 1000,
+		Knee:        math.Round(result.KneePosition*100) / 100,
+		Method:      "curveShape",
+	})); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+}
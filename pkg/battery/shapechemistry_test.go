@@ -0,0 +1,49 @@
+package battery
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckChemistryShape(t *testing.T) {
+	events := []eventclient.Event{}
+	m := &Monitor{
+		Config: &goconfig.Battery{},
+		AddEvent: func(e eventclient.Event) error {
+			events = append(events, e)
+			return nil
+		},
+	}
+	state := &State{}
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// A 4S LiFePO4 pack guessed as Li-ion from the voltage range.
+	chemistry := ""
+	var percent float32
+	for d := time.Duration(0); d <= ShapeWindow; d += ReadingInterval {
+		voltage := float32(13.2 + 0.4*math.Exp(-d.Hours()*3) - 0.002*d.Hours())
+		chemistry, percent = m.checkChemistryShape(state, "li-ion", 50, voltage, start.Add(d))
+	}
+	assert.Equal(t, "lifepo4", chemistry)
+	assert.NotEqual(t, float32(50), percent)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "batteryChemistryDetected", events[0].Type)
+	assert.Equal(t, "li-ion", events[0].Details["rangeGuess"])
+
+	// A different voltage range is likely a different battery.
+	chemistry, _ = m.checkChemistryShape(state, "lime", 80, 36, start.Add(7*time.Hour))
+	assert.Equal(t, "lime", chemistry)
+	assert.Nil(t, state.ShapeChemistry)
+
+	// The shape isn't used when the battery type is in the config.
+	m.Config.BatteryType = "li-ion"
+	state.ShapeChemistry = &ShapeChemistry{Chemistry: "lifepo4", RangeGuess: "li-ion"}
+	chemistry, percent = m.checkChemistryShape(state, "li-ion", 50, 13.1, start)
+	assert.Equal(t, "li-ion", chemistry)
+	assert.Equal(t, float32(50), percent)
+}
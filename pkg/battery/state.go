@@ -0,0 +1,180 @@
+package battery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const ProfileVersion = 1
+
+// VoltageCurve maps battery voltages to a percentage of charge.
+type VoltageCurve struct {
+	Voltages []float32 `json:"voltages"`
+	Percents []float32 `json:"percents"`
+}
+
+// DischargeStats are the averages learned from the battery discharging.
+type DischargeStats struct {
+	AvgPercentPerHour float64 `json:"avgPercentPerHour"`
+	Samples           int     `json:"samples"`
+}
+
+// State is what has been learned about the battery, it is saved so it is not lost when the
+// device restarts.
+type State struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	Chemistry     string         `json:"chemistry"`
+	CellCount     int            `json:"cellCount"`
+	VoltageCurve  *VoltageCurve  `json:"voltageCurve,omitempty"`
+	Discharge     DischargeStats `json:"discharge"`
+	LastVoltage   float32        `json:"lastVoltage"`
+	LastPercent   float32        `json:"lastPercent"`
+	LastReading   time.Time      `json:"lastReading"`
+	// Estimated from the voltage sag when loads are switched, see Transients.
+	InternalResistance float64 `json:"internalResistanceOhms,omitempty"`
+	// Internal resistance of each known load step, see impedance.go.
+	Impedance *ImpedanceTrend `json:"impedance,omitempty"`
+	// Chemistry from the shape of the discharge curve, see shapechemistry.go.
+	ShapeChemistry *ShapeChemistry `json:"shapeChemistry,omitempty"`
+	// Set while a charger is connected, see charger.go.
+	Charger *ChargerState `json:"charger,omitempty"`
+	// The pack in use, see swap.go.
+	Pack Pack `json:"pack"`
+
+	// Point the current discharge rate is being measured from.
+	refPercent float32
+	refTime    time.Time
+}
+
+// Profile is the portable part of the battery state. It can be exported from one device and
+// imported on other devices that have the same battery packs.
+type Profile struct {
+	Version      int            `json:"version"`
+	Chemistry    string         `json:"chemistry"`
+	CellCount    int            `json:"cellCount"`
+	VoltageCurve *VoltageCurve  `json:"voltageCurve,omitempty"`
+	Discharge    DischargeStats `json:"discharge"`
+}
+
+// LoadState reads the battery state file, migrating it from older schema versions. A new
+// state is returned if the file doesn't exist.
+func LoadState(filePath string) (*State, error) {
+	state := &State{}
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, fromVersion, err := MigrateState(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate %s: %v", filePath, err)
+	}
+	if fromVersion != StateSchemaVersion {
+		log.Printf("Migrated battery state from schema version %d to %d", fromVersion, StateSchemaVersion)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filePath, err)
+	}
+	return state, nil
+}
+
+func (s *State) Save(filePath string) error {
+	s.SchemaVersion = StateSchemaVersion
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := filePath + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filePath)
+}
+
+// Update adds a new reading to the battery state, returning true if something was learned
+// that should be saved.
+func (s *State) Update(chemistry string, voltage, percent float32, now time.Time) bool {
+	changed := false
+	if chemistry != "" && chemistry != s.Chemistry {
+		log.Printf("Battery chemistry changed from '%s' to '%s'", s.Chemistry, chemistry)
+		s.Chemistry = chemistry
+		s.CellCount = EstimateCellCount(chemistry, voltage)
+		changed = true
+	}
+	s.LastVoltage = voltage
+	s.LastPercent = percent
+	s.LastReading = now
+
+	if s.refTime.IsZero() || percent > s.refPercent+5 || s.Charger != nil {
+		// First reading, the battery has been changed or is being charged, start measuring again.
+		s.refPercent = percent
+		s.refTime = now
+		return changed
+	}
+
+	drop := s.refPercent - percent
+	hours := now.Sub(s.refTime).Hours()
+	if drop >= 1 && hours > 0 {
+		rate := float64(drop) / hours
+		if s.Discharge.Samples == 0 {
+			s.Discharge.AvgPercentPerHour = rate
+		} else {
+			// Weight recent discharge rates more so the average follows changes in usage.
+			s.Discharge.AvgPercentPerHour = 0.9*s.Discharge.AvgPercentPerHour + 0.1*rate
+		}
+		s.Discharge.Samples++
+		s.Pack.Cycles += float64(drop) / 100
+		s.refPercent = percent
+		s.refTime = now
+		changed = true
+	}
+	return changed
+}
+
+// HoursRemaining estimates how long the battery will last from the learned discharge rate.
+// Returns -1 if there is not enough information to make an estimate, or while it is charging.
+func (s *State) HoursRemaining() float64 {
+	if s.Charger != nil || s.Discharge.Samples == 0 || s.Discharge.AvgPercentPerHour <= 0 {
+		return -1
+	}
+	return float64(s.LastPercent) / s.Discharge.AvgPercentPerHour
+}
+
+func (s *State) Profile() Profile {
+	return Profile{
+		Version:      ProfileVersion,
+		Chemistry:    s.Chemistry,
+		CellCount:    s.CellCount,
+		VoltageCurve: s.VoltageCurve,
+		Discharge:    s.Discharge,
+	}
+}
+
+func (s *State) ApplyProfile(p Profile) {
+	s.Chemistry = p.Chemistry
+	s.CellCount = p.CellCount
+	s.VoltageCurve = p.VoltageCurve
+	s.Discharge = p.Discharge
+}
+
+func (p Profile) Validate() error {
+	if p.Version != ProfileVersion {
+		return fmt.Errorf("unsupported battery profile version %d", p.Version)
+	}
+	if p.Chemistry == "" {
+		return fmt.Errorf("battery profile has no chemistry")
+	}
+	if p.VoltageCurve != nil {
+		if len(p.VoltageCurve.Voltages) == 0 || len(p.VoltageCurve.Voltages) != len(p.VoltageCurve.Percents) {
+			return fmt.Errorf("battery profile voltage curve is invalid")
+		}
+	}
+	if p.Discharge.AvgPercentPerHour < 0 {
+		return fmt.Errorf("battery profile has a negative discharge rate")
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package battery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateDischarge(t *testing.T) {
+	state := &State{}
+	now := time.Now()
+
+	assert.True(t, state.Update("li-ion", 12.4, 90, now))
+	assert.Equal(t, 3, state.CellCount)
+	assert.Equal(t, float64(-1), state.HoursRemaining())
+
+	// Less than 1% drop, nothing learned yet.
+	assert.False(t, state.Update("li-ion", 12.3, 89.5, now.Add(time.Hour)))
+
+	// 10% drop over 5 hours.
+	assert.True(t, state.Update("li-ion", 12.0, 80, now.Add(5*time.Hour)))
+	assert.Equal(t, 1, state.Discharge.Samples)
+	assert.InDelta(t, 2, state.Discharge.AvgPercentPerHour, 0.001)
+	assert.InDelta(t, 40, state.HoursRemaining(), 0.001)
+
+	// Charging resets the measurement point but keeps the learned averages.
+	assert.False(t, state.Update("li-ion", 12.6, 100, now.Add(6*time.Hour)))
+	assert.Equal(t, float32(100), state.refPercent)
+	assert.Equal(t, 1, state.Discharge.Samples)
+}
+
+func TestBatteryProfileValidation(t *testing.T) {
+	state := &State{
+		Chemistry: "lifepo4",
+		CellCount: 4,
+		Discharge: DischargeStats{AvgPercentPerHour: 0.5, Samples: 20},
+	}
+	profile := state.Profile()
+	assert.NoError(t, profile.Validate())
+
+	imported := &State{}
+	imported.ApplyProfile(profile)
+	assert.Equal(t, "lifepo4", imported.Chemistry)
+	assert.Equal(t, 20, imported.Discharge.Samples)
+
+	profile.VoltageCurve = &VoltageCurve{Voltages: []float32{12, 13}, Percents: []float32{0}}
+	assert.Error(t, profile.Validate())
+
+	profile = state.Profile()
+	profile.Version = 99
+	assert.Error(t, profile.Validate())
+}
@@ -0,0 +1,60 @@
+package battery
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The battery state file has a schemaVersion field. When the fields in State change in a way
+// that older files can't just be unmarshalled, bump StateSchemaVersion and add a migration
+// from the previous version so existing files are upgraded when loaded. Files written before
+// schemaVersion was added are version 0.
+const StateSchemaVersion = 1
+
+// stateMigrations[i] migrates a state from version i to version i+1.
+var stateMigrations = []func(state map[string]interface{}) error{
+	migrateStateV0,
+}
+
+// migrateStateV0 normalises the chemistry name and fills in the cell count, which could be
+// left at 0 by older versions.
+func migrateStateV0(state map[string]interface{}) error {
+	chemistry, _ := state["chemistry"].(string)
+	chemistry = strings.ToLower(chemistry)
+	state["chemistry"] = chemistry
+	cellCount, _ := state["cellCount"].(float64)
+	voltage, _ := state["lastVoltage"].(float64)
+	if cellCount == 0 {
+		state["cellCount"] = EstimateCellCount(chemistry, float32(voltage))
+	}
+	return nil
+}
+
+// MigrateState upgrades the JSON of a battery state file to the current schema version.
+// It returns the migrated JSON and the version it was migrated from.
+func MigrateState(data []byte) ([]byte, int, error) {
+	state := map[string]interface{}{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, 0, err
+	}
+	version := 0
+	if v, ok := state["schemaVersion"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return nil, 0, fmt.Errorf("invalid schema version '%v'", v)
+		}
+		version = int(f)
+	}
+	if version > StateSchemaVersion {
+		return nil, version, fmt.Errorf("schema version %d is newer than the supported version %d", version, StateSchemaVersion)
+	}
+	for v := version; v < StateSchemaVersion; v++ {
+		if err := stateMigrations[v](state); err != nil {
+			return nil, version, fmt.Errorf("failed to migrate from schema version %d: %v", v, err)
+		}
+		state["schemaVersion"] = v + 1
+	}
+	migrated, err := json.MarshalIndent(state, "", "  ")
+	return migrated, version, err
+}
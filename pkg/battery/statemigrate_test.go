@@ -0,0 +1,37 @@
+package battery
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Every historical schema version should have a fixture in testdata.
+func TestLoadStateFixtures(t *testing.T) {
+	for v := 0; v <= StateSchemaVersion; v++ {
+		file := filepath.Join("testdata", fmt.Sprintf("battery_state_v%d.json", v))
+		state, err := LoadState(file)
+		if !assert.NoError(t, err, file) {
+			continue
+		}
+		assert.Equal(t, StateSchemaVersion, state.SchemaVersion, file)
+		assert.NotEmpty(t, state.Chemistry, file)
+		assert.NotZero(t, state.CellCount, file)
+		assert.False(t, state.LastReading.IsZero(), file)
+	}
+}
+
+func TestMigrateStateV0(t *testing.T) {
+	state, err := LoadState(filepath.Join("testdata", "battery_state_v0.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "li-ion", state.Chemistry)
+	assert.Equal(t, 3, state.CellCount)
+	assert.Equal(t, 12, state.Discharge.Samples)
+}
+
+func TestMigrateStateNewerVersion(t *testing.T) {
+	_, _, err := MigrateState([]byte(fmt.Sprintf(`{"schemaVersion": %d}`, StateSchemaVersion+1)))
+	assert.Error(t, err)
+}
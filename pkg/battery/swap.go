@@ -0,0 +1,115 @@
+package battery
+
+import (
+	"math"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+// After swapping the battery pack the battery state is started afresh for the new pack. The
+// discharge rate, chemistry, internal resistance and charger state learned from the old pack
+// are cleared, an imported voltage curve is kept as it is for the type of pack rather than
+// the pack. A batteryReplaced event records the swap, with the identities of the packs and
+// the odometer of the old pack, the discharge it did in equivalent full cycles.
+//
+// For SwapGrace after the swap the level of the new pack is expected to jump and the rails to
+// come and go while it is connected, so the charger detection and the battery disconnected
+// and reconnected events are skipped instead of misfiring.
+const SwapGrace = time.Hour
+
+// Pack is the pack the battery state was learned from.
+type Pack struct {
+	ID        string    `json:"id,omitempty"`
+	Installed time.Time `json:"installed,omitempty"` // Zero if it was there before swaps were recorded.
+	Cycles    float64   `json:"cycles"`              // Discharge in equivalent full cycles.
+}
+
+// Swap is a request to record a battery pack swap.
+type Swap struct {
+	OldPack string
+	NewPack string
+}
+
+// InSwapGrace returns true if the pack was swapped less than SwapGrace ago.
+func (s *State) InSwapGrace(now time.Time) bool {
+	installed := s.Pack.Installed
+	return !installed.IsZero() && !now.Before(installed) && now.Sub(installed) < SwapGrace
+}
+
+// ReplacePack clears what was learned from the old pack, returning the state as it was.
+func (s *State) ReplacePack(newPack string, now time.Time) State {
+	old := *s
+	*s = State{
+		VoltageCurve: old.VoltageCurve,
+		Pack:         Pack{ID: newPack, Installed: now},
+	}
+	return old
+}
+
+// SwapEvent returns the batteryReplaced event for a swap from the old state.
+func SwapEvent(swap Swap, old State, now time.Time) eventclient.Event {
+	oldPack := swap.OldPack
+	if oldPack == "" {
+		oldPack = old.Pack.ID
+	}
+	return eventhelper.NewEvent(eventhelper.BatteryReplaced, now, eventhelper.PackSwap{
+		OldPack:                   oldPack,
+		NewPack:                   swap.NewPack,
+		OldPackCycles:             math.Round(old.Pack.Cycles*100) / 100,
+		OldChemistry:              old.Chemistry,
+		OldLastPercent:            math.Round(float64(old.LastPercent)),
+		OldPackInstalled:          old.Pack.Installed,
+		OldInternalResistanceOhms: math.Round(old.InternalResistance*1000) / 1000,
+	})
+}
+
+// RequestSwap records the swap to be applied at the next reading, waking the monitor so it
+// is applied straight away.
+func (m *Monitor) RequestSwap(swap Swap) {
+	m.swapMu.Lock()
+	m.swap = &swap
+	m.swapMu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// applySwap starts the battery state afresh if a swap has been requested.
+func (m *Monitor) applySwap(state *State, now time.Time) bool {
+	m.swapMu.Lock()
+	swap := m.swap
+	m.swap = nil
+	m.swapMu.Unlock()
+	if swap == nil {
+		return false
+	}
+	old := state.ReplacePack(swap.NewPack, now)
+	m.resetChemistryShape(state)
+	if m.Transients != nil {
+		m.Transients.SetInternalResistance(0)
+	}
+	m.takeMeasurements() // They were of the old pack.
+	log.Printf("Battery pack replaced with '%s', the old pack did %.2f cycles", swap.NewPack, old.Pack.Cycles)
+	if err := m.addEvent(SwapEvent(*swap, old, now)); err != nil {
+		log.Printf("Error adding event: %v", err)
+	}
+	if err := state.Save(m.StateFile); err != nil {
+		log.Printf("Error saving battery state: %v", err)
+	}
+	return true
+}
+
+// wait waits for the next reading, returning early if woken for a swap.
+func (m *Monitor) wait(d time.Duration) {
+	if m.Sleep != nil {
+		m.Sleep(d)
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-m.wake:
+	}
+}
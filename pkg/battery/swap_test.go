@@ -0,0 +1,43 @@
+package battery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplacePack(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	curve := &VoltageCurve{Voltages: []float32{11, 13}, Percents: []float32{0, 100}}
+	s := &State{Chemistry: "lifepo4", VoltageCurve: curve, Pack: Pack{ID: "A1"}}
+	s.Update("lifepo4", 13, 90, now)
+	s.Update("lifepo4", 12.8, 40, now.Add(10*time.Hour))
+	assert.InDelta(t, 0.5, s.Pack.Cycles, 0.001)
+
+	old := s.ReplacePack("B2", now.Add(11*time.Hour))
+	assert.Equal(t, "lifepo4", old.Chemistry)
+	assert.Equal(t, State{VoltageCurve: curve, Pack: Pack{ID: "B2", Installed: now.Add(11 * time.Hour)}}, *s)
+	assert.True(t, s.InSwapGrace(now.Add(11*time.Hour+30*time.Minute)))
+	assert.False(t, s.InSwapGrace(now.Add(12*time.Hour)))
+
+	e := SwapEvent(Swap{NewPack: "B2"}, old, now)
+	assert.Equal(t, "A1", e.Details["oldPack"])
+	assert.Equal(t, 0.5, e.Details["oldPackCycles"])
+}
+
+func TestMonitorSwap(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	reader := newTestReader(start, 12.4, 12.4, 0, 0, 0, 0, 0, 12.3)
+	events := []eventclient.Event{}
+	m := newTestMonitor(t, reader, &events)
+	m.RequestSwap(Swap{OldPack: "A1", NewPack: "B2"})
+	assert.NoError(t, m.Run())
+
+	// The pack coming and going while it is connected isn't reported.
+	assert.Equal(t, []string{"batteryReplaced", "rpiBattery", "rpiBattery"}, eventTypes(events))
+	state, err := LoadState(m.StateFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "B2", state.Pack.ID)
+}
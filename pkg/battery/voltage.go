@@ -0,0 +1,71 @@
+package battery
+
+import (
+	"math"
+	"strings"
+)
+
+// LVThreshold is the voltage on the HV rail at or below which the LV rail is used instead.
+const LVThreshold = 15
+
+// Nominal voltage of a single cell, used to estimate how many cells are in a pack.
+var NominalCellVoltages = map[string]float32{
+	"li-ion":    3.7,
+	"lipo":      3.7,
+	"lifepo4":   3.2,
+	"lead-acid": 2.0,
+	"nimh":      1.2,
+}
+
+// SelectVoltage returns the voltage of the battery that is being used, 0 if no
+// battery is connected.
+func SelectVoltage(hvBat float32, lvBat float32) float32 {
+	var batVolt float32
+	if hvBat <= LVThreshold {
+		batVolt = lvBat
+	} else {
+		batVolt = hvBat
+	}
+
+	if batVolt < 1 {
+		batVolt = 0
+	}
+	return batVolt
+}
+
+// PercentFromCurve interpolates the battery percentage from the voltage curve. ok is
+// false if the voltage is below the curve, which probably means the wrong battery config.
+func PercentFromCurve(voltages, percents []float32, batVolt float32) (percent float32, ok bool) {
+	var upper float32 = 0
+	var lower float32 = 0
+	var i = 0
+	for i = 0; i < len(voltages); i++ {
+		voltage := voltages[i]
+		lower = upper
+		upper = voltage
+		if batVolt >= lower && batVolt < upper {
+			break
+		}
+		if batVolt <= lower && batVolt <= upper {
+			return percents[i], false
+		}
+	}
+	if i == 0 {
+		return 0, true
+	} else if batVolt > upper {
+		//voltage is higher than config
+		return 100, true
+	}
+	gradient := (percents[i] - percents[i-1]) / (upper - lower)
+	return gradient*batVolt + percents[i-1] - gradient*lower, true
+}
+
+// EstimateCellCount estimates how many cells are in a pack of the chemistry from its
+// voltage, 0 if the chemistry is unknown.
+func EstimateCellCount(chemistry string, voltage float32) int {
+	cellVoltage, ok := NominalCellVoltages[strings.ToLower(chemistry)]
+	if !ok || voltage <= 0 {
+		return 0
+	}
+	return int(math.Max(1, math.Round(float64(voltage/cellVoltage))))
+}
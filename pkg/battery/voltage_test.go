@@ -0,0 +1,35 @@
+package battery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectVoltage(t *testing.T) {
+	assert.Equal(t, float32(3.7), SelectVoltage(0.2, 3.7))
+	assert.Equal(t, float32(24.1), SelectVoltage(24.1, 0))
+	assert.Equal(t, float32(0), SelectVoltage(0.2, 0.5))
+}
+
+func TestPercentFromCurve(t *testing.T) {
+	voltages := []float32{3.0, 3.6, 4.2}
+	percents := []float32{0, 50, 100}
+
+	percent, ok := PercentFromCurve(voltages, percents, 3.3)
+	assert.True(t, ok)
+	assert.InDelta(t, 25, percent, 0.01)
+
+	percent, ok = PercentFromCurve(voltages, percents, 4.5)
+	assert.True(t, ok)
+	assert.Equal(t, float32(100), percent)
+
+	_, ok = PercentFromCurve([]float32{3.0, 3.6}, []float32{0, 100}, 0)
+	assert.True(t, ok)
+}
+
+func TestEstimateCellCount(t *testing.T) {
+	assert.Equal(t, 3, EstimateCellCount("Li-Ion", 11.1))
+	assert.Equal(t, 1, EstimateCellCount("lifepo4", 1))
+	assert.Equal(t, 0, EstimateCellCount("unknown", 12))
+}
@@ -0,0 +1,139 @@
+// Package commsproto is the protocol used to talk to devices connected to the UART on the
+// TC2 HAT. Each message is JSON followed by a checksum of the JSON, framed as `<json|checksum>`.
+// Compact messages, for radio links, are sent as raw bytes instead of JSON, so they don't use up
+// the airtime. They are framed as '#', the length of the payload as a byte, the payload, then
+// the checksum of the payload as a byte.
+package commsproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ErrChecksumMismatch is returned by Decode when the checksum doesn't match the message.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Message types.
+const (
+	TypeCommand = "command"
+	TypeWrite   = "write"
+	TypeRead    = "read"
+	TypeACK     = "ACK"
+	TypeNACK    = "NACK"
+	// The payload is sent as it is, without the JSON.
+	TypeCompact = "compact"
+)
+
+// compactStart starts a compact frame, JSON frames start with '<'.
+const compactStart = '#'
+
+// UartMessage represents the data structure for communication with a device connected on UART.
+// - ID: Identifier of the message being sent or the message being responded to.
+// - Response: Indicates if the message is a response.
+// - Type: Specifies the type of message (e.g., write, read, command, ACK, NACK).
+// - Data: Contains the actual data payload, which varies depending on the type or response.
+// - Payload: The raw payload of a compact message.
+type UartMessage struct {
+	ID       int    `json:"id,omitempty"`
+	Response bool   `json:"response,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Data     string `json:"data,omitempty"`
+	Payload  []byte `json:"payload,omitempty"`
+}
+
+type Command struct {
+	Command string `json:"command"`
+	Args    string `json:"args,omitempty"`
+}
+
+type Write struct {
+	Var string      `json:"var,omitempty"`
+	Val interface{} `json:"val,omitempty"`
+}
+
+type Read struct {
+	Var string `json:"var,omitempty"`
+}
+
+type ReadResponse struct {
+	Val string `json:"var,omitempty"`
+}
+
+// NewMessage makes a message of the type with the payload marshalled into the data.
+func NewMessage(messageType string, payload interface{}) (UartMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return UartMessage{}, err
+	}
+	return UartMessage{Type: messageType, Data: string(data)}, nil
+}
+
+// Checksum is the sum of the bytes modulo 256.
+func Checksum(message []byte) int {
+	checksum := 0
+	for _, b := range message {
+		checksum += int(b)
+	}
+	return checksum % 256
+}
+
+// Encode frames the message so it can be sent over the UART.
+func Encode(message UartMessage) ([]byte, error) {
+	if message.Type == TypeCompact {
+		if len(message.Payload) == 0 || len(message.Payload) > math.MaxUint8 {
+			return nil, fmt.Errorf("invalid compact payload length %d", len(message.Payload))
+		}
+		frame := append([]byte{compactStart, byte(len(message.Payload))}, message.Payload...)
+		return append(frame, byte(Checksum(message.Payload))), nil
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("<%s|%d>", data, Checksum(data))), nil
+}
+
+// Decode checks the framing and checksum of a message read from the UART and unmarshals it.
+func Decode(data []byte) (*UartMessage, error) {
+	if len(data) > 0 && data[0] == compactStart {
+		return decodeCompact(data)
+	}
+	if len(data) == 0 || data[0] != '<' {
+		return nil, fmt.Errorf("response doesn't start with '<'")
+	}
+	if data[len(data)-1] != '>' {
+		return nil, fmt.Errorf("response doesn't end with '>'")
+	}
+
+	// Extract and verify message and checksum
+	data = data[1 : len(data)-1]
+	parts := bytes.Split(data, []byte("|"))
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid response format")
+	}
+	receivedChecksum, err := strconv.Atoi(string(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	if Checksum(parts[0]) != receivedChecksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	message := &UartMessage{}
+	return message, json.Unmarshal(parts[0], message)
+}
+
+func decodeCompact(data []byte) (*UartMessage, error) {
+	if len(data) < 3 || len(data) != int(data[1])+3 {
+		return nil, fmt.Errorf("invalid compact frame length %d", len(data))
+	}
+	payload := data[2 : len(data)-1]
+	if byte(Checksum(payload)) != data[len(data)-1] {
+		return nil, ErrChecksumMismatch
+	}
+	return &UartMessage{Type: TypeCompact, Payload: append([]byte{}, payload...)}, nil
+}
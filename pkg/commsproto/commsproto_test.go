@@ -0,0 +1,53 @@
+package commsproto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	message, err := NewMessage(TypeWrite, &Write{Var: "active", Val: true})
+	assert.NoError(t, err)
+	data, err := Encode(message)
+	assert.NoError(t, err)
+	assert.Equal(t, `<{"type":"write","data":"{\"var\":\"active\",\"val\":true}"}|`, string(data[:len(data)-4]))
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, message, *decoded)
+}
+
+func TestEncodeDecodeCompact(t *testing.T) {
+	// The payload is sent raw, even bytes used in the JSON framing.
+	message := UartMessage{Type: TypeCompact, Payload: []byte{0x83, '<', '|', '>'}}
+	data, err := Encode(message)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'#', 4, 0x83, '<', '|', '>', 0x79}, data)
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, message, *decoded)
+
+	data[3] = '{'
+	_, err = Decode(data)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	_, err = Decode(data[:5])
+	assert.Error(t, err)
+	_, err = Encode(UartMessage{Type: TypeCompact})
+	assert.Error(t, err)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		`{"type":"ACK"}|1>`,
+		`<{"type":"ACK"}|1`,
+		`<{"type":"ACK"}>`,
+		`<{"type":"ACK"}|1>`,
+		`<{"type":"ACK"}|x>`,
+	} {
+		_, err := Decode([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
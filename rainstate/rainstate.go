@@ -0,0 +1,56 @@
+// Package rainstate shares whether it is raining heavily, from the weather input of
+// tc2-hat-comms, with the other hat services. tc2-hat-temp uses it to check that the humidity
+// in the enclosure doesn't rise with the rain. The state is kept in a file in /run so it is
+// cleared at boot. tc2-hat-comms saves it when heavy rain starts or stops and with each hourly
+// weather event, so a state older than MaxAge is from a service that has stopped.
+package rainstate
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// MaxAge is how old the state can be before it isn't used.
+const MaxAge = 3 * time.Hour
+
+var file = "/run/tc2-hat-rain.json"
+
+// State is the rain from the weather input.
+type State struct {
+	Heavy    bool      `json:"heavyRain"`
+	RainRate float64   `json:"rainRateMMPerHour"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Save saves the state for the other services.
+func Save(s State) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// Load returns the state, ok is false if there is no weather input or the state is older
+// than MaxAge.
+func Load(now time.Time) (s State, ok bool, err error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return State{}, false, nil
+	}
+	if err != nil {
+		return State{}, false, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return State{}, false, err
+	}
+	if now.Sub(s.Updated) > MaxAge {
+		return s, false, nil
+	}
+	return s, true, nil
+}
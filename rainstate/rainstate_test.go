@@ -0,0 +1,38 @@
+package rainstate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	previous := file
+	file = filepath.Join(t.TempDir(), "rain.json")
+	defer func() { file = previous }()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	_, ok, err := Load(now)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	saved := State{Heavy: true, RainRate: 8.2, Updated: now}
+	assert.NoError(t, Save(saved))
+	s, ok, err := Load(now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, saved, s)
+
+	// Too old, tc2-hat-comms has stopped saving it.
+	_, ok, err = Load(now.Add(MaxAge + time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, os.WriteFile(file, []byte("{"), 0644))
+	_, ok, err = Load(now)
+	assert.Error(t, err)
+	assert.False(t, ok)
+}
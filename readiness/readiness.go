@@ -0,0 +1,215 @@
+// Package readiness is a handshake between the hat services at boot, so a service waits for
+// the services it depends on to be ready instead of relying on the start order and sleeps.
+// The RTC has to have set the system time before services that save timestamps start, and
+// tc2-hat-i2c has to be on D-Bus before anything uses the I2C bus. When a service is ready it
+// sends a Ready signal on the system bus with its name:
+//
+//	org.cacophony.TC2HatReady.Ready("tc2-hat-rtc")
+//
+// and leaves a file with its PID in /run/tc2-hat-ready, so a service that starts after the
+// signal was sent still sees it. /run is cleared at boot and the PID is checked, so a service
+// that has stopped isn't taken to be ready. Waiting is bounded, if a dependency isn't ready
+// in time the service starts anyway, falling back on its own retries, and a
+// dependencyNotReady event is made.
+package readiness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+	"github.com/godbus/dbus"
+)
+
+const (
+	Interface = "org.cacophony.TC2HatReady"
+	Path      = "/org/cacophony/TC2HatReady"
+	// DefaultTimeout is how long WaitFor waits for the services.
+	DefaultTimeout = 30 * time.Second
+	// How often the files are checked, in case a signal is missed.
+	pollInterval = time.Second
+)
+
+// The hat services.
+const (
+	I2C    = "tc2-hat-i2c"
+	RTC    = "tc2-hat-rtc"
+	ATtiny = "tc2-hat-attiny"
+	Temp   = "tc2-hat-temp"
+	Comms  = "tc2-hat-comms"
+)
+
+// Dir is where the files of the ready services are kept.
+var Dir = "/run/tc2-hat-ready"
+
+var log = logging.NewLogger("info")
+
+// subscribe returns the names of the services as they send the Ready signal, and a function
+// to stop. Replaced in the tests.
+var subscribe = func() (<-chan string, func(), error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, nil, err
+	}
+	rule := fmt.Sprintf("type='signal',interface='%s',member='Ready'", Interface)
+	if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule); call.Err != nil {
+		return nil, nil, call.Err
+	}
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+	names := make(chan string, 10)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case signal := <-signals:
+				if signal.Name != Interface+".Ready" || len(signal.Body) != 1 {
+					continue
+				}
+				if name, ok := signal.Body[0].(string); ok {
+					select {
+					case names <- name:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	stop := func() {
+		conn.RemoveSignal(signals)
+		conn.BusObject().Call("org.freedesktop.DBus.RemoveMatch", 0, rule)
+		close(done)
+	}
+	return names, stop, nil
+}
+
+// emit sends the Ready signal, replaced in the tests.
+var emit = func(service string) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	return conn.Emit(Path, Interface+".Ready", service)
+}
+
+func file(service string) string {
+	return filepath.Join(Dir, service)
+}
+
+// Clear marks the service as not ready, called when it starts so it isn't taken to be ready
+// from when it last ran.
+func Clear(service string) error {
+	err := os.Remove(file(service))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Announce marks the service as ready and tells the services waiting for it.
+func Announce(service string) error {
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return err
+	}
+	tmp := file(service) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file(service)); err != nil {
+		return err
+	}
+	log.Infof("%s is ready", service)
+	return emit(service)
+}
+
+// IsReady returns true if the service has announced it is ready and is still running.
+func IsReady(service string) bool {
+	data, err := os.ReadFile(file(service))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Wait waits up to the timeout for the services to be ready, returning the ones that aren't.
+func Wait(ctx context.Context, timeout time.Duration, services ...string) []string {
+	waiting := map[string]bool{}
+	for _, s := range services {
+		waiting[s] = true
+	}
+	names, stop, err := subscribe()
+	if err != nil {
+		log.Debugf("Not listening for ready signals, checking the files: %v", err)
+	} else {
+		defer stop()
+	}
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		for s := range waiting {
+			if IsReady(s) {
+				delete(waiting, s)
+			}
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+		select {
+		case name := <-names:
+			delete(waiting, name)
+		case <-ticker.C:
+		case <-deadline:
+			return sortedKeys(waiting)
+		case <-ctx.Done():
+			return sortedKeys(waiting)
+		}
+	}
+}
+
+// WaitFor waits up to DefaultTimeout for the services the service depends on, reporting
+// the ones that weren't ready. The service should carry on either way.
+func WaitFor(ctx context.Context, service string, dependencies ...string) {
+	start := time.Now()
+	notReady := Wait(ctx, DefaultTimeout, dependencies...)
+	if len(notReady) == 0 {
+		log.Debugf("Waited %s for %v", time.Since(start).Round(time.Millisecond), dependencies)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	log.Errorf("%v not ready after %s, starting %s anyway", notReady, DefaultTimeout, service)
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.DependencyNotReady, time.Now(), eventhelper.DependencyWait{
+		Service:       service,
+		NotReady:      notReady,
+		WaitedSeconds: int(DefaultTimeout.Seconds()),
+	})); err != nil {
+		log.Errorf("Error adding event: %v", err)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,54 @@
+package readiness
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeBus(t *testing.T) chan string {
+	Dir = t.TempDir()
+	names := make(chan string, 10)
+	subscribe = func() (<-chan string, func(), error) {
+		return names, func() {}, nil
+	}
+	emit = func(service string) error {
+		names <- service
+		return nil
+	}
+	return names
+}
+
+func TestAnnounce(t *testing.T) {
+	fakeBus(t)
+	assert.False(t, IsReady(I2C))
+	assert.NoError(t, Announce(I2C))
+	assert.True(t, IsReady(I2C))
+	assert.Empty(t, Wait(context.Background(), time.Second, I2C))
+	assert.NoError(t, Clear(I2C))
+	assert.False(t, IsReady(I2C))
+	assert.NoError(t, Clear(I2C))
+
+	// A service that has stopped isn't ready.
+	assert.NoError(t, os.WriteFile(filepath.Join(Dir, RTC), []byte("999999999"), 0644))
+	assert.False(t, IsReady(RTC))
+}
+
+func TestWait(t *testing.T) {
+	names := fakeBus(t)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, Announce(RTC))
+		// The signal is enough without the file.
+		names <- I2C
+	}()
+	start := time.Now()
+	assert.Empty(t, Wait(context.Background(), 5*time.Second, I2C, RTC))
+	assert.Less(t, time.Since(start), pollInterval)
+
+	assert.Equal(t, []string{ATtiny}, Wait(context.Background(), 20*time.Millisecond, RTC, ATtiny))
+}
@@ -0,0 +1,115 @@
+package safemode
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+)
+
+// When a service can't read the EEPROM data or config it runs in safe mode with
+// conservative defaults instead of exiting. The services that are in safe mode, and why,
+// are recorded in a file in /var/run so it is reset on reboot and shared between services.
+var (
+	stateFile = "/var/run/tc2-hat-safe-mode.json"
+	lockFile  = "/var/run/tc2-hat-safe-mode.lock"
+)
+
+var log = logging.NewLogger("info")
+
+// Enter records that the service is running in safe mode because of reason.
+func Enter(service, reason string) error {
+	log.Printf("'%s' is running in safe mode: %s", service, reason)
+	return update(func(reasons map[string]string) {
+		reasons[service] = reason
+	})
+}
+
+// Exit records that the service is no longer running in safe mode.
+func Exit(service string) error {
+	return update(func(reasons map[string]string) {
+		delete(reasons, service)
+	})
+}
+
+// Clear takes all services out of safe mode.
+func Clear() error {
+	return update(func(reasons map[string]string) {
+		for service := range reasons {
+			delete(reasons, service)
+		}
+	})
+}
+
+// Reasons returns why each service is in safe mode, it is empty when not in safe mode.
+func Reasons() (map[string]string, error) {
+	var reasons map[string]string
+	err := withLock(func() error {
+		var err error
+		reasons, err = read()
+		return err
+	})
+	return reasons, err
+}
+
+// Active returns true if any service is in safe mode.
+func Active() bool {
+	reasons, err := Reasons()
+	return err == nil && len(reasons) > 0
+}
+
+func update(f func(map[string]string)) error {
+	return withLock(func() error {
+		reasons, err := read()
+		if err != nil {
+			log.Printf("Error reading safe mode state, resetting it: %v", err)
+			reasons = map[string]string{}
+		}
+		f(reasons)
+		if len(reasons) == 0 {
+			err := os.Remove(stateFile)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		data, err := json.Marshal(reasons)
+		if err != nil {
+			return err
+		}
+		tmpFile := stateFile + ".tmp"
+		if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmpFile, stateFile)
+	})
+}
+
+func read() (map[string]string, error) {
+	reasons := map[string]string{}
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return reasons, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &reasons); err != nil {
+		return nil, err
+	}
+	return reasons, nil
+}
+
+func withLock(f func() error) error {
+	lock, err := os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	return f()
+}
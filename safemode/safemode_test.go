@@ -0,0 +1,71 @@
+package safemode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useTestStateFiles(t *testing.T) {
+	dir := t.TempDir()
+	state, lock := stateFile, lockFile
+	stateFile = filepath.Join(dir, "safe-mode.json")
+	lockFile = filepath.Join(dir, "safe-mode.lock")
+	t.Cleanup(func() { stateFile, lockFile = state, lock })
+}
+
+func TestEnterAndExit(t *testing.T) {
+	useTestStateFiles(t)
+	reasons, err := Reasons()
+	assert.NoError(t, err)
+	assert.Empty(t, reasons)
+	assert.False(t, Active())
+
+	assert.NoError(t, Enter("tc2-hat-temp", "config can't be parsed"))
+	assert.NoError(t, Enter("tc2-hat-attiny", "no EEPROM data"))
+	assert.True(t, Active())
+	reasons, err = Reasons()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"tc2-hat-temp":   "config can't be parsed",
+		"tc2-hat-attiny": "no EEPROM data",
+	}, reasons)
+
+	assert.NoError(t, Exit("tc2-hat-temp"))
+	reasons, err = Reasons()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"tc2-hat-attiny": "no EEPROM data"}, reasons)
+
+	// The state file is removed when nothing is in safe mode.
+	assert.NoError(t, Exit("tc2-hat-attiny"))
+	assert.False(t, Active())
+	_, err = os.Stat(stateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestClear(t *testing.T) {
+	useTestStateFiles(t)
+	assert.NoError(t, Enter("tc2-hat-temp", "config can't be parsed"))
+	assert.NoError(t, Enter("tc2-hat-rtc", "no RTC"))
+	assert.NoError(t, Clear())
+	reasons, err := Reasons()
+	assert.NoError(t, err)
+	assert.Empty(t, reasons)
+	assert.NoError(t, Clear())
+}
+
+func TestCorruptState(t *testing.T) {
+	useTestStateFiles(t)
+	assert.NoError(t, os.WriteFile(stateFile, []byte("{not json"), 0644))
+	_, err := Reasons()
+	assert.Error(t, err)
+	assert.False(t, Active())
+
+	// Updating it starts again.
+	assert.NoError(t, Enter("tc2-hat-temp", "config can't be parsed"))
+	reasons, err := Reasons()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"tc2-hat-temp": "config can't be parsed"}, reasons)
+}
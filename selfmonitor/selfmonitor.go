@@ -0,0 +1,242 @@
+// Package selfmonitor watches the health of a long running service from inside it, so a slow
+// leak or a stuck loop is found before the service stops working. The goroutine count and heap
+// are checked every check-interval, and the main loops of the service call Beat each time
+// around so a loop that has stopped is noticed:
+//
+//	[service-health]
+//	enable = true
+//	max-goroutines = 200
+//	max-heap-mb = 64
+//	check-interval = "1m"
+//	restart = false
+//
+// When a limit is passed, or a loop stops, a serviceDegraded event is made. With restart set
+// the service then exits with an error so systemd restarts it. The trend of the goroutines and
+// heap is logged every hour.
+package selfmonitor
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/tc2-hat-controller/configcompat"
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventhelper"
+)
+
+const (
+	ConfigKey = "service-health"
+	// The goroutine and heap limits have to be passed for this many checks in a row, so a
+	// burst of work isn't reported.
+	degradedChecks = 3
+	// A serviceDegraded event is made at most this often when not restarting.
+	eventInterval = 6 * time.Hour
+	trendInterval = time.Hour
+)
+
+var (
+	log = logging.NewLogger("info")
+
+	defaultMonitor atomic.Pointer[Monitor]
+)
+
+// Config is read from the "service-health" section of the config.
+type Config struct {
+	Enable        bool          `mapstructure:"enable"`
+	MaxGoroutines int           `mapstructure:"max-goroutines"`
+	MaxHeapMB     float64       `mapstructure:"max-heap-mb"`
+	CheckInterval time.Duration `mapstructure:"check-interval"`
+	Restart       bool          `mapstructure:"restart"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Enable:        true,
+		MaxGoroutines: 200,
+		MaxHeapMB:     64,
+		CheckInterval: time.Minute,
+	}
+}
+
+// LoadConfig returns the self monitor config, the default config is returned with the error
+// if it can't be read.
+func LoadConfig(config *goconfig.Config) (Config, error) {
+	c := DefaultConfig()
+	if config == nil {
+		return c, nil
+	}
+	if err := configcompat.Unmarshal(config, ConfigKey, &c); err != nil {
+		return DefaultConfig(), err
+	}
+	if c.CheckInterval < time.Second {
+		return DefaultConfig(), fmt.Errorf("%s check-interval must be at least a second", ConfigKey)
+	}
+	if c.MaxGoroutines <= 0 || c.MaxHeapMB <= 0 {
+		return DefaultConfig(), fmt.Errorf("%s max-goroutines and max-heap-mb must be positive", ConfigKey)
+	}
+	return c, nil
+}
+
+// Sample is the resource use of the service.
+type Sample struct {
+	Goroutines int
+	HeapMB     float64
+}
+
+func readSample() Sample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return Sample{
+		Goroutines: runtime.NumGoroutine(),
+		HeapMB:     float64(mem.HeapAlloc) / (1 << 20),
+	}
+}
+
+type loop struct {
+	lastBeat time.Time
+	maxGap   time.Duration
+}
+
+// Monitor checks the health of the service. A nil Monitor doesn't do anything, so it can be
+// used when the self monitor isn't enabled.
+type Monitor struct {
+	service string
+	config  Config
+	sample  func() Sample
+	now     func() time.Time
+	exit    func(code int)
+
+	mu         sync.Mutex
+	loops      map[string]*loop
+	overCount  int
+	lastEvent  time.Time
+	trend      Sample
+	trendStart time.Time
+}
+
+// New returns a monitor for the service, nil if it isn't enabled.
+func New(service string, c Config) *Monitor {
+	if !c.Enable {
+		return nil
+	}
+	return &Monitor{
+		service: service,
+		config:  c,
+		sample:  readSample,
+		now:     time.Now,
+		exit:    os.Exit,
+		loops:   map[string]*loop{},
+	}
+}
+
+// Start starts monitoring the service, and makes it the monitor used by Beat. Nothing is
+// started if the self monitor isn't enabled.
+func Start(service string, c Config) *Monitor {
+	m := New(service, c)
+	if m == nil {
+		return nil
+	}
+	defaultMonitor.Store(m)
+	go m.run()
+	return m
+}
+
+// Beat records that the loop has gone around, it is reported as stopped if it doesn't go
+// around again within maxGap. Safe to call when the self monitor hasn't been started.
+func Beat(name string, maxGap time.Duration) {
+	defaultMonitor.Load().Beat(name, maxGap)
+}
+
+// Beat records that the loop has gone around, it is reported as stopped if it doesn't go
+// around again within maxGap.
+func (m *Monitor) Beat(name string, maxGap time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loops[name] = &loop{lastBeat: m.now(), maxGap: maxGap}
+}
+
+func (m *Monitor) run() {
+	for {
+		time.Sleep(m.config.CheckInterval)
+		m.check()
+	}
+}
+
+// check checks the resources and loops, reporting if the service is degraded.
+func (m *Monitor) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	s := m.sample()
+	m.logTrend(s, now)
+
+	reasons := []string{}
+	if s.Goroutines > m.config.MaxGoroutines {
+		reasons = append(reasons, fmt.Sprintf("%d goroutines is above %d", s.Goroutines, m.config.MaxGoroutines))
+	}
+	if s.HeapMB > m.config.MaxHeapMB {
+		reasons = append(reasons, fmt.Sprintf("heap of %.1fMB is above %.0fMB", s.HeapMB, m.config.MaxHeapMB))
+	}
+	if len(reasons) > 0 {
+		m.overCount++
+	} else {
+		m.overCount = 0
+	}
+	if m.overCount < degradedChecks {
+		reasons = reasons[:0]
+	}
+	stalled := []string{}
+	for name, l := range m.loops {
+		if gap := now.Sub(l.lastBeat); gap > l.maxGap {
+			stalled = append(stalled, fmt.Sprintf("%s loop hasn't run for %s", name, gap.Round(time.Second)))
+		}
+	}
+	sort.Strings(stalled)
+	reasons = append(reasons, stalled...)
+	if len(reasons) == 0 {
+		return
+	}
+
+	restart := m.config.Restart
+	if !restart && !m.lastEvent.IsZero() && now.Sub(m.lastEvent) < eventInterval {
+		return
+	}
+	m.lastEvent = now
+	log.Errorf("Service degraded: %v", reasons)
+	if err := eventhelper.AddEvent(eventhelper.NewEvent(eventhelper.ServiceDegraded, now, eventhelper.ServiceDegradation{
+		Service:    m.service,
+		Reasons:    reasons,
+		Goroutines: s.Goroutines,
+		HeapMB:     s.HeapMB,
+		Restarting: restart,
+	})); err != nil {
+		log.Errorf("Error adding serviceDegraded event: %v", err)
+	}
+	if restart {
+		log.Errorf("Exiting so %s is restarted", m.service)
+		m.exit(1)
+	}
+}
+
+// logTrend logs how the resources have changed over the last trend interval.
+func (m *Monitor) logTrend(s Sample, now time.Time) {
+	if m.trendStart.IsZero() {
+		m.trend, m.trendStart = s, now
+		return
+	}
+	if now.Sub(m.trendStart) < trendInterval {
+		return
+	}
+	log.Infof("Goroutines: %d (%+d), heap: %.1fMB (%+.1fMB) over the last %s",
+		s.Goroutines, s.Goroutines-m.trend.Goroutines, s.HeapMB, s.HeapMB-m.trend.HeapMB, now.Sub(m.trendStart).Round(time.Minute))
+	m.trend, m.trendStart = s, now
+}
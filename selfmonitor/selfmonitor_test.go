@@ -0,0 +1,85 @@
+package selfmonitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eventtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMonitor struct {
+	*Monitor
+	now    time.Time
+	sample Sample
+	events *eventtest.Recorder
+	exited bool
+}
+
+func newFakeMonitor(t *testing.T, c Config) *fakeMonitor {
+	f := &fakeMonitor{
+		Monitor: New("tc2-hat-test", c),
+		now:     time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		sample:  Sample{Goroutines: 10, HeapMB: 5},
+		events:  eventtest.Capture(t),
+	}
+	f.Monitor.now = func() time.Time { return f.now }
+	f.Monitor.sample = func() Sample { return f.sample }
+	f.exit = func(int) { f.exited = true }
+	return f
+}
+
+func TestGoroutineLeak(t *testing.T) {
+	f := newFakeMonitor(t, DefaultConfig())
+	f.check()
+	assert.Empty(t, f.events.Events())
+
+	// Only reported once it has been over the limit for a few checks.
+	f.sample.Goroutines = 500
+	for i := 0; i < degradedChecks-1; i++ {
+		f.now = f.now.Add(time.Minute)
+		f.check()
+	}
+	assert.Empty(t, f.events.Events())
+	f.now = f.now.Add(time.Minute)
+	f.check()
+	if assert.Len(t, f.events.Events(), 1) {
+		assert.Equal(t, "serviceDegraded", f.events.Events()[0].Type)
+		assert.Equal(t, []string{"500 goroutines is above 200"}, f.events.Events()[0].Details["reasons"])
+		assert.Equal(t, false, f.events.Events()[0].Details["restarting"])
+	}
+	assert.False(t, f.exited)
+
+	// Not reported again straight away.
+	f.now = f.now.Add(time.Minute)
+	f.check()
+	assert.Len(t, f.events.Events(), 1)
+}
+
+func TestStalledLoop(t *testing.T) {
+	c := DefaultConfig()
+	c.Restart = true
+	f := newFakeMonitor(t, c)
+	f.Beat("uart", 5*time.Minute)
+	f.now = f.now.Add(4 * time.Minute)
+	f.check()
+	f.Beat("uart", 5*time.Minute)
+	f.now = f.now.Add(5 * time.Minute)
+	f.check()
+	assert.Empty(t, f.events.Events())
+
+	f.now = f.now.Add(time.Minute)
+	f.check()
+	if assert.Len(t, f.events.Events(), 1) {
+		assert.Equal(t, []string{"uart loop hasn't run for 6m0s"}, f.events.Events()[0].Details["reasons"])
+		assert.Equal(t, true, f.events.Events()[0].Details["restarting"])
+	}
+	assert.True(t, f.exited)
+}
+
+func TestDisabled(t *testing.T) {
+	assert.Nil(t, New("tc2-hat-test", Config{}))
+	var m *Monitor
+	m.Beat("uart", time.Minute)
+	Beat("uart", time.Minute)
+}
@@ -0,0 +1,303 @@
+package serialhelper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Serial ownership is arbitrated cooperatively between processes using an owner file.
+// A process holding the serial port has a lease that it needs to keep renewing. If it stops
+// renewing (or the process dies) the lease expires and another process can take it.
+// A process can also force the current owner to release the serial port, the owner will
+// be notified through the Revoked channel of its lease, which is also closed if the lease
+// expires without being renewed.
+var (
+	serialOwnerFile     = "/var/run/tc2-serial-owner.json"
+	serialOwnerLockFile = "/var/run/tc2-serial-owner.lock"
+	leaseCheckInterval  = time.Second
+)
+
+var ErrLeaseNotHeld = errors.New("serial lease is not held")
+
+// SerialOwner describes who currently owns the serial port.
+type SerialOwner struct {
+	Owner   string    `json:"owner"`
+	PID     int       `json:"pid"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (o *SerialOwner) active() bool {
+	if o == nil || o.Token == "" {
+		return false
+	}
+	if time.Now().After(o.Expires) {
+		return false
+	}
+	// Check that the process holding the lease is still running.
+	return syscall.Kill(o.PID, 0) != syscall.ESRCH
+}
+
+// SerialLease is the ownership of the serial port by this process.
+type SerialLease struct {
+	owner   SerialOwner
+	timeout time.Duration
+	mu      sync.Mutex
+	revoked chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup // The goroutines checking and renewing the lease.
+}
+
+// AcquireSerialLease will try to get ownership of the serial port for the given owner name.
+// The lease will expire after timeout unless it is renewed. If the serial port is owned by
+// another process it will wait up to wait for it to be released. If force is true the
+// other owner will be displaced instead and notified that it has lost the serial port.
+func AcquireSerialLease(owner string, timeout, wait time.Duration, force bool) (*SerialLease, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	lease := &SerialLease{
+		owner: SerialOwner{
+			Owner: owner,
+			PID:   os.Getpid(),
+			Token: token,
+		},
+		timeout: timeout,
+		revoked: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	startTime := time.Now()
+	for {
+		acquired, current, err := lease.tryAcquire(force)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+		if time.Since(startTime) > wait {
+			return nil, NewSerialUnavailableError(fmt.Sprintf("serial is owned by '%s' (pid %d)", current.Owner, current.PID))
+		}
+		time.Sleep(leaseCheckInterval)
+	}
+
+	lease.wg.Add(1)
+	go lease.watch()
+	return lease, nil
+}
+
+func (l *SerialLease) tryAcquire(force bool) (bool, *SerialOwner, error) {
+	var current *SerialOwner
+	acquired := false
+	err := withOwnerFileLock(func() error {
+		var err error
+		current, err = readSerialOwner()
+		if err != nil {
+			log.Printf("Error reading serial owner file, ignoring it: %v", err)
+			current = nil
+		}
+		if current.active() && current.Token != l.owner.Token {
+			if !force {
+				return nil
+			}
+			log.Printf("Forcing '%s' (pid %d) to release the serial port for '%s'", current.Owner, current.PID, l.owner.Owner)
+		}
+		l.mu.Lock()
+		l.owner.Expires = time.Now().Add(l.timeout)
+		owner := l.owner
+		l.mu.Unlock()
+		acquired = true
+		return writeSerialOwner(&owner)
+	})
+	return acquired, current, err
+}
+
+// CurrentSerialOwner returns the owner of the serial port, or nil if it is not owned.
+func CurrentSerialOwner() (*SerialOwner, error) {
+	var owner *SerialOwner
+	err := withOwnerFileLock(func() error {
+		var err error
+		owner, err = readSerialOwner()
+		return err
+	})
+	if err != nil || !owner.active() {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// Renew extends the lease by its timeout.
+func (l *SerialLease) Renew() error {
+	return withOwnerFileLock(func() error {
+		current, err := readSerialOwner()
+		if err != nil {
+			return err
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if current == nil || current.Token != l.owner.Token {
+			return ErrLeaseNotHeld
+		}
+		l.owner.Expires = time.Now().Add(l.timeout)
+		return writeSerialOwner(&l.owner)
+	})
+}
+
+// KeepAlive renews the lease until it is released or revoked.
+func (l *SerialLease) KeepAlive() {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(l.timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-l.revoked:
+				return
+			case <-ticker.C:
+				if err := l.Renew(); err != nil {
+					log.Printf("Error renewing serial lease for '%s': %v", l.owner.Owner, err)
+				}
+			}
+		}
+	}()
+}
+
+// Valid returns true if this lease still owns the serial port.
+func (l *SerialLease) Valid() bool {
+	select {
+	case <-l.revoked:
+		return false
+	case <-l.done:
+		return false
+	default:
+	}
+	current, err := CurrentSerialOwner()
+	if err != nil || current == nil {
+		return false
+	}
+	return current.Token == l.owner.Token
+}
+
+// Revoked is closed when another process has taken the serial port from this lease, or the
+// lease has expired.
+func (l *SerialLease) Revoked() <-chan struct{} {
+	return l.revoked
+}
+
+// Release gives up ownership of the serial port.
+func (l *SerialLease) Release() error {
+	l.once.Do(func() { close(l.done) })
+	l.wg.Wait()
+	return withOwnerFileLock(func() error {
+		current, err := readSerialOwner()
+		if err != nil {
+			return err
+		}
+		if current == nil || current.Token != l.owner.Token {
+			return nil
+		}
+		return os.Remove(serialOwnerFile)
+	})
+}
+
+// watch checks if the lease has been taken by another process or has expired, and notifies
+// the holder.
+func (l *SerialLease) watch() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		var current *SerialOwner
+		err := withOwnerFileLock(func() error {
+			var err error
+			current, err = readSerialOwner()
+			return err
+		})
+		if err != nil {
+			continue
+		}
+		switch {
+		case current == nil:
+			log.Printf("Serial lease for '%s' was removed", l.owner.Owner)
+		case current.Token != l.owner.Token:
+			log.Printf("Serial port was taken from '%s' by '%s' (pid %d)", l.owner.Owner, current.Owner, current.PID)
+		case time.Now().After(current.Expires):
+			log.Printf("Serial lease for '%s' expired at %s", l.owner.Owner, current.Expires.Format(time.RFC3339))
+		default:
+			continue
+		}
+		select {
+		case <-l.done:
+			// Released while it was being checked.
+		default:
+			close(l.revoked)
+		}
+		return
+	}
+}
+
+func withOwnerFileLock(f func() error) error {
+	lockFile, err := os.OpenFile(serialOwnerLockFile, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+	return f()
+}
+
+func readSerialOwner() (*SerialOwner, error) {
+	data, err := os.ReadFile(serialOwnerFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	owner := &SerialOwner{}
+	if err := json.Unmarshal(data, owner); err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+func writeSerialOwner(owner *SerialOwner) error {
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	tmpFile := serialOwnerFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, serialOwnerFile)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,139 @@
+package serialhelper
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useTestOwnerFiles(t *testing.T) {
+	dir := t.TempDir()
+	file, lockFile, interval := serialOwnerFile, serialOwnerLockFile, leaseCheckInterval
+	serialOwnerFile = filepath.Join(dir, "owner.json")
+	serialOwnerLockFile = filepath.Join(dir, "owner.lock")
+	leaseCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		serialOwnerFile, serialOwnerLockFile, leaseCheckInterval = file, lockFile, interval
+	})
+}
+
+func revoked(l *SerialLease) bool {
+	select {
+	case <-l.Revoked():
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestAcquireSerialLease(t *testing.T) {
+	useTestOwnerFiles(t)
+	owner, err := CurrentSerialOwner()
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+
+	lease, err := AcquireSerialLease("comms", time.Minute, 0, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, lease.Valid())
+	owner, err = CurrentSerialOwner()
+	assert.NoError(t, err)
+	if assert.NotNil(t, owner) {
+		assert.Equal(t, "comms", owner.Owner)
+	}
+	assert.NoError(t, lease.Renew())
+
+	assert.NoError(t, lease.Release())
+	assert.False(t, lease.Valid())
+	owner, err = CurrentSerialOwner()
+	assert.NoError(t, err)
+	assert.Nil(t, owner)
+	assert.ErrorIs(t, lease.Renew(), ErrLeaseNotHeld)
+}
+
+func TestSerialLeaseContention(t *testing.T) {
+	useTestOwnerFiles(t)
+	first, err := AcquireSerialLease("comms", time.Minute, 0, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer first.Release()
+
+	_, err = AcquireSerialLease("attiny", time.Minute, 0, false)
+	unavailable := &SerialUnavailableError{}
+	assert.True(t, errors.As(err, &unavailable), err)
+	assert.True(t, first.Valid())
+
+	// Released while waiting for it.
+	released := make(chan error)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		released <- first.Release()
+	}()
+	second, err := AcquireSerialLease("attiny", time.Minute, 5*time.Second, false)
+	assert.NoError(t, <-released)
+	if assert.NoError(t, err) {
+		assert.True(t, second.Valid())
+		second.Release()
+	}
+}
+
+func TestSerialLeaseExpiry(t *testing.T) {
+	useTestOwnerFiles(t)
+	lease, err := AcquireSerialLease("comms", 50*time.Millisecond, 0, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer lease.Release()
+	assert.True(t, revoked(lease), "expired lease wasn't revoked")
+	assert.False(t, lease.Valid())
+
+	// Another owner can take it without forcing it.
+	other, err := AcquireSerialLease("attiny", time.Minute, 0, false)
+	if assert.NoError(t, err) {
+		assert.True(t, other.Valid())
+		other.Release()
+	}
+}
+
+func TestSerialLeaseKeepAlive(t *testing.T) {
+	useTestOwnerFiles(t)
+	lease, err := AcquireSerialLease("comms", 100*time.Millisecond, 0, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer lease.Release()
+	lease.KeepAlive()
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, lease.Valid())
+}
+
+func TestSerialLeaseTakeover(t *testing.T) {
+	useTestOwnerFiles(t)
+	first, err := AcquireSerialLease("comms", time.Minute, 0, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer first.Release()
+
+	second, err := AcquireSerialLease("attiny", time.Minute, 0, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer second.Release()
+	assert.True(t, revoked(first), "displaced lease wasn't revoked")
+	assert.False(t, first.Valid())
+	assert.True(t, second.Valid())
+
+	// Releasing the displaced lease leaves the new owner alone.
+	assert.NoError(t, first.Release())
+	owner, err := CurrentSerialOwner()
+	assert.NoError(t, err)
+	if assert.NotNil(t, owner) {
+		assert.Equal(t, "attiny", owner.Owner)
+	}
+}
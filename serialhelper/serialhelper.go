@@ -153,8 +153,14 @@ func ReleaseSerial(serialFile *os.File) error {
 	return syscall.Flock(int(serialFile.Fd()), syscall.LOCK_UN)
 }
 
+const DefaultBaudRate = 9600
+
 func SerialSendReceive(retries int, mul0, mul1 gpio.Level, wait time.Duration, data []byte) ([]byte, error) {
+	return SerialSendReceiveBaud(retries, mul0, mul1, wait, DefaultBaudRate, data)
+}
 
+// SerialSendReceiveBaud is the same as SerialSendReceive but with the baud rate set.
+func SerialSendReceiveBaud(retries int, mul0, mul1 gpio.Level, wait time.Duration, baud int, data []byte) ([]byte, error) {
 	serialFile, err := GetSerial(retries, mul0, mul1, wait)
 	if err != nil {
 		return nil, err
@@ -162,7 +168,7 @@ func SerialSendReceive(retries int, mul0, mul1 gpio.Level, wait time.Duration, d
 
 	defer ReleaseSerial(serialFile)
 
-	c := &serial.Config{Name: "/dev/serial0", Baud: 9600, ReadTimeout: time.Second * 5}
+	c := &serial.Config{Name: "/dev/serial0", Baud: baud, ReadTimeout: time.Second * 5}
 	serialPort, err := serial.OpenPort(c)
 	if err != nil {
 		return nil, err
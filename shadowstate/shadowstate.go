@@ -0,0 +1,243 @@
+// Package shadowstate keeps a copy of the state the hat services have learned on the boot
+// partition of the SD card. The rootfs is sometimes re-flashed in the field, which loses the
+// battery profile, calibration and pairing saved in /etc/cacophony, but the boot partition is
+// kept. The copy is one small JSON file:
+//
+//	/boot/firmware/tc2-hat-shadow.json
+//
+// It has the contents of each state file with when it was last changed and a checksum. The
+// boot partition is FAT and is less robust to losing power part way through a write, so the
+// shadow is only written when a file has changed. Files are only restored when they are
+// missing from the rootfs, so state learned since the shadow was written is never replaced.
+package shadowstate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	FileName = "tc2-hat-shadow.json"
+	version  = 1
+	// Files bigger than this aren't shadowed, the shadow is for small state files.
+	maxFileSize = 64 * 1024
+)
+
+// BootDirs are where the boot partition can be mounted, newer versions of Raspberry Pi OS
+// mount it at /boot/firmware.
+var BootDirs = []string{"/boot/firmware", "/boot"}
+
+// Files are the state files that are shadowed. These need to match the paths in the services.
+var Files = []string{
+	"/etc/cacophony/battery_state.json",         // Learned battery profile.
+	"/etc/cacophony/hardware-pairing.json",      // Device and hat IDs.
+	"/etc/cacophony/eeprom-data.json",           // Hat hardware versions and ID.
+	"/etc/cacophony/rtc-temp-compensation.json", // RTC calibration.
+	"/etc/cacophony/species-corrections.json",   // Classifier calibration.
+}
+
+// shadowFile is the copy of one state file.
+type shadowFile struct {
+	Data     []byte    `json:"data"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256"`
+}
+
+type shadow struct {
+	Version int                   `json:"version"`
+	Updated time.Time             `json:"updated"`
+	Files   map[string]shadowFile `json:"files"`
+}
+
+// Store is the shadow file on the boot partition.
+type Store struct {
+	path string
+}
+
+// New returns the store for the shadow file at the path.
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+// Find returns the store on the boot partition, the first of BootDirs with a config.txt.
+func Find() (*Store, error) {
+	for _, dir := range BootDirs {
+		if _, err := os.Stat(filepath.Join(dir, "config.txt")); err == nil {
+			return New(filepath.Join(dir, FileName)), nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find the boot partition in %v", BootDirs)
+}
+
+// Path returns the path of the shadow file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+func (s *Store) load() (shadow, error) {
+	sh := shadow{Version: version, Files: map[string]shadowFile{}}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sh, nil
+	} else if err != nil {
+		return sh, err
+	}
+	if err := json.Unmarshal(data, &sh); err != nil {
+		return sh, fmt.Errorf("failed to parse '%s': %v", s.path, err)
+	}
+	if sh.Version > version {
+		return sh, fmt.Errorf("'%s' is version %d, newer than supported version %d", s.path, sh.Version, version)
+	}
+	if sh.Files == nil {
+		sh.Files = map[string]shadowFile{}
+	}
+	return sh, nil
+}
+
+func (s *Store) save(sh shadow) error {
+	data, err := json.MarshalIndent(sh, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.path, data, time.Time{})
+}
+
+// Sync copies the files that have changed since the last sync into the shadow, returning the
+// files that were copied. Files that are missing are left in the shadow so they can still be
+// restored.
+func (s *Store) Sync(files []string, now time.Time) ([]string, error) {
+	sh, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	updated := []string{}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return updated, err
+		}
+		if info.Size() > maxFileSize {
+			return updated, fmt.Errorf("'%s' is too big to shadow, %d bytes", file, info.Size())
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return updated, err
+		}
+		sum := checksum(data)
+		if old, ok := sh.Files[file]; ok && old.SHA256 == sum {
+			continue
+		}
+		sh.Files[file] = shadowFile{Data: data, Modified: info.ModTime().UTC(), SHA256: sum}
+		updated = append(updated, file)
+	}
+	if len(updated) == 0 {
+		return updated, nil
+	}
+	sh.Version = version
+	sh.Updated = now.UTC()
+	return updated, s.save(sh)
+}
+
+// Restore writes back the files that are missing from the rootfs but are in the shadow,
+// returning the files that were restored. The files are given the time they were modified
+// when they were shadowed, so the age of the state isn't lost.
+func (s *Store) Restore(files []string) ([]string, error) {
+	sh, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	restored := []string{}
+	for _, file := range files {
+		f, ok := sh.Files[file]
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if checksum(f.Data) != f.SHA256 {
+			return restored, fmt.Errorf("shadow of '%s' is corrupt", file)
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return restored, err
+		}
+		if err := writeFile(file, f.Data, f.Modified); err != nil {
+			return restored, err
+		}
+		restored = append(restored, file)
+	}
+	return restored, nil
+}
+
+// FileStatus is how a state file compares to its shadow.
+type FileStatus struct {
+	File     string    `json:"file"`
+	OnDisk   bool      `json:"onDisk"`
+	Shadowed bool      `json:"shadowed"`
+	Same     bool      `json:"same"`
+	Modified time.Time `json:"modified,omitempty"` // When the shadowed copy was modified.
+}
+
+// Status returns how each of the files compares to its shadow, sorted by file.
+func (s *Store) Status(files []string) ([]FileStatus, error) {
+	sh, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []FileStatus{}
+	for _, file := range files {
+		status := FileStatus{File: file}
+		data, err := os.ReadFile(file)
+		status.OnDisk = err == nil
+		if f, ok := sh.Files[file]; ok {
+			status.Shadowed = true
+			status.Modified = f.Modified
+			status.Same = status.OnDisk && bytes.Equal(data, f.Data)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].File < statuses[j].File })
+	return statuses, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFile writes the file through a temporary file so a partly written file is never left,
+// setting the modified time if it isn't zero.
+func writeFile(path string, data []byte, modified time.Time) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if !modified.IsZero() {
+		if err := os.Chtimes(tmp, modified, modified); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
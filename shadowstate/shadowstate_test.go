@@ -0,0 +1,84 @@
+package shadowstate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	battery := filepath.Join(dir, "etc", "battery_state.json")
+	pairing := filepath.Join(dir, "etc", "hardware-pairing.json")
+	missing := filepath.Join(dir, "etc", "missing.json")
+	files := []string{battery, pairing, missing}
+	assert.NoError(t, os.MkdirAll(filepath.Dir(battery), 0755))
+	assert.NoError(t, os.WriteFile(battery, []byte(`{"chemistry":"li-ion"}`), 0644))
+	assert.NoError(t, os.WriteFile(pairing, []byte(`{"deviceID":1234}`), 0644))
+	modified := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(battery, modified, modified))
+
+	store := New(filepath.Join(dir, "boot", FileName))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(store.Path()), 0755))
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	updated, err := store.Sync(files, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{battery, pairing}, updated)
+
+	// Nothing has changed so the shadow isn't written again.
+	updated, err = store.Sync(files, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, updated)
+	sh, err := store.load()
+	assert.NoError(t, err)
+	assert.Equal(t, now, sh.Updated)
+
+	// After a re-image the files are gone, the pairing has already been saved again.
+	assert.NoError(t, os.RemoveAll(filepath.Dir(battery)))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(battery), 0755))
+	assert.NoError(t, os.WriteFile(pairing, []byte(`{"deviceID":5678}`), 0644))
+	restored, err := store.Restore(files)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{battery}, restored)
+	data, err := os.ReadFile(battery)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"chemistry":"li-ion"}`, string(data))
+	info, err := os.Stat(battery)
+	assert.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(modified))
+	data, err = os.ReadFile(pairing)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"deviceID":5678}`, string(data))
+
+	statuses, err := store.Status(files)
+	assert.NoError(t, err)
+	assert.Equal(t, []FileStatus{
+		{File: battery, OnDisk: true, Shadowed: true, Same: true, Modified: modified},
+		{File: pairing, OnDisk: true, Shadowed: true, Same: false, Modified: sh.Files[pairing].Modified},
+		{File: missing},
+	}, statuses)
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "battery_state.json")
+	store := New(filepath.Join(dir, FileName))
+	assert.NoError(t, store.save(shadow{Version: version, Files: map[string]shadowFile{
+		file: {Data: []byte("{}"), SHA256: checksum([]byte("{\"bad\"}"))},
+	}}))
+	_, err := store.Restore([]string{file})
+	assert.Error(t, err)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNewerVersion(t *testing.T) {
+	dir := t.TempDir()
+	store := New(filepath.Join(dir, FileName))
+	assert.NoError(t, os.WriteFile(store.Path(), []byte(`{"version":2,"files":{}}`), 0644))
+	_, err := store.Sync(nil, time.Now())
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package simulator
+
+import (
+	"errors"
+	"math"
+
+	"github.com/sigurn/crc8"
+)
+
+const (
+	aht20Address      = 0x38
+	aht20StatusReg    = 0x71
+	aht20TriggerReg   = 0xAC
+	aht20Calibrated   = 0x18
+	aht20MeanTemp     = 15.0 // Average temperature over the day in °C.
+	aht20TempRange    = 8.0  // How far the temperature goes either side of the mean.
+	aht20MeanHumidity = 60.0
+	aht20HumRange     = 20.0
+)
+
+var aht20CRCTable = crc8.MakeTable(crc8.Params{
+	Poly:   0x31,
+	Init:   0xFF,
+	RefIn:  false,
+	RefOut: false,
+	XorOut: 0x00,
+})
+
+// aht20 simulates the temperature and humidity sensor. The temperature follows a daily
+// cycle, being warmest at 3pm, with the humidity going the opposite way.
+type aht20 struct {
+	clock *Clock
+}
+
+func newAHT20(clock *Clock) *aht20 {
+	return &aht20{clock: clock}
+}
+
+func (s *aht20) reading() (temp, humidity float64) {
+	now := s.clock.Now()
+	hour := float64(now.Hour()) + float64(now.Minute())/60
+	cycle := math.Cos((hour - 15) / 24 * 2 * math.Pi)
+	return aht20MeanTemp + aht20TempRange*cycle, aht20MeanHumidity - aht20HumRange*cycle
+}
+
+func (s *aht20) tx(w, r []byte) error {
+	if len(w) == 0 {
+		return errors.New("no data written")
+	}
+	switch w[0] {
+	case aht20TriggerReg:
+		return nil
+	case aht20StatusReg:
+		if len(r) == 0 {
+			return nil
+		}
+		r[0] = aht20Calibrated
+		if len(r) < 7 {
+			return nil
+		}
+		temp, humidity := s.reading()
+		humidityRaw := uint32(humidity / 100 * (1 << 20))
+		tempRaw := uint32((temp + 50) / 200 * (1 << 20))
+		r[1] = byte(humidityRaw >> 12)
+		r[2] = byte(humidityRaw >> 4)
+		r[3] = byte(humidityRaw<<4) | byte(tempRaw>>16&0x0F)
+		r[4] = byte(tempRaw >> 8)
+		r[5] = byte(tempRaw)
+		r[6] = crc8.Checksum(r[:6], aht20CRCTable)
+		return nil
+	}
+	return errors.New("unknown command")
+}
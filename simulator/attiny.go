@@ -0,0 +1,108 @@
+package simulator
+
+import (
+	"errors"
+	"math"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+)
+
+const attinyVref = 3.3
+
+// Resistor dividers for the power PCB version in the simulated EEPROM.
+const (
+	lvDividerR1  = 2000
+	lvDividerR2  = 470
+	rtcDividerR1 = 0
+	rtcDividerR2 = 1
+)
+
+type attiny struct {
+	config Config
+	clock  *Clock
+	regs   [256]byte
+}
+
+func newATtiny(config Config, clock *Clock) *attiny {
+	a := &attiny{config: config, clock: clock}
+	a.regs[attinyclient.TypeReg] = attinyclient.TypeVal
+	a.regs[attinyclient.MajorVersionReg] = config.ATtinyMajor
+	a.regs[attinyclient.MinorVersionReg] = config.ATtinyMinor
+	a.regs[attinyclient.PatchVersionReg] = config.ATtinyPatch
+	// Act like the RP2040 wants the RPi to stay on so the simulation doesn't power off.
+	a.regs[attinyclient.RP2040PiPowerCtrlReg] = 0x01
+	return a
+}
+
+// batteryVoltage is the voltage of the battery on the LV rail at the current virtual time.
+func (a *attiny) batteryVoltage() float32 {
+	hours := float32(a.clock.Elapsed().Hours())
+	v := a.config.BatteryVoltage - hours*a.config.BatteryDrainPerHour
+	return float32(math.Max(float64(v), float64(a.config.BatteryEmptyVoltage)))
+}
+
+func adcReading(voltage, r1, r2 float32) uint16 {
+	raw := voltage * r2 / (r1 + r2) / attinyVref * 1023
+	return uint16(math.Min(math.Round(float64(raw)), 1023))
+}
+
+func (a *attiny) tx(w, r []byte) error {
+	if len(w) == 0 {
+		return errors.New("no data written")
+	}
+	// Transactions without a CRC are just used to check the device is on the bus.
+	if len(w) < 3 {
+		for i := range r {
+			r[i] = a.regs[int(w[0])+i]
+		}
+		return nil
+	}
+
+	data := w[:len(w)-2]
+	crc := uint16(w[len(w)-2])<<8 | uint16(w[len(w)-1])
+	if i2crequest.CalculateCRC(data) != crc {
+		return errors.New("bad CRC")
+	}
+	reg := data[0]
+	if len(data) > 1 {
+		a.write(reg, data[1])
+	}
+	if len(r) > 0 {
+		if len(r) < 3 {
+			return errors.New("read too short for CRC")
+		}
+		n := len(r) - 2
+		for i := 0; i < n; i++ {
+			r[i] = a.regs[int(reg)+i]
+		}
+		respCRC := i2crequest.CalculateCRC(r[:n])
+		r[n] = byte(respCRC >> 8)
+		r[n+1] = byte(respCRC & 0xFF)
+	}
+	return nil
+}
+
+func (a *attiny) write(reg, val byte) {
+	startReading := val&attinyclient.AnalogReadingStart != 0
+	switch r := attinyclient.Register(reg); {
+	case r == attinyclient.ClearErrorReg:
+		for i := 0; i < attinyclient.ErrorRegisters; i++ {
+			a.regs[int(attinyclient.Errors1Reg)+i] = 0
+		}
+	case r == attinyclient.BatteryLVDivVal1Reg && startReading:
+		a.setAnalogReading(reg, adcReading(a.batteryVoltage(), lvDividerR1, lvDividerR2))
+	case r == attinyclient.BatteryHVDivVal1Reg && startReading:
+		// Only the LV rail has a battery on it.
+		a.setAnalogReading(reg, 0)
+	case r == attinyclient.RTCBattery1Reg && startReading:
+		a.setAnalogReading(reg, adcReading(a.config.RTCBatteryVoltage, rtcDividerR1, rtcDividerR2))
+	default:
+		a.regs[reg] = val
+	}
+}
+
+func (a *attiny) setAnalogReading(reg byte, val uint16) {
+	a.regs[reg] = byte(val >> 8)
+	a.regs[reg+1] = byte(val & 0xFF)
+}
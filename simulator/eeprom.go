@@ -0,0 +1,41 @@
+package simulator
+
+import (
+	"errors"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/eeprom"
+)
+
+const eepromAddress = eeprom.EEPROM_ADDRESS
+
+// eepromDevice simulates the EEPROM with the hardware versions of a 0.7.0 power PCB.
+type eepromDevice struct {
+	data []byte
+}
+
+func newEEPROM() *eepromDevice {
+	e := &eeprom.EepromDataV2{
+		Version:  2,
+		MainPCB:  eeprom.SemVer{Major: 0, Minor: 2, Patch: 0},
+		PowerPCB: eeprom.SemVer{Major: 0, Minor: 7, Patch: 0},
+		ID:       eeprom.GenerateRandomID(),
+		Time:     time.Now().Truncate(time.Second),
+	}
+	return &eepromDevice{data: e.WriteData()}
+}
+
+func (e *eepromDevice) tx(w, r []byte) error {
+	if len(w) != 1 {
+		return errors.New("simulated EEPROM is read only")
+	}
+	for i := range r {
+		addr := int(w[0]) + i
+		if addr < len(e.data) {
+			r[i] = e.data[addr]
+		} else {
+			r[i] = 0xFF
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package simulator
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	pcf8563Address  = 0x51
+	pcf8563TimeReg  = 0x02
+	pcf8563TimeRegs = 7
+)
+
+// pcf8563 simulates the RTC. The time is kept as an offset from the virtual clock so it
+// keeps running at the simulation speed, the other registers are just stored.
+type pcf8563 struct {
+	clock  *Clock
+	offset time.Duration
+	regs   [16]byte
+}
+
+func newPCF8563(clock *Clock) *pcf8563 {
+	return &pcf8563{clock: clock}
+}
+
+func (p *pcf8563) tx(w, r []byte) error {
+	if len(w) == 0 {
+		return errors.New("no data written")
+	}
+	reg := int(w[0])
+	if len(w) > 1 {
+		p.write(reg, w[1:])
+	}
+	if len(r) > 0 {
+		regs := p.regs
+		p.putTime(regs[:])
+		for i := range r {
+			r[i] = regs[(reg+i)%len(regs)]
+		}
+	}
+	return nil
+}
+
+func (p *pcf8563) write(reg int, data []byte) {
+	regs := p.regs
+	p.putTime(regs[:])
+	for i, b := range data {
+		regs[(reg+i)%len(regs)] = b
+	}
+	if reg < pcf8563TimeReg+pcf8563TimeRegs && reg+len(data) > pcf8563TimeReg {
+		t := time.Date(
+			2000+fromBCD(regs[8]),
+			time.Month(fromBCD(regs[7]&0x1F)),
+			fromBCD(regs[5]&0x3F),
+			fromBCD(regs[4]&0x3F),
+			fromBCD(regs[3]&0x7F),
+			fromBCD(regs[2]&0x7F),
+			0, time.UTC)
+		p.offset = t.Sub(p.clock.Now().Truncate(time.Second))
+	}
+	// The time registers are generated from the clock so are not stored.
+	for i := pcf8563TimeReg; i < pcf8563TimeReg+pcf8563TimeRegs; i++ {
+		regs[i] = 0
+	}
+	p.regs = regs
+}
+
+// putTime writes the current RTC time into the time registers in BCD.
+func (p *pcf8563) putTime(regs []byte) {
+	t := p.clock.Now().Add(p.offset).UTC()
+	regs[2] = toBCD(t.Second())
+	regs[3] = toBCD(t.Minute())
+	regs[4] = toBCD(t.Hour())
+	regs[5] = toBCD(t.Day())
+	regs[6] = toBCD(int(t.Weekday()))
+	regs[7] = toBCD(int(t.Month()))
+	regs[8] = toBCD(t.Year() % 100)
+}
+
+func toBCD(n int) byte {
+	return byte(n/10<<4 | n%10)
+}
+
+func fromBCD(b byte) int {
+	return int(b&0x0F) + int(b>>4)*10
+}
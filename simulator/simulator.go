@@ -0,0 +1,110 @@
+// Package simulator simulates the I2C devices on the TC2 hat so the hat services can be run
+// without the hardware. The simulated bus is used by the i2c service in place of the real
+// bus, so the other services talk to it over dbus in the same way as on a device.
+package simulator
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/go-utils/logging"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"periph.io/x/conn/v3/physic"
+)
+
+var log = logging.NewLogger("info")
+
+// Config is the setup of the simulated hardware.
+type Config struct {
+	Speed               float64 // How much faster the virtual clock runs than real time.
+	ATtinyMajor         uint8
+	ATtinyMinor         uint8
+	ATtinyPatch         uint8
+	BatteryVoltage      float32 // Starting voltage of the battery on the LV rail.
+	BatteryEmptyVoltage float32
+	BatteryDrainPerHour float32 // Volts the battery drops per (virtual) hour.
+	RTCBatteryVoltage   float32
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Speed:               1,
+		ATtinyMajor:         1,
+		BatteryVoltage:      12.6,
+		BatteryEmptyVoltage: 9.6,
+		BatteryDrainPerHour: 0.02,
+		RTCBatteryVoltage:   3.0,
+	}
+}
+
+// Clock is a virtual clock that can run faster than real time.
+type Clock struct {
+	start     time.Time
+	realStart time.Time
+	speed     float64
+}
+
+func NewClock(start time.Time, speed float64) *Clock {
+	return &Clock{start: start, realStart: time.Now(), speed: speed}
+}
+
+func (c *Clock) Now() time.Time {
+	elapsed := time.Since(c.realStart)
+	return c.start.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+// Elapsed returns how much virtual time has passed.
+func (c *Clock) Elapsed() time.Duration {
+	return c.Now().Sub(c.start)
+}
+
+type device interface {
+	tx(w, r []byte) error
+}
+
+// Bus is a simulated I2C bus with the TC2 hat devices on it.
+type Bus struct {
+	mu      sync.Mutex
+	clock   *Clock
+	devices map[uint16]device
+}
+
+func NewBus(config Config) *Bus {
+	clock := NewClock(time.Now(), config.Speed)
+	return &Bus{
+		clock: clock,
+		devices: map[uint16]device{
+			attinyclient.Address: newATtiny(config, clock),
+			aht20Address:         newAHT20(clock),
+			eepromAddress:        newEEPROM(),
+			pcf8563Address:       newPCF8563(clock),
+		},
+	}
+}
+
+func (b *Bus) String() string {
+	return "simulated-i2c"
+}
+
+func (b *Bus) Tx(addr uint16, w, r []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, ok := b.devices[addr]
+	if !ok {
+		return fmt.Errorf("no device at address 0x%X", addr)
+	}
+	if err := d.tx(w, r); err != nil {
+		log.Debugf("Simulated Tx to 0x%X failed: %v", addr, err)
+		return err
+	}
+	return nil
+}
+
+func (b *Bus) SetSpeed(f physic.Frequency) error {
+	return nil
+}
+
+func (b *Bus) Close() error {
+	return nil
+}
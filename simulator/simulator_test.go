@@ -0,0 +1,73 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/tc2-hat-controller/i2crequest"
+	attinyclient "github.com/TheCacophonyProject/tc2-hat-controller/pkg/attiny"
+	"github.com/stretchr/testify/assert"
+)
+
+func withCRC(data ...byte) []byte {
+	crc := i2crequest.CalculateCRC(data)
+	return append(data, byte(crc>>8), byte(crc&0xFF))
+}
+
+func TestATtinyReadWithCRC(t *testing.T) {
+	bus := NewBus(DefaultConfig())
+	r := make([]byte, 3)
+	assert.NoError(t, bus.Tx(attinyclient.Address, withCRC(byte(attinyclient.TypeReg)), r))
+	assert.Equal(t, byte(attinyclient.TypeVal), r[0])
+	assert.Equal(t, i2crequest.CalculateCRC(r[:1]), uint16(r[1])<<8|uint16(r[2]))
+
+	assert.Error(t, bus.Tx(attinyclient.Address, []byte{byte(attinyclient.TypeReg), 0x00, 0x00}, r))
+}
+
+func TestATtinyBatteryReading(t *testing.T) {
+	config := DefaultConfig()
+	bus := NewBus(config)
+	assert.NoError(t, bus.Tx(attinyclient.Address, withCRC(byte(attinyclient.BatteryLVDivVal1Reg), attinyclient.AnalogReadingStart), nil))
+	r := make([]byte, 4)
+	assert.NoError(t, bus.Tx(attinyclient.Address, withCRC(byte(attinyclient.BatteryLVDivVal1Reg)), r))
+	assert.Zero(t, r[0]&attinyclient.AnalogReadingStart)
+	raw := uint16(r[0])<<8 | uint16(r[1])
+	voltage := float32(raw) * attinyVref / 1023 * (lvDividerR1 + lvDividerR2) / lvDividerR2
+	assert.InDelta(t, config.BatteryVoltage, voltage, 0.05)
+}
+
+func TestAHT20Reading(t *testing.T) {
+	bus := NewBus(DefaultConfig())
+	assert.NoError(t, bus.Tx(aht20Address, []byte{aht20TriggerReg, 0x33, 0x00}, nil))
+	r := make([]byte, 7)
+	assert.NoError(t, bus.Tx(aht20Address, []byte{aht20StatusReg}, r))
+	assert.Equal(t, byte(aht20Calibrated), r[0]&aht20Calibrated)
+
+	tempRaw := uint32(r[3]&0x0F)<<16 | uint32(r[4])<<8 | uint32(r[5])
+	temp := float64(tempRaw)/float64(1<<20)*200 - 50
+	assert.InDelta(t, aht20MeanTemp, temp, aht20TempRange+0.1)
+}
+
+func TestRTCSetAndRead(t *testing.T) {
+	clock := NewClock(time.Now(), 1)
+	rtc := newPCF8563(clock)
+	want := time.Date(2024, time.March, 5, 13, 45, 30, 0, time.UTC)
+	assert.NoError(t, rtc.tx([]byte{pcf8563TimeReg,
+		toBCD(want.Second()), toBCD(want.Minute()), toBCD(want.Hour()), toBCD(want.Day()),
+		toBCD(int(want.Weekday())), toBCD(int(want.Month())), toBCD(want.Year() % 100)}, nil))
+
+	r := make([]byte, pcf8563TimeRegs)
+	assert.NoError(t, rtc.tx([]byte{pcf8563TimeReg}, r))
+	got := time.Date(2000+fromBCD(r[6]), time.Month(fromBCD(r[5]&0x1F)), fromBCD(r[3]&0x3F),
+		fromBCD(r[2]&0x3F), fromBCD(r[1]&0x7F), fromBCD(r[0]&0x7F), 0, time.UTC)
+	assert.WithinDuration(t, want, got, 2*time.Second)
+	assert.Zero(t, r[0]&0x80, "integrity flag should be clear")
+}
+
+func TestEEPROMData(t *testing.T) {
+	bus := NewBus(DefaultConfig())
+	r := make([]byte, 16)
+	assert.NoError(t, bus.Tx(eepromAddress, []byte{0}, r))
+	assert.Equal(t, []byte{0xCA, 2}, r[:2])
+	assert.Equal(t, []byte{0, 7, 0}, r[5:8])
+}
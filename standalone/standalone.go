@@ -0,0 +1,122 @@
+// Package standalone is the datalogger mode, for running the hat services on a bare RPi image
+// without the event-reporter, the management services or /etc/cacophony/config.toml. It is on
+// when there is a config.toml in ConfigDir, which the services then use for their config
+// instead of the one in /etc/cacophony:
+//
+//	[standalone]
+//	data-dir = "/var/lib/tc2-hat"
+//
+// The readings are still written to their CSV files, but events are appended to events.jsonl
+// in the data dir instead of being sent to the event-reporter, and nothing is sent to the
+// journal or the live feed. tc2-hat-i2c still needs its D-Bus service as that is how the other
+// services get to the I2C bus, the others keep logging without theirs if it can't be started
+// and don't use the services that aren't part of the hat.
+package standalone
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	goconfig "github.com/TheCacophonyProject/go-config"
+)
+
+const (
+	ConfigDir      = "/etc/tc2-hat"
+	ConfigKey      = "standalone"
+	DefaultDataDir = "/var/lib/tc2-hat"
+
+	EventsFileName = "events.jsonl"
+	// The events file is moved to events.jsonl.1 when it gets this big, replacing the last one.
+	maxEventsFileSize = 10 * 1024 * 1024
+)
+
+// Config is read from the "standalone" section of the config.
+type Config struct {
+	DataDir string `mapstructure:"data-dir"`
+}
+
+var (
+	enabled = sync.OnceValue(func() bool {
+		_, err := os.Stat(filepath.Join(ConfigDir, goconfig.ConfigFileName))
+		return err == nil
+	})
+
+	events = sync.OnceValue(func() *eventLog {
+		c, err := LoadConfig()
+		if err != nil {
+			c = Config{DataDir: DefaultDataDir}
+		}
+		return &eventLog{file: filepath.Join(c.DataDir, EventsFileName), maxSize: maxEventsFileSize}
+	})
+)
+
+// Enabled returns true when running as a standalone datalogger.
+func Enabled() bool {
+	return enabled()
+}
+
+// ConfigDirOr returns ConfigDir when running standalone, otherwise the dir.
+func ConfigDirOr(dir string) string {
+	if Enabled() {
+		return ConfigDir
+	}
+	return dir
+}
+
+// LoadConfig reads the standalone config from ConfigDir.
+func LoadConfig() (Config, error) {
+	c := Config{DataDir: DefaultDataDir}
+	conf, err := goconfig.New(ConfigDir)
+	if err != nil {
+		return c, err
+	}
+	if err := conf.Unmarshal(ConfigKey, &c); err != nil {
+		return Config{DataDir: DefaultDataDir}, err
+	}
+	if c.DataDir == "" {
+		c.DataDir = DefaultDataDir
+	}
+	return c, nil
+}
+
+// WriteEvent appends the event to the events file in the data dir.
+func WriteEvent(event eventclient.Event) error {
+	return events().write(event)
+}
+
+// eventLog is a file of events, one JSON object per line.
+type eventLog struct {
+	file    string
+	maxSize int64
+
+	mu sync.Mutex
+}
+
+func (l *eventLog) write(event eventclient.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.file), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(l.file); err == nil && info.Size()+int64(len(data)) >= l.maxSize {
+		if err := os.Rename(l.file, l.file+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
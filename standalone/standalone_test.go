@@ -0,0 +1,38 @@
+package standalone
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLog(t *testing.T) {
+	file := t.TempDir() + "/data/events.jsonl"
+	l := &eventLog{file: file, maxSize: 200}
+	now := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, l.write(eventclient.Event{Timestamp: now, Type: "rpiBattery", Details: map[string]interface{}{"battery": 80}}))
+	assert.NoError(t, l.write(eventclient.Event{Timestamp: now, Type: "tempHumidity"}))
+
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	e := eventclient.Event{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, "rpiBattery", e.Type)
+	assert.Equal(t, float64(80), e.Details["battery"])
+
+	// The file is moved aside once it is too big.
+	assert.NoError(t, l.write(eventclient.Event{Timestamp: now, Type: "rtcNtpDrift"}))
+	_, err = os.Stat(file + ".1")
+	assert.NoError(t, err)
+	data, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "rtcNtpDrift")
+	assert.NotContains(t, string(data), "rpiBattery")
+}
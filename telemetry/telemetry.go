@@ -0,0 +1,324 @@
+// Package telemetry encodes hat telemetry into a small binary bundle for sending over
+// constrained links such as satellite or LoRa, and decodes it again on the server.
+//
+// Readings are averaged into fixed time buckets and each channel is quantised to its
+// resolution, then stored as zigzag varint deltas from the previous bucket so slowly
+// changing values take about a byte each. Buckets without readings are marked in a bitmap.
+// The body is compressed with deflate and followed by a CRC32 of the uncompressed body:
+//
+//	"HT" version(1)
+//	deflate(
+//	    start (uvarint unix seconds) interval (uvarint seconds) buckets (uvarint)
+//	    state flags (1) battery percent (1) link failure per mille (uvarint)
+//	    channel count (1)
+//	    for each channel: id (1) presence bitmap (buckets/8 rounded up) deltas (zigzag varints)
+//	)
+//	crc32 (4, big endian)
+package telemetry
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	Version = 1
+	magic   = "HT"
+)
+
+// Channel is a telemetry value that is recorded over time.
+type Channel uint8
+
+const (
+	Temperature Channel = iota + 1
+	Humidity
+	HVBattery
+	LVBattery
+	RTCBattery
+)
+
+// resolutions is the step each channel is quantised to.
+var resolutions = map[Channel]float64{
+	Temperature: 0.1,  // °C
+	Humidity:    1,    // %
+	HVBattery:   0.01, // V
+	LVBattery:   0.01, // V
+	RTCBattery:  0.01, // V
+}
+
+var channelNames = map[Channel]string{
+	Temperature: "temperature",
+	Humidity:    "humidity",
+	HVBattery:   "hvBattery",
+	LVBattery:   "lvBattery",
+	RTCBattery:  "rtcBattery",
+}
+
+func (c Channel) String() string {
+	if name, ok := channelNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("channel%d", c)
+}
+
+// Resolution returns the step the channel is quantised to.
+func (c Channel) Resolution() float64 {
+	return resolutions[c]
+}
+
+var errBadBundle = errors.New("invalid telemetry bundle")
+
+// State is a snapshot of the hat at the time the bundle was made.
+type State struct {
+	ATtinyPresent bool
+	// Battery charge percentage, 0-100.
+	BatteryPercent uint8
+	// Failed I2C transactions with the ATtiny, in tenths of a percent.
+	LinkFailurePerMille uint16
+}
+
+// Bundle is the telemetry for a period, split into buckets of Interval from Start.
+type Bundle struct {
+	Start    time.Time
+	Interval time.Duration
+	State    State
+	// Average value for each bucket, NaN if there were no readings in the bucket.
+	Series map[Channel][]float64
+
+	buckets int
+	sums    map[Channel][]float64
+	counts  map[Channel][]int
+}
+
+// New makes an empty bundle for the period. Start is truncated to a second.
+func New(start time.Time, interval time.Duration, buckets int) *Bundle {
+	return &Bundle{
+		Start:    start.Truncate(time.Second),
+		Interval: interval,
+		Series:   map[Channel][]float64{},
+		buckets:  buckets,
+		sums:     map[Channel][]float64{},
+		counts:   map[Channel][]int{},
+	}
+}
+
+// Buckets returns the number of buckets in the bundle.
+func (b *Bundle) Buckets() int {
+	return b.buckets
+}
+
+// End returns the end of the bundle period.
+func (b *Bundle) End() time.Time {
+	return b.Start.Add(time.Duration(b.buckets) * b.Interval)
+}
+
+// Add adds a reading to the bucket it falls in. Returns false if it is outside the bundle
+// period or the channel is unknown.
+func (b *Bundle) Add(c Channel, t time.Time, value float64) bool {
+	if _, ok := resolutions[c]; !ok || math.IsNaN(value) || t.Before(b.Start) || b.Interval <= 0 {
+		return false
+	}
+	i := int(t.Sub(b.Start) / b.Interval)
+	if i >= b.buckets {
+		return false
+	}
+	if _, ok := b.sums[c]; !ok {
+		b.sums[c] = make([]float64, b.buckets)
+		b.counts[c] = make([]int, b.buckets)
+		b.Series[c] = make([]float64, b.buckets)
+		for j := range b.Series[c] {
+			b.Series[c][j] = math.NaN()
+		}
+	}
+	b.sums[c][i] += value
+	b.counts[c][i]++
+	b.Series[c][i] = b.sums[c][i] / float64(b.counts[c][i])
+	return true
+}
+
+// Encode returns the compressed binary form of the bundle.
+func Encode(b *Bundle) ([]byte, error) {
+	buckets := b.Buckets()
+	body := &bytes.Buffer{}
+	putUvarint(body, uint64(b.Start.Unix()))
+	putUvarint(body, uint64(b.Interval/time.Second))
+	putUvarint(body, uint64(buckets))
+
+	flags := byte(0)
+	if b.State.ATtinyPresent {
+		flags |= 1
+	}
+	body.WriteByte(flags)
+	body.WriteByte(min(b.State.BatteryPercent, 100))
+	putUvarint(body, uint64(b.State.LinkFailurePerMille))
+
+	channels := []Channel{}
+	for c := range b.Series {
+		if _, ok := resolutions[c]; !ok {
+			return nil, fmt.Errorf("unknown channel %d", c)
+		}
+		channels = append(channels, c)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i] < channels[j] })
+	body.WriteByte(byte(len(channels)))
+	for _, c := range channels {
+		body.WriteByte(byte(c))
+		values := b.Series[c]
+		bitmap := make([]byte, (buckets+7)/8)
+		for i := 0; i < buckets; i++ {
+			if i < len(values) && !math.IsNaN(values[i]) {
+				bitmap[i/8] |= 1 << (i % 8)
+			}
+		}
+		body.Write(bitmap)
+		previous := int64(0)
+		for i := 0; i < buckets; i++ {
+			if bitmap[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			q := int64(math.Round(values[i] / c.Resolution()))
+			putVarint(body, q-previous)
+			previous = q
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(magic)
+	out.WriteByte(Version)
+	w, err := flate.NewWriter(out, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(body.Bytes()))
+	out.Write(crc)
+	return out.Bytes(), nil
+}
+
+// Decode decodes a bundle made by Encode.
+func Decode(data []byte) (*Bundle, error) {
+	if len(data) < len(magic)+1+4 || string(data[:len(magic)]) != magic {
+		return nil, errBadBundle
+	}
+	if data[len(magic)] != Version {
+		return nil, fmt.Errorf("unsupported telemetry bundle version %d", data[len(magic)])
+	}
+	compressed := data[len(magic)+1 : len(data)-4]
+	body, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadBundle, err)
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("%w: CRC mismatch", errBadBundle)
+	}
+
+	r := bytes.NewReader(body)
+	start, err1 := binary.ReadUvarint(r)
+	interval, err2 := binary.ReadUvarint(r)
+	buckets, err3 := binary.ReadUvarint(r)
+	flags, err4 := r.ReadByte()
+	percent, err5 := r.ReadByte()
+	linkFailure, err6 := binary.ReadUvarint(r)
+	channelCount, err7 := r.ReadByte()
+	if err := errors.Join(err1, err2, err3, err4, err5, err6, err7); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadBundle, err)
+	}
+	if buckets > 1<<16 {
+		return nil, fmt.Errorf("%w: too many buckets", errBadBundle)
+	}
+	b := New(time.Unix(int64(start), 0).UTC(), time.Duration(interval)*time.Second, int(buckets))
+	b.State = State{
+		ATtinyPresent:       flags&1 != 0,
+		BatteryPercent:      percent,
+		LinkFailurePerMille: uint16(linkFailure),
+	}
+	for i := 0; i < int(channelCount); i++ {
+		id, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadBundle, err)
+		}
+		c := Channel(id)
+		if _, ok := resolutions[c]; !ok {
+			return nil, fmt.Errorf("%w: unknown channel %d", errBadBundle, id)
+		}
+		bitmap := make([]byte, (buckets+7)/8)
+		if _, err := io.ReadFull(r, bitmap); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadBundle, err)
+		}
+		values := make([]float64, buckets)
+		q := int64(0)
+		for j := range values {
+			values[j] = math.NaN()
+			if bitmap[j/8]&(1<<(j%8)) == 0 {
+				continue
+			}
+			delta, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errBadBundle, err)
+			}
+			q += delta
+			values[j] = float64(q) * c.Resolution()
+		}
+		b.Series[c] = values
+	}
+	return b, nil
+}
+
+type jsonState struct {
+	ATtinyPresent       bool   `json:"attinyPresent"`
+	BatteryPercent      uint8  `json:"batteryPercent"`
+	LinkFailurePerMille uint16 `json:"linkFailurePerMille"`
+}
+
+type jsonBundle struct {
+	Start           time.Time             `json:"start"`
+	IntervalSeconds int64                 `json:"intervalSeconds"`
+	State           jsonState             `json:"state"`
+	Series          map[string][]*float64 `json:"series"`
+}
+
+// MarshalJSON gives the bundle with the channels by name and null for empty buckets.
+func (b *Bundle) MarshalJSON() ([]byte, error) {
+	j := jsonBundle{
+		Start:           b.Start,
+		IntervalSeconds: int64(b.Interval / time.Second),
+		State:           jsonState(b.State),
+		Series:          map[string][]*float64{},
+	}
+	for c, values := range b.Series {
+		series := make([]*float64, len(values))
+		for i, v := range values {
+			if !math.IsNaN(v) {
+				rounded := math.Round(v/c.Resolution()) * c.Resolution()
+				series[i] = &rounded
+			}
+		}
+		j.Series[c.String()] = series
+	}
+	return json.Marshal(j)
+}
+
+func putUvarint(w *bytes.Buffer, v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutUvarint(buf, v)])
+}
+
+func putVarint(w *bytes.Buffer, v int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutVarint(buf, v)])
+}
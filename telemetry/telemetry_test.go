@@ -0,0 +1,103 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+func dayBundle() *Bundle {
+	b := New(start, time.Hour, 24)
+	b.State = State{ATtinyPresent: true, BatteryPercent: 76, LinkFailurePerMille: 12}
+	for m := 0; m < 24*60; m += 10 {
+		t := start.Add(time.Duration(m) * time.Minute)
+		hour := float64(m) / 60
+		b.Add(Temperature, t, 12+6*math.Sin(hour/24*2*math.Pi))
+		b.Add(Humidity, t, 70-10*math.Sin(hour/24*2*math.Pi))
+		b.Add(HVBattery, t, 24.8-hour*0.01)
+		b.Add(LVBattery, t, 0)
+		b.Add(RTCBattery, t, 3.01)
+	}
+	return b
+}
+
+func TestAddAverages(t *testing.T) {
+	b := New(start, time.Hour, 2)
+	assert.True(t, b.Add(Temperature, start, 10))
+	assert.True(t, b.Add(Temperature, start.Add(30*time.Minute), 20))
+	assert.False(t, b.Add(Temperature, start.Add(-time.Second), 20))
+	assert.False(t, b.Add(Temperature, start.Add(2*time.Hour), 20))
+	assert.False(t, b.Add(Channel(99), start, 20))
+
+	assert.Equal(t, 15.0, b.Series[Temperature][0])
+	assert.True(t, math.IsNaN(b.Series[Temperature][1]))
+	assert.Equal(t, start.Add(2*time.Hour), b.End())
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := dayBundle()
+	// Leave a gap in the temperature readings.
+	b.Series[Temperature][5] = math.NaN()
+
+	data, err := Encode(b)
+	assert.NoError(t, err)
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, b.Start, decoded.Start)
+	assert.Equal(t, b.Interval, decoded.Interval)
+	assert.Equal(t, b.Buckets(), decoded.Buckets())
+	assert.Equal(t, b.State, decoded.State)
+	assert.Len(t, decoded.Series, len(b.Series))
+	for c, values := range b.Series {
+		for i, v := range values {
+			got := decoded.Series[c][i]
+			if math.IsNaN(v) {
+				assert.True(t, math.IsNaN(got), "%s bucket %d", c, i)
+				continue
+			}
+			assert.InDelta(t, v, got, c.Resolution()/2+1e-9, "%s bucket %d", c, i)
+		}
+	}
+}
+
+func TestDayBundleIsSmall(t *testing.T) {
+	data, err := Encode(dayBundle())
+	assert.NoError(t, err)
+	assert.Less(t, len(data), 300)
+}
+
+func TestDecodeRejectsBadData(t *testing.T) {
+	data, err := Encode(dayBundle())
+	assert.NoError(t, err)
+
+	_, err = Decode(data[:5])
+	assert.Error(t, err)
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+	_, err = Decode(corrupt)
+	assert.ErrorIs(t, err, errBadBundle)
+
+	wrongVersion := append([]byte{}, data...)
+	wrongVersion[2] = Version + 1
+	_, err = Decode(wrongVersion)
+	assert.Error(t, err)
+}
+
+func TestMarshalJSON(t *testing.T) {
+	b := New(start, time.Hour, 2)
+	b.Add(Temperature, start, 12.34)
+	out, err := json.Marshal(b)
+	assert.NoError(t, err)
+	var got map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out, &got))
+	assert.Equal(t, "2026-10-01T00:00:00Z", got["start"])
+	assert.Equal(t, 3600.0, got["intervalSeconds"])
+	assert.Equal(t, map[string]interface{}{"temperature": []interface{}{12.3, nil}}, got["series"])
+}
@@ -0,0 +1,272 @@
+// Package timeline merges the histories saved by the hat services, the temperature and battery
+// CSV files and the events file of a standalone datalogger, into one timeline ordered by time.
+//
+// Each line is timestamped with the system clock when it is written, so when the clock is
+// stepped, say by NTP after booting with a flat RTC, the lines before and after the step are
+// in different epochs and can't be ordered by their timestamps. tc2-hat-rtc records each step
+// it detects in clock-steps.csv, with the time just after the step and how far the clock moved:
+//
+//	2026-06-01T09:12:44+12:00, 78643200.000
+//
+// The lines of a file are in the order they were written, so a step shows up as the time
+// jumping between two lines by about the step offset. The lines before a step found like this
+// are moved by the offsets of all the steps after them, putting the whole timeline in the
+// epoch of the last step. Steps that aren't found in a file aren't applied to it.
+package timeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/tc2-hat-controller/batterycsv"
+	"github.com/TheCacophonyProject/tc2-hat-controller/csvtime"
+)
+
+// ClockStepsFile is where tc2-hat-rtc records the clock steps.
+const ClockStepsFile = "/var/log/clock-steps.csv"
+
+// DefaultTolerance is how far a jump between two lines can be from a step offset, and the
+// line after it from the step time, for the jump to be taken as the step. It needs to be
+// longer than the time between the readings.
+const DefaultTolerance = time.Hour
+
+// ClockStep is the system clock being moved by Offset, Time is just after the step.
+type ClockStep struct {
+	Time   time.Time
+	Offset time.Duration
+}
+
+// String formats the step as a line of the clock steps file.
+func (s ClockStep) String() string {
+	return fmt.Sprintf("%s, %.3f", csvtime.Format(s.Time, false), s.Offset.Seconds())
+}
+
+// ParseClockStep parses a line of the clock steps file.
+func ParseClockStep(line string) (ClockStep, error) {
+	t, offset, ok := strings.Cut(line, ",")
+	if !ok {
+		return ClockStep{}, fmt.Errorf("expected 2 fields in '%s'", line)
+	}
+	stepTime, err := csvtime.Parse(t)
+	if err != nil {
+		return ClockStep{}, err
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(offset), 64)
+	if err != nil {
+		return ClockStep{}, fmt.Errorf("invalid offset: %v", err)
+	}
+	return ClockStep{Time: stepTime, Offset: time.Duration(seconds * float64(time.Second))}, nil
+}
+
+// ReadClockSteps reads a clock steps file, skipping lines that can't be parsed. Returns the
+// steps and the number of lines skipped.
+func ReadClockSteps(r io.Reader) ([]ClockStep, int, error) {
+	steps := []ClockStep{}
+	bad := 0
+	err := eachLine(r, func(line string) {
+		s, err := ParseClockStep(line)
+		if err != nil {
+			bad++
+			return
+		}
+		steps = append(steps, s)
+	})
+	return steps, bad, err
+}
+
+// Entry is a line from one of the histories.
+type Entry struct {
+	Time     time.Time // Corrected for the clock steps.
+	Recorded time.Time // As written in the file.
+	Source   string
+	Kind     string // The event type, or "reading" for CSV lines.
+	Values   map[string]string
+}
+
+// ReadCSV reads a CSV file with the time in the first column, the other columns are named by
+// columns, with ones past the end named by their position. Lines that can't be parsed are
+// skipped. Returns the entries in file order and the number of lines skipped.
+func ReadCSV(r io.Reader, source string, columns []string) ([]Entry, int, error) {
+	entries := []Entry{}
+	bad := 0
+	err := eachLine(r, func(line string) {
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "time") {
+			return
+		}
+		fields := strings.Split(line, ",")
+		t, err := csvtime.Parse(fields[0])
+		if err != nil {
+			bad++
+			return
+		}
+		values := map[string]string{}
+		for i, f := range fields[1:] {
+			name := fmt.Sprintf("column%d", i+2)
+			if i < len(columns) {
+				name = columns[i]
+			}
+			values[name] = strings.TrimSpace(f)
+		}
+		entries = append(entries, Entry{Time: t, Recorded: t, Source: source, Kind: "reading", Values: values})
+	})
+	return entries, bad, err
+}
+
+// ReadBatteryCSV reads battery-readings.csv, in any of its layouts.
+func ReadBatteryCSV(r io.Reader, source string) ([]Entry, int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, bad := batterycsv.Read(data)
+	entries := make([]Entry, len(rows))
+	for i, row := range rows {
+		entries[i] = Entry{
+			Time:     row.Time,
+			Recorded: row.Time,
+			Source:   source,
+			Kind:     "reading",
+			Values: map[string]string{
+				"hv":    fmt.Sprintf("%.2f", row.HV),
+				"lv":    fmt.Sprintf("%.2f", row.LV),
+				"rtc":   fmt.Sprintf("%.2f", row.RTC),
+				"flags": strconv.Itoa(row.Flags),
+			},
+		}
+	}
+	return entries, bad, nil
+}
+
+// ReadEvents reads an events file with an event as a JSON object on each line.
+func ReadEvents(r io.Reader, source string) ([]Entry, int, error) {
+	entries := []Entry{}
+	bad := 0
+	err := eachLine(r, func(line string) {
+		event := eventclient.Event{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil || event.Timestamp.IsZero() {
+			bad++
+			return
+		}
+		values := map[string]string{}
+		for k, v := range event.Details {
+			if s, ok := v.(string); ok {
+				values[k] = s
+			} else if data, err := json.Marshal(v); err == nil {
+				values[k] = string(data)
+			}
+		}
+		entries = append(entries, Entry{Time: event.Timestamp, Recorded: event.Timestamp, Source: source, Kind: event.Type, Values: values})
+	})
+	return entries, bad, err
+}
+
+func eachLine(r io.Reader, f func(line string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			f(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// Correct moves the entries of a source, in file order, to the epoch after the last step.
+// Returns the number of steps found in the entries.
+func Correct(entries []Entry, steps []ClockStep, tolerance time.Duration) int {
+	// boundaries[i] is the index of the first entry after step i, 0 if it wasn't found.
+	boundaries := make([]int, len(steps))
+	used := map[int]bool{}
+	for i, s := range steps {
+		best, bestErr := 0, tolerance
+		for j := 1; j < len(entries); j++ {
+			if used[j] || absDuration(entries[j].Recorded.Sub(s.Time)) > tolerance {
+				continue
+			}
+			jump := entries[j].Recorded.Sub(entries[j-1].Recorded)
+			if e := absDuration(jump - s.Offset); e <= bestErr {
+				best, bestErr = j, e
+			}
+		}
+		if best > 0 {
+			boundaries[i] = best
+			used[best] = true
+		}
+	}
+	found := 0
+	for _, b := range boundaries {
+		if b > 0 {
+			found++
+		}
+	}
+	for j := range entries {
+		var correction time.Duration
+		for i, b := range boundaries {
+			if b > j {
+				correction += steps[i].Offset
+			}
+		}
+		entries[j].Time = entries[j].Recorded.Add(correction)
+	}
+	return found
+}
+
+// Merge returns the entries of all the sources ordered by their corrected time. Entries with
+// the same time keep the order of their sources.
+func Merge(sources ...[]Entry) []Entry {
+	merged := []Entry{}
+	for _, s := range sources {
+		merged = append(merged, s...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Time.Before(merged[j].Time)
+	})
+	return merged
+}
+
+// WriteCSV writes the timeline with a line for each value, which is easy to pivot for
+// analysis: time, recorded, source, kind, field, value. Entries without values have a line
+// with an empty field.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "time,recorded,source,kind,field,value")
+	for _, e := range entries {
+		prefix := fmt.Sprintf("%s,%s,%s,%s", e.Time.Format(time.RFC3339), e.Recorded.Format(time.RFC3339), csvField(e.Source), csvField(e.Kind))
+		if len(e.Values) == 0 {
+			fmt.Fprintf(bw, "%s,,\n", prefix)
+			continue
+		}
+		fields := make([]string, 0, len(e.Values))
+		for k := range e.Values {
+			fields = append(fields, k)
+		}
+		slices.Sort(fields)
+		for _, k := range fields {
+			fmt.Fprintf(bw, "%s,%s,%s\n", prefix, csvField(k), csvField(e.Values[k]))
+		}
+	}
+	return bw.Flush()
+}
+
+// csvField quotes the field if it has a comma, quote or newline in it.
+func csvField(s string) string {
+	if !strings.ContainsAny(s, ",\"\n") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
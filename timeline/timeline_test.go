@@ -0,0 +1,81 @@
+package timeline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockStep(t *testing.T) {
+	s := ClockStep{Time: time.Date(2026, 6, 1, 9, 12, 44, 0, time.UTC), Offset: 910 * 24 * time.Hour}
+	line := s.String()
+	assert.Equal(t, "2026-06-01T09:12:44Z, 78624000.000", line)
+	parsed, err := ParseClockStep(line)
+	assert.NoError(t, err)
+	assert.True(t, s.Time.Equal(parsed.Time))
+	assert.Equal(t, s.Offset, parsed.Offset)
+
+	steps, bad, err := ReadClockSteps(strings.NewReader(line + "\nnot a step\n2026-06-01T10:00:00Z, -2.5\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bad)
+	assert.Len(t, steps, 2)
+	assert.Equal(t, -2500*time.Millisecond, steps[1].Offset)
+}
+
+func TestCorrectAndMerge(t *testing.T) {
+	// Booted with the RTC a day behind, then NTP stepped the clock forward.
+	step := ClockStep{Time: time.Date(2026, 6, 2, 10, 0, 30, 0, time.UTC), Offset: 24 * time.Hour}
+	temperature, bad, err := ReadCSV(strings.NewReader(`2026-06-01T09:50:00Z, 10.50, 80.00
+2026-06-01T10:00:00Z, 10.75, 79.00
+garbage
+2026-06-02T10:10:00Z, 11.00, 78.00, 1
+`), "temperature", []string{"temp", "humidity"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bad)
+	assert.Equal(t, "1", temperature[2].Values["column4"])
+	battery, _, err := ReadBatteryCSV(strings.NewReader(`# battery-readings schema 2: time, hv, lv, rtc, flags
+2026-06-01T09:55:00Z, 24.10, 0.00, 3.10, 0
+2026-06-02T10:05:00Z, 24.00, 0.00, 3.10, 0
+`), "battery")
+	assert.NoError(t, err)
+	events, _, err := ReadEvents(strings.NewReader(`{"Timestamp":"2026-06-02T10:01:00Z","Type":"rpiBattery","Details":{"battery":80,"batteryType":"lifepo4"}}
+`), "events")
+	assert.NoError(t, err)
+	assert.Equal(t, "80", events[0].Values["battery"])
+	assert.Equal(t, "lifepo4", events[0].Values["batteryType"])
+
+	assert.Equal(t, 1, Correct(temperature, []ClockStep{step}, DefaultTolerance))
+	assert.Equal(t, 1, Correct(battery, []ClockStep{step}, DefaultTolerance))
+	assert.Equal(t, 0, Correct(events, []ClockStep{step}, DefaultTolerance))
+	assert.Equal(t, time.Date(2026, 6, 2, 9, 50, 0, 0, time.UTC), temperature[0].Time)
+	assert.Equal(t, time.Date(2026, 6, 1, 9, 50, 0, 0, time.UTC), temperature[0].Recorded)
+	assert.Equal(t, time.Date(2026, 6, 2, 10, 10, 0, 0, time.UTC), temperature[2].Time)
+
+	merged := Merge(temperature, battery, events)
+	order := []string{}
+	for _, e := range merged {
+		order = append(order, e.Source+" "+e.Time.Format("15:04"))
+	}
+	assert.Equal(t, []string{
+		"temperature 09:50",
+		"battery 09:55",
+		"temperature 10:00",
+		"events 10:01",
+		"battery 10:05",
+		"temperature 10:10",
+	}, order)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, WriteCSV(out, merged[:2]))
+	assert.Equal(t, `time,recorded,source,kind,field,value
+2026-06-02T09:50:00Z,2026-06-01T09:50:00Z,temperature,reading,humidity,80.00
+2026-06-02T09:50:00Z,2026-06-01T09:50:00Z,temperature,reading,temp,10.50
+2026-06-02T09:55:00Z,2026-06-01T09:55:00Z,battery,reading,flags,0
+2026-06-02T09:55:00Z,2026-06-01T09:55:00Z,battery,reading,hv,24.10
+2026-06-02T09:55:00Z,2026-06-01T09:55:00Z,battery,reading,lv,0.00
+2026-06-02T09:55:00Z,2026-06-01T09:55:00Z,battery,reading,rtc,3.10
+`, out.String())
+}